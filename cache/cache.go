@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"io"
 	"sync/atomic"
 	"time"
 
@@ -24,10 +25,24 @@ type BytesCache interface {
 	Set(k string, v []byte, expire int32)
 }
 
+// Deleter is implemented by caches, that can delete entries
+type Deleter interface {
+	Delete(k string) error
+}
+
+// Close releases resources of the cache (connections, background goroutines), if it implements io.Closer
+func Close(c BytesCache) error {
+	if closer, ok := c.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
 type NullCache struct{}
 
 func (NullCache) Get(string) ([]byte, error) { return nil, ErrNotFound }
 func (NullCache) Set(string, []byte, int32)  {}
+func (NullCache) Delete(string) error        { return nil }
 
 func NewExpireCache(maxsize uint64) BytesCache {
 	ec := expirecache.New(maxsize)
@@ -53,18 +68,47 @@ func (ec ExpireCache) Set(k string, v []byte, expire int32) {
 	ec.ec.Set(k, v, uint64(len(v)), expire)
 }
 
+// Delete replaces value with an expired one, it's removed by the cleaner later
+func (ec ExpireCache) Delete(k string) error {
+	ec.ec.Set(k, []byte(nil), 0, -1)
+	return nil
+}
+
 func (ec ExpireCache) Items() int { return ec.ec.Items() }
 
 func (ec ExpireCache) Size() uint64 { return ec.ec.Size() }
 
+const (
+	// DefaultMemcachedGetTimeout is a time to wait for a value from memcached, slower responses are counted as misses
+	DefaultMemcachedGetTimeout = 50 * time.Millisecond
+)
+
 func NewMemcached(prefix string, servers ...string) BytesCache {
-	return &MemcachedCache{prefix: prefix, client: memcache.New(servers...)}
+	return NewMemcachedWithTimeouts(prefix, 0, 0, servers...)
+}
+
+// NewMemcachedWithTimeouts creates memcached cache with the given timeouts, zero timeout means default one.
+// Values are written asynchronously, so setTimeout only limits time of the background write.
+func NewMemcachedWithTimeouts(prefix string, getTimeout, setTimeout time.Duration, servers ...string) BytesCache {
+	if getTimeout <= 0 {
+		getTimeout = DefaultMemcachedGetTimeout
+	}
+	if setTimeout <= 0 {
+		setTimeout = memcache.DefaultTimeout
+	}
+	client := memcache.New(servers...)
+	client.Timeout = getTimeout
+	setClient := memcache.New(servers...)
+	setClient.Timeout = setTimeout
+	return &MemcachedCache{prefix: prefix, client: client, setClient: setClient, getTimeout: getTimeout}
 }
 
 type MemcachedCache struct {
-	prefix   string
-	client   *memcache.Client
-	timeouts uint64
+	prefix     string
+	client     *memcache.Client
+	setClient  *memcache.Client
+	getTimeout time.Duration
+	timeouts   uint64
 }
 
 func (m *MemcachedCache) Get(k string) ([]byte, error) {
@@ -80,10 +124,11 @@ func (m *MemcachedCache) Get(k string) ([]byte, error) {
 		done <- true
 	}()
 
-	timeout := time.After(50 * time.Millisecond)
+	timeout := time.NewTimer(m.getTimeout)
+	defer timeout.Stop()
 
 	select {
-	case <-timeout:
+	case <-timeout.C:
 		atomic.AddUint64(&m.timeouts, 1)
 		return nil, ErrTimeout
 	case <-done:
@@ -104,10 +149,112 @@ func (m *MemcachedCache) Set(k string, v []byte, expire int32) {
 	key := sha256.Sum256([]byte(k))
 	hk := hex.EncodeToString(key[:])
 	go func() {
-		_ = m.client.Set(&memcache.Item{Key: m.prefix + hk, Value: v, Expiration: expire})
+		_ = m.setClient.Set(&memcache.Item{Key: m.prefix + hk, Value: v, Expiration: expire})
 	}()
 }
 
+func (m *MemcachedCache) Delete(k string) error {
+	key := sha256.Sum256([]byte(k))
+	hk := hex.EncodeToString(key[:])
+	err := m.setClient.Delete(m.prefix + hk)
+	if err != nil && !merry.Is(err, memcache.ErrCacheMiss) {
+		return err
+	}
+	return nil
+}
+
 func (m *MemcachedCache) Timeouts() uint64 {
 	return atomic.LoadUint64(&m.timeouts)
 }
+
+// NewTwoTier creates cache with in-process L1 in front of a shared L2.
+// Values are kept in L1 no longer than l1Expire seconds, values found in L2 are promoted to L1 with this expiration.
+func NewTwoTier(l1, l2 BytesCache, l1Expire int32) *TwoTierCache {
+	return &TwoTierCache{l1: l1, l2: l2, l1Expire: l1Expire}
+}
+
+type TwoTierCache struct {
+	l1       BytesCache
+	l2       BytesCache
+	l1Expire int32
+
+	l1Hits   uint64
+	l1Misses uint64
+	l2Hits   uint64
+	l2Misses uint64
+}
+
+// TwoTierStats contains hits and misses of each tier. L2 is checked only on L1 miss.
+type TwoTierStats struct {
+	L1Hits   uint64
+	L1Misses uint64
+	L2Hits   uint64
+	L2Misses uint64
+}
+
+func (t *TwoTierCache) Get(k string) ([]byte, error) {
+	v, err := t.l1.Get(k)
+	if err == nil {
+		atomic.AddUint64(&t.l1Hits, 1)
+		return v, nil
+	}
+	atomic.AddUint64(&t.l1Misses, 1)
+
+	v, err = t.l2.Get(k)
+	if err != nil {
+		atomic.AddUint64(&t.l2Misses, 1)
+		return nil, err
+	}
+	atomic.AddUint64(&t.l2Hits, 1)
+	t.l1.Set(k, v, t.l1Expire)
+
+	return v, nil
+}
+
+func (t *TwoTierCache) Set(k string, v []byte, expire int32) {
+	l1Expire := expire
+	if l1Expire <= 0 || l1Expire > t.l1Expire {
+		l1Expire = t.l1Expire
+	}
+	t.l1.Set(k, v, l1Expire)
+	t.l2.Set(k, v, expire)
+}
+
+// Delete removes value from both tiers
+func (t *TwoTierCache) Delete(k string) error {
+	if d, ok := t.l1.(Deleter); ok {
+		_ = d.Delete(k)
+	}
+	if d, ok := t.l2.(Deleter); ok {
+		return d.Delete(k)
+	}
+	return nil
+}
+
+// Close closes both tiers
+func (t *TwoTierCache) Close() error {
+	err := Close(t.l1)
+	if err2 := Close(t.l2); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// L1 returns in-process tier of the cache
+func (t *TwoTierCache) L1() BytesCache {
+	return t.l1
+}
+
+// L2 returns shared tier of the cache
+func (t *TwoTierCache) L2() BytesCache {
+	return t.l2
+}
+
+func (t *TwoTierCache) Stats() TwoTierStats {
+	return TwoTierStats{
+		L1Hits:   atomic.LoadUint64(&t.l1Hits),
+		L1Misses: atomic.LoadUint64(&t.l1Misses),
+		L2Hits:   atomic.LoadUint64(&t.l2Hits),
+		L2Misses: atomic.LoadUint64(&t.l2Misses),
+	}
+}
@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"testing"
+)
+
+func TestTwoTierCache(t *testing.T) {
+	l1 := NewExpireCache(1024 * 1024)
+	l2 := NewExpireCache(1024 * 1024)
+	c := NewTwoTier(l1, l2, 10)
+
+	if _, err := c.Get("foo"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// value written by another instance is found in L2 and promoted to L1
+	l2.Set("foo", []byte("bar"), 60)
+	v, err := c.Get("foo")
+	if err != nil || string(v) != "bar" {
+		t.Fatalf("unexpected value %q, error %v", v, err)
+	}
+	if v, err := l1.Get("foo"); err != nil || string(v) != "bar" {
+		t.Fatalf("value was not promoted to L1: %q, error %v", v, err)
+	}
+	v, err = c.Get("foo")
+	if err != nil || string(v) != "bar" {
+		t.Fatalf("unexpected value %q, error %v", v, err)
+	}
+
+	c.Set("baz", []byte("qux"), 60)
+	for _, tier := range []BytesCache{l1, l2} {
+		if v, err := tier.Get("baz"); err != nil || string(v) != "qux" {
+			t.Fatalf("value was not written to both tiers: %q, error %v", v, err)
+		}
+	}
+
+	expected := TwoTierStats{L1Hits: 1, L1Misses: 2, L2Hits: 1, L2Misses: 1}
+	if s := c.Stats(); s != expected {
+		t.Fatalf("unexpected stats %+v, expected %+v", s, expected)
+	}
+}
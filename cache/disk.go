@@ -0,0 +1,402 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	diskMagic   = "CAPD"
+	diskVersion = 1
+	// magic, version, expire at (unix time), key length, value length
+	diskHeaderSize = len(diskMagic) + 1 + 8 + 4 + 4
+	diskCRCSize    = 4
+
+	diskTmpSuffix = ".tmp"
+	// diskTmpMaxAge is an age of temporary file, after which it's considered to be left by interrupted write. Younger
+	// files can be written by another instance, e.g. the one, that is replaced on config reload.
+	diskTmpMaxAge = time.Hour
+)
+
+var errDiskEntryCorrupted = errors.New("cache: disk entry is corrupted")
+
+// DiskConfig contains settings of the disk cache
+type DiskConfig struct {
+	// Path is a directory for cache files
+	Path string `mapstructure:"path"`
+}
+
+// NewDisk creates cache, stored in files under the directory. Entries, that are already in the directory, are loaded,
+// so cache survives restarts. Entries are evicted in LRU order, when total size of files is above maxSize.
+func NewDisk(dir string, maxSize uint64) (*DiskCache, error) {
+	if dir == "" {
+		return nil, errors.New("cache: disk cache path is not set")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		stop:    make(chan struct{}),
+		now:     time.Now,
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	go c.cleaner(time.Minute)
+	return c, nil
+}
+
+// DiskCache keeps entries in files, named by hash of the key and unique suffix, so file of the entry is never
+// replaced or removed by writes of the same key. Entry files contain key, expiration time and checksum, so broken or
+// foreign files are treated as misses and removed.
+type DiskCache struct {
+	dir     string
+	maxSize uint64
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    uint64
+
+	corrupted uint64
+
+	stop      chan struct{}
+	closeOnce sync.Once
+
+	now func() time.Time
+}
+
+type diskEntry struct {
+	name string
+	// file is a name of the entry file, hash of the key with unique suffix
+	file     string
+	size     uint64
+	expireAt int64
+}
+
+func diskName(k string) string {
+	h := sha256.Sum256([]byte(k))
+	return hex.EncodeToString(h[:])
+}
+
+// diskFileName returns name of the entry, stored in the file, or false, if it's not a cache file
+func diskFileName(file string) (string, bool) {
+	const nameLen = sha256.Size * 2
+	if len(file) <= nameLen+1 || file[nameLen] != '-' {
+		return "", false
+	}
+	if _, err := hex.DecodeString(file[:nameLen]); err != nil {
+		return "", false
+	}
+	return file[:nameLen], true
+}
+
+func (c *DiskCache) path(file string) string {
+	return filepath.Join(c.dir, file[:2], file)
+}
+
+// load indexes entries, that are already in the directory, recently modified files are evicted last
+func (c *DiskCache) load() error {
+	type file struct {
+		diskEntry
+		modTime time.Time
+	}
+	var files []file
+	now := c.now().Unix()
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if strings.HasSuffix(path, diskTmpSuffix) {
+			if c.now().Sub(info.ModTime()) > diskTmpMaxAge {
+				// left by interrupted write
+				_ = os.Remove(path)
+			}
+			return nil
+		}
+		name, ok := diskFileName(d.Name())
+		if !ok || c.path(d.Name()) != path {
+			// not a cache file
+			return nil
+		}
+		expireAt, err := readDiskExpiration(path)
+		if err != nil || expireAt != 0 && expireAt <= now {
+			_ = os.Remove(path)
+			return nil
+		}
+		files = append(files, file{
+			diskEntry: diskEntry{name: name, file: d.Name(), size: uint64(info.Size()), expireAt: expireAt},
+			modTime:   info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+	var removed []string
+	c.mu.Lock()
+	for _, f := range files {
+		e := f.diskEntry
+		if _, ok := c.entries[e.name]; ok {
+			// older file of the same key, left by interrupted process
+			removed = append(removed, c.path(e.file))
+			continue
+		}
+		c.entries[e.name] = c.lru.PushBack(&e)
+		c.size += e.size
+	}
+	removed = append(removed, c.evict()...)
+	c.mu.Unlock()
+	removeFiles(removed)
+	return nil
+}
+
+func readDiskExpiration(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	header := make([]byte, diskHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, err
+	}
+	if string(header[:len(diskMagic)]) != diskMagic || header[len(diskMagic)] != diskVersion {
+		return 0, errDiskEntryCorrupted
+	}
+	return int64(binary.BigEndian.Uint64(header[len(diskMagic)+1:])), nil
+}
+
+func encodeDiskEntry(k string, v []byte, expireAt int64) []byte {
+	b := make([]byte, 0, diskHeaderSize+len(k)+len(v)+diskCRCSize)
+	b = append(b, diskMagic...)
+	b = append(b, diskVersion)
+	b = binary.BigEndian.AppendUint64(b, uint64(expireAt))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(k)))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+	b = append(b, k...)
+	b = append(b, v...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+func decodeDiskEntry(k string, b []byte) ([]byte, error) {
+	if len(b) < diskHeaderSize+diskCRCSize {
+		return nil, errDiskEntryCorrupted
+	}
+	data, sum := b[:len(b)-diskCRCSize], b[len(b)-diskCRCSize:]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(sum) {
+		return nil, errDiskEntryCorrupted
+	}
+	if string(data[:len(diskMagic)]) != diskMagic || data[len(diskMagic)] != diskVersion {
+		return nil, errDiskEntryCorrupted
+	}
+	keyLen := int(binary.BigEndian.Uint32(data[len(diskMagic)+9:]))
+	valueLen := int(binary.BigEndian.Uint32(data[len(diskMagic)+13:]))
+	if diskHeaderSize+keyLen+valueLen != len(data) || string(data[diskHeaderSize:diskHeaderSize+keyLen]) != k {
+		return nil, errDiskEntryCorrupted
+	}
+	return data[diskHeaderSize+keyLen:], nil
+}
+
+func (c *DiskCache) Get(k string) ([]byte, error) {
+	name := diskName(k)
+	c.mu.Lock()
+	el, ok := c.entries[name]
+	if !ok {
+		c.mu.Unlock()
+		return nil, ErrNotFound
+	}
+	e := el.Value.(*diskEntry)
+	if e.expireAt != 0 && e.expireAt <= c.now().Unix() {
+		path := c.remove(el)
+		c.mu.Unlock()
+		removeFiles([]string{path})
+		return nil, ErrNotFound
+	}
+	file := e.file
+	c.lru.MoveToFront(el)
+	c.mu.Unlock()
+
+	b, err := os.ReadFile(c.path(file))
+	if err == nil {
+		var v []byte
+		if v, err = decodeDiskEntry(k, b); err == nil {
+			return v, nil
+		}
+	}
+
+	c.mu.Lock()
+	el, ok = c.entries[name]
+	if !ok || el.Value.(*diskEntry).file != file {
+		// entry is replaced or removed, while file was read
+		c.mu.Unlock()
+		return nil, ErrNotFound
+	}
+	// entry is broken or removed from the disk by someone else
+	atomic.AddUint64(&c.corrupted, 1)
+	path := c.remove(el)
+	c.mu.Unlock()
+	removeFiles([]string{path})
+	return nil, ErrNotFound
+}
+
+// Set writes entry to a temporary file and renames it to a new unique name, so readers never see partially written
+// files and file of the entry, that is replaced or evicted concurrently, is removed without affecting the new one
+func (c *DiskCache) Set(k string, v []byte, expire int32) {
+	var expireAt int64
+	if expire > 0 {
+		expireAt = c.now().Unix() + int64(expire)
+	}
+	b := encodeDiskEntry(k, v, expireAt)
+	if c.maxSize > 0 && uint64(len(b)) > c.maxSize {
+		return
+	}
+
+	name := diskName(k)
+	dir := filepath.Dir(c.path(name))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(dir, name+"-*"+diskTmpSuffix)
+	if err != nil {
+		return
+	}
+	file := strings.TrimSuffix(filepath.Base(tmp.Name()), diskTmpSuffix)
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(file))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return
+	}
+
+	var removed []string
+	c.mu.Lock()
+	if el, ok := c.entries[name]; ok {
+		removed = append(removed, c.remove(el))
+	}
+	c.entries[name] = c.lru.PushFront(&diskEntry{name: name, file: file, size: uint64(len(b)), expireAt: expireAt})
+	c.size += uint64(len(b))
+	removed = append(removed, c.evict()...)
+	c.mu.Unlock()
+	removeFiles(removed)
+}
+
+func (c *DiskCache) Delete(k string) error {
+	c.mu.Lock()
+	el, ok := c.entries[diskName(k)]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	path := c.remove(el)
+	c.mu.Unlock()
+	removeFiles([]string{path})
+	return nil
+}
+
+// remove deletes entry and returns path of its file, that should be removed after the lock is released. Must be
+// called with lock held.
+func (c *DiskCache) remove(el *list.Element) string {
+	e := c.lru.Remove(el).(*diskEntry)
+	delete(c.entries, e.name)
+	c.size -= e.size
+	return c.path(e.file)
+}
+
+// evict removes least recently used entries, until cache fits its size, and returns paths of their files. Must be
+// called with lock held.
+func (c *DiskCache) evict() []string {
+	var removed []string
+	for c.maxSize > 0 && c.size > c.maxSize {
+		removed = append(removed, c.remove(c.lru.Back()))
+	}
+	return removed
+}
+
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		_ = os.Remove(path)
+	}
+}
+
+func (c *DiskCache) cleaner(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.clean()
+		}
+	}
+}
+
+// clean removes expired entries
+func (c *DiskCache) clean() {
+	now := c.now().Unix()
+	var removed []string
+	c.mu.Lock()
+	for el := c.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if e := el.Value.(*diskEntry); e.expireAt != 0 && e.expireAt <= now {
+			removed = append(removed, c.remove(el))
+		}
+		el = prev
+	}
+	c.mu.Unlock()
+	removeFiles(removed)
+}
+
+// Close stops the cleaner, entries are kept on the disk
+func (c *DiskCache) Close() error {
+	c.closeOnce.Do(func() { close(c.stop) })
+	return nil
+}
+
+// Items returns count of entries
+func (c *DiskCache) Items() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Size returns total size of entry files
+func (c *DiskCache) Size() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Corrupted returns count of entries, that were broken or missing on read
+func (c *DiskCache) Corrupted() uint64 {
+	return atomic.LoadUint64(&c.corrupted)
+}
@@ -0,0 +1,231 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// filePath returns path of the entry file
+func (c *DiskCache) filePath(k string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[diskName(k)]; ok {
+		return c.path(el.Value.(*diskEntry).file)
+	}
+	return ""
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDisk(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get("foo"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	c.Set("foo", []byte("bar"), 60)
+	c.Set("baz", []byte("qux"), 0)
+	v, err := c.Get("foo")
+	if err != nil || string(v) != "bar" {
+		t.Fatalf("unexpected value %q, error %v", v, err)
+	}
+
+	// entries survive restart
+	c, err = NewDisk(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Items() != 2 {
+		t.Fatalf("unexpected count of loaded entries: %d", c.Items())
+	}
+	for k, expected := range map[string]string{"foo": "bar", "baz": "qux"} {
+		v, err := c.Get(k)
+		if err != nil || string(v) != expected {
+			t.Fatalf("%s: unexpected value %q, error %v", k, v, err)
+		}
+	}
+
+	// expired entries are misses
+	now := time.Now().Add(time.Hour)
+	c.now = func() time.Time { return now }
+	if _, err := c.Get("foo"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound for expired entry, got %v", err)
+	}
+	if _, err := c.Get("baz"); err != nil {
+		t.Fatalf("entry without expiration is expired: %v", err)
+	}
+
+	path := c.filePath("baz")
+	c.Delete("baz")
+	if c.Items() != 0 || c.Size() != 0 {
+		t.Fatalf("cache is not empty: %d items, %d bytes", c.Items(), c.Size())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("file of deleted entry exists: %v", err)
+	}
+}
+
+func TestDiskCacheCorruption(t *testing.T) {
+	c, err := NewDisk(t.TempDir(), 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Set("foo", []byte("bar"), 60)
+	path := c.filePath("foo")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-5] ^= 0xff
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get("foo"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound for corrupted entry, got %v", err)
+	}
+	if c.Corrupted() != 1 || c.Items() != 0 {
+		t.Fatalf("unexpected state: %d corrupted, %d items", c.Corrupted(), c.Items())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("corrupted file is not removed: %v", err)
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	value := bytes.Repeat([]byte("a"), 1000)
+	entrySize := uint64(len(encodeDiskEntry("k1", value, 0)))
+	c, err := NewDisk(t.TempDir(), 3*entrySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Set("k1", value, 60)
+	c.Set("k2", value, 60)
+	c.Set("k3", value, 60)
+	// k1 becomes recently used, so k2 is evicted
+	if _, err := c.Get("k1"); err != nil {
+		t.Fatal(err)
+	}
+	c.Set("k4", value, 60)
+
+	if c.Items() != 3 || c.Size() != 3*entrySize {
+		t.Fatalf("unexpected state: %d items, %d bytes", c.Items(), c.Size())
+	}
+	if _, err := c.Get("k2"); err != ErrNotFound {
+		t.Fatalf("expected k2 to be evicted, got %v", err)
+	}
+	for _, k := range []string{"k1", "k3", "k4"} {
+		if _, err := c.Get(k); err != nil {
+			t.Fatalf("%s: %v", k, err)
+		}
+	}
+}
+
+func TestDiskCacheConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	value := bytes.Repeat([]byte("a"), 100)
+	c, err := NewDisk(dir, 4*uint64(len(encodeDiskEntry("k0", value, 0))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the same keys are replaced and evicted concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				k := "k" + strconv.Itoa(j%6)
+				c.Set(k, value, 60)
+				if _, err := c.Get(k); err != nil && err != ErrNotFound {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if c.Corrupted() != 0 {
+		t.Fatalf("entries are corrupted: %d", c.Corrupted())
+	}
+	// files of replaced and evicted entries are removed, files of indexed entries are kept
+	files := 0
+	for k := 0; k < 6; k++ {
+		if path := c.filePath("k" + strconv.Itoa(k)); path != "" {
+			if _, err := os.Stat(path); err != nil {
+				t.Fatalf("file of indexed entry is missing: %v", err)
+			}
+			files++
+		}
+	}
+	if files != c.Items() {
+		t.Fatalf("unexpected count of entries: %d, files %d", c.Items(), files)
+	}
+	reloaded, err := NewDisk(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if reloaded.Items() != c.Items() {
+		t.Fatalf("unexpected count of loaded entries: %d, expected %d", reloaded.Items(), c.Items())
+	}
+}
+
+func TestDiskCacheClose(t *testing.T) {
+	c, err := NewDisk(t.TempDir(), 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(c); err != nil {
+		t.Fatal(err)
+	}
+	// second close is no-op
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.stop:
+	default:
+		t.Fatal("cleaner is not stopped")
+	}
+}
+
+func TestDiskCacheTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "ab"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// temporary file of another instance, that is writing now, and the one left by interrupted write
+	writing := filepath.Join(dir, "ab", "ab-writing"+diskTmpSuffix)
+	interrupted := filepath.Join(dir, "ab", "ab-interrupted"+diskTmpSuffix)
+	for _, path := range []string{writing, interrupted} {
+		if err := os.WriteFile(path, []byte("foo"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * diskTmpMaxAge)
+	if err := os.Chtimes(interrupted, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewDisk(dir, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(writing); err != nil {
+		t.Fatalf("temporary file of another instance is removed: %v", err)
+	}
+	if _, err := os.Stat(interrupted); !os.IsNotExist(err) {
+		t.Fatalf("temporary file of interrupted write is not removed: %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	encodedMagic = 0xca
+	// encodedVersion must be changed on any change of the format, entries of other versions are treated as misses
+	encodedVersion = 1
+
+	flagGzip    = 1 << 0
+	flagChunked = 1 << 1
+
+	encodedHeaderSize = 3
+
+	// DefaultChunkSize keeps chunks below memcached item size limit (1 MB by default) including key and item overhead
+	DefaultChunkSize = 1000 * 1024
+	// DefaultCompressMinSize is a size of the smallest value to be compressed
+	DefaultCompressMinSize = 1024
+)
+
+var errInvalidEntry = errors.New("cache: invalid entry")
+
+// EncodingConfig describes how values are stored in a shared cache
+type EncodingConfig struct {
+	// Compression is "none" or "gzip"
+	Compression string
+	// CompressMinSize is a size of the smallest value to be compressed, DefaultCompressMinSize if zero
+	CompressMinSize int
+	// ChunkSize is a maximum size of a single item, bigger values are split over several keys. DefaultChunkSize if zero.
+	ChunkSize int
+}
+
+// Validate checks, that encoding is supported
+func (cfg EncodingConfig) Validate() error {
+	switch cfg.Compression {
+	case "", "none", "gzip":
+		return nil
+	default:
+		return errors.New("cache: unknown compression '" + cfg.Compression + "', supported: none, gzip")
+	}
+}
+
+// NewEncoded wraps cache, values are stored with a version header, compressed and split into chunks if needed.
+// Entries with unknown version or broken ones are treated as misses.
+func NewEncoded(c BytesCache, cfg EncodingConfig) (*EncodedCache, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	e := &EncodedCache{
+		c:               c,
+		gzip:            cfg.Compression == "gzip",
+		compressMinSize: cfg.CompressMinSize,
+		chunkSize:       cfg.ChunkSize,
+	}
+	if e.compressMinSize <= 0 {
+		e.compressMinSize = DefaultCompressMinSize
+	}
+	if e.chunkSize <= 0 {
+		e.chunkSize = DefaultChunkSize
+	}
+	return e, nil
+}
+
+type EncodedCache struct {
+	c               BytesCache
+	gzip            bool
+	compressMinSize int
+	chunkSize       int
+
+	invalid uint64
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+func chunkKey(k string, id uint64, i int) string {
+	return k + "\x00" + strconv.FormatUint(id, 16) + "\x00" + strconv.Itoa(i)
+}
+
+// Set stores value in the format:
+// magic, version, flags, [chunks id (8 bytes), uvarint chunks count] if chunked, payload if not chunked.
+// Chunks are stored under keys with unique id, so chunks of concurrent writes are never mixed.
+func (e *EncodedCache) Set(k string, v []byte, expire int32) {
+	payload := v
+	var flags byte
+	if e.gzip && len(v) >= e.compressMinSize {
+		var buf bytes.Buffer
+		w := gzipWriters.Get().(*gzip.Writer)
+		w.Reset(&buf)
+		_, err := w.Write(v)
+		if err == nil {
+			err = w.Close()
+		}
+		gzipWriters.Put(w)
+		if err == nil && buf.Len() < len(v) {
+			payload = buf.Bytes()
+			flags |= flagGzip
+		}
+	}
+
+	if len(payload) <= e.chunkSize {
+		entry := make([]byte, 0, encodedHeaderSize+len(payload))
+		entry = append(entry, encodedMagic, encodedVersion, flags)
+		entry = append(entry, payload...)
+		e.c.Set(k, entry, expire)
+		return
+	}
+
+	flags |= flagChunked
+	id := rand.Uint64()
+	n := (len(payload) + e.chunkSize - 1) / e.chunkSize
+	for i := 0; i < n; i++ {
+		end := (i + 1) * e.chunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		e.c.Set(chunkKey(k, id, i), payload[i*e.chunkSize:end], expire)
+	}
+	entry := make([]byte, 0, encodedHeaderSize+8+binary.MaxVarintLen64)
+	entry = append(entry, encodedMagic, encodedVersion, flags)
+	entry = binary.BigEndian.AppendUint64(entry, id)
+	entry = binary.AppendUvarint(entry, uint64(n))
+	e.c.Set(k, entry, expire)
+}
+
+func (e *EncodedCache) Get(k string) ([]byte, error) {
+	entry, err := e.c.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	v, err := e.decode(k, entry)
+	if err == errInvalidEntry {
+		atomic.AddUint64(&e.invalid, 1)
+		return nil, ErrNotFound
+	}
+	return v, err
+}
+
+func (e *EncodedCache) decode(k string, entry []byte) ([]byte, error) {
+	if len(entry) < encodedHeaderSize || entry[0] != encodedMagic || entry[1] != encodedVersion {
+		return nil, errInvalidEntry
+	}
+	flags := entry[2]
+	if flags&^(flagGzip|flagChunked) != 0 {
+		return nil, errInvalidEntry
+	}
+	payload := entry[encodedHeaderSize:]
+
+	if flags&flagChunked != 0 {
+		if len(payload) < 8 {
+			return nil, errInvalidEntry
+		}
+		id := binary.BigEndian.Uint64(payload)
+		n, l := binary.Uvarint(payload[8:])
+		if l <= 0 || n == 0 || n > 1<<16 {
+			return nil, errInvalidEntry
+		}
+		payload = nil
+		for i := 0; i < int(n); i++ {
+			chunk, err := e.c.Get(chunkKey(k, id, i))
+			if err != nil {
+				// chunk expired or evicted before the header
+				return nil, err
+			}
+			payload = append(payload, chunk...)
+		}
+	}
+
+	if flags&flagGzip != 0 {
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, errInvalidEntry
+		}
+		v, err := io.ReadAll(r)
+		if err != nil {
+			return nil, errInvalidEntry
+		}
+		return v, nil
+	}
+
+	return payload, nil
+}
+
+// Delete removes the entry, chunks of the value are left to expire
+func (e *EncodedCache) Delete(k string) error {
+	if d, ok := e.c.(Deleter); ok {
+		return d.Delete(k)
+	}
+	return nil
+}
+
+// Close closes underlying cache
+func (e *EncodedCache) Close() error {
+	return Close(e.c)
+}
+
+// Unwrap returns underlying cache
+func (e *EncodedCache) Unwrap() BytesCache {
+	return e.c
+}
+
+// Invalid returns count of entries, that can't be decoded (broken or written in another format)
+func (e *EncodedCache) Invalid() uint64 {
+	return atomic.LoadUint64(&e.invalid)
+}
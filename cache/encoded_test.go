@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"testing"
+)
+
+// mapCache keeps items as is, so they can be inspected
+type mapCache struct {
+	items map[string][]byte
+}
+
+func (m *mapCache) Get(k string) ([]byte, error) {
+	v, ok := m.items[k]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return v, nil
+}
+
+func (m *mapCache) Set(k string, v []byte, expire int32) {
+	m.items[k] = v
+}
+
+func TestEncodedCache(t *testing.T) {
+	compressible := bytes.Repeat([]byte(`{"target":"a.b.c","datapoints":[[1,2],[3,4]]},`), 2000)
+	random := make([]byte, 50*1024)
+	for i := range random {
+		random[i] = byte(rand.IntN(256))
+	}
+
+	tests := []struct {
+		name        string
+		compression string
+		value       []byte
+		// items is an expected count of items in the underlying cache
+		items int
+		// maxItemSize is an expected size of the biggest item
+		maxItemSize int
+	}{
+		{name: "small", compression: "gzip", value: []byte("small"), items: 1, maxItemSize: 8},
+		{name: "compressed", compression: "gzip", value: compressible, items: 1, maxItemSize: 16 * 1024},
+		{name: "not compressible", compression: "gzip", value: random, items: 5, maxItemSize: 16 * 1024},
+		{name: "chunked", compression: "none", value: compressible, items: 7, maxItemSize: 16 * 1024},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &mapCache{items: make(map[string][]byte)}
+			c, err := NewEncoded(m, EncodingConfig{Compression: tt.compression, ChunkSize: 16 * 1024})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.Set("foo", tt.value, 60)
+			if len(m.items) != tt.items {
+				t.Fatalf("got %d items, expected %d", len(m.items), tt.items)
+			}
+			for k, v := range m.items {
+				if len(v) > tt.maxItemSize {
+					t.Fatalf("item %q is too big: %d", k, len(v))
+				}
+			}
+
+			v, err := c.Get("foo")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(v, tt.value) {
+				t.Fatalf("value mismatch, got %d bytes, expected %d", len(v), len(tt.value))
+			}
+		})
+	}
+}
+
+func TestEncodedCacheInvalid(t *testing.T) {
+	m := &mapCache{items: make(map[string][]byte)}
+	c, err := NewEncoded(m, EncodingConfig{Compression: "gzip", ChunkSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// value written by an older version
+	m.items["old"] = []byte(`[{"target":"a"}]`)
+	// value written by a newer version
+	m.items["new"] = []byte{encodedMagic, encodedVersion + 1, 0, 'a'}
+	// broken compressed value
+	m.items["broken"] = []byte{encodedMagic, encodedVersion, flagGzip, 'a'}
+	for _, k := range []string{"old", "new", "broken"} {
+		if _, err := c.Get(k); err != ErrNotFound {
+			t.Errorf("%s: expected ErrNotFound, got %v", k, err)
+		}
+	}
+	if c.Invalid() != 3 {
+		t.Errorf("unexpected invalid entries count: %d", c.Invalid())
+	}
+
+	// chunk is evicted
+	c.Set("chunked", bytes.Repeat([]byte("a"), 100), 60)
+	for k := range m.items {
+		if k != "chunked" && len(k) > len("chunked") && k[:len("chunked")] == "chunked" {
+			delete(m.items, k)
+			break
+		}
+	}
+	if _, err := c.Get("chunked"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for evicted chunk, got %v", err)
+	}
+
+	if _, err := NewEncoded(m, EncodingConfig{Compression: "lz4"}); err == nil {
+		t.Error("expected error for unknown compression")
+	}
+}
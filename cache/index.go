@@ -0,0 +1,410 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// memcachedIndexBucketKeys is a maximum count of keys in a single item of memcached index
+	memcachedIndexBucketKeys = 1000
+	// memcachedIndexRetries limits attempts to update item of memcached index, that is changed concurrently
+	memcachedIndexRetries = 5
+	// redisIndexScanCount is a count of index entries requested by a single HSCAN
+	redisIndexScanCount = 1000
+)
+
+var errIndexConflict = errors.New("cache: index is updated concurrently")
+
+// NewIndexed wraps cache with an index of written keys, so entries can be found and purged by their tags
+// (e.g. render targets). Index of redis and memcached caches is kept in the same storage next to the entries, so
+// every instance sharing the cache can purge entries written by others. Index of other caches is kept in memory.
+// Index keeps at most maxKeys keys, expired and then random keys are dropped from the index, when it's full.
+func NewIndexed(c BytesCache, maxKeys int) *IndexedCache {
+	return &IndexedCache{
+		c:     c,
+		index: newKeyIndex(c, maxKeys),
+		now:   time.Now,
+	}
+}
+
+type IndexedCache struct {
+	c     BytesCache
+	index keyIndex
+
+	now func() time.Time
+}
+
+type indexEntry struct {
+	Tags []string `json:"tags,omitempty"`
+	// ExpireAt is zero for entries without expiration
+	ExpireAt int64 `json:"expire_at,omitempty"`
+}
+
+func (e indexEntry) expired(now int64) bool {
+	return e.ExpireAt != 0 && e.ExpireAt <= now
+}
+
+// keyIndex stores indexed keys with their tags
+type keyIndex interface {
+	add(now int64, k string, e indexEntry) error
+	remove(keys ...string) error
+	// entries returns all indexed keys, that are not expired
+	entries(now int64) (map[string]indexEntry, error)
+}
+
+// newKeyIndex returns index, that is kept in the shared storage of the cache, if it has one
+func newKeyIndex(c BytesCache, maxKeys int) keyIndex {
+	for {
+		switch s := c.(type) {
+		case *TwoTierCache:
+			c = s.L2()
+		case *EncodedCache:
+			c = s.Unwrap()
+		case *RedisCache:
+			return &redisIndex{r: s, key: s.prefix + "index", maxKeys: maxKeys}
+		case *MemcachedCache:
+			buckets := (maxKeys + memcachedIndexBucketKeys - 1) / memcachedIndexBucketKeys
+			return &memcachedIndex{m: s, buckets: max(buckets, 1), bucketKeys: min(maxKeys, memcachedIndexBucketKeys)}
+		default:
+			return &localIndex{maxKeys: maxKeys, keys: make(map[string]indexEntry)}
+		}
+	}
+}
+
+// evictEntries removes expired entries and then random ones, until there are less than maxKeys entries
+func evictEntries(entries map[string]indexEntry, now int64, maxKeys int) []string {
+	var evicted []string
+	for k, e := range entries {
+		if e.expired(now) {
+			delete(entries, k)
+			evicted = append(evicted, k)
+		}
+	}
+	for k := range entries {
+		if len(entries) < maxKeys {
+			break
+		}
+		delete(entries, k)
+		evicted = append(evicted, k)
+	}
+	return evicted
+}
+
+func (c *IndexedCache) Get(k string) ([]byte, error) {
+	return c.c.Get(k)
+}
+
+func (c *IndexedCache) Set(k string, v []byte, expire int32) {
+	c.SetTagged(k, v, expire, nil)
+}
+
+// SetTagged stores value and indexes its key with the tags. Value is stored even if index can't be updated.
+func (c *IndexedCache) SetTagged(k string, v []byte, expire int32, tags []string) {
+	c.c.Set(k, v, expire)
+
+	e := indexEntry{Tags: tags}
+	now := c.now().Unix()
+	if expire > 0 {
+		e.ExpireAt = now + int64(expire)
+	}
+	_ = c.index.add(now, k, e)
+}
+
+// Delete removes the entry from the cache and from the index
+func (c *IndexedCache) Delete(k string) error {
+	err := c.index.remove(k)
+	if d, ok := c.c.(Deleter); ok {
+		if err2 := d.Delete(k); err2 != nil {
+			return err2
+		}
+	}
+	return err
+}
+
+// Purge deletes indexed entries, matched by the function, and returns their count.
+// Deletion is continued on errors, the last error is returned.
+func (c *IndexedCache) Purge(match func(key string, tags []string) bool) (int, error) {
+	entries, err := c.index.entries(c.now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	var keys []string
+	for k, e := range entries {
+		if match(k, e.Tags) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	lastErr := c.index.remove(keys...)
+	if d, ok := c.c.(Deleter); ok {
+		for _, k := range keys {
+			if err := d.Delete(k); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return len(keys), lastErr
+}
+
+// Keys returns count of indexed keys
+func (c *IndexedCache) Keys() (int, error) {
+	entries, err := c.index.entries(c.now().Unix())
+	return len(entries), err
+}
+
+// Close closes underlying cache
+func (c *IndexedCache) Close() error {
+	return Close(c.c)
+}
+
+// Unwrap returns underlying cache
+func (c *IndexedCache) Unwrap() BytesCache {
+	return c.c
+}
+
+// localIndex is kept in memory of the instance
+type localIndex struct {
+	maxKeys int
+
+	mu   sync.Mutex
+	keys map[string]indexEntry
+}
+
+func (i *localIndex) add(now int64, k string, e indexEntry) error {
+	i.mu.Lock()
+	if _, ok := i.keys[k]; !ok && len(i.keys) >= i.maxKeys {
+		evictEntries(i.keys, now, i.maxKeys)
+	}
+	i.keys[k] = e
+	i.mu.Unlock()
+	return nil
+}
+
+func (i *localIndex) remove(keys ...string) error {
+	i.mu.Lock()
+	for _, k := range keys {
+		delete(i.keys, k)
+	}
+	i.mu.Unlock()
+	return nil
+}
+
+func (i *localIndex) entries(now int64) (map[string]indexEntry, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	res := make(map[string]indexEntry, len(i.keys))
+	for k, e := range i.keys {
+		if e.expired(now) {
+			delete(i.keys, k)
+			continue
+		}
+		res[k] = e
+	}
+	return res, nil
+}
+
+// redisIndex is a hash, where fields are keys and values are encoded entries
+type redisIndex struct {
+	r       *RedisCache
+	key     string
+	maxKeys int
+}
+
+func (i *redisIndex) do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := i.r.do(i.key, cmd, append([]interface{}{i.key}, args...)...)
+	if err != nil && i.r.isTimeout(err) {
+		return nil, ErrTimeout
+	}
+	return reply, err
+}
+
+func (i *redisIndex) add(now int64, k string, e indexEntry) error {
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	added, err := redis.Int(i.do("HSET", k, v))
+	if err != nil || added == 0 {
+		return err
+	}
+	size, err := redis.Int(i.do("HLEN"))
+	if err != nil || size <= i.maxKeys {
+		return err
+	}
+
+	// index is full, it's shrunk by a tenth at once, so it's not scanned on every write
+	entries, err := i.scan()
+	if err != nil {
+		return err
+	}
+	return i.remove(evictEntries(entries, now, i.maxKeys-i.maxKeys/10)...)
+}
+
+func (i *redisIndex) remove(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		args = append(args, k)
+	}
+	_, err := i.do("HDEL", args...)
+	return err
+}
+
+// scan returns all entries of the index, entries, that can't be decoded, are skipped
+func (i *redisIndex) scan() (map[string]indexEntry, error) {
+	res := make(map[string]indexEntry)
+	cursor := "0"
+	for {
+		values, err := redis.Values(i.do("HSCAN", cursor, "COUNT", redisIndexScanCount))
+		if err != nil {
+			return nil, err
+		}
+		var fields [][]byte
+		if _, err := redis.Scan(values, &cursor, &fields); err != nil {
+			return nil, err
+		}
+		for j := 0; j+1 < len(fields); j += 2 {
+			var e indexEntry
+			if json.Unmarshal(fields[j+1], &e) == nil {
+				res[string(fields[j])] = e
+			}
+		}
+		if cursor == "0" {
+			return res, nil
+		}
+	}
+}
+
+func (i *redisIndex) entries(now int64) (map[string]indexEntry, error) {
+	entries, err := i.scan()
+	if err != nil {
+		return nil, err
+	}
+	var expired []string
+	for k, e := range entries {
+		if e.expired(now) {
+			delete(entries, k)
+			expired = append(expired, k)
+		}
+	}
+	return entries, i.remove(expired...)
+}
+
+// memcachedIndex is split into buckets, each one is a single item with encoded entries, that is updated with
+// compare-and-swap
+type memcachedIndex struct {
+	m          *MemcachedCache
+	buckets    int
+	bucketKeys int
+}
+
+func (i *memcachedIndex) bucketKey(n int) string {
+	return i.m.prefix + "index-" + strconv.Itoa(n)
+}
+
+func (i *memcachedIndex) bucketOf(k string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(k))
+	return int(h.Sum32() % uint32(i.buckets))
+}
+
+// update changes entries of the bucket, update is retried, if the bucket is changed concurrently
+func (i *memcachedIndex) update(n int, f func(entries map[string]indexEntry)) error {
+	key := i.bucketKey(n)
+	for try := 0; try < memcachedIndexRetries; try++ {
+		entries := make(map[string]indexEntry)
+		item, err := i.m.setClient.Get(key)
+		if errors.Is(err, memcache.ErrCacheMiss) {
+			item = nil
+		} else if err != nil {
+			return err
+		} else if json.Unmarshal(item.Value, &entries) != nil {
+			// broken bucket is replaced
+			entries = make(map[string]indexEntry)
+		}
+
+		f(entries)
+		v, err := json.Marshal(entries)
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			err = i.m.setClient.Add(&memcache.Item{Key: key, Value: v})
+		} else {
+			item.Value = v
+			err = i.m.setClient.CompareAndSwap(item)
+		}
+		if errors.Is(err, memcache.ErrNotStored) || errors.Is(err, memcache.ErrCASConflict) || errors.Is(err, memcache.ErrCacheMiss) {
+			continue
+		}
+		return err
+	}
+	return errIndexConflict
+}
+
+func (i *memcachedIndex) add(now int64, k string, e indexEntry) error {
+	return i.update(i.bucketOf(k), func(entries map[string]indexEntry) {
+		if _, ok := entries[k]; !ok && len(entries) >= i.bucketKeys {
+			evictEntries(entries, now, i.bucketKeys)
+		}
+		entries[k] = e
+	})
+}
+
+func (i *memcachedIndex) remove(keys ...string) error {
+	byBucket := make(map[int][]string)
+	for _, k := range keys {
+		n := i.bucketOf(k)
+		byBucket[n] = append(byBucket[n], k)
+	}
+	var lastErr error
+	for n, keys := range byBucket {
+		err := i.update(n, func(entries map[string]indexEntry) {
+			for _, k := range keys {
+				delete(entries, k)
+			}
+		})
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (i *memcachedIndex) entries(now int64) (map[string]indexEntry, error) {
+	keys := make([]string, 0, i.buckets)
+	for n := 0; n < i.buckets; n++ {
+		keys = append(keys, i.bucketKey(n))
+	}
+	items, err := i.m.setClient.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]indexEntry)
+	for _, item := range items {
+		var entries map[string]indexEntry
+		if json.Unmarshal(item.Value, &entries) != nil {
+			continue
+		}
+		for k, e := range entries {
+			if !e.expired(now) {
+				res[k] = e
+			}
+		}
+	}
+	return res, nil
+}
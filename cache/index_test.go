@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestIndexedCache(t *testing.T) {
+	ec := NewExpireCache(1024 * 1024)
+	c := NewIndexed(ec, 3)
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+
+	c.SetTagged("a", []byte("1"), 60, []string{"foo.bar"})
+	c.SetTagged("b", []byte("2"), 60, []string{"sumSeries(foo.*)"})
+	c.Set("c", []byte("3"), 10)
+	if n, err := c.Keys(); err != nil || n != 3 {
+		t.Fatalf("unexpected count of keys %d, error %v", n, err)
+	}
+
+	// expired key is dropped from the full index
+	now = now.Add(30 * time.Second)
+	c.SetTagged("d", []byte("4"), 60, []string{"foo.baz"})
+	if n, err := c.Keys(); err != nil || n != 3 {
+		t.Fatalf("unexpected count of keys %d, error %v", n, err)
+	}
+
+	n, err := c.Purge(func(_ string, tags []string) bool {
+		return len(tags) > 0 && tags[0] == "foo.bar"
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("unexpected purge result %d, error %v", n, err)
+	}
+	if _, err := c.Get("a"); err != ErrNotFound {
+		t.Fatalf("purged entry is found, error %v", err)
+	}
+	if v, err := c.Get("b"); err != nil || string(v) != "2" {
+		t.Fatalf("unexpected value %q, error %v", v, err)
+	}
+
+	if err := c.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ec.Get("b"); err != ErrNotFound {
+		t.Fatalf("deleted entry is found, error %v", err)
+	}
+	if n, err := c.Keys(); err != nil || n != 1 {
+		t.Fatalf("unexpected count of keys %d, error %v", n, err)
+	}
+}
+
+func TestIndexedCacheSharedRedis(t *testing.T) {
+	r := miniredis.RunT(t)
+
+	newIndexed := func() *IndexedCache {
+		rc, err := NewRedis(RedisConfig{Servers: []string{r.Addr()}, KeyPrefix: "capi-test-"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = Close(rc) })
+		c := NewIndexed(NewTwoTier(NewExpireCache(1024*1024), rc, 60), 10)
+		c.now = func() time.Time { return time.Unix(1000, 0) }
+		return c
+	}
+	c1, c2 := newIndexed(), newIndexed()
+	rc := c1.Unwrap().(*TwoTierCache).L2().(*RedisCache)
+
+	c1.SetTagged("a", []byte("1"), 60, []string{"foo.bar"})
+	c2.SetTagged("b", []byte("2"), 60, []string{"foo.baz"})
+	c2.SetTagged("c", []byte("3"), 60, []string{"foo.bar"})
+	waitForKey(t, r, rc.key("c"))
+
+	if !r.Exists("capi-test-index") {
+		t.Fatal("index is not stored in redis")
+	}
+	if n, err := c1.Keys(); err != nil || n != 3 {
+		t.Fatalf("unexpected count of keys %d, error %v", n, err)
+	}
+
+	// entries written by another instance are purged
+	n, err := c1.Purge(func(_ string, tags []string) bool {
+		return len(tags) > 0 && tags[0] == "foo.bar"
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("unexpected purge result %d, error %v", n, err)
+	}
+	if r.Exists(rc.key("c")) {
+		t.Fatal("purged entry is found in redis")
+	}
+	if n, err := c2.Keys(); err != nil || n != 1 {
+		t.Fatalf("unexpected count of keys %d, error %v", n, err)
+	}
+}
+
+func TestRedisIndexEviction(t *testing.T) {
+	r := miniredis.RunT(t)
+	rc, err := NewRedis(RedisConfig{Servers: []string{r.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(rc)
+
+	c := NewIndexed(rc, 10)
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		c.SetTagged(k, []byte(k), 10, nil)
+	}
+	now = now.Add(20 * time.Second)
+	c.SetTagged("k", []byte("k"), 0, nil)
+
+	if n, err := c.Keys(); err != nil || n != 1 {
+		t.Fatalf("unexpected count of keys %d, error %v", n, err)
+	}
+}
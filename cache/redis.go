@@ -0,0 +1,566 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	redisClusterSlots = 16384
+	// redisMaxPipeline limits amount of Set commands sent in one pipeline
+	redisMaxPipeline = 128
+)
+
+// RedisConfig is a configuration of the redis (or valkey) cache
+type RedisConfig struct {
+	// Servers are addresses of the redis server, sentinels or cluster nodes, depending on the mode
+	Servers []string `mapstructure:"servers"`
+	// Mode is "single" (default), "sentinel" or "cluster"
+	Mode string `mapstructure:"mode"`
+	// MasterName is a name of the master, monitored by sentinels
+	MasterName string `mapstructure:"masterName"`
+	// SentinelPassword is a password for sentinels, if they require it
+	SentinelPassword string `mapstructure:"sentinelPassword" json:"-"`
+	Username         string `mapstructure:"username"`
+	Password         string `mapstructure:"password" json:"-"`
+	// Database is not supported in cluster mode
+	Database int `mapstructure:"database"`
+	// KeyPrefix is added to all keys
+	KeyPrefix string `mapstructure:"keyPrefix"`
+	// Timeout limits every operation, including waiting for a connection
+	Timeout        time.Duration `mapstructure:"timeout"`
+	ConnectTimeout time.Duration `mapstructure:"connectTimeout"`
+	MaxIdle        int           `mapstructure:"maxIdle"`
+	// SetQueueSize limits amount of Set commands waiting to be sent, new values are dropped if queue is full
+	SetQueueSize int `mapstructure:"setQueueSize"`
+}
+
+type redisSet struct {
+	key    string
+	value  []byte
+	expire int32
+}
+
+// RedisCache stores values in redis, keys are hashed as for memcached.
+// Set is asynchronous, values are sent to redis in pipelines.
+type RedisCache struct {
+	prefix  string
+	timeout time.Duration
+
+	// pool is used for single server and sentinel modes
+	pool    *redis.Pool
+	cluster *redisCluster
+
+	sets     chan redisSet
+	timeouts uint64
+
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewRedis creates redis cache, connections are established on demand
+func NewRedis(cfg RedisConfig) (BytesCache, error) {
+	if len(cfg.Servers) == 0 {
+		return nil, errors.New("redis: no servers provided")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 50 * time.Millisecond
+	}
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = 200 * time.Millisecond
+	}
+	if cfg.MaxIdle <= 0 {
+		cfg.MaxIdle = 16
+	}
+	if cfg.SetQueueSize <= 0 {
+		cfg.SetQueueSize = 1024
+	}
+
+	c := &RedisCache{
+		prefix:  cfg.KeyPrefix,
+		timeout: cfg.Timeout,
+		sets:    make(chan redisSet, cfg.SetQueueSize),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	switch cfg.Mode {
+	case "", "single":
+		addr := cfg.Servers[0]
+		c.pool = newRedisPool(cfg, func() (string, error) { return addr, nil })
+	case "sentinel":
+		if cfg.MasterName == "" {
+			return nil, errors.New("redis: masterName is required in sentinel mode")
+		}
+		s := &redisSentinel{cfg: cfg}
+		c.pool = newRedisPool(cfg, s.master)
+		// connections are recreated from time to time, so they follow the master after failover
+		c.pool.MaxConnLifetime = 30 * time.Second
+	case "cluster":
+		if cfg.Database != 0 {
+			return nil, errors.New("redis: database can't be selected in cluster mode")
+		}
+		c.cluster = newRedisCluster(cfg)
+	default:
+		return nil, errors.New("redis: unknown mode " + cfg.Mode)
+	}
+
+	go c.setLoop()
+
+	return c, nil
+}
+
+func newRedisPool(cfg RedisConfig, address func() (string, error)) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     cfg.MaxIdle,
+		IdleTimeout: 5 * time.Minute,
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			addr, err := address()
+			if err != nil {
+				return nil, err
+			}
+			return redis.DialContext(ctx, "tcp", addr,
+				redis.DialConnectTimeout(cfg.ConnectTimeout),
+				redis.DialUsername(cfg.Username),
+				redis.DialPassword(cfg.Password),
+				redis.DialDatabase(cfg.Database),
+			)
+		},
+	}
+}
+
+func (r *RedisCache) key(k string) string {
+	key := sha256.Sum256([]byte(k))
+	return r.prefix + hex.EncodeToString(key[:])
+}
+
+func (r *RedisCache) poolFor(key string) *redis.Pool {
+	if r.cluster != nil {
+		return r.cluster.poolFor(key)
+	}
+	return r.pool
+}
+
+// isTimeout checks if err is caused by the operation timeout and counts it
+func (r *RedisCache) isTimeout(err error) bool {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		atomic.AddUint64(&r.timeouts, 1)
+		return true
+	}
+	return false
+}
+
+// do runs command for the key, following cluster redirections once
+func (r *RedisCache) do(key string, cmd string, args ...interface{}) (interface{}, error) {
+	pool := r.poolFor(key)
+	asking := false
+	for try := 0; ; try++ {
+		reply, err := r.doOnPool(pool, asking, cmd, args...)
+		if r.cluster == nil || try > 0 {
+			return reply, err
+		}
+		var redirected bool
+		pool, asking, redirected = r.cluster.redirect(err)
+		if !redirected {
+			return reply, err
+		}
+	}
+}
+
+func (r *RedisCache) doOnPool(pool *redis.Pool, asking bool, cmd string, args ...interface{}) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	conn, err := pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if asking {
+		// reply of ASKING is read by Do together with the reply of the command
+		if err := conn.Send("ASKING"); err != nil {
+			return nil, err
+		}
+	}
+
+	deadline, _ := ctx.Deadline()
+	return redis.DoWithTimeout(conn, time.Until(deadline), cmd, args...)
+}
+
+func (r *RedisCache) Get(k string) ([]byte, error) {
+	key := r.key(k)
+	v, err := redis.Bytes(r.do(key, "GET", key))
+	if err != nil {
+		if errors.Is(err, redis.ErrNil) {
+			return nil, ErrNotFound
+		}
+		if r.isTimeout(err) {
+			return nil, ErrTimeout
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+// Set queues value to be sent to redis, value is dropped if queue is full
+func (r *RedisCache) Set(k string, v []byte, expire int32) {
+	select {
+	case r.sets <- redisSet{key: r.key(k), value: v, expire: expire}:
+	default:
+	}
+}
+
+func (r *RedisCache) Delete(k string) error {
+	key := r.key(k)
+	_, err := r.do(key, "DEL", key)
+	if err != nil && r.isTimeout(err) {
+		return ErrTimeout
+	}
+	return err
+}
+
+func (r *RedisCache) Timeouts() uint64 {
+	return atomic.LoadUint64(&r.timeouts)
+}
+
+func setArgs(s redisSet) []interface{} {
+	if s.expire > 0 {
+		return []interface{}{s.key, s.value, "EX", s.expire}
+	}
+	return []interface{}{s.key, s.value}
+}
+
+// Close stops sending of queued values (values, that are not sent yet, are dropped) and closes connections
+func (r *RedisCache) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		<-r.stopped
+		if r.cluster != nil {
+			r.closeErr = r.cluster.close()
+		} else {
+			r.closeErr = r.pool.Close()
+		}
+	})
+	return r.closeErr
+}
+
+// setLoop sends queued values in pipelines, until cache is closed
+func (r *RedisCache) setLoop() {
+	defer close(r.stopped)
+	for {
+		var s redisSet
+		select {
+		case <-r.stop:
+			return
+		case s = <-r.sets:
+		}
+
+		batch := []redisSet{s}
+	drain:
+		for len(batch) < redisMaxPipeline {
+			select {
+			case s := <-r.sets:
+				batch = append(batch, s)
+			default:
+				break drain
+			}
+		}
+
+		byPool := make(map[*redis.Pool][]redisSet)
+		for _, s := range batch {
+			pool := r.poolFor(s.key)
+			byPool[pool] = append(byPool[pool], s)
+		}
+		for pool, sets := range byPool {
+			r.pipeline(pool, sets)
+		}
+	}
+}
+
+func (r *RedisCache) pipeline(pool *redis.Pool, sets []redisSet) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	conn, err := pool.GetContext(ctx)
+	if err != nil {
+		r.isTimeout(err)
+		return
+	}
+	defer conn.Close()
+
+	for _, s := range sets {
+		if err := conn.Send("SET", setArgs(s)...); err != nil {
+			return
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		r.isTimeout(err)
+		return
+	}
+	for _, s := range sets {
+		_, err := redis.ReceiveWithTimeout(conn, r.timeout)
+		if err == nil {
+			continue
+		}
+		if r.isTimeout(err) {
+			return
+		}
+		if r.cluster != nil {
+			if _, _, redirected := r.cluster.redirect(err); redirected {
+				// slot has moved, value is sent once more to the new owner
+				_, _ = r.do(s.key, "SET", setArgs(s)...)
+			}
+		}
+	}
+}
+
+// redisSentinel resolves address of the master with sentinels
+type redisSentinel struct {
+	cfg RedisConfig
+}
+
+func (s *redisSentinel) master() (string, error) {
+	var lastErr error
+	for _, addr := range s.cfg.Servers {
+		conn, err := redis.Dial("tcp", addr,
+			redis.DialConnectTimeout(s.cfg.ConnectTimeout),
+			redis.DialPassword(s.cfg.SentinelPassword),
+		)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reply, err := redis.Strings(redis.DoWithTimeout(conn, s.cfg.Timeout, "SENTINEL", "get-master-addr-by-name", s.cfg.MasterName))
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(reply) != 2 {
+			lastErr = errors.New("redis: unexpected sentinel reply")
+			continue
+		}
+		return net.JoinHostPort(reply[0], reply[1]), nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("redis: master " + s.cfg.MasterName + " is unknown")
+	}
+	return "", lastErr
+}
+
+// redisCluster routes keys to nodes by hash slots
+type redisCluster struct {
+	cfg RedisConfig
+
+	mu    sync.RWMutex
+	slots []string
+	pools map[string]*redis.Pool
+	// closed is set by close, pools created after it are closed at once
+	closed bool
+
+	refreshing int32
+}
+
+func newRedisCluster(cfg RedisConfig) *redisCluster {
+	c := &redisCluster{
+		cfg:   cfg,
+		slots: make([]string, redisClusterSlots),
+		pools: make(map[string]*redis.Pool),
+	}
+	_ = c.refresh()
+	return c
+}
+
+// redisSlot returns hash slot of the key, with respect to hash tags
+func redisSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % redisClusterSlots)
+}
+
+// crc16 is CRC16-CCITT (XMODEM), used by redis cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func (c *redisCluster) poolByAddr(addr string) *redis.Pool {
+	c.mu.RLock()
+	pool, ok := c.pools[addr]
+	c.mu.RUnlock()
+	if ok {
+		return pool
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pool, ok = c.pools[addr]; !ok {
+		pool = newRedisPool(c.cfg, func() (string, error) { return addr, nil })
+		if c.closed {
+			_ = pool.Close()
+		}
+		c.pools[addr] = pool
+	}
+	return pool
+}
+
+// close closes pools of all nodes
+func (c *redisCluster) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	var lastErr error
+	for _, pool := range c.pools {
+		if err := pool.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (c *redisCluster) poolFor(key string) *redis.Pool {
+	slot := redisSlot(key)
+	c.mu.RLock()
+	addr := c.slots[slot]
+	c.mu.RUnlock()
+	if addr == "" {
+		// slots are unknown yet, any node will redirect us
+		addr = c.cfg.Servers[rand.Intn(len(c.cfg.Servers))]
+	}
+	return c.poolByAddr(addr)
+}
+
+// redirect checks for MOVED and ASK errors and returns the node, that owns the slot
+func (c *redisCluster) redirect(err error) (pool *redis.Pool, asking, ok bool) {
+	var redisErr redis.Error
+	if !errors.As(err, &redisErr) {
+		return nil, false, false
+	}
+	fields := strings.Fields(string(redisErr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return nil, false, false
+	}
+	slot, e := strconv.Atoi(fields[1])
+	if e != nil || slot < 0 || slot >= redisClusterSlots {
+		return nil, false, false
+	}
+	addr := fields[2]
+
+	if fields[0] == "ASK" {
+		return c.poolByAddr(addr), true, true
+	}
+
+	c.mu.Lock()
+	c.slots[slot] = addr
+	c.mu.Unlock()
+	// other slots have likely moved too
+	if atomic.CompareAndSwapInt32(&c.refreshing, 0, 1) {
+		go func() {
+			_ = c.refresh()
+			atomic.StoreInt32(&c.refreshing, 0)
+		}()
+	}
+	return c.poolByAddr(addr), false, true
+}
+
+// refresh loads slots map from any node
+func (c *redisCluster) refresh() error {
+	c.mu.RLock()
+	nodes := append([]string{}, c.cfg.Servers...)
+	for addr := range c.pools {
+		nodes = append(nodes, addr)
+	}
+	c.mu.RUnlock()
+
+	var lastErr error
+	for _, addr := range nodes {
+		reply, err := c.clusterSlots(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		slots := make([]string, redisClusterSlots)
+		for _, r := range reply {
+			for slot := r.start; slot <= r.end && slot < redisClusterSlots; slot++ {
+				slots[slot] = r.addr
+			}
+		}
+		c.mu.Lock()
+		c.slots = slots
+		c.mu.Unlock()
+		return nil
+	}
+	return lastErr
+}
+
+type redisSlotRange struct {
+	start, end int
+	addr       string
+}
+
+func (c *redisCluster) clusterSlots(addr string) ([]redisSlotRange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.ConnectTimeout+c.cfg.Timeout)
+	defer cancel()
+	conn, err := c.poolByAddr(addr).GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ranges, err := redis.Values(redis.DoWithTimeout(conn, c.cfg.Timeout, "CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]redisSlotRange, 0, len(ranges))
+	for _, r := range ranges {
+		fields, err := redis.Values(r, nil)
+		if err != nil || len(fields) < 3 {
+			return nil, errors.New("redis: unexpected CLUSTER SLOTS reply")
+		}
+		start, err1 := redis.Int(fields[0], nil)
+		end, err2 := redis.Int(fields[1], nil)
+		master, err3 := redis.Values(fields[2], nil)
+		if err1 != nil || err2 != nil || err3 != nil || len(master) < 2 {
+			return nil, errors.New("redis: unexpected CLUSTER SLOTS reply")
+		}
+		host, err1 := redis.String(master[0], nil)
+		port, err2 := redis.Int(master[1], nil)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("redis: unexpected CLUSTER SLOTS reply")
+		}
+		if host == "" {
+			// node doesn't know its own address, the one we are connected to is used
+			host, _, _ = net.SplitHostPort(addr)
+		}
+		res = append(res, redisSlotRange{start: start, end: end, addr: net.JoinHostPort(host, strconv.Itoa(port))})
+	}
+	return res, nil
+}
@@ -0,0 +1,215 @@
+package cache
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+)
+
+func waitForKey(t *testing.T, r *miniredis.Miniredis, key string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if r.Exists(key) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("key %q was not set", key)
+}
+
+func TestRedisCache(t *testing.T) {
+	r := miniredis.RunT(t)
+
+	c, err := NewRedis(RedisConfig{Servers: []string{r.Addr()}, KeyPrefix: "capi-test-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := c.(*RedisCache)
+
+	if _, err := c.Get("foo"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	c.Set("foo", []byte("bar"), 60)
+	c.Set("baz", []byte("qux"), 0)
+	waitForKey(t, r, rc.key("foo"))
+	waitForKey(t, r, rc.key("baz"))
+
+	if !strings.HasPrefix(rc.key("foo"), "capi-test-") {
+		t.Fatalf("key %q has no prefix", rc.key("foo"))
+	}
+	if ttl := r.TTL(rc.key("foo")); ttl != 60*time.Second {
+		t.Fatalf("unexpected ttl %v", ttl)
+	}
+	if ttl := r.TTL(rc.key("baz")); ttl != 0 {
+		t.Fatalf("unexpected ttl %v for key without expiration", ttl)
+	}
+
+	v, err := c.Get("foo")
+	if err != nil || string(v) != "bar" {
+		t.Fatalf("unexpected value %q, error %v", v, err)
+	}
+	if rc.Timeouts() != 0 {
+		t.Fatalf("unexpected timeouts: %d", rc.Timeouts())
+	}
+}
+
+func TestRedisCacheTimeout(t *testing.T) {
+	// server accepts connections, but never replies
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c, err := NewRedis(RedisConfig{Servers: []string{l.Addr().String()}, Timeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get("foo"); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if timeouts := c.(*RedisCache).Timeouts(); timeouts != 1 {
+		t.Fatalf("unexpected timeouts: %d", timeouts)
+	}
+}
+
+func TestRedisCacheSentinel(t *testing.T) {
+	r := miniredis.RunT(t)
+	host, port, _ := net.SplitHostPort(r.Addr())
+
+	sentinel, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sentinel.Close()
+	_ = sentinel.Register("SENTINEL", func(c *server.Peer, cmd string, args []string) {
+		if len(args) != 2 || strings.ToLower(args[0]) != "get-master-addr-by-name" || args[1] != "mymaster" {
+			c.WriteNull()
+			return
+		}
+		c.WriteLen(2)
+		c.WriteBulk(host)
+		c.WriteBulk(port)
+	})
+
+	c, err := NewRedis(RedisConfig{
+		Mode:       "sentinel",
+		MasterName: "mymaster",
+		// first sentinel is down
+		Servers: []string{"127.0.0.1:1", sentinel.Addr().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = r.Set(c.(*RedisCache).key("foo"), "bar")
+	v, err := c.Get("foo")
+	if err != nil || string(v) != "bar" {
+		t.Fatalf("unexpected value %q, error %v", v, err)
+	}
+}
+
+func TestRedisSlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"foo", 12182},
+		{"123456789", 12739},
+		{"{user1000}.following", redisSlot("user1000")},
+		{"foo{bar}{zap}", redisSlot("bar")},
+	}
+	for _, tt := range tests {
+		if slot := redisSlot(tt.key); slot != tt.slot {
+			t.Errorf("slot of %q is %d, expected %d", tt.key, slot, tt.slot)
+		}
+	}
+	if redisSlot("{user1000}.following") != redisSlot("{user1000}.followers") {
+		t.Error("keys with the same hash tag have different slots")
+	}
+}
+
+func TestRedisCacheCluster(t *testing.T) {
+	r := miniredis.RunT(t)
+
+	// node owns all slots according to CLUSTER SLOTS, but redirects every request to miniredis
+	node, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	_ = node.Register("CLUSTER", func(c *server.Peer, cmd string, args []string) {
+		c.WriteLen(1)
+		c.WriteLen(3)
+		c.WriteInt(0)
+		c.WriteInt(redisClusterSlots - 1)
+		c.WriteLen(2)
+		c.WriteBulk("127.0.0.1")
+		c.WriteInt(node.Addr().Port)
+	})
+	_ = node.Register("GET", func(c *server.Peer, cmd string, args []string) {
+		c.WriteError("MOVED 1 " + r.Addr())
+	})
+
+	c, err := NewRedis(RedisConfig{Mode: "cluster", Servers: []string{node.Addr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := c.(*RedisCache)
+
+	_ = r.Set(rc.key("foo"), "bar")
+	v, err := c.Get("foo")
+	if err != nil || string(v) != "bar" {
+		t.Fatalf("unexpected value %q, error %v", v, err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("foo"); err == nil {
+		t.Fatal("closed cache returned value")
+	}
+}
+
+func TestRedisCacheClose(t *testing.T) {
+	r := miniredis.RunT(t)
+
+	c, err := NewRedis(RedisConfig{Servers: []string{r.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := c.(*RedisCache)
+	c.Set("foo", []byte("bar"), 60)
+	waitForKey(t, r, rc.key("foo"))
+
+	if err := Close(c); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-rc.stopped:
+	default:
+		t.Fatal("set loop is not stopped")
+	}
+	// closed cache doesn't panic and doesn't reach redis
+	c.Set("baz", []byte("qux"), 60)
+	if _, err := c.Get("foo"); err == nil {
+		t.Fatal("closed cache returned value")
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("second close failed: %v", err)
+	}
+}
@@ -1,14 +1,21 @@
 package config
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-graphite/carbonapi/cache"
+	"github.com/go-graphite/carbonapi/events"
 	"github.com/go-graphite/carbonapi/expr"
 	"github.com/go-graphite/carbonapi/expr/interfaces"
 	"github.com/go-graphite/carbonapi/limiter"
 	"github.com/go-graphite/carbonapi/pkg/tlsconfig"
+	"github.com/go-graphite/carbonapi/pkg/tracing"
 	zipperCfg "github.com/go-graphite/carbonapi/zipper/config"
 	zipper "github.com/go-graphite/carbonapi/zipper/interfaces"
 	zipperTypes "github.com/go-graphite/carbonapi/zipper/types"
@@ -16,6 +23,9 @@ import (
 	"github.com/lomik/zapwriter"
 )
 
+// DefaultMaxItemSizeKb is a default limit of the streamed response, that is kept for the cache
+const DefaultMaxItemSizeKb = 10 * 1024
+
 var DefaultLoggerConfig = zapwriter.Config{
 	Logger:           "",
 	File:             "stdout",
@@ -26,13 +36,44 @@ var DefaultLoggerConfig = zapwriter.Config{
 }
 
 type CacheConfig struct {
-	Type                string        `mapstructure:"type"`
-	Size                int           `mapstructure:"size_mb"`
-	MemcachedServers    []string      `mapstructure:"memcachedServers"`
+	Type             string   `mapstructure:"type"`
+	Size             int      `mapstructure:"size_mb"`
+	MemcachedServers []string `mapstructure:"memcachedServers"`
+	// MemcachedGetTimeout and MemcachedSetTimeout are timeouts of memcached requests, zero means default
+	MemcachedGetTimeout time.Duration     `mapstructure:"memcachedGetTimeout"`
+	MemcachedSetTimeout time.Duration     `mapstructure:"memcachedSetTimeout"`
+	Redis               cache.RedisConfig `mapstructure:"redis"`
+	Disk                cache.DiskConfig  `mapstructure:"disk"`
+	// Compression of values in memcache or redis, values smaller than CompressMinSize bytes are not compressed
+	Compression     string `mapstructure:"compression"`
+	CompressMinSize int    `mapstructure:"compressMinSize"`
+	// ChunkSizeKb limits size of a single item in memcache or redis, bigger values are split over several keys
+	ChunkSizeKb int `mapstructure:"chunkSizeKb"`
+	// L1 is an in-process cache in front of memcache, redis or disk cache
+	L1                  L1CacheConfig `mapstructure:"l1"`
 	DefaultTimeoutSec   int32         `mapstructure:"defaultTimeoutSec"`
 	ShortTimeoutSec     int32         `mapstructure:"shortTimeoutSec"`
 	ShortDuration       time.Duration `mapstructure:"shortDuration"`
 	ShortUntilOffsetSec int64         `mapstructure:"shortUntilOffsetSec"`
+	// MaxItemSizeKb limits size of the streamed response, that is kept for the cache. Default: DefaultMaxItemSizeKb.
+	MaxItemSizeKb int `mapstructure:"maxItemSizeKb"`
+	// StaleSec is a time to serve expired response, while it's refreshed in the background. Only for response cache.
+	StaleSec int32 `mapstructure:"staleSec"`
+	// EarlyRefreshBeta enables probabilistic refresh of the response before it's expired, bigger values refresh earlier
+	EarlyRefreshBeta float64 `mapstructure:"earlyRefreshBeta"`
+	// KeyIndexSize is a maximum count of written keys, kept to purge entries by target with admin API. Zero disables index.
+	KeyIndexSize int `mapstructure:"keyIndexSize"`
+}
+
+type L1CacheConfig struct {
+	Size int `mapstructure:"size_mb"`
+	// TimeoutSec limits time to keep value in L1, values found in shared cache are kept for this time
+	TimeoutSec int32 `mapstructure:"timeoutSec"`
+}
+
+type EventsConfig struct {
+	Type string `mapstructure:"type"`
+	Path string `mapstructure:"path"`
 }
 
 type GraphiteConfig struct {
@@ -54,6 +95,91 @@ type ExpvarConfig struct {
 	PProfEnabled bool   `mapstructure:"pprofEnabled"`
 }
 
+type PrometheusConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+}
+
+type AdminConfig struct {
+	// Token must be passed in Authorization header (as Bearer token) for admin API. Admin API is disabled if empty.
+	Token string `mapstructure:"token"`
+}
+
+type QuotaOverride struct {
+	// Key is a user name or a value of KeyHeader
+	Key           string `mapstructure:"key"`
+	limiter.Quota `mapstructure:",squash"`
+}
+
+type QuotasConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// KeyHeader is a header with tenant id (e.x. X-Scope-OrgID). User name from BasicAuth is used if empty.
+	KeyHeader string `mapstructure:"keyHeader"`
+	// TrustedProxies are addresses or networks (CIDR) of proxies, that set KeyHeader. Header of requests from other
+	// addresses is ignored. Required if KeyHeader is set.
+	TrustedProxies []string `mapstructure:"trustedProxies"`
+	// AnonymousKey is used for requests without key
+	AnonymousKey string          `mapstructure:"anonymousKey"`
+	Default      limiter.Quota   `mapstructure:"default"`
+	Overrides    []QuotaOverride `mapstructure:"overrides"`
+
+	trustedProxies []netip.Prefix
+}
+
+// ParseTrustedProxies checks and parses TrustedProxies
+func (q *QuotasConfig) ParseTrustedProxies() error {
+	if q.KeyHeader != "" && len(q.TrustedProxies) == 0 {
+		return errors.New("quotas: trustedProxies are required with keyHeader")
+	}
+	q.trustedProxies = make([]netip.Prefix, 0, len(q.TrustedProxies))
+	for _, s := range q.TrustedProxies {
+		var prefix netip.Prefix
+		addr, err := netip.ParseAddr(s)
+		if err == nil {
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		} else if prefix, err = netip.ParsePrefix(s); err != nil {
+			return fmt.Errorf("quotas: invalid trusted proxy '%s': %w", s, err)
+		}
+		q.trustedProxies = append(q.trustedProxies, prefix.Masked())
+	}
+	return nil
+}
+
+// IsTrustedProxy checks that peer address (host:port) is one of TrustedProxies
+func (q *QuotasConfig) IsTrustedProxy(remoteAddr string) bool {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, prefix := range q.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type QueryLimitsOverride struct {
+	// Key is a user name or a tenant id, same as for quotas
+	Key                string `mapstructure:"key"`
+	limiter.CostLimits `mapstructure:",squash"`
+}
+
+type QueryLimitsConfig struct {
+	Default   limiter.CostLimits    `mapstructure:"default"`
+	Overrides []QueryLimitsOverride `mapstructure:"overrides"`
+}
+
+// Get returns limits for the user or tenant
+func (c *QueryLimitsConfig) Get(key string) limiter.CostLimits {
+	for i := range c.Overrides {
+		if c.Overrides[i].Key == key {
+			return c.Overrides[i].CostLimits
+		}
+	}
+	return c.Default
+}
+
 type Listener struct {
 	Address string `mapstructure:"address"`
 
@@ -78,6 +204,7 @@ type ConfigType struct {
 	Concurency                 int                `mapstructure:"concurency"`
 	ResponseCacheConfig        CacheConfig        `mapstructure:"cache"`
 	BackendCacheConfig         CacheConfig        `mapstructure:"backendCache"`
+	EventsConfig               EventsConfig       `mapstructure:"events"`
 	Cpus                       int                `mapstructure:"cpus"`
 	TimezoneString             string             `mapstructure:"tz"`
 	UnicodeRangeTables         []string           `mapstructure:"unicodeRangeTables"`
@@ -102,6 +229,11 @@ type ConfigType struct {
 	Define                     []Define           `mapstructure:"define"`
 	Prefix                     string             `mapstructure:"prefix"`
 	Expvar                     ExpvarConfig       `mapstructure:"expvar"`
+	Prometheus                 PrometheusConfig   `mapstructure:"prometheus"`
+	Tracing                    tracing.Config     `mapstructure:"tracing"`
+	Admin                      AdminConfig        `mapstructure:"admin"`
+	Quotas                     QuotasConfig       `mapstructure:"quotas"`
+	QueryLimits                QueryLimitsConfig  `mapstructure:"queryLimits"`
 	NotFoundStatusCode         int                `mapstructure:"notFoundStatusCode"`
 	HTTPResponseStackTrace     bool               `mapstructure:"httpResponseStackTrace"`
 	UseCachingDNSResolver      bool               `mapstructure:"useCachingDNSResolver"`
@@ -119,6 +251,9 @@ type ConfigType struct {
 	ResponseCache cache.BytesCache `mapstructure:"-" json:"-"`
 	BackendCache  cache.BytesCache `mapstructure:"-" json:"-"`
 
+	// Events is a storage for /events/ API and events() function
+	Events events.Store `mapstructure:"-" json:"-"`
+
 	DefaultTimeZone *time.Location `mapstructure:"-" json:"-"`
 
 	// ZipperInstance is API entry to carbonzipper
@@ -127,7 +262,13 @@ type ConfigType struct {
 	// Limiter limits concurrent zipper requests
 	Limiter limiter.SimpleLimiter `mapstructure:"-" json:"-"`
 
+	// QuotaLimiter limits requests per user or tenant, nil if quotas are disabled
+	QuotaLimiter *limiter.QuotaLimiter `mapstructure:"-" json:"-"`
+
 	Evaluator interfaces.Evaluator `mapstructure:"-" json:"-"`
+
+	// gen counts requests using the config, nil for configs, that are never replaced
+	gen *generation
 }
 
 // skipcq: CRT-P0003
@@ -146,61 +287,131 @@ func (c *ConfigType) SetZipper(zipper zipper.CarbonZipper) (err error) {
 	return
 }
 
-var Config = ConfigType{
-	ExtrapolateExperiment: false,
-	Buckets:               10,
-	Concurency:            1000,
-	MaxBatchSize:          100,
-	ResponseCacheConfig: CacheConfig{
-		Type:              "mem",
-		DefaultTimeoutSec: 60,
-		ShortTimeoutSec:   0,
-		ShortDuration:     0,
-	},
-	BackendCacheConfig: CacheConfig{
-		Type:              "null",
-		DefaultTimeoutSec: 0,
-		ShortTimeoutSec:   0,
-	},
-	TimezoneString: "",
-	Graphite: GraphiteConfig{
-		Pattern:  "{prefix}.{fqdn}",
-		Host:     "",
-		Interval: 60 * time.Second,
-		Prefix:   "carbon.api",
-	},
-	Cpus:            0,
-	IdleConnections: 10,
-	PidFile:         "",
-
-	ResponseCache: cache.NullCache{},
-	BackendCache:  cache.NullCache{},
-
-	DefaultTimeZone: time.Local,
-	Logger:          []zapwriter.Config{DefaultLoggerConfig},
-
-	Upstreams: zipperCfg.Config{
-		Buckets:          10,
-		SlowLogThreshold: 1 * time.Second,
-		Timeouts: zipperTypes.Timeouts{
-			Render:  10000 * time.Second,
-			Find:    2 * time.Second,
-			Connect: 200 * time.Millisecond,
+// Config is a configuration, that carbonapi was started with. It's replaced by a new one on reload,
+// so everything that serves requests should use Current()
+var Config = DefaultConfig()
+
+var current atomic.Pointer[ConfigType]
+
+func init() {
+	Config.gen = newGeneration()
+	current.Store(&Config)
+}
+
+// Current returns running configuration. Requests should use the config, they were started with (see FromContext).
+func Current() *ConfigType {
+	return current.Load()
+}
+
+// Acquire returns running configuration and marks it as used until Release is called, so its resources (caches,
+// zipper) are not closed by reload while request is in progress
+func Acquire() *ConfigType {
+	for {
+		cfg := current.Load()
+		if cfg.gen.acquire() {
+			return cfg
+		}
+		// config is replaced and closed concurrently, the new one is taken
+	}
+}
+
+// Release marks configuration, returned by Acquire, as not used by the request
+func (c *ConfigType) Release() {
+	c.gen.release()
+}
+
+type configKey struct{}
+
+// NewContext returns context of the request, that is served with the config
+func NewContext(ctx context.Context, cfg *ConfigType) context.Context {
+	return context.WithValue(ctx, configKey{}, cfg)
+}
+
+// FromContext returns configuration of the request, running configuration is returned for contexts without one
+func FromContext(ctx context.Context) *ConfigType {
+	if cfg, ok := ctx.Value(configKey{}).(*ConfigType); ok {
+		return cfg
+	}
+	return Current()
+}
+
+// DefaultConfig returns configuration with default values
+func DefaultConfig() ConfigType {
+	return ConfigType{
+		ExtrapolateExperiment: false,
+		Buckets:               10,
+		Concurency:            1000,
+		MaxBatchSize:          100,
+		ResponseCacheConfig: CacheConfig{
+			Type:              "mem",
+			DefaultTimeoutSec: 60,
+			ShortTimeoutSec:   0,
+			ShortDuration:     0,
+		},
+		BackendCacheConfig: CacheConfig{
+			Type:              "null",
+			DefaultTimeoutSec: 0,
+			ShortTimeoutSec:   0,
+		},
+		EventsConfig: EventsConfig{
+			Type: "null",
 		},
-		KeepAliveInterval: 30 * time.Second,
-
-		MaxIdleConnsPerHost: 100,
-	},
-	ExpireDelaySec:             10 * 60,
-	GraphiteWeb09Compatibility: false,
-	Prefix:                     "",
-	Expvar: ExpvarConfig{
-		Listen:       "",
-		Enabled:      true,
-		PProfEnabled: false,
-	},
-	NotFoundStatusCode:     200,
-	HTTPResponseStackTrace: true,
-	UseCachingDNSResolver:  false,
-	CachingDNSRefreshTime:  1 * time.Minute,
+		TimezoneString: "",
+		Graphite: GraphiteConfig{
+			Pattern:  "{prefix}.{fqdn}",
+			Host:     "",
+			Interval: 60 * time.Second,
+			Prefix:   "carbon.api",
+		},
+		Cpus:            0,
+		IdleConnections: 10,
+		PidFile:         "",
+
+		ResponseCache: cache.NullCache{},
+		BackendCache:  cache.NullCache{},
+		Events:        events.NullStore{},
+
+		DefaultTimeZone: time.Local,
+		Logger:          []zapwriter.Config{DefaultLoggerConfig},
+
+		Upstreams: zipperCfg.Config{
+			Buckets:          10,
+			SlowLogThreshold: 1 * time.Second,
+			Timeouts: zipperTypes.Timeouts{
+				Render:  10000 * time.Second,
+				Find:    2 * time.Second,
+				Connect: 200 * time.Millisecond,
+			},
+			KeepAliveInterval: 30 * time.Second,
+
+			MaxIdleConnsPerHost: 100,
+		},
+		ExpireDelaySec:             10 * 60,
+		GraphiteWeb09Compatibility: false,
+		Prefix:                     "",
+		Expvar: ExpvarConfig{
+			Listen:       "",
+			Enabled:      true,
+			PProfEnabled: false,
+		},
+		Prometheus: PrometheusConfig{
+			Enabled: true,
+		},
+		Tracing: tracing.Config{
+			Enabled:       false,
+			Endpoint:      "http://localhost:4318/v1/traces",
+			ServiceName:   "carbonapi",
+			Timeout:       5 * time.Second,
+			BatchSize:     512,
+			QueueSize:     4096,
+			FlushInterval: 5 * time.Second,
+		},
+		Quotas: QuotasConfig{
+			AnonymousKey: "anonymous",
+		},
+		NotFoundStatusCode:     200,
+		HTTPResponseStackTrace: true,
+		UseCachingDNSResolver:  false,
+		CachingDNSRefreshTime:  1 * time.Minute,
+	}
 }
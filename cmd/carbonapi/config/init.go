@@ -2,6 +2,7 @@ package config
 
 import (
 	"bytes"
+	"errors"
 	"expvar"
 	"fmt"
 	"os"
@@ -21,19 +22,22 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/go-graphite/carbonapi/cache"
+	"github.com/go-graphite/carbonapi/events"
 	"github.com/go-graphite/carbonapi/expr/functions"
 	"github.com/go-graphite/carbonapi/expr/functions/cairo/png"
 	fconfig "github.com/go-graphite/carbonapi/expr/functions/config"
-	"github.com/go-graphite/carbonapi/expr/helper"
 	"github.com/go-graphite/carbonapi/expr/rewrite"
 	tconfig "github.com/go-graphite/carbonapi/expr/types/config"
 	"github.com/go-graphite/carbonapi/limiter"
 	"github.com/go-graphite/carbonapi/pkg/parser"
+	"github.com/go-graphite/carbonapi/pkg/tracing"
 	zipperTypes "github.com/go-graphite/carbonapi/zipper/types"
 )
 
 var graphTemplates map[string]png.PictureParams
 
+var ErrNoBackends = errors.New("no backends specified for upstreams")
+
 func truncateTimeSlice(m map[time.Duration]time.Duration) ([]DurationTruncate, error) {
 	s := make([]DurationTruncate, len(m))
 	n := 0
@@ -54,27 +58,133 @@ func truncateTimeSlice(m map[time.Duration]time.Duration) ([]DurationTruncate, e
 	return s, nil
 }
 
-func SetUpConfig(logger *zap.Logger, BuildVersion string) {
-	Config.ResponseCacheConfig.MemcachedServers = viper.GetStringSlice("cache.memcachedServers")
-	Config.BackendCacheConfig.MemcachedServers = viper.GetStringSlice("backendCache.memcachedServers")
-	if n := viper.GetString("logger.logger"); n != "" {
-		Config.Logger[0].Logger = n
+// setUpFromViper sets options, that can't be unmarshaled directly
+func setUpFromViper(v *viper.Viper, cfg *ConfigType) {
+	cfg.ResponseCacheConfig.MemcachedServers = v.GetStringSlice("cache.memcachedServers")
+	cfg.BackendCacheConfig.MemcachedServers = v.GetStringSlice("backendCache.memcachedServers")
+	if v.IsSet("cache.redis.servers") {
+		cfg.ResponseCacheConfig.Redis.Servers = v.GetStringSlice("cache.redis.servers")
+	}
+	if v.IsSet("backendCache.redis.servers") {
+		cfg.BackendCacheConfig.Redis.Servers = v.GetStringSlice("backendCache.redis.servers")
+	}
+	if n := v.GetString("logger.logger"); n != "" {
+		cfg.Logger[0].Logger = n
+	}
+	if n := v.GetString("logger.file"); n != "" {
+		cfg.Logger[0].File = n
+	}
+	if n := v.GetString("logger.level"); n != "" {
+		cfg.Logger[0].Level = n
 	}
-	if n := viper.GetString("logger.file"); n != "" {
-		Config.Logger[0].File = n
+	if n := v.GetString("logger.encoding"); n != "" {
+		cfg.Logger[0].Encoding = n
 	}
-	if n := viper.GetString("logger.level"); n != "" {
-		Config.Logger[0].Level = n
+	if n := v.GetString("logger.encodingtime"); n != "" {
+		cfg.Logger[0].EncodingTime = n
 	}
-	if n := viper.GetString("logger.encoding"); n != "" {
-		Config.Logger[0].Encoding = n
+	if n := v.GetString("logger.encodingduration"); n != "" {
+		cfg.Logger[0].EncodingDuration = n
+	}
+}
+
+func loadGraphTemplates(logger *zap.Logger, path string) (map[string]png.PictureParams, error) {
+	graphTemplates := make(map[string]png.PictureParams)
+	graphTemplatesViper := viper.New()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, merry.Prepend(err, "error reading graphTemplates file")
+	}
+
+	if strings.HasSuffix(path, ".toml") {
+		logger.Info("will parse config as toml",
+			zap.String("graphTemplate_path", path),
+		)
+		graphTemplatesViper.SetConfigType("TOML")
+	} else {
+		logger.Info("will parse config as yaml",
+			zap.String("graphTemplate_path", path),
+		)
+		graphTemplatesViper.SetConfigType("YAML")
 	}
-	if n := viper.GetString("logger.encodingtime"); n != "" {
-		Config.Logger[0].EncodingTime = n
+
+	err = graphTemplatesViper.ReadConfig(bytes.NewBuffer(b))
+	if err != nil {
+		return nil, merry.Prepend(err, "failed to parse graphTemplates file")
 	}
-	if n := viper.GetString("logger.encodingduration"); n != "" {
-		Config.Logger[0].EncodingDuration = n
+
+	for k := range graphTemplatesViper.AllSettings() {
+		// we need to explicitly copy	YDivisors and ColorList
+		newStruct := png.DefaultParams
+		newStruct.ColorList = nil
+		newStruct.YDivisors = nil
+		sub := graphTemplatesViper.Sub(k)
+		err = sub.Unmarshal(&newStruct)
+		if err != nil {
+			logger.Error("failed to parse graphTemplates config, settings will be ignored",
+				zap.String("graphTemplate_path", path),
+				zap.Error(err),
+			)
+		}
+		if newStruct.ColorList == nil || len(newStruct.ColorList) == 0 {
+			newStruct.ColorList = make([]string, len(png.DefaultParams.ColorList))
+			copy(newStruct.ColorList, png.DefaultParams.ColorList)
+		}
+		if newStruct.YDivisors == nil || len(newStruct.YDivisors) == 0 {
+			newStruct.YDivisors = make([]float64, len(png.DefaultParams.YDivisors))
+			copy(newStruct.YDivisors, png.DefaultParams.YDivisors)
+		}
+		graphTemplates[k] = newStruct
+	}
+
+	return graphTemplates, nil
+}
+
+func parseTimezone(s string) (*time.Location, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("unexpected amount of fields in tz '%s': got %d, expected 2", s, len(fields))
+	}
+
+	offs, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, merry.Prependf(err, "unable to parse seconds in tz '%s'", s)
+	}
+
+	return time.FixedZone(fields[0], offs), nil
+}
+
+func getDefines(cfg *ConfigType) (map[string]string, error) {
+	defines := make(map[string]string, len(cfg.Define))
+	for _, define := range cfg.Define {
+		if define.Name == "" {
+			return nil, parser.ErrEmptyDefineName
+		}
+		defines[define.Name] = define.Template
+	}
+	return defines, nil
+}
+
+func setUpListeners(cfg *ConfigType) {
+	if cfg.Listen != "" {
+		listeners := make(map[string]struct{})
+		for _, l := range cfg.Listeners {
+			listeners[l.Address] = struct{}{}
+		}
+		if _, ok := listeners[cfg.Listen]; !ok {
+			cfg.Listeners = append(cfg.Listeners, Listener{
+				Address: cfg.Listen,
+			})
+		}
+	}
+
+	if len(cfg.Listeners) == 0 {
+		cfg.Listeners = append(cfg.Listeners, Listener{Address: "127.0.0.1:8081"})
 	}
+}
+
+func SetUpConfig(logger *zap.Logger, BuildVersion string) {
+	setUpFromViper(viper.GetViper(), &Config)
 	err := zapwriter.ApplyConfig(Config.Logger)
 	if err != nil {
 		logger.Fatal("failed to initialize logger with requested configuration",
@@ -93,60 +203,14 @@ func SetUpConfig(logger *zap.Logger, BuildVersion string) {
 	merry.SetStackCaptureEnabled(needStackTrace)
 
 	if Config.GraphTemplates != "" {
-		graphTemplates = make(map[string]png.PictureParams)
-		graphTemplatesViper := viper.New()
-		b, err := os.ReadFile(Config.GraphTemplates)
-		if err != nil {
-			logger.Fatal("error reading graphTemplates file",
-				zap.String("graphTemplate_path", Config.GraphTemplates),
-				zap.Error(err),
-			)
-		}
-
-		if strings.HasSuffix(Config.GraphTemplates, ".toml") {
-			logger.Info("will parse config as toml",
-				zap.String("graphTemplate_path", Config.GraphTemplates),
-			)
-			graphTemplatesViper.SetConfigType("TOML")
-		} else {
-			logger.Info("will parse config as yaml",
-				zap.String("graphTemplate_path", Config.GraphTemplates),
-			)
-			graphTemplatesViper.SetConfigType("YAML")
-		}
-
-		err = graphTemplatesViper.ReadConfig(bytes.NewBuffer(b))
+		graphTemplates, err = loadGraphTemplates(logger, Config.GraphTemplates)
 		if err != nil {
-			logger.Fatal("failed to parse config",
+			logger.Fatal("failed to load graphTemplates",
 				zap.String("graphTemplate_path", Config.GraphTemplates),
 				zap.Error(err),
 			)
 		}
 
-		for k := range graphTemplatesViper.AllSettings() {
-			// we need to explicitly copy	YDivisors and ColorList
-			newStruct := png.DefaultParams
-			newStruct.ColorList = nil
-			newStruct.YDivisors = nil
-			sub := graphTemplatesViper.Sub(k)
-			err = sub.Unmarshal(&newStruct)
-			if err != nil {
-				logger.Error("failed to parse graphTemplates config, settings will be ignored",
-					zap.String("graphTemplate_path", Config.GraphTemplates),
-					zap.Error(err),
-				)
-			}
-			if newStruct.ColorList == nil || len(newStruct.ColorList) == 0 {
-				newStruct.ColorList = make([]string, len(png.DefaultParams.ColorList))
-				copy(newStruct.ColorList, png.DefaultParams.ColorList)
-			}
-			if newStruct.YDivisors == nil || len(newStruct.YDivisors) == 0 {
-				newStruct.YDivisors = make([]float64, len(png.DefaultParams.YDivisors))
-				copy(newStruct.YDivisors, png.DefaultParams.YDivisors)
-			}
-			graphTemplates[k] = newStruct
-		}
-
 		// skipcq: CRT-P0006
 		for name, params := range graphTemplates {
 			png.SetTemplate(name, &params)
@@ -178,36 +242,51 @@ func SetUpConfig(logger *zap.Logger, BuildVersion string) {
 
 	expvar.NewString("GoVersion").Set(runtime.Version())
 	expvar.NewString("BuildVersion").Set(BuildVersion)
-	expvar.Publish("config", Config)
+	expvar.Publish("config", expvar.Func(func() interface{} {
+		return Current()
+	}))
 
 	Config.Limiter = limiter.NewSimpleLimiter(Config.Concurency)
+	if err := Config.Quotas.ParseTrustedProxies(); err != nil {
+		logger.Fatal("invalid quotas config", zap.Error(err))
+	}
+	Config.QuotaLimiter = newQuotaLimiter(&Config.Quotas)
 
-	Config.ResponseCache = createCache(logger, "cache", &Config.ResponseCacheConfig)
-	Config.BackendCache = createCache(logger, "backendCache", &Config.BackendCacheConfig)
+	Config.ResponseCache, err = createCache(logger, "cache", &Config.ResponseCacheConfig)
+	if err != nil {
+		logger.Fatal("failed to create cache", zap.Error(err))
+	}
+	Config.BackendCache, err = createCache(logger, "backendCache", &Config.BackendCacheConfig)
+	if err != nil {
+		logger.Fatal("failed to create cache", zap.Error(err))
+	}
 
-	if Config.TimezoneString != "" {
-		fields := strings.Split(Config.TimezoneString, ",")
+	Config.Events = createEventsStore(logger, &Config.EventsConfig)
+	fconfig.Config.Events = Config.Events
 
-		if len(fields) != 2 {
-			logger.Fatal("unexpected amount of fields in tz",
-				zap.String("timezone_string", Config.TimezoneString),
-				zap.Int("fields_got", len(fields)),
-				zap.Int("fields_expected", 2),
+	if Config.Tracing.Enabled {
+		exporter, err := tracing.NewExporter(Config.Tracing, zapwriter.Logger("tracing"))
+		if err != nil {
+			logger.Fatal("failed to setup tracing",
+				zap.Error(err),
 			)
 		}
+		tracing.SetExporter(exporter)
+		logger.Info("tracing enabled",
+			zap.String("endpoint", Config.Tracing.Endpoint),
+		)
+	}
 
-		offs, err := strconv.Atoi(fields[1])
+	if Config.TimezoneString != "" {
+		Config.DefaultTimeZone, err = parseTimezone(Config.TimezoneString)
 		if err != nil {
-			logger.Fatal("unable to parse seconds",
-				zap.String("field[1]", fields[1]),
+			logger.Fatal("failed to parse tz",
+				zap.String("timezone_string", Config.TimezoneString),
 				zap.Error(err),
 			)
 		}
-
-		Config.DefaultTimeZone = time.FixedZone(fields[0], offs)
 		logger.Info("using fixed timezone",
 			zap.String("timezone", Config.DefaultTimeZone.String()),
-			zap.Int("offset", offs),
 		)
 	}
 
@@ -251,50 +330,51 @@ func SetUpConfig(logger *zap.Logger, BuildVersion string) {
 		}
 	}
 
-	helper.ExtrapolatePoints = Config.ExtrapolateExperiment
 	if Config.ExtrapolateExperiment {
 		logger.Warn("extraploation experiment is enabled",
 			zap.String("reason", "this feature is highly experimental and untested"),
 		)
 	}
 
-	tconfig.Config.NudgeStartTimeOnAggregation = Config.NudgeStartTimeOnAggregation
-	tconfig.Config.UseBucketsHighestTimestampOnAggregation = Config.UseBucketsHighestTimestampOnAggregation
+	tconfig.Replace(exprConfig(&Config))
 
-	if Config.Listen != "" {
-		listeners := make(map[string]struct{})
-		for _, l := range Config.Listeners {
-			listeners[l.Address] = struct{}{}
-		}
-		if _, ok := listeners[Config.Listen]; !ok {
-			Config.Listeners = append(Config.Listeners, Listener{
-				Address: Config.Listen,
-			})
-		}
-	}
+	setUpListeners(&Config)
 
-	if len(Config.Listeners) == 0 {
-		Config.Listeners = append(Config.Listeners, Listener{Address: "127.0.0.1:8081"})
+	defines, err := getDefines(&Config)
+	if err == nil {
+		err = parser.ReplaceDefines(defines)
+	}
+	if err != nil {
+		logger.Fatal("unable to compile define template",
+			zap.Error(err),
+		)
 	}
+}
 
-	for _, define := range Config.Define {
-		if define.Name == "" {
-			logger.Fatal("empty define name")
-		}
-		err := parser.Define(define.Name, define.Template)
-		if err != nil {
-			logger.Fatal("unable to compile define template",
-				zap.Error(err),
-				zap.String("template", define.Template),
-			)
-		}
+// newQuotaLimiter creates limiter for per-user quotas, nil is returned if quotas are disabled
+// exprConfig returns configuration of expressions evaluation
+func exprConfig(cfg *ConfigType) tconfig.ConfigType {
+	return tconfig.ConfigType{
+		NudgeStartTimeOnAggregation:             cfg.NudgeStartTimeOnAggregation,
+		UseBucketsHighestTimestampOnAggregation: cfg.UseBucketsHighestTimestampOnAggregation,
+		ExtrapolatePoints:                       cfg.ExtrapolateExperiment,
+		ExtractTagsFromArgs:                     cfg.ExtractTagsFromArgs,
+		DefaultTimeZone:                         cfg.DefaultTimeZone,
 	}
 }
 
-func createCache(logger *zap.Logger, cacheName string, cacheConfig *CacheConfig) cache.BytesCache {
-	if cacheConfig.DefaultTimeoutSec <= 0 && cacheConfig.ShortTimeoutSec <= 0 {
-		return cache.NullCache{}
+func newQuotaLimiter(quotas *QuotasConfig) *limiter.QuotaLimiter {
+	if !quotas.Enabled {
+		return nil
 	}
+	overrides := make(map[string]limiter.Quota, len(quotas.Overrides))
+	for _, o := range quotas.Overrides {
+		overrides[o.Key] = o.Quota
+	}
+	return limiter.NewQuotaLimiter(quotas.Default, overrides)
+}
+
+func normalizeCacheConfig(cacheConfig *CacheConfig) {
 	if cacheConfig.ShortTimeoutSec < 0 || cacheConfig.DefaultTimeoutSec == cacheConfig.ShortTimeoutSec {
 		// broken value or short timeout not need due to equal
 		cacheConfig.ShortTimeoutSec = 0
@@ -308,182 +388,362 @@ func createCache(logger *zap.Logger, cacheName string, cacheConfig *CacheConfig)
 	if cacheConfig.ShortUntilOffsetSec == 0 {
 		cacheConfig.ShortUntilOffsetSec = 120
 	}
+	if cacheConfig.MaxItemSizeKb <= 0 {
+		cacheConfig.MaxItemSizeKb = DefaultMaxItemSizeKb
+	}
+}
+
+func createCache(logger *zap.Logger, cacheName string, cacheConfig *CacheConfig) (cache.BytesCache, error) {
+	c, err := newCache(logger, cacheName, cacheConfig)
+	if err != nil || cacheConfig.KeyIndexSize <= 0 {
+		return c, err
+	}
+	if _, ok := c.(cache.NullCache); ok {
+		return c, nil
+	}
+	logger.Info(cacheName+": key index configured",
+		zap.Int("max_keys", cacheConfig.KeyIndexSize),
+	)
+	return cache.NewIndexed(c, cacheConfig.KeyIndexSize), nil
+}
 
+// validateCacheConfig checks settings of the cache, so it can be created without errors
+func validateCacheConfig(cacheName string, cacheConfig *CacheConfig) error {
+	if cacheConfig.DefaultTimeoutSec <= 0 && cacheConfig.ShortTimeoutSec <= 0 {
+		return nil
+	}
 	switch cacheConfig.Type {
 	case "memcache":
 		if len(cacheConfig.MemcachedServers) == 0 {
-			logger.Fatal(cacheName + ": memcache cache requested but no memcache servers provided")
+			return fmt.Errorf("%s: memcache cache requested but no memcache servers provided", cacheName)
+		}
+	case "redis":
+		if len(cacheConfig.Redis.Servers) == 0 {
+			return fmt.Errorf("%s: redis cache requested but no redis servers provided", cacheName)
+		}
+	case "disk":
+		if cacheConfig.Size <= 0 {
+			return fmt.Errorf("%s: disk cache requested but size_mb is not set", cacheName)
+		}
+		return nil
+	case "mem", "null":
+		return nil
+	default:
+		return fmt.Errorf("%s: unknown cache type '%s'", cacheName, cacheConfig.Type)
+	}
+	if err := cacheEncoding(cacheConfig).Validate(); err != nil {
+		return fmt.Errorf("%s: %w", cacheName, err)
+	}
+	return nil
+}
+
+func cacheEncoding(cacheConfig *CacheConfig) cache.EncodingConfig {
+	return cache.EncodingConfig{
+		Compression:     cacheConfig.Compression,
+		CompressMinSize: cacheConfig.CompressMinSize,
+		ChunkSize:       cacheConfig.ChunkSizeKb * 1024,
+	}
+}
+
+func newCache(logger *zap.Logger, cacheName string, cacheConfig *CacheConfig) (cache.BytesCache, error) {
+	if cacheConfig.DefaultTimeoutSec <= 0 && cacheConfig.ShortTimeoutSec <= 0 {
+		return cache.NullCache{}, nil
+	}
+	normalizeCacheConfig(cacheConfig)
+
+	var shared cache.BytesCache
+	switch cacheConfig.Type {
+	case "memcache":
+		if len(cacheConfig.MemcachedServers) == 0 {
+			return nil, fmt.Errorf("%s: memcache cache requested but no memcache servers provided", cacheName)
 		}
 
 		logger.Info(cacheName+": memcached configured",
 			zap.Strings("servers", cacheConfig.MemcachedServers),
+			zap.Duration("get_timeout", cacheConfig.MemcachedGetTimeout),
+			zap.Duration("set_timeout", cacheConfig.MemcachedSetTimeout),
+		)
+		shared = cache.NewMemcachedWithTimeouts("capi-"+cacheName, cacheConfig.MemcachedGetTimeout, cacheConfig.MemcachedSetTimeout, cacheConfig.MemcachedServers...)
+	case "redis":
+		if len(cacheConfig.Redis.Servers) == 0 {
+			return nil, fmt.Errorf("%s: redis cache requested but no redis servers provided", cacheName)
+		}
+		// config is not changed, so it can be compared with the running one on reload
+		redisConfig := cacheConfig.Redis
+		if redisConfig.KeyPrefix == "" {
+			redisConfig.KeyPrefix = "capi-" + cacheName
+		}
+
+		logger.Info(cacheName+": redis configured",
+			zap.Strings("servers", redisConfig.Servers),
+			zap.String("mode", redisConfig.Mode),
+			zap.String("key_prefix", redisConfig.KeyPrefix),
 		)
-		return cache.NewMemcached("capi-"+cacheName, cacheConfig.MemcachedServers...)
+		var err error
+		shared, err = cache.NewRedis(redisConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cacheName, err)
+		}
+	case "disk":
+		if cacheConfig.Size <= 0 {
+			return nil, fmt.Errorf("%s: disk cache requested but size_mb is not set", cacheName)
+		}
+		logger.Info(cacheName+": disk cache configured",
+			zap.String("path", cacheConfig.Disk.Path),
+			zap.Int("size_mb", cacheConfig.Size),
+		)
+		var err error
+		shared, err = cache.NewDisk(cacheConfig.Disk.Path, uint64(cacheConfig.Size)*1024*1024)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cacheName, err)
+		}
 	case "mem":
 		logger.Info(cacheName + ": in-memory cache configured")
-		return cache.NewExpireCache(uint64(cacheConfig.Size * 1024 * 1024))
+		return cache.NewExpireCache(uint64(cacheConfig.Size * 1024 * 1024)), nil
 	case "null":
 		// defaults
-		return cache.NullCache{}
+		return cache.NullCache{}, nil
 	default:
 		logger.Error(cacheName+": unknown cache type",
 			zap.String("cache_type", cacheConfig.Type),
-			zap.Strings("known_cache_types", []string{"null", "mem", "memcache"}),
+			zap.Strings("known_cache_types", []string{"null", "mem", "memcache", "redis", "disk"}),
 		)
-		return nil
+		return nil, fmt.Errorf("%s: unknown cache type '%s'", cacheName, cacheConfig.Type)
+	}
+
+	if cacheConfig.Type != "disk" {
+		encoded, err := cache.NewEncoded(shared, cacheEncoding(cacheConfig))
+		if err != nil {
+			_ = cache.Close(shared)
+			return nil, fmt.Errorf("%s: %w", cacheName, err)
+		}
+		shared = encoded
+	}
+
+	if cacheConfig.L1.Size <= 0 {
+		return shared, nil
+	}
+	l1Timeout := cacheConfig.L1.TimeoutSec
+	if l1Timeout <= 0 {
+		l1Timeout = 10
 	}
+	logger.Info(cacheName+": in-memory L1 cache configured",
+		zap.Int("size_mb", cacheConfig.L1.Size),
+		zap.Int32("timeout_sec", l1Timeout),
+	)
+	return cache.NewTwoTier(cache.NewExpireCache(uint64(cacheConfig.L1.Size*1024*1024)), shared, l1Timeout), nil
 }
 
-func SetUpViper(logger *zap.Logger, configPath *string, exactConfig bool, viperPrefix string) {
-	if *configPath != "" {
-		b, err := os.ReadFile(*configPath)
+func createEventsStore(logger *zap.Logger, eventsConfig *EventsConfig) events.Store {
+	switch eventsConfig.Type {
+	case "file":
+		if eventsConfig.Path == "" {
+			logger.Fatal("events: file storage requested but no path provided")
+		}
+		s, err := events.NewFileStore(eventsConfig.Path)
 		if err != nil {
-			logger.Fatal("error reading config file",
-				zap.String("config_path", *configPath),
+			logger.Fatal("events: failed to load events",
+				zap.String("path", eventsConfig.Path),
 				zap.Error(err),
 			)
 		}
+		logger.Info("events: file storage configured",
+			zap.String("path", eventsConfig.Path),
+		)
+		return s
+	case "mem":
+		logger.Info("events: in-memory storage configured")
+		return events.NewMemoryStore()
+	case "null", "":
+		return events.NullStore{}
+	default:
+		logger.Fatal("events: unknown storage type",
+			zap.String("events_type", eventsConfig.Type),
+			zap.Strings("known_events_types", []string{"null", "mem", "file"}),
+		)
+		return nil
+	}
+}
 
-		if strings.HasSuffix(*configPath, ".toml") {
+func SetUpViper(logger *zap.Logger, configPath *string, exactConfig bool, viperPrefix string) {
+	reloadParams.Lock()
+	reloadParams.configPath = *configPath
+	reloadParams.exactConfig = exactConfig
+	reloadParams.envPrefix = viperPrefix
+	reloadParams.Unlock()
+
+	if err := readConfig(logger, viper.GetViper(), *configPath, exactConfig, viperPrefix, &Config); err != nil {
+		logger.Fatal("failed to parse config",
+			zap.String("config_path", *configPath),
+			zap.Error(err),
+		)
+	}
+}
+
+// readConfig reads config file (if specified), environment variables and defaults into cfg
+func readConfig(logger *zap.Logger, v *viper.Viper, configPath string, exactConfig bool, viperPrefix string, cfg *ConfigType) error {
+	if configPath != "" {
+		b, err := os.ReadFile(configPath)
+		if err != nil {
+			return merry.Prepend(err, "error reading config file")
+		}
+
+		if strings.HasSuffix(configPath, ".toml") {
 			logger.Info("will parse config as toml",
-				zap.String("config_file", *configPath),
+				zap.String("config_file", configPath),
 			)
-			viper.SetConfigType("TOML")
+			v.SetConfigType("TOML")
 		} else {
 			logger.Info("will parse config as yaml",
-				zap.String("config_file", *configPath),
+				zap.String("config_file", configPath),
 			)
-			viper.SetConfigType("YAML")
+			v.SetConfigType("YAML")
 		}
-		err = viper.ReadConfig(bytes.NewBuffer(b))
+		err = v.ReadConfig(bytes.NewBuffer(b))
 		if err != nil {
-			logger.Fatal("failed to parse config",
-				zap.String("config_path", *configPath),
-				zap.Error(err),
-			)
+			return err
 		}
 	}
 
 	if viperPrefix != "" {
-		viper.SetEnvPrefix(viperPrefix)
-	}
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	_ = viper.BindEnv("tz", "carbonapi_tz")
-	viper.SetDefault("listeners", []Listener{})
-	viper.SetDefault("concurency", 20)
-	viper.SetDefault("cache.type", "mem")
-	viper.SetDefault("cache.size_mb", 0)
-	viper.SetDefault("cache.defaultTimeoutSec", 60)
-	viper.SetDefault("cache.memcachedServers", []string{})
-	viper.SetDefault("cpus", 0)
-	viper.SetDefault("tz", "")
-	viper.SetDefault("sendGlobsAsIs", nil)
-	viper.SetDefault("alwaysSendGlobsAsIs", nil)
-	viper.SetDefault("extractTagsFromArgs", false)
-	viper.SetDefault("maxBatchSize", 100)
-	viper.SetDefault("graphite.host", "")
-	viper.SetDefault("graphite.interval", "60s")
-	viper.SetDefault("graphite.prefix", "carbon.api")
-	viper.SetDefault("graphite.pattern", "{prefix}.{fqdn}")
-	viper.SetDefault("idleConnections", 10)
-	viper.SetDefault("pidFile", "")
-	viper.SetDefault("upstreams.internalRoutingCache", "600s")
-	viper.SetDefault("upstreams.buckets", 10)
-	viper.SetDefault("upstreams.sumBuckets", false)
-	viper.SetDefault("upstreams.bucketsWidth", []int64{})
-	viper.SetDefault("upstreams.bucketsLabels", []string{})
-	viper.SetDefault("upstreams.slowLogThreshold", "1s")
-	viper.SetDefault("upstreams.timeouts.find", "2s")
-	viper.SetDefault("upstreams.timeouts.render", "10s")
-	viper.SetDefault("upstreams.timeouts.connect", "200ms")
-	viper.SetDefault("upstreams.concurrencyLimitPerServer", 0)
-	viper.SetDefault("upstreams.keepAliveInterval", "30s")
-	viper.SetDefault("upstreams.maxIdleConnsPerHost", 100)
-	viper.SetDefault("upstreams.scaleToCommonStep", true)
-	viper.SetDefault("graphite09compat", false)
-	viper.SetDefault("expireDelaySec", 600)
-	viper.SetDefault("useCachingDNSResolver", false)
-	viper.SetDefault("logger", map[string]string{})
-	viper.SetDefault("combineMultipleTargetsInOne", false)
-	viper.SetDefault("nudgeStartTimeOnAggregation", false)
-	viper.SetDefault("useBucketsHighestTimestampOnAggregation", false)
-
-	viper.AutomaticEnv()
+		v.SetEnvPrefix(viperPrefix)
+	}
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	_ = v.BindEnv("tz", "carbonapi_tz")
+	v.SetDefault("listeners", []Listener{})
+	v.SetDefault("concurency", 20)
+	v.SetDefault("cache.type", "mem")
+	v.SetDefault("cache.size_mb", 0)
+	v.SetDefault("cache.defaultTimeoutSec", 60)
+	v.SetDefault("cache.memcachedServers", []string{})
+	v.SetDefault("events.type", "null")
+	v.SetDefault("prometheus.enabled", true)
+	v.SetDefault("tracing.enabled", false)
+	v.SetDefault("tracing.endpoint", "http://localhost:4318/v1/traces")
+	v.SetDefault("tracing.serviceName", "carbonapi")
+	v.SetDefault("tracing.timeout", "5s")
+	v.SetDefault("tracing.batchSize", 512)
+	v.SetDefault("tracing.queueSize", 4096)
+	v.SetDefault("tracing.flushInterval", "5s")
+	v.SetDefault("quotas.enabled", false)
+	v.SetDefault("quotas.keyHeader", "")
+	v.SetDefault("quotas.anonymousKey", "anonymous")
+	v.SetDefault("queryLimits.default.maxFindMetrics", 0)
+	v.SetDefault("queryLimits.default.maxFetchedSeries", 0)
+	v.SetDefault("queryLimits.default.maxDatapoints", 0)
+	v.SetDefault("queryLimits.default.maxOutputSeries", 0)
+	v.SetDefault("cpus", 0)
+	v.SetDefault("tz", "")
+	v.SetDefault("sendGlobsAsIs", nil)
+	v.SetDefault("alwaysSendGlobsAsIs", nil)
+	v.SetDefault("extractTagsFromArgs", false)
+	v.SetDefault("maxBatchSize", 100)
+	v.SetDefault("graphite.host", "")
+	v.SetDefault("graphite.interval", "60s")
+	v.SetDefault("graphite.prefix", "carbon.api")
+	v.SetDefault("graphite.pattern", "{prefix}.{fqdn}")
+	v.SetDefault("idleConnections", 10)
+	v.SetDefault("pidFile", "")
+	v.SetDefault("upstreams.internalRoutingCache", "600s")
+	v.SetDefault("upstreams.buckets", 10)
+	v.SetDefault("upstreams.sumBuckets", false)
+	v.SetDefault("upstreams.bucketsWidth", []int64{})
+	v.SetDefault("upstreams.bucketsLabels", []string{})
+	v.SetDefault("upstreams.slowLogThreshold", "1s")
+	v.SetDefault("upstreams.timeouts.find", "2s")
+	v.SetDefault("upstreams.timeouts.render", "10s")
+	v.SetDefault("upstreams.timeouts.connect", "200ms")
+	v.SetDefault("upstreams.concurrencyLimitPerServer", 0)
+	v.SetDefault("upstreams.keepAliveInterval", "30s")
+	v.SetDefault("upstreams.maxIdleConnsPerHost", 100)
+	v.SetDefault("upstreams.scaleToCommonStep", true)
+	v.SetDefault("upstreams.coalesceRequests", false)
+	v.SetDefault("upstreams.fetchCache.enabled", false)
+	v.SetDefault("upstreams.fetchCache.size", 128)
+	v.SetDefault("upstreams.fetchCache.chunkSize", "10m")
+	v.SetDefault("upstreams.fetchCache.mutableWindow", "5m")
+	v.SetDefault("upstreams.fetchCache.ttl", "6h")
+	v.SetDefault("graphite09compat", false)
+	v.SetDefault("expireDelaySec", 600)
+	v.SetDefault("useCachingDNSResolver", false)
+	v.SetDefault("logger", map[string]string{})
+	v.SetDefault("combineMultipleTargetsInOne", false)
+	v.SetDefault("nudgeStartTimeOnAggregation", false)
+	v.SetDefault("useBucketsHighestTimestampOnAggregation", false)
+
+	v.AutomaticEnv()
 
-	var err error
 	if exactConfig {
-		err = viper.UnmarshalExact(&Config)
-	} else {
-		err = viper.Unmarshal(&Config)
+		return v.UnmarshalExact(cfg)
 	}
+	return v.Unmarshal(cfg)
+}
 
-	if err != nil {
-		logger.Fatal("failed to parse config",
-			zap.Error(err),
-		)
+func SetUpConfigUpstreams(logger *zap.Logger) {
+	if err := setUpUpstreams(logger, &Config); err != nil {
+		logger.Fatal(err.Error())
 	}
-
-	fconfig.Config.ExtractTagsFromArgs = Config.ExtractTagsFromArgs
-	fconfig.Config.DefaultTimeZone = Config.DefaultTimeZone
 }
 
-func SetUpConfigUpstreams(logger *zap.Logger) {
-	if Config.Zipper != "" {
+func setUpUpstreams(logger *zap.Logger, cfg *ConfigType) error {
+	if cfg.Zipper != "" {
 		logger.Warn("found legacy 'zipper' option, will use it instead of any 'upstreams' specified. This will be removed in future versions!")
 
-		Config.Upstreams.Backends = []string{Config.Zipper}
-		Config.Upstreams.ConcurrencyLimitPerServer = Config.Concurency
-		Config.Upstreams.MaxIdleConnsPerHost = Config.IdleConnections
-		Config.Upstreams.MaxBatchSize = &Config.MaxBatchSize
-		Config.Upstreams.KeepAliveInterval = 10 * time.Second
-		Config.Upstreams.SlowLogThreshold = 1 * time.Second
+		cfg.Upstreams.Backends = []string{cfg.Zipper}
+		cfg.Upstreams.ConcurrencyLimitPerServer = cfg.Concurency
+		cfg.Upstreams.MaxIdleConnsPerHost = cfg.IdleConnections
+		cfg.Upstreams.MaxBatchSize = &cfg.MaxBatchSize
+		cfg.Upstreams.KeepAliveInterval = 10 * time.Second
+		cfg.Upstreams.SlowLogThreshold = 1 * time.Second
 		// To emulate previous behavior
-		Config.Upstreams.Timeouts = zipperTypes.Timeouts{
+		cfg.Upstreams.Timeouts = zipperTypes.Timeouts{
 			Connect: 1 * time.Second,
 			Render:  600 * time.Second,
 			Find:    600 * time.Second,
 		}
-		Config.Upstreams.ScaleToCommonStep = true
+		cfg.Upstreams.ScaleToCommonStep = true
 	}
-	if len(Config.Upstreams.Backends) == 0 && len(Config.Upstreams.BackendsV2.Backends) == 0 {
-		logger.Fatal("no backends specified for upstreams!")
+	if len(cfg.Upstreams.Backends) == 0 && len(cfg.Upstreams.BackendsV2.Backends) == 0 {
+		return ErrNoBackends
 	}
 
 	oldStyleGlobsUsed := false
 	alwaysSendGlobs := false
 	sendGlobs := false
-	if Config.AlwaysSendGlobsAsIs != nil {
-		alwaysSendGlobs = *Config.AlwaysSendGlobsAsIs
+	if cfg.AlwaysSendGlobsAsIs != nil {
+		alwaysSendGlobs = *cfg.AlwaysSendGlobsAsIs
 		oldStyleGlobsUsed = true
 	}
 
-	if Config.SendGlobsAsIs != nil {
-		alwaysSendGlobs = *Config.SendGlobsAsIs
+	if cfg.SendGlobsAsIs != nil {
+		alwaysSendGlobs = *cfg.SendGlobsAsIs
 		oldStyleGlobsUsed = true
 	}
 
 	if oldStyleGlobsUsed {
 		if alwaysSendGlobs {
-			Config.Upstreams.FallbackMaxBatchSize = 0
+			cfg.Upstreams.FallbackMaxBatchSize = 0
 		} else if sendGlobs {
-			Config.Upstreams.FallbackMaxBatchSize = Config.MaxBatchSize
+			cfg.Upstreams.FallbackMaxBatchSize = cfg.MaxBatchSize
 		} else {
-			Config.Upstreams.FallbackMaxBatchSize = 1
+			cfg.Upstreams.FallbackMaxBatchSize = 1
 		}
 	} else {
-		Config.Upstreams.FallbackMaxBatchSize = Config.MaxBatchSize
+		cfg.Upstreams.FallbackMaxBatchSize = cfg.MaxBatchSize
 	}
 
-	Config.Upstreams = *zipperConfig.SanitizeConfig(logger, Config.Upstreams)
+	cfg.Upstreams = *zipperConfig.SanitizeConfig(logger, cfg.Upstreams)
 
-	if Config.Buckets != 10 {
+	if cfg.Buckets != 10 {
 		logger.Warn("`buckets` config option was moved to `upstreams` section, this will be removed in future releases, please migrate your configuration")
-		Config.Upstreams.Buckets = Config.Buckets
+		cfg.Upstreams.Buckets = cfg.Buckets
 	}
 
 	var err error
-	Config.TruncateTime, err = truncateTimeSlice(Config.TruncateTimeMap)
+	cfg.TruncateTime, err = truncateTimeSlice(cfg.TruncateTimeMap)
 	if err != nil {
 		logger.Warn("`truncateTime` config option is invalid", zap.Error(err))
 	}
+
+	return nil
 }
@@ -0,0 +1,315 @@
+package config
+
+import (
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ansel1/merry"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/cache"
+	"github.com/go-graphite/carbonapi/expr/functions"
+	"github.com/go-graphite/carbonapi/expr/functions/cairo/png"
+	"github.com/go-graphite/carbonapi/expr/metadata"
+	"github.com/go-graphite/carbonapi/expr/rewrite"
+	tconfig "github.com/go-graphite/carbonapi/expr/types/config"
+	"github.com/go-graphite/carbonapi/limiter"
+	"github.com/go-graphite/carbonapi/pkg/parser"
+	zipper "github.com/go-graphite/carbonapi/zipper/interfaces"
+)
+
+var (
+	ErrReloadNotSupported = errors.New("config reload is not supported")
+	ErrNoConfigFile       = errors.New("config file was not specified on startup")
+)
+
+// ZipperFactory creates zipper for the given configuration
+type ZipperFactory func(cfg *ConfigType) (zipper.CarbonZipper, error)
+
+var reloadParams struct {
+	sync.Mutex
+
+	configPath  string
+	exactConfig bool
+	envPrefix   string
+	newZipper   ZipperFactory
+}
+
+// SetZipperFactory enables config reload. Factory is used to create zipper for the new config.
+func SetZipperFactory(f ZipperFactory) {
+	reloadParams.Lock()
+	reloadParams.newZipper = f
+	reloadParams.Unlock()
+}
+
+// restartOnlyOptions are applied only on startup (listeners, loggers, registered handlers, etc.),
+// values from the running config are kept on reload.
+var restartOnlyOptions = []string{
+	"Logger",
+	"Listen",
+	"Listeners",
+	"Prefix",
+	"HeadersToPass",
+	"HeadersToLog",
+	"Expvar",
+	"Prometheus",
+	"Tracing",
+	"Admin",
+	"EventsConfig",
+	"Graphite",
+	"Cpus",
+	"PidFile",
+	"UnicodeRangeTables",
+	"DefaultColors",
+	"UseCachingDNSResolver",
+	"CachingDNSRefreshTime",
+}
+
+// keepRestartOnlyOptions copies restartOnlyOptions from running config and warns about changed ones
+func keepRestartOnlyOptions(logger *zap.Logger, running, cfg *ConfigType) {
+	rv := reflect.ValueOf(running).Elem()
+	cv := reflect.ValueOf(cfg).Elem()
+	t := cv.Type()
+	for _, name := range restartOnlyOptions {
+		f, _ := t.FieldByName(name)
+		rf := rv.FieldByName(name)
+		cf := cv.FieldByName(name)
+		if !reflect.DeepEqual(rf.Interface(), cf.Interface()) {
+			option, _, _ := strings.Cut(f.Tag.Get("mapstructure"), ",")
+			logger.Warn("option can't be changed without restart, change will be ignored",
+				zap.String("option", option),
+			)
+		}
+		cf.Set(rf)
+	}
+}
+
+// reuseCache returns running cache if it's config is not changed or creates a new one
+func reuseCache(logger *zap.Logger, cacheName string, runningConfig CacheConfig, running cache.BytesCache, cacheConfig *CacheConfig) (cache.BytesCache, error) {
+	if cacheConfig.DefaultTimeoutSec > 0 || cacheConfig.ShortTimeoutSec > 0 {
+		normalizeCacheConfig(cacheConfig)
+	}
+	if running != nil && reflect.DeepEqual(runningConfig, *cacheConfig) {
+		return running, nil
+	}
+	return createCache(logger, cacheName, cacheConfig)
+}
+
+func closeZipper(logger *zap.Logger, z zipper.CarbonZipper) {
+	if c, ok := z.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			logger.Warn("failed to close zipper", zap.Error(err))
+		}
+	}
+}
+
+func closeCache(logger *zap.Logger, c cache.BytesCache) {
+	if c == nil {
+		return
+	}
+	if err := cache.Close(c); err != nil {
+		logger.Warn("failed to close cache", zap.Error(err))
+	}
+}
+
+// generation counts requests, that use the config. Resources of replaced config are closed, when the last of them
+// is finished.
+type generation struct {
+	// refs is a count of requests, plus one while the config is running
+	refs atomic.Int64
+	// retired is called once, when config is replaced and isn't used anymore
+	retired func()
+}
+
+func newGeneration() *generation {
+	g := &generation{}
+	g.refs.Store(1)
+	return g
+}
+
+// acquire marks config as used, if it's not closed yet
+func (g *generation) acquire() bool {
+	if g == nil {
+		return true
+	}
+	for {
+		n := g.refs.Load()
+		if n == 0 {
+			return false
+		}
+		if g.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (g *generation) release() {
+	if g != nil && g.refs.Add(-1) == 0 {
+		g.retired()
+	}
+}
+
+// retire calls f, when requests using the replaced config are finished
+func (g *generation) retire(f func()) {
+	if g == nil {
+		f()
+		return
+	}
+	g.retired = f
+	g.release()
+}
+
+// closeUnused closes caches and zipper of cfg, that are not used by running config
+func closeUnused(logger *zap.Logger, running, cfg *ConfigType) {
+	if cfg.ResponseCache != running.ResponseCache {
+		closeCache(logger, cfg.ResponseCache)
+	}
+	if cfg.BackendCache != running.BackendCache {
+		closeCache(logger, cfg.BackendCache)
+	}
+	if cfg.ZipperInstance != nil && cfg.ZipperInstance != running.ZipperInstance {
+		closeZipper(logger, cfg.ZipperInstance)
+	}
+}
+
+// Reload reads config file again and replaces running config. Zipper, evaluator, caches (if their settings are changed),
+// graph templates, defines and functions configs are recreated, requests in progress are finished with the old ones.
+// Everything is validated before any resource is created, running config is kept and new resources are closed in case
+// of any error.
+func Reload(logger *zap.Logger) error {
+	reloadParams.Lock()
+	defer reloadParams.Unlock()
+
+	if reloadParams.newZipper == nil {
+		return ErrReloadNotSupported
+	}
+	if reloadParams.configPath == "" {
+		return ErrNoConfigFile
+	}
+
+	logger = logger.With(zap.String("config_path", reloadParams.configPath))
+
+	running := Current()
+	cfg := DefaultConfig()
+
+	v := viper.New()
+	if err := readConfig(logger, v, reloadParams.configPath, reloadParams.exactConfig, reloadParams.envPrefix, &cfg); err != nil {
+		return merry.Prepend(err, "failed to parse config")
+	}
+	setUpFromViper(v, &cfg)
+	setUpListeners(&cfg)
+	keepRestartOnlyOptions(logger, running, &cfg)
+	cfg.Events = running.Events
+
+	if err := setUpUpstreams(logger, &cfg); err != nil {
+		return err
+	}
+
+	if cfg.TimezoneString != "" {
+		tz, err := parseTimezone(cfg.TimezoneString)
+		if err != nil {
+			return err
+		}
+		cfg.DefaultTimeZone = tz
+	}
+
+	defines, err := getDefines(&cfg)
+	if err != nil {
+		return err
+	}
+	compiledDefines, err := parser.CompileDefines(defines)
+	if err != nil {
+		return merry.Prepend(err, "unable to compile define template")
+	}
+
+	var templates map[string]png.PictureParams
+	if cfg.GraphTemplates != "" {
+		templates, err = loadGraphTemplates(logger, cfg.GraphTemplates)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.FunctionsConfigs == nil {
+		cfg.FunctionsConfigs = make(map[string]string)
+	}
+	for name, path := range cfg.FunctionsConfigs {
+		if _, err := os.Stat(path); err != nil {
+			return merry.Prependf(err, "function %s config", name)
+		}
+	}
+	// functions stop the process on invalid config, so it must be checked before they are initialized
+	if err := functions.ValidateConfigs(cfg.FunctionsConfigs); err != nil {
+		return err
+	}
+
+	if err := cfg.Quotas.ParseTrustedProxies(); err != nil {
+		return err
+	}
+	if err := validateCacheConfig("cache", &cfg.ResponseCacheConfig); err != nil {
+		return err
+	}
+	if err := validateCacheConfig("backendCache", &cfg.BackendCacheConfig); err != nil {
+		return err
+	}
+
+	// all checks are passed, create resources
+	cfg.ResponseCache, err = reuseCache(logger, "cache", running.ResponseCacheConfig, running.ResponseCache, &cfg.ResponseCacheConfig)
+	if err != nil {
+		return err
+	}
+	cfg.BackendCache, err = reuseCache(logger, "backendCache", running.BackendCacheConfig, running.BackendCache, &cfg.BackendCacheConfig)
+	if err != nil {
+		closeUnused(logger, running, &cfg)
+		return err
+	}
+
+	if cfg.Concurency == running.Concurency && running.Limiter != nil {
+		cfg.Limiter = running.Limiter
+	} else {
+		cfg.Limiter = limiter.NewSimpleLimiter(cfg.Concurency)
+	}
+
+	// keep state of quotas (requests in progress, tokens) if they are not changed
+	if reflect.DeepEqual(cfg.Quotas, running.Quotas) {
+		cfg.QuotaLimiter = running.QuotaLimiter
+	} else {
+		cfg.QuotaLimiter = newQuotaLimiter(&cfg.Quotas)
+	}
+
+	z, err := reloadParams.newZipper(&cfg)
+	if err != nil {
+		closeUnused(logger, running, &cfg)
+		return merry.Prepend(err, "failed to setup zipper")
+	}
+	if err = cfg.SetZipper(z); err != nil {
+		closeUnused(logger, running, &cfg)
+		return err
+	}
+
+	// new state is built, swap it in. Nothing can fail from now on.
+	parser.UseDefines(compiledDefines)
+	png.ReplaceTemplates(templates)
+	metadata.ReplaceFunctions(func() {
+		rewrite.New(cfg.FunctionsConfigs)
+		functions.New(cfg.FunctionsConfigs)
+	})
+	tconfig.Replace(exprConfig(&cfg))
+	cfg.gen = newGeneration()
+	current.Store(&cfg)
+
+	// requests in progress are finished with resources of the running config
+	running.gen.retire(func() {
+		closeUnused(logger, &cfg, running)
+	})
+
+	logger.Info("config reloaded")
+
+	return nil
+}
@@ -0,0 +1,219 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ansel1/merry"
+	pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/cache"
+	"github.com/go-graphite/carbonapi/expr/metadata"
+	"github.com/go-graphite/carbonapi/expr/types"
+	"github.com/go-graphite/carbonapi/pkg/parser"
+	zipper "github.com/go-graphite/carbonapi/zipper/interfaces"
+	zipperTypes "github.com/go-graphite/carbonapi/zipper/types"
+)
+
+type mockZipper struct {
+	closed bool
+}
+
+func (z *mockZipper) Find(context.Context, pb.MultiGlobRequest) (*pb.MultiGlobResponse, *zipperTypes.Stats, merry.Error) {
+	return nil, nil, nil
+}
+
+func (z *mockZipper) Info(context.Context, []string) (*pb.ZipperInfoResponse, *zipperTypes.Stats, merry.Error) {
+	return nil, nil, nil
+}
+
+func (z *mockZipper) RenderCompat(context.Context, []string, int64, int64) ([]*types.MetricData, *zipperTypes.Stats, merry.Error) {
+	return nil, nil, nil
+}
+
+func (z *mockZipper) Render(context.Context, pb.MultiFetchRequest) ([]*types.MetricData, *zipperTypes.Stats, merry.Error) {
+	return nil, nil, nil
+}
+
+func (z *mockZipper) TagNames(context.Context, string, int64) ([]string, merry.Error) {
+	return nil, nil
+}
+
+func (z *mockZipper) TagValues(context.Context, string, int64) ([]string, merry.Error) {
+	return nil, nil
+}
+
+func (z *mockZipper) ScaleToCommonStep() bool {
+	return false
+}
+
+func (z *mockZipper) Close() error {
+	z.closed = true
+	return nil
+}
+
+const reloadTestConfig = `
+listen: "127.0.0.1:8081"
+concurency: 10
+notFoundStatusCode: %d
+cache:
+  type: "mem"
+  size_mb: %d
+  defaultTimeoutSec: 60
+define:
+  - name: "perMinute"
+    template: "perSecond({{.argString}})|scale(60)"
+upstreams:
+  tldCacheDisabled: true
+  backends:
+    - "http://127.0.0.1:8080"
+`
+
+func writeConfig(t *testing.T, path, format string, args ...interface{}) {
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(format, args...)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	logger := zap.NewNop()
+	path := filepath.Join(t.TempDir(), "carbonapi.yaml")
+	writeConfig(t, path, reloadTestConfig, 200, 10)
+
+	saved := Current()
+	defer current.Store(saved)
+
+	var zippers []*mockZipper
+	SetZipperFactory(func(cfg *ConfigType) (zipper.CarbonZipper, error) {
+		z := &mockZipper{}
+		zippers = append(zippers, z)
+		return z, nil
+	})
+	defer SetZipperFactory(nil)
+
+	reloadParams.configPath = ""
+	assert.ErrorIs(t, Reload(logger), ErrNoConfigFile)
+
+	reloadParams.configPath = path
+	if !assert.NoError(t, Reload(logger)) {
+		return
+	}
+	first := Current()
+	assert.NotEqual(t, saved, first)
+	assert.Equal(t, 200, first.NotFoundStatusCode)
+	assert.Equal(t, zippers[0], first.ZipperInstance)
+	assert.NotNil(t, first.Evaluator)
+	assert.IsType(t, &cache.ExpireCache{}, first.ResponseCache)
+	// restart-only options are kept from running config
+	assert.Equal(t, saved.Listen, first.Listen)
+
+	exp, _, err := parser.ParseExpr("perMinute(a.b)")
+	assert.NoError(t, err)
+	assert.Equal(t, "scale", exp.Target())
+
+	// cache settings are not changed, so cache must be reused
+	writeConfig(t, path, reloadTestConfig, 404, 10)
+	if !assert.NoError(t, Reload(logger)) {
+		return
+	}
+	second := Current()
+	assert.Equal(t, 404, second.NotFoundStatusCode)
+	assert.Same(t, first.ResponseCache, second.ResponseCache)
+	assert.Equal(t, first.Limiter, second.Limiter)
+	assert.True(t, zippers[0].closed)
+	assert.False(t, zippers[1].closed)
+
+	writeConfig(t, path, reloadTestConfig, 404, 20)
+	if !assert.NoError(t, Reload(logger)) {
+		return
+	}
+	assert.NotSame(t, second.ResponseCache, Current().ResponseCache)
+
+	// functions are registered again
+	metadata.FunctionMD.RLock()
+	assert.Contains(t, metadata.FunctionMD.Functions, "perSecond")
+	metadata.FunctionMD.RUnlock()
+
+	// invalid configs are rejected and running one is kept
+	running := Current()
+	created := len(zippers)
+	for _, broken := range []string{
+		"upstreams: [",
+		"upstreams:\n  backends: []\n",
+		"cache:\n  type: unknown\n  defaultTimeoutSec: 60\nupstreams:\n  backends:\n    - \"http://127.0.0.1:8080\"\n",
+		"tz: \"UTC\"\nupstreams:\n  backends:\n    - \"http://127.0.0.1:8080\"\n",
+		"define:\n  - name: \"broken\"\n    template: \"{{.args\"\nupstreams:\n  backends:\n    - \"http://127.0.0.1:8080\"\n",
+	} {
+		writeConfig(t, path, "%s", broken)
+		assert.Error(t, Reload(logger), broken)
+		assert.Same(t, running, Current(), broken)
+	}
+	// functions stop the process on invalid config, so it's rejected before they are initialized
+	functionConfig := filepath.Join(t.TempDir(), "moving.yaml")
+	writeConfig(t, functionConfig, "returnNaNsIfStepMismatch: [1, 2]\n")
+	writeConfig(t, path, "functionsConfig:\n  moving: %q\n"+reloadTestConfig, functionConfig, 404, 30)
+	assert.Error(t, Reload(logger))
+	assert.Same(t, running, Current())
+
+	assert.False(t, running.ZipperInstance.(*mockZipper).closed)
+	// configs are validated before zipper is created
+	assert.Len(t, zippers, created)
+
+	// config is rejected, if zipper can't be created
+	writeConfig(t, path, reloadTestConfig, 404, 30)
+	SetZipperFactory(func(cfg *ConfigType) (zipper.CarbonZipper, error) {
+		return nil, errors.New("no backends")
+	})
+	assert.Error(t, Reload(logger))
+	assert.Same(t, running, Current())
+	exp, _, err = parser.ParseExpr("perMinute(a.b)")
+	assert.NoError(t, err)
+	assert.Equal(t, "scale", exp.Target())
+}
+
+func TestReloadInFlightRequests(t *testing.T) {
+	logger := zap.NewNop()
+	path := filepath.Join(t.TempDir(), "carbonapi.yaml")
+	writeConfig(t, path, reloadTestConfig, 200, 10)
+
+	saved := Current()
+	defer current.Store(saved)
+
+	SetZipperFactory(func(cfg *ConfigType) (zipper.CarbonZipper, error) {
+		return &mockZipper{}, nil
+	})
+	defer SetZipperFactory(nil)
+	reloadParams.configPath = path
+
+	if !assert.NoError(t, Reload(logger)) {
+		return
+	}
+
+	// request is started with the first config and isn't finished before reload
+	first := Acquire()
+	ctx := NewContext(context.Background(), first)
+	writeConfig(t, path, reloadTestConfig, 200, 20)
+	if !assert.NoError(t, Reload(logger)) {
+		return
+	}
+	assert.NotSame(t, first, Current())
+	assert.Same(t, first, FromContext(ctx))
+	assert.False(t, first.ZipperInstance.(*mockZipper).closed)
+
+	// resources of the replaced config are closed, when the last request is finished
+	first.Release()
+	assert.True(t, first.ZipperInstance.(*mockZipper).closed)
+	assert.False(t, Current().ZipperInstance.(*mockZipper).closed)
+	assert.Same(t, Current(), FromContext(context.Background()))
+
+	// replaced config can't be acquired anymore
+	second := Acquire()
+	assert.Same(t, Current(), second)
+	second.Release()
+}
@@ -71,6 +71,8 @@ func setupGraphiteMetrics(logger *zap.Logger) {
 
 		metrics.Register("request_cache_hits", http.ApiMetrics.RequestCacheHits)
 		metrics.Register("request_cache_misses", http.ApiMetrics.RequestCacheMisses)
+		metrics.Register("request_cache_stale_hits", http.ApiMetrics.RequestCacheStaleHits)
+		metrics.Register("request_cache_refreshes", http.ApiMetrics.RequestCacheRefreshes)
 		metrics.Register("request_cache_overhead_ns", http.ApiMetrics.RequestsCacheOverheadNS)
 		metrics.Register("backend_cache_hits", http.ApiMetrics.BackendCacheHits)
 		metrics.Register("backend_cache_misses", http.ApiMetrics.BackendCacheMisses)
@@ -91,9 +93,29 @@ func setupGraphiteMetrics(logger *zap.Logger) {
 		metrics.Register("find_requests", http.ApiMetrics.FindRequests)
 		metrics.Register("render_requests", http.ApiMetrics.RenderRequests)
 
+		if config.Config.Quotas.Enabled {
+			metrics.Register("quota_rejected.concurrency", http.ApiMetrics.QuotaRejectedConcurrency)
+			metrics.Register("quota_rejected.rate", http.ApiMetrics.QuotaRejectedRate)
+		}
+
 		if http.ApiMetrics.MemcacheTimeouts != nil {
 			metrics.Register("memcache_timeouts", http.ApiMetrics.MemcacheTimeouts)
 		}
+		if http.ApiMetrics.RedisTimeouts != nil {
+			metrics.Register("redis_timeouts", http.ApiMetrics.RedisTimeouts)
+		}
+		if tiers := http.ApiMetrics.RequestCacheTiers; tiers != nil {
+			metrics.Register("request_cache_l1_hits", tiers.L1Hits)
+			metrics.Register("request_cache_l1_misses", tiers.L1Misses)
+			metrics.Register("request_cache_l2_hits", tiers.L2Hits)
+			metrics.Register("request_cache_l2_misses", tiers.L2Misses)
+		}
+		if tiers := http.ApiMetrics.BackendCacheTiers; tiers != nil {
+			metrics.Register("backend_cache_l1_hits", tiers.L1Hits)
+			metrics.Register("backend_cache_l1_misses", tiers.L1Misses)
+			metrics.Register("backend_cache_l2_hits", tiers.L2Hits)
+			metrics.Register("backend_cache_l2_misses", tiers.L2Misses)
+		}
 
 		if http.ApiMetrics.CacheSize != nil {
 			metrics.Register("cache_size", http.ApiMetrics.CacheSize)
@@ -113,6 +135,13 @@ func setupGraphiteMetrics(logger *zap.Logger) {
 
 		metrics.Register("zipper.cache_hits", http.ZipperMetrics.CacheHits)
 		metrics.Register("zipper.cache_misses", http.ZipperMetrics.CacheMisses)
+		metrics.Register("zipper.coalesce_hits", http.ZipperMetrics.CoalesceHits)
+		metrics.Register("zipper.coalesce_misses", http.ZipperMetrics.CoalesceMisses)
+		metrics.Register("zipper.fetch_cache_hits", http.ZipperMetrics.FetchCacheHits)
+		metrics.Register("zipper.fetch_cache_misses", http.ZipperMetrics.FetchCacheMisses)
+		metrics.Register("zipper.ejected_requests", http.ZipperMetrics.EjectedRequests)
+		metrics.Register("zipper.hedged_requests", http.ZipperMetrics.HedgedRequests)
+		metrics.Register("zipper.hedge_wins", http.ZipperMetrics.HedgeWins)
 
 		metrics.RegisterRuntimeMemStats(nil)
 		go metrics.CaptureRuntimeMemStats(config.Config.Graphite.Interval)
@@ -0,0 +1,99 @@
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/lomik/zapwriter"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+	"github.com/go-graphite/carbonapi/zipper/breaker"
+)
+
+type adminResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func writeAdminResponse(w http.ResponseWriter, code int, err error) {
+	resp := adminResponse{Status: "ok"}
+	if err != nil {
+		resp.Status = "error"
+		resp.Error = err.Error()
+	}
+	writeAdminJSON(w, code, resp)
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, resp interface{}) {
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(code)
+	_, _ = w.Write(b)
+}
+
+// adminAuth allows only requests with admin token in Authorization header
+func adminAuth(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := config.Current().Admin.Token
+		auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="carbonapi"`)
+			writeAdminResponse(w, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
+			return
+		}
+
+		fn(w, r)
+	}
+}
+
+func configReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAdminResponse(w, http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+		return
+	}
+
+	logger := zapwriter.Logger("admin")
+	logger.Info("reloading config",
+		zap.String("peer", r.RemoteAddr),
+	)
+	if err := configReload(logger); err != nil {
+		logger.Error("failed to reload config, running config is kept",
+			zap.Error(err),
+		)
+		code := http.StatusUnprocessableEntity
+		if errors.Is(err, config.ErrReloadNotSupported) || errors.Is(err, config.ErrNoConfigFile) {
+			code = http.StatusNotImplemented
+		}
+		writeAdminResponse(w, code, err)
+		return
+	}
+
+	writeAdminResponse(w, http.StatusOK, nil)
+}
+
+// configReload is replaced in tests
+var configReload = config.Reload
+
+type backendsResponse struct {
+	Servers []breaker.Status `json:"servers"`
+}
+
+// backendsHandler returns state of circuit breakers of backend servers
+func backendsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeAdminResponse(w, http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+		return
+	}
+
+	resp := backendsResponse{Servers: []breaker.Status{}}
+	breaker.Each(func(b *breaker.Breaker) {
+		resp.Servers = append(resp.Servers, b.Status())
+	})
+	writeAdminJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,72 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+)
+
+func TestConfigReloadHandler(t *testing.T) {
+	savedToken := config.Config.Admin.Token
+	savedReload := configReload
+	defer func() {
+		config.Config.Admin.Token = savedToken
+		configReload = savedReload
+	}()
+
+	var reloadErr error
+	reloads := 0
+	configReload = func(*zap.Logger) error {
+		reloads++
+		return reloadErr
+	}
+	handler := adminAuth(configReloadHandler)
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		auth   string
+		err    error
+		code   int
+	}{
+		{name: "disabled", method: http.MethodPost, auth: "Bearer ", code: http.StatusUnauthorized},
+		{name: "no auth", token: "secret", method: http.MethodPost, code: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", method: http.MethodPost, auth: "Bearer wrong", code: http.StatusUnauthorized},
+		{name: "wrong method", token: "secret", method: http.MethodGet, auth: "Bearer secret", code: http.StatusMethodNotAllowed},
+		{name: "ok", token: "secret", method: http.MethodPost, auth: "Bearer secret", code: http.StatusOK},
+		{name: "invalid config", token: "secret", method: http.MethodPost, auth: "Bearer secret", err: errors.New("no backends"), code: http.StatusUnprocessableEntity},
+		{name: "no config file", token: "secret", method: http.MethodPost, auth: "Bearer secret", err: config.ErrNoConfigFile, code: http.StatusNotImplemented},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.Admin.Token = tt.token
+			reloadErr = tt.err
+			reloads = 0
+
+			req, rr := setUpRequest(t, "/admin/config/reload")
+			req.Method = tt.method
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			handler(rr, req)
+
+			assert.Equal(t, tt.code, rr.Code)
+			assert.Equal(t, contentTypeJSON, rr.Header().Get("Content-Type"))
+			if tt.code == http.StatusOK {
+				assert.Equal(t, 1, reloads)
+				assert.JSONEq(t, `{"status":"ok"}`, rr.Body.String())
+			} else if tt.err != nil {
+				assert.Equal(t, 1, reloads)
+				assert.Contains(t, rr.Body.String(), tt.err.Error())
+			} else {
+				assert.Equal(t, 0, reloads)
+			}
+		})
+	}
+}
@@ -0,0 +1,368 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/lomik/zapwriter"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/cache"
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+	"github.com/go-graphite/carbonapi/pathcache"
+)
+
+// maxWarmURLs limits count of render requests in a single warm up request
+const maxWarmURLs = 1000
+
+var errNoKeyIndex = errors.New("cache has no key index, set keyIndexSize to purge by target")
+
+type cacheStats struct {
+	Type        string  `json:"type"`
+	Items       *int64  `json:"items,omitempty"`
+	SizeBytes   *uint64 `json:"sizeBytes,omitempty"`
+	IndexedKeys *int    `json:"indexedKeys,omitempty"`
+	Hits        uint64  `json:"hits"`
+	StaleHits   uint64  `json:"staleHits,omitempty"`
+	Misses      uint64  `json:"misses"`
+	HitRatio    float64 `json:"hitRatio"`
+}
+
+type pathCacheStats struct {
+	Group     string  `json:"group"`
+	Items     int     `json:"items"`
+	SizeBytes uint64  `json:"sizeBytes"`
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	HitRatio  float64 `json:"hitRatio"`
+}
+
+type cacheStatsResponse struct {
+	Response cacheStats       `json:"response"`
+	Backend  cacheStats       `json:"backend"`
+	Path     []pathCacheStats `json:"path"`
+}
+
+type cachePurgeResponse struct {
+	Status string         `json:"status"`
+	Error  string         `json:"error,omitempty"`
+	Purged map[string]int `json:"purged"`
+}
+
+type cacheWarmResponse struct {
+	Status string   `json:"status"`
+	Warmed int      `json:"warmed"`
+	Failed int      `json:"failed"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+func hitRatio(hits, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+func getCacheStats(cacheType string, c cache.BytesCache, hits, misses uint64) cacheStats {
+	s := cacheStats{Type: cacheType, Hits: hits, Misses: misses, HitRatio: hitRatio(hits, misses)}
+	if i, ok := c.(*cache.IndexedCache); ok {
+		// index of shared cache can be unavailable, count is omitted then
+		if keys, err := i.Keys(); err == nil {
+			s.IndexedKeys = &keys
+		}
+	}
+	c = unindexed(c)
+	if t, ok := c.(*cache.TwoTierCache); ok {
+		c = t.L2()
+	}
+	if sc, ok := c.(sizedCache); ok {
+		items, size := int64(sc.Items()), sc.Size()
+		s.Items, s.SizeBytes = &items, &size
+	}
+	return s
+}
+
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeAdminResponse(w, http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+		return
+	}
+
+	cfg := config.Acquire()
+	defer cfg.Release()
+	staleHits := ApiMetrics.RequestCacheStaleHits.Count()
+	resp := cacheStatsResponse{
+		Response: getCacheStats(cfg.ResponseCacheConfig.Type, cfg.ResponseCache,
+			ApiMetrics.RequestCacheHits.Count()+staleHits, ApiMetrics.RequestCacheMisses.Count()),
+		Backend: getCacheStats(cfg.BackendCacheConfig.Type, cfg.BackendCache,
+			ApiMetrics.BackendCacheHits.Count(), ApiMetrics.BackendCacheMisses.Count()),
+		Path: []pathCacheStats{},
+	}
+	resp.Response.StaleHits = staleHits
+	pathcache.Each(func(group string, p pathcache.PathCache) {
+		hits, misses := p.Stats()
+		resp.Path = append(resp.Path, pathCacheStats{
+			Group:     group,
+			Items:     p.ECItems(),
+			SizeBytes: p.ECSize(),
+			Hits:      hits,
+			Misses:    misses,
+			HitRatio:  hitRatio(hits, misses),
+		})
+	})
+
+	writeAdminJSON(w, http.StatusOK, resp)
+}
+
+// globToRegexp converts graphite glob to regexp, matching the whole string. Unlike in metric names, * matches dots.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+	inBraces := false
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '*':
+			re.WriteString(".*")
+		case c == '?':
+			re.WriteString(".")
+		case c == '{' && !inBraces:
+			inBraces = true
+			re.WriteString("(?:")
+		case c == '}' && inBraces:
+			inBraces = false
+			re.WriteString(")")
+		case c == ',' && inBraces:
+			re.WriteString("|")
+		case c == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end == -1 {
+				return nil, errors.New("unclosed '[' in glob")
+			}
+			re.WriteString(glob[i : i+end+1])
+			i += end
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if inBraces {
+		return nil, errors.New("unclosed '{' in glob")
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// purgeMatcher returns function to match cache entries by targets, nil if all entries should be purged
+func purgeMatcher(r *http.Request) (func(key string, targets []string) bool, error) {
+	var re *regexp.Regexp
+	var err error
+	switch {
+	case r.FormValue("target") != "":
+		re, err = globToRegexp(r.FormValue("target"))
+	case r.FormValue("regex") != "":
+		re, err = regexp.Compile(r.FormValue("regex"))
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func(_ string, targets []string) bool {
+		for _, target := range targets {
+			if re.MatchString(target) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func purgeCache(c cache.BytesCache, key string, match func(key string, targets []string) bool) (int, error) {
+	if _, ok := c.(cache.NullCache); ok {
+		return 0, nil
+	}
+	if key != "" {
+		d, ok := c.(cache.Deleter)
+		if !ok {
+			return 0, errors.New("cache doesn't support deletion")
+		}
+		return 1, d.Delete(key)
+	}
+	i, ok := c.(*cache.IndexedCache)
+	if !ok {
+		return 0, errNoKeyIndex
+	}
+	if match == nil {
+		match = func(string, []string) bool { return true }
+	}
+	return i.Purge(match)
+}
+
+func cachePurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAdminResponse(w, http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeAdminResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	key := r.FormValue("key")
+	match, err := purgeMatcher(r)
+	if err != nil {
+		writeAdminResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if key == "" && match == nil && r.FormValue("all") == "" {
+		writeAdminResponse(w, http.StatusBadRequest, errors.New("one of key, target, regex or all must be specified"))
+		return
+	}
+
+	names := []string{"response", "backend", "path"}
+	if c := r.FormValue("cache"); c != "" && c != "all" {
+		names = strings.Split(c, ",")
+		for _, name := range names {
+			if name != "response" && name != "backend" && name != "path" {
+				writeAdminResponse(w, http.StatusBadRequest, errors.New("unknown cache '"+name+"', supported: response, backend, path"))
+				return
+			}
+		}
+	}
+
+	logger := zapwriter.Logger("admin")
+	cfg := config.Acquire()
+	defer cfg.Release()
+	resp := cachePurgeResponse{Status: "ok", Purged: make(map[string]int)}
+	code := http.StatusOK
+	for _, name := range names {
+		var n int
+		var err error
+		switch name {
+		case "response":
+			n, err = purgeCache(cfg.ResponseCache, key, match)
+		case "backend":
+			n, err = purgeCache(cfg.BackendCache, key, match)
+		case "path":
+			if key != "" || match != nil {
+				// path cache is keyed by top level domains, it can only be purged entirely
+				continue
+			}
+			pathcache.Each(func(_ string, p pathcache.PathCache) {
+				n += p.Purge()
+			})
+		}
+		resp.Purged[name] = n
+		if err != nil {
+			resp.Status = "error"
+			resp.Error = name + ": " + err.Error()
+			code = http.StatusInternalServerError
+			if errors.Is(err, errNoKeyIndex) {
+				code = http.StatusNotImplemented
+			}
+		}
+	}
+
+	logger.Info("cache purged",
+		zap.String("peer", r.RemoteAddr),
+		zap.String("key", key),
+		zap.String("target", r.FormValue("target")),
+		zap.String("regex", r.FormValue("regex")),
+		zap.Any("purged", resp.Purged),
+		zap.String("error", resp.Error),
+	)
+	writeAdminJSON(w, code, resp)
+}
+
+// warmURLs returns render URLs from url params and request body, one URL per line
+func warmURLs(r *http.Request) ([]string, error) {
+	urls := r.URL.Query()["url"]
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			urls = append(urls, line)
+		}
+	}
+	return urls, scanner.Err()
+}
+
+func cacheWarmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAdminResponse(w, http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+		return
+	}
+
+	urls, err := warmURLs(r)
+	if err != nil {
+		writeAdminResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(urls) == 0 {
+		writeAdminResponse(w, http.StatusBadRequest, errors.New("no render urls specified"))
+		return
+	}
+	if len(urls) > maxWarmURLs {
+		writeAdminResponse(w, http.StatusBadRequest, errors.New("too many render urls"))
+		return
+	}
+
+	// responses are rendered again and stored in the caches, even if they are cached already. Requests are rendered by
+	// refresh workers, so warm up doesn't render more responses at once than background refreshes do.
+	ctx := context.WithValue(r.Context(), refreshContextKey{}, true)
+	resp := cacheWarmResponse{Status: "ok"}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	fail := func(u, msg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		resp.Failed++
+		resp.Errors = append(resp.Errors, u+": "+msg)
+	}
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err == nil && !strings.HasSuffix(strings.TrimSuffix(parsed.Path, "/"), "/render") {
+			err = errors.New("not a render url")
+		}
+		var req *http.Request
+		if err == nil {
+			req, err = http.NewRequestWithContext(ctx, http.MethodGet, parsed.RequestURI(), nil)
+		}
+		if err == nil {
+			wg.Add(1)
+			err = warmResponse(r.Context(), req, func(code int) {
+				defer wg.Done()
+				if code != http.StatusOK {
+					fail(u, http.StatusText(code))
+					return
+				}
+				mu.Lock()
+				resp.Warmed++
+				mu.Unlock()
+			})
+			if err != nil {
+				wg.Done()
+			}
+		}
+		if err != nil {
+			fail(u, err.Error())
+		}
+	}
+	wg.Wait()
+
+	zapwriter.Logger("admin").Info("cache warmed up",
+		zap.String("peer", r.RemoteAddr),
+		zap.Int("warmed", resp.Warmed),
+		zap.Int("failed", resp.Failed),
+	)
+	writeAdminJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,125 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-graphite/carbonapi/cache"
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+	"github.com/go-graphite/carbonapi/pathcache"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		matches []string
+		misses  []string
+	}{
+		{glob: "foo.bar", matches: []string{"foo.bar"}, misses: []string{"foo_bar", "foo.bar.baz"}},
+		{glob: "*foo.*", matches: []string{"sumSeries(foo.bar)", "foo.bar.baz"}, misses: []string{"bar.baz"}},
+		{glob: "foo.{bar,baz}", matches: []string{"foo.bar", "foo.baz"}, misses: []string{"foo.qux"}},
+		{glob: "foo.ba[rz]?", matches: []string{"foo.bar1", "foo.baz2"}, misses: []string{"foo.bar"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.glob, func(t *testing.T) {
+			re, err := globToRegexp(tt.glob)
+			if !assert.NoError(t, err) {
+				return
+			}
+			for _, s := range tt.matches {
+				assert.True(t, re.MatchString(s), s)
+			}
+			for _, s := range tt.misses {
+				assert.False(t, re.MatchString(s), s)
+			}
+		})
+	}
+
+	_, err := globToRegexp("foo.{bar")
+	assert.Error(t, err)
+}
+
+func TestCacheAdminHandlers(t *testing.T) {
+	savedCache, savedCacheConfig := config.Config.ResponseCache, config.Config.ResponseCacheConfig
+	defer func() {
+		config.Config.ResponseCache, config.Config.ResponseCacheConfig = savedCache, savedCacheConfig
+	}()
+	responseCache := cache.NewIndexed(cache.NewExpireCache(1024*1024), 100)
+	config.Config.ResponseCache = responseCache
+	config.Config.ResponseCacheConfig.Type = "mem"
+	config.Config.ResponseCacheConfig.DefaultTimeoutSec = 60
+
+	render := func(target string) string {
+		req, rr := setUpRequest(t, "/render/?target="+target+"&from=-10minutes&format=json")
+		renderHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		return rr.Header().Get("X-Carbonapi-Cache")
+	}
+	admin := func(handler http.HandlerFunc, method, url, body string) map[string]interface{} {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var resp map[string]interface{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		return resp
+	}
+
+	render("foo.bar")
+	render("sumSeries(foo.bar)")
+	assert.Equal(t, cacheStatusHit, render("foo.bar"))
+
+	stats := admin(cacheStatsHandler, http.MethodGet, "/admin/cache/stats", "")
+	response := stats["response"].(map[string]interface{})
+	assert.Equal(t, "mem", response["type"])
+	assert.Equal(t, float64(2), response["indexedKeys"])
+
+	purged := admin(cachePurgeHandler, http.MethodPost, "/admin/cache/purge?cache=response&target=foo.ba[r]", "")
+	assert.Equal(t, map[string]interface{}{"response": float64(1)}, purged["purged"])
+	assert.Equal(t, cacheStatusMiss, render("foo.bar"))
+	assert.Equal(t, cacheStatusHit, render("sumSeries(foo.bar)"))
+
+	purged = admin(cachePurgeHandler, http.MethodPost, "/admin/cache/purge?cache=response&all=1", "")
+	assert.Equal(t, map[string]interface{}{"response": float64(2)}, purged["purged"])
+	keys, err := responseCache.Keys()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, keys)
+
+	// warm up is rendered by refresh workers with the middlewares of render requests
+	savedHandler := refreshHandler
+	defer func() {
+		refreshHandler = savedHandler
+	}()
+	var refreshes atomic.Int32
+	refreshHandler = func(w http.ResponseWriter, r *http.Request) {
+		refreshes.Add(1)
+		renderHandler(w, r)
+	}
+	warmed := admin(cacheWarmHandler, http.MethodPost, "/admin/cache/warm",
+		"/render/?target=foo.bar&from=-10minutes&format=json\n/find/?query=foo\n")
+	assert.Equal(t, float64(1), warmed["warmed"])
+	assert.Equal(t, float64(1), warmed["failed"])
+	assert.Equal(t, int32(1), refreshes.Load())
+	assert.Equal(t, cacheStatusHit, render("foo.bar"))
+
+	// path cache reports count of removed entries
+	pathCache := pathcache.NewPathCache(60)
+	defer pathCache.Close()
+	pathcache.Register("cache_admin_test", pathCache)
+	defer pathcache.Deregister("cache_admin_test", pathCache)
+	pathCache.Set("foo", nil)
+	pathCache.Set("bar", nil)
+	purged = admin(cachePurgeHandler, http.MethodPost, "/admin/cache/purge?cache=path&all=1", "")
+	assert.Equal(t, map[string]interface{}{"path": float64(2)}, purged["purged"])
+	_, ok := pathCache.Get("foo")
+	assert.False(t, ok)
+}
@@ -1,14 +1,23 @@
 package http
 
 import (
+	"bufio"
+	"errors"
+	"net"
 	"net/http"
 
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+	"github.com/go-graphite/carbonapi/pkg/tracing"
 	utilctx "github.com/go-graphite/carbonapi/util/ctx"
 )
 
-// TrackConnections exports via expvar a list of all currently executing requests
+// enrichContextWithHeaders adds headers to pass and to log, trace context and running config to the request context.
+// Request is served with the config it's started with, even if config is reloaded meanwhile.
 func enrichContextWithHeaders(headersToPass, headersToLog []string, fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		cfg := config.Acquire()
+		defer cfg.Release()
+
 		headersToPassMap := make(map[string]string)
 		for _, name := range headersToPass {
 			h := req.Header.Get(name)
@@ -25,10 +34,57 @@ func enrichContextWithHeaders(headersToPass, headersToLog []string, fn http.Hand
 			}
 		}
 
-		ctx := utilctx.SetPassHeaders(req.Context(), headersToPassMap)
+		ctx := config.NewContext(req.Context(), cfg)
+		ctx = utilctx.SetPassHeaders(ctx, headersToPassMap)
 		ctx = utilctx.SetLogHeaders(ctx, headersToLogMap)
-		req = req.WithContext(ctx)
+		ctx = utilctx.ParseTraceHeaders(ctx, req.Header)
+
+		ctx, span := tracing.StartSpan(ctx, req.URL.Path, tracing.SpanKindServer)
+		if span == nil {
+			fn(w, req.WithContext(ctx))
+			return
+		}
+		defer span.End()
+
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.target", req.URL.RequestURI())
+
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		fn(sw, req.WithContext(ctx))
+
+		span.SetAttribute("http.status_code", sw.code)
+		if sw.code >= 500 {
+			span.SetError(errors.New(http.StatusText(sw.code)))
+		}
+	}
+}
 
-		fn(w, req)
+// statusWriter remembers response code for the request span
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
 }
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Unwrap returns original writer for http.ResponseController, so it can reach other optional interfaces
+// (e.g. deadlines)
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,54 @@
+package http
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+	deadline time.Time
+}
+
+func (r *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.hijacked = true
+	return nil, nil, nil
+}
+
+func (r *hijackableRecorder) SetWriteDeadline(deadline time.Time) error {
+	r.deadline = deadline
+	return nil
+}
+
+func TestStatusWriter(t *testing.T) {
+	rec := &hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}
+	w := &statusWriter{ResponseWriter: rec, code: http.StatusOK}
+
+	w.WriteHeader(http.StatusTeapot)
+	assert.Equal(t, http.StatusTeapot, w.code)
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+
+	w.Flush()
+	assert.True(t, rec.Flushed)
+
+	_, _, err := w.Hijack()
+	assert.NoError(t, err)
+	assert.True(t, rec.hijacked)
+
+	// optional interfaces, that are not forwarded, are found by http.ResponseController with Unwrap
+	deadline := time.Unix(1700000000, 0)
+	assert.NoError(t, http.NewResponseController(w).SetWriteDeadline(deadline))
+	assert.Equal(t, deadline, rec.deadline)
+
+	// writer without Hijacker
+	w = &statusWriter{ResponseWriter: httptest.NewRecorder(), code: http.StatusOK}
+	_, _, err = w.Hijack()
+	assert.ErrorIs(t, err, http.ErrNotSupported)
+}
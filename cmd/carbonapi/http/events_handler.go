@@ -0,0 +1,208 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lomik/zapwriter"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/go-graphite/carbonapi/carbonapipb"
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+	"github.com/go-graphite/carbonapi/date"
+	"github.com/go-graphite/carbonapi/events"
+	utilctx "github.com/go-graphite/carbonapi/util/ctx"
+)
+
+// maxEventSize limits size of the body for event creation request
+const maxEventSize = 1024 * 1024
+
+// eventRequest is a body of POST request. Same as in graphite-web, tags can be either
+// a list or a space-separated string and data can be any json value.
+type eventRequest struct {
+	What string          `json:"what"`
+	When *float64        `json:"when"`
+	Tags json.RawMessage `json:"tags"`
+	Data json.RawMessage `json:"data"`
+}
+
+func (e *eventRequest) toEvent() (events.Event, error) {
+	ev := events.Event{
+		What: e.What,
+		When: timeNow().Unix(),
+		Tags: []string{},
+	}
+	if e.When != nil {
+		ev.When = int64(*e.When)
+	}
+
+	if len(e.Tags) > 0 && string(e.Tags) != "null" {
+		var tags string
+		if err := json.Unmarshal(e.Tags, &tags); err == nil {
+			ev.Tags = events.ParseTags(tags)
+		} else if err = json.Unmarshal(e.Tags, &ev.Tags); err != nil {
+			return ev, errors.New("tags must be a string or a list of strings")
+		}
+	}
+
+	if len(e.Data) > 0 && string(e.Data) != "null" {
+		if err := json.Unmarshal(e.Data, &ev.Data); err != nil {
+			ev.Data = string(e.Data)
+		}
+	}
+
+	return ev, nil
+}
+
+func eventsErrorCode(err error) int {
+	switch {
+	case errors.Is(err, events.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, events.ErrNoWhat):
+		return http.StatusBadRequest
+	case errors.Is(err, events.ErrNotConfigured):
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	t0 := time.Now()
+	uuid := uuid.NewV4()
+	carbonapiUUID := uuid.String()
+	cfg := config.FromContext(r.Context())
+
+	ctx := utilctx.SetUUID(r.Context(), carbonapiUUID)
+	requestHeaders := utilctx.GetLogHeaders(ctx)
+	username, _, _ := r.BasicAuth()
+
+	srcIP, srcPort := splitRemoteAddr(r.RemoteAddr)
+
+	accessLogger := zapwriter.Logger("access")
+	var accessLogDetails = &carbonapipb.AccessLogDetails{
+		Handler:        "events",
+		Username:       username,
+		CarbonapiUUID:  carbonapiUUID,
+		URL:            r.URL.Path,
+		PeerIP:         srcIP,
+		PeerPort:       srcPort,
+		Host:           r.Host,
+		Referer:        r.Referer(),
+		URI:            r.RequestURI,
+		RequestHeaders: requestHeaders,
+	}
+
+	logAsError := false
+	defer func() {
+		deferredAccessLogging(accessLogger, accessLogDetails, t0, logAsError)
+	}()
+
+	// event id, if specified: /events/<id>/
+	idStr := strings.Trim(strings.TrimPrefix(r.URL.Path, cfg.Prefix+"/events"), "/")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if idStr != "" {
+			setError(w, accessLogDetails, "", http.StatusNotFound, carbonapiUUID)
+			return
+		}
+
+		q := r.URL.Query()
+		tz := q.Get("tz")
+		now := timeNow()
+		from := date.DateParamToEpoch(q.Get("from"), tz, 0, cfg.DefaultTimeZone)
+		until := date.DateParamToEpoch(q.Get("until"), tz, now.Unix(), cfg.DefaultTimeZone)
+
+		var tags []string
+		for _, t := range q["tags"] {
+			tags = append(tags, events.ParseTags(t)...)
+		}
+		union := q.Get("set") == "union"
+
+		res, err := cfg.Events.Find(from, until, tags, union)
+		if err != nil {
+			setError(w, accessLogDetails, err.Error(), eventsErrorCode(err), carbonapiUUID)
+			logAsError = true
+			return
+		}
+		if res == nil {
+			res = []events.Event{}
+		}
+
+		b, err := json.Marshal(res)
+		if err != nil {
+			setError(w, accessLogDetails, err.Error(), http.StatusInternalServerError, carbonapiUUID)
+			logAsError = true
+			return
+		}
+
+		writeResponse(w, http.StatusOK, b, jsonFormat, q.Get("jsonp"), carbonapiUUID)
+		accessLogDetails.HTTPCode = http.StatusOK
+	case http.MethodPost:
+		if idStr != "" {
+			setError(w, accessLogDetails, "", http.StatusMethodNotAllowed, carbonapiUUID)
+			return
+		}
+
+		var req eventRequest
+		err := json.NewDecoder(io.LimitReader(r.Body, maxEventSize)).Decode(&req)
+		if err != nil {
+			setError(w, accessLogDetails, "failed to parse event: "+err.Error(), http.StatusBadRequest, carbonapiUUID)
+			logAsError = true
+			return
+		}
+
+		ev, err := req.toEvent()
+		if err != nil {
+			setError(w, accessLogDetails, err.Error(), http.StatusBadRequest, carbonapiUUID)
+			logAsError = true
+			return
+		}
+
+		ev, err = cfg.Events.Add(ev)
+		if err != nil {
+			setError(w, accessLogDetails, err.Error(), eventsErrorCode(err), carbonapiUUID)
+			logAsError = true
+			return
+		}
+
+		b, err := json.Marshal(ev)
+		if err != nil {
+			setError(w, accessLogDetails, err.Error(), http.StatusInternalServerError, carbonapiUUID)
+			logAsError = true
+			return
+		}
+
+		writeResponse(w, http.StatusOK, b, jsonFormat, "", carbonapiUUID)
+		accessLogDetails.HTTPCode = http.StatusOK
+	case http.MethodDelete:
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			setError(w, accessLogDetails, "invalid event id: '"+idStr+"'", http.StatusBadRequest, carbonapiUUID)
+			logAsError = true
+			return
+		}
+
+		err = cfg.Events.Delete(id)
+		if err != nil {
+			setError(w, accessLogDetails, err.Error(), eventsErrorCode(err), carbonapiUUID)
+			logAsError = true
+			return
+		}
+
+		w.Header().Set(ctxHeaderUUID, carbonapiUUID)
+		w.WriteHeader(http.StatusOK)
+		accessLogDetails.HTTPCode = http.StatusOK
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		setError(w, accessLogDetails, "", http.StatusMethodNotAllowed, carbonapiUUID)
+	}
+
+	accessLogDetails.Runtime = time.Since(t0).Seconds()
+}
@@ -0,0 +1,89 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+	"github.com/go-graphite/carbonapi/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventsHandler(t *testing.T) {
+	saved := config.Config.Events
+	config.Config.Events = events.NewMemoryStore()
+	defer func() { config.Config.Events = saved }()
+
+	for _, body := range []string{
+		`{"what": "deploy", "tags": "deploy prod", "when": 1000, "data": "v1.0"}`,
+		`{"what": "restart", "tags": ["prod"], "when": 2000}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/events/", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		eventsHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/events/", strings.NewReader(`{"tags": "deploy"}`))
+	rr := httptest.NewRecorder()
+	eventsHandler(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	tests := []struct {
+		url  string
+		want []events.Event
+	}{
+		{
+			url: "/events/?from=0&until=3000",
+			want: []events.Event{
+				{ID: 1, When: 1000, What: "deploy", Data: "v1.0", Tags: []string{"deploy", "prod"}},
+				{ID: 2, When: 2000, What: "restart", Tags: []string{"prod"}},
+			},
+		},
+		{
+			url: "/events/?from=0&until=3000&tags=deploy+prod",
+			want: []events.Event{
+				{ID: 1, When: 1000, What: "deploy", Data: "v1.0", Tags: []string{"deploy", "prod"}},
+			},
+		},
+		{
+			url:  "/events/?from=1500&until=3000&tags=deploy",
+			want: []events.Event{},
+		},
+		{
+			url: "/events/?from=0&until=3000&tags=deploy+restart&set=union",
+			want: []events.Event{
+				{ID: 1, When: 1000, What: "deploy", Data: "v1.0", Tags: []string{"deploy", "prod"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			req, rr := setUpRequest(t, tt.url)
+			eventsHandler(rr, req)
+			assert.Equal(t, http.StatusOK, rr.Code)
+
+			var got []events.Event
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/events/1/", nil)
+	rr = httptest.NewRecorder()
+	eventsHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	req = httptest.NewRequest(http.MethodDelete, "/events/1/", nil)
+	rr = httptest.NewRecorder()
+	eventsHandler(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	req, rr = setUpRequest(t, "/events/?from=0&until=3000")
+	eventsHandler(rr, req)
+	assert.Equal(t, `[{"id":2,"when":2000,"what":"restart","data":"","tags":["prod"]}]`, rr.Body.String())
+}
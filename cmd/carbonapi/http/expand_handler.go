@@ -20,8 +20,9 @@ import (
 func expandHandler(w http.ResponseWriter, r *http.Request) {
 	t0 := time.Now()
 	uid := uuid.NewV4()
+	cfg := config.FromContext(r.Context())
 	// TODO: Migrate to context.WithTimeout
-	// ctx, _ := context.WithTimeout(context.TODO(), config.Config.ZipperTimeout)
+	// ctx, _ := context.WithTimeout(context.TODO(), cfg.ZipperTimeout)
 	ctx := utilctx.SetUUID(r.Context(), uid.String())
 	username, _, _ := r.BasicAuth()
 	requestHeaders := utilctx.GetLogHeaders(ctx)
@@ -69,7 +70,7 @@ func expandHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if queryLengthLimitExceeded(query, config.Config.MaxQueryLength) {
+	if queryLengthLimitExceeded(query, cfg.MaxQueryLength) {
 		setError(w, &accessLogDetails, "query length limit exceeded", http.StatusBadRequest, uid.String())
 		logAsError = true
 		return
@@ -78,7 +79,7 @@ func expandHandler(w http.ResponseWriter, r *http.Request) {
 	var pv3Request pbv3.MultiGlobRequest
 	pv3Request.Metrics = query
 
-	multiGlobs, stats, err := config.Config.ZipperInstance.Find(ctx, pv3Request)
+	multiGlobs, stats, err := cfg.ZipperInstance.Find(ctx, pv3Request)
 	if stats != nil {
 		accessLogDetails.ZipperRequests = stats.ZipperRequests
 		accessLogDetails.TotalMetricsCount += stats.TotalMetricsCount
@@ -88,7 +89,7 @@ func expandHandler(w http.ResponseWriter, r *http.Request) {
 		if returnCode != http.StatusOK || multiGlobs == nil {
 			// Allow override status code for 404-not-found replies.
 			if returnCode == http.StatusNotFound {
-				returnCode = config.Config.NotFoundStatusCode
+				returnCode = cfg.NotFoundStatusCode
 			}
 
 			if returnCode < 300 {
@@ -98,7 +99,7 @@ func expandHandler(w http.ResponseWriter, r *http.Request) {
 				accessLogDetails.HTTPCode = int32(returnCode)
 				accessLogDetails.Reason = err.Error()
 				// We don't want to log this as an error if it's something normal
-				// Normal is everything that is >= 500. So if config.Config.NotFoundStatusCode is 500 - this will be
+				// Normal is everything that is >= 500. So if cfg.NotFoundStatusCode is 500 - this will be
 				// logged as error
 
 				if returnCode >= 500 {
@@ -109,6 +110,12 @@ func expandHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if err := checkFindCost(newQueryCost(r, cfg), multiGlobs); err != nil {
+		setError(w, &accessLogDetails, merry.Message(err), http.StatusUnprocessableEntity, uid.String())
+		logAsError = true
+		return
+	}
+
 	var b []byte
 	var err2 error
 	b, err2 = expandEncoder(multiGlobs, leavesOnly, groupByExpr)
@@ -17,6 +17,7 @@ import (
 	"github.com/lomik/zapwriter"
 	"github.com/maruel/natural"
 	uuid "github.com/satori/go.uuid"
+	"github.com/tinylib/msgp/msgp"
 
 	"github.com/go-graphite/carbonapi/carbonapipb"
 	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
@@ -173,11 +174,53 @@ func findList(multiGlobs *pbv3.MultiGlobResponse) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+// findMsgpack returns matches in the same structure as graphite-web, intervals are set only for leaves
+func findMsgpack(multiGlobs *pbv3.MultiGlobResponse, now int64) []byte {
+	var matches uint32
+	for _, globs := range multiGlobs.Metrics {
+		for _, g := range globs.Matches {
+			if !strings.HasPrefix(g.Path, "_tag") {
+				matches++
+			}
+		}
+	}
+
+	b := msgp.AppendArrayHeader(nil, matches)
+	for _, globs := range multiGlobs.Metrics {
+		for _, g := range globs.Matches {
+			if strings.HasPrefix(g.Path, "_tag") {
+				continue
+			}
+
+			if g.IsLeaf {
+				b = msgp.AppendMapHeader(b, 3)
+			} else {
+				b = msgp.AppendMapHeader(b, 2)
+			}
+			b = msgp.AppendString(b, "path")
+			b = msgp.AppendString(b, g.Path)
+			b = msgp.AppendString(b, "is_leaf")
+			b = msgp.AppendBool(b, g.IsLeaf)
+			if g.IsLeaf {
+				// Tell graphite-web that we have everything
+				b = msgp.AppendString(b, "intervals")
+				b = msgp.AppendArrayHeader(b, 1)
+				b = msgp.AppendArrayHeader(b, 2)
+				b = msgp.AppendInt64(b, 0)
+				b = msgp.AppendInt64(b, now)
+			}
+		}
+	}
+
+	return b
+}
+
 func findHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := config.FromContext(r.Context())
 	t0 := time.Now()
 	uid := uuid.NewV4()
 	// TODO: Migrate to context.WithTimeout
-	// ctx, _ := context.WithTimeout(context.TODO(), config.Config.ZipperTimeout)
+	// ctx, _ := context.WithTimeout(context.TODO(), cfg.ZipperTimeout)
 	ctx := utilctx.SetUUID(r.Context(), uid.String())
 	username, _, _ := r.BasicAuth()
 	requestHeaders := utilctx.GetLogHeaders(ctx)
@@ -188,8 +231,8 @@ func findHandler(w http.ResponseWriter, r *http.Request) {
 	qtz := r.FormValue("tz")
 	from := r.FormValue("from")
 	until := r.FormValue("until")
-	from64 := date.DateParamToEpoch(from, qtz, timeNow().Add(-time.Hour).Unix(), config.Config.DefaultTimeZone)
-	until64 := date.DateParamToEpoch(until, qtz, timeNow().Unix(), config.Config.DefaultTimeZone)
+	from64 := date.DateParamToEpoch(from, qtz, timeNow().Add(-time.Hour).Unix(), cfg.DefaultTimeZone)
+	until64 := date.DateParamToEpoch(until, qtz, timeNow().Unix(), cfg.DefaultTimeZone)
 
 	query := r.Form["query"]
 	srcIP, srcPort := splitRemoteAddr(r.RemoteAddr)
@@ -220,7 +263,7 @@ func findHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if queryLengthLimitExceeded(query, config.Config.MaxQueryLength) {
+	if queryLengthLimitExceeded(query, cfg.MaxQueryLength) {
 		setError(w, &accessLogDetails, "query length limit exceeded", http.StatusBadRequest, uid.String())
 		logAsError = true
 		return
@@ -268,7 +311,7 @@ func findHandler(w http.ResponseWriter, r *http.Request) {
 
 	accessLogDetails.Metrics = pv3Request.Metrics
 
-	multiGlobs, stats, err := config.Config.ZipperInstance.Find(ctx, pv3Request)
+	multiGlobs, stats, err := cfg.ZipperInstance.Find(ctx, pv3Request)
 	if stats != nil {
 		accessLogDetails.ZipperRequests = stats.ZipperRequests
 		accessLogDetails.TotalMetricsCount += stats.TotalMetricsCount
@@ -278,7 +321,7 @@ func findHandler(w http.ResponseWriter, r *http.Request) {
 		if returnCode != http.StatusOK || multiGlobs == nil {
 			// Allow override status code for 404-not-found replies.
 			if returnCode == http.StatusNotFound {
-				returnCode = config.Config.NotFoundStatusCode
+				returnCode = cfg.NotFoundStatusCode
 			}
 
 			if returnCode < 300 {
@@ -286,7 +329,7 @@ func findHandler(w http.ResponseWriter, r *http.Request) {
 			} else {
 				setError(w, &accessLogDetails, helper.MerryRootError(err), returnCode, uid.String())
 				// We don't want to log this as an error if it's something normal
-				// Normal is everything that is >= 500. So if config.Config.NotFoundStatusCode is 500 - this will be
+				// Normal is everything that is >= 500. So if cfg.NotFoundStatusCode is 500 - this will be
 				// logged as error
 
 				if returnCode >= 500 {
@@ -296,6 +339,12 @@ func findHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+	if err := checkFindCost(newQueryCost(r, cfg), multiGlobs); err != nil {
+		setError(w, &accessLogDetails, merry.Message(err), http.StatusUnprocessableEntity, uid.String())
+		logAsError = true
+		return
+	}
+
 	var b []byte
 	var err2 error
 	switch format {
@@ -337,7 +386,7 @@ func findHandler(w http.ResponseWriter, r *http.Request) {
 				}
 				// Tell graphite-web that we have everything
 				var mm map[string]interface{}
-				if config.Config.GraphiteWeb09Compatibility {
+				if cfg.GraphiteWeb09Compatibility {
 					// graphite-web 0.9.x
 					mm = map[string]interface{}{
 						// graphite-web 0.9.x
@@ -361,6 +410,8 @@ func findHandler(w http.ResponseWriter, r *http.Request) {
 		pEnc := pickle.NewEncoder(p)
 		err = merry.Wrap(pEnc.Encode(result))
 		b = p.Bytes()
+	case msgpackFormat:
+		b = findMsgpack(multiGlobs, time.Now().Unix()+60)
 	}
 
 	if err != nil {
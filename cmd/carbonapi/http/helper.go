@@ -30,6 +30,7 @@ const (
 	protoV3Format
 	pickleFormat
 	completerFormat
+	msgpackFormat
 )
 
 const (
@@ -58,6 +59,8 @@ func (r responseFormat) String() string {
 		return "svg"
 	case completerFormat:
 		return "completer"
+	case msgpackFormat:
+		return "msgpack"
 	default:
 		return "unknown"
 	}
@@ -92,6 +95,8 @@ func (r responseFormat) ValidFindFormat() bool {
 		return true
 	case treejsonFormat:
 		return true
+	case msgpackFormat:
+		return true
 	default:
 		return false
 	}
@@ -115,6 +120,8 @@ func (r responseFormat) ValidRenderFormat() bool {
 		return true
 	case rawFormat:
 		return true
+	case msgpackFormat:
+		return true
 	default:
 		return false
 	}
@@ -133,6 +140,7 @@ var knownFormats = map[string]responseFormat{
 	"raw":             rawFormat,
 	"svg":             svgFormat,
 	"completer":       completerFormat,
+	"msgpack":         msgpackFormat,
 }
 
 const (
@@ -144,6 +152,7 @@ const (
 	contentTypePNG        = "image/png"
 	contentTypeCSV        = "text/csv"
 	contentTypeSVG        = "image/svg+xml"
+	contentTypeMsgpack    = "application/x-msgpack"
 )
 
 func getFormat(r *http.Request, defaultFormat responseFormat) (responseFormat, bool, string) {
@@ -162,58 +171,64 @@ func getFormat(r *http.Request, defaultFormat responseFormat) (responseFormat, b
 }
 
 func writeResponse(w http.ResponseWriter, returnCode int, b []byte, format responseFormat, jsonp, carbonapiUUID string) {
+	if !writeResponseHeader(w, returnCode, format, jsonp, carbonapiUUID) {
+		return
+	}
+	if format == jsonFormat && jsonp != "" {
+		_, _ = w.Write([]byte(jsonp))
+		_, _ = w.Write([]byte{'('})
+		_, _ = w.Write(b)
+		_, _ = w.Write([]byte{')'})
+	} else {
+		_, _ = w.Write(b)
+	}
+}
+
+// writeResponseHeader sets headers for the response format and writes status code, false is returned for unsupported formats
+func writeResponseHeader(w http.ResponseWriter, returnCode int, format responseFormat, jsonp, carbonapiUUID string) bool {
 	//TODO: Simplify that switch
 	w.Header().Set(ctxHeaderUUID, carbonapiUUID)
 	switch format {
 	case jsonFormat:
 		if jsonp != "" {
 			w.Header().Set("Content-Type", contentTypeJavaScript)
-			w.WriteHeader(returnCode)
-			_, _ = w.Write([]byte(jsonp))
-			_, _ = w.Write([]byte{'('})
-			_, _ = w.Write(b)
-			_, _ = w.Write([]byte{')'})
 		} else {
 			w.Header().Set("Content-Type", contentTypeJSON)
-			w.WriteHeader(returnCode)
-			_, _ = w.Write(b)
 		}
 	case protoV2Format, protoV3Format:
 		w.Header().Set("Content-Type", contentTypeProtobuf)
-		w.WriteHeader(returnCode)
-		_, _ = w.Write(b)
 	case rawFormat:
 		w.Header().Set("Content-Type", contentTypeRaw)
-		w.WriteHeader(returnCode)
-		_, _ = w.Write(b)
 	case pickleFormat:
 		w.Header().Set("Content-Type", contentTypePickle)
-		w.WriteHeader(returnCode)
-		_, _ = w.Write(b)
+	case msgpackFormat:
+		w.Header().Set("Content-Type", contentTypeMsgpack)
 	case csvFormat:
 		w.Header().Set("Content-Type", contentTypeCSV)
-		_, _ = w.Write(b)
+		return true
 	case pngFormat:
 		w.Header().Set("Content-Type", contentTypePNG)
-		w.WriteHeader(returnCode)
-		_, _ = w.Write(b)
 	case svgFormat:
 		w.Header().Set("Content-Type", contentTypeSVG)
-		w.WriteHeader(returnCode)
-		_, _ = w.Write(b)
+	default:
+		return false
 	}
+	w.WriteHeader(returnCode)
+	return true
 }
 
 func bucketRequestTimes(req *http.Request, t time.Duration) {
 	ms := t.Nanoseconds() / int64(time.Millisecond)
 	ApiMetrics.RequestsH.Add(ms)
+	ApiMetrics.RequestsTimeNS.Add(uint64(t.Nanoseconds()))
 
-	if t > config.Config.Upstreams.SlowLogThreshold {
+	slowLogThreshold := config.FromContext(req.Context()).Upstreams.SlowLogThreshold
+	if t > slowLogThreshold {
 		logger := zapwriter.Logger("slow")
 		referer := req.Header.Get("Referer")
 		logger.Warn("Slow Request",
 			zap.Duration("time", t),
-			zap.Duration("slowLogThreshold", config.Config.Upstreams.SlowLogThreshold),
+			zap.Duration("slowLogThreshold", slowLogThreshold),
 			zap.String("url", req.URL.String()),
 			zap.String("referer", referer),
 		)
@@ -270,7 +285,7 @@ func deferredAccessLogging(accessLogger *zap.Logger, accessLogDetails *carbonapi
 	accessLogDetails.Runtime = time.Since(t).Seconds()
 	if logAsError {
 		accessLogger.Error("request failed", zap.Any("data", *accessLogDetails))
-		if config.Config.Upstreams.ExtendedStat {
+		if config.Current().Upstreams.ExtendedStat {
 			switch accessLogDetails.HTTPCode {
 			case 400:
 				ApiMetrics.Requests400.Add(1)
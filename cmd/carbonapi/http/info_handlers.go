@@ -19,8 +19,9 @@ import (
 func infoHandler(w http.ResponseWriter, r *http.Request) {
 	t0 := time.Now()
 	uuid := uuid.NewV4()
+	cfg := config.FromContext(r.Context())
 	// TODO: Migrate to context.WithTimeout
-	// ctx, _ := context.WithTimeout(context.TODO(), config.Config.ZipperTimeout)
+	// ctx, _ := context.WithTimeout(context.TODO(), cfg.ZipperTimeout)
 	ctx := utilctx.SetUUID(r.Context(), uuid.String())
 	username, _, _ := r.BasicAuth()
 	srcIP, srcPort := splitRemoteAddr(r.RemoteAddr)
@@ -65,7 +66,7 @@ func infoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data, stats, err := config.Config.ZipperInstance.Info(ctx, query)
+	data, stats, err := cfg.ZipperInstance.Info(ctx, query)
 	if stats != nil {
 		accessLogDetails.ZipperRequests = stats.ZipperRequests
 		accessLogDetails.TotalMetricsCount += stats.TotalMetricsCount
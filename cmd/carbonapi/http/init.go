@@ -12,18 +12,23 @@ import (
 
 func InitHandlers(headersToPass, headersToLog []string) *http.ServeMux {
 	r := http.NewServeMux()
-	r.HandleFunc(config.Config.Prefix+"/render/", httputil.TrackConnections(httputil.TimeHandler(enrichContextWithHeaders(headersToPass, headersToLog, ctx.ParseCtx(renderHandler, ctx.HeaderUUIDAPI)), bucketRequestTimes)))
-	r.HandleFunc(config.Config.Prefix+"/render", httputil.TrackConnections(httputil.TimeHandler(enrichContextWithHeaders(headersToPass, headersToLog, ctx.ParseCtx(renderHandler, ctx.HeaderUUIDAPI)), bucketRequestTimes)))
+	// background refreshes of the response cache pass the same middlewares, except tracking of client connections
+	refreshHandler = enrichContextWithHeaders(headersToPass, headersToLog, ctx.ParseCtx(withQuota("render", renderHandler), ctx.HeaderUUIDAPI))
+	r.HandleFunc(config.Config.Prefix+"/render/", httputil.TrackConnections(httputil.TimeHandler(refreshHandler, bucketRequestTimes)))
+	r.HandleFunc(config.Config.Prefix+"/render", httputil.TrackConnections(httputil.TimeHandler(refreshHandler, bucketRequestTimes)))
 
-	r.HandleFunc(config.Config.Prefix+"/metrics/find/", httputil.TrackConnections(httputil.TimeHandler(enrichContextWithHeaders(headersToPass, headersToLog, ctx.ParseCtx(findHandler, ctx.HeaderUUIDAPI)), bucketRequestTimes)))
-	r.HandleFunc(config.Config.Prefix+"/metrics/find", httputil.TrackConnections(httputil.TimeHandler(enrichContextWithHeaders(headersToPass, headersToLog, ctx.ParseCtx(findHandler, ctx.HeaderUUIDAPI)), bucketRequestTimes)))
+	r.HandleFunc(config.Config.Prefix+"/metrics/find/", httputil.TrackConnections(httputil.TimeHandler(enrichContextWithHeaders(headersToPass, headersToLog, ctx.ParseCtx(withQuota("find", findHandler), ctx.HeaderUUIDAPI)), bucketRequestTimes)))
+	r.HandleFunc(config.Config.Prefix+"/metrics/find", httputil.TrackConnections(httputil.TimeHandler(enrichContextWithHeaders(headersToPass, headersToLog, ctx.ParseCtx(withQuota("find", findHandler), ctx.HeaderUUIDAPI)), bucketRequestTimes)))
 
-	r.HandleFunc(config.Config.Prefix+"/metrics/expand/", httputil.TrackConnections(httputil.TimeHandler(enrichContextWithHeaders(headersToPass, headersToLog, ctx.ParseCtx(expandHandler, ctx.HeaderUUIDAPI)), bucketRequestTimes)))
-	r.HandleFunc(config.Config.Prefix+"/metrics/expand", httputil.TrackConnections(httputil.TimeHandler(enrichContextWithHeaders(headersToPass, headersToLog, ctx.ParseCtx(expandHandler, ctx.HeaderUUIDAPI)), bucketRequestTimes)))
+	r.HandleFunc(config.Config.Prefix+"/metrics/expand/", httputil.TrackConnections(httputil.TimeHandler(enrichContextWithHeaders(headersToPass, headersToLog, ctx.ParseCtx(withQuota("expand", expandHandler), ctx.HeaderUUIDAPI)), bucketRequestTimes)))
+	r.HandleFunc(config.Config.Prefix+"/metrics/expand", httputil.TrackConnections(httputil.TimeHandler(enrichContextWithHeaders(headersToPass, headersToLog, ctx.ParseCtx(withQuota("expand", expandHandler), ctx.HeaderUUIDAPI)), bucketRequestTimes)))
 
 	r.HandleFunc(config.Config.Prefix+"/info/", httputil.TrackConnections(httputil.TimeHandler(enrichContextWithHeaders(headersToPass, headersToLog, ctx.ParseCtx(infoHandler, ctx.HeaderUUIDAPI)), bucketRequestTimes)))
 	r.HandleFunc(config.Config.Prefix+"/info", httputil.TrackConnections(httputil.TimeHandler(enrichContextWithHeaders(headersToPass, headersToLog, ctx.ParseCtx(infoHandler, ctx.HeaderUUIDAPI)), bucketRequestTimes)))
 
+	r.HandleFunc(config.Config.Prefix+"/events/", httputil.TrackConnections(httputil.TimeHandler(enrichContextWithHeaders(headersToPass, headersToLog, ctx.ParseCtx(eventsHandler, ctx.HeaderUUIDAPI)), bucketRequestTimes)))
+	r.HandleFunc(config.Config.Prefix+"/events", httputil.TrackConnections(httputil.TimeHandler(enrichContextWithHeaders(headersToPass, headersToLog, ctx.ParseCtx(eventsHandler, ctx.HeaderUUIDAPI)), bucketRequestTimes)))
+
 	r.HandleFunc(config.Config.Prefix+"/lb_check", lbcheckHandler)
 
 	r.HandleFunc(config.Config.Prefix+"/version", versionHandler)
@@ -32,14 +37,26 @@ func InitHandlers(headersToPass, headersToLog []string) *http.ServeMux {
 	r.HandleFunc(config.Config.Prefix+"/functions", enrichContextWithHeaders(headersToPass, headersToLog, functionsHandler))
 	r.HandleFunc(config.Config.Prefix+"/functions/", enrichContextWithHeaders(headersToPass, headersToLog, functionsHandler))
 
-	r.HandleFunc(config.Config.Prefix+"/tags", enrichContextWithHeaders(headersToPass, headersToLog, tagHandler))
-	r.HandleFunc(config.Config.Prefix+"/tags/", enrichContextWithHeaders(headersToPass, headersToLog, tagHandler))
+	r.HandleFunc(config.Config.Prefix+"/tags", enrichContextWithHeaders(headersToPass, headersToLog, withQuota("tags", tagHandler)))
+	r.HandleFunc(config.Config.Prefix+"/tags/", enrichContextWithHeaders(headersToPass, headersToLog, withQuota("tags", tagHandler)))
 
 	r.HandleFunc(config.Config.Prefix+"/_internal/capabilities", enrichContextWithHeaders(headersToPass, headersToLog, capabilityHandler))
 	r.HandleFunc(config.Config.Prefix+"/_internal/capabilities/", enrichContextWithHeaders(headersToPass, headersToLog, capabilityHandler))
 
 	r.HandleFunc(config.Config.Prefix+"/", enrichContextWithHeaders(headersToPass, headersToLog, usageHandler))
 
+	if config.Config.Admin.Token != "" {
+		r.HandleFunc(config.Config.Prefix+"/admin/config/reload", adminAuth(configReloadHandler))
+		r.HandleFunc(config.Config.Prefix+"/admin/cache/stats", adminAuth(cacheStatsHandler))
+		r.HandleFunc(config.Config.Prefix+"/admin/cache/purge", adminAuth(cachePurgeHandler))
+		r.HandleFunc(config.Config.Prefix+"/admin/cache/warm", adminAuth(cacheWarmHandler))
+		r.HandleFunc(config.Config.Prefix+"/admin/backends", adminAuth(backendsHandler))
+	}
+
+	if config.Config.Prometheus.Enabled {
+		r.HandleFunc(config.Config.Prefix+"/metrics", prometheusHandler)
+	}
+
 	if config.Config.Expvar.Enabled {
 		if config.Config.Expvar.Listen == "" || config.Config.Expvar.Listen == config.Config.Listen {
 			r.HandleFunc(config.Config.Prefix+"/debug/vars", expvar.Handler().ServeHTTP)
@@ -15,6 +15,7 @@ import (
 	pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
 	"github.com/lomik/zapwriter"
 	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
 )
 
 type mockCarbonZipper struct{}
@@ -151,6 +152,57 @@ func TestRenderHandler(t *testing.T) {
 	}
 }
 
+func TestRenderHandlerMsgpack(t *testing.T) {
+	req, rr := setUpRequest(t, "/render/?target=foo.bar&from=-10minutes&format=json")
+	renderHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var expected []struct {
+		Target     string        `json:"target"`
+		Datapoints [][2]*float64 `json:"datapoints"`
+	}
+	if !assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &expected)) {
+		return
+	}
+
+	req, rr = setUpRequest(t, "/render/?target=foo.bar&from=-10minutes&format=msgpack")
+	renderHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, contentTypeMsgpack, rr.Header().Get("Content-Type"))
+
+	decoded, left, err := msgp.ReadIntfBytes(rr.Body.Bytes())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, left)
+
+	series, ok := decoded.([]interface{})
+	if !assert.True(t, ok) || !assert.Len(t, series, len(expected)) {
+		return
+	}
+	for i, s := range series {
+		m := s.(map[string]interface{})
+		assert.Equal(t, expected[i].Target, m["name"])
+		assert.Equal(t, "foo.bar", m["pathExpression"])
+		assert.Equal(t, int64(1), m["valuesPerPoint"])
+
+		start, step := m["start"].(int64), m["step"].(int64)
+		values := m["values"].([]interface{})
+		if !assert.Len(t, values, len(expected[i].Datapoints)) {
+			continue
+		}
+		for j, v := range values {
+			dp := expected[i].Datapoints[j]
+			assert.Equal(t, *dp[1], float64(start+int64(j)*step))
+			if dp[0] == nil {
+				assert.Nil(t, v)
+			} else {
+				assert.Equal(t, *dp[0], v)
+			}
+		}
+	}
+}
+
 func TestFindHandler(t *testing.T) {
 	req, rr := setUpRequest(t, "/metrics/find/?query=foo.bar&format=json")
 	findHandler(rr, req)
@@ -167,6 +219,46 @@ func TestFindHandler(t *testing.T) {
 	}
 }
 
+func TestFindHandlerMsgpack(t *testing.T) {
+	req, rr := setUpRequest(t, "/metrics/find/?query=foo.bar&format=json")
+	findHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var expected []treejson
+	if !assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &expected)) {
+		return
+	}
+
+	req, rr = setUpRequest(t, "/metrics/find/?query=foo.bar&format=msgpack")
+	findHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, contentTypeMsgpack, rr.Header().Get("Content-Type"))
+
+	decoded, left, err := msgp.ReadIntfBytes(rr.Body.Bytes())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, left)
+
+	matches, ok := decoded.([]interface{})
+	if !assert.True(t, ok) || !assert.Len(t, matches, len(expected)) {
+		return
+	}
+	for i, match := range matches {
+		m := match.(map[string]interface{})
+		assert.Equal(t, expected[i].ID, m["path"])
+		assert.Equal(t, expected[i].Leaf == 1, m["is_leaf"])
+		if expected[i].Leaf == 1 {
+			intervals := m["intervals"].([]interface{})
+			if assert.Len(t, intervals, 1) {
+				assert.Len(t, intervals[0], 2)
+			}
+		} else {
+			assert.NotContains(t, m, "intervals")
+		}
+	}
+}
+
 func TestInfoHandler(t *testing.T) {
 	req, rr := setUpRequest(t, "/info/?target=foo.bar&format=json")
 	infoHandler(rr, req)
@@ -13,10 +13,13 @@ import (
 var ApiMetrics = struct {
 	RequestCacheHits        metrics.Counter
 	RequestCacheMisses      metrics.Counter
+	RequestCacheStaleHits   metrics.Counter
+	RequestCacheRefreshes   metrics.Counter
 	BackendCacheHits        metrics.Counter
 	BackendCacheMisses      metrics.Counter
 	RequestsCacheOverheadNS metrics.Counter
 	RequestsH               metrics.Histogram
+	RequestsTimeNS          metrics.Counter
 	Requests200             metrics.Counter
 	Requests400             metrics.Counter
 	Requests403             metrics.Counter
@@ -29,7 +32,16 @@ var ApiMetrics = struct {
 
 	FindRequests metrics.Counter
 
+	// requests rejected by per-user quotas
+	QuotaRejectedConcurrency metrics.Counter
+	QuotaRejectedRate        metrics.Counter
+
 	MemcacheTimeouts metrics.UGauge
+	RedisTimeouts    metrics.UGauge
+
+	// hits and misses of each tier, set only for two-tier caches
+	RequestCacheTiers *CacheTierMetrics
+	BackendCacheTiers *CacheTierMetrics
 
 	CacheSize  metrics.UGauge
 	CacheItems metrics.Gauge
@@ -37,9 +49,12 @@ var ApiMetrics = struct {
 	RenderRequests:          metrics.NewCounter(),
 	RequestCacheHits:        metrics.NewCounter(),
 	RequestCacheMisses:      metrics.NewCounter(),
+	RequestCacheStaleHits:   metrics.NewCounter(),
+	RequestCacheRefreshes:   metrics.NewCounter(),
 	BackendCacheHits:        metrics.NewCounter(),
 	BackendCacheMisses:      metrics.NewCounter(),
 	RequestsCacheOverheadNS: metrics.NewCounter(),
+	RequestsTimeNS:          metrics.NewCounter(),
 
 	Requests200: metrics.NewCounter(),
 	Requests400: metrics.NewCounter(),
@@ -50,6 +65,9 @@ var ApiMetrics = struct {
 	Requests5xx: metrics.NewCounter(),
 
 	FindRequests: metrics.NewCounter(),
+
+	QuotaRejectedConcurrency: metrics.NewCounter(),
+	QuotaRejectedRate:        metrics.NewCounter(),
 }
 
 var ZipperMetrics = struct {
@@ -71,6 +89,17 @@ var ZipperMetrics = struct {
 
 	CacheMisses metrics.Counter
 	CacheHits   metrics.Counter
+
+	CoalesceHits   metrics.Counter
+	CoalesceMisses metrics.Counter
+
+	FetchCacheHits   metrics.Counter
+	FetchCacheMisses metrics.Counter
+
+	EjectedRequests metrics.Counter
+
+	HedgedRequests metrics.Counter
+	HedgeWins      metrics.Counter
 }{
 	FindRequests: metrics.NewCounter(),
 	FindTimeouts: metrics.NewCounter(),
@@ -90,6 +119,17 @@ var ZipperMetrics = struct {
 
 	CacheHits:   metrics.NewCounter(),
 	CacheMisses: metrics.NewCounter(),
+
+	CoalesceHits:   metrics.NewCounter(),
+	CoalesceMisses: metrics.NewCounter(),
+
+	FetchCacheHits:   metrics.NewCounter(),
+	FetchCacheMisses: metrics.NewCounter(),
+
+	EjectedRequests: metrics.NewCounter(),
+
+	HedgedRequests: metrics.NewCounter(),
+	HedgeWins:      metrics.NewCounter(),
 }
 
 func ZipperStats(stats *zipperTypes.Stats) {
@@ -109,79 +149,171 @@ func ZipperStats(stats *zipperTypes.Stats) {
 	ZipperMetrics.SearchRequests.Add(stats.SearchRequests)
 	ZipperMetrics.CacheMisses.Add(stats.CacheMisses)
 	ZipperMetrics.CacheHits.Add(stats.CacheHits)
+	ZipperMetrics.CoalesceHits.Add(stats.CoalesceHits)
+	ZipperMetrics.CoalesceMisses.Add(stats.CoalesceMisses)
+	ZipperMetrics.FetchCacheHits.Add(stats.FetchCacheHits)
+	ZipperMetrics.FetchCacheMisses.Add(stats.FetchCacheMisses)
+	ZipperMetrics.EjectedRequests.Add(stats.EjectedRequests)
+	ZipperMetrics.HedgedRequests.Add(stats.HedgedRequests)
+	ZipperMetrics.HedgeWins.Add(stats.HedgeWins)
 }
 
-func SetupMetrics(logger *zap.Logger) {
-	switch config.Config.ResponseCacheConfig.Type {
-	case "memcache":
-		mcache := config.Config.ResponseCache.(*cache.MemcachedCache)
+// CacheTierMetrics are hits and misses of each tier of two-tier cache. L2 is checked only on L1 miss.
+type CacheTierMetrics struct {
+	L1Hits   metrics.UGauge
+	L1Misses metrics.UGauge
+	L2Hits   metrics.UGauge
+	L2Misses metrics.UGauge
+}
 
-		ApiMetrics.MemcacheTimeouts = metrics.NewFunctionalUGauge(mcache.Timeouts)
-	case "mem":
-		qcache := config.Config.ResponseCache.(*cache.ExpireCache)
+func newCacheTierMetrics(current func() cache.BytesCache) *CacheTierMetrics {
+	stats := func() cache.TwoTierStats {
+		if c, ok := current().(*cache.TwoTierCache); ok {
+			return c.Stats()
+		}
+		return cache.TwoTierStats{}
+	}
+	return &CacheTierMetrics{
+		L1Hits:   metrics.NewFunctionalUGauge(func() uint64 { return stats().L1Hits }),
+		L1Misses: metrics.NewFunctionalUGauge(func() uint64 { return stats().L1Misses }),
+		L2Hits:   metrics.NewFunctionalUGauge(func() uint64 { return stats().L2Hits }),
+		L2Misses: metrics.NewFunctionalUGauge(func() uint64 { return stats().L2Misses }),
+	}
+}
 
-		ApiMetrics.CacheSize = metrics.NewFunctionalUGauge(qcache.Size)
+// unindexed returns cache without key index
+func unindexed(c cache.BytesCache) cache.BytesCache {
+	if i, ok := c.(*cache.IndexedCache); ok {
+		return i.Unwrap()
+	}
+	return c
+}
+
+// sharedResponseCache returns memcache or redis client of the response cache
+func sharedResponseCache() cache.BytesCache {
+	c := unindexed(config.Current().ResponseCache)
+	if t, ok := c.(*cache.TwoTierCache); ok {
+		c = t.L2()
+	}
+	if e, ok := c.(*cache.EncodedCache); ok {
+		c = e.Unwrap()
+	}
+	return c
+}
+
+// sizedCache is implemented by in-memory and disk caches
+type sizedCache interface {
+	Items() int
+	Size() uint64
+}
+
+// sizedResponseCache returns in-memory or disk response cache, for two-tier cache its disk tier
+func sizedResponseCache() (sizedCache, bool) {
+	c := unindexed(config.Current().ResponseCache)
+	if t, ok := c.(*cache.TwoTierCache); ok {
+		c = t.L2()
+	}
+	s, ok := c.(sizedCache)
+	return s, ok
+}
+
+func SetupMetrics(logger *zap.Logger) {
+	// caches may be replaced on config reload, so gauges always check the current one
+	cfg := config.Current()
+	switch cfg.ResponseCacheConfig.Type {
+	case "memcache":
+		ApiMetrics.MemcacheTimeouts = metrics.NewFunctionalUGauge(func() uint64 {
+			if mcache, ok := sharedResponseCache().(*cache.MemcachedCache); ok {
+				return mcache.Timeouts()
+			}
+			return 0
+		})
+	case "redis":
+		ApiMetrics.RedisTimeouts = metrics.NewFunctionalUGauge(func() uint64 {
+			if rcache, ok := sharedResponseCache().(*cache.RedisCache); ok {
+				return rcache.Timeouts()
+			}
+			return 0
+		})
+	case "mem", "disk":
+		ApiMetrics.CacheSize = metrics.NewFunctionalUGauge(func() uint64 {
+			if qcache, ok := sizedResponseCache(); ok {
+				return qcache.Size()
+			}
+			return 0
+		})
 		ApiMetrics.CacheItems = metrics.NewFunctionalGauge(func() int64 {
-			return int64(qcache.Items())
+			if qcache, ok := sizedResponseCache(); ok {
+				return int64(qcache.Items())
+			}
+			return 0
 		})
 	default:
 	}
 
+	if cfg.ResponseCacheConfig.L1.Size > 0 {
+		ApiMetrics.RequestCacheTiers = newCacheTierMetrics(func() cache.BytesCache { return unindexed(config.Current().ResponseCache) })
+	}
+	if cfg.BackendCacheConfig.L1.Size > 0 {
+		ApiMetrics.BackendCacheTiers = newCacheTierMetrics(func() cache.BytesCache { return unindexed(config.Current().BackendCache) })
+	}
+
 	ApiMetrics.RequestsH = initRequestsHistogram()
 }
 
 func initRequestsHistogram() metrics.Histogram {
-	if config.Config.Upstreams.SumBuckets {
-		if len(config.Config.Upstreams.BucketsWidth) > 0 {
-			labels := make([]string, len(config.Config.Upstreams.BucketsWidth)+1)
-
-			for i := 0; i <= len(config.Config.Upstreams.BucketsWidth); i++ {
-				if i >= len(config.Config.Upstreams.BucketsLabels) || config.Config.Upstreams.BucketsLabels[i] == "" {
-					if i < len(config.Config.Upstreams.BucketsWidth) {
-						labels[i] = fmt.Sprintf("_to_%dms", config.Config.Upstreams.BucketsWidth[i])
+	upstreams := config.Current().Upstreams
+	if upstreams.SumBuckets {
+		if len(upstreams.BucketsWidth) > 0 {
+			labels := make([]string, len(upstreams.BucketsWidth)+1)
+
+			for i := 0; i <= len(upstreams.BucketsWidth); i++ {
+				if i >= len(upstreams.BucketsLabels) || upstreams.BucketsLabels[i] == "" {
+					if i < len(upstreams.BucketsWidth) {
+						labels[i] = fmt.Sprintf("_to_%dms", upstreams.BucketsWidth[i])
 					} else {
 						labels[i] = "_to_inf"
 					}
 				} else {
-					labels[i] = config.Config.Upstreams.BucketsLabels[i]
+					labels[i] = upstreams.BucketsLabels[i]
 				}
 			}
-			return metrics.NewVSumHistogram(config.Config.Upstreams.BucketsWidth, labels).
+			return metrics.NewVSumHistogram(upstreams.BucketsWidth, labels).
 				SetNameTotal("")
 		} else {
-			labels := make([]string, config.Config.Upstreams.Buckets+1)
+			labels := make([]string, upstreams.Buckets+1)
 
-			for i := 0; i <= config.Config.Upstreams.Buckets; i++ {
+			for i := 0; i <= upstreams.Buckets; i++ {
 				labels[i] = fmt.Sprintf("_to_%dms", (i+1)*100)
 			}
-			return metrics.NewFixedSumHistogram(100, int64(config.Config.Upstreams.Buckets)*100, 100).
+			return metrics.NewFixedSumHistogram(100, int64(upstreams.Buckets)*100, 100).
 				SetLabels(labels).
 				SetNameTotal("")
 		}
-	} else if len(config.Config.Upstreams.BucketsWidth) > 0 {
-		labels := make([]string, len(config.Config.Upstreams.BucketsWidth)+1)
+	} else if len(upstreams.BucketsWidth) > 0 {
+		labels := make([]string, len(upstreams.BucketsWidth)+1)
 
-		for i := 0; i <= len(config.Config.Upstreams.BucketsWidth); i++ {
-			if i >= len(config.Config.Upstreams.BucketsLabels) || config.Config.Upstreams.BucketsLabels[i] == "" {
+		for i := 0; i <= len(upstreams.BucketsWidth); i++ {
+			if i >= len(upstreams.BucketsLabels) || upstreams.BucketsLabels[i] == "" {
 				if i == 0 {
-					labels[i] = fmt.Sprintf("_in_0ms_to_%dms", config.Config.Upstreams.BucketsWidth[0])
-				} else if i < len(config.Config.Upstreams.BucketsWidth) {
-					labels[i] = fmt.Sprintf("_in_%dms_to_%dms", config.Config.Upstreams.BucketsWidth[i-1], config.Config.Upstreams.BucketsWidth[i])
+					labels[i] = fmt.Sprintf("_in_0ms_to_%dms", upstreams.BucketsWidth[0])
+				} else if i < len(upstreams.BucketsWidth) {
+					labels[i] = fmt.Sprintf("_in_%dms_to_%dms", upstreams.BucketsWidth[i-1], upstreams.BucketsWidth[i])
 				} else {
-					labels[i] = fmt.Sprintf("_in_%dms_to_inf", config.Config.Upstreams.BucketsWidth[i-1])
+					labels[i] = fmt.Sprintf("_in_%dms_to_inf", upstreams.BucketsWidth[i-1])
 				}
 			} else {
-				labels[i] = config.Config.Upstreams.BucketsLabels[i]
+				labels[i] = upstreams.BucketsLabels[i]
 			}
 		}
-		return metrics.NewVSumHistogram(config.Config.Upstreams.BucketsWidth, labels).SetNameTotal("")
+		return metrics.NewVSumHistogram(upstreams.BucketsWidth, labels).SetNameTotal("")
 	} else {
-		labels := make([]string, config.Config.Upstreams.Buckets+1)
+		labels := make([]string, upstreams.Buckets+1)
 
-		for i := 0; i <= config.Config.Upstreams.Buckets; i++ {
+		for i := 0; i <= upstreams.Buckets; i++ {
 			labels[i] = fmt.Sprintf("_in_%dms_to_%dms", i*100, (i+1)*100)
 		}
-		return metrics.NewFixedSumHistogram(100, int64(config.Config.Upstreams.Buckets)*100, 100).
+		return metrics.NewFixedSumHistogram(100, int64(upstreams.Buckets)*100, 100).
 			SetLabels(labels).
 			SetNameTotal("")
 	}
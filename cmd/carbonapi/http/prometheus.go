@@ -0,0 +1,321 @@
+package http
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/msaf1980/go-metrics"
+
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+	"github.com/go-graphite/carbonapi/zipper/breaker"
+	"github.com/go-graphite/carbonapi/zipper/fetchcache"
+	"github.com/go-graphite/carbonapi/zipper/helper"
+)
+
+const (
+	contentTypePrometheus  = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+	prometheusNamespace = "carbonapi_"
+)
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// promWriter writes metrics in Prometheus text exposition format or OpenMetrics format
+type promWriter struct {
+	buf         bytes.Buffer
+	openMetrics bool
+}
+
+func (p *promWriter) header(name, typ, help string) {
+	if typ == "counter" && !p.openMetrics {
+		// prometheus text format has no concept of metric family with _total suffix
+		name += "_total"
+	}
+	p.buf.WriteString("# HELP ")
+	p.buf.WriteString(prometheusNamespace)
+	p.buf.WriteString(name)
+	p.buf.WriteByte(' ')
+	p.buf.WriteString(help)
+	p.buf.WriteString("\n# TYPE ")
+	p.buf.WriteString(prometheusNamespace)
+	p.buf.WriteString(name)
+	p.buf.WriteByte(' ')
+	p.buf.WriteString(typ)
+	p.buf.WriteByte('\n')
+}
+
+// sample writes a single sample, labels are specified as key, value pairs
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	p.buf.WriteString(prometheusNamespace)
+	p.buf.WriteString(name)
+	if len(labels) > 0 {
+		p.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.buf.WriteByte(',')
+			}
+			p.buf.WriteString(labels[i])
+			p.buf.WriteString(`="`)
+			p.buf.WriteString(labelValueEscaper.Replace(labels[i+1]))
+			p.buf.WriteByte('"')
+		}
+		p.buf.WriteByte('}')
+	}
+	p.buf.WriteByte(' ')
+	switch {
+	case math.IsInf(value, 1):
+		p.buf.WriteString("+Inf")
+	case math.IsInf(value, -1):
+		p.buf.WriteString("-Inf")
+	case math.IsNaN(value):
+		p.buf.WriteString("NaN")
+	default:
+		p.buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	}
+	p.buf.WriteByte('\n')
+}
+
+func (p *promWriter) counter(name, help string, value uint64) {
+	p.header(name, "counter", help)
+	p.sample(name+"_total", float64(value))
+}
+
+func (p *promWriter) gauge(name, help string, value float64) {
+	p.header(name, "gauge", help)
+	p.sample(name, value)
+}
+
+// histogram converts go-metrics histogram with buckets in milliseconds to cumulative prometheus histogram in seconds
+func (p *promWriter) histogram(name, help string, h metrics.Histogram, sumSeconds float64) {
+	if h == nil {
+		return
+	}
+	weights := h.Weights()
+	values := h.Values()
+	if len(weights) == 0 || len(weights) != len(values) {
+		return
+	}
+
+	p.header(name, "histogram", help)
+
+	var total uint64
+	if h.IsSummed() {
+		// summed histogram stores count of all values in first bucket and
+		// count of values greater than previous weight in the next ones
+		total = values[0]
+	} else {
+		for _, v := range values {
+			total += v
+		}
+	}
+
+	var cumulative uint64
+	for i, w := range weights {
+		var le string
+		if w == math.MaxInt64 {
+			le = "+Inf"
+			cumulative = total
+		} else {
+			le = strconv.FormatFloat(float64(w)/1000, 'g', -1, 64)
+			if h.IsSummed() {
+				cumulative = total - values[i+1]
+			} else {
+				cumulative += values[i]
+			}
+		}
+		p.sample(name+"_bucket", float64(cumulative), "le", le)
+	}
+	p.sample(name+"_sum", sumSeconds)
+	p.sample(name+"_count", float64(total))
+}
+
+func writePrometheusMetrics(p *promWriter) {
+	p.histogram("request_duration_seconds", "Time spent to serve API requests.",
+		ApiMetrics.RequestsH, float64(ApiMetrics.RequestsTimeNS.Count())/1e9)
+
+	p.header("responses", "counter", "API responses by HTTP status code.")
+	for _, c := range []struct {
+		code string
+		v    metrics.Counter
+	}{
+		{"200", ApiMetrics.Requests200},
+		{"400", ApiMetrics.Requests400},
+		{"403", ApiMetrics.Requests403},
+		{"4xx", ApiMetrics.Requestsxxx},
+		{"500", ApiMetrics.Requests500},
+		{"503", ApiMetrics.Requests503},
+		{"5xx", ApiMetrics.Requests5xx},
+	} {
+		p.sample("responses_total", float64(c.v.Count()), "code", c.code)
+	}
+
+	p.counter("render_requests", "Render requests received.", ApiMetrics.RenderRequests.Count())
+	p.counter("find_requests", "Find requests received.", ApiMetrics.FindRequests.Count())
+
+	p.header("quota_rejected_requests", "counter", "Requests rejected by per-user quotas.")
+	p.sample("quota_rejected_requests_total", float64(ApiMetrics.QuotaRejectedConcurrency.Count()), "reason", "concurrency")
+	p.sample("quota_rejected_requests_total", float64(ApiMetrics.QuotaRejectedRate.Count()), "reason", "rate")
+
+	p.header("cache_requests", "counter", "Cache lookups by cache and result.")
+	p.sample("cache_requests_total", float64(ApiMetrics.RequestCacheHits.Count()), "cache", "response", "result", "hit")
+	p.sample("cache_requests_total", float64(ApiMetrics.RequestCacheStaleHits.Count()), "cache", "response", "result", "stale")
+	p.sample("cache_requests_total", float64(ApiMetrics.RequestCacheMisses.Count()), "cache", "response", "result", "miss")
+	p.sample("cache_requests_total", float64(ApiMetrics.BackendCacheHits.Count()), "cache", "backend", "result", "hit")
+	p.sample("cache_requests_total", float64(ApiMetrics.BackendCacheMisses.Count()), "cache", "backend", "result", "miss")
+
+	p.counter("cache_refreshes", "Background refreshes of the response cache entries.", ApiMetrics.RequestCacheRefreshes.Count())
+
+	if ApiMetrics.RequestCacheTiers != nil || ApiMetrics.BackendCacheTiers != nil {
+		p.header("cache_tier_requests", "counter", "Lookups in tiers of two-tier caches by cache, tier and result.")
+		for _, c := range []struct {
+			name  string
+			tiers *CacheTierMetrics
+		}{{"response", ApiMetrics.RequestCacheTiers}, {"backend", ApiMetrics.BackendCacheTiers}} {
+			if c.tiers == nil {
+				continue
+			}
+			p.sample("cache_tier_requests_total", float64(c.tiers.L1Hits.Value()), "cache", c.name, "tier", "l1", "result", "hit")
+			p.sample("cache_tier_requests_total", float64(c.tiers.L1Misses.Value()), "cache", c.name, "tier", "l1", "result", "miss")
+			p.sample("cache_tier_requests_total", float64(c.tiers.L2Hits.Value()), "cache", c.name, "tier", "l2", "result", "hit")
+			p.sample("cache_tier_requests_total", float64(c.tiers.L2Misses.Value()), "cache", c.name, "tier", "l2", "result", "miss")
+		}
+	}
+
+	p.header("cache_overhead_seconds", "counter", "Time spent in response cache lookups.")
+	p.sample("cache_overhead_seconds_total", float64(ApiMetrics.RequestsCacheOverheadNS.Count())/1e9)
+
+	if ApiMetrics.MemcacheTimeouts != nil {
+		p.counter("memcache_timeouts", "Response cache memcached timeouts.", ApiMetrics.MemcacheTimeouts.Value())
+	}
+	if ApiMetrics.RedisTimeouts != nil {
+		p.counter("redis_timeouts", "Response cache redis timeouts.", ApiMetrics.RedisTimeouts.Value())
+	}
+	if ApiMetrics.CacheSize != nil {
+		p.gauge("cache_size_bytes", "Response cache size.", float64(ApiMetrics.CacheSize.Value()))
+		p.gauge("cache_items", "Response cache items.", float64(ApiMetrics.CacheItems.Value()))
+	}
+
+	p.gauge("limiter_capacity", "Maximum amount of concurrent backend requests.", float64(config.Current().Limiter.Capacity()))
+	p.gauge("limiter_in_use", "Amount of currently running backend requests.", float64(config.Current().Limiter.Len()))
+
+	p.header("zipper_requests", "counter", "Zipper requests by type.")
+	p.sample("zipper_requests_total", float64(ZipperMetrics.FindRequests.Count()), "type", "find")
+	p.sample("zipper_requests_total", float64(ZipperMetrics.RenderRequests.Count()), "type", "render")
+	p.sample("zipper_requests_total", float64(ZipperMetrics.InfoRequests.Count()), "type", "info")
+	p.sample("zipper_requests_total", float64(ZipperMetrics.SearchRequests.Count()), "type", "search")
+
+	p.header("zipper_errors", "counter", "Zipper errors by type.")
+	p.sample("zipper_errors_total", float64(ZipperMetrics.FindErrors.Count()), "type", "find")
+	p.sample("zipper_errors_total", float64(ZipperMetrics.RenderErrors.Count()), "type", "render")
+	p.sample("zipper_errors_total", float64(ZipperMetrics.InfoErrors.Count()), "type", "info")
+
+	p.header("zipper_timeouts", "counter", "Zipper timeouts by type.")
+	p.sample("zipper_timeouts_total", float64(ZipperMetrics.FindTimeouts.Count()), "type", "find")
+	p.sample("zipper_timeouts_total", float64(ZipperMetrics.RenderTimeouts.Count()), "type", "render")
+	p.sample("zipper_timeouts_total", float64(ZipperMetrics.InfoTimeouts.Count()), "type", "info")
+	p.sample("zipper_timeouts_total", float64(ZipperMetrics.Timeouts.Count()), "type", "all")
+
+	p.header("zipper_cache_requests", "counter", "Zipper path cache lookups by result.")
+	p.sample("zipper_cache_requests_total", float64(ZipperMetrics.CacheHits.Count()), "result", "hit")
+	p.sample("zipper_cache_requests_total", float64(ZipperMetrics.CacheMisses.Count()), "result", "miss")
+	p.header("zipper_coalesced_requests", "counter", "Coalesced zipper requests by result (hit means result of identical in-flight request was reused).")
+	p.sample("zipper_coalesced_requests_total", float64(ZipperMetrics.CoalesceHits.Count()), "result", "hit")
+	p.sample("zipper_coalesced_requests_total", float64(ZipperMetrics.CoalesceMisses.Count()), "result", "miss")
+
+	var fetchCaches []*fetchcache.GroupStats
+	fetchcache.EachGroupStats(func(s *fetchcache.GroupStats) {
+		fetchCaches = append(fetchCaches, s)
+	})
+	if len(fetchCaches) > 0 {
+		p.header("zipper_fetch_cache_chunks", "counter", "Time chunks of fetched series by backend group and result (hit means chunk was taken from the fetch cache).")
+		for _, s := range fetchCaches {
+			p.sample("zipper_fetch_cache_chunks_total", float64(atomic.LoadUint64(&s.Hits)), "group", s.Group, "result", "hit")
+			p.sample("zipper_fetch_cache_chunks_total", float64(atomic.LoadUint64(&s.Misses)), "group", s.Group, "result", "miss")
+		}
+		p.header("zipper_fetch_cache_hit_ratio", "gauge", "Share of time chunks taken from the fetch cache by backend group.")
+		for _, s := range fetchCaches {
+			hits, misses := atomic.LoadUint64(&s.Hits), atomic.LoadUint64(&s.Misses)
+			var ratio float64
+			if hits+misses > 0 {
+				ratio = float64(hits) / float64(hits+misses)
+			}
+			p.sample("zipper_fetch_cache_hit_ratio", ratio, "group", s.Group)
+		}
+	}
+
+	p.header("zipper_ejected_requests", "counter", "Requests, that were not sent to backend servers, ejected by circuit breakers.")
+	p.sample("zipper_ejected_requests_total", float64(ZipperMetrics.EjectedRequests.Count()))
+	p.header("zipper_hedged_requests", "counter", "Requests, that were sent to a second server of the group, because the first one was slow.")
+	p.sample("zipper_hedged_requests_total", float64(ZipperMetrics.HedgedRequests.Count()))
+	p.header("zipper_hedge_wins", "counter", "Hedged requests, that got the response from the second server first.")
+	p.sample("zipper_hedge_wins_total", float64(ZipperMetrics.HedgeWins.Count()))
+
+	var breakers []*breaker.Breaker
+	breaker.Each(func(b *breaker.Breaker) {
+		breakers = append(breakers, b)
+	})
+	if len(breakers) > 0 {
+		p.header("backend_ejected", "gauge", "Backend servers, ejected by circuit breakers (1 if ejected or readmission is being probed).")
+		for _, b := range breakers {
+			var ejected float64
+			if b.State() != breaker.Closed {
+				ejected = 1
+			}
+			p.sample("backend_ejected", ejected, "group", b.Group, "server", b.Server)
+		}
+		p.header("backend_ejections", "counter", "Ejections of backend servers by circuit breakers.")
+		for _, b := range breakers {
+			p.sample("backend_ejections_total", float64(b.Ejections()), "group", b.Group, "server", b.Server)
+		}
+	}
+
+	var servers []*helper.ServerStats
+	helper.EachServerStats(func(s *helper.ServerStats) {
+		servers = append(servers, s)
+	})
+	if len(servers) == 0 {
+		return
+	}
+
+	p.header("backend_requests", "counter", "Requests sent to backend servers.")
+	for _, s := range servers {
+		p.sample("backend_requests_total", float64(atomic.LoadUint64(&s.Requests)), "group", s.Group, "server", s.Server)
+	}
+	p.header("backend_errors", "counter", "Failed requests to backend servers.")
+	for _, s := range servers {
+		p.sample("backend_errors_total", float64(atomic.LoadUint64(&s.Errors)), "group", s.Group, "server", s.Server)
+	}
+	p.header("backend_timeouts", "counter", "Timed out requests to backend servers.")
+	for _, s := range servers {
+		p.sample("backend_timeouts_total", float64(atomic.LoadUint64(&s.Timeouts)), "group", s.Group, "server", s.Server)
+	}
+	p.header("backend_request_duration_seconds", "counter", "Time spent in requests to backend servers.")
+	for _, s := range servers {
+		p.sample("backend_request_duration_seconds_total", float64(atomic.LoadUint64(&s.TimeNS))/1e9, "group", s.Group, "server", s.Server)
+	}
+	p.header("backend_in_flight_requests", "gauge", "Currently running requests to backend servers.")
+	for _, s := range servers {
+		p.sample("backend_in_flight_requests", float64(atomic.LoadInt64(&s.InFlight)), "group", s.Group, "server", s.Server)
+	}
+}
+
+func prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	p := &promWriter{
+		openMetrics: strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text"),
+	}
+
+	writePrometheusMetrics(p)
+
+	if p.openMetrics {
+		p.buf.WriteString("# EOF\n")
+		w.Header().Set("Content-Type", contentTypeOpenMetrics)
+	} else {
+		w.Header().Set("Content-Type", contentTypePrometheus)
+	}
+	_, _ = w.Write(p.buf.Bytes())
+}
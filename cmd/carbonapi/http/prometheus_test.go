@@ -0,0 +1,79 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/msaf1980/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromWriterHistogram(t *testing.T) {
+	for _, h := range []metrics.Histogram{
+		metrics.NewVSumHistogram([]int64{100, 500}, nil),
+		metrics.NewVHistogram([]int64{100, 500}, nil),
+	} {
+		for _, v := range []int64{50, 100, 300, 700, 1000} {
+			h.Add(v)
+		}
+
+		p := &promWriter{}
+		p.histogram("test_seconds", "Test.", h, 2.15)
+
+		expected := `# HELP carbonapi_test_seconds Test.
+# TYPE carbonapi_test_seconds histogram
+carbonapi_test_seconds_bucket{le="0.1"} 2
+carbonapi_test_seconds_bucket{le="0.5"} 3
+carbonapi_test_seconds_bucket{le="+Inf"} 5
+carbonapi_test_seconds_sum 2.15
+carbonapi_test_seconds_count 5
+`
+		assert.Equal(t, expected, p.buf.String(), "summed=%v", h.IsSummed())
+	}
+}
+
+func TestPromWriterCounter(t *testing.T) {
+	p := &promWriter{}
+	p.counter("test", "Test.", 10)
+	p.sample("test_total", 1, "group", "a\"b", "server", "http://127.0.0.1:8080")
+	assert.Equal(t, `# HELP carbonapi_test_total Test.
+# TYPE carbonapi_test_total counter
+carbonapi_test_total 10
+carbonapi_test_total{group="a\"b",server="http://127.0.0.1:8080"} 1
+`, p.buf.String())
+
+	p = &promWriter{openMetrics: true}
+	p.counter("test", "Test.", 10)
+	assert.Equal(t, `# HELP carbonapi_test Test.
+# TYPE carbonapi_test counter
+carbonapi_test_total 10
+`, p.buf.String())
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	if ApiMetrics.RequestsH == nil {
+		ApiMetrics.RequestsH = initRequestsHistogram()
+	}
+
+	req, rr := setUpRequest(t, "/metrics")
+	prometheusHandler(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, contentTypePrometheus, rr.Header().Get("Content-Type"))
+	body := rr.Body.String()
+	for _, s := range []string{
+		"carbonapi_request_duration_seconds_bucket{le=\"+Inf\"}",
+		"carbonapi_cache_requests_total{cache=\"backend\",result=\"miss\"}",
+		"carbonapi_limiter_capacity ",
+		"carbonapi_zipper_requests_total{type=\"render\"}",
+	} {
+		assert.Contains(t, body, s)
+	}
+
+	req, rr = setUpRequest(t, "/metrics")
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	prometheusHandler(rr, req)
+	assert.Equal(t, contentTypeOpenMetrics, rr.Header().Get("Content-Type"))
+	assert.True(t, strings.HasSuffix(rr.Body.String(), "# EOF\n"))
+}
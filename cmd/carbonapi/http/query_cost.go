@@ -0,0 +1,175 @@
+package http
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/ansel1/merry"
+	pbv3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+	"github.com/go-graphite/carbonapi/limiter"
+	"github.com/go-graphite/carbonapi/pkg/parser"
+)
+
+// newQueryCost returns resources accounting with limits for the user or tenant, nil if there are no limits
+func newQueryCost(r *http.Request, cfg *config.ConfigType) *limiter.QueryCost {
+	limits := cfg.QueryLimits.Get(quotaKey(r, &cfg.Quotas))
+	if !limits.Enabled() {
+		return nil
+	}
+	return limiter.NewQueryCost(limits)
+}
+
+// checkFindCost checks amount of metrics for each glob, branches are not counted, as they are when globs are expanded for fetching.
+// Response is merged from all backends, so metrics found on several of them are counted once.
+func checkFindCost(queryCost *limiter.QueryCost, multiGlobs *pbv3.MultiGlobResponse) merry.Error {
+	for _, globs := range multiGlobs.Metrics {
+		leafs := make([]string, 0, len(globs.Matches))
+		for _, match := range globs.Matches {
+			if match.IsLeaf {
+				leafs = append(leafs, match.Path)
+			}
+		}
+		if err := queryCost.AddFindMetrics(globs.Name, leafs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryCostError returns error for exceeded query cost limit, if any
+func queryCostError(errs map[string]merry.Error) merry.Error {
+	for _, err := range errs {
+		if merry.Is(err, limiter.ErrQueryCostExceeded) {
+			return err
+		}
+	}
+	return nil
+}
+
+type dryRunMetric struct {
+	Pattern string `json:"pattern"`
+	From    int64  `json:"from"`
+	Until   int64  `json:"until"`
+	Series  int    `json:"series"`
+	// Step is taken from the retention of the first matched metric, datapoints are not estimated if it's unknown
+	Step       int64  `json:"step"`
+	Datapoints int64  `json:"datapoints"`
+	Error      string `json:"error,omitempty"`
+}
+
+type dryRunTarget struct {
+	Target  string         `json:"target"`
+	Metrics []dryRunMetric `json:"metrics"`
+}
+
+type dryRunResponse struct {
+	From    int64              `json:"from"`
+	Until   int64              `json:"until"`
+	Targets []dryRunTarget     `json:"targets"`
+	Cost    limiter.Cost       `json:"cost"`
+	Limits  limiter.CostLimits `json:"limits"`
+	// Error is set, if estimated cost exceeds limits
+	Error string `json:"error,omitempty"`
+}
+
+// retentionStep returns step of the archive, that will be used for fetch from the given time
+func retentionStep(info *pbv3.ZipperInfoResponse, age int64) int64 {
+	if info == nil {
+		return 0
+	}
+	for _, resp := range info.Info {
+		for _, m := range resp.Metrics {
+			for _, r := range m.Retentions {
+				if r.SecondsPerPoint*r.NumberOfPoints >= age {
+					return r.SecondsPerPoint
+				}
+			}
+			if len(m.Retentions) > 0 {
+				return m.Retentions[len(m.Retentions)-1].SecondsPerPoint
+			}
+		}
+	}
+	return 0
+}
+
+// estimateMetricCost expands glob and estimates amount of datapoints to fetch
+func estimateMetricCost(ctx context.Context, m parser.MetricRequest, now int64) dryRunMetric {
+	res := dryRunMetric{Pattern: m.Metric, From: m.From, Until: m.Until}
+
+	zipper := config.FromContext(ctx).ZipperInstance
+	multiGlobs, _, err := zipper.Find(ctx, pbv3.MultiGlobRequest{Metrics: []string{m.Metric}, StartTime: m.From, StopTime: m.Until})
+	if err != nil && merry.HTTPCode(err) != http.StatusNotFound {
+		res.Error = merry.Message(err)
+		return res
+	}
+	if multiGlobs == nil {
+		return res
+	}
+
+	var first string
+	for _, globs := range multiGlobs.Metrics {
+		for _, match := range globs.Matches {
+			if !match.IsLeaf {
+				continue
+			}
+			if first == "" {
+				first = match.Path
+			}
+			res.Series++
+		}
+	}
+	if first == "" {
+		return res
+	}
+
+	info, _, err := zipper.Info(ctx, []string{first})
+	if err != nil {
+		res.Error = merry.Message(err)
+		return res
+	}
+	res.Step = retentionStep(info, now-m.From)
+	if res.Step > 0 {
+		res.Datapoints = int64(res.Series) * ((m.Until - m.From) / res.Step)
+	}
+
+	return res
+}
+
+// renderDryRun expands globs in targets and reports estimated cost of the request without fetching data
+func renderDryRun(ctx context.Context, exprs []parser.Expr, targets []string, from, until, now int64, limits limiter.CostLimits) dryRunResponse {
+	res := dryRunResponse{
+		From:    from,
+		Until:   until,
+		Targets: make([]dryRunTarget, 0, len(exprs)),
+		Limits:  limits,
+	}
+
+	// same metrics are fetched once for the request
+	seen := make(map[parser.MetricRequest]dryRunMetric)
+	for i, exp := range exprs {
+		target := dryRunTarget{Target: targets[i], Metrics: []dryRunMetric{}}
+		for _, m := range exp.Metrics(from, until) {
+			metricRequest := parser.MetricRequest{Metric: m.Metric, From: m.From, Until: m.Until}
+			metric, ok := seen[metricRequest]
+			if !ok {
+				metric = estimateMetricCost(ctx, metricRequest, now)
+				seen[metricRequest] = metric
+				res.Cost.FetchedSeries += int64(metric.Series)
+				res.Cost.Datapoints += metric.Datapoints
+				if int64(metric.Series) > res.Cost.FindMetrics {
+					res.Cost.FindMetrics = int64(metric.Series)
+				}
+			}
+			target.Metrics = append(target.Metrics, metric)
+		}
+		res.Targets = append(res.Targets, target)
+	}
+
+	if err := res.Cost.Check(limits); err != nil {
+		res.Error = merry.Message(err)
+	}
+
+	return res
+}
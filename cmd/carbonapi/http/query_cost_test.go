@@ -0,0 +1,67 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+	"github.com/go-graphite/carbonapi/limiter"
+)
+
+func TestRenderQueryLimits(t *testing.T) {
+	saved := config.Config.QueryLimits
+	defer func() {
+		config.Config.QueryLimits = saved
+	}()
+
+	config.Config.QueryLimits = config.QueryLimitsConfig{
+		Default: limiter.CostLimits{MaxDatapoints: 2},
+		Overrides: []config.QueryLimitsOverride{
+			{Key: "admin", CostLimits: limiter.CostLimits{MaxOutputSeries: 1}},
+		},
+	}
+
+	req, rr := setUpRequest(t, "/render/?target=foo.bar&from=-10minutes&format=json&noCache=1")
+	renderHandler(rr, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, rr.Body.String(), "maxDatapoints")
+
+	// per-user limits
+	req, rr = setUpRequest(t, "/render/?target=foo.bar&from=-10minutes&format=json&noCache=1")
+	req.SetBasicAuth("admin", "")
+	renderHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	req, rr = setUpRequest(t, "/render/?target=foo.bar&target=foo.bar&from=-10minutes&format=json&noCache=1")
+	req.SetBasicAuth("admin", "")
+	renderHandler(rr, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, rr.Body.String(), "maxOutputSeries")
+}
+
+func TestRenderDryRun(t *testing.T) {
+	saved := config.Config.QueryLimits
+	defer func() {
+		config.Config.QueryLimits = saved
+	}()
+	config.Config.QueryLimits.Default = limiter.CostLimits{MaxDatapoints: 15}
+
+	req, rr := setUpRequest(t, "/render/?target=sumSeries(foo.*)&target=foo.*&target=timeShift(foo.*,'10min')&from=-10minutes&format=json&dryRun=1")
+	renderHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var res dryRunResponse
+	if !assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &res)) {
+		return
+	}
+	assert.Equal(t, int64(600), res.Until-res.From)
+	assert.Len(t, res.Targets, 3)
+	assert.Equal(t, dryRunMetric{Pattern: "foo.*", From: res.From, Until: res.Until, Series: 1, Step: 60, Datapoints: 10}, res.Targets[0].Metrics[0])
+	// same metrics are fetched once
+	assert.Equal(t, limiter.Cost{FindMetrics: 1, FetchedSeries: 2, Datapoints: 20}, res.Cost)
+	assert.Equal(t, config.Config.QueryLimits.Default, res.Limits)
+	assert.Contains(t, res.Error, "maxDatapoints")
+}
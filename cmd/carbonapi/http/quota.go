@@ -0,0 +1,82 @@
+package http
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lomik/zapwriter"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/go-graphite/carbonapi/carbonapipb"
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+	"github.com/go-graphite/carbonapi/limiter"
+	utilctx "github.com/go-graphite/carbonapi/util/ctx"
+)
+
+// quotaKey returns user or tenant id for the request. Header with tenant id is set by the client, so it's used only
+// for requests from trusted proxies, other requests are anonymous.
+func quotaKey(r *http.Request, quotas *config.QuotasConfig) string {
+	var key string
+	if quotas.KeyHeader != "" {
+		if quotas.IsTrustedProxy(r.RemoteAddr) {
+			key = r.Header.Get(quotas.KeyHeader)
+		}
+	} else {
+		key, _, _ = r.BasicAuth()
+	}
+	if key == "" {
+		return quotas.AnonymousKey
+	}
+	return key
+}
+
+// withQuota rejects requests over per-user quota with 429 Too Many Requests
+func withQuota(handler string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := config.FromContext(r.Context())
+		quotaLimiter := cfg.QuotaLimiter
+		if quotaLimiter == nil {
+			fn(w, r)
+			return
+		}
+
+		key := quotaKey(r, &cfg.Quotas)
+		retryAfter, err := quotaLimiter.Enter(key)
+		if err == nil {
+			defer quotaLimiter.Leave(key)
+			fn(w, r)
+			return
+		}
+
+		t0 := time.Now()
+		carbonapiUUID := uuid.NewV4().String()
+		username, _, _ := r.BasicAuth()
+		srcIP, srcPort := splitRemoteAddr(r.RemoteAddr)
+
+		if errors.Is(err, limiter.ErrQuotaConcurrency) {
+			ApiMetrics.QuotaRejectedConcurrency.Add(1)
+		} else {
+			ApiMetrics.QuotaRejectedRate.Add(1)
+		}
+
+		accessLogDetails := &carbonapipb.AccessLogDetails{
+			Handler:        handler,
+			Username:       username,
+			CarbonapiUUID:  carbonapiUUID,
+			URL:            r.URL.Path,
+			PeerIP:         srcIP,
+			PeerPort:       srcPort,
+			Host:           r.Host,
+			Referer:        r.Referer(),
+			URI:            r.RequestURI,
+			RequestHeaders: utilctx.GetLogHeaders(r.Context()),
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		setError(w, accessLogDetails, "quota exceeded for '"+key+"': "+err.Error(), http.StatusTooManyRequests, carbonapiUUID)
+		deferredAccessLogging(zapwriter.Logger("access"), accessLogDetails, t0, true)
+	}
+}
@@ -0,0 +1,105 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+	"github.com/go-graphite/carbonapi/limiter"
+)
+
+func TestWithQuota(t *testing.T) {
+	savedQuotas, savedLimiter := config.Config.Quotas, config.Config.QuotaLimiter
+	defer func() {
+		config.Config.Quotas, config.Config.QuotaLimiter = savedQuotas, savedLimiter
+	}()
+
+	config.Config.Quotas = config.QuotasConfig{
+		Enabled:        true,
+		KeyHeader:      "X-Scope-OrgID",
+		TrustedProxies: []string{"10.0.0.0/8"},
+		AnonymousKey:   "anonymous",
+		Default:        limiter.Quota{Concurrency: 1},
+		Overrides: []config.QuotaOverride{
+			{Key: "big", Quota: limiter.Quota{Concurrency: 2}},
+		},
+	}
+	assert.NoError(t, config.Config.Quotas.ParseTrustedProxies())
+	config.Config.QuotaLimiter = limiter.NewQuotaLimiter(config.Config.Quotas.Default, map[string]limiter.Quota{
+		"big": {Concurrency: 2},
+	})
+
+	var inner func(w http.ResponseWriter, r *http.Request, tenant string)
+	handler := withQuota("render", func(w http.ResponseWriter, r *http.Request) {
+		inner(w, r, r.Header.Get("X-Scope-OrgID"))
+	})
+
+	request := func(tenant string) int {
+		req, rr := setUpRequest(t, "/render/?target=a.b&format=json")
+		req.RemoteAddr = "10.0.0.1:12345"
+		if tenant != "" {
+			req.Header.Set("X-Scope-OrgID", tenant)
+		}
+		handler(rr, req)
+		if rr.Code == http.StatusTooManyRequests {
+			assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+		}
+		return rr.Code
+	}
+
+	rejected := ApiMetrics.QuotaRejectedConcurrency.Count()
+
+	// nested requests are made while outer one is in progress
+	var codes []int
+	nested := false
+	inner = func(w http.ResponseWriter, r *http.Request, tenant string) {
+		if !nested {
+			nested = true
+			codes = append(codes, request(tenant), request("big"))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	assert.Equal(t, http.StatusOK, request(""))
+	assert.Equal(t, []int{http.StatusTooManyRequests, http.StatusOK}, codes)
+	assert.Equal(t, rejected+1, ApiMetrics.QuotaRejectedConcurrency.Count())
+
+	// slot is released after request
+	assert.Equal(t, 0, config.Config.QuotaLimiter.InFlight("anonymous"))
+	assert.Equal(t, http.StatusOK, request(""))
+}
+
+func TestQuotaKey(t *testing.T) {
+	quotas := config.QuotasConfig{
+		KeyHeader:      "X-Scope-OrgID",
+		TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1", "::1"},
+		AnonymousKey:   "anonymous",
+	}
+	assert.NoError(t, quotas.ParseTrustedProxies())
+
+	tests := []struct {
+		remoteAddr string
+		expected   string
+	}{
+		{remoteAddr: "10.1.2.3:12345", expected: "tenant"},
+		{remoteAddr: "192.168.1.1:12345", expected: "tenant"},
+		{remoteAddr: "[::1]:12345", expected: "tenant"},
+		{remoteAddr: "[::ffff:10.1.2.3]:12345", expected: "tenant"},
+		// header of untrusted client is ignored
+		{remoteAddr: "192.168.1.2:12345", expected: "anonymous"},
+		{remoteAddr: "", expected: "anonymous"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			req, _ := setUpRequest(t, "/render/?target=a.b")
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Scope-OrgID", "tenant")
+			assert.Equal(t, tt.expected, quotaKey(req, &quotas))
+		})
+	}
+
+	// key header requires trusted proxies
+	assert.Error(t, (&config.QuotasConfig{KeyHeader: "X-Scope-OrgID"}).ParseTrustedProxies())
+	assert.Error(t, (&config.QuotasConfig{KeyHeader: "X-Scope-OrgID", TrustedProxies: []string{"10.0.0.0/33"}}).ParseTrustedProxies())
+}
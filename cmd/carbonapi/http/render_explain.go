@@ -0,0 +1,228 @@
+package http
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+	"github.com/go-graphite/carbonapi/expr"
+	"github.com/go-graphite/carbonapi/expr/types"
+	"github.com/go-graphite/carbonapi/pkg/parser"
+	utilctx "github.com/go-graphite/carbonapi/util/ctx"
+	zipperTypes "github.com/go-graphite/carbonapi/zipper/types"
+)
+
+// explainNode is a parsed expression
+type explainNode struct {
+	Type string `json:"type"`
+	// Target is a function or series name
+	Target    string                 `json:"target,omitempty"`
+	Value     interface{}            `json:"value,omitempty"`
+	Args      []explainNode          `json:"args,omitempty"`
+	NamedArgs map[string]explainNode `json:"namedArgs,omitempty"`
+}
+
+func explainExpr(e parser.Expr) explainNode {
+	switch e.Type() {
+	case parser.EtName:
+		return explainNode{Type: "name", Target: e.Target()}
+	case parser.EtConst:
+		return explainNode{Type: "const", Value: e.FloatValue()}
+	case parser.EtString:
+		return explainNode{Type: "string", Value: e.StringValue()}
+	case parser.EtBool:
+		return explainNode{Type: "bool", Value: e.Target() == "true"}
+	}
+
+	node := explainNode{Type: "func", Target: e.Target()}
+	for _, arg := range e.Args() {
+		node.Args = append(node.Args, explainExpr(arg))
+	}
+	if namedArgs := e.NamedArgs(); len(namedArgs) > 0 {
+		node.NamedArgs = make(map[string]explainNode, len(namedArgs))
+		for name, arg := range namedArgs {
+			node.NamedArgs[name] = explainExpr(arg)
+		}
+	}
+	return node
+}
+
+type explainMetric struct {
+	Metric            string `json:"metric"`
+	From              int64  `json:"from"`
+	Until             int64  `json:"until"`
+	ConsolidationFunc string `json:"consolidationFunc,omitempty"`
+}
+
+type explainProfile struct {
+	WallTime     time.Duration  `json:"wallTimeNs"`
+	OutputSeries int            `json:"outputSeries"`
+	Error        string         `json:"error,omitempty"`
+	Calls        []utilctx.Call `json:"calls"`
+}
+
+type explainTarget struct {
+	Target  string          `json:"target"`
+	AST     explainNode     `json:"ast"`
+	Metrics []explainMetric `json:"metrics"`
+	Profile *explainProfile `json:"profile,omitempty"`
+}
+
+type explainFetchMetric struct {
+	Name            string   `json:"name"`
+	From            int64    `json:"from"`
+	Until           int64    `json:"until"`
+	MaxDataPoints   int64    `json:"maxDataPoints,omitempty"`
+	FilterFunctions []string `json:"filterFunctions,omitempty"`
+}
+
+// explainFetch is a request to the zipper
+type explainFetch struct {
+	Targets []string             `json:"targets"`
+	Metrics []explainFetchMetric `json:"metrics"`
+	// Route is set, if zipper can tell which backends will get the request
+	Route *zipperTypes.Route `json:"route,omitempty"`
+	Error string             `json:"error,omitempty"`
+}
+
+type explainResponse struct {
+	From                int64           `json:"from"`
+	Until               int64           `json:"until"`
+	CacheKey            string          `json:"cacheKey"`
+	CacheTimeout        int32           `json:"cacheTimeout"`
+	BackendCacheKey     string          `json:"backendCacheKey"`
+	BackendCacheTimeout int32           `json:"backendCacheTimeout"`
+	Targets             []explainTarget `json:"targets"`
+	// Fetches are done for each target or once for all targets, if combineMultipleTargetsInOne is enabled
+	Fetches []explainFetch `json:"fetches"`
+}
+
+// isExplainRequest checks that request asks for the query plan instead of data
+func isExplainRequest(path, explain string) bool {
+	return parser.TruthyBool(explain) || strings.HasSuffix(strings.TrimSuffix(path, "/"), "/render/explain")
+}
+
+// parseTargets parses all targets, error message is returned for the first invalid one
+func parseTargets(targets []string) ([]parser.Expr, string) {
+	exprs := make([]parser.Expr, 0, len(targets))
+	for _, target := range targets {
+		exp, e, err := parser.ParseExpr(target)
+		if err != nil || e != "" {
+			return nil, buildParseErrorString(target, e, err)
+		}
+		exprs = append(exprs, exp)
+	}
+	return exprs, ""
+}
+
+// explainFetches returns requests, that will be sent to the zipper, without sending them
+func explainFetches(ctx context.Context, exprs []parser.Expr, targets []string, from, until int64) []explainFetch {
+	cfg := config.FromContext(ctx)
+	router, _ := cfg.ZipperInstance.(zipperTypes.Router)
+
+	groups := make([][]int, 0, len(exprs))
+	if cfg.CombineMultipleTargetsInOne {
+		all := make([]int, len(exprs))
+		for i := range exprs {
+			all[i] = i
+		}
+		groups = append(groups, all)
+	} else {
+		for i := range exprs {
+			groups = append(groups, []int{i})
+		}
+	}
+
+	// metrics are fetched once for the request
+	values := make(map[parser.MetricRequest][]*types.MetricData)
+	fetches := make([]explainFetch, 0, len(groups))
+	for _, group := range groups {
+		fetch := explainFetch{
+			Targets: make([]string, 0, len(group)),
+			Metrics: []explainFetchMetric{},
+		}
+		groupExprs := make([]parser.Expr, 0, len(group))
+		for _, i := range group {
+			fetch.Targets = append(fetch.Targets, targets[i])
+			groupExprs = append(groupExprs, exprs[i])
+		}
+
+		request, err := expr.FetchRequest(ctx, groupExprs, from, until, values, cfg.PassFunctionsToBackend)
+		if err != nil {
+			fetch.Error = merry.Message(err)
+			fetches = append(fetches, fetch)
+			continue
+		}
+
+		names := make([]string, 0, len(request.Metrics))
+		for _, m := range request.Metrics {
+			metric := explainFetchMetric{
+				Name:          m.PathExpression,
+				From:          m.StartTime,
+				Until:         m.StopTime,
+				MaxDataPoints: m.MaxDataPoints,
+			}
+			for _, f := range m.FilterFunctions {
+				metric.FilterFunctions = append(metric.FilterFunctions, f.Name+"("+strings.Join(f.Arguments, ",")+")")
+			}
+			fetch.Metrics = append(fetch.Metrics, metric)
+			names = append(names, m.PathExpression)
+			values[parser.MetricRequest{Metric: m.PathExpression, From: m.StartTime, Until: m.StopTime}] = nil
+		}
+		if router != nil && len(names) > 0 {
+			route := router.Route(names)
+			fetch.Route = &route
+		}
+		fetches = append(fetches, fetch)
+	}
+
+	return fetches
+}
+
+// profileTargets evaluates targets one by one and records time spent in each function
+func profileTargets(ctx context.Context, exprs []parser.Expr, from, until int64, res []explainTarget) {
+	values := make(map[parser.MetricRequest][]*types.MetricData)
+	for i, exp := range exprs {
+		profile := utilctx.NewProfile()
+		t0 := time.Now()
+		result, err := expr.FetchAndEvalExp(utilctx.SetProfile(ctx, profile), config.FromContext(ctx).Evaluator, exp, from, until, values)
+		res[i].Profile = &explainProfile{
+			WallTime:     time.Since(t0),
+			OutputSeries: len(result),
+			Calls:        profile.Calls(),
+		}
+		if err != nil {
+			res[i].Profile.Error = merry.Message(err)
+		}
+	}
+}
+
+// renderExplain describes how targets are parsed, fetched and cached. Query is executed only if profile is set.
+func renderExplain(ctx context.Context, res *explainResponse, exprs []parser.Expr, targets []string, profile bool) {
+	res.Targets = make([]explainTarget, 0, len(exprs))
+	for i, exp := range exprs {
+		target := explainTarget{
+			Target:  targets[i],
+			AST:     explainExpr(exp),
+			Metrics: []explainMetric{},
+		}
+		for _, m := range exp.Metrics(res.From, res.Until) {
+			target.Metrics = append(target.Metrics, explainMetric{
+				Metric:            m.Metric,
+				From:              m.From,
+				Until:             m.Until,
+				ConsolidationFunc: m.ConsolidationFunc,
+			})
+		}
+		res.Targets = append(res.Targets, target)
+	}
+
+	res.Fetches = explainFetches(ctx, exprs, targets, res.From, res.Until)
+
+	if profile {
+		profileTargets(ctx, exprs, res.From, res.Until, res.Targets)
+	}
+}
@@ -0,0 +1,95 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+	zipperTypes "github.com/go-graphite/carbonapi/zipper/types"
+)
+
+type mockRouterZipper struct {
+	mockCarbonZipper
+}
+
+func (z mockRouterZipper) Route(metrics []string) zipperTypes.Route {
+	return zipperTypes.Route{Group: "root", Servers: []string{"backend1"}}
+}
+
+func TestRenderExplain(t *testing.T) {
+	saved := config.Config.ZipperInstance
+	defer func() {
+		config.Config.ZipperInstance = saved
+	}()
+	config.Config.ZipperInstance = mockRouterZipper{}
+
+	req, rr := setUpRequest(t, "/render/explain?target=sumSeries(foo.bar,timeShift(foo.baz,'1min'),alignToFrom=true)&target=foo.bar&from=-10minutes&format=json")
+	renderHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var res explainResponse
+	if !assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &res)) {
+		return
+	}
+	assert.Equal(t, int64(600), res.Until-res.From)
+	assert.NotContains(t, res.CacheKey, "explain")
+	assert.Contains(t, res.BackendCacheKey, "targets:sumSeries")
+
+	if !assert.Len(t, res.Targets, 2) {
+		return
+	}
+	ast := res.Targets[0].AST
+	assert.Equal(t, "func", ast.Type)
+	assert.Equal(t, "sumSeries", ast.Target)
+	if assert.Len(t, ast.Args, 2) {
+		assert.Equal(t, explainNode{Type: "name", Target: "foo.bar"}, ast.Args[0])
+		assert.Equal(t, "timeShift", ast.Args[1].Target)
+		assert.Equal(t, explainNode{Type: "string", Value: "1min"}, ast.Args[1].Args[1])
+	}
+	assert.Equal(t, map[string]explainNode{"alignToFrom": {Type: "bool", Value: true}}, ast.NamedArgs)
+	assert.Equal(t, []explainMetric{
+		{Metric: "foo.bar", From: res.From, Until: res.Until},
+		{Metric: "foo.baz", From: res.From - 60, Until: res.Until - 60},
+	}, res.Targets[0].Metrics)
+	assert.Nil(t, res.Targets[0].Profile)
+
+	// second target doesn't fetch foo.bar again
+	if assert.Len(t, res.Fetches, 2) {
+		assert.Len(t, res.Fetches[0].Metrics, 2)
+		assert.Equal(t, &zipperTypes.Route{Group: "root", Servers: []string{"backend1"}}, res.Fetches[0].Route)
+		assert.Equal(t, []string{"foo.bar"}, res.Fetches[1].Targets)
+		assert.Empty(t, res.Fetches[1].Metrics)
+		assert.Nil(t, res.Fetches[1].Route)
+	}
+}
+
+func TestRenderExplainProfile(t *testing.T) {
+	req, rr := setUpRequest(t, "/render/?target=sumSeries(scale(foo.bar,2))&from=-10minutes&format=json&explain=1&profile=1")
+	renderHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var res explainResponse
+	if !assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &res)) {
+		return
+	}
+	if !assert.Len(t, res.Targets, 1) || !assert.NotNil(t, res.Targets[0].Profile) {
+		return
+	}
+	profile := res.Targets[0].Profile
+	assert.Equal(t, 1, profile.OutputSeries)
+	assert.Empty(t, profile.Error)
+	if assert.Len(t, profile.Calls, 3) {
+		assert.Equal(t, "fetch", profile.Calls[0].Function)
+		assert.Equal(t, 1, profile.Calls[0].OutputSeries)
+		// nested calls are finished first
+		assert.Equal(t, "scale", profile.Calls[1].Function)
+		assert.Equal(t, 1, profile.Calls[1].Depth)
+		assert.Equal(t, 1, profile.Calls[1].InputSeries)
+		assert.Equal(t, "sumSeries", profile.Calls[2].Function)
+		assert.Equal(t, 0, profile.Calls[2].Depth)
+		assert.Equal(t, 1, profile.Calls[2].OutputSeries)
+	}
+}
@@ -3,9 +3,11 @@ package http
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"strconv"
 	"strings"
@@ -18,12 +20,14 @@ import (
 	uuid "github.com/satori/go.uuid"
 	"go.uber.org/zap"
 
+	"github.com/go-graphite/carbonapi/cache"
 	"github.com/go-graphite/carbonapi/carbonapipb"
 	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
 	"github.com/go-graphite/carbonapi/date"
 	"github.com/go-graphite/carbonapi/expr"
 	"github.com/go-graphite/carbonapi/expr/functions/cairo/png"
 	"github.com/go-graphite/carbonapi/expr/types"
+	"github.com/go-graphite/carbonapi/limiter"
 	"github.com/go-graphite/carbonapi/pkg/parser"
 	utilctx "github.com/go-graphite/carbonapi/util/ctx"
 	"github.com/go-graphite/carbonapi/zipper/helper"
@@ -67,9 +71,11 @@ func getCacheTimeout(logger *zap.Logger, r *http.Request, now32, until32 int64,
 func renderHandler(w http.ResponseWriter, r *http.Request) {
 	t0 := time.Now()
 	uid := uuid.NewV4()
+	// the whole request is served with the same config, even if it's reloaded meanwhile
+	cfg := config.FromContext(r.Context())
 
 	// TODO: Migrate to context.WithTimeout
-	// ctx, _ := context.WithTimeout(context.TODO(), config.Config.ZipperTimeout)
+	// ctx, _ := context.WithTimeout(context.TODO(), cfg.ZipperTimeout)
 	ctx := utilctx.SetUUID(r.Context(), uid.String())
 	username, _, _ := r.BasicAuth()
 	requestHeaders := utilctx.GetLogHeaders(ctx)
@@ -154,8 +160,8 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 
 	// normalize from and until values
 	qtz := r.FormValue("tz")
-	from32 := date.DateParamToEpoch(from, qtz, now.Add(-24*time.Hour).Unix(), config.Config.DefaultTimeZone)
-	until32 := date.DateParamToEpoch(until, qtz, now.Unix(), config.Config.DefaultTimeZone)
+	from32 := date.DateParamToEpoch(from, qtz, now.Add(-24*time.Hour).Unix(), cfg.DefaultTimeZone)
+	until32 := date.DateParamToEpoch(until, qtz, now.Unix(), cfg.DefaultTimeZone)
 
 	var (
 		responseCacheKey     string
@@ -164,21 +170,21 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 	)
 
 	duration := time.Second * time.Duration(until32-from32)
-	if len(config.Config.TruncateTime) > 0 {
-		from32 = timestampTruncate(from32, duration, config.Config.TruncateTime)
-		until32 = timestampTruncate(until32, duration, config.Config.TruncateTime)
+	if len(cfg.TruncateTime) > 0 {
+		from32 = timestampTruncate(from32, duration, cfg.TruncateTime)
+		until32 = timestampTruncate(until32, duration, cfg.TruncateTime)
 		// recalc duration
 		duration = time.Second * time.Duration(until32-from32)
 		responseCacheKey = responseCacheComputeKey(from32, until32, targets, formatRaw, maxDataPoints, noNullPoints, template)
 		if useCache {
-			responseCacheTimeout = getCacheTimeout(logger, r, now32, until32, duration, &config.Config.ResponseCacheConfig)
-			backendCacheTimeout = getCacheTimeout(logger, r, now32, until32, duration, &config.Config.BackendCacheConfig)
+			responseCacheTimeout = getCacheTimeout(logger, r, now32, until32, duration, &cfg.ResponseCacheConfig)
+			backendCacheTimeout = getCacheTimeout(logger, r, now32, until32, duration, &cfg.BackendCacheConfig)
 		}
 	} else {
 		responseCacheKey = r.Form.Encode()
 		if useCache {
-			responseCacheTimeout = getCacheTimeout(logger, r, now32, until32, duration, &config.Config.ResponseCacheConfig)
-			backendCacheTimeout = getCacheTimeout(logger, r, now32, until32, duration, &config.Config.BackendCacheConfig)
+			responseCacheTimeout = getCacheTimeout(logger, r, now32, until32, duration, &cfg.ResponseCacheConfig)
+			backendCacheTimeout = getCacheTimeout(logger, r, now32, until32, duration, &cfg.BackendCacheConfig)
 		}
 	}
 
@@ -221,23 +227,125 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if queryLengthLimitExceeded(targets, config.Config.MaxQueryLength) {
+	if queryLengthLimitExceeded(targets, cfg.MaxQueryLength) {
 		setError(w, accessLogDetails, "total target length limit exceeded", http.StatusBadRequest, uid.String())
 		logAsError = true
 		return
 	}
 
-	if useCache {
+	queryCost := newQueryCost(r, cfg)
+	if queryCost != nil {
+		ctx = utilctx.SetQueryCost(ctx, queryCost)
+	}
+
+	if isExplainRequest(r.URL.Path, r.FormValue("explain")) {
+		if from32 >= until32 {
+			setError(w, accessLogDetails, "Invalid or empty time range", http.StatusBadRequest, uid.String())
+			logAsError = true
+			return
+		}
+
+		exprs, msg := parseTargets(targets)
+		if msg != "" {
+			setError(w, accessLogDetails, msg, http.StatusBadRequest, uid.String())
+			logAsError = true
+			return
+		}
+
+		res := explainResponse{
+			From:                from32,
+			Until:               until32,
+			CacheKey:            responseCacheKey,
+			CacheTimeout:        responseCacheTimeout,
+			BackendCacheTimeout: backendCacheTimeout,
+		}
+		if len(cfg.TruncateTime) > 0 {
+			res.BackendCacheKey = backendCacheComputeKeyAbs(from32, until32, targets, maxDataPoints, noNullPoints)
+		} else {
+			// key of the same request for data
+			form := maps.Clone(r.Form)
+			form.Del("explain")
+			form.Del("profile")
+			res.CacheKey = form.Encode()
+			res.BackendCacheKey = backendCacheComputeKey(from, until, targets, maxDataPoints, noNullPoints)
+		}
+		renderExplain(ctx, &res, exprs, targets, parser.TruthyBool(r.FormValue("profile")))
+
+		body, err := json.Marshal(res)
+		if err != nil {
+			setError(w, accessLogDetails, err.Error(), http.StatusInternalServerError, uid.String())
+			logAsError = true
+			return
+		}
+		accessLogDetails.CarbonapiResponseSizeBytes = int64(len(body))
+		writeResponse(w, http.StatusOK, body, jsonFormat, jsonp, uid.String())
+		return
+	}
+
+	if parser.TruthyBool(r.FormValue("dryRun")) {
+		if from32 >= until32 {
+			setError(w, accessLogDetails, "Invalid or empty time range", http.StatusBadRequest, uid.String())
+			logAsError = true
+			return
+		}
+
+		exprs, msg := parseTargets(targets)
+		if msg != "" {
+			setError(w, accessLogDetails, msg, http.StatusBadRequest, uid.String())
+			logAsError = true
+			return
+		}
+
+		limits := cfg.QueryLimits.Get(quotaKey(r, &cfg.Quotas))
+		body, err := json.Marshal(renderDryRun(ctx, exprs, targets, from32, until32, now32, limits))
+		if err != nil {
+			setError(w, accessLogDetails, err.Error(), http.StatusInternalServerError, uid.String())
+			logAsError = true
+			return
+		}
+		accessLogDetails.CarbonapiResponseSizeBytes = int64(len(body))
+		writeResponse(w, http.StatusOK, body, jsonFormat, jsonp, uid.String())
+		return
+	}
+
+	// background refresh renders the response again, even if it's still in the cache
+	refresh := isRefresh(ctx)
+	if useCache && !refresh {
 		tc := time.Now()
-		response, err := config.Config.ResponseCache.Get(responseCacheKey)
+		response, err := cfg.ResponseCache.Get(responseCacheKey)
 		td := time.Since(tc).Nanoseconds()
 		ApiMetrics.RequestsCacheOverheadNS.Add(uint64(td))
 
+		cacheStatus := cacheStatusHit
+		cacheConfig := &cfg.ResponseCacheConfig
+		if err == nil && staleEnabled(cacheConfig) {
+			cached, ok := decodeCachedResponse(response)
+			if !ok {
+				err = cache.ErrNotFound
+			} else if cached.needsRefresh(now, cacheConfig.EarlyRefreshBeta) {
+				// request body is already read, so protobuf requests can't be refreshed in the background
+				if format == protoV3Format {
+					err = cache.ErrNotFound
+				} else {
+					refreshResponse(r, responseCacheKey)
+					if now.Unix() >= cached.freshUntil {
+						cacheStatus = cacheStatusStale
+					}
+				}
+			}
+			response = cached.body
+		}
+
 		accessLogDetails.CarbonzipperResponseSizeBytes = 0
 		accessLogDetails.CarbonapiResponseSizeBytes = int64(len(response))
 
 		if err == nil {
-			ApiMetrics.RequestCacheHits.Add(1)
+			if cacheStatus == cacheStatusStale {
+				ApiMetrics.RequestCacheStaleHits.Add(1)
+			} else {
+				ApiMetrics.RequestCacheHits.Add(1)
+			}
+			w.Header().Set("X-Carbonapi-Cache", cacheStatus)
 			w.Header().Set("X-Carbonapi-Request-Cached", strconv.FormatInt(int64(responseCacheTimeout), 10))
 			writeResponse(w, http.StatusOK, response, format, jsonp, uid.String())
 			accessLogDetails.FromCache = true
@@ -245,6 +353,7 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		ApiMetrics.RequestCacheMisses.Add(1)
 	}
+	w.Header().Set("X-Carbonapi-Cache", cacheStatusMiss)
 
 	if from32 >= until32 {
 		setError(w, accessLogDetails, "Invalid or empty time range", http.StatusBadRequest, uid.String())
@@ -261,7 +370,7 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 			)
 			logAsError = true
 			var answer string
-			if config.Config.HTTPResponseStackTrace {
+			if cfg.HTTPResponseStackTrace {
 				answer = fmt.Sprintf("%v\nStack trace: %v", r, zap.Stack("").String)
 			} else {
 				answer = fmt.Sprint(r)
@@ -273,13 +382,13 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 	errors := make(map[string]merry.Error)
 
 	var backendCacheKey string
-	if len(config.Config.TruncateTime) > 0 {
+	if len(cfg.TruncateTime) > 0 {
 		backendCacheKey = backendCacheComputeKeyAbs(from32, until32, targets, maxDataPoints, noNullPoints)
 	} else {
 		backendCacheKey = backendCacheComputeKey(from, until, targets, maxDataPoints, noNullPoints)
 	}
 
-	results, err := backendCacheFetchResults(logger, useCache, backendCacheKey, accessLogDetails)
+	results, err := backendCacheFetchResults(cfg, logger, useCache && !refresh, backendCacheKey, accessLogDetails)
 
 	if err != nil {
 		ApiMetrics.BackendCacheMisses.Add(1)
@@ -287,7 +396,7 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 		results = make([]*types.MetricData, 0)
 		values := make(map[parser.MetricRequest][]*types.MetricData)
 
-		if config.Config.CombineMultipleTargetsInOne && len(targets) > 0 {
+		if cfg.CombineMultipleTargetsInOne && len(targets) > 0 {
 			exprs := make([]parser.Expr, 0, len(targets))
 			for _, target := range targets {
 				exp, e, err := parser.ParseExpr(target)
@@ -302,10 +411,15 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 
 			ApiMetrics.RenderRequests.Add(1)
 
-			result, errs := expr.FetchAndEvalExprs(ctx, config.Config.Evaluator, exprs, from32, until32, values)
+			result, errs := expr.FetchAndEvalExprs(ctx, cfg.Evaluator, exprs, from32, until32, values)
 			if errs != nil {
 				errors = errs
 			}
+			if err := queryCostError(errs); err != nil {
+				setError(w, accessLogDetails, merry.Message(err), http.StatusUnprocessableEntity, uid.String())
+				logAsError = true
+				return
+			}
 
 			results = append(results, result...)
 		} else {
@@ -320,10 +434,16 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 
 				ApiMetrics.RenderRequests.Add(1)
 
-				result, err := expr.FetchAndEvalExp(ctx, config.Config.Evaluator, exp, from32, until32, values)
+				result, err := expr.FetchAndEvalExp(ctx, cfg.Evaluator, exp, from32, until32, values)
+				if merry.Is(err, limiter.ErrQueryCostExceeded) {
+					// stop early, other targets would only make it worse
+					setError(w, accessLogDetails, merry.Message(err), http.StatusUnprocessableEntity, uid.String())
+					logAsError = true
+					return
+				}
 				if err != nil {
 					errors[target] = merry.Wrap(err)
-					if config.Config.Upstreams.RequireSuccessAll {
+					if cfg.Upstreams.RequireSuccessAll {
 						code := merry.HTTPCode(err)
 						if code != http.StatusOK && code != http.StatusNotFound {
 							break
@@ -337,7 +457,7 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 
 		if len(errors) == 0 && backendCacheTimeout > 0 {
 			w.Header().Set("X-Carbonapi-Backend-Cached", strconv.FormatInt(int64(backendCacheTimeout), 10))
-			backendCacheStoreResults(logger, backendCacheKey, results, backendCacheTimeout)
+			backendCacheStoreResults(cfg, logger, backendCacheKey, targets, results, backendCacheTimeout)
 		}
 	}
 
@@ -349,7 +469,7 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 	var body []byte
 
 	returnCode := http.StatusOK
-	if len(results) == 0 || (len(errors) > 0 && config.Config.Upstreams.RequireSuccessAll) {
+	if len(results) == 0 || (len(errors) > 0 && cfg.Upstreams.RequireSuccessAll) {
 		// Obtain error code from the errors
 		// In case we have only "Not Found" errors, result should be 404
 		// Otherwise it should be 500
@@ -358,7 +478,7 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 		logger.Debug("error response or no response", zap.Any("error", errMsgs))
 		// Allow override status code for 404-not-found replies.
 		if returnCode == http.StatusNotFound {
-			returnCode = config.Config.NotFoundStatusCode
+			returnCode = cfg.NotFoundStatusCode
 		}
 
 		if returnCode == http.StatusBadRequest || returnCode == http.StatusNotFound || returnCode == http.StatusForbidden || returnCode >= 500 {
@@ -368,51 +488,71 @@ func renderHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	switch format {
-	case jsonFormat:
-		if maxDataPoints != 0 {
-			types.ConsolidateJSON(maxDataPoints, results)
-			accessLogDetails.MaxDataPoints = maxDataPoints
-		}
+	if format == jsonFormat && maxDataPoints != 0 {
+		types.ConsolidateJSON(maxDataPoints, results)
+		accessLogDetails.MaxDataPoints = maxDataPoints
+	}
 
-		body = types.MarshalJSON(results, timestampMultiplier, noNullPoints)
-	case protoV2Format:
-		body, err = types.MarshalProtobufV2(results)
-		if err != nil {
-			setError(w, accessLogDetails, err.Error(), http.StatusInternalServerError, uid.String())
-			logAsError = true
-			return
+	accessLogDetails.Metrics = targets
+	accessLogDetails.CarbonzipperResponseSizeBytes = int64(size)
+
+	if isStreamingFormat(format) {
+		// response can be huge, so it's not materialized in memory (except a copy for the response cache)
+		var tee *cacheTee
+		if len(results) != 0 && responseCacheTimeout > 0 {
+			tee = newCacheTee(cfg.ResponseCacheConfig.MaxItemSizeKb * 1024)
+		}
+		params := streamParams{
+			format:              format,
+			jsonp:               jsonp,
+			timestampMultiplier: timestampMultiplier,
+			noNullPoints:        noNullPoints,
 		}
-	case protoV3Format:
-		body, err = types.MarshalProtobufV3(results)
+		accessLogDetails.CarbonapiResponseSizeBytes, err = streamResponse(w, returnCode, results, params, tee, uid.String())
 		if err != nil {
-			setError(w, accessLogDetails, err.Error(), http.StatusInternalServerError, uid.String())
-			logAsError = true
-			return
+			// status is already sent, partial response must not be cached
+			logger.Debug("failed to write response", zap.Error(err))
+			accessLogDetails.Reason = err.Error()
+		} else if tee != nil {
+			if body = tee.Bytes(); body != nil {
+				tc := time.Now()
+				storeResponse(cfg, responseCacheKey, targets, body, responseCacheTimeout, tc.Sub(t0))
+				td := time.Since(tc).Nanoseconds()
+				ApiMetrics.RequestsCacheOverheadNS.Add(uint64(td))
+			}
+		}
+	} else {
+		switch format {
+		case protoV2Format:
+			body, err = types.MarshalProtobufV2(results)
+			if err != nil {
+				setError(w, accessLogDetails, err.Error(), http.StatusInternalServerError, uid.String())
+				logAsError = true
+				return
+			}
+		case protoV3Format:
+			body, err = types.MarshalProtobufV3(results)
+			if err != nil {
+				setError(w, accessLogDetails, err.Error(), http.StatusInternalServerError, uid.String())
+				logAsError = true
+				return
+			}
+		case pngFormat:
+			body = png.MarshalPNGRequest(r, results, template)
+		case svgFormat:
+			body = png.MarshalSVGRequest(r, results, template)
 		}
-	case rawFormat:
-		body = types.MarshalRaw(results)
-	case csvFormat:
-		body = types.MarshalCSV(results)
-	case pickleFormat:
-		body = types.MarshalPickle(results)
-	case pngFormat:
-		body = png.MarshalPNGRequest(r, results, template)
-	case svgFormat:
-		body = png.MarshalSVGRequest(r, results, template)
-	}
 
-	accessLogDetails.Metrics = targets
-	accessLogDetails.CarbonzipperResponseSizeBytes = int64(size)
-	accessLogDetails.CarbonapiResponseSizeBytes = int64(len(body))
+		accessLogDetails.CarbonapiResponseSizeBytes = int64(len(body))
 
-	writeResponse(w, returnCode, body, format, jsonp, uid.String())
+		writeResponse(w, returnCode, body, format, jsonp, uid.String())
 
-	if len(results) != 0 {
-		tc := time.Now()
-		config.Config.ResponseCache.Set(responseCacheKey, body, responseCacheTimeout)
-		td := time.Since(tc).Nanoseconds()
-		ApiMetrics.RequestsCacheOverheadNS.Add(uint64(td))
+		if len(results) != 0 {
+			tc := time.Now()
+			storeResponse(cfg, responseCacheKey, targets, body, responseCacheTimeout, tc.Sub(t0))
+			td := time.Since(tc).Nanoseconds()
+			ApiMetrics.RequestsCacheOverheadNS.Add(uint64(td))
+		}
 	}
 
 	gotErrors := len(errors) > 0
@@ -481,12 +621,12 @@ func backendCacheComputeKeyAbs(from, until int64, targets []string, maxDataPoint
 	return backendCacheKey.String()
 }
 
-func backendCacheFetchResults(logger *zap.Logger, useCache bool, backendCacheKey string, accessLogDetails *carbonapipb.AccessLogDetails) ([]*types.MetricData, error) {
+func backendCacheFetchResults(cfg *config.ConfigType, logger *zap.Logger, useCache bool, backendCacheKey string, accessLogDetails *carbonapipb.AccessLogDetails) ([]*types.MetricData, error) {
 	if !useCache {
 		return nil, errors.New("useCache is false")
 	}
 
-	backendCacheResults, err := config.Config.BackendCache.Get(backendCacheKey)
+	backendCacheResults, err := cfg.BackendCache.Get(backendCacheKey)
 
 	if err != nil {
 		return nil, err
@@ -508,7 +648,7 @@ func backendCacheFetchResults(logger *zap.Logger, useCache bool, backendCacheKey
 	return results, nil
 }
 
-func backendCacheStoreResults(logger *zap.Logger, backendCacheKey string, results []*types.MetricData, backendCacheTimeout int32) {
+func backendCacheStoreResults(cfg *config.ConfigType, logger *zap.Logger, backendCacheKey string, targets []string, results []*types.MetricData, backendCacheTimeout int32) {
 	var serializedResults bytes.Buffer
 	enc := gob.NewEncoder(&serializedResults)
 	err := enc.Encode(results)
@@ -518,5 +658,5 @@ func backendCacheStoreResults(logger *zap.Logger, backendCacheKey string, result
 		return
 	}
 
-	config.Config.BackendCache.Set(backendCacheKey, serializedResults.Bytes(), backendCacheTimeout)
+	setCacheTagged(cfg.BackendCache, backendCacheKey, serializedResults.Bytes(), backendCacheTimeout, targets)
 }
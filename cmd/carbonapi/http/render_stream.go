@@ -0,0 +1,116 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+	"github.com/go-graphite/carbonapi/expr/types"
+)
+
+// isStreamingFormat checks that render response in the format is written to the client series by series
+func isStreamingFormat(format responseFormat) bool {
+	switch format {
+	case jsonFormat, csvFormat, rawFormat, pickleFormat, msgpackFormat:
+		return true
+	}
+	return false
+}
+
+// cacheTee keeps a copy of the streamed response for the response cache.
+// Copy is dropped and the rest of response is not copied, if response is bigger than limit.
+type cacheTee struct {
+	buf      bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+// newCacheTee returns tee with the limit in bytes, config.DefaultMaxItemSizeKb is used, if it's not set
+func newCacheTee(limit int) *cacheTee {
+	if limit <= 0 {
+		limit = config.DefaultMaxItemSizeKb * 1024
+	}
+	return &cacheTee{limit: limit}
+}
+
+func (t *cacheTee) Write(p []byte) (int, error) {
+	if t.overflow {
+		return len(p), nil
+	}
+	if t.buf.Len()+len(p) > t.limit {
+		t.overflow = true
+		t.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return t.buf.Write(p)
+}
+
+// Bytes returns copy of response, nil if response was too big
+func (t *cacheTee) Bytes() []byte {
+	if t.overflow {
+		return nil
+	}
+	return t.buf.Bytes()
+}
+
+// countWriter counts bytes written to the client
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type streamParams struct {
+	format              responseFormat
+	jsonp               string
+	timestampMultiplier int64
+	noNullPoints        bool
+}
+
+// streamResponse writes results to the client series by series (with chunked transfer encoding for big responses).
+// If tee is not nil, response (without jsonp callback) is also copied to it.
+// Amount of bytes written to the client is returned. Status code is already sent on error, so it can only be logged.
+func streamResponse(w http.ResponseWriter, returnCode int, results []*types.MetricData, params streamParams, tee *cacheTee, carbonapiUUID string) (int64, error) {
+	writeResponseHeader(w, returnCode, params.format, params.jsonp, carbonapiUUID)
+
+	cw := &countWriter{w: w}
+	var out io.Writer = cw
+	if tee != nil {
+		out = io.MultiWriter(cw, tee)
+	}
+
+	var err error
+	if params.format == jsonFormat && params.jsonp != "" {
+		if _, err = cw.Write([]byte(params.jsonp + "(")); err != nil {
+			return cw.n, err
+		}
+	}
+
+	switch params.format {
+	case jsonFormat:
+		err = types.WriteJSON(out, results, params.timestampMultiplier, params.noNullPoints)
+	case csvFormat:
+		err = types.WriteCSV(out, results)
+	case rawFormat:
+		err = types.WriteRaw(out, results)
+	case pickleFormat:
+		err = types.WritePickle(out, results)
+	case msgpackFormat:
+		err = types.WriteMsgpack(out, results)
+	}
+	if err != nil {
+		return cw.n, err
+	}
+
+	if params.format == jsonFormat && params.jsonp != "" {
+		_, err = cw.Write([]byte{')'})
+	}
+
+	return cw.n, err
+}
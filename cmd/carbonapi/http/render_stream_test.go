@@ -0,0 +1,128 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-graphite/carbonapi/cache"
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+)
+
+// recordingCache keeps values stored in the response cache
+type recordingCache struct {
+	cache.NullCache
+	values [][]byte
+}
+
+func (c *recordingCache) Set(_ string, v []byte, _ int32) {
+	c.values = append(c.values, v)
+}
+
+func TestRenderStreaming(t *testing.T) {
+	savedCache, savedCacheConfig := config.Config.ResponseCache, config.Config.ResponseCacheConfig
+	defer func() {
+		config.Config.ResponseCache, config.Config.ResponseCacheConfig = savedCache, savedCacheConfig
+	}()
+
+	tests := []struct {
+		name        string
+		url         string
+		contentType string
+		body        string
+		maxItemSize int
+		cached      string
+	}{
+		{
+			name:        "json",
+			url:         "/render/?target=foo.bar&from=-10minutes&format=json",
+			contentType: contentTypeJSON,
+			body:        `[{"target":"foo.bar","datapoints":[[null,1510913280],[1510913759,1510913340],[1510913818,1510913400]],"tags":{}}]`,
+			cached:      `[{"target":"foo.bar","datapoints":[[null,1510913280],[1510913759,1510913340],[1510913818,1510913400]],"tags":{}}]`,
+		},
+		{
+			name:        "jsonp",
+			url:         "/render/?target=foo.bar&from=-10minutes&format=json&jsonp=cb",
+			contentType: contentTypeJavaScript,
+			body:        `cb([{"target":"foo.bar","datapoints":[[null,1510913280],[1510913759,1510913340],[1510913818,1510913400]],"tags":{}}])`,
+			cached:      `[{"target":"foo.bar","datapoints":[[null,1510913280],[1510913759,1510913340],[1510913818,1510913400]],"tags":{}}]`,
+		},
+		{
+			name:        "raw",
+			url:         "/render/?target=foo.bar&from=-10minutes&format=raw",
+			contentType: contentTypeRaw,
+			body:        "foo.bar,1510913280,1510913880,60|None,1510913759,1510913818\n",
+			cached:      "foo.bar,1510913280,1510913880,60|None,1510913759,1510913818\n",
+		},
+		{
+			name:        "too big for cache",
+			url:         "/render/?target=foo.bar&from=-10minutes&format=raw",
+			contentType: contentTypeRaw,
+			body:        "foo.bar,1510913280,1510913880,60|None,1510913759,1510913818\n",
+			maxItemSize: 1,
+		},
+		{
+			name:        "no cache",
+			url:         "/render/?target=foo.bar&from=-10minutes&format=raw&cacheTimeout=0",
+			contentType: contentTypeRaw,
+			body:        "foo.bar,1510913280,1510913880,60|None,1510913759,1510913818\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responseCache := &recordingCache{}
+			config.Config.ResponseCache = responseCache
+			config.Config.ResponseCacheConfig.MaxItemSizeKb = tt.maxItemSize
+			if tt.maxItemSize > 0 {
+				// make response bigger than limit
+				tt.url += "&target=" + longTarget(1024)
+			}
+
+			req, rr := setUpRequest(t, tt.url)
+			renderHandler(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, tt.contentType, rr.Header().Get("Content-Type"))
+			if tt.maxItemSize == 0 {
+				assert.Equal(t, tt.body, rr.Body.String())
+			}
+			if tt.cached != "" {
+				if assert.Len(t, responseCache.values, 1) {
+					assert.Equal(t, tt.cached, string(responseCache.values[0]))
+				}
+			} else {
+				assert.Empty(t, responseCache.values)
+			}
+		})
+	}
+}
+
+func longTarget(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = 'a'
+	}
+	return "alias(foo.bar,'" + string(b) + "')"
+}
+
+func TestCacheTee(t *testing.T) {
+	tee := newCacheTee(0)
+	assert.Equal(t, config.DefaultMaxItemSizeKb*1024, tee.limit)
+
+	tee = newCacheTee(10)
+	n, err := tee.Write([]byte("0123456789"))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, "0123456789", string(tee.Bytes()))
+
+	// copy is dropped at once, the rest of response is not copied
+	n, err = tee.Write([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Nil(t, tee.Bytes())
+	assert.Equal(t, 0, tee.buf.Cap())
+	_, _ = tee.Write([]byte("b"))
+	assert.Nil(t, tee.Bytes())
+	assert.Equal(t, 0, tee.buf.Cap())
+}
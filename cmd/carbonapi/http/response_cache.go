@@ -0,0 +1,205 @@
+package http
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-graphite/carbonapi/cache"
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+)
+
+// values of X-Carbonapi-Cache header
+const (
+	cacheStatusHit   = "hit"
+	cacheStatusStale = "stale"
+	cacheStatusMiss  = "miss"
+)
+
+const (
+	cachedResponseMagic = 0xc5
+	// magic, fresh until (unix time), compute time (ms)
+	cachedResponseHeaderSize = 1 + 8 + 4
+)
+
+// cachedResponse is a value of the response cache, when stale entries can be served.
+// Entries are kept in the cache for the stale window after they are expired.
+type cachedResponse struct {
+	body       []byte
+	freshUntil int64
+	// computeTime is a time it took to render the response, expensive responses are refreshed earlier
+	computeTime time.Duration
+}
+
+// staleEnabled returns true, if response cache entries are stored with freshness header
+func staleEnabled(cfg *config.CacheConfig) bool {
+	return cfg.StaleSec > 0 || cfg.EarlyRefreshBeta > 0
+}
+
+func encodeCachedResponse(c cachedResponse) []byte {
+	ms := c.computeTime.Milliseconds()
+	if ms > math.MaxUint32 {
+		ms = math.MaxUint32
+	}
+	v := make([]byte, 0, cachedResponseHeaderSize+len(c.body))
+	v = append(v, cachedResponseMagic)
+	v = binary.BigEndian.AppendUint64(v, uint64(c.freshUntil))
+	v = binary.BigEndian.AppendUint32(v, uint32(ms))
+	return append(v, c.body...)
+}
+
+func decodeCachedResponse(v []byte) (cachedResponse, bool) {
+	if len(v) < cachedResponseHeaderSize || v[0] != cachedResponseMagic {
+		return cachedResponse{}, false
+	}
+	return cachedResponse{
+		freshUntil:  int64(binary.BigEndian.Uint64(v[1:])),
+		computeTime: time.Duration(binary.BigEndian.Uint32(v[9:])) * time.Millisecond,
+		body:        v[cachedResponseHeaderSize:],
+	}, true
+}
+
+// needsRefresh returns true, if entry is expired or should be refreshed early.
+// Early refresh is probabilistic (XFetch): chance grows as expiration comes closer and for expensive responses,
+// so usually only a single request refreshes a hot key before it expires.
+func (c *cachedResponse) needsRefresh(now time.Time, beta float64) bool {
+	if now.Unix() >= c.freshUntil {
+		return true
+	}
+	if beta <= 0 || c.computeTime <= 0 {
+		return false
+	}
+	early := -c.computeTime.Seconds() * beta * math.Log(rand.Float64())
+	return float64(now.UnixNano())/1e9+early >= float64(c.freshUntil)
+}
+
+// storeResponse puts rendered response to the response cache
+func storeResponse(cfg *config.ConfigType, key string, targets []string, body []byte, timeout int32, computeTime time.Duration) {
+	expire := timeout
+	if timeout > 0 && staleEnabled(&cfg.ResponseCacheConfig) {
+		body = encodeCachedResponse(cachedResponse{
+			body:        body,
+			freshUntil:  timeNow().Unix() + int64(timeout),
+			computeTime: computeTime,
+		})
+		expire += cfg.ResponseCacheConfig.StaleSec
+	}
+	setCacheTagged(cfg.ResponseCache, key, body, expire, targets)
+}
+
+type refreshContextKey struct{}
+
+// isRefresh returns true for requests, that refresh the response cache in the background
+func isRefresh(ctx context.Context) bool {
+	return ctx.Value(refreshContextKey{}) != nil
+}
+
+const (
+	// refreshWorkers limits count of background refreshes running at once
+	refreshWorkers = 8
+	// refreshQueueSize limits count of refreshes waiting for a worker, other refreshes are dropped
+	refreshQueueSize = 256
+)
+
+type refreshTask struct {
+	// key is set for refreshes of stale responses, warm up requests have no key
+	key string
+	req *http.Request
+	// done is called with status code of the response, if it's set
+	done func(code int)
+}
+
+var (
+	// refreshing contains keys of the response cache, that are refreshed now or wait for a worker
+	refreshing          sync.Map
+	refreshQueue        = make(chan refreshTask, refreshQueueSize)
+	startRefreshWorkers sync.Once
+
+	// refreshHandler is a render handler with the same middlewares as requests of clients (quota, metrics, etc.),
+	// it's set by InitHandlers
+	refreshHandler http.HandlerFunc
+)
+
+// refreshResponse queues the request to be rendered again in the background to update the response cache.
+// Only a single refresh of the key is queued or running at a time, refresh is dropped if queue is full.
+func refreshResponse(r *http.Request, key string) bool {
+	if _, loaded := refreshing.LoadOrStore(key, struct{}{}); loaded {
+		return false
+	}
+	startRefresh()
+
+	// refresh is not cancelled, when the client, which got the stale response, goes away
+	ctx := context.WithValue(context.WithoutCancel(r.Context()), refreshContextKey{}, true)
+	select {
+	case refreshQueue <- refreshTask{key: key, req: r.Clone(ctx)}:
+		ApiMetrics.RequestCacheRefreshes.Add(1)
+		return true
+	default:
+		refreshing.Delete(key)
+		return false
+	}
+}
+
+// warmResponse queues the request to be rendered and stored in the response cache by refresh workers. Unlike refreshes,
+// warm up waits for a free place in the queue, until the context is done.
+func warmResponse(ctx context.Context, r *http.Request, done func(code int)) error {
+	startRefresh()
+	select {
+	case refreshQueue <- refreshTask{req: r, done: done}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func startRefresh() {
+	startRefreshWorkers.Do(func() {
+		for i := 0; i < refreshWorkers; i++ {
+			go refreshWorker()
+		}
+	})
+}
+
+func refreshWorker() {
+	for t := range refreshQueue {
+		handler := refreshHandler
+		if handler == nil {
+			handler = withQuota("render", renderHandler)
+		}
+		w := newDiscardResponseWriter()
+		handler(w, t.req)
+		if t.key != "" {
+			refreshing.Delete(t.key)
+		}
+		if t.done != nil {
+			t.done(w.code)
+		}
+	}
+}
+
+// discardResponseWriter is used for background refreshes and warm up, response is only stored in the cache
+type discardResponseWriter struct {
+	header http.Header
+	code   int
+}
+
+func newDiscardResponseWriter() *discardResponseWriter {
+	return &discardResponseWriter{header: make(http.Header), code: http.StatusOK}
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponseWriter) WriteHeader(code int)        { w.code = code }
+
+// setCacheTagged stores value, indexing its key with render targets, if cache has key index
+func setCacheTagged(c cache.BytesCache, k string, v []byte, expire int32, targets []string) {
+	if i, ok := c.(*cache.IndexedCache); ok {
+		i.SetTagged(k, v, expire, targets)
+		return
+	}
+	c.Set(k, v, expire)
+}
@@ -0,0 +1,126 @@
+package http
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-graphite/carbonapi/cache"
+	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
+	"github.com/go-graphite/carbonapi/limiter"
+)
+
+func waitForRefreshes(t *testing.T) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		running := false
+		refreshing.Range(func(_, _ any) bool {
+			running = true
+			return false
+		})
+		if !running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("refresh is not finished")
+}
+
+func TestRenderStaleResponse(t *testing.T) {
+	savedCache, savedCacheConfig, savedTimeNow := config.Config.ResponseCache, config.Config.ResponseCacheConfig, timeNow
+	defer func() {
+		config.Config.ResponseCache, config.Config.ResponseCacheConfig, timeNow = savedCache, savedCacheConfig, savedTimeNow
+	}()
+
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	config.Config.ResponseCache = cache.NewExpireCache(1024 * 1024)
+	config.Config.ResponseCacheConfig.DefaultTimeoutSec = 60
+	config.Config.ResponseCacheConfig.StaleSec = 600
+
+	render := func(expectedStatus string) {
+		t.Helper()
+		req, rr := setUpRequest(t, "/render/?target=foo.bar&from=-10minutes&format=json")
+		renderHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, expectedStatus, rr.Header().Get("X-Carbonapi-Cache"))
+		assert.Equal(t, `[{"target":"foo.bar","datapoints":[[null,1510913280],[1510913759,1510913340],[1510913818,1510913400]],"tags":{}}]`, rr.Body.String())
+	}
+
+	render(cacheStatusMiss)
+	render(cacheStatusHit)
+
+	refreshes := ApiMetrics.RequestCacheRefreshes.Count()
+	now = now.Add(2 * time.Minute)
+	render(cacheStatusStale)
+	waitForRefreshes(t)
+	assert.Equal(t, refreshes+1, ApiMetrics.RequestCacheRefreshes.Count())
+
+	// entry was refreshed in the background
+	render(cacheStatusHit)
+}
+
+func TestRefreshResponse(t *testing.T) {
+	savedHandler, savedQuotas, savedLimiter := refreshHandler, config.Config.Quotas, config.Config.QuotaLimiter
+	defer func() {
+		refreshHandler, config.Config.Quotas, config.Config.QuotaLimiter = savedHandler, savedQuotas, savedLimiter
+	}()
+
+	// refreshes pass quota of the user
+	config.Config.Quotas = config.QuotasConfig{Enabled: true, AnonymousKey: "anonymous"}
+	config.Config.QuotaLimiter = limiter.NewQuotaLimiter(limiter.Quota{Concurrency: 1}, nil)
+	_, err := config.Config.QuotaLimiter.Enter("anonymous")
+	assert.NoError(t, err)
+
+	release := make(chan struct{})
+	var calls, rejected atomic.Int32
+	refreshHandler = withQuota("render", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+	})
+
+	req, _ := setUpRequest(t, "/render/?target=foo.bar")
+	assert.True(t, refreshResponse(req, "rejected"))
+	waitForRefreshes(t)
+	assert.Equal(t, int32(0), calls.Load())
+	config.Config.QuotaLimiter.Leave("anonymous")
+
+	// duplicate refreshes of the key are dropped
+	assert.True(t, refreshResponse(req, "key"))
+	for i := 0; i < 10; i++ {
+		if refreshResponse(req, "key") {
+			rejected.Add(1)
+		}
+	}
+	close(release)
+	waitForRefreshes(t)
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, int32(0), rejected.Load())
+}
+
+func TestCachedResponseNeedsRefresh(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		name     string
+		entry    cachedResponse
+		beta     float64
+		expected bool
+	}{
+		{name: "fresh", entry: cachedResponse{freshUntil: 1060, computeTime: time.Second}, expected: false},
+		{name: "expired", entry: cachedResponse{freshUntil: 1000}, expected: true},
+		{name: "early refresh", entry: cachedResponse{freshUntil: 1060, computeTime: time.Hour}, beta: 1000, expected: true},
+		{name: "early refresh, cheap response", entry: cachedResponse{freshUntil: 1060}, beta: 1000, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := encodeCachedResponse(cachedResponse{body: []byte("body"), freshUntil: tt.entry.freshUntil, computeTime: tt.entry.computeTime})
+			decoded, ok := decodeCachedResponse(encoded)
+			assert.True(t, ok)
+			assert.Equal(t, "body", string(decoded.body))
+			assert.Equal(t, tt.expected, decoded.needsRefresh(now, tt.beta))
+		})
+	}
+}
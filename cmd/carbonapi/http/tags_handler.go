@@ -23,6 +23,7 @@ func tagHandler(w http.ResponseWriter, r *http.Request) {
 	t0 := time.Now()
 	uuid := uuid.NewV4()
 	carbonapiUUID := uuid.String()
+	cfg := config.FromContext(r.Context())
 
 	// TODO: Migrate to context.WithTimeout
 	ctx := utilctx.SetUUID(r.Context(), carbonapiUUID)
@@ -81,7 +82,7 @@ func tagHandler(w http.ResponseWriter, r *http.Request) {
 	q.Del("pretty")
 	rawQuery := q.Encode()
 
-	if queryLengthLimitExceeded(r.Form["query"], config.Config.MaxQueryLength) {
+	if queryLengthLimitExceeded(r.Form["query"], cfg.MaxQueryLength) {
 		setError(w, accessLogDetails, "query length limit exceeded", http.StatusBadRequest, carbonapiUUID)
 		logAsError = true
 		return
@@ -90,9 +91,9 @@ func tagHandler(w http.ResponseWriter, r *http.Request) {
 	// TODO(civil): Implement caching
 	var res []string
 	if strings.HasSuffix(r.URL.Path, "tags") || strings.HasSuffix(r.URL.Path, "tags/") {
-		res, err = config.Config.ZipperInstance.TagNames(ctx, rawQuery, limit)
+		res, err = cfg.ZipperInstance.TagNames(ctx, rawQuery, limit)
 	} else if strings.HasSuffix(r.URL.Path, "values") || strings.HasSuffix(r.URL.Path, "values/") {
-		res, err = config.Config.ZipperInstance.TagValues(ctx, rawQuery, limit)
+		res, err = cfg.ZipperInstance.TagValues(ctx, rawQuery, limit)
 	} else {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		accessLogDetails.HTTPCode = http.StatusNotFound
@@ -100,7 +101,7 @@ func tagHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// TODO(civil): Implement stats
-	if err != nil && !merry.Is(err, types.ErrNoMetricsFetched) && (!merry.Is(err, types.ErrNonFatalErrors) || config.Config.Upstreams.RequireSuccessAll) {
+	if err != nil && !merry.Is(err, types.ErrNoMetricsFetched) && (!merry.Is(err, types.ErrNonFatalErrors) || cfg.Upstreams.RequireSuccessAll) {
 		code := merry.HTTPCode(err)
 		setError(w, accessLogDetails, helper.MerryRootError(err), code, carbonapiUUID)
 		logAsError = true
@@ -6,9 +6,11 @@ import (
 
 var usageMsg = []byte(`
 supported requests:
+    /events/?from=&until=&tags=
     /functions/
     /info/?target=
     /lb_check/
+    /metrics
     /metrics/find/?query=
 	/render/?target=
 	/tags/autoComplete/tags/
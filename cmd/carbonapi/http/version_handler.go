@@ -14,7 +14,7 @@ func versionHandler(w http.ResponseWriter, r *http.Request) {
 	t0 := time.Now()
 	accessLogger := zapwriter.Logger("access")
 
-	if config.Config.GraphiteWeb09Compatibility {
+	if config.Current().GraphiteWeb09Compatibility {
 		_, _ = w.Write([]byte("0.9.15\n"))
 	} else {
 		_, _ = w.Write([]byte("1.1.0\n"))
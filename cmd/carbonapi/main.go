@@ -20,11 +20,13 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/go-graphite/carbonapi/pkg/tlsconfig"
+	"github.com/go-graphite/carbonapi/pkg/tracing"
 
 	"github.com/go-graphite/carbonapi/cmd/carbonapi/config"
 	"github.com/go-graphite/carbonapi/cmd/carbonapi/helper"
 	carbonapiHttp "github.com/go-graphite/carbonapi/cmd/carbonapi/http"
 	"github.com/go-graphite/carbonapi/internal/dns"
+	zipperInterfaces "github.com/go-graphite/carbonapi/zipper/interfaces"
 )
 
 // Version of carbonapi
@@ -73,11 +75,36 @@ func main() {
 		dns.UseDNSCache(config.Config.CachingDNSRefreshTime)
 	}
 
-	if err := config.Config.SetZipper(newZipper(carbonapiHttp.ZipperStats, &config.Config.Upstreams, config.Config.IgnoreClientTimeout, zapwriter.Logger("zipper"))); err != nil {
+	zipperFactory := func(cfg *config.ConfigType) (zipperInterfaces.CarbonZipper, error) {
+		z, err := newZipper(carbonapiHttp.ZipperStats, &cfg.Upstreams, cfg.IgnoreClientTimeout, zapwriter.Logger("zipper"))
+		if err != nil {
+			return nil, err
+		}
+		return z, nil
+	}
+	z, err := zipperFactory(&config.Config)
+	if err == nil {
+		err = config.Config.SetZipper(z)
+	}
+	if err != nil {
 		logger.Fatal("failed to setup zipper",
 			zap.Error(err),
 		)
 	}
+	config.SetZipperFactory(zipperFactory)
+
+	go func() {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		for range reload {
+			logger.Info("reloading config")
+			if err := config.Reload(logger); err != nil {
+				logger.Error("failed to reload config, running config is kept",
+					zap.Error(err),
+				)
+			}
+		}
+	}()
 
 	wg := sync.WaitGroup{}
 	serve := func(listen config.Listener, handler http.Handler) {
@@ -230,6 +257,8 @@ func main() {
 
 	wg.Wait()
 
+	tracing.Shutdown(5 * time.Second)
+
 	if g != nil {
 		g.Stop()
 	}
@@ -24,14 +24,11 @@ type zipper struct {
 	ignoreClientTimeout bool
 }
 
-func newZipper(sender func(*zipperTypes.Stats), config *zipperCfg.Config, ignoreClientTimeout bool, logger *zap.Logger) *zipper {
+func newZipper(sender func(*zipperTypes.Stats), config *zipperCfg.Config, ignoreClientTimeout bool, logger *zap.Logger) (*zipper, error) {
 	logger.Debug("initializing zipper")
 	zz, err := realZipper.NewZipper(sender, config, logger)
 	if err != nil {
-		logger.Fatal("failed to initialize zipper",
-			zap.Error(err),
-		)
-		return nil
+		return nil, err
 	}
 	z := &zipper{
 		z:                   zz,
@@ -40,7 +37,13 @@ func newZipper(sender func(*zipperTypes.Stats), config *zipperCfg.Config, ignore
 		ignoreClientTimeout: ignoreClientTimeout,
 	}
 
-	return z
+	return z, nil
+}
+
+// Close stops background tasks of the zipper, it's called when zipper is replaced on config reload
+func (z zipper) Close() error {
+	z.z.Close()
+	return nil
 }
 
 func (z zipper) Find(ctx context.Context, req pb.MultiGlobRequest) (*pb.MultiGlobResponse, *zipperTypes.Stats, merry.Error) {
@@ -129,3 +132,7 @@ func (z zipper) TagValues(ctx context.Context, query string, limit int64) ([]str
 func (z zipper) ScaleToCommonStep() bool {
 	return z.z.ScaleToCommonStep
 }
+
+func (z zipper) Route(metrics []string) zipperTypes.Route {
+	return z.z.Route(metrics)
+}
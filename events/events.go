@@ -0,0 +1,224 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNotFound      = errors.New("events: not found")
+	ErrNotConfigured = errors.New("events: store is not configured")
+	ErrNoWhat        = errors.New("events: 'what' is required")
+)
+
+// Event is a single annotation, modeled after graphite-web's events
+type Event struct {
+	ID   uint64   `json:"id"`
+	When int64    `json:"when"`
+	What string   `json:"what"`
+	Data string   `json:"data"`
+	Tags []string `json:"tags"`
+}
+
+// HasTags checks if event matches provided tags. If union is set, one matching tag is enough,
+// otherwise all tags must be present. Empty tag list matches everything.
+func (e *Event) HasTags(tags []string, union bool) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	for _, t := range tags {
+		found := false
+		for _, et := range e.Tags {
+			if et == t {
+				found = true
+				break
+			}
+		}
+		if found && union {
+			return true
+		}
+		if !found && !union {
+			return false
+		}
+	}
+	return !union
+}
+
+// ParseTags splits graphite-style space separated tags list
+func ParseTags(s string) []string {
+	return strings.Fields(s)
+}
+
+// Store is an interface for events storage backends
+type Store interface {
+	// Add stores event and returns it with assigned ID
+	Add(e Event) (Event, error)
+	// Find returns events in [from, until] range, sorted by time
+	Find(from, until int64, tags []string, union bool) ([]Event, error)
+	// Delete removes event by ID
+	Delete(id uint64) error
+}
+
+type NullStore struct{}
+
+func (NullStore) Add(Event) (Event, error)                           { return Event{}, ErrNotConfigured }
+func (NullStore) Find(int64, int64, []string, bool) ([]Event, error) { return nil, nil }
+func (NullStore) Delete(uint64) error                                { return ErrNotConfigured }
+
+// MemoryStore keeps events in memory, sorted by time
+type MemoryStore struct {
+	mu     sync.RWMutex
+	lastID uint64
+	events []Event
+
+	// onChange is called under write lock after every modification
+	onChange func() error
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) Add(e Event) (Event, error) {
+	if e.What == "" {
+		return Event{}, ErrNoWhat
+	}
+	if e.Tags == nil {
+		e.Tags = []string{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastID++
+	e.ID = s.lastID
+	idx := sort.Search(len(s.events), func(i int) bool { return s.events[i].When > e.When })
+	s.events = append(s.events, Event{})
+	copy(s.events[idx+1:], s.events[idx:])
+	s.events[idx] = e
+
+	if s.onChange != nil {
+		if err := s.onChange(); err != nil {
+			copy(s.events[idx:], s.events[idx+1:])
+			s.events = s.events[:len(s.events)-1]
+			s.lastID--
+			return Event{}, err
+		}
+	}
+
+	return e, nil
+}
+
+func (s *MemoryStore) Find(from, until int64, tags []string, union bool) ([]Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]Event, 0)
+	idx := sort.Search(len(s.events), func(i int) bool { return s.events[i].When >= from })
+	for ; idx < len(s.events) && s.events[idx].When <= until; idx++ {
+		if s.events[idx].HasTags(tags, union) {
+			res = append(res, s.events[idx])
+		}
+	}
+
+	return res, nil
+}
+
+func (s *MemoryStore) Delete(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.events {
+		if s.events[i].ID == id {
+			e := s.events[i]
+			s.events = append(s.events[:i], s.events[i+1:]...)
+			if s.onChange != nil {
+				if err := s.onChange(); err != nil {
+					s.events = append(s.events, Event{})
+					copy(s.events[i+1:], s.events[i:])
+					s.events[i] = e
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+type fileContent struct {
+	LastID uint64  `json:"lastId"`
+	Events []Event `json:"events"`
+}
+
+// FileStore is a MemoryStore that persists all events to a single JSON file
+type FileStore struct {
+	*MemoryStore
+	path string
+}
+
+// NewFileStore loads events from file (if it exists) and returns a store that writes
+// every modification back to it
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		path:        path,
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(b) > 0 {
+		var c fileContent
+		if err = json.Unmarshal(b, &c); err != nil {
+			return nil, err
+		}
+		sort.SliceStable(c.Events, func(i, j int) bool { return c.Events[i].When < c.Events[j].When })
+		s.lastID = c.LastID
+		for _, e := range c.Events {
+			if e.ID > s.lastID {
+				s.lastID = e.ID
+			}
+		}
+		s.events = c.Events
+	}
+
+	s.onChange = s.save
+
+	return s, nil
+}
+
+// save writes events to temporary file and renames it, so file is never left half-written
+func (s *FileStore) save() error {
+	b, err := json.Marshal(fileContent{LastID: s.lastID, Events: s.events})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+
+	return err
+}
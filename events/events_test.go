@@ -0,0 +1,98 @@
+package events
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventHasTags(t *testing.T) {
+	e := Event{Tags: []string{"deploy", "prod"}}
+
+	tests := []struct {
+		tags  []string
+		union bool
+		want  bool
+	}{
+		{tags: nil, want: true},
+		{tags: []string{"deploy"}, want: true},
+		{tags: []string{"deploy", "prod"}, want: true},
+		{tags: []string{"deploy", "dev"}, want: false},
+		{tags: []string{"deploy", "dev"}, union: true, want: true},
+		{tags: []string{"dev"}, union: true, want: false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, e.HasTags(tt.tags, tt.union), "tags=%v union=%v", tt.tags, tt.union)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.json")
+
+	s, err := NewFileStore(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = s.Add(Event{When: 100})
+	assert.ErrorIs(t, err, ErrNoWhat)
+
+	e1, err := s.Add(Event{When: 200, What: "second", Tags: []string{"a", "b"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	e2, err := s.Add(Event{When: 100, What: "first", Tags: []string{"a"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, uint64(1), e1.ID)
+	assert.Equal(t, uint64(2), e2.ID)
+
+	got, err := s.Find(0, 300, nil, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []Event{e2, e1}, got)
+
+	got, err = s.Find(150, 300, []string{"a"}, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []Event{e1}, got)
+
+	// reopen and check that everything was persisted
+	s, err = NewFileStore(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	got, err = s.Find(0, 300, []string{"a", "b"}, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []Event{e1}, got)
+
+	if !assert.NoError(t, s.Delete(e1.ID)) {
+		return
+	}
+	assert.ErrorIs(t, s.Delete(e1.ID), ErrNotFound)
+
+	s, err = NewFileStore(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	got, err = s.Find(0, 300, nil, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []Event{e2}, got)
+
+	e3, err := s.Add(Event{When: 300, What: "third"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, uint64(3), e3.ID)
+}
@@ -3,6 +3,8 @@ package expr
 import (
 	"context"
 	"errors"
+	"strings"
+	"time"
 
 	"github.com/ansel1/merry"
 	pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
@@ -15,6 +17,7 @@ import (
 	"github.com/go-graphite/carbonapi/expr/types"
 	"github.com/go-graphite/carbonapi/limiter"
 	"github.com/go-graphite/carbonapi/pkg/parser"
+	"github.com/go-graphite/carbonapi/pkg/tracing"
 	utilctx "github.com/go-graphite/carbonapi/util/ctx"
 	zipper "github.com/go-graphite/carbonapi/zipper/interfaces"
 )
@@ -28,18 +31,106 @@ type Evaluator struct {
 }
 
 func (eval Evaluator) Fetch(ctx context.Context, exprs []parser.Expr, from, until int64, values map[parser.MetricRequest][]*types.MetricData) (map[parser.MetricRequest][]*types.MetricData, error) {
+	ctx, span := tracing.StartSpan(ctx, "Fetch", tracing.SpanKindInternal)
+	defer span.End()
+
 	if err := eval.limiter.Enter(ctx); err != nil {
+		span.SetError(err)
 		return nil, err
 	}
 	defer eval.limiter.Leave()
 
-	multiFetchRequest := pb.MultiFetchRequest{}
-	metricRequestCache := make(map[string]parser.MetricRequest)
+	plan, err := newFetchPlan(ctx, exprs, from, until, values, eval.passFunctionsToBackend)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	multiFetchRequest, metricRequestCache, targetValues := plan.request, plan.metricRequests, plan.targetValues
+
+	span.SetAttribute("fetch.metrics", len(multiFetchRequest.Metrics))
+	span.SetAttribute("fetch.from", from)
+	span.SetAttribute("fetch.until", until)
+
+	if len(multiFetchRequest.Metrics) > 0 {
+		profile, depth := utilctx.GetProfile(ctx)
+		t0 := time.Now()
+		// zipper charges fetched data against query cost while merging responses and stops as soon as a limit is exceeded
+		fetchCtx, charged := utilctx.WithFetchCharge(ctx)
+		metrics, _, err := eval.zipper.Render(fetchCtx, multiFetchRequest)
+		if profile != nil {
+			profile.Add(fetchCall(multiFetchRequest, depth, time.Since(t0), len(metrics), err))
+		}
+		// error of the limit can be lost while merging responses
+		queryCost := utilctx.GetQueryCost(ctx)
+		if costErr := queryCost.Err(); costErr != nil {
+			span.SetError(costErr)
+			return nil, costErr
+		}
+		// If we had only partial result, we want to do our best to actually do our job
+		if err != nil && merry.HTTPCode(err) >= 400 && !plan.haveFallbackSeries {
+			span.SetError(err)
+			return nil, err
+		}
+		span.SetAttribute("fetch.series", len(metrics))
+		if !charged.Load() {
+			series := make([]limiter.FetchedSeries, 0, len(metrics))
+			for _, metric := range metrics {
+				series = append(series, limiter.FetchedSeries{
+					PathExpression: metric.PathExpression,
+					Name:           metric.Name,
+					RequestFrom:    metric.RequestStartTime,
+					RequestUntil:   metric.RequestStopTime,
+					Datapoints:     len(metric.Values),
+				})
+			}
+			if costErr := queryCost.AddFetched(series); costErr != nil {
+				span.SetError(costErr)
+				return nil, costErr
+			}
+		}
+		for _, metric := range metrics {
+			metricRequest := metricRequestCache[metric.PathExpression]
+			if metric.RequestStartTime != 0 && metric.RequestStopTime != 0 {
+				metricRequest.From = metric.RequestStartTime
+				metricRequest.Until = metric.RequestStopTime
+			}
+			data, ok := values[metricRequest]
+			if !ok {
+				data = make([]*types.MetricData, 0, 1)
+			}
+			values[metricRequest] = append(data, metric)
+		}
+	}
+
+	for m := range targetValues {
+		targetValues[m] = values[m]
+	}
+
+	if eval.zipper.ScaleToCommonStep() {
+		targetValues = helper.ScaleValuesToCommonStep(targetValues)
+	}
+
+	return targetValues, nil
+}
+
+type fetchPlan struct {
+	request pb.MultiFetchRequest
+	// metricRequests maps path expression to the requested metric
+	metricRequests map[string]parser.MetricRequest
+	// targetValues contains metrics, that are used by expressions
+	targetValues       map[parser.MetricRequest][]*types.MetricData
+	haveFallbackSeries bool
+}
+
+// newFetchPlan builds request to the zipper for metrics in expressions, metrics already present in values are not requested again
+func newFetchPlan(ctx context.Context, exprs []parser.Expr, from, until int64, values map[parser.MetricRequest][]*types.MetricData, passFunctionsToBackend bool) (*fetchPlan, error) {
+	plan := &fetchPlan{
+		metricRequests: make(map[string]parser.MetricRequest),
+		// values related to this particular `target=`
+		targetValues: make(map[parser.MetricRequest][]*types.MetricData),
+	}
 	maxDataPoints := utilctx.GetMaxDatapoints(ctx)
-	// values related to this particular `target=`
-	targetValues := make(map[parser.MetricRequest][]*types.MetricData)
 
-	haveFallbackSeries := false
 	for _, exp := range exprs {
 		for _, m := range exp.Metrics(from, until) {
 			fetchRequest := pb.FetchRequest{
@@ -55,7 +146,7 @@ func (eval Evaluator) Fetch(ctx context.Context, exprs []parser.Expr, from, unti
 				Until:  fetchRequest.StopTime,
 			}
 
-			if eval.passFunctionsToBackend && m.ConsolidationFunc != "" {
+			if passFunctionsToBackend && m.ConsolidationFunc != "" {
 				if _, ok := consolidateBy.ValidAggregateFunctions[m.ConsolidationFunc]; !ok {
 					return nil, merry.WithMessagef(parser.ErrInvalidArg, "invalid consolidateBy argument: '%s'", m.ConsolidationFunc)
 				}
@@ -66,11 +157,11 @@ func (eval Evaluator) Fetch(ctx context.Context, exprs []parser.Expr, from, unti
 			}
 
 			if exp.Target() == "fallbackSeries" {
-				haveFallbackSeries = true
+				plan.haveFallbackSeries = true
 			}
 
 			// avoid multiple requests in a function, E.g divideSeries(a.b, a.b)
-			if cachedMetricRequest, ok := metricRequestCache[m.Metric]; ok &&
+			if cachedMetricRequest, ok := plan.metricRequests[m.Metric]; ok &&
 				cachedMetricRequest.From == metricRequest.From &&
 				cachedMetricRequest.Until == metricRequest.Until {
 				continue
@@ -78,50 +169,31 @@ func (eval Evaluator) Fetch(ctx context.Context, exprs []parser.Expr, from, unti
 
 			// avoid multiple requests in a http request, E.g render?target=a.b&target=a.b
 			if _, ok := values[metricRequest]; ok {
-				targetValues[metricRequest] = nil
+				plan.targetValues[metricRequest] = nil
 				continue
 			}
 
 			// avoid multiple requests from the same target, e.g. target=max(a,asPercent(holtWintersForecast(a),a))
-			if _, ok := targetValues[metricRequest]; ok {
+			if _, ok := plan.targetValues[metricRequest]; ok {
 				continue
 			}
 
-			metricRequestCache[m.Metric] = metricRequest
-			targetValues[metricRequest] = nil
-			multiFetchRequest.Metrics = append(multiFetchRequest.Metrics, fetchRequest)
+			plan.metricRequests[m.Metric] = metricRequest
+			plan.targetValues[metricRequest] = nil
+			plan.request.Metrics = append(plan.request.Metrics, fetchRequest)
 		}
 	}
 
-	if len(multiFetchRequest.Metrics) > 0 {
-		metrics, _, err := eval.zipper.Render(ctx, multiFetchRequest)
-		// If we had only partial result, we want to do our best to actually do our job
-		if err != nil && merry.HTTPCode(err) >= 400 && !haveFallbackSeries {
-			return nil, err
-		}
-		for _, metric := range metrics {
-			metricRequest := metricRequestCache[metric.PathExpression]
-			if metric.RequestStartTime != 0 && metric.RequestStopTime != 0 {
-				metricRequest.From = metric.RequestStartTime
-				metricRequest.Until = metric.RequestStopTime
-			}
-			data, ok := values[metricRequest]
-			if !ok {
-				data = make([]*types.MetricData, 0, 1)
-			}
-			values[metricRequest] = append(data, metric)
-		}
-	}
-
-	for m := range targetValues {
-		targetValues[m] = values[m]
-	}
+	return plan, nil
+}
 
-	if eval.zipper.ScaleToCommonStep() {
-		targetValues = helper.ScaleValuesToCommonStep(targetValues)
+// FetchRequest returns request, that Evaluator.Fetch sends to the zipper for expressions. Metrics present in values are not requested.
+func FetchRequest(ctx context.Context, exprs []parser.Expr, from, until int64, values map[parser.MetricRequest][]*types.MetricData, passFunctionsToBackend bool) (pb.MultiFetchRequest, error) {
+	plan, err := newFetchPlan(ctx, exprs, from, until, values, passFunctionsToBackend)
+	if err != nil {
+		return pb.MultiFetchRequest{}, err
 	}
-
-	return targetValues, nil
+	return plan.request, nil
 }
 
 // Eval evaluates expressions.
@@ -188,7 +260,31 @@ func EvalExpr(ctx context.Context, eval interfaces.Evaluator, e parser.Expr, fro
 	f, ok := metadata.FunctionMD.Functions[e.Target()]
 	metadata.FunctionMD.RUnlock()
 	if ok {
-		v, err := f.Do(ctx, eval, e, from, until, values)
+		ctx, span := tracing.StartSpan(ctx, e.Target(), tracing.SpanKindInternal)
+		defer span.End()
+
+		profile, depth := utilctx.GetProfile(ctx)
+		t0 := time.Now()
+		v, err := f.Do(utilctx.NestProfile(ctx), eval, e, from, until, values)
+		if profile != nil {
+			call := utilctx.Call{
+				Function:     e.Target(),
+				Expression:   e.ToString(),
+				Depth:        depth,
+				WallTime:     time.Since(t0),
+				InputSeries:  inputSeries(e, from, until, values),
+				OutputSeries: len(v),
+			}
+			if err != nil {
+				call.Error = err.Error()
+			}
+			profile.Add(call)
+		}
+		if span != nil {
+			span.SetAttribute("expr.target", e.ToString())
+			span.SetAttribute("expr.series", len(v))
+			span.SetError(err)
+		}
 		if err != nil {
 			err = merry.WithMessagef(err, "function=%s: %s", e.Target(), err.Error())
 			if merry.Is(
@@ -213,6 +309,34 @@ func EvalExpr(ctx context.Context, eval interfaces.Evaluator, e parser.Expr, fro
 	return nil, merry.WithHTTPCode(helper.ErrUnknownFunction(e.Target()), 400)
 }
 
+// inputSeries counts fetched series, that are used by the expression
+func inputSeries(e parser.Expr, from, until int64, values map[parser.MetricRequest][]*types.MetricData) int {
+	n := 0
+	for _, m := range e.Metrics(from, until) {
+		n += len(values[parser.MetricRequest{Metric: m.Metric, From: m.From, Until: m.Until}])
+	}
+	return n
+}
+
+func fetchCall(request pb.MultiFetchRequest, depth int, wallTime time.Duration, series int, err error) utilctx.Call {
+	names := make([]string, 0, len(request.Metrics))
+	for _, m := range request.Metrics {
+		names = append(names, m.PathExpression)
+	}
+	call := utilctx.Call{
+		Function:     "fetch",
+		Expression:   strings.Join(names, ","),
+		Depth:        depth,
+		WallTime:     wallTime,
+		InputSeries:  len(request.Metrics),
+		OutputSeries: series,
+	}
+	if err != nil {
+		call.Error = err.Error()
+	}
+	return call
+}
+
 // RewriteExpr expands targets that use applyByNode into a new list of targets.
 // eg:
 // applyByNode(foo*, 1, "%") -> (true, ["foo1", "foo2"], nil)
@@ -241,6 +365,9 @@ func FetchAndEvalExp(ctx context.Context, eval interfaces.Evaluator, e parser.Ex
 	if err != nil {
 		return nil, merry.Wrap(err)
 	}
+	if err := utilctx.GetQueryCost(ctx).AddOutput(len(res)); err != nil {
+		return nil, err
+	}
 
 	for mReq := range values {
 		SortMetrics(values[mReq], mReq)
@@ -265,6 +392,9 @@ func FetchAndEvalExprs(ctx context.Context, eval interfaces.Evaluator, exprs []p
 			}
 			errors[exp.Target()] = merry.Wrap(err)
 		}
+		if err := utilctx.GetQueryCost(ctx).AddOutput(len(evaluationResult)); err != nil {
+			return nil, map[string]merry.Error{"*": err}
+		}
 		res = append(res, evaluationResult...)
 	}
 
@@ -10,6 +10,7 @@ import (
 	"github.com/go-graphite/carbonapi/expr/helper"
 	"github.com/go-graphite/carbonapi/expr/interfaces"
 	"github.com/go-graphite/carbonapi/expr/types"
+	tconfig "github.com/go-graphite/carbonapi/expr/types/config"
 	"github.com/go-graphite/carbonapi/pkg/parser"
 )
 
@@ -84,7 +85,7 @@ func (f *aggregate) Do(ctx context.Context, eval interfaces.Evaluator, e parser.
 		e.SetRawArgs(e.Arg(0).Target())
 	}
 
-	results, err := helper.AggregateSeries(e, args, aggFunc, xFilesFactor, fconfig.Config.ExtractTagsFromArgs)
+	results, err := helper.AggregateSeries(e, args, aggFunc, xFilesFactor, fconfig.Config.ExtractTagsFromArgs || tconfig.Current().ExtractTagsFromArgs)
 	if err != nil {
 		return nil, err
 	}
@@ -6,10 +6,10 @@ import (
 	"testing"
 	"time"
 
-	fconfig "github.com/go-graphite/carbonapi/expr/functions/config"
 	"github.com/go-graphite/carbonapi/expr/interfaces"
 	"github.com/go-graphite/carbonapi/expr/metadata"
 	"github.com/go-graphite/carbonapi/expr/types"
+	tconfig "github.com/go-graphite/carbonapi/expr/types/config"
 	"github.com/go-graphite/carbonapi/pkg/parser"
 	th "github.com/go-graphite/carbonapi/tests"
 	"github.com/go-graphite/carbonapi/tests/compare"
@@ -26,7 +26,7 @@ func init() {
 }
 
 func TestAverageSeries(t *testing.T) {
-	fconfig.Config.ExtractTagsFromArgs = false
+	tconfig.Replace(tconfig.ConfigType{ExtractTagsFromArgs: false})
 
 	now32 := int64(time.Now().Unix())
 
@@ -408,7 +408,7 @@ func TestAverageSeries(t *testing.T) {
 }
 
 func TestAverageSeriesExtractSeriesByTag(t *testing.T) {
-	fconfig.Config.ExtractTagsFromArgs = true
+	tconfig.Replace(tconfig.ConfigType{ExtractTagsFromArgs: true})
 
 	now32 := int64(time.Now().Unix())
 
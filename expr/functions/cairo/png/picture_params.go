@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-graphite/carbonapi/expr/types"
@@ -212,10 +213,12 @@ func GetPictureParams(r *http.Request, metricData []*types.MetricData) PicturePa
 
 // GetPictureParamsWithTemplate returns PictureParams with specified template
 func GetPictureParamsWithTemplate(r *http.Request, template string, metricData []*types.MetricData) PictureParams {
+	templatesMu.RLock()
 	t, ok := templates[template]
 	if !ok {
 		t = templates["default"]
 	}
+	templatesMu.RUnlock()
 
 	pixelRatioParam := ""
 	if r.Header.Get("Referer") != "" {
@@ -356,7 +359,24 @@ func getTimeZone(s string, def *time.Location) *time.Location {
 
 // SetTemplate adds a picture param template with specified name and parameters
 func SetTemplate(name string, params *PictureParams) {
+	templatesMu.Lock()
 	templates[name] = *params
+	templatesMu.Unlock()
+}
+
+// ReplaceTemplates drops all previously added templates and sets new ones
+func ReplaceTemplates(params map[string]PictureParams) {
+	t := make(map[string]PictureParams, len(builtinTemplates)+len(params))
+	for name, p := range builtinTemplates {
+		t[name] = p
+	}
+	for name, p := range params {
+		t[name] = p
+	}
+
+	templatesMu.Lock()
+	templates = t
+	templatesMu.Unlock()
 }
 
 var DefaultParams = PictureParams{
@@ -431,6 +451,18 @@ var DefaultParams = PictureParams{
 	MinorGridLineColor: "grey",
 }
 
+var (
+	templatesMu      sync.RWMutex
+	builtinTemplates map[string]PictureParams
+)
+
+func init() {
+	builtinTemplates = make(map[string]PictureParams, len(templates))
+	for name, p := range templates {
+		builtinTemplates[name] = p
+	}
+}
+
 var templates = map[string]PictureParams{
 	"default": {
 		Width:      330,
@@ -1,10 +1,18 @@
 package config
 
-import "time"
+import (
+	"time"
+
+	"github.com/go-graphite/carbonapi/events"
+)
 
 var Config = struct {
+	// Deprecated: use ExtractTagsFromArgs of expr/types/config instead. Enabling it here still works.
 	ExtractTagsFromArgs bool
-	DefaultTimeZone     *time.Location
+	// Deprecated: use DefaultTimeZone of expr/types/config instead. If set, it overrides that one.
+	DefaultTimeZone *time.Location
+	// Events is a storage used by events() function
+	Events events.Store
 }{
-	DefaultTimeZone: time.UTC,
+	Events: events.NullStore{},
 }
@@ -0,0 +1,122 @@
+package events
+
+import (
+	"context"
+	"math"
+	"strings"
+
+	storage "github.com/go-graphite/carbonapi/events"
+	fconfig "github.com/go-graphite/carbonapi/expr/functions/config"
+	"github.com/go-graphite/carbonapi/expr/interfaces"
+	"github.com/go-graphite/carbonapi/expr/types"
+	"github.com/go-graphite/carbonapi/pkg/parser"
+	pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+)
+
+type events struct{}
+
+func GetOrder() interfaces.Order {
+	return interfaces.Any
+}
+
+func New(configFile string) []interfaces.FunctionMetadata {
+	res := make([]interfaces.FunctionMetadata, 0)
+	f := &events{}
+	functions := []string{"events"}
+	for _, n := range functions {
+		res = append(res, interfaces.FunctionMetadata{Name: n, F: f})
+	}
+	return res
+}
+
+// events("tag1", "tag2", ...)
+func (f *events) Do(ctx context.Context, eval interfaces.Evaluator, e parser.Expr, from, until int64, values map[parser.MetricRequest][]*types.MetricData) ([]*types.MetricData, error) {
+	var tags []string
+	if e.ArgsLen() > 0 {
+		var err error
+		tags, err = e.GetStringArgs(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	name := "events(\"" + strings.Join(tags, "\", \"") + "\")"
+	if len(tags) == 1 && tags[0] == "*" {
+		tags = nil
+	}
+
+	// graphite-web always uses 1 second step for events
+	const step = 1
+	start := from - from%step
+	stop := until - until%step
+
+	points := stop - start
+	if points < 0 {
+		points = 0
+	}
+
+	store := fconfig.Config.Events
+	if store == nil {
+		store = storage.NullStore{}
+	}
+	found, err := store.Find(start, stop, tags, false)
+	if err != nil {
+		return nil, err
+	}
+
+	vals := make([]float64, points)
+	for i := range vals {
+		vals[i] = math.NaN()
+	}
+	for _, ev := range found {
+		i := (ev.When - start) / step
+		if i < 0 || i >= points {
+			continue
+		}
+		if math.IsNaN(vals[i]) {
+			vals[i] = 1
+		} else {
+			vals[i]++
+		}
+	}
+
+	r := &types.MetricData{
+		FetchResponse: pb.FetchResponse{
+			Name:              name,
+			PathExpression:    name,
+			StartTime:         start,
+			StopTime:          stop,
+			StepTime:          step,
+			Values:            vals,
+			ConsolidationFunc: "sum",
+		},
+		Tags: map[string]string{"name": name},
+	}
+
+	return []*types.MetricData{r}, nil
+}
+
+// Description is auto-generated description, based on output of https://github.com/graphite-project/graphite-web
+func (f *events) Description() map[string]types.FunctionDescription {
+	return map[string]types.FunctionDescription{
+		"events": {
+			Description: "Returns the number of events at this point in time. Usable with\ndrawAsInfinite.\n\nExample:\n\n.. code-block:: none\n\n  &target=events(\"tag-one\", \"tag-two\")\n  &target=events(\"*\")\n\nReturns all events tagged as \"tag-one\" and \"tag-two\" and the second one\nreturns all events.",
+			Function:    "events(*tags)",
+			Group:       "Special",
+			Module:      "graphite.render.functions",
+			Name:        "events",
+			Params: []types.FunctionParam{
+				{
+					Name:     "tags",
+					Required: true,
+					Multiple: true,
+					Type:     types.String,
+				},
+			},
+			SeriesChange: true, // function aggregate metrics or change series items count
+			NameChange:   true, // name changed
+			TagsChange:   true, // name tag changed
+			ValuesChange: true, // values changed
+		},
+	}
+}
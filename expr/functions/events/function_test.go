@@ -0,0 +1,81 @@
+package events
+
+import (
+	"math"
+	"testing"
+
+	storage "github.com/go-graphite/carbonapi/events"
+	fconfig "github.com/go-graphite/carbonapi/expr/functions/config"
+	"github.com/go-graphite/carbonapi/expr/interfaces"
+	"github.com/go-graphite/carbonapi/expr/metadata"
+	"github.com/go-graphite/carbonapi/expr/types"
+	"github.com/go-graphite/carbonapi/pkg/parser"
+	th "github.com/go-graphite/carbonapi/tests"
+)
+
+var (
+	md []interfaces.FunctionMetadata = New("")
+)
+
+func init() {
+	for _, m := range md {
+		metadata.RegisterFunction(m.Name, m.F)
+	}
+
+	store := storage.NewMemoryStore()
+	for _, e := range []storage.Event{
+		{When: 101, What: "deploy", Tags: []string{"deploy", "prod"}},
+		{When: 101, What: "deploy", Tags: []string{"deploy", "dev"}},
+		{When: 103, What: "restart", Tags: []string{"restart", "prod"}},
+		{When: 200, What: "out of range", Tags: []string{"deploy", "prod"}},
+	} {
+		_, _ = store.Add(e)
+	}
+	fconfig.Config.Events = store
+}
+
+func TestEvents(t *testing.T) {
+	var startTime int64 = 100
+	nan := math.NaN()
+
+	tests := []th.EvalTestItemWithRange{
+		{
+			Target: `events("*")`,
+			M: map[parser.MetricRequest][]*types.MetricData{
+				{From: startTime, Until: startTime + 5}: {},
+			},
+			Want: []*types.MetricData{types.MakeMetricData(`events("*")`,
+				[]float64{nan, 2, nan, 1, nan}, 1, startTime).SetConsolidationFunc("sum").SetNameTag(`events("*")`)},
+			From:  startTime,
+			Until: startTime + 5,
+		},
+		{
+			Target: `events("deploy", "prod")`,
+			M: map[parser.MetricRequest][]*types.MetricData{
+				{From: startTime, Until: startTime + 5}: {},
+			},
+			Want: []*types.MetricData{types.MakeMetricData(`events("deploy", "prod")`,
+				[]float64{nan, 1, nan, nan, nan}, 1, startTime).SetConsolidationFunc("sum").SetNameTag(`events("deploy", "prod")`)},
+			From:  startTime,
+			Until: startTime + 5,
+		},
+		{
+			Target: `events("prod")`,
+			M: map[parser.MetricRequest][]*types.MetricData{
+				{From: startTime, Until: startTime + 5}: {},
+			},
+			Want: []*types.MetricData{types.MakeMetricData(`events("prod")`,
+				[]float64{nan, 1, nan, 1, nan}, 1, startTime).SetConsolidationFunc("sum").SetNameTag(`events("prod")`)},
+			From:  startTime,
+			Until: startTime + 5,
+		},
+	}
+
+	for _, tt := range tests {
+		testName := tt.Target
+		t.Run(testName, func(t *testing.T) {
+			eval := th.EvaluatorFromFunc(md[0].F)
+			th.TestEvalExprWithRange(t, eval, &tt)
+		})
+	}
+}
@@ -74,6 +74,20 @@ func paramsIsEqual(first, second []types.FunctionParam) bool {
 	return true
 }
 
+// ValidateConfig checks, that config file can be read and parsed, so New doesn't stop the process on config reload
+func ValidateConfig(configFile string) error {
+	if configFile == "" {
+		return nil
+	}
+	v := viper.New()
+	v.SetConfigFile(configFile)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+	var cfg graphiteWebConfig
+	return v.Unmarshal(&cfg)
+}
+
 func New(configFile string) []interfaces.FunctionMetadata {
 	logger := zapwriter.Logger("functionInit").With(zap.String("function", "graphiteWeb"))
 	if configFile == "" {
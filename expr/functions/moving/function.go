@@ -27,6 +27,18 @@ type movingConfig struct {
 	ReturnNaNsIfStepMismatch *bool
 }
 
+// ValidateConfig checks, that config file can be parsed, so New doesn't stop the process on config reload.
+// Config file, that can't be read, is valid, defaults are used then.
+func ValidateConfig(configFile string) error {
+	v := viper.New()
+	v.SetConfigFile(configFile)
+	if v.ReadInConfig() != nil {
+		return nil
+	}
+	var cfg movingConfig
+	return v.Unmarshal(&cfg)
+}
+
 func New(configFile string) []interfaces.FunctionMetadata {
 	logger := zapwriter.Logger("functionInit").With(zap.String("function", "moving"))
 	res := make([]interfaces.FunctionMetadata, 0)
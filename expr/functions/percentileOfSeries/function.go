@@ -8,6 +8,7 @@ import (
 	"github.com/go-graphite/carbonapi/expr/helper"
 	"github.com/go-graphite/carbonapi/expr/interfaces"
 	"github.com/go-graphite/carbonapi/expr/types"
+	tconfig "github.com/go-graphite/carbonapi/expr/types/config"
 	"github.com/go-graphite/carbonapi/pkg/parser"
 )
 
@@ -63,7 +64,7 @@ func (f *percentileOfSeries) Do(ctx context.Context, eval interfaces.Evaluator,
 
 	return helper.AggregateSeries(e, args, func(values []float64) float64 {
 		return consolidations.Percentile(values, percent, interpolate)
-	}, float64(xFilesFactor), fconfig.Config.ExtractTagsFromArgs)
+	}, float64(xFilesFactor), fconfig.Config.ExtractTagsFromArgs || tconfig.Current().ExtractTagsFromArgs)
 }
 
 // SetExtractTagsFromArgs for use in tests
@@ -5,10 +5,10 @@ import (
 	"testing"
 	"time"
 
-	fconfig "github.com/go-graphite/carbonapi/expr/functions/config"
 	"github.com/go-graphite/carbonapi/expr/interfaces"
 	"github.com/go-graphite/carbonapi/expr/metadata"
 	"github.com/go-graphite/carbonapi/expr/types"
+	tconfig "github.com/go-graphite/carbonapi/expr/types/config"
 	"github.com/go-graphite/carbonapi/pkg/parser"
 	th "github.com/go-graphite/carbonapi/tests"
 )
@@ -24,7 +24,7 @@ func init() {
 }
 
 func TestPercentileOfSeries(t *testing.T) {
-	fconfig.Config.ExtractTagsFromArgs = false
+	tconfig.Replace(tconfig.ConfigType{ExtractTagsFromArgs: false})
 
 	now32 := int64(time.Now().Unix())
 
@@ -108,7 +108,7 @@ func TestPercentileOfSeries(t *testing.T) {
 }
 
 func TestPercentileOfSeriesExtractSeriesByTag(t *testing.T) {
-	fconfig.Config.ExtractTagsFromArgs = true
+	tconfig.Replace(tconfig.ConfigType{ExtractTagsFromArgs: true})
 
 	now32 := int64(time.Now().Unix())
 
@@ -10,6 +10,7 @@ import (
 	"github.com/go-graphite/carbonapi/expr/helper"
 	"github.com/go-graphite/carbonapi/expr/interfaces"
 	"github.com/go-graphite/carbonapi/expr/types"
+	tconfig "github.com/go-graphite/carbonapi/expr/types/config"
 	"github.com/go-graphite/carbonapi/pkg/parser"
 )
 
@@ -32,7 +33,11 @@ func New(configFile string) []interfaces.FunctionMetadata {
 // parseTimeArg parses using date.ParseAtTime and falls back
 // to parsing as an interval for retrocompatibility.
 func parseTimeArg(s string) (int64, error) {
-	if epoch, err := date.ParseAtTime(s, "", fconfig.Config.DefaultTimeZone); err == nil {
+	tz := tconfig.Current().DefaultTimeZone
+	if fconfig.Config.DefaultTimeZone != nil {
+		tz = fconfig.Config.DefaultTimeZone
+	}
+	if epoch, err := date.ParseAtTime(s, "", tz); err == nil {
 		return epoch, nil
 	}
 	if secs, err := parser.IntervalString(s, 1); err == nil {
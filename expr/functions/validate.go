@@ -0,0 +1,34 @@
+package functions
+
+import (
+	"strings"
+
+	"github.com/ansel1/merry"
+
+	"github.com/go-graphite/carbonapi/expr/functions/graphiteWeb"
+	"github.com/go-graphite/carbonapi/expr/functions/moving"
+	"github.com/go-graphite/carbonapi/expr/functions/movingMedian"
+	"github.com/go-graphite/carbonapi/expr/functions/timeShift"
+)
+
+// configValidators check configs of functions, that can't be initialized with invalid config
+var configValidators = map[string]func(configFile string) error{
+	"graphiteWeb":  graphiteWeb.ValidateConfig,
+	"moving":       moving.ValidateConfig,
+	"movingMedian": movingMedian.ValidateConfig,
+	"timeShift":    timeShift.ValidateConfig,
+}
+
+// ValidateConfigs checks function configs, so functions can be initialized with New without errors
+func ValidateConfigs(configs map[string]string) error {
+	for name, validate := range configValidators {
+		configFile, ok := configs[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		if err := validate(configFile); err != nil {
+			return merry.Prependf(err, "function %s config", name)
+		}
+	}
+	return nil
+}
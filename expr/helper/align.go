@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/go-graphite/carbonapi/expr/types"
+	tconfig "github.com/go-graphite/carbonapi/expr/types/config"
 	"github.com/go-graphite/carbonapi/pkg/parser"
 )
 
@@ -243,7 +244,7 @@ func AlignToBucketSize(start, stop, bucketSize int64) (int64, int64) {
 func AlignSeries(args []*types.MetricData) []*types.MetricData {
 	minStart, maxStop := GetInterval(args)
 
-	if ExtrapolatePoints {
+	if ExtrapolatePoints || tconfig.Current().ExtrapolatePoints {
 		minStepTime, _, needScale := GetStepRange(args)
 		if needScale {
 			for _, arg := range args {
@@ -304,7 +305,7 @@ func ScaleSeries(args []*types.MetricData) []*types.MetricData {
 	var commonStep int64
 	var needScale bool
 
-	if ExtrapolatePoints {
+	if ExtrapolatePoints || tconfig.Current().ExtrapolatePoints {
 		commonStep, _, needScale = GetStepRange(args)
 		if needScale {
 			for _, arg := range args {
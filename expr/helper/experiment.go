@@ -1,4 +1,6 @@
 package helper
 
 // ExtrapolatePoints defines if we should extrapolate when we are aligning series together
+//
+// Deprecated: use ExtrapolatePoints of expr/types/config instead. Enabling it here still works.
 var ExtrapolatePoints = false
@@ -2,6 +2,7 @@ package metadata
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/go-graphite/carbonapi/expr/interfaces"
 	"github.com/go-graphite/carbonapi/expr/types"
@@ -11,11 +12,12 @@ import (
 
 // RegisterRewriteFunctionWithFilename registers function for a rewrite phase in metadata and fills out all Description structs
 func RegisterRewriteFunctionWithFilename(name, filename string, function interfaces.RewriteFunction) {
-	FunctionMD.Lock()
-	defer FunctionMD.Unlock()
+	md := registry.Load()
+	md.Lock()
+	defer md.Unlock()
 
-	if _, ok := FunctionMD.RewriteFunctions[name]; ok {
-		n := FunctionMD.RewriteFunctionsFilenames[name]
+	if _, ok := md.RewriteFunctions[name]; ok {
+		n := md.RewriteFunctionsFilenames[name]
 		logger := zapwriter.Logger("registerRewriteFunction")
 		logger.Warn("function already registered, will register new anyway",
 			zap.String("name", name),
@@ -24,11 +26,11 @@ func RegisterRewriteFunctionWithFilename(name, filename string, function interfa
 			zap.Stack("stack"),
 		)
 	} else {
-		FunctionMD.RewriteFunctionsFilenames[name] = make([]string, 0)
+		md.RewriteFunctionsFilenames[name] = make([]string, 0)
 	}
 	// Check if we are colliding with non-rewrite Functions
-	if _, ok := FunctionMD.Functions[name]; ok {
-		n := FunctionMD.FunctionsFilenames[name]
+	if _, ok := md.Functions[name]; ok {
+		n := md.FunctionsFilenames[name]
 		logger := zapwriter.Logger("registerRewriteFunction")
 		logger.Warn("non-rewrite function with the same name already registered",
 			zap.String("name", name),
@@ -37,15 +39,15 @@ func RegisterRewriteFunctionWithFilename(name, filename string, function interfa
 			zap.Stack("stack"),
 		)
 	}
-	FunctionMD.RewriteFunctionsFilenames[name] = append(FunctionMD.RewriteFunctionsFilenames[name], filename)
-	FunctionMD.RewriteFunctions[name] = function
+	md.RewriteFunctionsFilenames[name] = append(md.RewriteFunctionsFilenames[name], filename)
+	md.RewriteFunctions[name] = function
 
 	for k, v := range function.Description() {
-		FunctionMD.Descriptions[k] = v
-		if _, ok := FunctionMD.DescriptionsGrouped[v.Group]; !ok {
-			FunctionMD.DescriptionsGrouped[v.Group] = make(map[string]types.FunctionDescription)
+		md.Descriptions[k] = v
+		if _, ok := md.DescriptionsGrouped[v.Group]; !ok {
+			md.DescriptionsGrouped[v.Group] = make(map[string]types.FunctionDescription)
 		}
-		FunctionMD.DescriptionsGrouped[v.Group][k] = v
+		md.DescriptionsGrouped[v.Group][k] = v
 	}
 }
 
@@ -56,11 +58,12 @@ func RegisterRewriteFunction(name string, function interfaces.RewriteFunction) {
 
 // RegisterFunctionWithFilename registers function in metadata and fills out all Description structs
 func RegisterFunctionWithFilename(name, filename string, function interfaces.Function) {
-	FunctionMD.Lock()
-	defer FunctionMD.Unlock()
+	md := registry.Load()
+	md.Lock()
+	defer md.Unlock()
 
-	if _, ok := FunctionMD.Functions[name]; ok {
-		n := FunctionMD.FunctionsFilenames[name]
+	if _, ok := md.Functions[name]; ok {
+		n := md.FunctionsFilenames[name]
 		logger := zapwriter.Logger("registerFunction")
 		logger.Warn("function already registered, will register new anyway",
 			zap.String("name", name),
@@ -69,11 +72,11 @@ func RegisterFunctionWithFilename(name, filename string, function interfaces.Fun
 			zap.Stack("stack"),
 		)
 	} else {
-		FunctionMD.FunctionsFilenames[name] = make([]string, 0)
+		md.FunctionsFilenames[name] = make([]string, 0)
 	}
 	// Check if we are colliding with non-rewrite Functions
-	if _, ok := FunctionMD.RewriteFunctions[name]; ok {
-		n := FunctionMD.RewriteFunctionsFilenames[name]
+	if _, ok := md.RewriteFunctions[name]; ok {
+		n := md.RewriteFunctionsFilenames[name]
 		logger := zapwriter.Logger("registerRewriteFunction")
 		logger.Warn("rewrite function with the same name already registered",
 			zap.String("name", name),
@@ -82,15 +85,15 @@ func RegisterFunctionWithFilename(name, filename string, function interfaces.Fun
 			zap.Stack("stack"),
 		)
 	}
-	FunctionMD.Functions[name] = function
-	FunctionMD.FunctionsFilenames[name] = append(FunctionMD.FunctionsFilenames[name], filename)
+	md.Functions[name] = function
+	md.FunctionsFilenames[name] = append(md.FunctionsFilenames[name], filename)
 
 	for k, v := range function.Description() {
-		FunctionMD.Descriptions[k] = v
-		if _, ok := FunctionMD.DescriptionsGrouped[v.Group]; !ok {
-			FunctionMD.DescriptionsGrouped[v.Group] = make(map[string]types.FunctionDescription)
+		md.Descriptions[k] = v
+		if _, ok := md.DescriptionsGrouped[v.Group]; !ok {
+			md.DescriptionsGrouped[v.Group] = make(map[string]types.FunctionDescription)
 		}
-		FunctionMD.DescriptionsGrouped[v.Group][k] = v
+		md.DescriptionsGrouped[v.Group][k] = v
 	}
 }
 
@@ -114,6 +117,18 @@ type Metadata struct {
 	evaluator interfaces.Evaluator
 }
 
+func newMetadata() *Metadata {
+	return &Metadata{
+		RewriteFunctions:          make(map[string]interfaces.RewriteFunction),
+		Functions:                 make(map[string]interfaces.Function),
+		Descriptions:              make(map[string]types.FunctionDescription),
+		DescriptionsGrouped:       make(map[string]map[string]types.FunctionDescription),
+		FunctionConfigFiles:       make(map[string]string),
+		FunctionsFilenames:        make(map[string][]string),
+		RewriteFunctionsFilenames: make(map[string][]string),
+	}
+}
+
 // FunctionMD is actual global variable that stores metadata
 var FunctionMD = Metadata{
 	RewriteFunctions:          make(map[string]interfaces.RewriteFunction),
@@ -124,3 +139,33 @@ var FunctionMD = Metadata{
 	FunctionsFilenames:        make(map[string][]string),
 	RewriteFunctionsFilenames: make(map[string][]string),
 }
+
+// registry is metadata, that functions are registered in. It's FunctionMD, unless functions are replaced.
+var registry atomic.Pointer[Metadata]
+
+var replaceMu sync.Mutex
+
+func init() {
+	registry.Store(&FunctionMD)
+}
+
+// ReplaceFunctions calls register to register functions in the empty metadata and replaces all functions and their
+// descriptions in FunctionMD with them at once, so requests in progress never see partially registered functions.
+func ReplaceFunctions(register func()) {
+	replaceMu.Lock()
+	defer replaceMu.Unlock()
+
+	md := newMetadata()
+	registry.Store(md)
+	register()
+	registry.Store(&FunctionMD)
+
+	FunctionMD.Lock()
+	FunctionMD.Functions = md.Functions
+	FunctionMD.RewriteFunctions = md.RewriteFunctions
+	FunctionMD.Descriptions = md.Descriptions
+	FunctionMD.DescriptionsGrouped = md.DescriptionsGrouped
+	FunctionMD.FunctionsFilenames = md.FunctionsFilenames
+	FunctionMD.RewriteFunctionsFilenames = md.RewriteFunctionsFilenames
+	FunctionMD.Unlock()
+}
@@ -1,5 +1,10 @@
 package config
 
+import (
+	"sync/atomic"
+	"time"
+)
+
 type ConfigType = struct {
 	// NudgeStartTimeOnAggregation enables nudging the start time of metrics
 	// when aggregated. The start time is nudged in such way that timestamps
@@ -11,6 +16,46 @@ type ConfigType = struct {
 	// buckets when aggregating to honor MaxDataPoints, instead of the lowest timestamp.
 	// This prevents results to appear to predict the future.
 	UseBucketsHighestTimestampOnAggregation bool
+
+	// ExtrapolatePoints defines if we should extrapolate when we are aligning series together
+	ExtrapolatePoints bool
+
+	// ExtractTagsFromArgs enables extraction of tags from arguments of seriesByTag by aggregate functions
+	ExtractTagsFromArgs bool
+
+	// DefaultTimeZone is used to parse time, that is specified without time zone
+	DefaultTimeZone *time.Location
 }
 
+// Config is a configuration of expressions evaluation.
+//
+// Deprecated: use Replace and Current instead. Options enabled here are still honored by Current.
 var Config = ConfigType{}
+
+var current atomic.Pointer[ConfigType]
+
+func init() {
+	Replace(ConfigType{})
+}
+
+// Current returns configuration of expressions evaluation, with options enabled in deprecated Config merged in
+func Current() ConfigType {
+	c := *current.Load()
+	c.NudgeStartTimeOnAggregation = c.NudgeStartTimeOnAggregation || Config.NudgeStartTimeOnAggregation
+	c.UseBucketsHighestTimestampOnAggregation = c.UseBucketsHighestTimestampOnAggregation || Config.UseBucketsHighestTimestampOnAggregation
+	c.ExtrapolatePoints = c.ExtrapolatePoints || Config.ExtrapolatePoints
+	c.ExtractTagsFromArgs = c.ExtractTagsFromArgs || Config.ExtractTagsFromArgs
+	if Config.DefaultTimeZone != nil {
+		c.DefaultTimeZone = Config.DefaultTimeZone
+	}
+	return c
+}
+
+// Replace replaces configuration of expressions evaluation at once, so evaluation never sees a mix of old and new
+// settings. Time zone defaults to UTC.
+func Replace(c ConfigType) {
+	if c.DefaultTimeZone == nil {
+		c.DefaultTimeZone = time.UTC
+	}
+	current.Store(&c)
+}
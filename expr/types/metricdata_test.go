@@ -2,9 +2,17 @@ package types
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
 	"math"
 	"math/rand"
+	"reflect"
 	"testing"
+
+	pickle "github.com/lomik/og-rek"
+
+	"github.com/go-graphite/carbonapi/zipper/protocols/graphite/msgpack"
 )
 
 func TestJSONResponse(t *testing.T) {
@@ -110,6 +118,160 @@ func TestCSVResponse(t *testing.T) {
 	}
 }
 
+func TestPickleResponse(t *testing.T) {
+	results := []*MetricData{
+		MakeMetricData("metric1", []float64{1, 1.5, 2.25, math.NaN()}, 100, 100),
+		MakeMetricData("metric2", []float64{2, 2.5, 3.25, 4, 5}, 100, 100),
+	}
+
+	// must be the same as a list encoded at once
+	var p []map[string]interface{}
+	for _, r := range results {
+		values := make([]interface{}, len(r.Values))
+		for i, v := range r.Values {
+			if math.IsNaN(v) {
+				values[i] = pickle.None{}
+			} else {
+				values[i] = v
+			}
+		}
+		p = append(p, map[string]interface{}{
+			"name":              r.Name,
+			"pathExpression":    r.PathExpression,
+			"consolidationFunc": r.ConsolidationFunc,
+			"start":             r.StartTime,
+			"end":               r.StopTime,
+			"step":              r.StepTime,
+			"xFilesFactor":      r.XFilesFactor,
+			"values":            values,
+		})
+	}
+	var buf bytes.Buffer
+	if err := pickle.NewEncoder(&buf).Encode(p); err != nil {
+		t.Fatal(err)
+	}
+	want, err := pickle.NewDecoder(&buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, results := range [][]*MetricData{results, nil} {
+		got, err := pickle.NewDecoder(bytes.NewReader(MarshalPickle(results))).Decode()
+		if err != nil {
+			t.Fatalf("marshalPickle(%+v): %v", results, err)
+		}
+		if results == nil {
+			want = []interface{}{}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("marshalPickle(%+v): got\n%+v\nwant\n%+v", results, got, want)
+		}
+	}
+}
+
+type countingWriter struct {
+	writes int
+	failAt int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes == w.failAt {
+		return 0, errors.New("write failed")
+	}
+	return len(p), nil
+}
+
+func TestMsgpackResponse(t *testing.T) {
+	results := []*MetricData{
+		MakeMetricData("metric1", []float64{1, 1.5, 2.25, math.NaN()}, 100, 100),
+		MakeMetricData("metric2", []float64{2, 2.5, 3.25, 4, 5}, 100, 100),
+	}
+
+	// graphite backend protocol must read the same series, as in json
+	var fetched msgpack.MultiGraphiteFetchResponse
+	if _, err := fetched.UnmarshalMsg(MarshalMsgpack(results)); err != nil {
+		t.Fatal(err)
+	}
+	var want []struct {
+		Target     string        `json:"target"`
+		Datapoints [][2]*float64 `json:"datapoints"`
+	}
+	if err := json.Unmarshal(MarshalJSON(results, 1, false), &want); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fetched) != len(want) {
+		t.Fatalf("got %d series, want %d", len(fetched), len(want))
+	}
+	for i, r := range fetched {
+		if r.Name != want[i].Target || r.PathExpression != results[i].PathExpression {
+			t.Errorf("series %d: got name %q, want %q", i, r.Name, want[i].Target)
+		}
+		if len(r.Values) != len(want[i].Datapoints) {
+			t.Errorf("series %d: got %d values, want %d", i, len(r.Values), len(want[i].Datapoints))
+			continue
+		}
+		for j, v := range r.Values {
+			dp := want[i].Datapoints[j]
+			if ts := float64(int64(r.Start) + int64(j)*int64(r.Step)); ts != *dp[1] {
+				t.Errorf("series %d point %d: got timestamp %v, want %v", i, j, ts, *dp[1])
+			}
+			if dp[0] == nil {
+				if v != nil {
+					t.Errorf("series %d point %d: got %v, want nil", i, j, v)
+				}
+			} else if v != *dp[0] {
+				t.Errorf("series %d point %d: got %v, want %v", i, j, v, *dp[0])
+			}
+		}
+	}
+
+	if got := MarshalMsgpack(nil); !bytes.Equal(got, []byte{0x90}) {
+		t.Errorf("got %x for empty response, want empty array", got)
+	}
+}
+
+func TestWriteSeriesBySeries(t *testing.T) {
+	results := []*MetricData{
+		MakeMetricData("metric1", []float64{1, 1.5, 2.25, math.NaN()}, 100, 100),
+		MakeMetricData("metric2", []float64{2, 2.5, 3.25, 4, 5}, 100, 100),
+		MakeMetricData("metric3", []float64{2, 2.5, 3.25, 4, 5}, 100, 100),
+	}
+
+	tests := []struct {
+		name   string
+		write  func(w io.Writer) error
+		writes int
+	}{
+		{"json", func(w io.Writer) error { return WriteJSON(w, results, 1, false) }, 4},
+		{"csv", func(w io.Writer) error { return WriteCSV(w, results) }, 3},
+		{"raw", func(w io.Writer) error { return WriteRaw(w, results) }, 3},
+		{"pickle", func(w io.Writer) error { return WritePickle(w, results) }, 5},
+		{"msgpack", func(w io.Writer) error { return WriteMsgpack(w, results) }, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &countingWriter{}
+			if err := tt.write(w); err != nil {
+				t.Fatal(err)
+			}
+			if w.writes != tt.writes {
+				t.Errorf("got %d writes, want %d", w.writes, tt.writes)
+			}
+
+			// stop on first error
+			w = &countingWriter{failAt: 2}
+			if err := tt.write(w); err == nil {
+				t.Error("error expected")
+			}
+			if w.writes != 2 {
+				t.Errorf("got %d writes after error", w.writes)
+			}
+		})
+	}
+}
+
 func getData(rangeSize int) []float64 {
 	var data = make([]float64, rangeSize)
 	var r = rand.New(rand.NewSource(99))
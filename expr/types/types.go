@@ -3,6 +3,7 @@ package types
 import (
 	"bytes"
 	"errors"
+	"io"
 	"math"
 	"sort"
 	"strconv"
@@ -15,6 +16,7 @@ import (
 	pbv2 "github.com/go-graphite/protocol/carbonapi_v2_pb"
 	pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
 	pickle "github.com/lomik/og-rek"
+	"github.com/tinylib/msgp/msgp"
 )
 
 var (
@@ -46,13 +48,24 @@ func appendInt2(b []byte, n int64) []byte {
 
 // MarshalCSV marshals metric data to CSV
 func MarshalCSV(results []*MetricData) []byte {
+	var buf bytes.Buffer
+	if len(results) > 0 {
+		buf.Grow(len(results) * (len(results[0].Name) + len(results[0].PathExpression) + 128*len(results[0].Values) + 128))
+	}
+	_ = WriteCSV(&buf, results)
+	return buf.Bytes()
+}
+
+// WriteCSV writes metric data in CSV format series by series
+func WriteCSV(w io.Writer, results []*MetricData) error {
 	if len(results) == 0 {
-		return []byte("[]")
+		_, err := w.Write([]byte("[]"))
+		return err
 	}
-	n := len(results) * (len(results[0].Name) + len(results[0].PathExpression) + 128*len(results[0].Values) + 128)
-	b := make([]byte, 0, n)
 
+	var b []byte
 	for _, r := range results {
+		b = b[:0]
 
 		step := r.StepTime
 		t := r.StartTime
@@ -79,8 +92,12 @@ func MarshalCSV(results []*MetricData) []byte {
 			b = append(b, '\n')
 			t += step
 		}
+
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
 	}
-	return b
+	return nil
 }
 
 // ConsolidateJSON consolidates values to maxDataPoints size
@@ -118,13 +135,22 @@ func ConsolidateJSON(maxDataPoints int64, results []*MetricData) {
 
 // MarshalJSON marshals metric data to JSON
 func MarshalJSON(results []*MetricData, timestampMultiplier int64, noNullPoints bool) []byte {
+	var buf bytes.Buffer
+	if len(results) > 0 {
+		buf.Grow(len(results) * (len(results[0].Name) + len(results[0].PathExpression) + 128*len(results[0].Values) + 128))
+	}
+	_ = WriteJSON(&buf, results, timestampMultiplier, noNullPoints)
+	return buf.Bytes()
+}
+
+// WriteJSON writes metric data in JSON format series by series
+func WriteJSON(w io.Writer, results []*MetricData, timestampMultiplier int64, noNullPoints bool) error {
 	if len(results) == 0 {
-		return []byte("[]")
+		_, err := w.Write([]byte("[]"))
+		return err
 	}
-	n := len(results) * (len(results[0].Name) + len(results[0].PathExpression) + 128*len(results[0].Values) + 128)
 
-	b := make([]byte, 0, n)
-	b = append(b, '[')
+	b := []byte{'['}
 
 	var topComma bool
 	for _, r := range results {
@@ -189,18 +215,42 @@ func MarshalJSON(results []*MetricData, timestampMultiplier int64, noNullPoints
 		}
 
 		b = append(b, `}}`...)
+
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		b = b[:0]
 	}
 
 	b = append(b, ']')
+	_, err := w.Write(b)
 
-	return b
+	return err
 }
 
 // MarshalPickle marshals metric data to pickle format
 func MarshalPickle(results []*MetricData) []byte {
+	var buf bytes.Buffer
+	_ = WritePickle(&buf, results)
+	return buf.Bytes()
+}
+
+// pickle opcodes, used to write list of series one by one
+const (
+	pickleEmptyList = ']'
+	pickleMark      = '('
+	pickleAppends   = 'e'
+	pickleStop      = '.'
+)
 
-	var p []map[string]interface{}
+// WritePickle writes metric data in pickle format series by series
+func WritePickle(w io.Writer, results []*MetricData) error {
+	if _, err := w.Write([]byte{pickleEmptyList, pickleMark}); err != nil {
+		return err
+	}
 
+	var buf bytes.Buffer
+	penc := pickle.NewEncoder(&buf)
 	for _, r := range results {
 		values := make([]interface{}, len(r.Values))
 		for i, v := range r.Values {
@@ -211,7 +261,9 @@ func MarshalPickle(results []*MetricData) []byte {
 			}
 
 		}
-		p = append(p, map[string]interface{}{
+
+		buf.Reset()
+		err := penc.Encode(map[string]interface{}{
 			"name":              r.Name,
 			"pathExpression":    r.PathExpression,
 			"consolidationFunc": r.ConsolidationFunc,
@@ -221,14 +273,72 @@ func MarshalPickle(results []*MetricData) []byte {
 			"xFilesFactor":      r.XFilesFactor,
 			"values":            values,
 		})
+		if err != nil {
+			return err
+		}
+		// strip STOP opcode, list is not finished yet
+		if _, err = w.Write(buf.Bytes()[:buf.Len()-1]); err != nil {
+			return err
+		}
 	}
 
+	_, err := w.Write([]byte{pickleAppends, pickleStop})
+	return err
+}
+
+// MarshalMsgpack marshals metric data to msgpack in the same structure as graphite-web
+func MarshalMsgpack(results []*MetricData) []byte {
 	var buf bytes.Buffer
+	_ = WriteMsgpack(&buf, results)
+	return buf.Bytes()
+}
 
-	penc := pickle.NewEncoder(&buf)
-	_ = penc.Encode(p)
+// WriteMsgpack writes metric data in msgpack format series by series
+func WriteMsgpack(w io.Writer, results []*MetricData) error {
+	b := msgp.AppendArrayHeader(nil, uint32(len(results)))
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
 
-	return buf.Bytes()
+	for _, r := range results {
+		valuesPerPoint := r.ValuesPerPoint
+		if valuesPerPoint == 0 {
+			valuesPerPoint = 1
+		}
+
+		b = msgp.AppendMapHeader(b[:0], 9)
+		b = msgp.AppendString(b, "name")
+		b = msgp.AppendString(b, r.Name)
+		b = msgp.AppendString(b, "pathExpression")
+		b = msgp.AppendString(b, r.PathExpression)
+		b = msgp.AppendString(b, "consolidationFunc")
+		b = msgp.AppendString(b, r.ConsolidationFunc)
+		b = msgp.AppendString(b, "start")
+		b = msgp.AppendInt64(b, r.StartTime)
+		b = msgp.AppendString(b, "end")
+		b = msgp.AppendInt64(b, r.StopTime)
+		b = msgp.AppendString(b, "step")
+		b = msgp.AppendInt64(b, r.StepTime)
+		b = msgp.AppendString(b, "valuesPerPoint")
+		b = msgp.AppendInt(b, valuesPerPoint)
+		b = msgp.AppendString(b, "xFilesFactor")
+		b = msgp.AppendFloat64(b, float64(r.XFilesFactor))
+		b = msgp.AppendString(b, "values")
+		b = msgp.AppendArrayHeader(b, uint32(len(r.Values)))
+		for _, v := range r.Values {
+			if math.IsNaN(v) {
+				b = msgp.AppendNil(b)
+			} else {
+				b = msgp.AppendFloat64(b, v)
+			}
+		}
+
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // MarshalProtobufV3 marshals metric data to protobuf
@@ -283,10 +393,17 @@ func MarshalRaw(results []*MetricData) []byte {
 	if len(results) == 0 {
 		return []byte{}
 	}
-	n := len(results) * (len(results[0].Name) + len(results[0].PathExpression) + 128*len(results[0].Values) + 128)
-	b := make([]byte, 0, n)
+	var buf bytes.Buffer
+	buf.Grow(len(results) * (len(results[0].Name) + len(results[0].PathExpression) + 128*len(results[0].Values) + 128))
+	_ = WriteRaw(&buf, results)
+	return buf.Bytes()
+}
 
+// WriteRaw writes metric data in graphite's 'raw' format series by series
+func WriteRaw(w io.Writer, results []*MetricData) error {
+	var b []byte
 	for _, r := range results {
+		b = b[:0]
 
 		b = append(b, r.Name...)
 
@@ -312,8 +429,12 @@ func MarshalRaw(results []*MetricData) []byte {
 		}
 
 		b = append(b, '\n')
+
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
 	}
-	return b
+	return nil
 }
 
 // SetValuesPerPoint sets value per point coefficient.
@@ -336,7 +457,7 @@ func (r *MetricData) AggregatedTimeStep() int64 {
 // or UseBucketsHighestTimestampOnAggregation are enabled.
 func (r *MetricData) AggregatedStartTime() int64 {
 	start := r.StartTime + r.nudgePointsCount()*r.StepTime
-	if config.Config.UseBucketsHighestTimestampOnAggregation {
+	if config.Current().UseBucketsHighestTimestampOnAggregation {
 		return start + r.AggregatedTimeStep() - r.StepTime
 	}
 	return start
@@ -350,7 +471,7 @@ func (r *MetricData) AggregatedStartTime() int64 {
 // starts right at the beginning. This function calculates how many points to
 // discard.
 func (r *MetricData) nudgePointsCount() int64 {
-	if !config.Config.NudgeStartTimeOnAggregation {
+	if !config.Current().NudgeStartTimeOnAggregation {
 		return 0
 	}
 
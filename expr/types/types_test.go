@@ -9,8 +9,10 @@ import (
 
 func TestAggregatedValuesNudgedAndHighestTimestamp(t *testing.T) {
 
-	config.Config.NudgeStartTimeOnAggregation = true
-	config.Config.UseBucketsHighestTimestampOnAggregation = true
+	config.Replace(config.ConfigType{
+		NudgeStartTimeOnAggregation:             true,
+		UseBucketsHighestTimestampOnAggregation: true,
+	})
 
 	tests := []struct {
 		name      string
@@ -203,8 +205,10 @@ func TestAggregatedValuesConfigVariants(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			config.Config.NudgeStartTimeOnAggregation = tt.nudge
-			config.Config.UseBucketsHighestTimestampOnAggregation = tt.highestTimestamp
+			config.Replace(config.ConfigType{
+				NudgeStartTimeOnAggregation:             tt.nudge,
+				UseBucketsHighestTimestampOnAggregation: tt.highestTimestamp,
+			})
 
 			input := MakeMetricData("test", values, step, start)
 			input.ConsolidationFunc = "sum"
@@ -0,0 +1,226 @@
+package limiter
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/ansel1/merry"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+)
+
+var ErrQueryCostExceeded = errors.New("query cost limit exceeded")
+
+// CostLimits limits resources used by a single request. Zero values mean no limit.
+type CostLimits struct {
+	// MaxFindMetrics is a maximum amount of metrics returned by a single glob expansion
+	MaxFindMetrics int64 `mapstructure:"maxFindMetrics" json:"maxFindMetrics"`
+	// MaxFetchedSeries is a maximum amount of series fetched from backends
+	MaxFetchedSeries int64 `mapstructure:"maxFetchedSeries" json:"maxFetchedSeries"`
+	// MaxDatapoints is a maximum amount of datapoints in all fetched series
+	MaxDatapoints int64 `mapstructure:"maxDatapoints" json:"maxDatapoints"`
+	// MaxOutputSeries is a maximum amount of series in response
+	MaxOutputSeries int64 `mapstructure:"maxOutputSeries" json:"maxOutputSeries"`
+}
+
+// Enabled checks that any limit is set
+func (l CostLimits) Enabled() bool {
+	return l.MaxFindMetrics > 0 || l.MaxFetchedSeries > 0 || l.MaxDatapoints > 0 || l.MaxOutputSeries > 0
+}
+
+// Cost is a resource usage of a request
+type Cost struct {
+	// FindMetrics is a largest glob expansion on all backends
+	FindMetrics   int64 `json:"findMetrics"`
+	FetchedSeries int64 `json:"fetchedSeries"`
+	Datapoints    int64 `json:"datapoints"`
+	OutputSeries  int64 `json:"outputSeries,omitempty"`
+}
+
+// Check returns error for the first exceeded limit
+func (c Cost) Check(limits CostLimits) merry.Error {
+	switch {
+	case limits.MaxFindMetrics > 0 && c.FindMetrics > limits.MaxFindMetrics:
+		return costError("maxFindMetrics", c.FindMetrics, limits.MaxFindMetrics)
+	case limits.MaxFetchedSeries > 0 && c.FetchedSeries > limits.MaxFetchedSeries:
+		return costError("maxFetchedSeries", c.FetchedSeries, limits.MaxFetchedSeries)
+	case limits.MaxDatapoints > 0 && c.Datapoints > limits.MaxDatapoints:
+		return costError("maxDatapoints", c.Datapoints, limits.MaxDatapoints)
+	case limits.MaxOutputSeries > 0 && c.OutputSeries > limits.MaxOutputSeries:
+		return costError("maxOutputSeries", c.OutputSeries, limits.MaxOutputSeries)
+	}
+	return nil
+}
+
+func costError(limit string, value, max int64) merry.Error {
+	return merry.WithMessagef(ErrQueryCostExceeded, "query cost limit %s exceeded: %d > %d", limit, value, max).
+		WithHTTPCode(http.StatusUnprocessableEntity).
+		WithValue("limit", limit)
+}
+
+// QueryCost accounts resources used by a request. Nil QueryCost has no limits.
+// When a limit is exceeded, error is kept, so request can be stopped at any stage.
+type QueryCost struct {
+	limits CostLimits
+
+	mu   sync.Mutex
+	cost Cost
+	err  merry.Error
+	// done is closed, when a limit is exceeded
+	done chan struct{}
+	// found keeps metrics of each glob, that are found on all backends
+	found map[string]map[string]struct{}
+	// fetched keeps series, that are already charged
+	fetched map[seriesKey]struct{}
+}
+
+// FetchedSeries is a series in fetch response
+type FetchedSeries struct {
+	// PathExpression is a glob, that the series is found for
+	PathExpression string
+	Name           string
+	// RequestFrom and RequestUntil are the time range of the request for the series
+	RequestFrom  int64
+	RequestUntil int64
+	Datapoints   int
+}
+
+// FetchedSeriesOf returns series of the fetch response
+func FetchedSeriesOf(metrics []protov3.FetchResponse) []FetchedSeries {
+	series := make([]FetchedSeries, 0, len(metrics))
+	for i := range metrics {
+		series = append(series, FetchedSeries{
+			PathExpression: metrics[i].PathExpression,
+			Name:           metrics[i].Name,
+			RequestFrom:    metrics[i].RequestStartTime,
+			RequestUntil:   metrics[i].RequestStopTime,
+			Datapoints:     len(metrics[i].Values),
+		})
+	}
+	return series
+}
+
+// seriesKey identifies series the same way, as they are merged in the response
+type seriesKey struct {
+	name  string
+	from  int64
+	until int64
+}
+
+// NewQueryCost creates accounting with limits
+func NewQueryCost(limits CostLimits) *QueryCost {
+	return &QueryCost{
+		limits:  limits,
+		done:    make(chan struct{}),
+		found:   make(map[string]map[string]struct{}),
+		fetched: make(map[seriesKey]struct{}),
+	}
+}
+
+func (q *QueryCost) add(f func(c *Cost)) merry.Error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	f(&q.cost)
+	if q.err == nil {
+		q.err = q.cost.Check(q.limits)
+		if q.err != nil {
+			close(q.done)
+		}
+	}
+	return q.err
+}
+
+// Done returns a channel, that is closed when any limit is exceeded, so requests in flight can be stopped.
+// Nil QueryCost returns nil channel.
+func (q *QueryCost) Done() <-chan struct{} {
+	if q == nil {
+		return nil
+	}
+	return q.done
+}
+
+// addFound adds metric to the glob expansion. Must be called with lock held.
+func (q *QueryCost) addFound(c *Cost, glob, metric string) {
+	metrics, ok := q.found[glob]
+	if !ok {
+		metrics = make(map[string]struct{})
+		q.found[glob] = metrics
+	}
+	metrics[metric] = struct{}{}
+	if n := int64(len(metrics)); n > c.FindMetrics {
+		c.FindMetrics = n
+	}
+}
+
+// AddFindMetrics checks amount of metrics in a glob expansion. Metrics, that are found for the same glob on several
+// backends (shards or replicas), are counted once.
+func (q *QueryCost) AddFindMetrics(glob string, metrics []string) merry.Error {
+	return q.add(func(c *Cost) {
+		for _, m := range metrics {
+			q.addFound(c, glob, m)
+		}
+	})
+}
+
+// AddFetched adds fetched series and their datapoints, series are also counted in expansions of their globs.
+// Series, that are already charged (e.g. fetched from another replica), are skipped.
+func (q *QueryCost) AddFetched(series []FetchedSeries) merry.Error {
+	return q.add(func(c *Cost) {
+		for _, s := range series {
+			key := seriesKey{name: s.Name, from: s.RequestFrom, until: s.RequestUntil}
+			if _, ok := q.fetched[key]; ok {
+				continue
+			}
+			q.fetched[key] = struct{}{}
+			c.FetchedSeries++
+			c.Datapoints += int64(s.Datapoints)
+			if s.PathExpression != "" {
+				q.addFound(c, s.PathExpression, s.Name)
+			}
+		}
+	})
+}
+
+// AddOutput adds series in response
+func (q *QueryCost) AddOutput(series int) merry.Error {
+	return q.add(func(c *Cost) {
+		c.OutputSeries += int64(series)
+	})
+}
+
+// Limits returns limits of the request
+func (q *QueryCost) Limits() CostLimits {
+	if q == nil {
+		return CostLimits{}
+	}
+	return q.limits
+}
+
+// Err returns error if any limit was exceeded
+func (q *QueryCost) Err() merry.Error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.err
+}
+
+// Cost returns resources used so far
+func (q *QueryCost) Cost() Cost {
+	if q == nil {
+		return Cost{}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.cost
+}
@@ -0,0 +1,133 @@
+package limiter
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ansel1/merry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryCost(t *testing.T) {
+	var noLimits *QueryCost
+	assert.NoError(t, noLimits.AddFindMetrics("foo.*", []string{"foo.a"}))
+	assert.NoError(t, noLimits.AddFetched(series("foo.*", 1, 1000000)))
+	assert.NoError(t, noLimits.Err())
+
+	tests := []struct {
+		name   string
+		limits CostLimits
+		add    func(q *QueryCost) merry.Error
+		limit  string
+	}{
+		{
+			name:   "find",
+			limits: CostLimits{MaxFindMetrics: 2},
+			add: func(q *QueryCost) merry.Error {
+				// glob expansions are not summarized, metrics found on several backends are counted once
+				if err := q.AddFindMetrics("foo.*", []string{"foo.a", "foo.b"}); err != nil {
+					return err
+				}
+				if err := q.AddFindMetrics("bar.*", []string{"bar.a", "bar.b"}); err != nil {
+					return err
+				}
+				if err := q.AddFindMetrics("foo.*", []string{"foo.b"}); err != nil {
+					return err
+				}
+				return q.AddFindMetrics("foo.*", []string{"foo.c"})
+			},
+			limit: "maxFindMetrics",
+		},
+		{
+			name:   "found series",
+			limits: CostLimits{MaxFindMetrics: 2},
+			add: func(q *QueryCost) merry.Error {
+				if err := q.AddFindMetrics("foo.*", []string{"foo.s0", "foo.s1"}); err != nil {
+					return err
+				}
+				return q.AddFetched(series("foo.*", 3, 1))
+			},
+			limit: "maxFindMetrics",
+		},
+		{
+			name:   "series",
+			limits: CostLimits{MaxFetchedSeries: 10, MaxDatapoints: 1000},
+			add: func(q *QueryCost) merry.Error {
+				// the same series from replicas are charged once
+				if err := q.AddFetched(series("foo.*", 6, 10)); err != nil {
+					return err
+				}
+				if err := q.AddFetched(series("foo.*", 10, 10)); err != nil {
+					return err
+				}
+				return q.AddFetched(series("bar.*", 1, 10))
+			},
+			limit: "maxFetchedSeries",
+		},
+		{
+			name:   "datapoints",
+			limits: CostLimits{MaxFetchedSeries: 10, MaxDatapoints: 1000},
+			add: func(q *QueryCost) merry.Error {
+				if err := q.AddFetched(series("foo.*", 2, 500)); err != nil {
+					return err
+				}
+				return q.AddFetched(series("bar.*", 1, 1))
+			},
+			limit: "maxDatapoints",
+		},
+		{
+			name:   "output",
+			limits: CostLimits{MaxOutputSeries: 1},
+			add: func(q *QueryCost) merry.Error {
+				if err := q.AddOutput(1); err != nil {
+					return err
+				}
+				return q.AddOutput(1)
+			},
+			limit: "maxOutputSeries",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQueryCost(tt.limits)
+			err := tt.add(q)
+			assert.ErrorIs(t, err, ErrQueryCostExceeded)
+			assert.Equal(t, http.StatusUnprocessableEntity, merry.HTTPCode(err))
+			assert.Equal(t, tt.limit, merry.Value(err, "limit"))
+			assert.Contains(t, merry.Message(err), tt.limit)
+
+			// error is kept
+			assert.Equal(t, err, q.Err())
+			assert.Equal(t, err, q.AddOutput(0))
+		})
+	}
+}
+
+// series returns n series of the glob with datapoints each
+func series(glob string, n, datapoints int) []FetchedSeries {
+	res := make([]FetchedSeries, 0, n)
+	for i := 0; i < n; i++ {
+		res = append(res, FetchedSeries{
+			PathExpression: glob,
+			Name:           strings.TrimSuffix(glob, "*") + "s" + strconv.Itoa(i),
+			RequestUntil:   120,
+			Datapoints:     datapoints,
+		})
+	}
+	return res
+}
+
+func TestQueryCostReplicas(t *testing.T) {
+	q := NewQueryCost(CostLimits{MaxFetchedSeries: 2})
+	// both replicas return the same series
+	assert.NoError(t, q.AddFetched(series("foo.*", 2, 10)))
+	assert.NoError(t, q.AddFetched(series("foo.*", 2, 10)))
+	assert.Equal(t, Cost{FindMetrics: 2, FetchedSeries: 2, Datapoints: 20}, q.Cost())
+
+	// series of another time range is another series
+	s := series("foo.*", 1, 10)
+	s[0].RequestFrom = 60
+	assert.ErrorIs(t, q.AddFetched(s), ErrQueryCostExceeded)
+}
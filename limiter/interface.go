@@ -11,4 +11,6 @@ type ServerLimiter interface {
 	Capacity() int
 	Enter(ctx context.Context, s string) error
 	Leave(ctx context.Context, s string)
+	// Load returns amount of requests to the server, that are running or waiting for a slot
+	Load(s string) int
 }
@@ -2,18 +2,26 @@ package limiter
 
 import (
 	"context"
+	"sync/atomic"
 )
 
 // ServerLimiter provides interface to limit amount of requests
 type RealLimiter struct {
-	m   map[string]chan struct{}
-	cap int
+	m    map[string]chan struct{}
+	load map[string]*int64
+	cap  int
 }
 
 // NewServerLimiter creates a limiter for specific servers list.
+// Zero limit doesn't limit requests, but still tracks load of servers.
 func NewServerLimiter(servers []string, l int) ServerLimiter {
+	load := make(map[string]*int64)
+	for _, s := range servers {
+		load[s] = new(int64)
+	}
+
 	if l <= 0 {
-		return &NoopLimiter{}
+		return &RealLimiter{load: load}
 	}
 
 	sl := make(map[string]chan struct{})
@@ -23,8 +31,9 @@ func NewServerLimiter(servers []string, l int) ServerLimiter {
 	}
 
 	limiter := &RealLimiter{
-		m:   sl,
-		cap: l,
+		m:    sl,
+		load: load,
+		cap:  l,
 	}
 	return limiter
 }
@@ -35,6 +44,9 @@ func (sl RealLimiter) Capacity() int {
 
 // Enter claims one of free slots or blocks until there is one.
 func (sl RealLimiter) Enter(ctx context.Context, s string) error {
+	if l, ok := sl.load[s]; ok {
+		atomic.AddInt64(l, 1)
+	}
 	if sl.m == nil {
 		return nil
 	}
@@ -43,15 +55,29 @@ func (sl RealLimiter) Enter(ctx context.Context, s string) error {
 	case sl.m[s] <- struct{}{}:
 		return nil
 	case <-ctx.Done():
+		if l, ok := sl.load[s]; ok {
+			atomic.AddInt64(l, -1)
+		}
 		return ErrTimeout
 	}
 }
 
 // Frees a slot in limiter
 func (sl RealLimiter) Leave(ctx context.Context, s string) {
+	if l, ok := sl.load[s]; ok {
+		atomic.AddInt64(l, -1)
+	}
 	if sl.m == nil {
 		return
 	}
 
 	<-sl.m[s]
 }
+
+// Load returns amount of requests to the server, that are running or waiting for a slot
+func (sl RealLimiter) Load(s string) int {
+	if l, ok := sl.load[s]; ok {
+		return int(atomic.LoadInt64(l))
+	}
+	return 0
+}
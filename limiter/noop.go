@@ -20,3 +20,8 @@ func (l NoopLimiter) Enter(ctx context.Context, s string) error {
 // Frees a slot in limiter
 func (l NoopLimiter) Leave(ctx context.Context, s string) {
 }
+
+// Load is always 0, requests are not tracked
+func (l NoopLimiter) Load(s string) int {
+	return 0
+}
@@ -0,0 +1,186 @@
+package limiter
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQuotaConcurrency = errors.New("too many concurrent requests")
+	ErrQuotaRate        = errors.New("request rate limit exceeded")
+)
+
+// maxQuotaStates limits count of tracked keys, so keys made up by clients can't exhaust memory
+const maxQuotaStates = 100000
+
+// Quota limits requests for a single key (user or tenant). Zero values mean no limit.
+type Quota struct {
+	// Concurrency is a maximum amount of requests in progress
+	Concurrency int `mapstructure:"concurrency"`
+	// Rate is amount of requests per second
+	Rate float64 `mapstructure:"rate"`
+	// Burst is a size of token bucket. Default is max(1, Rate)
+	Burst int `mapstructure:"burst"`
+}
+
+func (q Quota) burst() float64 {
+	if q.Burst > 0 {
+		return float64(q.Burst)
+	}
+	return math.Max(1, q.Rate)
+}
+
+type quotaState struct {
+	quota    Quota
+	inFlight int
+	tokens   float64
+	updated  time.Time
+}
+
+// refill adds tokens for elapsed time
+func (s *quotaState) refill(now time.Time) {
+	if s.quota.Rate <= 0 {
+		return
+	}
+	s.tokens = math.Min(s.quota.burst(), s.tokens+now.Sub(s.updated).Seconds()*s.quota.Rate)
+	s.updated = now
+}
+
+// idle checks that state is the same as a new one, so it can be dropped
+func (s *quotaState) idle() bool {
+	return s.inFlight == 0 && (s.quota.Rate <= 0 || s.tokens >= s.quota.burst())
+}
+
+// QuotaLimiter limits concurrency and request rate (with token bucket) per key.
+// Unlike other limiters it doesn't wait for a free slot, request over quota should be rejected.
+type QuotaLimiter struct {
+	defaultQuota Quota
+	overrides    map[string]Quota
+
+	mu          sync.Mutex
+	states      map[string]*quotaState
+	maxStates   int
+	lastCleanup time.Time
+
+	now func() time.Time
+}
+
+// NewQuotaLimiter creates limiter with default quota and per-key overrides
+func NewQuotaLimiter(defaultQuota Quota, overrides map[string]Quota) *QuotaLimiter {
+	return &QuotaLimiter{
+		defaultQuota: defaultQuota,
+		overrides:    overrides,
+		states:       make(map[string]*quotaState),
+		maxStates:    maxQuotaStates,
+		now:          time.Now,
+	}
+}
+
+// Quota returns quota for the key
+func (q *QuotaLimiter) Quota(key string) Quota {
+	if quota, ok := q.overrides[key]; ok {
+		return quota
+	}
+	return q.defaultQuota
+}
+
+// Enter claims quota for a request. On success Leave must be called when request is finished.
+// If quota is exceeded, ErrQuotaConcurrency or ErrQuotaRate is returned with a time after which request can be retried.
+func (q *QuotaLimiter) Enter(key string) (retryAfter time.Duration, err error) {
+	quota := q.Quota(key)
+	if quota.Concurrency <= 0 && quota.Rate <= 0 {
+		return 0, nil
+	}
+
+	now := q.now()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.cleanup(now)
+
+	s, ok := q.states[key]
+	if !ok {
+		if len(q.states) >= q.maxStates && !q.shrink(now) {
+			return time.Second, ErrQuotaConcurrency
+		}
+		s = &quotaState{quota: quota, tokens: quota.burst(), updated: now}
+		q.states[key] = s
+	}
+
+	if quota.Concurrency > 0 && s.inFlight >= quota.Concurrency {
+		return time.Second, ErrQuotaConcurrency
+	}
+
+	if quota.Rate > 0 {
+		s.refill(now)
+		if s.tokens < 1 {
+			wait := time.Duration((1 - s.tokens) / quota.Rate * float64(time.Second))
+			return wait, ErrQuotaRate
+		}
+		s.tokens--
+	}
+
+	s.inFlight++
+
+	return 0, nil
+}
+
+// Leave frees concurrency slot for the key
+func (q *QuotaLimiter) Leave(key string) {
+	q.mu.Lock()
+	if s, ok := q.states[key]; ok && s.inFlight > 0 {
+		s.inFlight--
+	}
+	q.mu.Unlock()
+}
+
+// InFlight returns amount of requests in progress for the key
+func (q *QuotaLimiter) InFlight(key string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if s, ok := q.states[key]; ok {
+		return s.inFlight
+	}
+	return 0
+}
+
+// cleanup drops states for keys without activity, must be called under lock
+func (q *QuotaLimiter) cleanup(now time.Time) {
+	if now.Sub(q.lastCleanup) < time.Minute {
+		return
+	}
+	q.lastCleanup = now
+	for key, s := range q.states {
+		s.refill(now)
+		if s.idle() {
+			delete(q.states, key)
+		}
+	}
+}
+
+// shrink frees space for new keys, when there are too many of them. Idle states are dropped first, then states
+// without requests in progress (their keys get full token bucket again). States are dropped down to 90% of the limit,
+// so it's not done for every new key. Returns false, if all keys have requests in progress. Must be called under lock.
+func (q *QuotaLimiter) shrink(now time.Time) bool {
+	q.lastCleanup = now
+	for key, s := range q.states {
+		s.refill(now)
+		if s.idle() {
+			delete(q.states, key)
+		}
+	}
+	target := q.maxStates - q.maxStates/10
+	for key, s := range q.states {
+		if len(q.states) < target {
+			break
+		}
+		if s.inFlight == 0 {
+			delete(q.states, key)
+		}
+	}
+	return len(q.states) < q.maxStates
+}
@@ -0,0 +1,99 @@
+package limiter
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	q := NewQuotaLimiter(Quota{Concurrency: 2}, map[string]Quota{
+		"tenant": {Rate: 2, Burst: 2},
+		"free":   {},
+	})
+	q.now = func() time.Time { return now }
+
+	// concurrency
+	for i := 0; i < 2; i++ {
+		_, err := q.Enter("user")
+		assert.NoError(t, err)
+	}
+	retryAfter, err := q.Enter("user")
+	assert.ErrorIs(t, err, ErrQuotaConcurrency)
+	assert.Equal(t, time.Second, retryAfter)
+	assert.Equal(t, 2, q.InFlight("user"))
+	q.Leave("user")
+	_, err = q.Enter("user")
+	assert.NoError(t, err)
+
+	// rate, burst is used first
+	for i := 0; i < 2; i++ {
+		_, err = q.Enter("tenant")
+		assert.NoError(t, err)
+		q.Leave("tenant")
+	}
+	retryAfter, err = q.Enter("tenant")
+	assert.ErrorIs(t, err, ErrQuotaRate)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	now = now.Add(250 * time.Millisecond)
+	retryAfter, err = q.Enter("tenant")
+	assert.ErrorIs(t, err, ErrQuotaRate)
+	assert.Equal(t, 250*time.Millisecond, retryAfter)
+
+	now = now.Add(250 * time.Millisecond)
+	_, err = q.Enter("tenant")
+	assert.NoError(t, err)
+	q.Leave("tenant")
+
+	// unlimited override
+	for i := 0; i < 10; i++ {
+		_, err = q.Enter("free")
+		assert.NoError(t, err)
+	}
+
+	// idle keys are dropped
+	q.Leave("user")
+	q.Leave("user")
+	now = now.Add(time.Hour)
+	_, err = q.Enter("other")
+	assert.NoError(t, err)
+	assert.Len(t, q.states, 1)
+}
+
+func TestQuotaLimiterMaxStates(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	q := NewQuotaLimiter(Quota{Concurrency: 1, Rate: 1}, nil)
+	q.now = func() time.Time { return now }
+	q.maxStates = 10
+
+	// keys with requests in progress are kept
+	for i := 0; i < 5; i++ {
+		_, err := q.Enter("busy" + strconv.Itoa(i))
+		assert.NoError(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		key := "user" + strconv.Itoa(i)
+		_, err := q.Enter(key)
+		assert.NoError(t, err)
+		q.Leave(key)
+		assert.LessOrEqual(t, len(q.states), q.maxStates)
+	}
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, 1, q.InFlight("busy"+strconv.Itoa(i)))
+	}
+
+	// new key is rejected, if all keys have requests in progress
+	for i := 5; i < 10; i++ {
+		_, err := q.Enter("busy" + strconv.Itoa(i))
+		assert.NoError(t, err)
+	}
+	_, err := q.Enter("other")
+	assert.ErrorIs(t, err, ErrQuotaConcurrency)
+	q.Leave("busy0")
+	_, err = q.Enter("other")
+	assert.NoError(t, err)
+}
@@ -26,3 +26,13 @@ func (l SimpleLimiter) Leave() {
 func NewSimpleLimiter(l int) SimpleLimiter {
 	return make(chan struct{}, l)
 }
+
+// Len returns amount of currently occupied slots
+func (l SimpleLimiter) Len() int {
+	return len(l)
+}
+
+// Capacity returns total amount of slots
+func (l SimpleLimiter) Capacity() int {
+	return cap(l)
+}
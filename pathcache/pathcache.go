@@ -1,6 +1,10 @@
 package pathcache
 
 import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
 	"github.com/dgryski/go-expirecache"
 	"github.com/go-graphite/carbonapi/zipper/types"
 
@@ -9,32 +13,66 @@ import (
 
 // PathCache provides general interface to cache find and search queries
 type PathCache struct {
-	ec *expirecache.Cache
+	// entries are shared by copies of the cache, they are replaced on purge
+	entries *atomic.Pointer[entries]
 
 	expireDelaySec int32
+
+	// counters are shared by copies of the cache
+	stats *Stats
+}
+
+// Stats contains hits and misses of the cache. All fields must be accessed atomically.
+type Stats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// entries is expirecache with its cleaner, cleaner is stopped when entries are purged or cache is closed
+type entries struct {
+	ec   *expirecache.Cache
+	exit chan struct{}
+	once sync.Once
+}
+
+func newEntries() *entries {
+	e := &entries{
+		ec:   expirecache.New(0),
+		exit: make(chan struct{}),
+	}
+
+	go e.ec.StoppableApproximateCleaner(10*time.Second, e.exit)
+
+	return e
+}
+
+func (e *entries) stop() {
+	e.once.Do(func() {
+		close(e.exit)
+	})
 }
 
 // NewPathCache initializes PathCache structure
 func NewPathCache(ExpireDelaySec int32) PathCache {
 
 	p := PathCache{
-		ec:             expirecache.New(0),
+		entries:        &atomic.Pointer[entries]{},
 		expireDelaySec: ExpireDelaySec,
+		stats:          &Stats{},
 	}
-
-	go p.ec.ApproximateCleaner(10 * time.Second)
+	p.entries.Store(newEntries())
 
 	return p
 }
 
 // ECItems returns amount of items in the cache
 func (p *PathCache) ECItems() int {
-	return p.ec.Items()
+	return p.entries.Load().ec.Items()
 }
 
 // ECSize returns size of the cache
 func (p *PathCache) ECSize() uint64 {
-	return p.ec.Size()
+	return p.entries.Load().ec.Size()
 }
 
 // Set allows to set a key (k) to value (v).
@@ -45,14 +83,89 @@ func (p *PathCache) Set(k string, v []types.BackendServer) {
 		size += uint64(len(vv.Backends()))
 	}
 
-	p.ec.Set(k, v, size, p.expireDelaySec)
+	p.entries.Load().ec.Set(k, v, size, p.expireDelaySec)
 }
 
 // Get returns an an element by key. If not successful - returns also false in second var.
 func (p *PathCache) Get(k string) ([]types.BackendServer, bool) {
-	if v, ok := p.ec.Get(k); ok {
+	if v, ok := p.entries.Load().ec.Get(k); ok {
+		atomic.AddUint64(&p.stats.Hits, 1)
 		return v.([]types.BackendServer), true
 	}
 
+	atomic.AddUint64(&p.stats.Misses, 1)
 	return nil, false
 }
+
+// Purge removes all elements and returns their count
+func (p *PathCache) Purge() int {
+	old := p.entries.Swap(newEntries())
+	old.stop()
+	return old.ec.Items()
+}
+
+// Close stops background cleanup of the cache. Cache still can be used after Close, expired elements are just not
+// removed from memory.
+func (p *PathCache) Close() {
+	p.entries.Load().stop()
+}
+
+// Stats returns hits and misses of the cache
+func (p *PathCache) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&p.stats.Hits), atomic.LoadUint64(&p.stats.Misses)
+}
+
+var registry = struct {
+	sync.Mutex
+	// caches of the group in order of registration, the last one is used by the group of the running zipper
+	groups map[string][]PathCache
+}{
+	groups: make(map[string][]PathCache),
+}
+
+// Register makes cache of the backend group available for admin API. Cache of the group with the same name is hidden,
+// until the new one is closed (e.g. zipper created by failed config reload).
+func Register(group string, p PathCache) {
+	if p.entries == nil {
+		// group is created without path cache
+		return
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	registry.groups[group] = append(registry.groups[group], p)
+}
+
+// Deregister removes cache of the backend group from the registry, e.g. when zipper is replaced on config reload
+func Deregister(group string, p PathCache) {
+	registry.Lock()
+	defer registry.Unlock()
+	caches := registry.groups[group]
+	for i := range caches {
+		if caches[i].entries == p.entries {
+			caches = append(caches[:i], caches[i+1:]...)
+			break
+		}
+	}
+	if len(caches) == 0 {
+		delete(registry.groups, group)
+		return
+	}
+	registry.groups[group] = caches
+}
+
+// Each calls f for every registered cache, sorted by group name
+func Each(f func(group string, p PathCache)) {
+	registry.Lock()
+	groups := make([]string, 0, len(registry.groups))
+	caches := make(map[string]PathCache, len(registry.groups))
+	for group, c := range registry.groups {
+		groups = append(groups, group)
+		caches[group] = c[len(c)-1]
+	}
+	registry.Unlock()
+
+	sort.Strings(groups)
+	for _, group := range groups {
+		f(group, caches[group])
+	}
+}
@@ -0,0 +1,53 @@
+package pathcache
+
+import (
+	"testing"
+)
+
+func registered() map[string]PathCache {
+	res := make(map[string]PathCache)
+	Each(func(group string, p PathCache) {
+		res[group] = p
+	})
+	return res
+}
+
+func TestRegistry(t *testing.T) {
+	running := NewPathCache(60)
+	defer running.Close()
+	Register("group", running)
+
+	// cache of failed reload hides the running one until it's closed
+	reloaded := NewPathCache(60)
+	Register("group", reloaded)
+	if p, ok := registered()["group"]; !ok || p.entries != reloaded.entries {
+		t.Fatalf("the last registered cache is not used")
+	}
+	reloaded.Close()
+	Deregister("group", reloaded)
+	if p, ok := registered()["group"]; !ok || p.entries != running.entries {
+		t.Fatalf("running cache is not used after deregistration of the new one")
+	}
+
+	Deregister("group", running)
+	if _, ok := registered()["group"]; ok {
+		t.Fatalf("deregistered group is still registered")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	p := NewPathCache(60)
+	defer p.Close()
+	p.Set("foo", nil)
+	p.Set("bar", nil)
+
+	if n := p.Purge(); n != 2 {
+		t.Fatalf("unexpected count of purged entries: %d", n)
+	}
+	if _, ok := p.Get("foo"); ok {
+		t.Fatalf("purged entry is returned")
+	}
+	if n := p.Purge(); n != 0 {
+		t.Fatalf("unexpected count of purged entries of empty cache: %d", n)
+	}
+}
@@ -1,23 +1,69 @@
 package parser
 
 import (
+	"errors"
 	"strings"
+	"sync/atomic"
 	"text/template"
 )
 
+var ErrEmptyDefineName = errors.New("empty define name")
+
 type defineStruct struct {
 	tpl *template.Template
 }
 
-var defineMap = &defineStruct{tpl: template.New("define")}
+var defineMap atomic.Pointer[defineStruct]
+
+func init() {
+	defineMap.Store(&defineStruct{tpl: template.New("define")})
+}
 
 // Define new template
 func Define(name, tmpl string) error {
-	return defineMap.define(name, tmpl)
+	return defineMap.Load().define(name, tmpl)
+}
+
+// Defines are compiled templates, that replace defined ones by UseDefines
+type Defines struct {
+	d *defineStruct
+}
+
+// CompileDefines compiles templates without changing defined ones
+func CompileDefines(defines map[string]string) (Defines, error) {
+	d := &defineStruct{tpl: template.New("define")}
+	for name, tmpl := range defines {
+		if name == "" {
+			return Defines{}, ErrEmptyDefineName
+		}
+		if err := d.define(name, tmpl); err != nil {
+			return Defines{}, err
+		}
+	}
+	return Defines{d: d}, nil
+}
+
+// UseDefines replaces all defined templates at once
+func UseDefines(defines Defines) {
+	if defines.d == nil {
+		defineCleanUp()
+		return
+	}
+	defineMap.Store(defines.d)
+}
+
+// ReplaceDefines replaces all defined templates at once. Nothing is changed if any of templates can't be compiled.
+func ReplaceDefines(defines map[string]string) error {
+	d, err := CompileDefines(defines)
+	if err != nil {
+		return err
+	}
+	UseDefines(d)
+	return nil
 }
 
 func defineCleanUp() {
-	defineMap = &defineStruct{tpl: template.New("define")}
+	defineMap.Store(&defineStruct{tpl: template.New("define")})
 }
 
 func (d *defineStruct) define(name, tmpl string) error {
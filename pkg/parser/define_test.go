@@ -119,3 +119,25 @@ func TestDefineExpand(t *testing.T) {
 		assert.Equal(tt.e, e, tt.s)
 	}
 }
+
+func TestReplaceDefines(t *testing.T) {
+	defer defineCleanUp()
+
+	assert.NoError(t, Define("old", "old.metric"))
+	assert.NoError(t, ReplaceDefines(map[string]string{"new": "new.metric"}))
+
+	exp, _, err := ParseExpr("old")
+	assert.NoError(t, err)
+	assert.Equal(t, "old", exp.Target())
+
+	exp, _, err = ParseExpr("new")
+	assert.NoError(t, err)
+	assert.Equal(t, "new.metric", exp.Target())
+
+	// broken templates must not replace current ones
+	assert.Error(t, ReplaceDefines(map[string]string{"broken": "{{.args"}))
+	assert.ErrorIs(t, ReplaceDefines(map[string]string{"": "metric"}), ErrEmptyDefineName)
+	exp, _, err = ParseExpr("new")
+	assert.NoError(t, err)
+	assert.Equal(t, "new.metric", exp.Target())
+}
@@ -669,7 +669,7 @@ func ParseExpr(e string) (Expr, string, error) {
 	if err != nil {
 		return exp, e, err
 	}
-	exp, err = defineMap.expandExpr(exp.(*expr))
+	exp, err = defineMap.Load().expandExpr(exp.(*expr))
 	return exp, e, err
 }
 
@@ -0,0 +1,296 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var ErrNoEndpoint = errors.New("tracing: endpoint is not specified")
+
+// Config describes OTLP/HTTP exporter
+type Config struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Endpoint is a full URL of collector, e.g. http://localhost:4318/v1/traces
+	Endpoint      string            `mapstructure:"endpoint"`
+	ServiceName   string            `mapstructure:"serviceName"`
+	Headers       map[string]string `mapstructure:"headers"`
+	Timeout       time.Duration     `mapstructure:"timeout"`
+	BatchSize     int               `mapstructure:"batchSize"`
+	QueueSize     int               `mapstructure:"queueSize"`
+	FlushInterval time.Duration     `mapstructure:"flushInterval"`
+}
+
+// Exporter batches finished spans and sends them to the collector in background
+type Exporter struct {
+	endpoint      string
+	headers       map[string]string
+	client        *http.Client
+	batchSize     int
+	flushInterval time.Duration
+	resource      otlpResource
+	logger        *zap.Logger
+
+	queue chan *Span
+	stop  chan struct{}
+	done  chan struct{}
+
+	exported uint64
+	dropped  uint64
+	failed   uint64
+}
+
+// NewExporter creates exporter and starts background sender
+func NewExporter(cfg Config, logger *zap.Logger) (*Exporter, error) {
+	if cfg.Endpoint == "" {
+		return nil, ErrNoEndpoint
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "carbonapi"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 512
+	}
+	if cfg.QueueSize < cfg.BatchSize {
+		cfg.QueueSize = 4 * cfg.BatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 5 * time.Second
+	}
+
+	serviceName := cfg.ServiceName
+	e := &Exporter{
+		endpoint:      cfg.Endpoint,
+		headers:       cfg.Headers,
+		client:        &http.Client{Timeout: cfg.Timeout},
+		batchSize:     cfg.BatchSize,
+		flushInterval: cfg.FlushInterval,
+		resource: otlpResource{
+			Attributes: []otlpKeyValue{{Key: "service.name", Value: otlpAnyValue{StringValue: &serviceName}}},
+		},
+		logger: logger,
+		queue:  make(chan *Span, cfg.QueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go e.run()
+
+	return e, nil
+}
+
+func (e *Exporter) enqueue(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, e.batchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			e.export(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= e.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stop:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+					if len(batch) >= e.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown sends all queued spans and stops background sender
+func (e *Exporter) Shutdown(ctx context.Context) {
+	select {
+	case <-e.stop:
+	default:
+		close(e.stop)
+	}
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+	}
+}
+
+// Stats returns amount of exported, dropped (due to full queue) and failed to send spans
+func (e *Exporter) Stats() (exported, dropped, failed uint64) {
+	return atomic.LoadUint64(&e.exported), atomic.LoadUint64(&e.dropped), atomic.LoadUint64(&e.failed)
+}
+
+func (e *Exporter) export(batch []*Span) {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.toOTLP())
+	}
+
+	req := otlpExportRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: e.resource,
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/go-graphite/carbonapi"},
+				Spans: spans,
+			}},
+		}},
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		atomic.AddUint64(&e.failed, uint64(len(batch)))
+		e.logger.Error("failed to marshal spans", zap.Error(err))
+		return
+	}
+
+	r, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		atomic.AddUint64(&e.failed, uint64(len(batch)))
+		e.logger.Error("failed to create request", zap.Error(err))
+		return
+	}
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		r.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(r)
+	if err != nil {
+		atomic.AddUint64(&e.failed, uint64(len(batch)))
+		e.logger.Warn("failed to export spans",
+			zap.String("endpoint", e.endpoint),
+			zap.Error(err),
+		)
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		atomic.AddUint64(&e.failed, uint64(len(batch)))
+		e.logger.Warn("failed to export spans",
+			zap.String("endpoint", e.endpoint),
+			zap.Int("http_code", resp.StatusCode),
+		)
+		return
+	}
+
+	atomic.AddUint64(&e.exported, uint64(len(batch)))
+}
+
+// OTLP/JSON structures, see https://github.com/open-telemetry/opentelemetry-proto/blob/main/docs/specification.md#json-protobuf-encoding
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// status codes from OTLP
+const otlpStatusError = 2
+
+func (s *Span) toOTLP() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := otlpSpan{
+		TraceID:           hex.EncodeToString(s.tc.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.tc.SpanID[:]),
+		TraceState:        s.tc.State,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.parentSpanID != [8]byte{} {
+		r.ParentSpanID = hex.EncodeToString(s.parentSpanID[:])
+	}
+	if s.isError {
+		r.Status = &otlpStatus{Code: otlpStatusError, Message: s.errMsg}
+	}
+
+	return r
+}
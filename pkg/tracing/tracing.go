@@ -0,0 +1,178 @@
+// Package tracing implements minimal span recording with W3C trace context propagation
+// and export to OpenTelemetry collector over OTLP/HTTP (json encoding).
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	utilctx "github.com/go-graphite/carbonapi/util/ctx"
+)
+
+// SpanKind values are the same as in OTLP
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Span is a single timed operation. All methods are safe to call on nil Span, which is returned
+// when tracing is disabled or request is not sampled.
+type Span struct {
+	tc           utilctx.TraceContext
+	parentSpanID [8]byte
+	name         string
+	kind         SpanKind
+	start        time.Time
+	end          time.Time
+
+	mu      sync.Mutex
+	attrs   []otlpKeyValue
+	errMsg  string
+	isError bool
+	ended   bool
+}
+
+var exporter atomic.Pointer[Exporter]
+
+// SetExporter sets global exporter for all spans. nil disables tracing.
+func SetExporter(e *Exporter) {
+	exporter.Store(e)
+}
+
+// Shutdown disables tracing and waits up to timeout for queued spans to be sent
+func Shutdown(timeout time.Duration) {
+	e := exporter.Swap(nil)
+	if e == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	e.Shutdown(ctx)
+}
+
+// Enabled reports if spans are recorded
+func Enabled() bool {
+	return exporter.Load() != nil
+}
+
+func newSpanID() (id [8]byte) {
+	for id == [8]byte{} {
+		binary.BigEndian.PutUint64(id[:], rand.Uint64())
+	}
+	return
+}
+
+func newTraceID() (id [16]byte) {
+	for id == [16]byte{} {
+		binary.BigEndian.PutUint64(id[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(id[8:], rand.Uint64())
+	}
+	return
+}
+
+// StartSpan starts a new span as a child of span (or remote parent) stored in ctx.
+// Returned context carries trace context of the new span and must be used for nested operations.
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if exporter.Load() == nil {
+		return ctx, nil
+	}
+
+	parent, hasParent := utilctx.GetTraceContext(ctx)
+	if hasParent && !parent.IsSampled() {
+		// caller doesn't record this trace, so we only propagate it as is
+		return ctx, nil
+	}
+
+	s := &Span{
+		name:  name,
+		kind:  kind,
+		start: time.Now(),
+	}
+	if hasParent {
+		s.tc = parent
+		s.parentSpanID = parent.SpanID
+	} else {
+		s.tc.TraceID = newTraceID()
+		s.tc.Flags = utilctx.TraceFlagSampled
+	}
+	s.tc.SpanID = newSpanID()
+
+	return utilctx.SetTraceContext(ctx, s.tc), s
+}
+
+// SetAttribute adds attribute to the span. Supported value types are string, bool, int, int64, uint64 and float64,
+// everything else is ignored.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	case int:
+		i := strconv.Itoa(v)
+		kv.Value.IntValue = &i
+	case int64:
+		i := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &i
+	case uint64:
+		i := strconv.FormatUint(v, 10)
+		kv.Value.IntValue = &i
+	case float64:
+		kv.Value.DoubleValue = &v
+	default:
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, kv)
+	s.mu.Unlock()
+}
+
+// SetError marks span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.isError = true
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes span and passes it to exporter. Calling End multiple times has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if e := exporter.Load(); e != nil {
+		e.enqueue(s)
+	}
+}
+
+// TraceParent returns traceparent header value for the span
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return s.tc.TraceParent()
+}
@@ -0,0 +1,120 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	utilctx "github.com/go-graphite/carbonapi/util/ctx"
+)
+
+// collector is a stand-in for OTLP/HTTP collector
+type collector struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+	attrs []otlpKeyValue
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var req otlpExportRequest
+	if r.Header.Get("Content-Type") != "application/json" || json.Unmarshal(body, &req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	for _, rs := range req.ResourceSpans {
+		c.attrs = append(c.attrs, rs.Resource.Attributes...)
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	c.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestExporter(t *testing.T) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	e, err := NewExporter(Config{Endpoint: srv.URL + "/v1/traces", BatchSize: 2, FlushInterval: time.Hour}, zap.NewNop())
+	if !assert.NoError(t, err) {
+		return
+	}
+	SetExporter(e)
+
+	parent, ok := utilctx.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	ctx := utilctx.SetTraceContext(context.Background(), parent)
+
+	ctx, root := StartSpan(ctx, "/render", SpanKindServer)
+	root.SetAttribute("http.method", "GET")
+	_, child := StartSpan(ctx, "sumSeries", SpanKindInternal)
+	child.SetAttribute("expr.series", 3)
+	child.SetError(errors.New("boom"))
+	child.End()
+	root.End()
+	root.End()
+
+	tc, _ := utilctx.GetTraceContext(ctx)
+	assert.Equal(t, root.TraceParent(), tc.TraceParent())
+
+	// unsampled trace is only propagated
+	unsampled, _ := utilctx.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, s := StartSpan(utilctx.SetTraceContext(context.Background(), unsampled), "skipped", SpanKindServer)
+	assert.Nil(t, s)
+	s.SetAttribute("k", "v")
+	s.End()
+
+	Shutdown(time.Second)
+	assert.False(t, Enabled())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !assert.Len(t, c.spans, 2) {
+		return
+	}
+	assert.Equal(t, "service.name", c.attrs[0].Key)
+	assert.Equal(t, "carbonapi", *c.attrs[0].Value.StringValue)
+
+	cs, rs := c.spans[0], c.spans[1]
+	assert.Equal(t, "sumSeries", cs.Name)
+	assert.Equal(t, "/render", rs.Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", rs.TraceID)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", cs.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", rs.ParentSpanID)
+	assert.Equal(t, rs.SpanID, cs.ParentSpanID)
+	assert.Equal(t, SpanKindServer, rs.Kind)
+	assert.Nil(t, rs.Status)
+	if assert.NotNil(t, cs.Status) {
+		assert.Equal(t, otlpStatusError, cs.Status.Code)
+		assert.Equal(t, "boom", cs.Status.Message)
+	}
+	if assert.Len(t, cs.Attributes, 1) {
+		assert.Equal(t, "3", *cs.Attributes[0].Value.IntValue)
+	}
+
+	exported, dropped, failed := e.Stats()
+	assert.Equal(t, uint64(2), exported)
+	assert.Equal(t, uint64(0), dropped)
+	assert.Equal(t, uint64(0), failed)
+}
+
+func TestStartSpanDisabled(t *testing.T) {
+	ctx := context.Background()
+	ctx2, s := StartSpan(ctx, "test", SpanKindInternal)
+	assert.Nil(t, s)
+	assert.Equal(t, ctx, ctx2)
+	assert.Equal(t, "", s.TraceParent())
+}
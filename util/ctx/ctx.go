@@ -3,6 +3,9 @@ package ctx
 import (
 	"context"
 	"net/http"
+	"sync/atomic"
+
+	"github.com/go-graphite/carbonapi/limiter"
 )
 
 type key int
@@ -15,6 +18,10 @@ const (
 	headersToPassKey
 	headersToLogKey
 	maxDataPoints
+	traceContextKey
+	queryCostKey
+	profileKey
+	fetchChargedKey
 )
 
 func ifaceToString(v interface{}) string {
@@ -80,6 +87,30 @@ func GetMaxDatapoints(ctx context.Context) int64 {
 	return getCtxInt64(ctx, maxDataPoints)
 }
 
+// GetQueryCost returns resources accounting for the request, nil if request has no cost limits
+func GetQueryCost(ctx context.Context) *limiter.QueryCost {
+	v, _ := ctx.Value(queryCostKey).(*limiter.QueryCost)
+	return v
+}
+
+func SetQueryCost(ctx context.Context, c *limiter.QueryCost) context.Context {
+	return context.WithValue(ctx, queryCostKey, c)
+}
+
+// WithFetchCharge returns context for fetching data, the flag is set if fetched data were charged against query cost
+// by a nested fetcher with MarkFetchCharged, so they are not charged again
+func WithFetchCharge(ctx context.Context) (context.Context, *atomic.Bool) {
+	charged := new(atomic.Bool)
+	return context.WithValue(ctx, fetchChargedKey, charged), charged
+}
+
+// MarkFetchCharged marks data, that are fetched with the context, as charged against query cost
+func MarkFetchCharged(ctx context.Context) {
+	if charged, ok := ctx.Value(fetchChargedKey).(*atomic.Bool); ok {
+		charged.Store(true)
+	}
+}
+
 func ParseCtx(h http.HandlerFunc, uuidKey string) http.HandlerFunc {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		uuid := req.Header.Get(uuidKey)
@@ -0,0 +1,83 @@
+package ctx
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Call is a function call (or fetch), recorded while profiling the request
+type Call struct {
+	Function   string `json:"function"`
+	Expression string `json:"expression"`
+	// Depth is a nesting level of the call, calls are recorded when finished, so nested calls go before the parent
+	Depth int `json:"depth"`
+	// WallTime includes time of nested calls
+	WallTime time.Duration `json:"wallTimeNs"`
+	// InputSeries is amount of fetched series used by the expression, for fetch it's amount of requested path expressions
+	InputSeries  int    `json:"inputSeries"`
+	OutputSeries int    `json:"outputSeries"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Profile collects calls of the request. Nil Profile doesn't record anything.
+type Profile struct {
+	mu    sync.Mutex
+	calls []Call
+}
+
+// NewProfile creates empty profile
+func NewProfile() *Profile {
+	return &Profile{}
+}
+
+// Add records finished call
+func (p *Profile) Add(c Call) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.calls = append(p.calls, c)
+	p.mu.Unlock()
+}
+
+// Calls returns recorded calls
+func (p *Profile) Calls() []Call {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	calls := make([]Call, len(p.calls))
+	copy(calls, p.calls)
+	return calls
+}
+
+type profileFrame struct {
+	profile *Profile
+	depth   int
+}
+
+// GetProfile returns profile of the request and nesting level of the current call, nil if request is not profiled
+func GetProfile(ctx context.Context) (*Profile, int) {
+	v, _ := ctx.Value(profileKey).(profileFrame)
+	return v.profile, v.depth
+}
+
+// SetProfile enables profiling of the request
+func SetProfile(ctx context.Context, p *Profile) context.Context {
+	return context.WithValue(ctx, profileKey, profileFrame{profile: p})
+}
+
+// NestProfile returns context for nested calls, it's returned as is if request is not profiled
+func NestProfile(ctx context.Context) context.Context {
+	v, ok := ctx.Value(profileKey).(profileFrame)
+	if !ok {
+		return ctx
+	}
+	v.depth++
+	return context.WithValue(ctx, profileKey, v)
+}
@@ -0,0 +1,110 @@
+package ctx
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const (
+	HeaderTraceParent = "traceparent"
+	HeaderTraceState  = "tracestate"
+
+	// TraceFlagSampled is a W3C trace-flags bit, that indicates that caller may have recorded trace data
+	TraceFlagSampled byte = 0x01
+)
+
+// TraceContext is a W3C trace context (https://www.w3.org/TR/trace-context/) of the current request.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+	State   string
+}
+
+// IsValid checks that trace and span ids are not zero
+func (tc TraceContext) IsValid() bool {
+	return tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+func (tc TraceContext) IsSampled() bool {
+	return tc.Flags&TraceFlagSampled != 0
+}
+
+// TraceParent formats traceparent header value
+func (tc TraceContext) TraceParent() string {
+	var b strings.Builder
+	b.Grow(55)
+	b.WriteString("00-")
+	b.WriteString(hex.EncodeToString(tc.TraceID[:]))
+	b.WriteByte('-')
+	b.WriteString(hex.EncodeToString(tc.SpanID[:]))
+	b.WriteByte('-')
+	b.WriteString(hex.EncodeToString([]byte{tc.Flags}))
+	return b.String()
+}
+
+// ParseTraceParent parses traceparent header value. Unknown versions are parsed as version 00, as required by spec.
+func ParseTraceParent(s string) (tc TraceContext, ok bool) {
+	s = strings.TrimSpace(s)
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return tc, false
+	}
+	if s[:2] == "ff" || (s[:2] == "00" && len(s) != 55) || (len(s) > 55 && s[55] != '-') {
+		return tc, false
+	}
+	if !isLowerHex(s[:2]) || !isLowerHex(s[3:35]) || !isLowerHex(s[36:52]) || !isLowerHex(s[53:55]) {
+		return tc, false
+	}
+	_, _ = hex.Decode(tc.TraceID[:], []byte(s[3:35]))
+	_, _ = hex.Decode(tc.SpanID[:], []byte(s[36:52]))
+	var flags [1]byte
+	_, _ = hex.Decode(flags[:], []byte(s[53:55]))
+	tc.Flags = flags[0]
+
+	return tc, tc.IsValid()
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func GetTraceContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey).(TraceContext)
+	return tc, ok
+}
+
+func SetTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey, tc)
+}
+
+// ParseTraceHeaders stores trace context from incoming request headers, if present and valid
+func ParseTraceHeaders(ctx context.Context, h http.Header) context.Context {
+	tc, ok := ParseTraceParent(h.Get(HeaderTraceParent))
+	if !ok {
+		return ctx
+	}
+	tc.State = h.Get(HeaderTraceState)
+	return SetTraceContext(ctx, tc)
+}
+
+// MarshalTraceContext sets traceparent and tracestate headers for outgoing request
+func MarshalTraceContext(ctx context.Context, request *http.Request) *http.Request {
+	tc, ok := GetTraceContext(ctx)
+	if !ok {
+		return request
+	}
+	request.Header.Set(HeaderTraceParent, tc.TraceParent())
+	if tc.State != "" {
+		request.Header.Set(HeaderTraceState, tc.State)
+	}
+
+	return request
+}
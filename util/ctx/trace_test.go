@@ -0,0 +1,59 @@
+package ctx
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		sampled bool
+		ok      bool
+	}{
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", want: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sampled: true, ok: true},
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", want: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", ok: true},
+		// future version with extra fields
+		{in: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", want: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sampled: true, ok: true},
+		{in: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"},
+		{in: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{in: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"},
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7"},
+		{in: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			tc, ok := ParseTraceParent(tt.in)
+			assert.Equal(t, tt.ok, ok)
+			if ok {
+				assert.Equal(t, tt.want, tc.TraceParent())
+				assert.Equal(t, tt.sampled, tc.IsSampled())
+			}
+		})
+	}
+}
+
+func TestTraceHeadersRoundTrip(t *testing.T) {
+	h := http.Header{}
+	h.Set(HeaderTraceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.Set(HeaderTraceState, "congo=t61rcWkgMzE")
+	ctx := ParseTraceHeaders(context.Background(), h)
+
+	req, _ := http.NewRequest("GET", "http://localhost/render", nil)
+	req = MarshalTraceContext(ctx, req)
+	assert.Equal(t, h.Get(HeaderTraceParent), req.Header.Get(HeaderTraceParent))
+	assert.Equal(t, h.Get(HeaderTraceState), req.Header.Get(HeaderTraceState))
+
+	// invalid header must not be propagated
+	h.Set(HeaderTraceParent, "garbage")
+	ctx = ParseTraceHeaders(context.Background(), h)
+	req, _ = http.NewRequest("GET", "http://localhost/render", nil)
+	req = MarshalTraceContext(ctx, req)
+	assert.Empty(t, req.Header.Get(HeaderTraceParent))
+}
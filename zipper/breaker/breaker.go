@@ -0,0 +1,296 @@
+package breaker
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+// State of the circuit breaker
+type State int
+
+const (
+	// Closed breaker sends all requests to the server
+	Closed State = iota
+	// Open breaker doesn't send requests to the ejected server
+	Open
+	// HalfOpen breaker sends limited amount of trial requests to the server
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// buckets is a count of buckets, the window is split to
+const buckets = 10
+
+type bucket struct {
+	start    int64
+	requests uint64
+	errors   uint64
+	timeNS   int64
+}
+
+// Breaker tracks error rate and latency of requests to a single server. Server is ejected (breaker opens), when they
+// are above thresholds, and readmitted after enough successful trial requests.
+type Breaker struct {
+	Group  string
+	Server string
+
+	cfg      types.CircuitBreaker
+	bucketNS int64
+
+	mu      sync.Mutex
+	state   State
+	buckets [buckets]bucket
+	// openedAt is a time of the last ejection
+	openedAt time.Time
+	reason   string
+	// generation is changed on every change of the state, so results of requests, admitted in the previous state,
+	// are ignored
+	generation uint64
+	// probes is a count of running trial requests, successes is a count of successful ones
+	probes    int
+	successes int
+	ejections uint64
+
+	now func() time.Time
+}
+
+// New creates closed circuit breaker for the server
+func New(group, server string, cfg types.CircuitBreaker) *Breaker {
+	cfg = cfg.WithDefaults()
+	return &Breaker{
+		Group:    group,
+		Server:   server,
+		cfg:      cfg,
+		bucketNS: int64(cfg.Window) / buckets,
+		now:      time.Now,
+	}
+}
+
+// Ticket is given to the allowed request, it tells whether the request is a trial one and in which state of the
+// breaker it was admitted
+type Ticket struct {
+	generation uint64
+	probe      bool
+}
+
+// Allow returns true, if request can be sent to the server. Every allowed request must be followed by Done or Release
+// with the returned ticket.
+func (b *Breaker) Allow() (Ticket, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.allow(true) {
+		return Ticket{}, false
+	}
+	return Ticket{generation: b.generation, probe: b.state == HalfOpen}, true
+}
+
+// Ejected returns true, if request would not be allowed now
+func (b *Breaker) Ejected() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.allow(false)
+}
+
+func (b *Breaker) allow(take bool) bool {
+	if b.state == Open {
+		if b.now().Sub(b.openedAt) < b.cfg.EjectTime {
+			return false
+		}
+		if !take {
+			return true
+		}
+		b.setState(HalfOpen)
+		b.probes, b.successes = 0, 0
+	}
+	if b.state == HalfOpen {
+		if b.probes >= b.cfg.HalfOpenRequests-b.successes {
+			return false
+		}
+		if take {
+			b.probes++
+		}
+	}
+	return true
+}
+
+// Done records result of the allowed request. Result of the request, admitted before the last change of the state,
+// is ignored, e.g. request, sent before the server was ejected, doesn't affect trial requests.
+func (b *Breaker) Done(t Ticket, failed bool, d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t.generation != b.generation {
+		return
+	}
+
+	switch b.state {
+	case HalfOpen:
+		b.probes--
+		if failed {
+			b.open(fmt.Sprintf("trial request failed in %v", d))
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenRequests {
+			b.setState(Closed)
+			b.buckets = [buckets]bucket{}
+		}
+	case Closed:
+		bk := b.bucket()
+		bk.requests++
+		bk.timeNS += int64(d)
+		if failed {
+			bk.errors++
+		}
+		requests, errors, timeNS := b.totals()
+		if requests < uint64(b.cfg.MinRequests) {
+			return
+		}
+		if rate := float64(errors) / float64(requests); rate >= b.cfg.ErrorRate {
+			b.open(fmt.Sprintf("error rate %.2f of %d requests", rate, requests))
+		} else if avg := time.Duration(timeNS / int64(requests)); b.cfg.Latency > 0 && avg >= b.cfg.Latency {
+			b.open(fmt.Sprintf("average latency %v of %d requests", avg, requests))
+		}
+	}
+}
+
+// Release returns the slot of allowed request, that has no result (e.g. it was cancelled by the client)
+func (b *Breaker) Release(t Ticket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t.probe && t.generation == b.generation {
+		b.probes--
+	}
+}
+
+// setState changes state and generation of the breaker, must be called with lock held
+func (b *Breaker) setState(state State) {
+	b.state = state
+	b.generation++
+}
+
+// open ejects the server, must be called with lock held
+func (b *Breaker) open(reason string) {
+	b.setState(Open)
+	b.openedAt = b.now()
+	b.reason = reason
+	b.ejections++
+}
+
+// bucket returns bucket for current time, must be called with lock held
+func (b *Breaker) bucket() *bucket {
+	start := b.now().UnixNano() / b.bucketNS * b.bucketNS
+	bk := &b.buckets[(start/b.bucketNS)%buckets]
+	if bk.start != start {
+		*bk = bucket{start: start}
+	}
+	return bk
+}
+
+// totals returns counters of the window, must be called with lock held
+func (b *Breaker) totals() (requests, errors uint64, timeNS int64) {
+	oldest := b.now().UnixNano() - int64(b.cfg.Window)
+	for i := range b.buckets {
+		if bk := &b.buckets[i]; bk.start > oldest-b.bucketNS {
+			requests += bk.requests
+			errors += bk.errors
+			timeNS += bk.timeNS
+		}
+	}
+	return requests, errors, timeNS
+}
+
+// Status is a state of the breaker, reported by admin API
+type Status struct {
+	Group     string     `json:"group"`
+	Server    string     `json:"server"`
+	State     string     `json:"state"`
+	Requests  uint64     `json:"requests"`
+	Errors    uint64     `json:"errors"`
+	Latency   float64    `json:"avgLatencySeconds"`
+	Ejections uint64     `json:"ejections"`
+	EjectedAt *time.Time `json:"ejectedAt,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+}
+
+// Status returns current state and counters of the window
+func (b *Breaker) Status() Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	requests, errors, timeNS := b.totals()
+	s := Status{
+		Group:     b.Group,
+		Server:    b.Server,
+		State:     b.state.String(),
+		Requests:  requests,
+		Errors:    errors,
+		Ejections: b.ejections,
+	}
+	if requests > 0 {
+		s.Latency = time.Duration(timeNS / int64(requests)).Seconds()
+	}
+	if b.state != Closed {
+		openedAt := b.openedAt
+		s.EjectedAt = &openedAt
+		s.Reason = b.reason
+	}
+	return s
+}
+
+// State returns current state of the breaker
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Ejections returns count of times the server was ejected
+func (b *Breaker) Ejections() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ejections
+}
+
+type breakerKey struct {
+	group  string
+	server string
+}
+
+var breakers sync.Map
+
+// Register makes breaker visible in admin API and metrics, replacing breaker of the same server (e.g. after config reload)
+func Register(b *Breaker) {
+	breakers.Store(breakerKey{group: b.Group, server: b.Server}, b)
+}
+
+// Each calls f for every registered breaker, sorted by group and server name
+func Each(f func(b *Breaker)) {
+	var list []*Breaker
+	breakers.Range(func(_, v interface{}) bool {
+		list = append(list, v.(*Breaker))
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Group == list[j].Group {
+			return list[i].Server < list[j].Server
+		}
+		return list[i].Group < list[j].Group
+	})
+	for _, b := range list {
+		f(b)
+	}
+}
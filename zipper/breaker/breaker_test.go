@@ -0,0 +1,171 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+func newTestBreaker(cfg types.CircuitBreaker) (*Breaker, *time.Time) {
+	now := time.Unix(1700000000, 0)
+	b := New("group", "server", cfg)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func mustAllow(t *testing.T, b *Breaker) Ticket {
+	t.Helper()
+	ticket, ok := b.Allow()
+	if !ok {
+		t.Fatalf("request is not allowed: %v", b.State())
+	}
+	return ticket
+}
+
+func allowed(b *Breaker) bool {
+	_, ok := b.Allow()
+	return ok
+}
+
+func TestBreakerErrorRate(t *testing.T) {
+	b, now := newTestBreaker(types.CircuitBreaker{
+		MinRequests:      10,
+		ErrorRate:        0.5,
+		EjectTime:        10 * time.Second,
+		HalfOpenRequests: 2,
+	})
+
+	for i := 0; i < 9; i++ {
+		b.Done(mustAllow(t, b), true, time.Millisecond)
+	}
+	if b.State() != Closed {
+		t.Fatalf("breaker is opened before MinRequests: %v", b.State())
+	}
+	b.Done(mustAllow(t, b), false, time.Millisecond)
+	if b.State() != Open || !b.Ejected() || allowed(b) {
+		t.Fatalf("breaker is not opened: %v", b.State())
+	}
+	if s := b.Status(); s.Reason == "" || s.EjectedAt == nil || s.Ejections != 1 {
+		t.Fatalf("unexpected status of ejected server: %+v", s)
+	}
+
+	// trial requests after eject time, a single failure ejects server again
+	*now = now.Add(10 * time.Second)
+	if b.Ejected() {
+		t.Fatal("server is ejected after eject time")
+	}
+	probe := mustAllow(t, b)
+	if b.State() != HalfOpen {
+		t.Fatalf("breaker is not half-open: %v", b.State())
+	}
+	b.Done(probe, true, time.Millisecond)
+	if b.State() != Open || b.Ejections() != 2 {
+		t.Fatalf("breaker is not opened after failed trial: %v", b.State())
+	}
+
+	// only HalfOpenRequests trials run at once
+	*now = now.Add(10 * time.Second)
+	probe1, probe2 := mustAllow(t, b), mustAllow(t, b)
+	if allowed(b) || !b.Ejected() {
+		t.Fatal("more trial requests than HalfOpenRequests are allowed")
+	}
+	b.Done(probe1, false, time.Millisecond)
+	if b.State() != HalfOpen {
+		t.Fatalf("breaker is closed before enough trials: %v", b.State())
+	}
+	b.Done(probe2, false, time.Millisecond)
+	if b.State() != Closed || b.Ejected() {
+		t.Fatalf("breaker is not closed after successful trials: %v", b.State())
+	}
+	if s := b.Status(); s.Requests != 0 {
+		t.Fatalf("window is not reset after readmission: %+v", s)
+	}
+}
+
+func TestBreakerLatency(t *testing.T) {
+	b, now := newTestBreaker(types.CircuitBreaker{
+		Window:      10 * time.Second,
+		MinRequests: 5,
+		Latency:     time.Second,
+	})
+
+	for i := 0; i < 5; i++ {
+		b.Done(mustAllow(t, b), false, 500*time.Millisecond)
+	}
+	// old requests leave the window
+	*now = now.Add(time.Minute)
+	for i := 0; i < 4; i++ {
+		b.Done(mustAllow(t, b), false, 2*time.Second)
+	}
+	if b.State() != Closed {
+		t.Fatalf("breaker is opened before MinRequests in the window: %v", b.State())
+	}
+	b.Done(mustAllow(t, b), false, 2*time.Second)
+	if b.State() != Open {
+		t.Fatalf("slow server is not ejected: %v", b.State())
+	}
+}
+
+func TestBreakerRelease(t *testing.T) {
+	b, now := newTestBreaker(types.CircuitBreaker{MinRequests: 1, HalfOpenRequests: 1, EjectTime: time.Second})
+
+	b.Done(mustAllow(t, b), true, time.Millisecond)
+	*now = now.Add(time.Second)
+	probe := mustAllow(t, b)
+	if allowed(b) {
+		t.Fatal("unexpected count of trial requests")
+	}
+	b.Release(probe)
+	if !allowed(b) {
+		t.Fatal("released trial slot is not reused")
+	}
+}
+
+func TestBreakerStaleRequests(t *testing.T) {
+	b, now := newTestBreaker(types.CircuitBreaker{MinRequests: 1, HalfOpenRequests: 2, EjectTime: time.Second})
+
+	// requests, admitted by closed breaker, finish after the server is ejected and trials have started
+	stale1, stale2, stale3 := mustAllow(t, b), mustAllow(t, b), mustAllow(t, b)
+	b.Done(mustAllow(t, b), true, time.Millisecond)
+	*now = now.Add(time.Second)
+	probe := mustAllow(t, b)
+
+	b.Done(stale1, false, time.Millisecond)
+	b.Done(stale2, true, time.Millisecond)
+	b.Release(stale3)
+	if b.State() != HalfOpen {
+		t.Fatalf("stale request changed the state: %v", b.State())
+	}
+	// only one more trial is allowed, stale results didn't free or fill slots
+	mustAllow(t, b)
+	if allowed(b) {
+		t.Fatal("stale request freed a trial slot")
+	}
+	b.Done(probe, false, time.Millisecond)
+	if b.State() != HalfOpen {
+		t.Fatalf("stale success is counted as a trial: %v", b.State())
+	}
+}
+
+func TestBreakerStaleTrial(t *testing.T) {
+	b, now := newTestBreaker(types.CircuitBreaker{MinRequests: 1, HalfOpenRequests: 2, EjectTime: time.Second})
+
+	// trial, admitted before the server was ejected by another trial, doesn't affect the next trials
+	b.Done(mustAllow(t, b), true, time.Millisecond)
+	*now = now.Add(time.Second)
+	stale, failed := mustAllow(t, b), mustAllow(t, b)
+	b.Done(failed, true, time.Millisecond)
+	*now = now.Add(time.Second)
+	probe := mustAllow(t, b)
+	b.Done(stale, false, time.Millisecond)
+
+	mustAllow(t, b)
+	if allowed(b) {
+		t.Fatal("stale trial freed a trial slot")
+	}
+	b.Done(probe, false, time.Millisecond)
+	if b.State() != HalfOpen {
+		t.Fatalf("stale trial is counted as success: %v", b.State())
+	}
+}
@@ -0,0 +1,108 @@
+package breaker
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/ansel1/merry"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+
+	"github.com/go-graphite/carbonapi/zipper/helper"
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+// Server sends requests to the backend server only if its circuit breaker allows them. Ejected server fails at once.
+type Server struct {
+	types.BackendServer
+	Breaker *Breaker
+}
+
+// Wrap returns server with new registered circuit breaker
+func Wrap(group string, server types.BackendServer, cfg types.CircuitBreaker) *Server {
+	b := New(group, server.Name(), cfg)
+	Register(b)
+	return &Server{BackendServer: server, Breaker: b}
+}
+
+// Ejected returns true, if requests are not sent to the server now
+func (s *Server) Ejected() bool {
+	return s.Breaker.Ejected()
+}
+
+// EjectedError returns error, reported instead of the response of ejected server
+func (s *Server) EjectedError() merry.Error {
+	return types.ErrServerEjected.WithValue("server", s.Name()).WithMessagef("server %s is ejected by circuit breaker", s.Name())
+}
+
+// done records result of the request, requests cancelled by the client are not counted
+func (s *Server) done(ctx context.Context, t Ticket, start time.Time, err merry.Error) {
+	if err != nil && ctx.Err() == context.Canceled {
+		s.Breaker.Release(t)
+		return
+	}
+	s.Breaker.Done(t, err != nil && helper.HttpErrorCode(err) >= http.StatusInternalServerError, time.Since(start))
+}
+
+func (s *Server) Fetch(ctx context.Context, request *protov3.MultiFetchRequest) (*protov3.MultiFetchResponse, *types.Stats, merry.Error) {
+	t, ok := s.Breaker.Allow()
+	if !ok {
+		return nil, &types.Stats{EjectedRequests: 1, EjectedServers: []string{s.Name()}}, s.EjectedError()
+	}
+	start := time.Now()
+	res, stats, err := s.BackendServer.Fetch(ctx, request)
+	s.done(ctx, t, start, err)
+	return res, stats, err
+}
+
+func (s *Server) Find(ctx context.Context, request *protov3.MultiGlobRequest) (*protov3.MultiGlobResponse, *types.Stats, merry.Error) {
+	t, ok := s.Breaker.Allow()
+	if !ok {
+		return nil, &types.Stats{EjectedRequests: 1, EjectedServers: []string{s.Name()}}, s.EjectedError()
+	}
+	start := time.Now()
+	res, stats, err := s.BackendServer.Find(ctx, request)
+	s.done(ctx, t, start, err)
+	return res, stats, err
+}
+
+func (s *Server) Info(ctx context.Context, request *protov3.MultiMetricsInfoRequest) (*protov3.ZipperInfoResponse, *types.Stats, merry.Error) {
+	t, ok := s.Breaker.Allow()
+	if !ok {
+		return nil, &types.Stats{EjectedRequests: 1, EjectedServers: []string{s.Name()}}, s.EjectedError()
+	}
+	start := time.Now()
+	res, stats, err := s.BackendServer.Info(ctx, request)
+	s.done(ctx, t, start, err)
+	return res, stats, err
+}
+
+func (s *Server) TagNames(ctx context.Context, query string, limit int64) ([]string, merry.Error) {
+	t, ok := s.Breaker.Allow()
+	if !ok {
+		return nil, s.EjectedError()
+	}
+	start := time.Now()
+	res, err := s.BackendServer.TagNames(ctx, query, limit)
+	s.done(ctx, t, start, err)
+	return res, err
+}
+
+func (s *Server) TagValues(ctx context.Context, query string, limit int64) ([]string, merry.Error) {
+	t, ok := s.Breaker.Allow()
+	if !ok {
+		return nil, s.EjectedError()
+	}
+	start := time.Now()
+	res, err := s.BackendServer.TagValues(ctx, query, limit)
+	s.done(ctx, t, start, err)
+	return res, err
+}
+
+// ProbeTLDs is not sent to ejected server, its TLDs are probed again after it's readmitted
+func (s *Server) ProbeTLDs(ctx context.Context) ([]string, merry.Error) {
+	if s.Breaker.Ejected() {
+		return nil, s.EjectedError()
+	}
+	return s.BackendServer.ProbeTLDs(ctx)
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"sort"
 	"strings"
+	"sync/atomic"
 
 	"github.com/ansel1/merry"
 	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
@@ -14,6 +16,7 @@ import (
 	"github.com/go-graphite/carbonapi/limiter"
 	"github.com/go-graphite/carbonapi/pathcache"
 	utilctx "github.com/go-graphite/carbonapi/util/ctx"
+	"github.com/go-graphite/carbonapi/zipper/breaker"
 	"github.com/go-graphite/carbonapi/zipper/helper"
 	"github.com/go-graphite/carbonapi/zipper/types"
 
@@ -36,6 +39,9 @@ type BroadcastGroup struct {
 	pathCache pathcache.PathCache
 	logger    *zap.Logger
 	dialer    *net.Dialer
+
+	// consistentHash is set for carbon-c-relay clusters, metrics without globs are fetched only from their owners
+	consistentHash *ConsistentHash
 }
 
 type Option func(group *BroadcastGroup)
@@ -119,6 +125,12 @@ func WithSuccess(requireSuccessAll bool) Option {
 	}
 }
 
+func WithConsistentHash(consistentHash *ConsistentHash) Option {
+	return func(bg *BroadcastGroup) {
+		bg.consistentHash = consistentHash
+	}
+}
+
 func New(opts ...Option) (*BroadcastGroup, merry.Error) {
 	bg := &BroadcastGroup{
 		limiter: limiter.NoopLimiter{},
@@ -138,14 +150,35 @@ func New(opts ...Option) (*BroadcastGroup, merry.Error) {
 	if len(bg.backends) == 0 {
 		return nil, types.ErrNoServersSpecified
 	}
+	if err := bg.checkConsistentHash(); err != nil {
+		return nil, err
+	}
 
 	if bg.concurrencyLimit != 0 {
 		bg.limiter = limiter.NewServerLimiter(bg.servers, bg.concurrencyLimit)
 	}
 
+	pathcache.Register(bg.groupName, bg.pathCache)
+
 	return bg, nil
 }
 
+// Close stops cleanup of path caches of the group and groups inside it and removes them from the registry. Group still
+// can serve requests after Close.
+func (bg *BroadcastGroup) Close() {
+	bg.pathCache.Close()
+	pathcache.Deregister(bg.groupName, bg.pathCache)
+	for _, backend := range bg.backends {
+		// groups can be wrapped, e.g. by fetch cache
+		if w, ok := backend.(interface{ Unwrap() types.BackendServer }); ok {
+			backend = w.Unwrap()
+		}
+		if g, ok := backend.(*BroadcastGroup); ok {
+			g.Close()
+		}
+	}
+}
+
 func (bg *BroadcastGroup) Children() []types.BackendServer {
 	return bg.backends
 }
@@ -159,6 +192,51 @@ func (bg *BroadcastGroup) SetDoMultipleRequestIfSplit(v bool) {
 	}
 }
 
+// SetConsistentHash makes group fetch metrics only from servers, that own them in carbon-c-relay cluster
+func (bg *BroadcastGroup) SetConsistentHash(consistentHash *ConsistentHash) merry.Error {
+	bg.consistentHash = consistentHash
+	return bg.checkConsistentHash()
+}
+
+// SetCircuitBreaker wraps servers with circuit breakers, failing servers are ejected and get no requests for a while
+func (bg *BroadcastGroup) SetCircuitBreaker(cfg types.CircuitBreaker) {
+	backends := make([]types.BackendServer, 0, len(bg.backends))
+	for _, backend := range bg.backends {
+		backends = append(backends, breaker.Wrap(bg.groupName, backend, cfg))
+	}
+	bg.backends = backends
+}
+
+// admitted returns backends, that are not ejected by circuit breakers. If group requires success of all servers
+// or all servers are ejected, error is returned at once instead of waiting for the rest of servers.
+func (bg *BroadcastGroup) admitted(backends []types.BackendServer, stats *types.Stats) ([]types.BackendServer, merry.Error) {
+	res := make([]types.BackendServer, 0, len(backends))
+	var errors []string
+	for _, backend := range backends {
+		s, ok := backend.(*breaker.Server)
+		if !ok || !s.Ejected() {
+			res = append(res, backend)
+			continue
+		}
+		errors = append(errors, s.EjectedError().Error())
+		if stats != nil {
+			stats.EjectedRequests++
+			stats.EjectedServers = append(stats.EjectedServers, s.Name())
+		}
+	}
+	if len(errors) > 0 && (bg.requireSuccessAll || len(res) == 0) {
+		return nil, types.ErrFailedToFetch.WithHTTPCode(http.StatusServiceUnavailable).WithMessage(strings.Join(errors, "\n"))
+	}
+	return res, nil
+}
+
+func (bg *BroadcastGroup) checkConsistentHash() merry.Error {
+	if bg.consistentHash != nil && len(bg.consistentHash.nodes) != len(bg.backends) {
+		return merry.Errorf("count of consistent hash nodes %d doesn't match count of backends %d", len(bg.consistentHash.nodes), len(bg.backends))
+	}
+	return nil
+}
+
 func NewBroadcastGroup(logger *zap.Logger, groupName string, doMultipleRequestsIfSplit bool, servers []types.BackendServer, expireDelaySec int32, concurrencyLimit, maxBatchSize int, timeouts types.Timeouts, tldCacheDisabled bool, requireSuccessAll bool) (*BroadcastGroup, merry.Error) {
 	return New(
 		WithLogger(logger),
@@ -219,6 +297,74 @@ func (bg *BroadcastGroup) filterServersByTLD(requests []string, backends []types
 	return filteredBackends
 }
 
+// isGlob returns true for requests, that can match metrics on any server
+func isGlob(request string) bool {
+	return strings.HasPrefix(request, "seriesByTag") || strings.ContainsAny(request, "*?[{")
+}
+
+// shardRequests returns backends and indexes of requests, that should be sent to each of them.
+// Metrics without globs are sent only to servers, that own them, globs are sent to all servers (or by TLD cache).
+func (bg *BroadcastGroup) shardRequests(requests []string) ([]types.BackendServer, [][]int) {
+	children := bg.Children()
+	childIdx := make(map[types.BackendServer]int, len(children))
+	for i, child := range children {
+		childIdx[child] = i
+	}
+
+	shards := make([][]int, len(children))
+	for i, request := range requests {
+		if isGlob(request) {
+			for _, backend := range bg.filterServersByTLD([]string{request}, children) {
+				shards[childIdx[backend]] = append(shards[childIdx[backend]], i)
+			}
+			continue
+		}
+		for _, node := range bg.consistentHash.Get(request) {
+			shards[node] = append(shards[node], i)
+		}
+	}
+
+	backends := make([]types.BackendServer, 0, len(children))
+	backendShards := make([][]int, 0, len(children))
+	for i, shard := range shards {
+		if len(shard) > 0 {
+			backends = append(backends, children[i])
+			backendShards = append(backendShards, shard)
+		}
+	}
+	return backends, backendShards
+}
+
+// Route returns children, that will receive fetch request for the metrics, without sending it
+func (bg *BroadcastGroup) Route(requests []string) types.Route {
+	var backends []types.BackendServer
+	var shards [][]int
+	if bg.consistentHash != nil {
+		backends, shards = bg.shardRequests(requests)
+	} else {
+		backends = bg.filterServersByTLD(requests, bg.Children())
+	}
+	route := types.Route{
+		Group:    bg.groupName,
+		Servers:  make([]string, 0, len(backends)),
+		Cached:   shards == nil && len(backends) < len(bg.Children()),
+		Children: make([]types.Route, 0, len(backends)),
+	}
+	for i, backend := range backends {
+		backendRequests := requests
+		if shards != nil {
+			backendRequests = make([]string, 0, len(shards[i]))
+			for _, idx := range shards[i] {
+				backendRequests = append(backendRequests, requests[idx])
+			}
+		}
+		child := types.RouteOf(backend, backendRequests)
+		route.Servers = append(route.Servers, child.Servers...)
+		route.Children = append(route.Children, child)
+	}
+	return route
+}
+
 func (bg BroadcastGroup) MaxMetricsPerRequest() int {
 	return bg.maxMetricsPerRequest
 }
@@ -262,11 +408,21 @@ func (bg *BroadcastGroup) doMultiFetch(ctx context.Context, logger *zap.Logger,
 			logger.Debug("got slot")
 			defer bg.limiter.Leave(ctx, backend.Name())
 
+			if err := utilctx.GetQueryCost(ctx).Err(); err != nil {
+				resCh <- response.NonFatalError(err)
+				return
+			}
+
 			// uuid := util.GetUUID(ctx)
 			var err merry.Error
 			logger.Debug("sending request")
-			response.Response, response.Stats, err = backend.Fetch(ctx, req)
+			fetchCtx, charged := utilctx.WithFetchCharge(ctx)
+			response.Response, response.Stats, err = backend.Fetch(fetchCtx, req)
 			response.AddError(err)
+			if err := chargeFetched(ctx, charged, response.Response); err != nil {
+				response.Response = nil
+				response.AddError(err)
+			}
 			if response.Response != nil && response.Stats != nil {
 				logger.Debug("got response",
 					zap.Int("metrics_in_response", len(response.Response.Metrics)),
@@ -337,10 +493,19 @@ func (bg *BroadcastGroup) doSingleFetch(ctx context.Context, logger *zap.Logger,
 	// uuid := util.GetUUID(ctx)
 	var err merry.Error
 	for _, req := range requests {
+		if err := utilctx.GetQueryCost(ctx).Err(); err != nil {
+			response.AddError(err)
+			break
+		}
 		logger.Debug("sending request")
 		r := types.NewServerFetchResponse()
-		r.Response, r.Stats, err = backend.Fetch(ctx, req)
+		fetchCtx, charged := utilctx.WithFetchCharge(ctx)
+		r.Response, r.Stats, err = backend.Fetch(fetchCtx, req)
 		r.AddError(err)
+		if err := chargeFetched(ctx, charged, r.Response); err != nil {
+			r.Response = nil
+			r.AddError(err)
+		}
 		if r.Stats != nil && r.Response != nil {
 			logger.Debug("got response",
 				zap.Int("metrics_in_response", len(r.Response.Metrics)),
@@ -379,8 +544,37 @@ func (bg *BroadcastGroup) doSingleFetch(ctx context.Context, logger *zap.Logger,
 	resCh <- response
 }
 
+// chargeFetched charges query cost for the fetched response, unless it was already charged by a nested group.
+// Parent groups are notified, that the response is charged. Series, that are returned by several backends
+// (e.g. replicas), are charged once.
+func chargeFetched(ctx context.Context, charged *atomic.Bool, response *protov3.MultiFetchResponse) merry.Error {
+	queryCost := utilctx.GetQueryCost(ctx)
+	if queryCost == nil {
+		return nil
+	}
+	utilctx.MarkFetchCharged(ctx)
+	if charged.Load() || response == nil {
+		return queryCost.Err()
+	}
+	return queryCost.AddFetched(limiter.FetchedSeriesOf(response.Metrics))
+}
+
+// foundLeafs returns paths of metrics in find response
+func foundLeafs(f *protov3.MultiGlobResponse) []string {
+	var leafs []string
+	for _, m := range f.Metrics {
+		for _, match := range m.Matches {
+			if match.IsLeaf {
+				leafs = append(leafs, match.Path)
+			}
+		}
+	}
+	return leafs
+}
+
 func (bg *BroadcastGroup) splitRequest(ctx context.Context, request *protov3.MultiFetchRequest, backend types.BackendServer) ([]*protov3.MultiFetchRequest, merry.Error) {
 	if backend.MaxMetricsPerRequest() == 0 {
+		// globs are expanded by the backend, metrics found for them are charged with fetched series
 		return []*protov3.MultiFetchRequest{request}, nil
 	}
 
@@ -458,6 +652,15 @@ func (bg *BroadcastGroup) splitRequest(ctx context.Context, request *protov3.Mul
 			}
 		}
 
+		// stop before fetching, if glob expanded to too many metrics on all backends
+		glob := metric.PathExpression
+		if glob == "" {
+			glob = metric.Name
+		}
+		if e := utilctx.GetQueryCost(ctx).AddFindMetrics(glob, foundLeafs(f)); e != nil {
+			return nil, e
+		}
+
 		for _, m := range f.Metrics {
 			for _, match := range m.Matches {
 				if !match.IsLeaf {
@@ -494,14 +697,49 @@ func (bg *BroadcastGroup) Fetch(ctx context.Context, request *protov3.MultiFetch
 	logger := bg.logger.With(zap.String("type", "fetch"), zap.Strings("request", requestNames), zap.String("carbonapi_uuid", utilctx.GetUUID(ctx)))
 	logger.Debug("will try to fetch data")
 
-	backends := bg.filterServersByTLD(requestNames, bg.Children())
+	var backends []types.BackendServer
+	fetcher := bg.fetcher
+	if bg.consistentHash != nil {
+		var shards [][]int
+		backends, shards = bg.shardRequests(requestNames)
+		requests := make(map[string]*protov3.MultiFetchRequest, len(backends))
+		for i, backend := range backends {
+			r := &protov3.MultiFetchRequest{Metrics: make([]protov3.FetchRequest, 0, len(shards[i]))}
+			for _, idx := range shards[i] {
+				r.Metrics = append(r.Metrics, request.Metrics[idx])
+			}
+			requests[backend.Name()] = r
+		}
+		fetcher = func(ctx context.Context, logger *zap.Logger, backend types.BackendServer, _ interface{}, resCh chan types.ServerFetcherResponse) {
+			bg.fetcher(ctx, logger, backend, requests[backend.Name()], resCh)
+		}
+	} else {
+		backends = bg.filterServersByTLD(requestNames, bg.Children())
+	}
 
 	result := types.NewServerFetchResponse()
+	backends, ejectedErr := bg.admitted(backends, result.Stats)
+	if ejectedErr != nil {
+		logger.Debug("servers are ejected", zap.Strings("ejected_servers", result.Stats.EjectedServers))
+		return nil, result.Stats, ejectedErr
+	}
 
 	ctxNew, cancel := context.WithTimeout(ctx, bg.timeout.Render)
 	defer cancel()
 
-	resultNew, responseCount := types.DoRequest(ctxNew, logger, backends, result, request, bg.fetcher)
+	// requests in flight are canceled as soon as query cost limit is exceeded
+	queryCost := utilctx.GetQueryCost(ctx)
+	if done := queryCost.Done(); done != nil {
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-ctxNew.Done():
+			}
+		}()
+	}
+
+	resultNew, responseCount := types.DoRequest(ctxNew, logger, backends, result, request, fetcher)
 
 	result, ok := resultNew.Self().(*types.ServerFetchResponse)
 	if !ok {
@@ -512,6 +750,13 @@ func (bg *BroadcastGroup) Fetch(ctx context.Context, request *protov3.MultiFetch
 		)
 	}
 
+	if err := queryCost.Err(); err != nil {
+		logger.Debug("query cost limit exceeded",
+			zap.Error(err),
+		)
+		return nil, result.Stats, err
+	}
+
 	if len(result.Response.Metrics) == 0 || (bg.requireSuccessAll && len(result.Err) > 0) {
 		code, errors := helper.MergeHttpErrors(result.Err)
 		if len(errors) > 0 {
@@ -603,7 +848,12 @@ func (bg *BroadcastGroup) doFind(ctx context.Context, logger *zap.Logger, backen
 func (bg *BroadcastGroup) Find(ctx context.Context, request *protov3.MultiGlobRequest) (*protov3.MultiGlobResponse, *types.Stats, merry.Error) {
 	logger := bg.logger.With(zap.String("type", "find"), zap.Strings("request", request.Metrics))
 
-	backends := bg.Children()
+	result := types.NewServerFindResponse()
+	result.Server = bg.Name()
+	backends, ejectedErr := bg.admitted(bg.Children(), result.Stats)
+	if ejectedErr != nil {
+		return nil, result.Stats, ejectedErr
+	}
 
 	logger.Debug("will do query with timeout",
 		zap.Any("backends", backends),
@@ -613,8 +863,6 @@ func (bg *BroadcastGroup) Find(ctx context.Context, request *protov3.MultiGlobRe
 	ctxNew, cancel := context.WithTimeout(ctx, bg.timeout.Find)
 	defer cancel()
 
-	result := types.NewServerFindResponse()
-	result.Server = bg.Name()
 	result.Stats.ZipperRequests = uint64(len(backends))
 	resultNew, responseCount := types.DoRequest(ctxNew, logger, backends, result, request, bg.doFind)
 
@@ -704,9 +952,12 @@ func (bg *BroadcastGroup) Info(ctx context.Context, request *protov3.MultiMetric
 
 	ctxNew, cancel := context.WithTimeout(ctx, bg.timeout.Render)
 	defer cancel()
-	backends := bg.Children()
 	result := types.NewServerInfoResponse()
 	result.Server = bg.Name()
+	backends, ejectedErr := bg.admitted(bg.Children(), result.Stats)
+	if ejectedErr != nil {
+		return nil, result.Stats, ejectedErr
+	}
 	result.Stats.ZipperRequests = uint64(len(backends))
 
 	resultNew, responseCount := types.DoRequest(ctxNew, logger, backends, result, request, bg.doInfoRequest)
@@ -818,7 +1069,10 @@ func (bg *BroadcastGroup) tagEverything(ctx context.Context, isTagName bool, que
 	ctxNew, cancel := context.WithTimeout(ctx, bg.timeout.Find)
 	defer cancel()
 
-	backends := bg.Children()
+	backends, ejectedErr := bg.admitted(bg.Children(), nil)
+	if ejectedErr != nil {
+		return nil, ejectedErr
+	}
 	result := types.NewServerTagResponse()
 	result.Server = bg.Name()
 
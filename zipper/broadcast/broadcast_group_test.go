@@ -11,6 +11,10 @@ import (
 
 	"github.com/ansel1/merry"
 
+	"github.com/go-graphite/carbonapi/limiter"
+	"github.com/go-graphite/carbonapi/pathcache"
+	utilctx "github.com/go-graphite/carbonapi/util/ctx"
+	"github.com/go-graphite/carbonapi/zipper/breaker"
 	"github.com/go-graphite/carbonapi/zipper/dummy"
 	"github.com/go-graphite/carbonapi/zipper/types"
 
@@ -1170,3 +1174,310 @@ func TestFetchRequests(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitRequestQueryCost(t *testing.T) {
+	client := dummy.NewDummyClient("client1", []string{"backend1"}, 10)
+	client.AddFindResponse(&protov3.MultiGlobRequest{Metrics: []string{"foo.*"}}, &protov3.MultiGlobResponse{
+		Metrics: []protov3.GlobResponse{{
+			Name: "foo.*",
+			Matches: []protov3.GlobMatch{
+				{Path: "foo.a", IsLeaf: true},
+				{Path: "foo.b", IsLeaf: true},
+				{Path: "foo.c", IsLeaf: false},
+			},
+		}},
+	}, nil, nil)
+
+	b, err := NewBroadcastGroup(logger, "test", true, []types.BackendServer{client}, 60, 500, 100, timeouts, false, false)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	request := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{{Name: "foo.*", PathExpression: "foo.*", StartTime: 0, StopTime: 120}},
+	}
+
+	ctx := utilctx.SetQueryCost(context.Background(), limiter.NewQueryCost(limiter.CostLimits{MaxFindMetrics: 2}))
+	requests, err := b.splitRequest(ctx, request, client)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(requests) != 1 || len(requests[0].Metrics) != 2 {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+
+	ctx = utilctx.SetQueryCost(context.Background(), limiter.NewQueryCost(limiter.CostLimits{MaxFindMetrics: 1}))
+	requests, err = b.splitRequest(ctx, request, client)
+	if !merry.Is(err, limiter.ErrQueryCostExceeded) {
+		t.Fatalf("unexpected error %v, expected %v", err, limiter.ErrQueryCostExceeded)
+	}
+	if len(requests) != 0 {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	client1 := dummy.NewDummyClient("client1", []string{"backend1", "backend2"}, 1)
+	client1.SetTLDResponse(dummy.ProbeResponse{Response: []string{"a", "b"}})
+	client2 := dummy.NewDummyClient("client2", []string{"backend3"}, 1)
+	client2.SetTLDResponse(dummy.ProbeResponse{Response: []string{"a", "c"}})
+
+	b, err := NewBroadcastGroup(logger, "test", true, []types.BackendServer{client1, client2}, 60, 500, 100, timeouts, false, false)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := b.ProbeTLDs(context.Background()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tests := []struct {
+		requests []string
+		cached   bool
+		children []string
+		servers  []string
+	}{
+		{[]string{"b.foo"}, true, []string{"client1"}, []string{"backend1", "backend2"}},
+		{[]string{"b.foo", "c.bar"}, false, []string{"client1", "client2"}, []string{"backend1", "backend2", "backend3"}},
+		{[]string{"a.foo"}, false, []string{"client1", "client2"}, []string{"backend1", "backend2", "backend3"}},
+		// unknown tld is broadcasted
+		{[]string{"d.foo"}, false, []string{"client1", "client2"}, []string{"backend1", "backend2", "backend3"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.requests), func(t *testing.T) {
+			route := b.Route(tt.requests)
+			if route.Group != "test" || route.Cached != tt.cached {
+				t.Errorf("unexpected route %+v", route)
+			}
+			var children []string
+			for _, child := range route.Children {
+				children = append(children, child.Group)
+			}
+			if !reflect.DeepEqual(children, tt.children) {
+				t.Errorf("got children %v, expected %v", children, tt.children)
+			}
+			if !reflect.DeepEqual(route.Servers, tt.servers) {
+				t.Errorf("got servers %v, expected %v", route.Servers, tt.servers)
+			}
+		})
+	}
+}
+
+func TestFetchQueryCostGlobsAsIs(t *testing.T) {
+	// globs are sent as is to backends without batch size, so they are not expanded with find requests
+	request := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{{Name: "foo.*", PathExpression: "foo.*", StopTime: 120}},
+	}
+	client := dummy.NewDummyClient("client1", []string{"backend1"}, 0)
+	client.AddFetchResponse(request, &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{
+			{Name: "foo.a", PathExpression: "foo.*", RequestStopTime: 120, StopTime: 120, StepTime: 60, Values: []float64{0, 1}},
+			{Name: "foo.b", PathExpression: "foo.*", RequestStopTime: 120, StopTime: 120, StepTime: 60, Values: []float64{0, 1}},
+		},
+	}, &types.Stats{}, nil)
+
+	b, err := NewBroadcastGroup(logger, "test", true, []types.BackendServer{client}, 60, 500, 0, timeouts, false, false)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	ctx := utilctx.SetQueryCost(context.Background(), limiter.NewQueryCost(limiter.CostLimits{MaxFindMetrics: 1}))
+	requests, err := b.splitRequest(ctx, request, client)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(requests) != 1 || !reflect.DeepEqual(requests[0], request) {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+
+	// metrics found for the glob are charged with fetched series
+	queryCost := limiter.NewQueryCost(limiter.CostLimits{MaxFindMetrics: 2})
+	if _, _, err := b.Fetch(utilctx.SetQueryCost(context.Background(), queryCost), request); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if cost := queryCost.Cost(); cost.FindMetrics != 2 {
+		t.Fatalf("unexpected cost %+v", cost)
+	}
+
+	_, _, err = b.Fetch(utilctx.SetQueryCost(context.Background(), limiter.NewQueryCost(limiter.CostLimits{MaxFindMetrics: 1})), request)
+	if !merry.Is(err, limiter.ErrQueryCostExceeded) {
+		t.Fatalf("unexpected error %v, expected %v", err, limiter.ErrQueryCostExceeded)
+	}
+}
+
+func TestFetchQueryCostReplicas(t *testing.T) {
+	request := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{{Name: "foo.*", PathExpression: "foo.*", StopTime: 120}},
+	}
+	findResponse := &protov3.MultiGlobResponse{
+		Metrics: []protov3.GlobResponse{{
+			Name: "foo.*",
+			Matches: []protov3.GlobMatch{
+				{Path: "foo.a", IsLeaf: true},
+				{Path: "foo.b", IsLeaf: true},
+			},
+		}},
+	}
+	expandedRequest := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "foo.a", PathExpression: "foo.*", StopTime: 120},
+			{Name: "foo.b", PathExpression: "foo.*", StopTime: 120},
+		},
+	}
+	fetchResponse := &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{
+			{Name: "foo.a", PathExpression: "foo.*", RequestStopTime: 120, StopTime: 120, StepTime: 60, Values: []float64{0, 1}},
+			{Name: "foo.b", PathExpression: "foo.*", RequestStopTime: 120, StopTime: 120, StepTime: 60, Values: []float64{0, 1}},
+		},
+	}
+
+	// both replicas return the same series
+	servers := []types.BackendServer{
+		dummy.NewDummyClient("client1", []string{"backend1"}, 100),
+		dummy.NewDummyClient("client2", []string{"backend2"}, 100),
+	}
+	for _, s := range servers {
+		s.(*dummy.DummyClient).AddFindResponse(&protov3.MultiGlobRequest{Metrics: []string{"foo.*"}}, findResponse, nil, nil)
+		s.(*dummy.DummyClient).AddFetchResponse(expandedRequest, fetchResponse, &types.Stats{}, nil)
+	}
+	b, err := NewBroadcastGroup(logger, "replicas", true, servers, 60, 500, 100, timeouts, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryCost := limiter.NewQueryCost(limiter.CostLimits{MaxFindMetrics: 2, MaxFetchedSeries: 3, MaxDatapoints: 4})
+	res, _, err := b.Fetch(utilctx.SetQueryCost(context.Background(), queryCost), request)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(res.Metrics) != 2 {
+		t.Fatalf("unexpected response %+v", res)
+	}
+	if cost := queryCost.Cost(); cost != (limiter.Cost{FindMetrics: 2, FetchedSeries: 2, Datapoints: 4}) {
+		t.Fatalf("series are charged more than once: %+v", cost)
+	}
+}
+
+func TestFetchQueryCost(t *testing.T) {
+	request := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{{Name: "foo", PathExpression: "foo", StopTime: 120}},
+	}
+	response := &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{
+			{Name: "foo.a", PathExpression: "foo", StopTime: 120, StepTime: 60, Values: []float64{0, 1}},
+			{Name: "foo.b", PathExpression: "foo", StopTime: 120, StepTime: 60, Values: []float64{0, 1}},
+		},
+	}
+	client := dummy.NewDummyClient("client1", []string{"backend1"}, 100)
+	client.AddFetchResponse(request, response, &types.Stats{}, nil)
+
+	// response is charged once by the nested group
+	inner, err := NewBroadcastGroup(logger, "inner", false, []types.BackendServer{client}, 60, 500, 100, timeouts, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBroadcastGroup(logger, "outer", false, []types.BackendServer{inner}, 60, 500, 100, timeouts, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryCost := limiter.NewQueryCost(limiter.CostLimits{MaxFetchedSeries: 2})
+	ctx, charged := utilctx.WithFetchCharge(utilctx.SetQueryCost(context.Background(), queryCost))
+	res, _, err := b.Fetch(ctx, request)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(res.Metrics) != 2 {
+		t.Fatalf("unexpected response %+v", res)
+	}
+	if cost := queryCost.Cost(); cost.FetchedSeries != 2 || cost.Datapoints != 4 || !charged.Load() {
+		t.Fatalf("unexpected cost %+v, charged %v", cost, charged.Load())
+	}
+
+	// exceeded limit stops the fetch
+	queryCost = limiter.NewQueryCost(limiter.CostLimits{MaxFetchedSeries: 1})
+	res, _, err = b.Fetch(utilctx.SetQueryCost(context.Background(), queryCost), request)
+	if !merry.Is(err, limiter.ErrQueryCostExceeded) {
+		t.Fatalf("unexpected error %v, expected %v", err, limiter.ErrQueryCostExceeded)
+	}
+	if res != nil {
+		t.Fatalf("unexpected response %+v", res)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	request := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{{Name: "foo", PathExpression: "foo", StopTime: 120}},
+	}
+	response := &protov3.MultiFetchResponse{
+		Metrics: []protov3.FetchResponse{{Name: "foo", PathExpression: "foo", StopTime: 120, StepTime: 60, Values: []float64{0, 1}}},
+	}
+
+	for _, requireSuccessAll := range []bool{false, true} {
+		t.Run(fmt.Sprintf("requireSuccessAll=%v", requireSuccessAll), func(t *testing.T) {
+			servers := []types.BackendServer{
+				dummy.NewDummyClient("client1", []string{"backend1"}, 0),
+				dummy.NewDummyClient("client2", []string{"backend2"}, 0),
+			}
+			servers[0].(*dummy.DummyClient).AddFetchResponse(request, response, &types.Stats{}, nil)
+			servers[1].(*dummy.DummyClient).AddFetchResponse(request, response, &types.Stats{}, nil)
+
+			b, err := NewBroadcastGroup(logger, "breaker", false, servers, 60, 500, 100, timeouts, true, requireSuccessAll)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.SetCircuitBreaker(types.CircuitBreaker{Enabled: true, MinRequests: 1})
+
+			// eject the second server
+			ejected := b.Children()[1].(*breaker.Server)
+			ticket, _ := ejected.Breaker.Allow()
+			ejected.Breaker.Done(ticket, true, time.Second)
+
+			res, stats, err := b.Fetch(context.Background(), request)
+			if !reflect.DeepEqual(stats.EjectedServers, []string{"client2"}) || stats.EjectedRequests != 1 {
+				t.Fatalf("unexpected stats of ejected servers: %v %v", stats.EjectedServers, stats.EjectedRequests)
+			}
+			if requireSuccessAll {
+				if err == nil || !merry.Is(err, types.ErrFailedToFetch) || merry.HTTPCode(err) != 503 {
+					t.Fatalf("expected error for ejected server, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Metrics) != 1 {
+				t.Fatalf("unexpected response: %+v", res)
+			}
+		})
+	}
+}
+
+func TestCloseDeregistersPathCaches(t *testing.T) {
+	logger := zapwriter.Logger("test")
+	timeouts := types.Timeouts{Find: time.Second, Render: time.Second, Connect: time.Second}
+	inner, err := NewBroadcastGroup(logger, "close_inner", false,
+		[]types.BackendServer{dummy.NewDummyClient("client1", []string{"backend1"}, 0)}, 60, 10, 100, timeouts, false, false)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	root, err := NewBroadcastGroup(logger, "close_root", false, []types.BackendServer{inner}, 60, 10, 100, timeouts, false, false)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	registered := func() []string {
+		var groups []string
+		pathcache.Each(func(group string, _ pathcache.PathCache) {
+			if group == "close_inner" || group == "close_root" {
+				groups = append(groups, group)
+			}
+		})
+		return groups
+	}
+	if groups := registered(); !reflect.DeepEqual(groups, []string{"close_inner", "close_root"}) {
+		t.Fatalf("path caches are not registered: %v", groups)
+	}
+	root.Close()
+	if groups := registered(); len(groups) != 0 {
+		t.Fatalf("path caches of closed groups are registered: %v", groups)
+	}
+}
@@ -0,0 +1,255 @@
+package broadcast
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+const (
+	// hashReplicas is a count of positions of every node on the ring, same as in carbon and carbon-c-relay
+	hashReplicas = 100
+	// defaultCarbonPort is used for nodes, specified without port
+	defaultCarbonPort = 2003
+)
+
+// HashNode is a destination of carbon-c-relay cluster
+type HashNode struct {
+	Host     string
+	Port     int
+	Instance string
+}
+
+// ParseHashNode parses node in carbon-c-relay format: host[:port][=instance]
+func ParseHashNode(s string) (HashNode, error) {
+	node := HashNode{Port: defaultCarbonPort}
+	if i := strings.LastIndexByte(s, '='); i != -1 {
+		s, node.Instance = s[:i], s[i+1:]
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		// no port
+		node.Host = strings.Trim(s, "[]")
+	} else {
+		node.Host = host
+		if node.Port, err = strconv.Atoi(port); err != nil {
+			return node, fmt.Errorf("invalid port in consistent hash node '%s': %w", s, err)
+		}
+	}
+	if node.Host == "" {
+		return node, fmt.Errorf("empty host in consistent hash node '%s'", s)
+	}
+	return node, nil
+}
+
+// hashNodeOfServer returns node of the backend server URL, with default carbon port
+func hashNodeOfServer(server string) (HashNode, error) {
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" {
+		return ParseHashNode(server)
+	}
+	return HashNode{Host: u.Hostname(), Port: defaultCarbonPort}, nil
+}
+
+type ringEntry struct {
+	pos  uint16
+	node int
+}
+
+// ConsistentHash places metrics on nodes the same way as carbon-c-relay's carbon_ch, fnv1a_ch and jump_fnv1a_ch
+// clusters do, so only servers, that own the metric, are asked for it.
+type ConsistentHash struct {
+	method            types.LBMethod
+	nodes             []HashNode
+	replicationFactor int
+
+	// ring is used by carbon_ch and fnv1a_ch, sorted by position
+	ring []ringEntry
+	// order is used by jump_fnv1a_ch, indexes of nodes, sorted by instance or host
+	order []int
+}
+
+// NewConsistentHash creates ring for the nodes, metrics are placed on replicationFactor distinct nodes
+func NewConsistentHash(method types.LBMethod, nodes []HashNode, replicationFactor int) (*ConsistentHash, error) {
+	if len(nodes) == 0 {
+		return nil, types.ErrNoServersSpecified
+	}
+	if replicationFactor <= 0 {
+		replicationFactor = 1
+	}
+	if replicationFactor > len(nodes) {
+		return nil, fmt.Errorf("replication factor %d is bigger than count of nodes %d", replicationFactor, len(nodes))
+	}
+
+	c := &ConsistentHash{
+		method:            method,
+		nodes:             nodes,
+		replicationFactor: replicationFactor,
+	}
+	switch method {
+	case types.CarbonCHLB:
+		c.buildRing(func(i int, n HashNode) uint16 {
+			// python's tuple format, used as input of the hash by carbon
+			instance := "None"
+			if n.Instance != "" {
+				instance = "'" + n.Instance + "'"
+			}
+			return carbonHashPos(fmt.Sprintf("('%s', %s):%d", n.Host, instance, i))
+		}, func(a, b HashNode) bool {
+			if a.Host != b.Host {
+				return a.Host < b.Host
+			}
+			return a.Instance < b.Instance
+		})
+	case types.FNV1aCHLB:
+		c.buildRing(func(i int, n HashNode) uint16 {
+			// unlike carbon_ch, port is taken into account, unless instance overrides it
+			if n.Instance != "" {
+				return fnv1aHashPos(fmt.Sprintf("%d-%s", i, n.Instance))
+			}
+			return fnv1aHashPos(fmt.Sprintf("%d-%s:%d", i, n.Host, n.Port))
+		}, func(a, b HashNode) bool {
+			if a.Host != b.Host {
+				return a.Host < b.Host
+			}
+			return a.Port < b.Port
+		})
+	case types.JumpFNV1aCHLB:
+		c.order = make([]int, len(nodes))
+		for i := range nodes {
+			c.order[i] = i
+		}
+		key := func(n HashNode) string {
+			if n.Instance != "" {
+				return n.Instance
+			}
+			return n.Host
+		}
+		sort.SliceStable(c.order, func(i, j int) bool { return key(nodes[c.order[i]]) < key(nodes[c.order[j]]) })
+	default:
+		return nil, fmt.Errorf("lb method %v doesn't use consistent hashing", method)
+	}
+	return c, nil
+}
+
+func (c *ConsistentHash) buildRing(pos func(i int, n HashNode) uint16, less func(a, b HashNode) bool) {
+	c.ring = make([]ringEntry, 0, len(c.nodes)*hashReplicas)
+	for node, n := range c.nodes {
+		for i := 0; i < hashReplicas; i++ {
+			c.ring = append(c.ring, ringEntry{pos: pos(i, n), node: node})
+		}
+	}
+	sort.SliceStable(c.ring, func(i, j int) bool {
+		a, b := c.ring[i], c.ring[j]
+		if a.pos != b.pos {
+			return a.pos < b.pos
+		}
+		return less(c.nodes[a.node], c.nodes[b.node])
+	})
+}
+
+// ReplicationFactor returns count of nodes, that own every metric
+func (c *ConsistentHash) ReplicationFactor() int {
+	return c.replicationFactor
+}
+
+// Get returns indexes of nodes, that own the metric, primary node first
+func (c *ConsistentHash) Get(metric string) []int {
+	res := make([]int, 0, c.replicationFactor)
+	if c.method == types.JumpFNV1aCHLB {
+		// every replica is chosen by jump hash from the nodes, that are left
+		order := append([]int(nil), c.order...)
+		hash := fnv1a64(metric)
+		for len(res) < c.replicationFactor {
+			b := jumpBucket(hash, len(order))
+			res = append(res, order[b])
+			order = append(order[:b], order[b+1:]...)
+		}
+		return res
+	}
+
+	var pos uint16
+	if c.method == types.CarbonCHLB {
+		pos = carbonHashPos(metric)
+	} else {
+		pos = fnv1aHashPos(metric)
+	}
+	// first entry at or after position, like python's bisect_left in carbon
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].pos >= pos })
+	for ; len(res) < c.replicationFactor; i++ {
+		node := c.ring[i%len(c.ring)].node
+		seen := false
+		for _, n := range res {
+			if n == node {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			res = append(res, node)
+		}
+	}
+	return res
+}
+
+func carbonHashPos(s string) uint16 {
+	sum := md5.Sum([]byte(s))
+	return uint16(sum[0])<<8 | uint16(sum[1])
+}
+
+// fnv1aHashPos and fnv1a64 sign extend bytes, as carbon-c-relay hashes signed chars
+func fnv1aHashPos(s string) uint16 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		hash = (hash ^ uint32(int8(s[i]))) * 16777619
+	}
+	return uint16((hash >> 16) ^ (hash & 0xffff))
+}
+
+func fnv1a64(s string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		hash = (hash ^ uint64(int8(s[i]))) * 1099511628211
+	}
+	return hash
+}
+
+// jumpBucket is a jump consistent hash by Lamping and Veach
+func jumpBucket(key uint64, buckets int) int {
+	b, j := int64(-1), int64(0)
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// HashNodes returns nodes of the servers: explicitly configured ones (in the same order as servers)
+// or hosts of server URLs with default carbon port
+func HashNodes(servers, nodes []string) ([]HashNode, error) {
+	if len(nodes) != 0 && len(nodes) != len(servers) {
+		return nil, fmt.Errorf("count of consistent hash nodes %d doesn't match count of servers %d", len(nodes), len(servers))
+	}
+	res := make([]HashNode, 0, len(servers))
+	for i, server := range servers {
+		var node HashNode
+		var err error
+		if len(nodes) != 0 {
+			node, err = ParseHashNode(nodes[i])
+		} else {
+			node, err = hashNodeOfServer(server)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, node)
+	}
+	return res, nil
+}
@@ -0,0 +1,184 @@
+package broadcast
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+
+	"github.com/go-graphite/carbonapi/zipper/dummy"
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+func TestParseHashNode(t *testing.T) {
+	tests := []struct {
+		node     string
+		expected HashNode
+	}{
+		{node: "10.0.0.1", expected: HashNode{Host: "10.0.0.1", Port: 2003}},
+		{node: "10.0.0.1:2103", expected: HashNode{Host: "10.0.0.1", Port: 2103}},
+		{node: "10.0.0.1:2103=a", expected: HashNode{Host: "10.0.0.1", Port: 2103, Instance: "a"}},
+		{node: "carbon1=b", expected: HashNode{Host: "carbon1", Port: 2003, Instance: "b"}},
+		{node: "[::1]:2003", expected: HashNode{Host: "::1", Port: 2003}},
+	}
+	for _, tt := range tests {
+		node, err := ParseHashNode(tt.node)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.node, err)
+		}
+		if node != tt.expected {
+			t.Fatalf("%s: got %+v, expected %+v", tt.node, node, tt.expected)
+		}
+	}
+
+	if _, err := ParseHashNode("10.0.0.1:port"); err == nil {
+		t.Fatal("expected error for invalid port")
+	}
+}
+
+// Placements are computed by carbon's (graphite-project/carbon hashing.py) and carbon-c-relay's algorithms
+func TestConsistentHashPlacements(t *testing.T) {
+	nodes := []HashNode{
+		{Host: "10.0.0.1", Port: 2003},
+		{Host: "10.0.0.2", Port: 2003},
+		{Host: "10.0.0.3", Port: 2003},
+		{Host: "10.0.0.4", Port: 2003},
+	}
+	instanceNodes := []HashNode{
+		{Host: "10.0.0.1", Port: 2003, Instance: "d"},
+		{Host: "10.0.0.2", Port: 2003, Instance: "b"},
+		{Host: "10.0.0.3", Port: 2003, Instance: "a"},
+		{Host: "10.0.0.4", Port: 2003, Instance: "c"},
+	}
+	metrics := []string{"carbon.agents.host1.cpuUsage", "sys.server01.cpu.user", "a.b.c", "metric.with.ünicode", "foo;tag=value"}
+
+	tests := []struct {
+		name     string
+		method   types.LBMethod
+		nodes    []HashNode
+		rf       int
+		expected [][]int
+	}{
+		{
+			name: "carbon_ch", method: types.CarbonCHLB, nodes: nodes, rf: 1,
+			expected: [][]int{{1}, {2}, {1}, {0}, {0}},
+		},
+		{
+			name: "carbon_ch replication 2", method: types.CarbonCHLB, nodes: nodes, rf: 2,
+			expected: [][]int{{1, 0}, {2, 1}, {1, 3}, {0, 3}, {0, 1}},
+		},
+		{
+			name: "carbon_ch instances", method: types.CarbonCHLB, nodes: instanceNodes, rf: 2,
+			expected: [][]int{{2, 3}, {1, 3}, {3, 0}, {0, 3}, {2, 3}},
+		},
+		{
+			name: "fnv1a_ch replication 2", method: types.FNV1aCHLB, nodes: nodes, rf: 2,
+			expected: [][]int{{0, 1}, {1, 3}, {0, 1}, {2, 1}, {1, 2}},
+		},
+		{
+			name: "fnv1a_ch instances", method: types.FNV1aCHLB, nodes: instanceNodes, rf: 2,
+			expected: [][]int{{0, 2}, {0, 1}, {0, 2}, {0, 3}, {2, 1}},
+		},
+		{
+			name: "jump_fnv1a_ch", method: types.JumpFNV1aCHLB, nodes: instanceNodes, rf: 1,
+			expected: [][]int{{2}, {1}, {1}, {0}, {3}},
+		},
+		{
+			name: "jump_fnv1a_ch replication 2", method: types.JumpFNV1aCHLB, nodes: instanceNodes, rf: 2,
+			expected: [][]int{{2, 1}, {1, 3}, {1, 3}, {0, 2}, {3, 0}},
+		},
+		{
+			name: "jump_fnv1a_ch without instances", method: types.JumpFNV1aCHLB, nodes: nodes, rf: 2,
+			expected: [][]int{{0, 1}, {1, 2}, {1, 2}, {3, 0}, {2, 3}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewConsistentHash(tt.method, tt.nodes, tt.rf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, metric := range metrics {
+				if got := c.Get(metric); !reflect.DeepEqual(got, tt.expected[i]) {
+					t.Errorf("%s: got %v, expected %v", metric, got, tt.expected[i])
+				}
+			}
+		})
+	}
+
+	if _, err := NewConsistentHash(types.CarbonCHLB, nodes, 5); err == nil {
+		t.Error("expected error for replication factor bigger than count of nodes")
+	}
+}
+
+func TestConsistentHashFetch(t *testing.T) {
+	servers := []types.BackendServer{
+		dummy.NewDummyClient("client1", []string{"backend1"}, 0),
+		dummy.NewDummyClient("client2", []string{"backend2"}, 0),
+		dummy.NewDummyClient("client3", []string{"backend3"}, 0),
+		dummy.NewDummyClient("client4", []string{"backend4"}, 0),
+	}
+	nodes, err := HashNodes(
+		[]string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://10.0.0.3:8080", "http://10.0.0.4:8080"}, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consistentHash, err := NewConsistentHash(types.CarbonCHLB, nodes, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, merr := NewBroadcastGroup(logger, "ch", false, servers, 60, 500, 100, timeouts, true, false)
+	if merr != nil {
+		t.Fatal(merr)
+	}
+	if merr = b.SetConsistentHash(consistentHash); merr != nil {
+		t.Fatal(merr)
+	}
+
+	fetchRequest := func(names ...string) *protov3.MultiFetchRequest {
+		r := &protov3.MultiFetchRequest{}
+		for _, name := range names {
+			r.Metrics = append(r.Metrics, protov3.FetchRequest{Name: name, PathExpression: name, StopTime: 120})
+		}
+		return r
+	}
+	fetchResponse := func(name string) *protov3.MultiFetchResponse {
+		return &protov3.MultiFetchResponse{Metrics: []protov3.FetchResponse{
+			{Name: name, PathExpression: name, StopTime: 120, StepTime: 60, Values: []float64{0, 1}},
+		}}
+	}
+	// every server gets only the metrics it owns
+	servers[1].(*dummy.DummyClient).AddFetchResponse(fetchRequest("carbon.agents.host1.cpuUsage"),
+		fetchResponse("carbon.agents.host1.cpuUsage"), &types.Stats{}, nil)
+	servers[2].(*dummy.DummyClient).AddFetchResponse(fetchRequest("sys.server01.cpu.user"),
+		fetchResponse("sys.server01.cpu.user"), &types.Stats{}, nil)
+
+	names := []string{"carbon.agents.host1.cpuUsage", "sys.server01.cpu.user"}
+	route := b.Route(names)
+	if !reflect.DeepEqual(route.Servers, []string{"backend2", "backend3"}) {
+		t.Fatalf("unexpected servers in route: %v", route.Servers)
+	}
+
+	res, _, merr := b.Fetch(context.Background(), fetchRequest(names...))
+	if merr != nil {
+		t.Fatal(merr)
+	}
+	got := make([]string, 0, len(res.Metrics))
+	for _, m := range res.Metrics {
+		got = append(got, m.Name)
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, names) {
+		t.Fatalf("unexpected metrics in response: %v", got)
+	}
+
+	// globs are still sent to all servers
+	route = b.Route([]string{"carbon.agents.*.cpuUsage"})
+	if !reflect.DeepEqual(route.Servers, []string{"backend1", "backend2", "backend3", "backend4"}) {
+		t.Fatalf("unexpected servers in route of glob: %v", route.Servers)
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"context"
 	"sync"
 	"sync/atomic"
-
-	"github.com/dgryski/go-expirecache"
 )
 
 const (
@@ -29,78 +27,115 @@ func (q *QueryItem) GetStatus() uint64 {
 	return s
 }
 
+// FetchOrLock returns data of the item, waiting for the leader if query is pending.
+// If there is no data and no pending query, caller becomes the leader and false is returned,
+// leader must call StoreAndUnlock or StoreAbort after that.
+// Nil data with true is returned if ctx is done before the leader finished.
 func (q *QueryItem) FetchOrLock(ctx context.Context) (interface{}, bool) {
-	d := q.Data.Load()
-	if d != nil {
-		return d, true
-	}
-
-	ok := atomic.CompareAndSwapUint64(&q.Flags, Empty, QueryIsPending)
-	if ok {
-		// We are the leader now and will be fetching the data
-		return nil, false
-	}
-
-	q.RLock()
-	defer q.RUnlock()
-
-	select {
-	case <-ctx.Done():
-		return nil, true
-	case <-q.QueryFinished:
-		break
+	for {
+		d := q.Data.Load()
+		if d != nil {
+			return d, true
+		}
+
+		ok := atomic.CompareAndSwapUint64(&q.Flags, Empty, QueryIsPending)
+		if ok {
+			// We are the leader now and will be fetching the data
+			return nil, false
+		}
+
+		q.RLock()
+		finished := q.QueryFinished
+		flags := atomic.LoadUint64(&q.Flags)
+		q.RUnlock()
+		if flags == Empty {
+			// leader aborted the query, try to become a new one
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, true
+		case <-finished:
+		}
 	}
-
-	return q.Data.Load(), true
 }
 
+// StoreAbort releases the item without data, one of waiting callers becomes the new leader
 func (q *QueryItem) StoreAbort() {
 	d := q.Data.Load()
 	if d != nil {
 		return
 	}
-	atomic.StoreUint64(&q.Flags, Empty)
-	close(q.QueryFinished)
 
 	q.Lock()
+	atomic.StoreUint64(&q.Flags, Empty)
+	close(q.QueryFinished)
 	q.QueryFinished = make(chan struct{})
 	q.Unlock()
 }
 
 func (q *QueryItem) StoreAndUnlock(data interface{}, size uint64) {
 	q.Data.Store(data)
+
+	q.Lock()
 	atomic.StoreUint64(&q.Flags, DataIsAvailable)
 	close(q.QueryFinished)
+	q.Unlock()
+
 	atomic.AddUint64(&q.parent.totalSize, size)
 }
 
+// QueryCache keeps items of queries, that are in flight, finished queries must be removed with Delete
 type QueryCache struct {
-	ec *expirecache.Cache
+	mu    sync.Mutex
+	items map[string]*QueryItem
 
-	objectCount uint64
-	totalSize   uint64
-	expireTime  int32
+	totalSize uint64
 }
 
-func NewQueryCache(queryCacheSizeMB uint64, expireTime int32) *QueryCache {
+func NewQueryCache() *QueryCache {
 	return &QueryCache{
-		ec:         expirecache.New(queryCacheSizeMB),
-		expireTime: expireTime,
+		items: make(map[string]*QueryItem),
 	}
 }
 
-// TODO: Make size and expire configurable
-func (q *QueryCache) GetQueryItem(k string) *QueryItem {
-	objectCount := atomic.AddUint64(&q.objectCount, 1)
-	size := atomic.AddUint64(&q.totalSize, 1)
-	emptyQueryItem := &QueryItem{
+func (q *QueryCache) newQueryItem(k string) *QueryItem {
+	return &QueryItem{
 		Key:           k,
 		QueryFinished: make(chan struct{}),
 		Flags:         Empty,
 
 		parent: q,
 	}
-	item := q.ec.GetOrSet(k, emptyQueryItem, size/objectCount, q.expireTime).(*QueryItem)
+}
+
+// GetQueryItem returns item of the query in flight or a new one
+func (q *QueryCache) GetQueryItem(k string) *QueryItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 
+	item, ok := q.items[k]
+	if !ok {
+		item = q.newQueryItem(k)
+		q.items[k] = item
+	}
 	return item
 }
+
+// Delete removes finished item, so the next query for the key is not served with old data.
+// Callers, that already got the item, still get its data.
+func (q *QueryCache) Delete(item *QueryItem) {
+	q.mu.Lock()
+	if q.items[item.Key] == item {
+		delete(q.items, item.Key)
+	}
+	q.mu.Unlock()
+}
+
+// Len returns amount of queries in flight
+func (q *QueryCache) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
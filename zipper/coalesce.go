@@ -0,0 +1,157 @@
+package zipper
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ansel1/merry"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+
+	"github.com/go-graphite/carbonapi/limiter"
+	utilctx "github.com/go-graphite/carbonapi/util/ctx"
+	"github.com/go-graphite/carbonapi/zipper/cache"
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+// coalescer makes identical concurrent requests to wait for the first one instead of sending them to backends
+type coalescer struct {
+	cache *cache.QueryCache
+}
+
+type coalescedResult struct {
+	response interface{}
+	err      merry.Error
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{cache: cache.NewQueryCache()}
+}
+
+type marshaler interface {
+	Marshal() ([]byte, error)
+}
+
+// coalesceKey identifies request, passed headers and query cost limits are part of the key, as they can change response
+func coalesceKey(ctx context.Context, kind string, request marshaler) (string, error) {
+	body, err := request.Marshal()
+	if err != nil {
+		return "", err
+	}
+
+	var key strings.Builder
+	key.WriteString(kind)
+
+	headers := utilctx.GetPassHeaders(ctx)
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key.WriteString("\x00")
+		key.WriteString(name)
+		key.WriteString("=")
+		key.WriteString(headers[name])
+	}
+
+	if queryCost := utilctx.GetQueryCost(ctx); queryCost != nil {
+		limits := queryCost.Limits()
+		for _, v := range []int64{limits.MaxFindMetrics, limits.MaxFetchedSeries, limits.MaxDatapoints, limits.MaxOutputSeries} {
+			key.WriteString("\x00")
+			key.WriteString(strconv.FormatInt(v, 10))
+		}
+	}
+
+	key.WriteString("\x00")
+	key.Write(body)
+	return key.String(), nil
+}
+
+// do sends request with fetch or waits for the result of identical request, that is already in flight.
+// Waiting requests get a copy of the response (made with clone) and stats without backend counters, so they are not counted twice.
+// Leader's query cost is charged by backends, waiting requests are charged for the shared response with charge, if it's set.
+func (c *coalescer) do(ctx context.Context, kind string, request marshaler, fetch func() (interface{}, *types.Stats, merry.Error), clone func(interface{}) interface{}, charge func(context.Context, interface{}) merry.Error) (interface{}, *types.Stats, merry.Error) {
+	if c == nil {
+		return fetch()
+	}
+	key, err := coalesceKey(ctx, kind, request)
+	if err != nil {
+		return fetch()
+	}
+
+	item := c.cache.GetQueryItem(key)
+	data, ok := item.FetchOrLock(ctx)
+	if !ok {
+		res, stats, err := fetch()
+		if err != nil && ctx.Err() != nil {
+			// request was canceled by the leader's client, so result can't be shared, one of waiting requests will retry
+			item.StoreAbort()
+		} else {
+			item.StoreAndUnlock(&coalescedResult{response: res, err: err}, 1)
+		}
+		c.cache.Delete(item)
+		if stats == nil {
+			stats = &types.Stats{}
+		}
+		stats.CoalesceMisses++
+		return res, stats, err
+	}
+
+	if data == nil {
+		return nil, &types.Stats{}, types.ErrTimeoutExceeded.WithCause(ctx.Err())
+	}
+
+	result := data.(*coalescedResult)
+	response := result.response
+	if response != nil {
+		if charge != nil {
+			if err := charge(ctx, response); err != nil {
+				return nil, &types.Stats{CoalesceHits: 1}, err
+			}
+		}
+		response = clone(response)
+	}
+	return response, &types.Stats{CoalesceHits: 1}, result.err
+}
+
+// chargeFetch charges query cost of the request for the fetched response: metrics, that are found for each path
+// expression, fetched series and datapoints
+func chargeFetch(ctx context.Context, v interface{}) merry.Error {
+	res := v.(*protov3.MultiFetchResponse)
+	queryCost := utilctx.GetQueryCost(ctx)
+	if res == nil || queryCost == nil {
+		return nil
+	}
+	utilctx.MarkFetchCharged(ctx)
+	return queryCost.AddFetched(limiter.FetchedSeriesOf(res.Metrics))
+}
+
+func cloneFetchResponse(v interface{}) interface{} {
+	res := v.(*protov3.MultiFetchResponse)
+	if res == nil {
+		return res
+	}
+	metrics := make([]protov3.FetchResponse, len(res.Metrics))
+	for i := range res.Metrics {
+		metrics[i] = res.Metrics[i]
+		metrics[i].Values = slices.Clone(res.Metrics[i].Values)
+		metrics[i].AppliedFunctions = slices.Clone(res.Metrics[i].AppliedFunctions)
+	}
+	return &protov3.MultiFetchResponse{Metrics: metrics}
+}
+
+func cloneFindResponse(v interface{}) interface{} {
+	res := v.(*protov3.MultiGlobResponse)
+	if res == nil {
+		return res
+	}
+	metrics := make([]protov3.GlobResponse, len(res.Metrics))
+	for i := range res.Metrics {
+		metrics[i] = res.Metrics[i]
+		metrics[i].Matches = slices.Clone(res.Metrics[i].Matches)
+	}
+	return &protov3.MultiGlobResponse{Metrics: metrics}
+}
@@ -0,0 +1,203 @@
+package zipper
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ansel1/merry"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+
+	"github.com/go-graphite/carbonapi/limiter"
+	utilctx "github.com/go-graphite/carbonapi/util/ctx"
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+func coalesceFetchRequest(name string) *protov3.MultiFetchRequest {
+	return &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{{Name: name, StartTime: 100, StopTime: 200, PathExpression: name}},
+	}
+}
+
+func TestCoalescer(t *testing.T) {
+	c := newCoalescer()
+
+	release := make(chan struct{})
+	var calls int32
+	fetch := func() (interface{}, *types.Stats, merry.Error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &protov3.MultiFetchResponse{Metrics: []protov3.FetchResponse{{Name: "foo", Values: []float64{1, 2}}}}, &types.Stats{RenderRequests: 1}, nil
+	}
+
+	const n = 5
+	var (
+		wg    sync.WaitGroup
+		stats = make([]*types.Stats, n)
+		resps = make([]*protov3.MultiFetchResponse, n)
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, s, err := c.do(context.Background(), "fetch", coalesceFetchRequest("foo"), fetch, cloneFetchResponse, chargeFetch)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			stats[i] = s
+			resps[i] = r.(*protov3.MultiFetchResponse)
+		}(i)
+	}
+
+	// wait for all requests to join the leader
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("backend was called %d times, expected 1", calls)
+	}
+	total := &types.Stats{}
+	for i := range stats {
+		total.Merge(stats[i])
+		if len(resps[i].Metrics) != 1 || resps[i].Metrics[0].Values[1] != 2 {
+			t.Fatalf("unexpected response %+v", resps[i])
+		}
+	}
+	if total.CoalesceHits != n-1 || total.CoalesceMisses != 1 || total.RenderRequests != 1 {
+		t.Fatalf("unexpected stats %+v", total)
+	}
+
+	// followers get their own copy of values
+	resps[0].Metrics[0].Values[0] = 42
+	for i := 1; i < n; i++ {
+		if resps[i].Metrics[0].Values[0] != 1 {
+			t.Fatalf("response %d shares values with other requests", i)
+		}
+	}
+
+	// finished request is removed
+	if n := c.cache.Len(); n != 0 {
+		t.Fatalf("%d finished requests are kept", n)
+	}
+
+	// finished result is not reused
+	_, s, _ := c.do(context.Background(), "fetch", coalesceFetchRequest("foo"), fetch, cloneFetchResponse, chargeFetch)
+	if calls != 2 || s.CoalesceMisses != 1 {
+		t.Fatalf("finished request was reused, calls %d, stats %+v", calls, s)
+	}
+}
+
+func TestCoalescerQueryCost(t *testing.T) {
+	c := newCoalescer()
+
+	release := make(chan struct{})
+	fetch := func() (interface{}, *types.Stats, merry.Error) {
+		<-release
+		return &protov3.MultiFetchResponse{Metrics: []protov3.FetchResponse{
+			{Name: "foo.a", PathExpression: "foo.*"},
+			{Name: "foo.b", PathExpression: "foo.*"},
+		}}, &types.Stats{}, nil
+	}
+
+	// requests with the same limits are coalesced, leader is charged by backends
+	limits := limiter.CostLimits{MaxFindMetrics: 1}
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		ctx := utilctx.SetQueryCost(context.Background(), limiter.NewQueryCost(limits))
+		_, _, _ = c.do(ctx, "fetch", coalesceFetchRequest("foo.*"), fetch, cloneFetchResponse, chargeFetch)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// waiting request is charged for metrics of the shared response
+	var err merry.Error
+	waiterDone := make(chan struct{})
+	go func() {
+		defer close(waiterDone)
+		ctx := utilctx.SetQueryCost(context.Background(), limiter.NewQueryCost(limits))
+		_, _, err = c.do(ctx, "fetch", coalesceFetchRequest("foo.*"), fetch, cloneFetchResponse, chargeFetch)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-leaderDone
+	<-waiterDone
+
+	if !merry.Is(err, limiter.ErrQueryCostExceeded) {
+		t.Fatalf("unexpected error for waiting request: %v", err)
+	}
+}
+
+func TestCoalescerKey(t *testing.T) {
+	req := coalesceFetchRequest("foo")
+	k1, _ := coalesceKey(context.Background(), "fetch", req)
+	k2, _ := coalesceKey(context.Background(), "find", req)
+	k3, _ := coalesceKey(context.Background(), "fetch", coalesceFetchRequest("bar"))
+	k4, _ := coalesceKey(utilctx.SetPassHeaders(context.Background(), map[string]string{"X-Auth": "user"}), "fetch", req)
+	k5, _ := coalesceKey(context.Background(), "fetch", coalesceFetchRequest("foo"))
+
+	for _, k := range []string{k2, k3, k4} {
+		if k == k1 {
+			t.Fatalf("different requests have the same key %q", k)
+		}
+	}
+	if k1 != k5 {
+		t.Fatalf("same requests have different keys %q and %q", k1, k5)
+	}
+}
+
+func TestCoalescerCancel(t *testing.T) {
+	c := newCoalescer()
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderStarted := make(chan struct{})
+	var calls int32
+	fetch := func(ctx context.Context) func() (interface{}, *types.Stats, merry.Error) {
+		return func() (interface{}, *types.Stats, merry.Error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				close(leaderStarted)
+				<-ctx.Done()
+				return nil, &types.Stats{}, types.ErrTimeoutExceeded.WithCause(ctx.Err())
+			}
+			return &protov3.MultiFetchResponse{Metrics: []protov3.FetchResponse{{Name: "foo"}}}, &types.Stats{}, nil
+		}
+	}
+
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		_, _, err := c.do(leaderCtx, "fetch", coalesceFetchRequest("foo"), fetch(leaderCtx), cloneFetchResponse, chargeFetch)
+		if err == nil {
+			t.Error("expected error for canceled leader")
+		}
+	}()
+	<-leaderStarted
+
+	// follower with short timeout gives up without the result
+	shortCtx, cancelShort := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelShort()
+	_, _, err := c.do(shortCtx, "fetch", coalesceFetchRequest("foo"), fetch(shortCtx), cloneFetchResponse, chargeFetch)
+	if !merry.Is(err, types.ErrTimeoutExceeded) {
+		t.Fatalf("unexpected error for timed out follower: %v", err)
+	}
+
+	// canceled leader doesn't share its error, waiting follower fetches itself
+	followerDone := make(chan struct{})
+	go func() {
+		defer close(followerDone)
+		r, _, err := c.do(context.Background(), "fetch", coalesceFetchRequest("foo"), fetch(context.Background()), cloneFetchResponse, chargeFetch)
+		if err != nil || r.(*protov3.MultiFetchResponse) == nil {
+			t.Errorf("unexpected result for follower: %v, %v", r, err)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancelLeader()
+	<-leaderDone
+	<-followerDone
+
+	if calls != 2 {
+		t.Fatalf("backend was called %d times, expected 2", calls)
+	}
+}
@@ -33,12 +33,31 @@ type Config struct {
 	Timeouts             types.Timeouts
 	KeepAliveInterval    time.Duration `mapstructure:"keepAliveInterval"`
 
+	// CoalesceRequests makes identical concurrent fetch and find requests to wait for the first one instead of querying backends again
+	CoalesceRequests bool `mapstructure:"coalesceRequests"`
+
+	// FetchCache keeps fetched series in time chunks, so only missing chunks are fetched from backends
+	FetchCache FetchCache `mapstructure:"fetchCache"`
+
 	// ScaleToCommonStep controls if metrics in one target should be aggregated to common step
 	ScaleToCommonStep bool `mapstructure:"scaleToCommonStep"`
 
 	isSanitized bool
 }
 
+// FetchCache is a configuration of per-series cache of fetched data
+type FetchCache struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Size is a maximum size of the cache in MB
+	Size int `mapstructure:"size"`
+	// ChunkSize is a size of time chunk, series are stored in chunks aligned to it
+	ChunkSize time.Duration `mapstructure:"chunkSize"`
+	// MutableWindow is a time before now, that can still get new points. Chunks ending in it are always fetched and never cached
+	MutableWindow time.Duration `mapstructure:"mutableWindow"`
+	// TTL is a time to keep chunk in the cache
+	TTL time.Duration `mapstructure:"ttl"`
+}
+
 func (cfg *Config) IsSanitized() bool {
 	return cfg.isSanitized
 }
@@ -135,6 +154,16 @@ func SanitizeConfig(logger *zap.Logger, oldConfig Config) *Config {
 		}
 	}
 
+	if newConfig.FetchCache.Enabled {
+		if newConfig.FetchCache.ChunkSize < time.Minute {
+			logger.Warn("fetchCache.chunkSize is too low, minimum allowed is 1m")
+			newConfig.FetchCache.ChunkSize = time.Minute
+		}
+		if newConfig.FetchCache.TTL <= 0 {
+			newConfig.FetchCache.TTL = 6 * time.Hour
+		}
+	}
+
 	if newConfig.BackendsV2.MaxBatchSize == nil {
 		newConfig.BackendsV2.MaxBatchSize = newConfig.MaxBatchSize
 	}
@@ -0,0 +1,192 @@
+package fetchcache
+
+import (
+	"math"
+	"sort"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+)
+
+// fetchPlan describes how a single fetch request is served: which chunks are taken from the cache and what is fetched
+type fetchPlan struct {
+	request *protov3.FetchRequest
+	// cacheable is false for requests, that are passed to backends as is
+	cacheable bool
+	// cached is series of cached chunks by chunk start
+	cached map[int64]map[string]*seriesChunk
+	// fetch is a request to backends, nil if everything is cached
+	fetch *protov3.FetchRequest
+	// fetchFrom and fetchUntil are boundaries of fetched chunks, chunks in [fetchFrom, storeUntil) are complete and can be stored
+	fetchFrom  int64
+	fetchUntil int64
+	storeUntil int64
+	// failed is set, if backends returned an error
+	failed bool
+
+	hits   uint64
+	misses uint64
+
+	response []protov3.FetchResponse
+}
+
+// floor aligns timestamp to the start of its chunk
+func floor(ts, size int64) int64 {
+	return ts - mod(ts, size)
+}
+
+func mod(a, b int64) int64 {
+	m := a % b
+	if m < 0 {
+		m += b
+	}
+	return m
+}
+
+type namedChunk struct {
+	*seriesChunk
+	name string
+}
+
+func (s namedChunk) size() uint64 {
+	return uint64(len(s.values)*8 + len(s.name) + len(s.consolidationFunc) + 64)
+}
+
+// cutChunk copies values of the series with timestamps in [from, until)
+func cutChunk(series *protov3.FetchResponse, from, until int64) namedChunk {
+	chunk := &seriesChunk{
+		step:              series.StepTime,
+		consolidationFunc: series.ConsolidationFunc,
+		xFilesFactor:      series.XFilesFactor,
+	}
+	if series.StepTime <= 0 {
+		return namedChunk{seriesChunk: chunk, name: series.Name}
+	}
+
+	first := int64(0)
+	if from > series.StartTime {
+		first = (from - series.StartTime + series.StepTime - 1) / series.StepTime
+	}
+	chunk.start = series.StartTime + first*series.StepTime
+	for i := first; i < int64(len(series.Values)); i++ {
+		if series.StartTime+i*series.StepTime >= until {
+			break
+		}
+		chunk.values = append(chunk.values, series.Values[i])
+	}
+	return namedChunk{seriesChunk: chunk, name: series.Name}
+}
+
+// seriesSource is a part of series, that is copied to the response
+type seriesSource struct {
+	start  int64
+	step   int64
+	values []float64
+}
+
+// stitch makes response from cached chunks and fetched series.
+// False is returned, if steps of cached and fetched parts don't match (e.g. backend used another archive).
+func (p *fetchPlan) stitch() bool {
+	if p.failed && len(p.response) == 0 {
+		// don't hide backend errors with partial data from the cache
+		return true
+	}
+
+	type series struct {
+		meta    protov3.FetchResponse
+		sources []seriesSource
+	}
+	byName := make(map[string]*series)
+	get := func(name string) *series {
+		s, ok := byName[name]
+		if !ok {
+			s = &series{}
+			s.meta.Name = name
+			byName[name] = s
+		}
+		return s
+	}
+
+	chunks := make([]int64, 0, len(p.cached))
+	for chunk := range p.cached {
+		chunks = append(chunks, chunk)
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i] < chunks[j] })
+	for _, chunk := range chunks {
+		if p.fetch != nil && chunk >= p.fetchFrom && chunk < p.fetchUntil && !p.failed {
+			// chunk was fetched again
+			continue
+		}
+		for name, c := range p.cached[chunk] {
+			s := get(name)
+			s.meta.ConsolidationFunc = c.consolidationFunc
+			s.meta.XFilesFactor = c.xFilesFactor
+			s.sources = append(s.sources, seriesSource{start: c.start, step: c.step, values: c.values})
+		}
+	}
+	for i := range p.response {
+		fetched := &p.response[i]
+		s := get(fetched.Name)
+		s.meta.ConsolidationFunc = fetched.ConsolidationFunc
+		s.meta.XFilesFactor = fetched.XFilesFactor
+		s.sources = append(s.sources, seriesSource{start: fetched.StartTime, step: fetched.StepTime, values: fetched.Values})
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	response := make([]protov3.FetchResponse, 0, len(names))
+	for _, name := range names {
+		s := byName[name]
+		var step, phase int64
+		for _, src := range s.sources {
+			if src.step <= 0 || len(src.values) == 0 {
+				continue
+			}
+			if step == 0 {
+				step, phase = src.step, mod(src.start, src.step)
+			} else if src.step != step || mod(src.start, step) != phase {
+				return false
+			}
+		}
+		if step == 0 {
+			continue
+		}
+
+		// values have timestamps in (from, until], as backends return them
+		from, until := p.request.StartTime, p.request.StopTime
+		start := from - mod(from-phase, step) + step
+		var n int64
+		if until >= start {
+			n = (until-start)/step + 1
+		}
+		values := make([]float64, n)
+		for i := range values {
+			values[i] = math.NaN()
+		}
+		for _, src := range s.sources {
+			for i, v := range src.values {
+				ts := src.start + int64(i)*step
+				if ts < start || ts > until {
+					continue
+				}
+				values[(ts-start)/step] = v
+			}
+		}
+
+		meta := s.meta
+		meta.PathExpression = pathExpression(p.request)
+		meta.StartTime = start
+		meta.StopTime = start + n*step
+		meta.StepTime = step
+		meta.Values = values
+		meta.RequestStartTime = p.request.StartTime
+		meta.RequestStopTime = p.request.StopTime
+		response = append(response, meta)
+	}
+
+	p.response = response
+	return true
+}
@@ -0,0 +1,346 @@
+package fetchcache
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/dgryski/go-expirecache"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/zipper/config"
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+// maxChunksPerRequest limits amount of chunks for a single fetch request, longer requests are not cached
+const maxChunksPerRequest = 1440
+
+// Cache keeps fetched series in time chunks, aligned to the chunk size. It's shared by all backend groups.
+type Cache struct {
+	ec *expirecache.Cache
+
+	chunkSize     int64
+	mutableWindow int64
+	ttl           int32
+
+	now func() int64
+}
+
+// seriesChunk is a part of the series, that belongs to a single chunk
+type seriesChunk struct {
+	// start is a timestamp of the first value
+	start             int64
+	step              int64
+	consolidationFunc string
+	xFilesFactor      float32
+	values            []float64
+}
+
+// New creates cache with the given configuration
+func New(cfg config.FetchCache) *Cache {
+	return &Cache{
+		ec:            expirecache.New(uint64(cfg.Size) * 1024 * 1024),
+		chunkSize:     int64(cfg.ChunkSize.Seconds()),
+		mutableWindow: int64(cfg.MutableWindow.Seconds()),
+		ttl:           int32(cfg.TTL.Seconds()),
+		now:           func() int64 { return time.Now().Unix() },
+	}
+}
+
+// Cleaner periodically removes expired chunks until exit is closed
+func (c *Cache) Cleaner(exit <-chan struct{}) {
+	c.ec.StoppableApproximateCleaner(time.Minute, exit)
+}
+
+// Wrap returns backend group, that serves fetch requests from the cache
+func (c *Cache) Wrap(logger *zap.Logger, backend types.BackendServer) types.BackendServer {
+	return &Group{
+		BackendServer: backend,
+		cache:         c,
+		stats:         GetGroupStats(backend.Name()),
+		logger:        logger.With(zap.String("type", "fetchCache"), zap.String("group", backend.Name())),
+	}
+}
+
+func patternKey(group string, request *protov3.FetchRequest, chunk int64) string {
+	return "p\x00" + group + "\x00" + pathExpression(request) + "\x00" + strconv.FormatInt(request.MaxDataPoints, 10) + "\x00" + strconv.FormatInt(chunk, 10)
+}
+
+func seriesKey(group string, request *protov3.FetchRequest, name string, chunk int64) string {
+	return "s\x00" + group + "\x00" + name + "\x00" + strconv.FormatInt(request.MaxDataPoints, 10) + "\x00" + strconv.FormatInt(chunk, 10)
+}
+
+func pathExpression(request *protov3.FetchRequest) string {
+	if request.PathExpression != "" {
+		return request.PathExpression
+	}
+	return request.Name
+}
+
+// lookup returns cached series of the chunk, false if any of them is missing
+func (c *Cache) lookup(group string, request *protov3.FetchRequest, chunk int64) (map[string]*seriesChunk, bool) {
+	v, ok := c.ec.Get(patternKey(group, request, chunk))
+	if !ok {
+		return nil, false
+	}
+	names := v.([]string)
+	series := make(map[string]*seriesChunk, len(names))
+	for _, name := range names {
+		v, ok := c.ec.Get(seriesKey(group, request, name, chunk))
+		if !ok {
+			return nil, false
+		}
+		series[name] = v.(*seriesChunk)
+	}
+	return series, true
+}
+
+// store splits fetched series into chunks and stores chunks from the range [from, until)
+func (c *Cache) store(group string, request *protov3.FetchRequest, from, until int64, fetched []protov3.FetchResponse) {
+	if len(fetched) == 0 {
+		return
+	}
+	names := make([]string, 0, len(fetched))
+	for i := range fetched {
+		names = append(names, fetched[i].Name)
+	}
+
+	for chunk := from; chunk < until; chunk += c.chunkSize {
+		for i := range fetched {
+			s := cutChunk(&fetched[i], chunk, chunk+c.chunkSize)
+			c.ec.Set(seriesKey(group, request, s.name, chunk), s.seriesChunk, s.size(), c.ttl)
+		}
+		// series are stored before the pattern, so pattern is never found without them
+		c.ec.Set(patternKey(group, request, chunk), names, uint64(len(names))*16, c.ttl)
+	}
+}
+
+// Group serves fetch requests to the backend group from the cache, only missing and mutable chunks are fetched
+type Group struct {
+	types.BackendServer
+
+	cache  *Cache
+	stats  *GroupStats
+	logger *zap.Logger
+}
+
+// Unwrap returns the wrapped group
+func (g *Group) Unwrap() types.BackendServer {
+	return g.BackendServer
+}
+
+// Route returns route of the wrapped group
+func (g *Group) Route(requests []string) types.Route {
+	return types.RouteOf(g.BackendServer, requests)
+}
+
+// plan makes a plan for the fetch request: which chunks can be taken from the cache and what should be fetched
+func (g *Group) plan(request *protov3.FetchRequest) *fetchPlan {
+	c := g.cache
+	p := &fetchPlan{request: request}
+	passThrough := func() *fetchPlan {
+		p.cacheable = false
+		p.cached = nil
+		p.fetch = request
+		return p
+	}
+
+	if len(request.FilterFunctions) > 0 || request.HighPrecisionTimestamps || request.StopTime <= request.StartTime {
+		return passThrough()
+	}
+
+	// fetched values have timestamps in (from, until]
+	first := floor(request.StartTime+1, c.chunkSize)
+	last := floor(request.StopTime, c.chunkSize)
+	if (last-first)/c.chunkSize >= maxChunksPerRequest {
+		return passThrough()
+	}
+	mutableFrom := c.now() - c.mutableWindow
+	if first+c.chunkSize > mutableFrom {
+		// nothing to take from the cache
+		return passThrough()
+	}
+
+	p.cacheable = true
+	p.cached = make(map[int64]map[string]*seriesChunk)
+	p.fetchFrom, p.fetchUntil = -1, -1
+	lastComplete := false
+	for chunk := first; chunk <= last; chunk += c.chunkSize {
+		complete := chunk+c.chunkSize <= mutableFrom
+		if complete {
+			if series, ok := c.lookup(g.Name(), request, chunk); ok {
+				p.cached[chunk] = series
+				p.hits++
+				continue
+			}
+		}
+		p.misses++
+		if p.fetchFrom == -1 {
+			p.fetchFrom = chunk
+		}
+		p.fetchUntil = chunk + c.chunkSize
+		lastComplete = complete
+	}
+
+	if p.fetchFrom == -1 {
+		return p
+	}
+
+	// chunk can't be stored, if it's fetched partially
+	stopTime := p.fetchUntil - 1
+	if !lastComplete {
+		stopTime = request.StopTime
+	}
+	p.storeUntil = p.fetchUntil
+	if !lastComplete {
+		p.storeUntil = floor(mutableFrom, c.chunkSize)
+	}
+	p.fetch = &protov3.FetchRequest{
+		Name:           request.Name,
+		StartTime:      p.fetchFrom - 1,
+		StopTime:       stopTime,
+		PathExpression: pathExpression(request),
+		MaxDataPoints:  request.MaxDataPoints,
+	}
+
+	return p
+}
+
+// Fetch takes complete chunks from the cache and fetches the rest from backends
+func (g *Group) Fetch(ctx context.Context, request *protov3.MultiFetchRequest) (*protov3.MultiFetchResponse, *types.Stats, merry.Error) {
+	plans := make([]*fetchPlan, len(request.Metrics))
+	for i := range request.Metrics {
+		plans[i] = g.plan(&request.Metrics[i])
+	}
+
+	stats := &types.Stats{}
+	err := g.fetch(ctx, plans, stats)
+
+	var fallback []*fetchPlan
+	for _, p := range plans {
+		if p.cacheable {
+			if !p.stitch() {
+				g.logger.Debug("cached chunks don't match fetched series, fetching full range",
+					zap.String("request", p.request.Name),
+				)
+				fallback = append(fallback, p)
+			}
+		}
+	}
+	if len(fallback) > 0 {
+		for _, p := range fallback {
+			p.misses += p.hits
+			p.hits = 0
+			p.cacheable = false
+			p.failed = false
+			p.fetch = p.request
+			p.response = nil
+		}
+		if e := g.fetch(ctx, fallback, stats); e != nil {
+			err = e
+		}
+	}
+
+	var hits, misses uint64
+	response := &protov3.MultiFetchResponse{}
+	for _, p := range plans {
+		hits += p.hits
+		misses += p.misses
+		response.Metrics = append(response.Metrics, p.response...)
+	}
+	if hits+misses > 0 {
+		stats.FetchCacheHits += hits
+		stats.FetchCacheMisses += misses
+		atomic.AddUint64(&g.stats.Hits, hits)
+		atomic.AddUint64(&g.stats.Misses, misses)
+	}
+
+	if len(response.Metrics) == 0 {
+		if err == nil {
+			err = types.ErrNoMetricsFetched
+		}
+		return nil, stats, err
+	}
+	return response, stats, err
+}
+
+// fetch sends fetch requests of the plans to the backend group.
+// Requests with the same path expression are sent separately, as responses are matched by it.
+func (g *Group) fetch(ctx context.Context, plans []*fetchPlan, stats *types.Stats) merry.Error {
+	var lastErr merry.Error
+	pending := plans
+	for len(pending) > 0 {
+		batch := make(map[string]*fetchPlan)
+		request := &protov3.MultiFetchRequest{}
+		var next []*fetchPlan
+		for _, p := range pending {
+			if p.fetch == nil {
+				continue
+			}
+			pathExpr := pathExpression(p.fetch)
+			if _, ok := batch[pathExpr]; ok {
+				next = append(next, p)
+				continue
+			}
+			batch[pathExpr] = p
+			request.Metrics = append(request.Metrics, *p.fetch)
+		}
+		pending = next
+		if len(request.Metrics) == 0 {
+			break
+		}
+
+		res, s, err := g.BackendServer.Fetch(ctx, request)
+		if s != nil {
+			stats.Merge(s)
+		}
+		if err != nil {
+			lastErr = err
+		}
+
+		var single *fetchPlan
+		if len(batch) == 1 {
+			for _, p := range batch {
+				single = p
+			}
+		}
+		if res != nil {
+			for i := range res.Metrics {
+				p, ok := batch[res.Metrics[i].PathExpression]
+				if !ok {
+					p, ok = batch[res.Metrics[i].Name]
+				}
+				if !ok {
+					p = single
+				}
+				if p == nil {
+					g.logger.Warn("can't match fetched series with request",
+						zap.String("name", res.Metrics[i].Name),
+						zap.String("path_expression", res.Metrics[i].PathExpression),
+					)
+					continue
+				}
+				p.response = append(p.response, res.Metrics[i])
+			}
+		}
+
+		for _, p := range batch {
+			if !p.cacheable {
+				continue
+			}
+			if err != nil && !merry.Is(err, types.ErrNotFound) && merry.HTTPCode(err) != 404 {
+				// partial data is not stored
+				p.failed = true
+				continue
+			}
+			if p.storeUntil > p.fetchFrom {
+				g.cache.store(g.Name(), p.request, p.fetchFrom, p.storeUntil, p.response)
+			}
+		}
+	}
+
+	return lastErr
+}
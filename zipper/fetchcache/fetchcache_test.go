@@ -0,0 +1,190 @@
+package fetchcache
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ansel1/merry"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/zipper/config"
+	"github.com/go-graphite/carbonapi/zipper/dummy"
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+// seriesBackend returns series with value equal to the timestamp, like go-carbon does: points are in (from, until]
+type seriesBackend struct {
+	*dummy.DummyClient
+
+	step     int64
+	names    []string
+	requests []protov3.FetchRequest
+	now      int64
+}
+
+func (b *seriesBackend) Fetch(ctx context.Context, request *protov3.MultiFetchRequest) (*protov3.MultiFetchResponse, *types.Stats, merry.Error) {
+	res := &protov3.MultiFetchResponse{}
+	for _, r := range request.Metrics {
+		b.requests = append(b.requests, r)
+		from := r.StartTime - r.StartTime%b.step + b.step
+		until := r.StopTime - r.StopTime%b.step + b.step
+		for _, name := range b.names {
+			m := protov3.FetchResponse{
+				Name:              name,
+				PathExpression:    r.PathExpression,
+				ConsolidationFunc: "average",
+				StartTime:         from,
+				StopTime:          until,
+				StepTime:          b.step,
+			}
+			for ts := from; ts < until; ts += b.step {
+				v := float64(ts)
+				if ts > b.now {
+					v = math.NaN()
+				}
+				m.Values = append(m.Values, v)
+			}
+			res.Metrics = append(res.Metrics, m)
+		}
+	}
+	return res, &types.Stats{RenderRequests: 1}, nil
+}
+
+func fetchRange(t *testing.T, g types.BackendServer, from, until int64) (*protov3.MultiFetchResponse, *types.Stats) {
+	t.Helper()
+	res, stats, err := g.Fetch(context.Background(), &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{{Name: "a.*", PathExpression: "a.*", StartTime: from, StopTime: until}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return res, stats
+}
+
+func TestFetchCache(t *testing.T) {
+	now := int64(36000)
+	backend := &seriesBackend{
+		DummyClient: dummy.NewDummyClient("group", []string{"server"}, 0),
+		step:        60,
+		names:       []string{"a.b", "a.c"},
+		now:         now,
+	}
+	cache := New(config.FetchCache{
+		Enabled:       true,
+		ChunkSize:     10 * time.Minute,
+		MutableWindow: 5 * time.Minute,
+		TTL:           time.Hour,
+	})
+	cache.now = func() int64 { return now }
+	g := cache.Wrap(zap.NewNop(), backend)
+
+	check := func(res *protov3.MultiFetchResponse, from, until int64) {
+		t.Helper()
+		uncached, _, _ := backend.Fetch(context.Background(), &protov3.MultiFetchRequest{
+			Metrics: []protov3.FetchRequest{{Name: "a.*", PathExpression: "a.*", StartTime: from, StopTime: until}},
+		})
+		backend.requests = backend.requests[:len(backend.requests)-1]
+		if len(res.Metrics) != len(uncached.Metrics) {
+			t.Fatalf("got %d series, expected %d", len(res.Metrics), len(uncached.Metrics))
+		}
+		for i := range res.Metrics {
+			got, expected := res.Metrics[i], uncached.Metrics[i]
+			if got.Name != expected.Name || got.StartTime != expected.StartTime || got.StopTime != expected.StopTime || got.StepTime != expected.StepTime {
+				t.Fatalf("series mismatch, got %v (%d-%d/%d), expected %v (%d-%d/%d)",
+					got.Name, got.StartTime, got.StopTime, got.StepTime, expected.Name, expected.StartTime, expected.StopTime, expected.StepTime)
+			}
+			if len(got.Values) != len(expected.Values) {
+				t.Fatalf("%s: got %d values, expected %d", got.Name, len(got.Values), len(expected.Values))
+			}
+			for j := range got.Values {
+				if got.Values[j] != expected.Values[j] && !(math.IsNaN(got.Values[j]) && math.IsNaN(expected.Values[j])) {
+					t.Fatalf("%s: value %d mismatch, got %v, expected %v", got.Name, j, got.Values[j], expected.Values[j])
+				}
+			}
+		}
+	}
+
+	// first request fetches everything
+	from, until := now-6*3600, now
+	res, stats := fetchRange(t, g, from, until)
+	check(res, from, until)
+	if stats.FetchCacheHits != 0 || stats.FetchCacheMisses != 37 || stats.RenderRequests != 1 {
+		t.Fatalf("unexpected stats for the first request: %+v", stats)
+	}
+
+	// a minute later only the mutable tail is fetched
+	now += 60
+	backend.now = now
+	from, until = now-6*3600, now
+	res, stats = fetchRange(t, g, from, until)
+	check(res, from, until)
+	if stats.FetchCacheHits != 35 || stats.FetchCacheMisses != 2 {
+		t.Fatalf("unexpected stats for the second request: %+v", stats)
+	}
+	last := backend.requests[len(backend.requests)-1]
+	if last.StartTime != 35399 || last.StopTime != until {
+		t.Fatalf("unexpected fetched range %d-%d", last.StartTime, last.StopTime)
+	}
+
+	// previous tail became immutable and is fetched once more to be stored
+	now += 600
+	backend.now = now
+	from, until = now-6*3600, now
+	res, stats = fetchRange(t, g, from, until)
+	check(res, from, until)
+	if stats.FetchCacheHits != 34 || stats.FetchCacheMisses != 3 {
+		t.Fatalf("unexpected stats for the third request: %+v", stats)
+	}
+
+	s := GetGroupStats("group")
+	if s.Hits != 69 || s.Misses != 42 {
+		t.Fatalf("unexpected group stats: %+v", s)
+	}
+}
+
+func TestFetchCachePassThrough(t *testing.T) {
+	now := int64(36000)
+	backend := &seriesBackend{
+		DummyClient: dummy.NewDummyClient("passthrough", []string{"server"}, 0),
+		step:        60,
+		names:       []string{"a.b"},
+		now:         now,
+	}
+	cache := New(config.FetchCache{Enabled: true, ChunkSize: 10 * time.Minute, MutableWindow: 5 * time.Minute, TTL: time.Hour})
+	cache.now = func() int64 { return now }
+	g := cache.Wrap(zap.NewNop(), backend)
+
+	tests := []struct {
+		name    string
+		request protov3.FetchRequest
+	}{
+		{
+			name:    "mutable range",
+			request: protov3.FetchRequest{Name: "a.*", PathExpression: "a.*", StartTime: now - 300, StopTime: now},
+		},
+		{
+			name: "filter functions",
+			request: protov3.FetchRequest{Name: "a.*", PathExpression: "a.*", StartTime: now - 3600, StopTime: now,
+				FilterFunctions: []*protov3.FilteringFunction{{Name: "sum"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend.requests = nil
+			_, stats, err := g.Fetch(context.Background(), &protov3.MultiFetchRequest{Metrics: []protov3.FetchRequest{tt.request}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if stats.FetchCacheHits+stats.FetchCacheMisses != 0 {
+				t.Fatalf("request was cached: %+v", stats)
+			}
+			if len(backend.requests) != 1 || backend.requests[0].StartTime != tt.request.StartTime || backend.requests[0].StopTime != tt.request.StopTime {
+				t.Fatalf("request was changed: %+v", backend.requests)
+			}
+		})
+	}
+}
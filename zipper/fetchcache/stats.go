@@ -0,0 +1,41 @@
+package fetchcache
+
+import (
+	"sort"
+	"sync"
+)
+
+// GroupStats counts time chunks of fetched series in backend group, that were taken from the cache or fetched from backends.
+// All counters must be accessed atomically.
+type GroupStats struct {
+	Group string
+
+	Hits   uint64
+	Misses uint64
+}
+
+var groupStats sync.Map
+
+// GetGroupStats returns counters for the backend group, creating them if needed
+func GetGroupStats(group string) *GroupStats {
+	if s, ok := groupStats.Load(group); ok {
+		return s.(*GroupStats)
+	}
+	s, _ := groupStats.LoadOrStore(group, &GroupStats{Group: group})
+	return s.(*GroupStats)
+}
+
+// EachGroupStats calls f for every backend group with the cache, sorted by group name
+func EachGroupStats(f func(s *GroupStats)) {
+	var list []*GroupStats
+	groupStats.Range(func(_, v interface{}) bool {
+		list = append(list, v.(*GroupStats))
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Group < list[j].Group
+	})
+	for _, s := range list {
+		f(s)
+	}
+}
@@ -0,0 +1,79 @@
+package helper
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+const (
+	latencySamples = 256
+	// minLatencySamples is a count of samples, required to calculate hedging delay from latencies
+	minLatencySamples = 20
+	// recalcEvery is a count of new samples, after which delay is calculated again
+	recalcEvery = 8
+)
+
+// errHedgeLost is a cause of cancellation of the request, that is still running, when hedged request is answered
+var errHedgeLost = errors.New("hedged request is answered")
+
+// latencyWindow keeps latencies of recent successful requests and cancelled losers of hedged requests of the group and calculates delay before hedged request
+type latencyWindow struct {
+	hedging types.Hedging
+
+	mu         sync.Mutex
+	samples    [latencySamples]time.Duration
+	count      int
+	hedgeDelay time.Duration
+}
+
+func newLatencyWindow(hedging types.Hedging) *latencyWindow {
+	hedging = hedging.WithDefaults()
+	return &latencyWindow{
+		hedging:    hedging,
+		hedgeDelay: hedging.MaxDelay,
+	}
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.samples[w.count%latencySamples] = d
+	w.count++
+	if w.count >= minLatencySamples && (w.count-minLatencySamples)%recalcEvery == 0 {
+		w.hedgeDelay = w.percentile()
+	}
+}
+
+// percentile returns configured percentile of latencies, limited by MinDelay and MaxDelay. Must be called with lock held.
+func (w *latencyWindow) percentile() time.Duration {
+	n := min(w.count, latencySamples)
+	sorted := make([]time.Duration, n)
+	copy(sorted, w.samples[:n])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := int(math.Ceil(w.hedging.Percentile/100*float64(n))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	d := sorted[idx]
+	if d < w.hedging.MinDelay {
+		return w.hedging.MinDelay
+	}
+	if d > w.hedging.MaxDelay {
+		return w.hedging.MaxDelay
+	}
+	return d
+}
+
+// delay returns time to wait for the response, before the request is sent to a second server
+func (w *latencyWindow) delay() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.hedgeDelay
+}
@@ -0,0 +1,34 @@
+package helper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	w := newLatencyWindow(types.Hedging{Percentile: 90, MinDelay: 5 * time.Millisecond, MaxDelay: 500 * time.Millisecond})
+
+	// MaxDelay is used until there are enough samples
+	for i := 1; i < minLatencySamples; i++ {
+		w.add(time.Millisecond)
+	}
+	assert.Equal(t, 500*time.Millisecond, w.delay())
+
+	// delay is limited by MinDelay
+	w.add(time.Millisecond)
+	assert.Equal(t, 5*time.Millisecond, w.delay())
+
+	for i := 1; i <= latencySamples; i++ {
+		w.add(time.Duration(i) * time.Millisecond)
+	}
+	assert.Equal(t, 231*time.Millisecond, w.delay())
+
+	for i := 0; i < latencySamples; i++ {
+		w.add(time.Second)
+	}
+	assert.Equal(t, 500*time.Millisecond, w.delay())
+}
@@ -8,12 +8,14 @@ import (
 	"net/url"
 	"strings"
 	"sync/atomic"
+	"time"
 	"unicode/utf8"
 
 	"github.com/ansel1/merry"
 	"go.uber.org/zap"
 
 	"github.com/go-graphite/carbonapi/limiter"
+	"github.com/go-graphite/carbonapi/pkg/tracing"
 	util "github.com/go-graphite/carbonapi/util/ctx"
 	"github.com/go-graphite/carbonapi/zipper/types"
 )
@@ -81,8 +83,9 @@ func stripHtmlTags(s string, maxLen int) string {
 }
 
 type ServerResponse struct {
-	Server   string
-	Response []byte
+	Server      string
+	Response    []byte
+	ContentType string
 }
 
 type HttpQuery struct {
@@ -92,6 +95,11 @@ type HttpQuery struct {
 	limiter   limiter.ServerLimiter
 	client    *http.Client
 	encoding  string
+	lbMethod  types.LBMethod
+	// latencies are tracked only if hedging is enabled
+	latencies *latencyWindow
+	// maxResponseSize is a limit of the response body in bytes, 0 means no limit
+	maxResponseSize int64
 
 	counter uint64
 }
@@ -107,24 +115,65 @@ func NewHttpQuery(groupName string, servers []string, maxTries int, limiter limi
 	}
 }
 
-func (c *HttpQuery) pickServer(logger *zap.Logger) string {
+// Configure sets balancing of requests between servers and hedging from the config of backend group
+func (c *HttpQuery) Configure(config types.BackendV2) *HttpQuery {
+	var lbMethod types.LBMethod
+	if err := lbMethod.FromString(config.LBMethod); err == nil && lbMethod == types.LeastLoadedLB {
+		c.lbMethod = lbMethod
+	}
+	if config.Hedging != nil && config.Hedging.Enabled && len(c.servers) > 1 {
+		c.latencies = newLatencyWindow(*config.Hedging)
+	}
+	return c
+}
+
+// WithMaxResponseSize limits size of the response body, larger responses fail with types.ErrResponseTooLarge.
+// 0 means no limit.
+func (c *HttpQuery) WithMaxResponseSize(size int64) *HttpQuery {
+	c.maxResponseSize = size
+	return c
+}
+
+// pickServer returns next server to send request to. Excluded server (e.g. the failed one) is not picked, if there are others.
+func (c *HttpQuery) pickServer(logger *zap.Logger, exclude string) string {
 	if len(c.servers) == 1 {
 		// No need to do heavy operations here
 		return c.servers[0]
 	}
 	logger = logger.With(zap.String("function", "picker"))
 	counter := atomic.AddUint64(&(c.counter), 1)
-	idx := counter % uint64(len(c.servers))
-	srv := c.servers[int(idx)]
+	idx := int(counter % uint64(len(c.servers)))
+	if c.lbMethod == types.LeastLoadedLB {
+		idx = c.leastLoaded(idx, exclude)
+	} else if c.servers[idx] == exclude {
+		idx = (idx + 1) % len(c.servers)
+	}
+	srv := c.servers[idx]
 	logger.Debug("picked",
 		zap.Uint64("counter", counter),
-		zap.Uint64("idx", idx),
+		zap.Int("idx", idx),
 		zap.String("server", srv),
 	)
 
 	return srv
 }
 
+// leastLoaded returns index of the server with the fewest requests in the limiter. Servers are checked from start,
+// so equally loaded servers get requests in turn.
+func (c *HttpQuery) leastLoaded(start int, exclude string) int {
+	best, bestLoad := start, -1
+	for i := range c.servers {
+		idx := (start + i) % len(c.servers)
+		if c.servers[idx] == exclude {
+			continue
+		}
+		if load := c.limiter.Load(c.servers[idx]); bestLoad == -1 || load < bestLoad {
+			best, bestLoad = idx, load
+		}
+	}
+	return best
+}
+
 func (c *HttpQuery) doRequest(ctx context.Context, logger *zap.Logger, server, uri string, r types.Request) (*ServerResponse, merry.Error) {
 	logger = logger.With(
 		zap.String("function", "HttpQuery.doRequest"),
@@ -152,14 +201,32 @@ func (c *HttpQuery) doRequest(ctx context.Context, logger *zap.Logger, server, u
 		zap.String("uri", u.String()),
 	)
 
+	method := "GET"
+	httpRequest, isHTTPRequest := r.(types.HTTPRequest)
+	if isHTTPRequest {
+		method = httpRequest.Method()
+	}
+
 	// TODO: change to NewRequestWithContext
-	req, err := http.NewRequest("GET", u.String(), reader)
+	req, err := http.NewRequest(method, u.String(), reader)
 	if err != nil {
 		return nil, merry.Here(err).WithValue("server", server)
 	}
 
+	spanCtx, span := tracing.StartSpan(ctx, "HTTP "+method+" "+u.Path, tracing.SpanKindClient)
+	defer span.End()
+	span.SetAttribute("backend.group", c.groupName)
+	span.SetAttribute("backend.server", server)
+	span.SetAttribute("http.url", u.String())
+
 	req.Header.Set("Accept", c.encoding)
+	if isHTTPRequest {
+		for k, v := range httpRequest.Headers() {
+			req.Header.Set(k, v)
+		}
+	}
 	req = util.MarshalPassHeaders(ctx, util.MarshalCtx(ctx, util.MarshalCtx(ctx, req, util.HeaderUUIDZipper), util.HeaderUUIDAPI))
+	req = util.MarshalTraceContext(spanCtx, req)
 
 	logger.Debug("trying to get slot",
 		zap.String("name", server),
@@ -179,40 +246,148 @@ func (c *HttpQuery) doRequest(ctx context.Context, logger *zap.Logger, server, u
 	if r != nil {
 		logger = logger.With(zap.Any("payloadData", r.LogInfo()))
 	}
+
+	stats := GetServerStats(c.groupName, server)
+	stats.enter()
+	t0 := time.Now()
+	defer func() {
+		stats.leave(time.Since(t0).Nanoseconds())
+	}()
+	// loser of hedged request is cancelled before it's answered, so its latency is at least the time it has run.
+	// Otherwise only fast responses are recorded and the delay is underestimated on a slow server.
+	addCancelledLatency := func() {
+		if c.latencies != nil && context.Cause(ctx) == errHedgeLost {
+			c.latencies.add(time.Since(t0))
+		}
+	}
+
 	resp, err := c.client.Do(req.WithContext(ctx))
 	if err != nil {
 		logger.Debug("error fetching result",
 			zap.Error(err),
 		)
 
-		return nil, requestError(err, server)
-
+		e := requestError(err, server)
+		if merry.Is(e, types.ErrTimeoutExceeded) {
+			atomic.AddUint64(&stats.Timeouts, 1)
+		}
+		// cancelled requests (e.g. losers of hedged requests) are not server errors
+		if ctx.Err() != context.Canceled {
+			atomic.AddUint64(&stats.Errors, 1)
+		}
+		addCancelledLatency()
+		span.SetError(e)
+		return nil, e
 	}
 	defer func() {
 		_ = resp.Body.Close()
 	}()
 
+	span.SetAttribute("http.status_code", resp.StatusCode)
+
 	// we don't need to process any further if the response is empty.
 	if resp.StatusCode == http.StatusNotFound {
 		return &ServerResponse{Server: server}, nil
 	}
 
-	body, err = io.ReadAll(resp.Body)
+	var bodyReader io.Reader = resp.Body
+	if c.maxResponseSize > 0 {
+		bodyReader = io.LimitReader(resp.Body, c.maxResponseSize+1)
+	}
+	body, err = io.ReadAll(bodyReader)
+	if err == nil && c.maxResponseSize > 0 && int64(len(body)) > c.maxResponseSize {
+		atomic.AddUint64(&stats.Errors, 1)
+		span.SetError(types.ErrResponseTooLarge)
+		return nil, types.ErrResponseTooLarge.WithValue("server", server).WithMessagef("response is larger than %d bytes", c.maxResponseSize)
+	}
 	if err != nil {
 		logger.Debug("error reading body",
 			zap.Error(err),
 		)
+		if ctx.Err() != context.Canceled {
+			atomic.AddUint64(&stats.Errors, 1)
+		}
+		addCancelledLatency()
+		span.SetError(err)
 		return nil, merry.Here(err).WithValue("server", server)
 	}
 
 	if resp.StatusCode != http.StatusOK {
+		atomic.AddUint64(&stats.Errors, 1)
+		span.SetError(types.ErrFailedToFetch)
 		return nil, types.ErrFailedToFetch.WithValue("server", server).WithMessage(string(body)).WithHTTPCode(resp.StatusCode)
 	}
 
-	return &ServerResponse{Server: server, Response: body}, nil
+	if c.latencies != nil {
+		c.latencies.add(time.Since(t0))
+	}
+
+	return &ServerResponse{Server: server, Response: body, ContentType: resp.Header.Get("Content-Type")}, nil
+}
+
+type hedgedResponse struct {
+	server string
+	res    *ServerResponse
+	err    merry.Error
+	hedged bool
+}
+
+// doHedgedRequest sends the same request to a second server, if the first one hasn't answered in time. The first
+// successful response is returned, the other request is cancelled.
+func (c *HttpQuery) doHedgedRequest(ctx context.Context, logger *zap.Logger, exclude, uri string, r types.Request, stats *types.Stats) (string, *ServerResponse, merry.Error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(errHedgeLost)
+
+	responses := make(chan hedgedResponse, 2)
+	send := func(server string, hedged bool) {
+		res, err := c.doRequest(ctx, logger, server, uri, r)
+		responses <- hedgedResponse{server: server, res: res, err: err, hedged: hedged}
+	}
+
+	server := c.pickServer(logger, exclude)
+	go send(server, false)
+	running := 1
+
+	timer := time.NewTimer(c.latencies.delay())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			hedge := c.pickServer(logger, server)
+			if hedge == server {
+				continue
+			}
+			logger.Debug("sending hedged request",
+				zap.String("server", server),
+				zap.String("hedge", hedge),
+			)
+			if stats != nil {
+				stats.HedgedRequests++
+			}
+			go send(hedge, true)
+			running++
+		case resp := <-responses:
+			running--
+			if resp.err == nil {
+				if resp.hedged && stats != nil {
+					stats.HedgeWins++
+				}
+				return resp.server, resp.res, nil
+			}
+			if running == 0 {
+				return resp.server, nil, resp.err
+			}
+		}
+	}
 }
 
 func (c *HttpQuery) DoQuery(ctx context.Context, logger *zap.Logger, uri string, r types.Request) (resp *ServerResponse, err merry.Error) {
+	return c.DoQueryWithStats(ctx, logger, uri, r, nil)
+}
+
+// DoQueryWithStats sends request to one of the servers like DoQuery and counts hedged requests in stats
+func (c *HttpQuery) DoQueryWithStats(ctx context.Context, logger *zap.Logger, uri string, r types.Request, stats *types.Stats) (resp *ServerResponse, err merry.Error) {
 	maxTries := c.maxTries
 	if len(c.servers) > maxTries {
 		maxTries = len(c.servers)
@@ -220,9 +395,17 @@ func (c *HttpQuery) DoQuery(ctx context.Context, logger *zap.Logger, uri string,
 
 	e := types.ErrFailedToFetch.WithValue("uri", uri)
 	code := http.StatusInternalServerError
+	var failed string
 	for try := 0; try < maxTries; try++ {
-		server := c.pickServer(logger)
-		res, err := c.doRequest(ctx, logger, server, uri, r)
+		var server string
+		var res *ServerResponse
+		var err merry.Error
+		if c.latencies != nil {
+			server, res, err = c.doHedgedRequest(ctx, logger, failed, uri, r, stats)
+		} else {
+			server = c.pickServer(logger, failed)
+			res, err = c.doRequest(ctx, logger, server, uri, r)
+		}
 		if err != nil {
 			logger.Debug("have errors",
 				zap.String("error", err.Error()),
@@ -231,6 +414,7 @@ func (c *HttpQuery) DoQuery(ctx context.Context, logger *zap.Logger, uri string,
 
 			e = e.WithCause(err).WithHTTPCode(merry.HTTPCode(err))
 			code = merry.HTTPCode(err)
+			failed = server
 			// TODO (msaf1980): may be metric for server failures ?
 			// TODO (msaf1980): may be retry policy for avoid retry bad queries ?
 			continue
@@ -1,10 +1,20 @@
 package helper
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/limiter"
+	utilctx "github.com/go-graphite/carbonapi/util/ctx"
+	"github.com/go-graphite/carbonapi/zipper/types"
 )
 
 func Test_stripHtmlTags(t *testing.T) {
@@ -69,3 +79,117 @@ func Test_recalcCode(t *testing.T) {
 		})
 	}
 }
+
+func TestDoQueryPassTraceContext(t *testing.T) {
+	var traceParent, traceState string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceParent = r.Header.Get(utilctx.HeaderTraceParent)
+		traceState = r.Header.Get(utilctx.HeaderTraceState)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	h := http.Header{}
+	h.Set(utilctx.HeaderTraceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.Set(utilctx.HeaderTraceState, "congo=t61rcWkgMzE")
+	ctx := utilctx.ParseTraceHeaders(context.Background(), h)
+
+	q := NewHttpQuery("test", []string{srv.URL}, 1, limiter.NoopLimiter{}, srv.Client(), "text/plain")
+	res, err := q.DoQuery(ctx, zap.NewNop(), "/render/", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "ok", string(res.Response))
+	assert.Equal(t, h.Get(utilctx.HeaderTraceParent), traceParent)
+	assert.Equal(t, h.Get(utilctx.HeaderTraceState), traceState)
+}
+
+func TestDoQueryLeastLoaded(t *testing.T) {
+	var requests [2]uint64
+	newServer := func(i int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddUint64(&requests[i], 1)
+			_, _ = w.Write([]byte(strconv.Itoa(i)))
+		}))
+	}
+	srv0, srv1 := newServer(0), newServer(1)
+	defer srv0.Close()
+	defer srv1.Close()
+
+	servers := []string{srv0.URL, srv1.URL}
+	l := limiter.NewServerLimiter(servers, 0)
+	q := NewHttpQuery("test", servers, 1, l, srv0.Client(), "text/plain").Configure(types.BackendV2{LBMethod: "least_loaded"})
+
+	// the first server has a request in flight, so all requests go to the second one
+	if !assert.NoError(t, l.Enter(context.Background(), srv0.URL)) {
+		return
+	}
+	assert.Equal(t, 1, l.Load(srv0.URL))
+	for i := 0; i < 4; i++ {
+		res, err := q.DoQuery(context.Background(), zap.NewNop(), "/render/", nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "1", string(res.Response))
+	}
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&requests[0]))
+	assert.Equal(t, 0, l.Load(srv1.URL))
+
+	// equally loaded servers get requests in turn
+	l.Leave(context.Background(), srv0.URL)
+	for i := 0; i < 4; i++ {
+		_, err := q.DoQuery(context.Background(), zap.NewNop(), "/render/", nil)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&requests[0]))
+	assert.Equal(t, uint64(6), atomic.LoadUint64(&requests[1]))
+}
+
+func TestDoQueryHedging(t *testing.T) {
+	cancelled := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(5 * time.Second):
+			_, _ = w.Write([]byte("slow"))
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	// round robin picks the second server first
+	servers := []string{fast.URL, slow.URL}
+	q := NewHttpQuery("test", servers, 1, limiter.NewServerLimiter(servers, 0), fast.Client(), "text/plain").Configure(types.BackendV2{
+		Hedging: &types.Hedging{Enabled: true, MaxDelay: 20 * time.Millisecond},
+	})
+
+	stats := &types.Stats{}
+	res, err := q.DoQueryWithStats(context.Background(), zap.NewNop(), "/render/", nil, stats)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "fast", string(res.Response))
+	assert.Equal(t, uint64(1), stats.HedgedRequests)
+	assert.Equal(t, uint64(1), stats.HedgeWins)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("request to the slow server is not cancelled")
+	}
+
+	// cancelled loser is recorded with the time it has run
+	latencies := func() []time.Duration {
+		q.latencies.mu.Lock()
+		defer q.latencies.mu.Unlock()
+		return append([]time.Duration(nil), q.latencies.samples[:q.latencies.count]...)
+	}
+	assert.Eventually(t, func() bool { return len(latencies()) == 2 }, time.Second, time.Millisecond)
+	if samples := latencies(); len(samples) == 2 {
+		assert.GreaterOrEqual(t, max(samples[0], samples[1]), 20*time.Millisecond)
+	}
+}
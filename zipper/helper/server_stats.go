@@ -0,0 +1,66 @@
+package helper
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ServerStats contains per-server request counters, collected by HttpQuery.
+// All counters must be accessed atomically.
+type ServerStats struct {
+	Group  string
+	Server string
+
+	Requests uint64
+	Errors   uint64
+	Timeouts uint64
+	// TimeNS is a total time spent in requests, in nanoseconds
+	TimeNS   uint64
+	InFlight int64
+}
+
+type serverStatsKey struct {
+	group  string
+	server string
+}
+
+var serverStats sync.Map
+
+// GetServerStats returns counters for the server in specified backend group, creating them if needed
+func GetServerStats(group, server string) *ServerStats {
+	k := serverStatsKey{group: group, server: server}
+	if s, ok := serverStats.Load(k); ok {
+		return s.(*ServerStats)
+	}
+	s, _ := serverStats.LoadOrStore(k, &ServerStats{Group: group, Server: server})
+	return s.(*ServerStats)
+}
+
+// EachServerStats calls f for every known server, sorted by group and server name
+func EachServerStats(f func(s *ServerStats)) {
+	var list []*ServerStats
+	serverStats.Range(func(_, v interface{}) bool {
+		list = append(list, v.(*ServerStats))
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Group == list[j].Group {
+			return list[i].Server < list[j].Server
+		}
+		return list[i].Group < list[j].Group
+	})
+	for _, s := range list {
+		f(s)
+	}
+}
+
+func (s *ServerStats) enter() {
+	atomic.AddUint64(&s.Requests, 1)
+	atomic.AddInt64(&s.InFlight, 1)
+}
+
+func (s *ServerStats) leave(durationNS int64) {
+	atomic.AddInt64(&s.InFlight, -1)
+	atomic.AddUint64(&s.TimeNS, uint64(durationNS))
+}
@@ -60,7 +60,7 @@ func NewWithLimiter(logger *zap.Logger, config types.BackendV2, tldCacheDisabled
 
 	httpClient := helper.GetHTTPClient(logger, config)
 
-	httpQuery := helper.NewHttpQuery(config.GroupName, config.Servers, *config.MaxTries, limiter, httpClient, httpHeaders.ContentTypeCarbonAPIv2PB)
+	httpQuery := helper.NewHttpQuery(config.GroupName, config.Servers, *config.MaxTries, limiter, httpClient, httpHeaders.ContentTypeCarbonAPIv2PB).Configure(config)
 
 	c := &GraphiteGroup{
 		groupName:            config.GroupName,
@@ -86,7 +86,7 @@ func New(logger *zap.Logger, config types.BackendV2, tldCacheDisabled, requireSu
 	if len(config.Servers) == 0 {
 		return nil, types.ErrNoServersSpecified
 	}
-	limiter := limiter.NewServerLimiter([]string{config.GroupName}, *config.ConcurrencyLimit)
+	limiter := limiter.NewServerLimiter(config.Servers, *config.ConcurrencyLimit)
 
 	return NewWithLimiter(logger, config, tldCacheDisabled, requireSuccessAll, limiter)
 }
@@ -125,7 +125,7 @@ func (c *GraphiteGroup) Fetch(ctx context.Context, request *protov3.MultiFetchRe
 		}
 		rewrite.RawQuery = v.Encode()
 		stats.RenderRequests++
-		res, err := c.httpQuery.DoQuery(ctx, logger, rewrite.RequestURI(), nil)
+		res, err := c.httpQuery.DoQueryWithStats(ctx, logger, rewrite.RequestURI(), nil, stats)
 		if err != nil {
 			stats.RenderErrors++
 			if merry.Is(err, types.ErrTimeoutExceeded) {
@@ -199,7 +199,7 @@ func (c *GraphiteGroup) Find(ctx context.Context, request *protov3.MultiGlobRequ
 		}
 		rewrite.RawQuery = v.Encode()
 		stats.FindRequests++
-		res, err := c.httpQuery.DoQuery(ctx, logger, rewrite.RequestURI(), nil)
+		res, err := c.httpQuery.DoQueryWithStats(ctx, logger, rewrite.RequestURI(), nil, stats)
 		if err != nil {
 			stats.FindErrors++
 			if merry.Is(err, types.ErrTimeoutExceeded) {
@@ -268,7 +268,7 @@ func (c *GraphiteGroup) Info(ctx context.Context, request *protov3.MultiMetricsI
 		}
 		rewrite.RawQuery = v.Encode()
 		stats.InfoRequests++
-		res, err := c.httpQuery.DoQuery(ctx, logger, rewrite.RequestURI(), nil)
+		res, err := c.httpQuery.DoQueryWithStats(ctx, logger, rewrite.RequestURI(), nil, stats)
 		if err != nil {
 			stats.InfoErrors++
 			if merry.Is(err, types.ErrTimeoutExceeded) {
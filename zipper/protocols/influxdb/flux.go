@@ -0,0 +1,312 @@
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/zipper/helper"
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+// flux queries InfluxDB 2.x with Flux
+type flux struct {
+	httpQuery   *helper.HttpQuery
+	org         string
+	bucket      string
+	token       string
+	aggregation string
+	// lookback limits range of schema requests, as data of buckets is always queried by time
+	lookback time.Duration
+}
+
+// fluxRequest is a types.HTTPRequest with the query in the body
+type fluxRequest struct {
+	Query   string      `json:"query"`
+	Type    string      `json:"type"`
+	Dialect fluxDialect `json:"dialect"`
+
+	token string
+}
+
+type fluxDialect struct {
+	Annotations []string `json:"annotations"`
+}
+
+func (r fluxRequest) Marshal() ([]byte, merry.Error) {
+	b, err := json.Marshal(r)
+	return b, merry.Wrap(err)
+}
+
+func (r fluxRequest) LogInfo() interface{} {
+	return r.Query
+}
+
+func (r fluxRequest) Method() string {
+	return "POST"
+}
+
+func (r fluxRequest) Headers() map[string]string {
+	h := map[string]string{
+		"Content-Type": "application/json",
+		"Accept":       "application/csv",
+	}
+	if r.token != "" {
+		h["Authorization"] = "Token " + r.token
+	}
+	return h
+}
+
+func fluxString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `${`, `\${`).Replace(s) + `"`
+}
+
+// fluxPredicate returns body of predicate function on the record r
+func fluxPredicate(conds []condition) (string, merry.Error) {
+	parts := make([]string, 0, len(conds))
+	for _, c := range conds {
+		switch c.op {
+		case "=~", "!~":
+			re, err := quoteRegexp(c.value)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, "r["+fluxString(c.key)+"] "+c.op+" "+re)
+		case "=":
+			parts = append(parts, "r["+fluxString(c.key)+"] == "+fluxString(c.value))
+		default:
+			parts = append(parts, "r["+fluxString(c.key)+"] != "+fluxString(c.value))
+		}
+	}
+	if len(parts) == 0 {
+		return "true", nil
+	}
+	return strings.Join(parts, " and "), nil
+}
+
+// fluxRow is a row of the response, values are mapped by the name of the column
+type fluxRow map[string]string
+
+// table returns id of the table, that row belongs to
+func (r fluxRow) table() string {
+	return r["result"] + "/" + r["table"]
+}
+
+// tags returns columns of the row, that are tags
+func (r fluxRow) tags() map[string]string {
+	tags := make(map[string]string)
+	for k, v := range r {
+		if k != "result" && k != "table" && !strings.HasPrefix(k, "_") {
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// parseFluxCSV parses annotated CSV. Every table with new schema starts with annotations, so the row after them is
+// the header.
+func parseFluxCSV(b []byte) ([]fluxRow, merry.Error) {
+	reader := csv.NewReader(bytes.NewReader(b))
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = false
+
+	var header []string
+	var rows []fluxRow
+	expectHeader := true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, types.ErrUnmarshalFailed.WithCause(err)
+		}
+		if strings.HasPrefix(record[0], "#") {
+			expectHeader = true
+			continue
+		}
+		if expectHeader {
+			header = record
+			expectHeader = false
+			continue
+		}
+		row := make(fluxRow, len(header))
+		for i, name := range header {
+			if i < len(record) && name != "" {
+				row[name] = record[i]
+			}
+		}
+		// errors, that happen while the response is written, are reported as a table with 'error' column
+		if msg, ok := row["error"]; ok && len(header) <= 3 {
+			return nil, types.ErrFailedToFetch.WithMessage(msg)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func (d *flux) query(ctx context.Context, logger *zap.Logger, stats *types.Stats, q string) ([]fluxRow, merry.Error) {
+	logger.Debug("will do query",
+		zap.String("query", q),
+	)
+	req := fluxRequest{
+		Query:   q,
+		Type:    "flux",
+		Dialect: fluxDialect{Annotations: []string{"datatype"}},
+		token:   d.token,
+	}
+	uri := "/api/v2/query"
+	if d.org != "" {
+		uri += "?org=" + url.QueryEscape(d.org)
+	}
+	res, err := d.httpQuery.DoQueryWithStats(ctx, logger, uri, req, stats)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil || len(res.Response) == 0 {
+		return nil, nil
+	}
+	return parseFluxCSV(res.Response)
+}
+
+func (d *flux) start() string {
+	return "-" + strconv.FormatInt(int64(d.lookback.Seconds()), 10) + "s"
+}
+
+// schemaQuery runs function of influxdata/influxdb/schema package and returns _value column
+func (d *flux) schemaQuery(ctx context.Context, logger *zap.Logger, stats *types.Stats, fn, args string, conds []condition, filter string) ([]string, merry.Error) {
+	predicate, err := fluxPredicate(conds)
+	if err != nil {
+		return nil, err
+	}
+	q := "import \"influxdata/influxdb/schema\"\n" +
+		"schema." + fn + "(bucket: " + fluxString(d.bucket) + args + ", predicate: (r) => " + predicate + ", start: " + d.start() + ")"
+	if filter != "" {
+		q += "\n  |> filter(fn: (r) => " + filter + ")"
+	}
+	rows, err := d.query(ctx, logger, stats, q)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(rows))
+	for _, row := range rows {
+		res = append(res, row["_value"])
+	}
+	return res, nil
+}
+
+func (d *flux) measurements(ctx context.Context, logger *zap.Logger, stats *types.Stats, re string, conds []condition) ([]string, merry.Error) {
+	var filter string
+	if re != "" {
+		quoted, err := quoteRegexp(re)
+		if err != nil {
+			return nil, err
+		}
+		filter = "r._value =~ " + quoted
+	}
+	return d.schemaQuery(ctx, logger, stats, "tagValues", ", tag: \"_measurement\"", conds, filter)
+}
+
+func (d *flux) series(ctx context.Context, logger *zap.Logger, stats *types.Stats, measurement string, conds []condition) ([]map[string]string, merry.Error) {
+	conds = append([]condition{{key: "_measurement", op: "=", value: measurement}}, conds...)
+	predicate, err := fluxPredicate(conds)
+	if err != nil {
+		return nil, err
+	}
+	q := "from(bucket: " + fluxString(d.bucket) + ")\n" +
+		"  |> range(start: " + d.start() + ")\n" +
+		"  |> filter(fn: (r) => " + predicate + ")\n" +
+		"  |> last()"
+	rows, err := d.query(ctx, logger, stats, q)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]map[string]string, 0, len(rows))
+	for _, row := range rows {
+		res = append(res, row.tags())
+	}
+	return res, nil
+}
+
+func (d *flux) fieldKeys(ctx context.Context, logger *zap.Logger, stats *types.Stats, measurement string) ([]string, merry.Error) {
+	return d.schemaQuery(ctx, logger, stats, "fieldKeys", "", []condition{{key: "_measurement", op: "=", value: measurement}}, "")
+}
+
+func (d *flux) tagKeys(ctx context.Context, logger *zap.Logger, stats *types.Stats, conds []condition) ([]string, merry.Error) {
+	keys, err := d.schemaQuery(ctx, logger, stats, "tagKeys", "", conds, "")
+	if err != nil {
+		return nil, err
+	}
+	res := keys[:0]
+	for _, k := range keys {
+		if !strings.HasPrefix(k, "_") {
+			res = append(res, k)
+		}
+	}
+	return res, nil
+}
+
+func (d *flux) tagValues(ctx context.Context, logger *zap.Logger, stats *types.Stats, key string, conds []condition) ([]string, merry.Error) {
+	return d.schemaQuery(ctx, logger, stats, "tagValues", ", tag: "+fluxString(key), conds, "")
+}
+
+func (d *flux) fetch(ctx context.Context, logger *zap.Logger, stats *types.Stats, q fetchQuery) ([]rawSeries, merry.Error) {
+	conds := append([]condition{
+		{key: "_measurement", op: "=", value: q.measurement},
+		{key: "_field", op: "=", value: q.field},
+	}, q.conditions...)
+
+	predicate, err := fluxPredicate(conds)
+	if err != nil {
+		return nil, err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("from(bucket: " + fluxString(d.bucket) + ")\n")
+	sb.WriteString("  |> range(start: " + strconv.FormatInt(q.from, 10) + ", stop: " + strconv.FormatInt(q.until+1, 10) + ")\n")
+	sb.WriteString("  |> filter(fn: (r) => " + predicate + ")\n")
+	if q.groupBy != nil {
+		columns := []string{fluxString("_measurement"), fluxString("_field")}
+		for _, tag := range q.groupBy {
+			columns = append(columns, fluxString(tag))
+		}
+		sb.WriteString("  |> group(columns: [" + strings.Join(columns, ", ") + "])\n")
+	}
+	sb.WriteString("  |> aggregateWindow(every: " + strconv.FormatInt(q.step, 10) + "s, fn: " + d.aggregation + ", createEmpty: true, timeSrc: \"_start\")")
+
+	rows, err := d.query(ctx, logger, stats, sb.String())
+	if err != nil {
+		return nil, err
+	}
+	var res []rawSeries
+	tables := make(map[string]int)
+	for _, row := range rows {
+		t, e := time.Parse(time.RFC3339Nano, row["_time"])
+		if e != nil {
+			return nil, types.ErrUnmarshalFailed.WithCause(e).WithValue("time", row["_time"])
+		}
+		p := point{timestamp: t.Unix(), value: nan}
+		if v := row["_value"]; v != "" {
+			if p.value, e = strconv.ParseFloat(v, 64); e != nil {
+				return nil, types.ErrUnmarshalFailed.WithCause(e).WithValue("value", v)
+			}
+		}
+		idx, ok := tables[row.table()]
+		if !ok {
+			idx = len(res)
+			tables[row.table()] = idx
+			res = append(res, rawSeries{tags: row.tags()})
+		}
+		res[idx].points = append(res[idx].points, p)
+	}
+	return res, nil
+}
@@ -0,0 +1,690 @@
+package influxdb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/limiter"
+	"github.com/go-graphite/carbonapi/zipper/helper"
+	"github.com/go-graphite/carbonapi/zipper/metadata"
+	"github.com/go-graphite/carbonapi/zipper/protocols/prometheus/helpers"
+	prometheusTypes "github.com/go-graphite/carbonapi/zipper/protocols/prometheus/types"
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+func init() {
+	aliases := []string{"influxdb", "influx"}
+	metadata.Metadata.Lock()
+	for _, name := range aliases {
+		metadata.Metadata.SupportedProtocols[name] = struct{}{}
+		metadata.Metadata.ProtocolInits[name] = New
+		metadata.Metadata.ProtocolInitsWithLimiter[name] = NewWithLimiter
+	}
+	defer metadata.Metadata.Unlock()
+}
+
+var ErrInvalidTagExpression = merry.New("invalid tag expression").WithHTTPCode(http.StatusBadRequest)
+
+var nan = math.NaN()
+
+var aggregations = map[string]bool{
+	"mean":   true,
+	"median": true,
+	"sum":    true,
+	"min":    true,
+	"max":    true,
+	"first":  true,
+	"last":   true,
+	"count":  true,
+}
+
+// dialect builds queries in one of query languages of InfluxDB and parses responses
+type dialect interface {
+	// measurements returns names of measurements, that match regular expression (if it's not empty) and have series
+	// matching the conditions
+	measurements(ctx context.Context, logger *zap.Logger, stats *types.Stats, re string, conds []condition) ([]string, merry.Error)
+	// series returns tags of series of the measurement, that match the conditions
+	series(ctx context.Context, logger *zap.Logger, stats *types.Stats, measurement string, conds []condition) ([]map[string]string, merry.Error)
+	// fieldKeys returns numeric fields of the measurement
+	fieldKeys(ctx context.Context, logger *zap.Logger, stats *types.Stats, measurement string) ([]string, merry.Error)
+	tagKeys(ctx context.Context, logger *zap.Logger, stats *types.Stats, conds []condition) ([]string, merry.Error)
+	tagValues(ctx context.Context, logger *zap.Logger, stats *types.Stats, key string, conds []condition) ([]string, merry.Error)
+	fetch(ctx context.Context, logger *zap.Logger, stats *types.Stats, q fetchQuery) ([]rawSeries, merry.Error)
+}
+
+type fetchQuery struct {
+	measurement string
+	field       string
+	conditions  []condition
+	// groupBy are tags, that series are grouped by. nil means all tags.
+	groupBy []string
+
+	from  int64
+	until int64
+	step  int64
+}
+
+type point struct {
+	timestamp int64
+	value     float64
+}
+
+type rawSeries struct {
+	tags   map[string]string
+	points []point
+}
+
+// InfluxDBGroup is a protocol group, that maps graphite paths onto measurements, tags and fields of InfluxDB
+type InfluxDBGroup struct {
+	groupName string
+	servers   []string
+	protocol  string
+
+	client *http.Client
+
+	limiter              limiter.ServerLimiter
+	logger               *zap.Logger
+	timeout              types.Timeouts
+	maxTries             int
+	maxMetricsPerRequest int
+
+	step     int64
+	template template
+	dialect  dialect
+
+	httpQuery *helper.HttpQuery
+}
+
+func stringOption(logger *zap.Logger, config types.BackendV2, name, defaultValue string) string {
+	v, ok := config.BackendOptions[name]
+	if !ok {
+		return defaultValue
+	}
+	s, ok := v.(string)
+	if !ok {
+		logger.Fatal("failed to parse option",
+			zap.String("option_name", name),
+			zap.String("type_parsed", fmt.Sprintf("%T", v)),
+			zap.String("type_expected", "string"),
+		)
+	}
+	return s
+}
+
+func durationOption(logger *zap.Logger, config types.BackendV2, name, defaultValue string) time.Duration {
+	s := stringOption(logger, config, name, defaultValue)
+	if s != "" && s[len(s)-1] >= '0' && s[len(s)-1] <= '9' {
+		s += "s"
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < time.Second {
+		logger.Fatal("failed to parse option",
+			zap.String("option_name", name),
+			zap.String("option_value", s),
+			zap.Error(err),
+		)
+	}
+	return d
+}
+
+func NewWithLimiter(logger *zap.Logger, config types.BackendV2, tldCacheDisabled, requireSuccessAll bool, limiter limiter.ServerLimiter) (types.BackendServer, merry.Error) {
+	logger = logger.With(zap.String("type", "influxdb"), zap.String("protocol", config.Protocol), zap.String("name", config.GroupName))
+
+	logger.Warn("support for this backend protocol is experimental, use with caution")
+	httpClient := helper.GetHTTPClient(logger, config)
+
+	tmpl, err := parseTemplate(stringOption(logger, config, "template", "measurement.field"))
+	if err != nil {
+		logger.Fatal("failed to parse option",
+			zap.String("option_name", "template"),
+			zap.Error(err),
+		)
+	}
+
+	aggregation := stringOption(logger, config, "aggregation", "mean")
+	if !aggregations[aggregation] {
+		logger.Fatal("unsupported aggregation",
+			zap.String("option_name", "aggregation"),
+			zap.String("option_value", aggregation),
+		)
+	}
+
+	version := 1
+	if v, ok := config.BackendOptions["version"]; ok {
+		if version, ok = v.(int); !ok || (version != 1 && version != 2) {
+			logger.Fatal("failed to parse option",
+				zap.String("option_name", "version"),
+				zap.Any("option_value", v),
+				zap.String("type_expected", "1 or 2"),
+			)
+		}
+	}
+
+	httpQuery := helper.NewHttpQuery(config.GroupName, config.Servers, *config.MaxTries, limiter, httpClient, "application/json").Configure(config)
+
+	var d dialect
+	if version == 1 {
+		if stringOption(logger, config, "database", "") == "" {
+			logger.Fatal("database is not set for InfluxDB 1.x")
+		}
+		d = &influxQL{
+			httpQuery:       httpQuery,
+			database:        stringOption(logger, config, "database", ""),
+			retentionPolicy: stringOption(logger, config, "retention_policy", ""),
+			username:        stringOption(logger, config, "username", ""),
+			password:        stringOption(logger, config, "password", ""),
+			aggregation:     aggregation,
+		}
+	} else {
+		if stringOption(logger, config, "bucket", "") == "" {
+			logger.Fatal("bucket is not set for InfluxDB 2.x")
+		}
+		d = &flux{
+			httpQuery:   httpQuery,
+			org:         stringOption(logger, config, "org", ""),
+			bucket:      stringOption(logger, config, "bucket", ""),
+			token:       stringOption(logger, config, "token", ""),
+			aggregation: aggregation,
+			lookback:    durationOption(logger, config, "lookback", "720h"),
+		}
+	}
+
+	c := &InfluxDBGroup{
+		groupName:            config.GroupName,
+		servers:              config.Servers,
+		protocol:             config.Protocol,
+		timeout:              *config.Timeouts,
+		maxTries:             *config.MaxTries,
+		maxMetricsPerRequest: *config.MaxBatchSize,
+
+		step:     int64(durationOption(logger, config, "step", "60s").Seconds()),
+		template: tmpl,
+		dialect:  d,
+
+		client:  httpClient,
+		limiter: limiter,
+		logger:  logger,
+
+		httpQuery: httpQuery,
+	}
+
+	return c, nil
+}
+
+func New(logger *zap.Logger, config types.BackendV2, tldCacheDisabled, requireSuccessAll bool) (types.BackendServer, merry.Error) {
+	if config.ConcurrencyLimit == nil {
+		return nil, types.ErrConcurrencyLimitNotSet
+	}
+	if len(config.Servers) == 0 {
+		return nil, types.ErrNoServersSpecified
+	}
+	l := limiter.NewServerLimiter(config.Servers, *config.ConcurrencyLimit)
+
+	return NewWithLimiter(logger, config, tldCacheDisabled, requireSuccessAll, l)
+}
+
+func (c *InfluxDBGroup) Children() []types.BackendServer {
+	return []types.BackendServer{c}
+}
+
+func (c InfluxDBGroup) MaxMetricsPerRequest() int {
+	return c.maxMetricsPerRequest
+}
+
+func (c InfluxDBGroup) Name() string {
+	return c.groupName
+}
+
+func (c InfluxDBGroup) Backends() []string {
+	return c.servers
+}
+
+// measurements returns measurements, that match the first node of graphite path
+func (c *InfluxDBGroup) measurements(ctx context.Context, logger *zap.Logger, stats *types.Stats, node string) ([]string, merry.Error) {
+	return c.dialect.measurements(ctx, logger, stats, globToRegexp(node), nil)
+}
+
+// fields returns fields of the measurement, that match the last node of graphite path
+func (c *InfluxDBGroup) fields(ctx context.Context, logger *zap.Logger, stats *types.Stats, measurement, node string) ([]string, merry.Error) {
+	if !isGlob(node) {
+		return []string{node}, nil
+	}
+	match, err := globMatcher(node)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := c.dialect.fieldKeys(ctx, logger, stats, measurement)
+	if err != nil {
+		return nil, err
+	}
+	res := fields[:0]
+	for _, f := range fields {
+		if match(f) {
+			res = append(res, f)
+		}
+	}
+	return res, nil
+}
+
+// tagConditions returns conditions on tags of the template, that match nodes of graphite path
+func (c *InfluxDBGroup) tagConditions(nodes []string) []condition {
+	conds := make([]condition, 0, len(nodes))
+	for i, node := range nodes {
+		if node != "*" {
+			conds = append(conds, globCondition(c.template.tags[i], node))
+		}
+	}
+	return conds
+}
+
+func (c *InfluxDBGroup) find(ctx context.Context, logger *zap.Logger, stats *types.Stats, query string) ([]protov3.GlobMatch, merry.Error) {
+	nodes := strings.Split(query, ".")
+	if len(nodes) > c.template.len() {
+		return nil, nil
+	}
+	measurements, err := c.measurements(ctx, logger, stats, nodes[0])
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make(map[string]bool)
+	for _, m := range measurements {
+		if len(nodes) == 1 {
+			matches[m] = false
+			continue
+		}
+
+		isLeaf := len(nodes) == c.template.len()
+		tagNodes := nodes[1:]
+		if isLeaf {
+			tagNodes = nodes[1 : len(nodes)-1]
+		}
+
+		paths := []string{m}
+		if len(tagNodes) > 0 {
+			series, err := c.dialect.series(ctx, logger, stats, m, c.tagConditions(tagNodes))
+			if err != nil {
+				return nil, err
+			}
+			uniquePaths := make(map[string]struct{})
+			paths = paths[:0]
+			for _, tags := range series {
+				if p, ok := c.template.path(m, tags, len(tagNodes)); ok {
+					if _, ok := uniquePaths[p]; !ok {
+						uniquePaths[p] = struct{}{}
+						paths = append(paths, p)
+					}
+				}
+			}
+		}
+
+		if !isLeaf {
+			for _, p := range paths {
+				matches[p] = false
+			}
+			continue
+		}
+		if len(paths) == 0 {
+			continue
+		}
+		match, err := globMatcher(nodes[len(nodes)-1])
+		if err != nil {
+			return nil, err
+		}
+		fields, err := c.dialect.fieldKeys(ctx, logger, stats, m)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			for _, f := range fields {
+				if match(f) {
+					matches[p+"."+f] = true
+				}
+			}
+		}
+	}
+
+	res := make([]protov3.GlobMatch, 0, len(matches))
+	for p, isLeaf := range matches {
+		res = append(res, protov3.GlobMatch{Path: p, IsLeaf: isLeaf})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Path < res[j].Path
+	})
+	return res, nil
+}
+
+func (c *InfluxDBGroup) Find(ctx context.Context, request *protov3.MultiGlobRequest) (*protov3.MultiGlobResponse, *types.Stats, merry.Error) {
+	logger := c.logger.With(zap.String("type", "find"), zap.Strings("request", request.Metrics))
+	stats := &types.Stats{}
+
+	r := protov3.MultiGlobResponse{
+		Metrics: make([]protov3.GlobResponse, 0, len(request.Metrics)),
+	}
+	var e merry.Error
+	for _, query := range request.Metrics {
+		stats.FindRequests++
+		matches, err := c.find(ctx, logger, stats, query)
+		if err != nil {
+			stats.FindErrors++
+			if merry.Is(err, types.ErrTimeoutExceeded) {
+				stats.Timeouts++
+				stats.FindTimeouts++
+			}
+			if e == nil {
+				e = err
+			} else {
+				e = e.WithCause(err)
+			}
+			continue
+		}
+		r.Metrics = append(r.Metrics, protov3.GlobResponse{
+			Name:    query,
+			Matches: matches,
+		})
+	}
+
+	if e != nil {
+		stats.FailedServers = []string{c.groupName}
+		logger.Error("errors occurred while getting results",
+			zap.Any("errors", e),
+		)
+		return &r, stats, e
+	}
+	return &r, stats, nil
+}
+
+// fetchResponse puts points of the series to the grid with the step of the request
+func fetchResponse(name, pathExpr string, points []point, step int64) (protov3.FetchResponse, bool) {
+	if len(points) == 0 {
+		return protov3.FetchResponse{}, false
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].timestamp < points[j].timestamp
+	})
+	start := points[0].timestamp - points[0].timestamp%step
+	stop := points[len(points)-1].timestamp - points[len(points)-1].timestamp%step
+	values := make([]float64, (stop-start)/step+1)
+	for i := range values {
+		values[i] = nan
+	}
+	for _, p := range points {
+		values[(p.timestamp-start)/step] = p.value
+	}
+	return protov3.FetchResponse{
+		Name:              name,
+		PathExpression:    pathExpr,
+		ConsolidationFunc: "Average",
+		StartTime:         start,
+		StopTime:          stop,
+		StepTime:          step,
+		Values:            values,
+		XFilesFactor:      0.0,
+	}, true
+}
+
+// fetchPath fetches series, which graphite path matches the target
+func (c *InfluxDBGroup) fetchPath(ctx context.Context, logger *zap.Logger, stats *types.Stats, m protov3.FetchRequest) ([]protov3.FetchResponse, merry.Error) {
+	nodes := strings.Split(m.Name, ".")
+	if len(nodes) != c.template.len() {
+		return nil, nil
+	}
+	measurements, err := c.measurements(ctx, logger, stats, nodes[0])
+	if err != nil {
+		return nil, err
+	}
+	conds := c.tagConditions(nodes[1 : len(nodes)-1])
+
+	var res []protov3.FetchResponse
+	for _, measurement := range measurements {
+		fields, err := c.fields(ctx, logger, stats, measurement, nodes[len(nodes)-1])
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range fields {
+			series, err := c.dialect.fetch(ctx, logger, stats, fetchQuery{
+				measurement: measurement,
+				field:       field,
+				conditions:  conds,
+				groupBy:     append([]string{}, c.template.tags...),
+				from:        m.StartTime,
+				until:       m.StopTime,
+				step:        c.step,
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range series {
+				p, ok := c.template.path(measurement, s.tags, len(c.template.tags))
+				if !ok {
+					continue
+				}
+				if fr, ok := fetchResponse(p+"."+field, m.PathExpression, s.points, c.step); ok {
+					res = append(res, fr)
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// fetchTagged fetches series, that match expressions of seriesByTag
+func (c *InfluxDBGroup) fetchTagged(ctx context.Context, logger *zap.Logger, stats *types.Stats, m protov3.FetchRequest) ([]protov3.FetchResponse, merry.Error) {
+	e, err := parseTagExpressions(helpers.SplitTagValues(m.Name[len("seriesByTag(") : len(m.Name)-1]))
+	if err != nil {
+		return nil, err
+	}
+	names, err := c.taggedNames(ctx, logger, stats, e)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []protov3.FetchResponse
+	for _, name := range names {
+		series, err := c.dialect.fetch(ctx, logger, stats, fetchQuery{
+			measurement: name[0],
+			field:       name[1],
+			conditions:  e.conditions,
+			from:        m.StartTime,
+			until:       m.StopTime,
+			step:        c.step,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range series {
+			if fr, ok := fetchResponse(taggedName(name[0], name[1], s.tags), m.PathExpression, s.points, c.step); ok {
+				res = append(res, fr)
+			}
+		}
+	}
+	return res, nil
+}
+
+// taggedNames returns pairs of measurement and field, which name ('measurement.field') matches expressions
+func (c *InfluxDBGroup) taggedNames(ctx context.Context, logger *zap.Logger, stats *types.Stats, e tagExpressions) ([][2]string, merry.Error) {
+	if e.name != nil && e.name.op == "=" {
+		idx := strings.LastIndexByte(e.name.value, '.')
+		if idx <= 0 || idx == len(e.name.value)-1 {
+			return nil, nil
+		}
+		return [][2]string{{e.name.value[:idx], e.name.value[idx+1:]}}, nil
+	}
+
+	match, err := e.matchName()
+	if err != nil {
+		return nil, err
+	}
+	measurements, err := c.dialect.measurements(ctx, logger, stats, "", e.conditions)
+	if err != nil {
+		return nil, err
+	}
+	var res [][2]string
+	for _, m := range measurements {
+		fields, err := c.dialect.fieldKeys(ctx, logger, stats, m)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fields {
+			if match(m + "." + f) {
+				res = append(res, [2]string{m, f})
+			}
+		}
+	}
+	return res, nil
+}
+
+func (c *InfluxDBGroup) Fetch(ctx context.Context, request *protov3.MultiFetchRequest) (*protov3.MultiFetchResponse, *types.Stats, merry.Error) {
+	logger := c.logger.With(zap.String("type", "fetch"), zap.String("request", request.String()))
+	stats := &types.Stats{}
+
+	var r protov3.MultiFetchResponse
+	var e merry.Error
+	for _, m := range request.Metrics {
+		stats.RenderRequests++
+		var series []protov3.FetchResponse
+		var err merry.Error
+		if strings.HasPrefix(m.Name, "seriesByTag(") && strings.HasSuffix(m.Name, ")") {
+			series, err = c.fetchTagged(ctx, logger, stats, m)
+		} else {
+			series, err = c.fetchPath(ctx, logger, stats, m)
+		}
+		if err != nil {
+			stats.RenderErrors++
+			if merry.Is(err, types.ErrTimeoutExceeded) {
+				stats.Timeouts++
+				stats.RenderTimeouts++
+			}
+			if e == nil {
+				e = err
+			} else {
+				e = e.WithCause(err)
+			}
+			continue
+		}
+		r.Metrics = append(r.Metrics, series...)
+	}
+
+	if e != nil {
+		stats.FailedServers = []string{c.groupName}
+		logger.Error("errors occurred while getting results",
+			zap.Any("errors", e),
+		)
+		return &r, stats, e
+	}
+	return &r, stats, nil
+}
+
+func (c *InfluxDBGroup) Info(ctx context.Context, request *protov3.MultiMetricsInfoRequest) (*protov3.ZipperInfoResponse, *types.Stats, merry.Error) {
+	return nil, nil, types.ErrNotSupportedByBackend
+}
+
+func (c *InfluxDBGroup) List(ctx context.Context) (*protov3.ListMetricsResponse, *types.Stats, merry.Error) {
+	return nil, nil, types.ErrNotImplementedYet
+}
+
+func (c *InfluxDBGroup) Stats(ctx context.Context) (*protov3.MetricDetailsResponse, *types.Stats, merry.Error) {
+	return nil, nil, types.ErrNotSupportedByBackend
+}
+
+// tagQuery parses query of graphite tags autocompletion API
+func tagQuery(query string) (url.Values, tagExpressions, merry.Error) {
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, tagExpressions{}, ErrInvalidTagExpression.WithCause(err)
+	}
+	var e tagExpressions
+	if exprs := params["expr"]; len(exprs) > 0 {
+		tvs := make(map[string]prometheusTypes.Tag, len(exprs))
+		for _, expr := range exprs {
+			name, t := helpers.PromethizeTagValue(expr)
+			tvs[name] = t
+		}
+		var err merry.Error
+		if e, err = parseTagExpressions(tvs); err != nil {
+			return nil, e, err
+		}
+	}
+	return params, e, nil
+}
+
+// filterTags returns sorted unique values with the prefix
+func filterTags(values []string, prefix string, limit int64) []string {
+	sort.Strings(values)
+	res := make([]string, 0, len(values))
+	for i, v := range values {
+		if (i > 0 && v == values[i-1]) || !strings.HasPrefix(v, prefix) {
+			continue
+		}
+		res = append(res, v)
+		if limit > 0 && int64(len(res)) == limit {
+			break
+		}
+	}
+	return res
+}
+
+func (c *InfluxDBGroup) TagNames(ctx context.Context, query string, limit int64) ([]string, merry.Error) {
+	logger := c.logger.With(zap.String("type", "tagName"), zap.String("query", query))
+	params, e, err := tagQuery(query)
+	if err != nil {
+		return []string{}, err
+	}
+	keys, err := c.dialect.tagKeys(ctx, logger, &types.Stats{}, e.conditions)
+	if err != nil {
+		return []string{}, err
+	}
+	return filterTags(append(keys, "name"), params.Get("tagPrefix"), limit), nil
+}
+
+func (c *InfluxDBGroup) TagValues(ctx context.Context, query string, limit int64) ([]string, merry.Error) {
+	logger := c.logger.With(zap.String("type", "tagValues"), zap.String("query", query))
+	params, e, err := tagQuery(query)
+	if err != nil {
+		return []string{}, err
+	}
+	tag := params.Get("tag")
+	if tag == "" {
+		return []string{}, types.ErrNoTagSpecified
+	}
+
+	var values []string
+	if tag == "name" {
+		names, err := c.taggedNames(ctx, logger, &types.Stats{}, e)
+		if err != nil {
+			return []string{}, err
+		}
+		for _, name := range names {
+			values = append(values, name[0]+"."+name[1])
+		}
+	} else {
+		values, err = c.dialect.tagValues(ctx, logger, &types.Stats{}, tag, e.conditions)
+		if err != nil {
+			return []string{}, err
+		}
+	}
+	return filterTags(values, params.Get("valuePrefix"), limit), nil
+}
+
+func (c *InfluxDBGroup) ProbeTLDs(ctx context.Context) ([]string, merry.Error) {
+	logger := c.logger.With(zap.String("function", "prober"))
+	tlds, err := c.dialect.measurements(ctx, logger, &types.Stats{}, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("will return data",
+		zap.Strings("tlds", tlds),
+	)
+	return tlds, nil
+}
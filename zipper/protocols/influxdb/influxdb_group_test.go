@@ -0,0 +1,349 @@
+package influxdb
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ansel1/merry"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+// newStandIn returns server, that answers known queries with canned responses
+func newStandIn(t *testing.T, check func(r *http.Request) bool, query func(r *http.Request) string, responses map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !check(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		q := query(r)
+		resp, ok := responses[q]
+		if !ok {
+			t.Errorf("unexpected query:\n%s", q)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(resp))
+	}))
+}
+
+func newTestGroup(t *testing.T, server string, options map[string]interface{}) types.BackendServer {
+	timeouts := types.Timeouts{Find: time.Second, Render: time.Second, Connect: time.Second}
+	concurrencyLimit, maxTries, maxBatchSize, maxIdleConns := 10, 1, 100, 10
+	idleTimeout, keepAlive := time.Minute, time.Second
+	b, err := New(zap.NewNop(), types.BackendV2{
+		GroupName:        "influxdb",
+		Protocol:         "influxdb",
+		Servers:          []string{server},
+		Timeouts:         &timeouts,
+		ConcurrencyLimit: &concurrencyLimit,
+		MaxTries:         &maxTries,
+		MaxBatchSize:     &maxBatchSize,
+		BackendOptions:   options,
+
+		MaxIdleConnsPerHost:   &maxIdleConns,
+		IdleConnectionTimeout: &idleTimeout,
+		KeepAliveInterval:     &keepAlive,
+	}, false, false)
+	if err != nil {
+		t.Fatalf("failed to create group: %v", err)
+	}
+	return b
+}
+
+func checkFind(t *testing.T, b types.BackendServer, query string, want []protov3.GlobMatch) {
+	t.Helper()
+	res, _, err := b.Find(t.Context(), &protov3.MultiGlobRequest{Metrics: []string{query}})
+	if err != nil {
+		t.Fatalf("find %s failed: %v", query, err)
+	}
+	if len(res.Metrics) != 1 || len(res.Metrics[0].Matches) != len(want) ||
+		(len(want) > 0 && !reflect.DeepEqual(res.Metrics[0].Matches, want)) {
+		t.Fatalf("unexpected result of find %s: %+v", query, res.Metrics)
+	}
+}
+
+func checkFetch(t *testing.T, b types.BackendServer, target string, want []protov3.FetchResponse) {
+	t.Helper()
+	res, _, err := b.Fetch(t.Context(), &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{{Name: target, PathExpression: target, StartTime: 1700000000, StopTime: 1700000180}},
+	})
+	if err != nil {
+		t.Fatalf("fetch %s failed: %v", target, err)
+	}
+	if len(res.Metrics) != len(want) {
+		t.Fatalf("unexpected series of %s: %+v", target, res.Metrics)
+	}
+	for i := range want {
+		got, w := res.Metrics[i], want[i]
+		w.PathExpression = target
+		w.ConsolidationFunc = "Average"
+		if got.Name != w.Name || got.PathExpression != w.PathExpression || got.StartTime != w.StartTime ||
+			got.StopTime != w.StopTime || got.StepTime != w.StepTime || len(got.Values) != len(w.Values) {
+			t.Fatalf("unexpected series:\n got: %+v\nwant: %+v", got, w)
+		}
+		for j := range w.Values {
+			if got.Values[j] != w.Values[j] && !(math.IsNaN(got.Values[j]) && math.IsNaN(w.Values[j])) {
+				t.Fatalf("unexpected values of %s: %v", got.Name, got.Values)
+			}
+		}
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	tmpl, err := parseTemplate("measurement.host.cpu.field")
+	if err != nil || !reflect.DeepEqual(tmpl.tags, []string{"host", "cpu"}) {
+		t.Fatalf("unexpected template: %+v, %v", tmpl, err)
+	}
+	for _, s := range []string{"field", "host.measurement.field", "measurement.host", "measurement.host.host.field", "measurement..field"} {
+		if _, err := parseTemplate(s); err == nil {
+			t.Errorf("invalid template %s is parsed", s)
+		}
+	}
+}
+
+func TestParseSeriesKey(t *testing.T) {
+	name, tags := parseSeriesKey(`cpu\,1,host=server\=01,region=us\,west,zone=a\ b`)
+	want := map[string]string{"host": "server=01", "region": "us,west", "zone": "a b"}
+	if name != "cpu,1" || !reflect.DeepEqual(tags, want) {
+		t.Fatalf("unexpected result: %s, %v", name, tags)
+	}
+}
+
+func TestInfluxQL(t *testing.T) {
+	results := func(series ...influxQLSeries) string {
+		b, _ := json.Marshal(map[string]interface{}{
+			"results": []interface{}{map[string]interface{}{"statement_id": 0, "series": series}},
+		})
+		return string(b)
+	}
+	srv := newStandIn(t,
+		func(r *http.Request) bool {
+			q := r.URL.Query()
+			return r.URL.Path == "/query" && q.Get("db") == "telegraf" && q.Get("u") == "reader" && q.Get("p") == "secret" && q.Get("epoch") == "s"
+		},
+		func(r *http.Request) string { return r.URL.Query().Get("q") },
+		map[string]string{
+			`SHOW MEASUREMENTS WITH MEASUREMENT =~ /^.*$/`: results(influxQLSeries{
+				Name: "measurements", Columns: []string{"name"}, Values: [][]interface{}{{"cpu"}, {"mem"}},
+			}),
+			`SHOW MEASUREMENTS WITH MEASUREMENT =~ /^cpu$/`: results(influxQLSeries{
+				Name: "measurements", Columns: []string{"name"}, Values: [][]interface{}{{"cpu"}},
+			}),
+			`SHOW SERIES FROM "cpu"`: results(influxQLSeries{
+				Columns: []string{"key"}, Values: [][]interface{}{{"cpu,host=server01"}, {"cpu,host=server02"}, {"cpu,region=eu"}},
+			}),
+			`SHOW SERIES FROM "cpu" WHERE "host" = 'server01'`: results(influxQLSeries{
+				Columns: []string{"key"}, Values: [][]interface{}{{"cpu,host=server01"}},
+			}),
+			`SHOW FIELD KEYS FROM "cpu"`: results(influxQLSeries{
+				Name: "cpu", Columns: []string{"fieldKey", "fieldType"},
+				Values: [][]interface{}{{"usage_idle", "float"}, {"usage_user", "float"}, {"state", "string"}},
+			}),
+			`SELECT mean("usage_idle") FROM "cpu" WHERE time >= 1700000000s AND time <= 1700000180s AND "host" =~ /^server0.*$/ GROUP BY time(60s), "host" fill(null)`: results(
+				influxQLSeries{
+					Name: "cpu", Tags: map[string]string{"host": "server01"}, Columns: []string{"time", "mean"},
+					Values: [][]interface{}{{1700000040, 1.5}, {1700000100, nil}, {1700000160, 3}},
+				},
+				influxQLSeries{
+					Name: "cpu", Tags: map[string]string{"host": "server02"}, Columns: []string{"time", "mean"},
+					Values: [][]interface{}{{1700000040, 7}},
+				},
+			),
+			`SELECT mean("usage_idle") FROM "cpu" WHERE time >= 1700000000s AND time <= 1700000180s AND "host" = 'server01' GROUP BY time(60s), * fill(null)`: results(
+				influxQLSeries{
+					Name: "cpu", Tags: map[string]string{"host": "server01", "cpu": "cpu0"}, Columns: []string{"time", "mean"},
+					Values: [][]interface{}{{1700000040, 1}, {1700000100, 2}},
+				},
+			),
+			`SHOW TAG KEYS WHERE "host" = 'server01'`: results(
+				influxQLSeries{Name: "cpu", Columns: []string{"tagKey"}, Values: [][]interface{}{{"cpu"}, {"host"}}},
+				influxQLSeries{Name: "mem", Columns: []string{"tagKey"}, Values: [][]interface{}{{"host"}}},
+			),
+			`SHOW TAG VALUES WITH KEY = "host"`: results(
+				influxQLSeries{Name: "cpu", Columns: []string{"key", "value"}, Values: [][]interface{}{{"host", "server01"}, {"host", "server02"}}},
+				influxQLSeries{Name: "mem", Columns: []string{"key", "value"}, Values: [][]interface{}{{"host", "server01"}}},
+			),
+			`SHOW MEASUREMENTS WHERE "host" = 'server01'`: results(influxQLSeries{
+				Name: "measurements", Columns: []string{"name"}, Values: [][]interface{}{{"cpu"}},
+			}),
+		},
+	)
+	defer srv.Close()
+
+	b := newTestGroup(t, srv.URL, map[string]interface{}{
+		"template": "measurement.host.field",
+		"database": "telegraf",
+		"username": "reader",
+		"password": "secret",
+	})
+
+	checkFind(t, b, "*", []protov3.GlobMatch{{Path: "cpu"}, {Path: "mem"}})
+	// series without the tag of the template are skipped
+	checkFind(t, b, "cpu.*", []protov3.GlobMatch{{Path: "cpu.server01"}, {Path: "cpu.server02"}})
+	checkFind(t, b, "cpu.server01.*", []protov3.GlobMatch{
+		{Path: "cpu.server01.usage_idle", IsLeaf: true},
+		{Path: "cpu.server01.usage_user", IsLeaf: true},
+	})
+	checkFind(t, b, "cpu.server01.usage_idle.x", []protov3.GlobMatch{})
+
+	checkFetch(t, b, "cpu.server0*.usage_idle", []protov3.FetchResponse{
+		{Name: "cpu.server01.usage_idle", StartTime: 1700000040, StopTime: 1700000160, StepTime: 60, Values: []float64{1.5, math.NaN(), 3}},
+		{Name: "cpu.server02.usage_idle", StartTime: 1700000040, StopTime: 1700000040, StepTime: 60, Values: []float64{7}},
+	})
+	checkFetch(t, b, "seriesByTag('name=cpu.usage_idle','host=server01')", []protov3.FetchResponse{
+		{Name: "cpu.usage_idle;cpu=cpu0;host=server01", StartTime: 1700000040, StopTime: 1700000100, StepTime: 60, Values: []float64{1, 2}},
+	})
+
+	names, err := b.TagNames(t.Context(), "tagPrefix=h&expr=host%3Dserver01", -1)
+	if err != nil || !reflect.DeepEqual(names, []string{"host"}) {
+		t.Errorf("unexpected tag names: %v, %v", names, err)
+	}
+	values, err := b.TagValues(t.Context(), "tag=host", 1)
+	if err != nil || !reflect.DeepEqual(values, []string{"server01"}) {
+		t.Errorf("unexpected tag values: %v, %v", values, err)
+	}
+	values, err = b.TagValues(t.Context(), "tag=name&expr=host%3Dserver01&expr=name%3D~cpu%5C.usage", -1)
+	if err != nil || !reflect.DeepEqual(values, []string{"cpu.usage_idle", "cpu.usage_user"}) {
+		t.Errorf("unexpected values of name: %v, %v", values, err)
+	}
+	if _, err := b.TagValues(t.Context(), "valuePrefix=a", -1); err == nil {
+		t.Errorf("tag values without tag are returned")
+	}
+}
+
+func TestFlux(t *testing.T) {
+	const header = "#datatype,string,long,string\n,result,table,_value\n"
+	srv := newStandIn(t,
+		func(r *http.Request) bool {
+			return r.Method == "POST" && r.URL.Path == "/api/v2/query" && r.URL.Query().Get("org") == "my-org" &&
+				r.Header.Get("Authorization") == "Token my-token"
+		},
+		func(r *http.Request) string {
+			var req fluxRequest
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			return req.Query
+		},
+		map[string]string{
+			"import \"influxdata/influxdb/schema\"\n" +
+				"schema.tagValues(bucket: \"telegraf\", tag: \"_measurement\", predicate: (r) => true, start: -86400s)\n" +
+				"  |> filter(fn: (r) => r._value =~ /^cpu$/)": header + ",_result,0,cpu\n",
+			"from(bucket: \"telegraf\")\n" +
+				"  |> range(start: -86400s)\n" +
+				"  |> filter(fn: (r) => r[\"_measurement\"] == \"cpu\")\n" +
+				"  |> last()": "#datatype,string,long,string,string,string,double\n" +
+				",result,table,_field,_measurement,host,_value\n" +
+				",_result,0,usage_idle,cpu,server01,1\n" +
+				",_result,1,usage_user,cpu,server01,2\n" +
+				",_result,2,usage_idle,cpu,server02,3\n",
+			"import \"influxdata/influxdb/schema\"\n" +
+				"schema.fieldKeys(bucket: \"telegraf\", predicate: (r) => r[\"_measurement\"] == \"cpu\", start: -86400s)": header +
+				",_result,0,usage_idle\n,_result,0,usage_user\n",
+			"from(bucket: \"telegraf\")\n" +
+				"  |> range(start: 1700000000, stop: 1700000181)\n" +
+				"  |> filter(fn: (r) => r[\"_measurement\"] == \"cpu\" and r[\"_field\"] == \"usage_idle\" and r[\"host\"] =~ /^server0(1|2)$/)\n" +
+				"  |> group(columns: [\"_measurement\", \"_field\", \"host\"])\n" +
+				"  |> aggregateWindow(every: 60s, fn: mean, createEmpty: true, timeSrc: \"_start\")": "" +
+				"#datatype,string,long,dateTime:RFC3339,double,string,string,string\n" +
+				",result,table,_time,_value,_field,_measurement,host\n" +
+				",_result,0,2023-11-14T22:14:00Z,1.5,usage_idle,cpu,server01\n" +
+				",_result,0,2023-11-14T22:15:00Z,,usage_idle,cpu,server01\n" +
+				",_result,0,2023-11-14T22:16:00Z,3,usage_idle,cpu,server01\n" +
+				"\n" +
+				"#datatype,string,long,dateTime:RFC3339,double,string,string,string\n" +
+				",result,table,_time,_value,_field,_measurement,host\n" +
+				",_result,1,2023-11-14T22:15:00Z,7,usage_idle,cpu,server02\n",
+		},
+	)
+	defer srv.Close()
+
+	b := newTestGroup(t, srv.URL, map[string]interface{}{
+		"version":  2,
+		"template": "measurement.host.field",
+		"org":      "my-org",
+		"bucket":   "telegraf",
+		"token":    "my-token",
+		"lookback": "24h",
+	})
+
+	checkFind(t, b, "cpu.*", []protov3.GlobMatch{{Path: "cpu.server01"}, {Path: "cpu.server02"}})
+	checkFind(t, b, "cpu.*.usage_*", []protov3.GlobMatch{
+		{Path: "cpu.server01.usage_idle", IsLeaf: true},
+		{Path: "cpu.server01.usage_user", IsLeaf: true},
+		{Path: "cpu.server02.usage_idle", IsLeaf: true},
+		{Path: "cpu.server02.usage_user", IsLeaf: true},
+	})
+	checkFetch(t, b, "cpu.server0{1,2}.usage_idle", []protov3.FetchResponse{
+		{Name: "cpu.server01.usage_idle", StartTime: 1700000040, StopTime: 1700000160, StepTime: 60, Values: []float64{1.5, math.NaN(), 3}},
+		{Name: "cpu.server02.usage_idle", StartTime: 1700000100, StopTime: 1700000100, StepTime: 60, Values: []float64{7}},
+	})
+}
+
+func TestParseFluxCSVError(t *testing.T) {
+	_, err := parseFluxCSV([]byte("#datatype,string,string\n,error,reference\n,failed to parse query,897\n"))
+	if err == nil || err.Error() != "failed to parse query" {
+		t.Fatalf("error is not returned: %v", err)
+	}
+}
+
+func TestQuoteRegexp(t *testing.T) {
+	tests := []struct {
+		re   string
+		want string
+	}{
+		{re: `^cpu$`, want: `/^cpu$/`},
+		{re: `a/b`, want: `/a\/b/`},
+		{re: `a\/b`, want: `/a\/b/`},
+		{re: `a\.b`, want: `/a\.b/`},
+		{re: `a\\/b`, want: `/a\\\/b/`},
+		{re: `a\\`, want: `/a\x5c/`},
+		{re: "a\nb", want: `/a\nb/`},
+	}
+	for _, tt := range tests {
+		got, err := quoteRegexp(tt.re)
+		if err != nil || got != tt.want {
+			t.Errorf("unexpected literal of %q: %s, %v", tt.re, got, err)
+		}
+	}
+	for _, re := range []string{`a\`, `a\\\`, "a\\\nb"} {
+		if got, err := quoteRegexp(re); err == nil {
+			t.Errorf("invalid regular expression %q is quoted: %s", re, got)
+		}
+	}
+}
+
+func TestInfluxQLRegexpInjection(t *testing.T) {
+	srv := newStandIn(t,
+		func(r *http.Request) bool { return true },
+		func(r *http.Request) string { return r.URL.Query().Get("q") },
+		map[string]string{
+			// slash can't close the literal, so the value is still matched by the single regular expression
+			`SHOW TAG VALUES WITH KEY = "host" WHERE "host" =~ /^(x\/ OR "host" =~ \/.*)/`: `{"results":[{"statement_id":0}]}`,
+		},
+	)
+	defer srv.Close()
+
+	b := newTestGroup(t, srv.URL, map[string]interface{}{
+		"template": "measurement.host.field",
+		"database": "telegraf",
+	})
+
+	query := url.Values{"tag": []string{"host"}, "expr": []string{`host=~x/ OR "host" =~ /.*`}}
+	if values, err := b.TagValues(t.Context(), query.Encode(), -1); err != nil || len(values) != 0 {
+		t.Errorf("unexpected tag values: %v, %v", values, err)
+	}
+
+	// trailing backslash would escape the closing delimiter
+	query = url.Values{"tag": []string{"host"}, "expr": []string{`host=~^x\`}}
+	if _, err := b.TagValues(t.Context(), query.Encode(), -1); !merry.Is(err, ErrInvalidTagExpression) {
+		t.Errorf("regular expression with trailing backslash is accepted: %v", err)
+	}
+}
@@ -0,0 +1,350 @@
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ansel1/merry"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/zipper/helper"
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+// influxQL queries InfluxDB 1.x (or /query compatibility API of InfluxDB 2.x) with InfluxQL
+type influxQL struct {
+	httpQuery       *helper.HttpQuery
+	database        string
+	retentionPolicy string
+	username        string
+	password        string
+	aggregation     string
+}
+
+type influxQLSeries struct {
+	Name    string            `json:"name"`
+	Tags    map[string]string `json:"tags"`
+	Columns []string          `json:"columns"`
+	Values  [][]interface{}   `json:"values"`
+}
+
+type influxQLResponse struct {
+	Results []struct {
+		Series []influxQLSeries `json:"series"`
+		Error  string           `json:"error"`
+	} `json:"results"`
+	Error string `json:"error"`
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func quoteString(s string) string {
+	return `'` + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + `'`
+}
+
+// quoteRegexp returns regular expression literal of InfluxQL and Flux. The only escape sequence of the literal is '\/',
+// other backslashes are passed to the regular expression as is. So every slash is escaped, backslash, that escapes
+// backslash at the end of the expression, is replaced by '\x5c' to keep the closing delimiter and the expression, that
+// can't be quoted (e.g. with dangling backslash), is rejected.
+func quoteRegexp(s string) (string, merry.Error) {
+	var sb strings.Builder
+	sb.WriteByte('/')
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '/':
+			sb.WriteString(`\/`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\\':
+			i++
+			switch {
+			case i == len(s) || s[i] == '\n':
+				return "", ErrInvalidTagExpression.WithMessage("invalid escape sequence in regular expression").WithValue("regexp", s)
+			case s[i] == '/':
+				sb.WriteString(`\/`)
+			case s[i] == '\\' && i == len(s)-1:
+				sb.WriteString(`\x5c`)
+			default:
+				sb.WriteByte('\\')
+				sb.WriteByte(s[i])
+			}
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	sb.WriteByte('/')
+	return sb.String(), nil
+}
+
+func influxQLWhere(conds []condition) (string, merry.Error) {
+	parts := make([]string, 0, len(conds))
+	for _, c := range conds {
+		if c.op == "=~" || c.op == "!~" {
+			re, err := quoteRegexp(c.value)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, quoteIdent(c.key)+" "+c.op+" "+re)
+		} else {
+			parts = append(parts, quoteIdent(c.key)+" "+c.op+" "+quoteString(c.value))
+		}
+	}
+	return strings.Join(parts, " AND "), nil
+}
+
+func (d *influxQL) query(ctx context.Context, logger *zap.Logger, stats *types.Stats, q string) ([]influxQLSeries, merry.Error) {
+	v := url.Values{
+		"db":    []string{d.database},
+		"q":     []string{q},
+		"epoch": []string{"s"},
+	}
+	if d.retentionPolicy != "" {
+		v.Set("rp", d.retentionPolicy)
+	}
+	if d.username != "" {
+		v.Set("u", d.username)
+		v.Set("p", d.password)
+	}
+
+	logger.Debug("will do query",
+		zap.String("query", q),
+	)
+	res, err := d.httpQuery.DoQueryWithStats(ctx, logger, "/query?"+v.Encode(), nil, stats)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil || len(res.Response) == 0 {
+		return nil, nil
+	}
+
+	var r influxQLResponse
+	dec := json.NewDecoder(bytes.NewReader(res.Response))
+	dec.UseNumber()
+	if err := dec.Decode(&r); err != nil {
+		return nil, types.ErrUnmarshalFailed.WithCause(err)
+	}
+	if r.Error != "" {
+		return nil, types.ErrFailedToFetch.WithMessage(r.Error).WithValue("query", q)
+	}
+	var series []influxQLSeries
+	for _, result := range r.Results {
+		if result.Error != "" {
+			return nil, types.ErrFailedToFetch.WithMessage(result.Error).WithValue("query", q)
+		}
+		series = append(series, result.Series...)
+	}
+	return series, nil
+}
+
+// column returns string values of the column of all series
+func (d *influxQL) column(ctx context.Context, logger *zap.Logger, stats *types.Stats, q string, idx int) ([]string, merry.Error) {
+	series, err := d.query(ctx, logger, stats, q)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, s := range series {
+		for _, row := range s.Values {
+			if len(row) > idx {
+				if v, ok := row[idx].(string); ok {
+					res = append(res, v)
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+func (d *influxQL) measurements(ctx context.Context, logger *zap.Logger, stats *types.Stats, re string, conds []condition) ([]string, merry.Error) {
+	q := "SHOW MEASUREMENTS"
+	if re != "" {
+		quoted, err := quoteRegexp(re)
+		if err != nil {
+			return nil, err
+		}
+		q += " WITH MEASUREMENT =~ " + quoted
+	}
+	if len(conds) > 0 {
+		where, err := influxQLWhere(conds)
+		if err != nil {
+			return nil, err
+		}
+		q += " WHERE " + where
+	}
+	return d.column(ctx, logger, stats, q, 0)
+}
+
+func (d *influxQL) series(ctx context.Context, logger *zap.Logger, stats *types.Stats, measurement string, conds []condition) ([]map[string]string, merry.Error) {
+	q := "SHOW SERIES FROM " + quoteIdent(measurement)
+	if len(conds) > 0 {
+		where, err := influxQLWhere(conds)
+		if err != nil {
+			return nil, err
+		}
+		q += " WHERE " + where
+	}
+	keys, err := d.column(ctx, logger, stats, q, 0)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]map[string]string, 0, len(keys))
+	for _, key := range keys {
+		_, tags := parseSeriesKey(key)
+		res = append(res, tags)
+	}
+	return res, nil
+}
+
+func (d *influxQL) fieldKeys(ctx context.Context, logger *zap.Logger, stats *types.Stats, measurement string) ([]string, merry.Error) {
+	series, err := d.query(ctx, logger, stats, "SHOW FIELD KEYS FROM "+quoteIdent(measurement))
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, s := range series {
+		for _, row := range s.Values {
+			if len(row) < 2 {
+				continue
+			}
+			key, _ := row[0].(string)
+			// strings and booleans can't be graphed
+			switch row[1] {
+			case "float", "integer", "unsigned":
+				res = append(res, key)
+			}
+		}
+	}
+	return res, nil
+}
+
+func (d *influxQL) tagKeys(ctx context.Context, logger *zap.Logger, stats *types.Stats, conds []condition) ([]string, merry.Error) {
+	q := "SHOW TAG KEYS"
+	if len(conds) > 0 {
+		where, err := influxQLWhere(conds)
+		if err != nil {
+			return nil, err
+		}
+		q += " WHERE " + where
+	}
+	return d.column(ctx, logger, stats, q, 0)
+}
+
+func (d *influxQL) tagValues(ctx context.Context, logger *zap.Logger, stats *types.Stats, key string, conds []condition) ([]string, merry.Error) {
+	q := "SHOW TAG VALUES WITH KEY = " + quoteIdent(key)
+	if len(conds) > 0 {
+		where, err := influxQLWhere(conds)
+		if err != nil {
+			return nil, err
+		}
+		q += " WHERE " + where
+	}
+	return d.column(ctx, logger, stats, q, 1)
+}
+
+func (d *influxQL) fetch(ctx context.Context, logger *zap.Logger, stats *types.Stats, q fetchQuery) ([]rawSeries, merry.Error) {
+	var sb strings.Builder
+	sb.WriteString("SELECT " + d.aggregation + "(" + quoteIdent(q.field) + ") FROM " + quoteIdent(q.measurement))
+	sb.WriteString(" WHERE time >= " + strconv.FormatInt(q.from, 10) + "s AND time <= " + strconv.FormatInt(q.until, 10) + "s")
+	if len(q.conditions) > 0 {
+		where, err := influxQLWhere(q.conditions)
+		if err != nil {
+			return nil, err
+		}
+		sb.WriteString(" AND " + where)
+	}
+	sb.WriteString(" GROUP BY time(" + strconv.FormatInt(q.step, 10) + "s)")
+	if q.groupBy == nil {
+		sb.WriteString(", *")
+	}
+	for _, tag := range q.groupBy {
+		sb.WriteString(", " + quoteIdent(tag))
+	}
+	sb.WriteString(" fill(null)")
+
+	series, err := d.query(ctx, logger, stats, sb.String())
+	if err != nil {
+		return nil, err
+	}
+	res := make([]rawSeries, 0, len(series))
+	for _, s := range series {
+		rs := rawSeries{tags: s.Tags, points: make([]point, 0, len(s.Values))}
+		for _, row := range s.Values {
+			if len(row) < 2 {
+				continue
+			}
+			ts, ok := row[0].(json.Number)
+			if !ok {
+				continue
+			}
+			p := point{value: nan}
+			if p.timestamp, err = toInt(ts); err != nil {
+				return nil, err
+			}
+			if v, ok := row[1].(json.Number); ok {
+				if p.value, err = toFloat(v); err != nil {
+					return nil, err
+				}
+			}
+			rs.points = append(rs.points, p)
+		}
+		res = append(res, rs)
+	}
+	return res, nil
+}
+
+func toInt(n json.Number) (int64, merry.Error) {
+	v, err := n.Int64()
+	if err != nil {
+		return 0, types.ErrUnmarshalFailed.WithCause(err)
+	}
+	return v, nil
+}
+
+func toFloat(n json.Number) (float64, merry.Error) {
+	v, err := n.Float64()
+	if err != nil {
+		return 0, types.ErrUnmarshalFailed.WithCause(err)
+	}
+	return v, nil
+}
+
+// parseSeriesKey parses series key of line protocol ('cpu,host=server01,region=us\,west'), where commas, spaces and
+// equal signs in names and values are escaped by backslash
+func parseSeriesKey(key string) (string, map[string]string) {
+	parts := splitEscaped(key, ',')
+	tags := make(map[string]string, len(parts)-1)
+	for _, part := range parts[1:] {
+		kv := splitEscaped(part, '=')
+		if len(kv) == 2 {
+			tags[unescapeKey(kv[0])] = unescapeKey(kv[1])
+		}
+	}
+	return unescapeKey(parts[0]), tags
+}
+
+func splitEscaped(s string, sep byte) []string {
+	var res []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			res = append(res, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(res, s[start:])
+}
+
+var keyUnescaper = strings.NewReplacer(`\,`, `,`, `\ `, ` `, `\=`, `=`, `\\`, `\`)
+
+func unescapeKey(s string) string {
+	return keyUnescaper.Replace(s)
+}
@@ -0,0 +1,177 @@
+package influxdb
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ansel1/merry"
+
+	"github.com/go-graphite/carbonapi/zipper/protocols/prometheus/helpers"
+	"github.com/go-graphite/carbonapi/zipper/protocols/prometheus/types"
+)
+
+const (
+	nodeMeasurement = "measurement"
+	nodeField       = "field"
+)
+
+var ErrInvalidTemplate = merry.New("template must be 'measurement.<tag>...field'")
+
+// template maps graphite path onto influx series: the first node of the path is the measurement, the last one is the
+// field, nodes in between are values of the tags. E.g. with template 'measurement.host.cpu.field' path
+// 'cpu.server01.cpu0.usage_idle' is the field 'usage_idle' of the series 'cpu,host=server01,cpu=cpu0'.
+type template struct {
+	tags []string
+}
+
+func parseTemplate(s string) (template, merry.Error) {
+	nodes := strings.Split(s, ".")
+	if len(nodes) < 2 || nodes[0] != nodeMeasurement || nodes[len(nodes)-1] != nodeField {
+		return template{}, ErrInvalidTemplate.WithValue("template", s)
+	}
+	t := template{tags: nodes[1 : len(nodes)-1]}
+	seen := make(map[string]bool)
+	for _, tag := range t.tags {
+		if tag == "" || tag == nodeMeasurement || tag == nodeField || seen[tag] {
+			return template{}, ErrInvalidTemplate.WithValue("template", s)
+		}
+		seen[tag] = true
+	}
+	return t, nil
+}
+
+// len returns count of nodes of the path
+func (t template) len() int {
+	return len(t.tags) + 2
+}
+
+// path returns graphite path of the series, the first n tags of the template are used. Returns false, if series
+// doesn't have one of them.
+func (t template) path(measurement string, tags map[string]string, n int) (string, bool) {
+	nodes := make([]string, 0, n+2)
+	nodes = append(nodes, measurement)
+	for _, tag := range t.tags[:n] {
+		v := tags[tag]
+		if v == "" {
+			return "", false
+		}
+		nodes = append(nodes, v)
+	}
+	return strings.Join(nodes, "."), true
+}
+
+// condition is a condition on the value of the tag
+type condition struct {
+	key   string
+	op    string // "=", "!=", "=~" or "!~"
+	value string
+}
+
+// globCondition returns condition, that matches the node of graphite path
+func globCondition(key, node string) condition {
+	if !isGlob(node) {
+		return condition{key: key, op: "=", value: node}
+	}
+	return condition{key: key, op: "=~", value: globToRegexp(node)}
+}
+
+func isGlob(node string) bool {
+	return strings.ContainsAny(node, "*?[{")
+}
+
+// globToRegexp converts glob of a single node to anchored regular expression
+func globToRegexp(node string) string {
+	return "^" + strings.ReplaceAll(helpers.ConvertGraphiteTargetToPromQL(node), `\?`, ".") + "$"
+}
+
+// globMatcher returns a function, that matches names against the node of graphite path
+func globMatcher(node string) (func(string) bool, merry.Error) {
+	if !isGlob(node) {
+		return func(s string) bool { return s == node }, nil
+	}
+	re, err := regexp.Compile(globToRegexp(node))
+	if err != nil {
+		return nil, merry.Wrap(err).WithValue("glob", node)
+	}
+	return re.MatchString, nil
+}
+
+// tagExpressions are parsed expressions of seriesByTag. Name of the series is 'measurement.field', so expression
+// on 'name' selects measurement and field, others are conditions on influx tags.
+type tagExpressions struct {
+	name       *condition
+	conditions []condition
+}
+
+func parseTagExpressions(tvs map[string]types.Tag) (tagExpressions, merry.Error) {
+	var res tagExpressions
+	for key, t := range tvs {
+		if key == "" {
+			return res, ErrInvalidTagExpression.WithValue("expression", t.OP+t.TagValue)
+		}
+		c := condition{key: key, op: t.OP, value: t.TagValue}
+		switch t.OP {
+		case "=", "!=":
+		case "=~", "!~":
+			// graphite matches regular expressions from the beginning of the value
+			if !strings.HasPrefix(c.value, "^") {
+				c.value = "^(" + c.value + ")"
+			}
+		default:
+			return res, ErrInvalidTagExpression.WithValue("expression", key+t.OP+t.TagValue)
+		}
+		if key == "name" {
+			res.name = &c
+			continue
+		}
+		res.conditions = append(res.conditions, c)
+	}
+	if res.name == nil && len(res.conditions) == 0 {
+		return res, ErrInvalidTagExpression.WithMessage("no tag expressions")
+	}
+	sort.Slice(res.conditions, func(i, j int) bool {
+		return res.conditions[i].key < res.conditions[j].key
+	})
+	return res, nil
+}
+
+// matchName returns a function, that matches name of the series against expression on 'name'
+func (e tagExpressions) matchName() (func(string) bool, merry.Error) {
+	if e.name == nil {
+		return func(string) bool { return true }, nil
+	}
+	c := *e.name
+	switch c.op {
+	case "=":
+		return func(s string) bool { return s == c.value }, nil
+	case "!=":
+		return func(s string) bool { return s != c.value }, nil
+	}
+	re, err := regexp.Compile(c.value)
+	if err != nil {
+		return nil, ErrInvalidTagExpression.WithValue("expression", "name"+c.op+c.value).WithCause(err)
+	}
+	if c.op == "=~" {
+		return re.MatchString, nil
+	}
+	return func(s string) bool { return !re.MatchString(s) }, nil
+}
+
+// taggedName returns name of the series in graphite format ('measurement.field;tag1=value1;tag2=value2')
+func taggedName(measurement, field string, tags map[string]string) string {
+	var sb strings.Builder
+	sb.WriteString(measurement + "." + field)
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if tags[k] != "" {
+			sb.WriteString(";" + k + "=" + tags[k])
+		}
+	}
+	return sb.String()
+}
@@ -15,6 +15,7 @@ import (
 
 	"github.com/go-graphite/carbonapi/limiter"
 	"github.com/go-graphite/carbonapi/zipper/metadata"
+	"github.com/go-graphite/carbonapi/zipper/protocols/prometheus/helpers"
 	"github.com/go-graphite/carbonapi/zipper/types"
 )
 
@@ -48,6 +49,7 @@ type IronDBGroup struct {
 	accountID      int64
 	graphiteRollup int64
 	graphitePrefix string
+	retention      time.Duration
 }
 
 func NewWithLimiter(logger *zap.Logger, config types.BackendV2, tldCacheDisabled, requireSuccessAll bool, limiter limiter.ServerLimiter) (types.BackendServer, merry.Error) {
@@ -177,6 +179,9 @@ func NewWithLimiter(logger *zap.Logger, config types.BackendV2, tldCacheDisabled
 				zap.String("type_expected", "int"),
 			)
 		}
+		if tmpInt <= 0 {
+			return nil, merry.Errorf("irondb_graphite_rollup must be positive, got %d", tmpInt)
+		}
 		graphiteRollup = int64(tmpInt)
 	}
 
@@ -191,6 +196,27 @@ func NewWithLimiter(logger *zap.Logger, config types.BackendV2, tldCacheDisabled
 		graphitePrefix = tmpStr
 	}
 
+	var retention time.Duration
+	if retentionOpt, ok := config.BackendOptions["irondb_retention"]; ok {
+		if tmpStr, ok = retentionOpt.(string); ok {
+			interval, err := helpers.ParseDuration(tmpStr)
+			if err != nil {
+				logger.Fatal("failed to parse option",
+					zap.String("option_name", "irondb_retention"),
+					zap.String("option_value", tmpStr),
+					zap.Errors("errors", []error{err}),
+				)
+			}
+			retention = interval
+		} else {
+			logger.Fatal("failed to parse option",
+				zap.String("option_name", "irondb_retention"),
+				zap.Any("option_value", tmpStr),
+				zap.Errors("errors", []error{fmt.Errorf("not a string")}),
+			)
+		}
+	}
+
 	snowthClient, err := gosnowth.NewClient(context.Background(), cfg)
 	if err != nil {
 		logger.Fatal("failed to create snowth client",
@@ -208,6 +234,7 @@ func NewWithLimiter(logger *zap.Logger, config types.BackendV2, tldCacheDisabled
 		accountID:            accountID,
 		graphiteRollup:       graphiteRollup,
 		graphitePrefix:       graphitePrefix,
+		retention:            retention,
 		limiter:              limiter,
 		logger:               logger,
 	}
@@ -540,16 +567,167 @@ func (c *IronDBGroup) Find(ctx context.Context, request *protov3.MultiGlobReques
 	return &r, stats, nil
 }
 
+func processInfoErrors(err error, e merry.Error, stats *types.Stats, query string) merry.Error {
+	stats.InfoErrors++
+	if merry.Is(err, types.ErrTimeoutExceeded) {
+		stats.Timeouts++
+		stats.InfoTimeouts++
+	}
+	if e == nil {
+		e = merry.Wrap(err).WithValue("query", query)
+	} else {
+		e = e.WithCause(err)
+	}
+	return e
+}
+
+// seriesNames returns names of the series, that match graphite glob or seriesByTag expression, in graphite format
+func (c *IronDBGroup) seriesNames(ctx context.Context, logger *zap.Logger, stats *types.Stats, query string) ([]string, error) {
+	var names []string
+	if strings.HasPrefix(query, "seriesByTag") {
+		tagQuery := graphiteExprListToIronDBTagQuery(strings.Split(query[12:len(query)-1], ",")) // 12 is len("seriesByTag(")
+		logger.Debug("will do tag find query",
+			zap.Int64("accountID", c.accountID),
+			zap.String("query", tagQuery),
+		)
+		stats.FindRequests++
+		tagMetrics, err := c.client.FindTagsContext(ctx, c.accountID, tagQuery, &gosnowth.FindTagsOptions{Limit: -1})
+		if err != nil {
+			return nil, err
+		}
+		for _, metric := range tagMetrics.Items {
+			names = append(names, convertNameToGraphite(metric.MetricName))
+		}
+		return uniqueSorted(names), nil
+	}
+
+	logger.Debug("will do find query",
+		zap.Int64("accountID", c.accountID),
+		zap.String("query", query),
+		zap.String("prefix", c.graphitePrefix),
+	)
+	stats.FindRequests++
+	findResult, err := c.client.GraphiteFindMetricsContext(ctx, c.accountID, c.graphitePrefix, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, metric := range findResult {
+		if metric.Leaf {
+			names = append(names, convertNameToGraphite(metric.Name))
+		}
+	}
+	return uniqueSorted(names), nil
+}
+
+// Info returns rollup, that is used to fetch graphite data, for every series, that matches the names. Retention is
+// unknown to IRONdb clients and is reported only if irondb_retention is set.
 func (c *IronDBGroup) Info(ctx context.Context, request *protov3.MultiMetricsInfoRequest) (*protov3.ZipperInfoResponse, *types.Stats, merry.Error) {
-	return nil, nil, types.ErrNotSupportedByBackend
+	logger := c.logger.With(zap.String("type", "info"), zap.Strings("request", request.Names))
+	stats := &types.Stats{}
+
+	retention := int64(c.retention.Seconds())
+	var infos protov3.MultiMetricsInfoResponse
+	var e merry.Error
+	for _, query := range request.Names {
+		stats.InfoRequests++
+		names, err := c.seriesNames(ctx, logger, stats, query)
+		if err != nil {
+			e = processInfoErrors(err, e, stats, query)
+			continue
+		}
+		for _, name := range names {
+			infos.Metrics = append(infos.Metrics, protov3.MetricsInfoResponse{
+				Name:              name,
+				ConsolidationFunc: "average",
+				MaxRetention:      retention,
+				Retentions: []protov3.Retention{{
+					SecondsPerPoint: c.graphiteRollup,
+					NumberOfPoints:  retention / c.graphiteRollup,
+				}},
+			})
+		}
+	}
+
+	if e != nil && len(infos.Metrics) == 0 {
+		stats.FailedServers = []string{c.groupName}
+		logger.Error("errors occurred while getting results",
+			zap.Any("errors", e),
+		)
+		return nil, stats, e
+	}
+	stats.MemoryUsage = int64(infos.Size())
+
+	r := &protov3.ZipperInfoResponse{
+		Info: map[string]protov3.MultiMetricsInfoResponse{
+			c.groupName: infos,
+		},
+	}
+	return r, stats, nil
 }
 
+// List walks graphite tree of the account, one find request per branch
 func (c *IronDBGroup) List(ctx context.Context) (*protov3.ListMetricsResponse, *types.Stats, merry.Error) {
-	return nil, nil, types.ErrNotImplementedYet
+	logger := c.logger.With(zap.String("type", "list"))
+	stats := &types.Stats{}
+
+	r := &protov3.ListMetricsResponse{}
+	queue := []string{"*"}
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, stats, types.ErrTimeoutExceeded.WithCause(err)
+		}
+		query := queue[0]
+		queue = queue[1:]
+
+		logger.Debug("will do find query",
+			zap.Int64("accountID", c.accountID),
+			zap.String("query", query),
+			zap.String("prefix", c.graphitePrefix),
+		)
+		stats.FindRequests++
+		findResult, err := c.client.GraphiteFindMetricsContext(ctx, c.accountID, c.graphitePrefix, query, nil)
+		if err != nil {
+			stats.FailedServers = []string{c.groupName}
+			return nil, stats, processFindErrors(err, nil, stats, query)
+		}
+		for _, metric := range findResult {
+			if metric.Leaf {
+				r.Metrics = append(r.Metrics, convertNameToGraphite(metric.Name))
+			} else {
+				queue = append(queue, metric.Name+".*")
+			}
+		}
+	}
+	r.Metrics = uniqueSorted(r.Metrics)
+	return r, stats, nil
 }
 
+// Stats returns cardinality of the account: Size is amount of series of every metric name, as it's reported by
+// IRONdb tag search
 func (c *IronDBGroup) Stats(ctx context.Context) (*protov3.MetricDetailsResponse, *types.Stats, merry.Error) {
-	return nil, nil, types.ErrNotSupportedByBackend
+	logger := c.logger.With(zap.String("type", "stats"))
+	stats := &types.Stats{}
+
+	query := "and(__name:*)"
+	logger.Debug("will do tag find query",
+		zap.Int64("accountID", c.accountID),
+		zap.String("query", query),
+	)
+	stats.FindRequests++
+	tagMetrics, err := c.client.FindTagsContext(ctx, c.accountID, query, &gosnowth.FindTagsOptions{Limit: -1})
+	if err != nil {
+		stats.FailedServers = []string{c.groupName}
+		return nil, stats, processFindErrors(err, nil, stats, query)
+	}
+
+	names := make([]string, 0, len(tagMetrics.Items))
+	for _, metric := range tagMetrics.Items {
+		names = append(names, convertNameToGraphite(metric.MetricName))
+	}
+	r := &protov3.MetricDetailsResponse{
+		Metrics: seriesCardinality(names),
+	}
+	return r, stats, nil
 }
 
 func (c *IronDBGroup) doTagQuery(ctx context.Context, isTagName bool, query string, limit int64) ([]string, merry.Error) {
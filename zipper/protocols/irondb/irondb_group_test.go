@@ -0,0 +1,30 @@
+package irondb
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+func TestNewInvalidGraphiteRollup(t *testing.T) {
+	timeouts := types.Timeouts{Find: time.Second, Render: time.Second, Connect: time.Second}
+	concurrencyLimit, maxTries, maxBatchSize := 10, 1, 100
+	for _, rollup := range []int{0, -60} {
+		_, err := New(zap.NewNop(), types.BackendV2{
+			GroupName:        "irondb",
+			Protocol:         "irondb",
+			Servers:          []string{"http://127.0.0.1:8112"},
+			Timeouts:         &timeouts,
+			ConcurrencyLimit: &concurrencyLimit,
+			MaxTries:         &maxTries,
+			MaxBatchSize:     &maxBatchSize,
+			BackendOptions:   map[string]interface{}{"irondb_graphite_rollup": rollup},
+		}, false, false)
+		if err == nil {
+			t.Errorf("irondb_graphite_rollup %d is not rejected", rollup)
+		}
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"math"
 	"regexp"
+	"sort"
 	"strings"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
 )
 
 // graphiteExprListToIronDBTagQuery - converts list of Graphite Tag expressions to IronDB Tag query
@@ -66,6 +69,32 @@ func convertNameToGraphite(name string) string {
 	return name
 }
 
+// uniqueSorted sorts names and removes duplicates, IRONdb returns the name once per check, that reports it
+func uniqueSorted(names []string) []string {
+	sort.Strings(names)
+	res := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// seriesCardinality counts series (graphite names with tags) of every metric name
+func seriesCardinality(names []string) map[string]*protov3.MetricDetails {
+	res := make(map[string]*protov3.MetricDetails)
+	for _, name := range uniqueSorted(names) {
+		metric, _, _ := strings.Cut(name, ";")
+		if d, ok := res[metric]; ok {
+			d.Size_++
+		} else {
+			res[metric] = &protov3.MetricDetails{Size_: 1}
+		}
+	}
+	return res
+}
+
 // AdjustStep adjusts step keeping in mind default/configurable limit of maximum points per query
 // Steps sequence is aligned with Grafana. Step progresses in the following order:
 // minimal configured step if not default => 20 => 30 => 60 => 120 => 300 => 600 => 900 => 1200 => 1800 => 3600 => 7200 => 10800 => 21600 => 43200 => 86400
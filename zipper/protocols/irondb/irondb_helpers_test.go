@@ -1,7 +1,10 @@
 package irondb
 
 import (
+	"reflect"
 	"testing"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
 )
 
 func TestGraphiteExprListToIronDBTagQuery(t *testing.T) {
@@ -50,6 +53,26 @@ func TestConvertNameToGraphite(t *testing.T) {
 	}
 }
 
+func TestSeriesCardinality(t *testing.T) {
+	cases := []struct {
+		desc           string
+		input          []string
+		expectedOutput map[string]*protov3.MetricDetails
+	}{
+		{"TestEmpty", []string{}, map[string]*protov3.MetricDetails{}},
+		{"TestGraphite", []string{"a.b", "a.c"}, map[string]*protov3.MetricDetails{"a.b": {Size_: 1}, "a.c": {Size_: 1}}},
+		{"TestTagged", []string{"cpu;host=a", "cpu;host=b", "mem;host=a", "cpu"}, map[string]*protov3.MetricDetails{"cpu": {Size_: 3}, "mem": {Size_: 1}}},
+		{"TestSeveralChecks", []string{"cpu;host=a", "cpu;host=a"}, map[string]*protov3.MetricDetails{"cpu": {Size_: 1}}},
+	}
+	for _, tc := range cases {
+		output := seriesCardinality(tc.input)
+		if !reflect.DeepEqual(output, tc.expectedOutput) {
+			t.Fatalf("%s: expected value: %v got: %v for input: %s",
+				tc.desc, tc.expectedOutput, output, tc.input)
+		}
+	}
+}
+
 func BenchmarkConvertNameToGraphite(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		_ = convertNameToGraphite("name|MT{tag1}|ST[c1=v1,c2=v2,c3=v3]|MT{tag}")
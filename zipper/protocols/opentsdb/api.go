@@ -0,0 +1,175 @@
+package opentsdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ansel1/merry"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+// filter is a tag filter of /api/query (OpenTSDB 2.2+)
+type filter struct {
+	Type    string `json:"type"`
+	TagK    string `json:"tagk"`
+	Filter  string `json:"filter"`
+	GroupBy bool   `json:"groupBy"`
+}
+
+type subQuery struct {
+	Aggregator string   `json:"aggregator"`
+	Metric     string   `json:"metric"`
+	Downsample string   `json:"downsample,omitempty"`
+	Filters    []filter `json:"filters,omitempty"`
+}
+
+// queryRequest is a body of /api/query, that is sent with POST
+type queryRequest struct {
+	Start        int64      `json:"start"`
+	End          int64      `json:"end"`
+	Queries      []subQuery `json:"queries"`
+	MsResolution bool       `json:"msResolution"`
+}
+
+func (r queryRequest) Marshal() ([]byte, merry.Error) {
+	b, err := json.Marshal(r)
+	return b, merry.Wrap(err)
+}
+
+func (r queryRequest) LogInfo() interface{} {
+	return r
+}
+
+func (r queryRequest) Method() string {
+	return "POST"
+}
+
+func (r queryRequest) Headers() map[string]string {
+	return map[string]string{"Content-Type": "application/json"}
+}
+
+type queryResult struct {
+	Metric string            `json:"metric"`
+	Tags   map[string]string `json:"tags"`
+	// Dps are datapoints by timestamp in seconds, value is null for empty intervals of downsampling
+	Dps map[string]*float64 `json:"dps"`
+}
+
+type lookupResponse struct {
+	Results []struct {
+		Metric string            `json:"metric"`
+		Tags   map[string]string `json:"tags"`
+	} `json:"results"`
+	TotalResults int `json:"totalResults"`
+}
+
+// series is a time series, that is returned by /api/search/lookup
+type series struct {
+	metric string
+	tags   map[string]string
+}
+
+func (c *OpenTSDBGroup) get(ctx context.Context, logger *zap.Logger, stats *types.Stats, uri string, res interface{}) merry.Error {
+	logger.Debug("will do query",
+		zap.String("uri", uri),
+	)
+	r, err := c.httpQuery.DoQueryWithStats(ctx, logger, uri, nil, stats)
+	if err != nil {
+		return err
+	}
+	if r == nil || len(r.Response) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(r.Response, res); err != nil {
+		return types.ErrUnmarshalFailed.WithCause(err)
+	}
+	return nil
+}
+
+// suggest returns names of the type ('metrics', 'tagk' or 'tagv'), that start with the prefix
+func (c *OpenTSDBGroup) suggest(ctx context.Context, logger *zap.Logger, stats *types.Stats, typ, prefix string) ([]string, merry.Error) {
+	v := url.Values{
+		"type": []string{typ},
+		"q":    []string{prefix},
+		"max":  []string{strconv.Itoa(c.suggestMax)},
+	}
+	var names []string
+	if err := c.get(ctx, logger, stats, "/api/suggest?"+v.Encode(), &names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// lookupQuery returns query of /api/search/lookup ('metric{tagk=tagv,...}'), tags with empty value match any value
+func lookupQuery(metric string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(metric)
+	sb.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		v := tags[k]
+		if v == "" {
+			v = "*"
+		}
+		sb.WriteString(k + "=" + v)
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// lookup returns series of the metric (any metric, if it's empty), that have the tags
+func (c *OpenTSDBGroup) lookup(ctx context.Context, logger *zap.Logger, stats *types.Stats, metric string, tags map[string]string) ([]series, merry.Error) {
+	v := url.Values{
+		"m":     []string{lookupQuery(metric, tags)},
+		"limit": []string{strconv.Itoa(c.lookupLimit)},
+	}
+	var r lookupResponse
+	if err := c.get(ctx, logger, stats, "/api/search/lookup?"+v.Encode(), &r); err != nil {
+		return nil, err
+	}
+	if r.TotalResults > len(r.Results) {
+		logger.Warn("lookup results are truncated",
+			zap.Int("total_results", r.TotalResults),
+			zap.Int("limit", c.lookupLimit),
+		)
+	}
+	res := make([]series, 0, len(r.Results))
+	for _, s := range r.Results {
+		res = append(res, series{metric: s.Metric, tags: s.Tags})
+	}
+	return res, nil
+}
+
+func (c *OpenTSDBGroup) query(ctx context.Context, logger *zap.Logger, stats *types.Stats, req queryRequest) ([]queryResult, merry.Error) {
+	logger.Debug("will do query",
+		zap.Int64("start", req.Start),
+		zap.Int64("end", req.End),
+		zap.Int("queries", len(req.Queries)),
+	)
+	r, err := c.httpQuery.DoQueryWithStats(ctx, logger, "/api/query", req, stats)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil || len(r.Response) == 0 {
+		return nil, nil
+	}
+	var res []queryResult
+	if err := json.Unmarshal(r.Response, &res); err != nil {
+		return nil, types.ErrUnmarshalFailed.WithCause(err)
+	}
+	return res, nil
+}
@@ -0,0 +1,701 @@
+package opentsdb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/limiter"
+	"github.com/go-graphite/carbonapi/zipper/helper"
+	"github.com/go-graphite/carbonapi/zipper/metadata"
+	"github.com/go-graphite/carbonapi/zipper/protocols/prometheus/helpers"
+	prometheusTypes "github.com/go-graphite/carbonapi/zipper/protocols/prometheus/types"
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+func init() {
+	aliases := []string{"opentsdb", "tsdb"}
+	metadata.Metadata.Lock()
+	for _, name := range aliases {
+		metadata.Metadata.SupportedProtocols[name] = struct{}{}
+		metadata.Metadata.ProtocolInits[name] = New
+		metadata.Metadata.ProtocolInitsWithLimiter[name] = NewWithLimiter
+	}
+	defer metadata.Metadata.Unlock()
+}
+
+var ErrInvalidTagExpression = merry.New("invalid tag expression").WithHTTPCode(http.StatusBadRequest)
+
+var nan = math.NaN()
+
+// OpenTSDBGroup is a protocol group for OpenTSDB 2.x HTTP API. Graphite path is the name of the metric, series of
+// the metric are aggregated by aggregator. seriesByTag selects series by OpenTSDB tags and returns them one by one.
+type OpenTSDBGroup struct {
+	groupName string
+	servers   []string
+	protocol  string
+
+	client *http.Client
+
+	limiter              limiter.ServerLimiter
+	logger               *zap.Logger
+	timeout              types.Timeouts
+	maxTries             int
+	maxMetricsPerRequest int
+
+	step              int64
+	maxPointsPerQuery int64
+	aggregator        string
+	downsample        string
+	suggestMax        int
+	lookupLimit       int
+
+	httpQuery *helper.HttpQuery
+}
+
+func stringOption(logger *zap.Logger, config types.BackendV2, name, defaultValue string) string {
+	v, ok := config.BackendOptions[name]
+	if !ok {
+		return defaultValue
+	}
+	s, ok := v.(string)
+	if !ok {
+		logger.Fatal("failed to parse option",
+			zap.String("option_name", name),
+			zap.String("type_parsed", fmt.Sprintf("%T", v)),
+			zap.String("type_expected", "string"),
+		)
+	}
+	return s
+}
+
+func intOption(logger *zap.Logger, config types.BackendV2, name string, defaultValue int) int {
+	v, ok := config.BackendOptions[name]
+	if !ok {
+		return defaultValue
+	}
+	i, ok := v.(int)
+	if !ok || i <= 0 {
+		logger.Fatal("failed to parse option",
+			zap.String("option_name", name),
+			zap.Any("option_value", v),
+			zap.String("type_expected", "positive int"),
+		)
+	}
+	return i
+}
+
+func NewWithLimiter(logger *zap.Logger, config types.BackendV2, tldCacheDisabled, requireSuccessAll bool, limiter limiter.ServerLimiter) (types.BackendServer, merry.Error) {
+	logger = logger.With(zap.String("type", "opentsdb"), zap.String("protocol", config.Protocol), zap.String("name", config.GroupName))
+
+	logger.Warn("support for this backend protocol is experimental, use with caution")
+	httpClient := helper.GetHTTPClient(logger, config)
+
+	stepStr := stringOption(logger, config, "step", "60s")
+	if stepStr != "" && stepStr[len(stepStr)-1] >= '0' && stepStr[len(stepStr)-1] <= '9' {
+		stepStr += "s"
+	}
+	step, err := time.ParseDuration(stepStr)
+	if err != nil || step < time.Second {
+		logger.Fatal("failed to parse option",
+			zap.String("option_name", "step"),
+			zap.String("option_value", stepStr),
+			zap.Error(err),
+		)
+	}
+
+	httpQuery := helper.NewHttpQuery(config.GroupName, config.Servers, *config.MaxTries, limiter, httpClient, "application/json").Configure(config)
+
+	c := &OpenTSDBGroup{
+		groupName:            config.GroupName,
+		servers:              config.Servers,
+		protocol:             config.Protocol,
+		timeout:              *config.Timeouts,
+		maxTries:             *config.MaxTries,
+		maxMetricsPerRequest: *config.MaxBatchSize,
+
+		step:              int64(step.Seconds()),
+		maxPointsPerQuery: int64(intOption(logger, config, "max_points_per_query", 11000)),
+		aggregator:        stringOption(logger, config, "aggregator", "sum"),
+		downsample:        stringOption(logger, config, "downsample", "avg"),
+		suggestMax:        intOption(logger, config, "suggest_max", 10000),
+		lookupLimit:       intOption(logger, config, "lookup_limit", 10000),
+
+		client:  httpClient,
+		limiter: limiter,
+		logger:  logger,
+
+		httpQuery: httpQuery,
+	}
+
+	return c, nil
+}
+
+func New(logger *zap.Logger, config types.BackendV2, tldCacheDisabled, requireSuccessAll bool) (types.BackendServer, merry.Error) {
+	if config.ConcurrencyLimit == nil {
+		return nil, types.ErrConcurrencyLimitNotSet
+	}
+	if len(config.Servers) == 0 {
+		return nil, types.ErrNoServersSpecified
+	}
+	l := limiter.NewServerLimiter(config.Servers, *config.ConcurrencyLimit)
+
+	return NewWithLimiter(logger, config, tldCacheDisabled, requireSuccessAll, l)
+}
+
+func (c *OpenTSDBGroup) Children() []types.BackendServer {
+	return []types.BackendServer{c}
+}
+
+func (c OpenTSDBGroup) MaxMetricsPerRequest() int {
+	return c.maxMetricsPerRequest
+}
+
+func (c OpenTSDBGroup) Name() string {
+	return c.groupName
+}
+
+func (c OpenTSDBGroup) Backends() []string {
+	return c.servers
+}
+
+// globMatcher returns a function, that matches names against the node of graphite path
+func globMatcher(node string) (func(string) bool, merry.Error) {
+	if !strings.ContainsAny(node, "*?[{") {
+		return func(s string) bool { return s == node }, nil
+	}
+	re, err := regexp.Compile("^" + strings.ReplaceAll(helpers.ConvertGraphiteTargetToPromQL(node), `\?`, ".") + "$")
+	if err != nil {
+		return nil, merry.Wrap(err).WithValue("glob", node)
+	}
+	return re.MatchString, nil
+}
+
+// metrics returns metrics, that start with the prefix and match the function. Suggest API is the only way to list
+// metrics of OpenTSDB, so names are limited by suggest_max.
+func (c *OpenTSDBGroup) metrics(ctx context.Context, logger *zap.Logger, stats *types.Stats, prefix string, match func(string) bool) ([]string, merry.Error) {
+	names, err := c.suggest(ctx, logger, stats, "metrics", prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) >= c.suggestMax {
+		logger.Warn("suggested metrics are truncated",
+			zap.String("prefix", prefix),
+			zap.Int("suggest_max", c.suggestMax),
+		)
+	}
+	res := names[:0]
+	for _, name := range names {
+		if match(name) {
+			res = append(res, name)
+		}
+	}
+	return res, nil
+}
+
+// parseGlob returns literal prefix of graphite glob and matchers of its nodes
+func parseGlob(glob string) (string, []func(string) bool, merry.Error) {
+	nodes := strings.Split(glob, ".")
+	matchers := make([]func(string) bool, 0, len(nodes))
+	for _, node := range nodes {
+		match, err := globMatcher(node)
+		if err != nil {
+			return "", nil, err
+		}
+		matchers = append(matchers, match)
+	}
+	prefix := glob
+	if idx := strings.IndexAny(glob, "*?[{"); idx >= 0 {
+		prefix = glob[:idx]
+	}
+	return prefix, matchers, nil
+}
+
+// matchNodes returns true, if the first nodes of the name match the glob
+func matchNodes(matchers []func(string) bool, nodes []string) bool {
+	if len(nodes) < len(matchers) {
+		return false
+	}
+	for i, match := range matchers {
+		if !match(nodes[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// globMetrics returns metrics, which names match graphite glob
+func (c *OpenTSDBGroup) globMetrics(ctx context.Context, logger *zap.Logger, stats *types.Stats, glob string) ([]string, merry.Error) {
+	prefix, matchers, err := parseGlob(glob)
+	if err != nil {
+		return nil, err
+	}
+	return c.metrics(ctx, logger, stats, prefix, func(name string) bool {
+		nodes := strings.Split(name, ".")
+		return len(nodes) == len(matchers) && matchNodes(matchers, nodes)
+	})
+}
+
+// taggedMetrics returns metrics, that can have series matching expressions
+func (c *OpenTSDBGroup) taggedMetrics(ctx context.Context, logger *zap.Logger, stats *types.Stats, e tagExpressions) ([]string, merry.Error) {
+	if e.name != nil {
+		prefix := ""
+		if e.name.op == "=" {
+			prefix = e.name.value
+		}
+		return c.metrics(ctx, logger, stats, prefix, e.matchName)
+	}
+
+	tags := e.lookupTags()
+	if len(tags) == 0 {
+		return nil, ErrInvalidTagExpression.WithMessage("at least one expression must select name or value of a tag")
+	}
+	found, err := c.lookup(ctx, logger, stats, "", tags)
+	if err != nil {
+		return nil, err
+	}
+	unique := make(map[string]struct{})
+	var res []string
+	for _, s := range found {
+		if _, ok := unique[s.metric]; !ok && e.match(s.metric, s.tags) {
+			unique[s.metric] = struct{}{}
+			res = append(res, s.metric)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (c *OpenTSDBGroup) find(ctx context.Context, logger *zap.Logger, stats *types.Stats, query string) ([]protov3.GlobMatch, merry.Error) {
+	if strings.Contains(query, ";") {
+		// tagged series exists, if lookup finds it
+		e, err := parseTaggedName(query)
+		if err != nil {
+			return nil, err
+		}
+		found, err := c.lookup(ctx, logger, stats, e.name.value, e.lookupTags())
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range found {
+			if e.match(s.metric, s.tags) {
+				return []protov3.GlobMatch{{Path: query, IsLeaf: true}}, nil
+			}
+		}
+		return nil, nil
+	}
+
+	prefix, matchers, err := parseGlob(query)
+	if err != nil {
+		return nil, err
+	}
+	names, err := c.metrics(ctx, logger, stats, prefix, func(name string) bool {
+		return matchNodes(matchers, strings.Split(name, "."))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the same path can be both a metric and a prefix of other metrics
+	unique := make(map[protov3.GlobMatch]struct{})
+	res := make([]protov3.GlobMatch, 0)
+	for _, name := range names {
+		nodes := strings.Split(name, ".")
+		m := protov3.GlobMatch{
+			Path:   strings.Join(nodes[:len(matchers)], "."),
+			IsLeaf: len(nodes) == len(matchers),
+		}
+		if _, ok := unique[m]; !ok {
+			unique[m] = struct{}{}
+			res = append(res, m)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Path == res[j].Path {
+			return !res[i].IsLeaf
+		}
+		return res[i].Path < res[j].Path
+	})
+	return res, nil
+}
+
+func (c *OpenTSDBGroup) Find(ctx context.Context, request *protov3.MultiGlobRequest) (*protov3.MultiGlobResponse, *types.Stats, merry.Error) {
+	logger := c.logger.With(zap.String("type", "find"), zap.Strings("request", request.Metrics))
+	stats := &types.Stats{}
+
+	r := protov3.MultiGlobResponse{
+		Metrics: make([]protov3.GlobResponse, 0, len(request.Metrics)),
+	}
+	var e merry.Error
+	for _, query := range request.Metrics {
+		stats.FindRequests++
+		matches, err := c.find(ctx, logger, stats, query)
+		if err != nil {
+			stats.FindErrors++
+			if merry.Is(err, types.ErrTimeoutExceeded) {
+				stats.Timeouts++
+				stats.FindTimeouts++
+			}
+			if e == nil {
+				e = err
+			} else {
+				e = e.WithCause(err)
+			}
+			continue
+		}
+		r.Metrics = append(r.Metrics, protov3.GlobResponse{
+			Name:    query,
+			Matches: matches,
+		})
+	}
+
+	if e != nil {
+		stats.FailedServers = []string{c.groupName}
+		logger.Error("errors occurred while getting results",
+			zap.Any("errors", e),
+		)
+		return &r, stats, e
+	}
+	return &r, stats, nil
+}
+
+// fetchResponse puts datapoints to the grid with the step of downsampling
+func fetchResponse(name, pathExpr string, dps map[string]*float64, step int64) (protov3.FetchResponse, bool, merry.Error) {
+	if len(dps) == 0 {
+		return protov3.FetchResponse{}, false, nil
+	}
+	timestamps := make([]int64, 0, len(dps))
+	values := make(map[int64]float64, len(dps))
+	for k, v := range dps {
+		ts, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return protov3.FetchResponse{}, false, types.ErrUnmarshalFailed.WithCause(err).WithValue("timestamp", k)
+		}
+		ts -= ts % step
+		if _, ok := values[ts]; !ok {
+			timestamps = append(timestamps, ts)
+			values[ts] = nan
+		}
+		if v != nil {
+			values[ts] = *v
+		}
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+
+	start, stop := timestamps[0], timestamps[len(timestamps)-1]
+	res := protov3.FetchResponse{
+		Name:              name,
+		PathExpression:    pathExpr,
+		ConsolidationFunc: "Average",
+		StartTime:         start,
+		StopTime:          stop,
+		StepTime:          step,
+		Values:            make([]float64, (stop-start)/step+1),
+		XFilesFactor:      0.0,
+	}
+	for i := range res.Values {
+		v, ok := values[start+int64(i)*step]
+		if !ok {
+			v = nan
+		}
+		res.Values[i] = v
+	}
+	return res, true, nil
+}
+
+func (c *OpenTSDBGroup) fetch(ctx context.Context, logger *zap.Logger, stats *types.Stats, m protov3.FetchRequest, step int64) ([]protov3.FetchResponse, merry.Error) {
+	var e *tagExpressions
+	switch {
+	case strings.HasPrefix(m.Name, "seriesByTag(") && strings.HasSuffix(m.Name, ")"):
+		exprs, err := parseSeriesByTag(m.Name)
+		if err != nil {
+			return nil, err
+		}
+		e = &exprs
+	case strings.Contains(m.Name, ";"):
+		exprs, err := parseTaggedName(m.Name)
+		if err != nil {
+			return nil, err
+		}
+		e = &exprs
+	}
+
+	var metrics []string
+	var err merry.Error
+	if e == nil {
+		metrics, err = c.globMetrics(ctx, logger, stats, m.Name)
+	} else {
+		metrics, err = c.taggedMetrics(ctx, logger, stats, *e)
+	}
+	if err != nil || len(metrics) == 0 {
+		return nil, err
+	}
+
+	req := queryRequest{
+		Start:   m.StartTime,
+		End:     m.StopTime,
+		Queries: make([]subQuery, 0, len(metrics)),
+	}
+	downsample := strconv.FormatInt(step, 10) + "s-" + c.downsample + "-null"
+	for _, metric := range metrics {
+		q := subQuery{
+			Aggregator: c.aggregator,
+			Metric:     metric,
+			Downsample: downsample,
+		}
+		if e != nil {
+			// every series is returned with its own tags
+			q.Aggregator = "none"
+			q.Filters = e.filters()
+		}
+		req.Queries = append(req.Queries, q)
+	}
+
+	results, err := c.query(ctx, logger, stats, req)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]protov3.FetchResponse, 0, len(results))
+	for _, r := range results {
+		name := r.Metric
+		if e != nil {
+			if !e.match(r.Metric, r.Tags) {
+				continue
+			}
+			name = taggedName(r.Metric, r.Tags)
+		}
+		fr, ok, err := fetchResponse(name, m.PathExpression, r.Dps, step)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			res = append(res, fr)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res, nil
+}
+
+func (c *OpenTSDBGroup) Fetch(ctx context.Context, request *protov3.MultiFetchRequest) (*protov3.MultiFetchResponse, *types.Stats, merry.Error) {
+	logger := c.logger.With(zap.String("type", "fetch"), zap.String("request", request.String()))
+	stats := &types.Stats{}
+
+	var r protov3.MultiFetchResponse
+	var e merry.Error
+	for _, m := range request.Metrics {
+		stats.RenderRequests++
+
+		maxPointsPerQuery := c.maxPointsPerQuery
+		if m.MaxDataPoints != 0 {
+			maxPointsPerQuery = m.MaxDataPoints
+		}
+		step := helpers.AdjustStep(m.StartTime, m.StopTime, maxPointsPerQuery, c.step, 0)
+
+		series, err := c.fetch(ctx, logger, stats, m, step)
+		if err != nil {
+			stats.RenderErrors++
+			if merry.Is(err, types.ErrTimeoutExceeded) {
+				stats.Timeouts++
+				stats.RenderTimeouts++
+			}
+			if e == nil {
+				e = err
+			} else {
+				e = e.WithCause(err)
+			}
+			continue
+		}
+		r.Metrics = append(r.Metrics, series...)
+	}
+
+	if e != nil {
+		stats.FailedServers = []string{c.groupName}
+		logger.Error("errors occurred while getting results",
+			zap.Any("errors", e),
+		)
+		return &r, stats, e
+	}
+	return &r, stats, nil
+}
+
+func (c *OpenTSDBGroup) Info(ctx context.Context, request *protov3.MultiMetricsInfoRequest) (*protov3.ZipperInfoResponse, *types.Stats, merry.Error) {
+	return nil, nil, types.ErrNotSupportedByBackend
+}
+
+func (c *OpenTSDBGroup) List(ctx context.Context) (*protov3.ListMetricsResponse, *types.Stats, merry.Error) {
+	return nil, nil, types.ErrNotImplementedYet
+}
+
+func (c *OpenTSDBGroup) Stats(ctx context.Context) (*protov3.MetricDetailsResponse, *types.Stats, merry.Error) {
+	return nil, nil, types.ErrNotSupportedByBackend
+}
+
+// tagQuery parses query of graphite tags autocompletion API
+func tagQuery(query string) (url.Values, *tagExpressions, merry.Error) {
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, nil, ErrInvalidTagExpression.WithCause(err)
+	}
+	exprs := params["expr"]
+	if len(exprs) == 0 {
+		return params, nil, nil
+	}
+	tvs := make(map[string]prometheusTypes.Tag, len(exprs))
+	for _, expr := range exprs {
+		name, t := helpers.PromethizeTagValue(expr)
+		tvs[name] = t
+	}
+	e, merr := parseTagExpressions(tvs)
+	if merr != nil {
+		return nil, nil, merr
+	}
+	return params, &e, nil
+}
+
+// taggedSeries returns series, that match expressions and have the tag (if it's not empty)
+func (c *OpenTSDBGroup) taggedSeries(ctx context.Context, logger *zap.Logger, stats *types.Stats, e tagExpressions, tag string) ([]series, merry.Error) {
+	tags := e.lookupTags()
+	if tag != "" {
+		if _, ok := tags[tag]; !ok {
+			tags[tag] = ""
+		}
+	}
+
+	// lookup needs either metric or tags
+	metrics := []string{""}
+	if e.name != nil && (e.name.op == "=" || len(tags) == 0) {
+		var err merry.Error
+		if metrics, err = c.taggedMetrics(ctx, logger, stats, e); err != nil {
+			return nil, err
+		}
+	}
+
+	var res []series
+	for _, metric := range metrics {
+		found, err := c.lookup(ctx, logger, stats, metric, tags)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range found {
+			if e.match(s.metric, s.tags) {
+				res = append(res, s)
+			}
+		}
+	}
+	return res, nil
+}
+
+// filterTags returns sorted unique values with the prefix
+func filterTags(values []string, prefix string, limit int64) []string {
+	sort.Strings(values)
+	res := make([]string, 0, len(values))
+	for i, v := range values {
+		if (i > 0 && v == values[i-1]) || !strings.HasPrefix(v, prefix) {
+			continue
+		}
+		res = append(res, v)
+		if limit > 0 && int64(len(res)) == limit {
+			break
+		}
+	}
+	return res
+}
+
+func (c *OpenTSDBGroup) TagNames(ctx context.Context, query string, limit int64) ([]string, merry.Error) {
+	logger := c.logger.With(zap.String("type", "tagName"), zap.String("query", query))
+	params, e, err := tagQuery(query)
+	if err != nil {
+		return []string{}, err
+	}
+	prefix := params.Get("tagPrefix")
+
+	names := []string{"name"}
+	if e == nil {
+		keys, err := c.suggest(ctx, logger, &types.Stats{}, "tagk", prefix)
+		if err != nil {
+			return []string{}, err
+		}
+		names = append(names, keys...)
+	} else {
+		found, err := c.taggedSeries(ctx, logger, &types.Stats{}, *e, "")
+		if err != nil {
+			return []string{}, err
+		}
+		for _, s := range found {
+			for k := range s.tags {
+				names = append(names, k)
+			}
+		}
+	}
+	return filterTags(names, prefix, limit), nil
+}
+
+func (c *OpenTSDBGroup) TagValues(ctx context.Context, query string, limit int64) ([]string, merry.Error) {
+	logger := c.logger.With(zap.String("type", "tagValues"), zap.String("query", query))
+	params, e, err := tagQuery(query)
+	if err != nil {
+		return []string{}, err
+	}
+	tag := params.Get("tag")
+	if tag == "" {
+		return []string{}, types.ErrNoTagSpecified
+	}
+	prefix := params.Get("valuePrefix")
+
+	var values []string
+	switch {
+	case tag == "name" && e == nil:
+		values, err = c.suggest(ctx, logger, &types.Stats{}, "metrics", prefix)
+	case tag == "name":
+		values, err = c.taggedMetrics(ctx, logger, &types.Stats{}, *e)
+	default:
+		if e == nil {
+			e = &tagExpressions{}
+		}
+		var found []series
+		found, err = c.taggedSeries(ctx, logger, &types.Stats{}, *e, tag)
+		for _, s := range found {
+			values = append(values, s.tags[tag])
+		}
+	}
+	if err != nil {
+		return []string{}, err
+	}
+	return filterTags(values, prefix, limit), nil
+}
+
+func (c *OpenTSDBGroup) ProbeTLDs(ctx context.Context) ([]string, merry.Error) {
+	logger := c.logger.With(zap.String("function", "prober"))
+	names, err := c.suggest(ctx, logger, &types.Stats{}, "metrics", "")
+	if err != nil {
+		return nil, err
+	}
+	tlds := make([]string, 0, len(names))
+	for _, name := range names {
+		if idx := strings.IndexByte(name, '.'); idx >= 0 {
+			name = name[:idx]
+		}
+		tlds = append(tlds, name)
+	}
+	tlds = filterTags(tlds, "", 0)
+
+	logger.Debug("will return data",
+		zap.Strings("tlds", tlds),
+	)
+	return tlds, nil
+}
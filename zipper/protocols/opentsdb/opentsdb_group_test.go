@@ -0,0 +1,377 @@
+package opentsdb
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+// standIn is a minimal OpenTSDB, that serves suggest, lookup and query APIs
+type standIn struct {
+	t       *testing.T
+	metrics []string
+	series  []series
+
+	sync.Mutex
+	queries []queryRequest
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var res interface{}
+	switch r.URL.Path {
+	case "/api/suggest":
+		q := r.URL.Query()
+		var names []string
+		switch q.Get("type") {
+		case "metrics":
+			names = s.metrics
+		case "tagk":
+			keys := make(map[string]bool)
+			for _, ts := range s.series {
+				for k := range ts.tags {
+					if !keys[k] {
+						keys[k] = true
+						names = append(names, k)
+					}
+				}
+			}
+			sort.Strings(names)
+		}
+		suggested := []string{}
+		for _, name := range names {
+			if strings.HasPrefix(name, q.Get("q")) {
+				suggested = append(suggested, name)
+			}
+		}
+		res = suggested
+	case "/api/search/lookup":
+		m := r.URL.Query().Get("m")
+		idx := strings.IndexByte(m, '{')
+		metric, tags := m[:idx], make(map[string]string)
+		for _, kv := range strings.Split(strings.Trim(m[idx:], "{}"), ",") {
+			if kv != "" {
+				parts := strings.SplitN(kv, "=", 2)
+				tags[parts[0]] = parts[1]
+			}
+		}
+		lookup := lookupResponse{}
+		for _, ts := range s.series {
+			if (metric == "" || ts.metric == metric) && s.hasTags(ts, tags) {
+				lookup.Results = append(lookup.Results, struct {
+					Metric string            `json:"metric"`
+					Tags   map[string]string `json:"tags"`
+				}{ts.metric, ts.tags})
+			}
+		}
+		lookup.TotalResults = len(lookup.Results)
+		res = lookup
+	case "/api/query":
+		var req queryRequest
+		if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.Lock()
+		s.queries = append(s.queries, req)
+		s.Unlock()
+		res = s.query(req)
+	default:
+		s.t.Errorf("unexpected request %s", r.URL)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func (s *standIn) hasTags(ts series, tags map[string]string) bool {
+	for k, v := range tags {
+		if tv, ok := ts.tags[k]; !ok || (v != "*" && v != tv) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *standIn) query(req queryRequest) []queryResult {
+	one, null := 1.0, (*float64)(nil)
+	res := []queryResult{}
+	for _, q := range req.Queries {
+		var matched []series
+		for _, ts := range s.series {
+			if ts.metric != q.Metric {
+				continue
+			}
+			ok := true
+			for _, f := range q.Filters {
+				v, exists := ts.tags[f.TagK]
+				switch f.Type {
+				case "literal_or":
+					ok = ok && exists && v == f.Filter
+				case "regexp":
+					ok = ok && exists && regexp.MustCompile(f.Filter).MatchString(v)
+				case "wildcard":
+					ok = ok && exists
+				}
+			}
+			if ok {
+				matched = append(matched, ts)
+			}
+		}
+		if q.Aggregator == "none" {
+			for _, ts := range matched {
+				res = append(res, queryResult{Metric: ts.metric, Tags: ts.tags, Dps: map[string]*float64{
+					"1700000040": &one,
+					"1700000100": null,
+				}})
+			}
+		} else if len(matched) > 0 {
+			sum := float64(len(matched))
+			res = append(res, queryResult{Metric: q.Metric, Tags: map[string]string{}, Dps: map[string]*float64{
+				"1700000040": &sum,
+				"1700000100": null,
+			}})
+		}
+	}
+	return res
+}
+
+func newTestGroup(t *testing.T) (types.BackendServer, *standIn) {
+	s := &standIn{
+		t:       t,
+		metrics: []string{"app.requests", "sys.cpu", "sys.cpu.system", "sys.cpu.user", "sys.mem.free"},
+		series: []series{
+			{metric: "sys.cpu.user", tags: map[string]string{"host": "web01", "dc": "eu"}},
+			{metric: "sys.cpu.user", tags: map[string]string{"host": "web02", "dc": "us"}},
+			{metric: "sys.cpu.user", tags: map[string]string{"host": "db01", "dc": "eu"}},
+			{metric: "sys.cpu.system", tags: map[string]string{"host": "web01", "dc": "eu"}},
+		},
+	}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	timeouts := types.Timeouts{Find: time.Second, Render: time.Second, Connect: time.Second}
+	concurrencyLimit, maxTries, maxBatchSize, maxIdleConns := 10, 1, 100, 10
+	idleTimeout, keepAlive := time.Minute, time.Second
+	b, err := New(zap.NewNop(), types.BackendV2{
+		GroupName:        "opentsdb",
+		Protocol:         "opentsdb",
+		Servers:          []string{srv.URL},
+		Timeouts:         &timeouts,
+		ConcurrencyLimit: &concurrencyLimit,
+		MaxTries:         &maxTries,
+		MaxBatchSize:     &maxBatchSize,
+
+		MaxIdleConnsPerHost:   &maxIdleConns,
+		IdleConnectionTimeout: &idleTimeout,
+		KeepAliveInterval:     &keepAlive,
+	}, false, false)
+	if err != nil {
+		t.Fatalf("failed to create group: %v", err)
+	}
+	return b, s
+}
+
+func TestFind(t *testing.T) {
+	b, _ := newTestGroup(t)
+
+	tests := []struct {
+		query string
+		want  []protov3.GlobMatch
+	}{
+		{"*", []protov3.GlobMatch{{Path: "app"}, {Path: "sys"}}},
+		{"sys.cpu*", []protov3.GlobMatch{{Path: "sys.cpu"}, {Path: "sys.cpu", IsLeaf: true}}},
+		{"sys.*.u?er", []protov3.GlobMatch{{Path: "sys.cpu.user", IsLeaf: true}}},
+		{"sys.{cpu,mem}.*", []protov3.GlobMatch{
+			{Path: "sys.cpu.system", IsLeaf: true},
+			{Path: "sys.cpu.user", IsLeaf: true},
+			{Path: "sys.mem.free", IsLeaf: true},
+		}},
+		{"sys.cpu.user;host=web01", []protov3.GlobMatch{{Path: "sys.cpu.user;host=web01", IsLeaf: true}}},
+		{"sys.cpu.user;host=web09", nil},
+		{"sys.disk.*", []protov3.GlobMatch{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			res, _, err := b.Find(t.Context(), &protov3.MultiGlobRequest{Metrics: []string{tt.query}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(res.Metrics) != 1 || len(res.Metrics[0].Matches) != len(tt.want) ||
+				(len(tt.want) > 0 && !reflect.DeepEqual(res.Metrics[0].Matches, tt.want)) {
+				t.Fatalf("unexpected result: %+v", res.Metrics)
+			}
+		})
+	}
+}
+
+func TestFetch(t *testing.T) {
+	tests := []struct {
+		name          string
+		target        string
+		maxDataPoints int64
+		wantQueries   []subQuery
+		wantNames     []string
+		wantValues    []float64
+		wantStep      int64
+	}{
+		{
+			name:   "path",
+			target: "sys.*.{system,free}",
+			wantQueries: []subQuery{
+				{Aggregator: "sum", Metric: "sys.cpu.system", Downsample: "60s-avg-null"},
+				{Aggregator: "sum", Metric: "sys.mem.free", Downsample: "60s-avg-null"},
+			},
+			wantNames:  []string{"sys.cpu.system"},
+			wantValues: []float64{1, math.NaN()},
+			wantStep:   60,
+		},
+		{
+			name:          "step of maxDataPoints",
+			target:        "sys.cpu.user",
+			maxDataPoints: 10,
+			wantQueries: []subQuery{
+				{Aggregator: "sum", Metric: "sys.cpu.user", Downsample: "600s-avg-null"},
+			},
+			wantNames:  []string{"sys.cpu.user"},
+			wantValues: []float64{3},
+			wantStep:   600,
+		},
+		{
+			name:   "seriesByTag",
+			target: "seriesByTag('name=sys.cpu.user','dc=eu','host!=~db.*')",
+			wantQueries: []subQuery{
+				{Aggregator: "none", Metric: "sys.cpu.user", Downsample: "60s-avg-null", Filters: []filter{
+					{Type: "literal_or", TagK: "dc", Filter: "eu", GroupBy: true},
+				}},
+			},
+			wantNames:  []string{"sys.cpu.user;dc=eu;host=web01"},
+			wantValues: []float64{1, math.NaN()},
+			wantStep:   60,
+		},
+		{
+			name:   "seriesByTag without name",
+			target: "seriesByTag('host=~web0[1-2]')",
+			wantQueries: []subQuery{
+				{Aggregator: "none", Metric: "sys.cpu.system", Downsample: "60s-avg-null", Filters: []filter{
+					{Type: "regexp", TagK: "host", Filter: "^(?:web0[1-2])", GroupBy: true},
+				}},
+				{Aggregator: "none", Metric: "sys.cpu.user", Downsample: "60s-avg-null", Filters: []filter{
+					{Type: "regexp", TagK: "host", Filter: "^(?:web0[1-2])", GroupBy: true},
+				}},
+			},
+			wantNames:  []string{"sys.cpu.system;dc=eu;host=web01", "sys.cpu.user;dc=eu;host=web01", "sys.cpu.user;dc=us;host=web02"},
+			wantValues: []float64{1, math.NaN()},
+			wantStep:   60,
+		},
+		{
+			name:   "tagged name",
+			target: "sys.cpu.user;host=web02",
+			wantQueries: []subQuery{
+				{Aggregator: "none", Metric: "sys.cpu.user", Downsample: "60s-avg-null", Filters: []filter{
+					{Type: "literal_or", TagK: "host", Filter: "web02", GroupBy: true},
+				}},
+			},
+			wantNames:  []string{"sys.cpu.user;dc=us;host=web02"},
+			wantValues: []float64{1, math.NaN()},
+			wantStep:   60,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, s := newTestGroup(t)
+			res, _, err := b.Fetch(t.Context(), &protov3.MultiFetchRequest{
+				Metrics: []protov3.FetchRequest{{
+					Name:           tt.target,
+					PathExpression: tt.target,
+					StartTime:      1700000000,
+					StopTime:       1700003600,
+					MaxDataPoints:  tt.maxDataPoints,
+				}},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(s.queries) != 1 || !reflect.DeepEqual(s.queries[0].Queries, tt.wantQueries) {
+				t.Fatalf("unexpected queries: %+v", s.queries)
+			}
+			if s.queries[0].Start != 1700000000 || s.queries[0].End != 1700003600 {
+				t.Errorf("unexpected range of query: %d - %d", s.queries[0].Start, s.queries[0].End)
+			}
+
+			names := make([]string, 0, len(res.Metrics))
+			for _, m := range res.Metrics {
+				names = append(names, m.Name)
+				if m.PathExpression != tt.target || m.StepTime != tt.wantStep || m.StartTime != 1700000040-1700000040%tt.wantStep {
+					t.Errorf("unexpected series: %+v", m)
+				}
+				if len(m.Values) != len(tt.wantValues) {
+					t.Fatalf("unexpected values of %s: %v", m.Name, m.Values)
+				}
+				for i, v := range tt.wantValues {
+					if m.Values[i] != v && !(math.IsNaN(v) && math.IsNaN(m.Values[i])) {
+						t.Errorf("unexpected values of %s: %v", m.Name, m.Values)
+					}
+				}
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("unexpected names: %v", names)
+			}
+		})
+	}
+}
+
+func TestTags(t *testing.T) {
+	b, _ := newTestGroup(t)
+
+	tests := []struct {
+		isTagName bool
+		query     string
+		limit     int64
+		want      []string
+	}{
+		{true, "", -1, []string{"dc", "host", "name"}},
+		{true, "tagPrefix=h&expr=dc%3Dus", -1, []string{"host"}},
+		{false, "tag=host", -1, []string{"db01", "web01", "web02"}},
+		{false, "tag=host&valuePrefix=web&expr=name%3Dsys.cpu.user", 1, []string{"web01"}},
+		{false, "tag=host&expr=name%3D~sys%5C.cpu%5C.s.*", -1, []string{"web01"}},
+		{false, "tag=name&valuePrefix=sys.cpu.", -1, []string{"sys.cpu.system", "sys.cpu.user"}},
+		{false, "tag=name&expr=host%3Dweb01", -1, []string{"sys.cpu.system", "sys.cpu.user"}},
+		{false, "tag=dc&expr=host%21%3D~web.*", -1, []string{"eu"}},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.FormatBool(tt.isTagName)+"/"+tt.query, func(t *testing.T) {
+			var res []string
+			var err error
+			if tt.isTagName {
+				res, err = b.TagNames(t.Context(), tt.query, tt.limit)
+			} else {
+				res, err = b.TagValues(t.Context(), tt.query, tt.limit)
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(res, tt.want) {
+				t.Fatalf("unexpected result: %v", res)
+			}
+		})
+	}
+
+	if _, err := b.TagValues(t.Context(), "valuePrefix=a", -1); err == nil {
+		t.Errorf("tag values without tag are returned")
+	}
+}
@@ -0,0 +1,173 @@
+package opentsdb
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ansel1/merry"
+
+	"github.com/go-graphite/carbonapi/zipper/protocols/prometheus/helpers"
+	prometheusTypes "github.com/go-graphite/carbonapi/zipper/protocols/prometheus/types"
+)
+
+// expression is an expression of seriesByTag, e.g. 'host=~web.*'
+type expression struct {
+	key   string
+	op    string // "=", "!=", "=~" or "!~"
+	value string
+	re    *regexp.Regexp
+}
+
+// match returns true, if value of the tag matches expression. Absent tag has empty value, as in graphite.
+func (e expression) match(tags map[string]string) bool {
+	v := tags[e.key]
+	switch e.op {
+	case "=":
+		return v == e.value
+	case "!=":
+		return v != e.value
+	case "=~":
+		return e.re.MatchString(v)
+	default:
+		return !e.re.MatchString(v)
+	}
+}
+
+// filter returns filter of /api/query for the expression. OpenTSDB can't select series without the tag and has no
+// negative regexp filters, so some expressions are checked on the results only.
+func (e expression) filter() (filter, bool) {
+	switch {
+	case e.op == "=" && e.value != "":
+		return filter{Type: "literal_or", TagK: e.key, Filter: e.value, GroupBy: true}, true
+	case e.op == "=~":
+		return filter{Type: "regexp", TagK: e.key, Filter: e.value, GroupBy: true}, true
+	case e.op == "!=" && e.value == "":
+		return filter{Type: "wildcard", TagK: e.key, Filter: "*", GroupBy: true}, true
+	}
+	return filter{}, false
+}
+
+// tagExpressions are parsed expressions of seriesByTag, expression on 'name' selects the metric
+type tagExpressions struct {
+	name *expression
+	tags []expression
+}
+
+func parseTagExpressions(tvs map[string]prometheusTypes.Tag) (tagExpressions, merry.Error) {
+	var res tagExpressions
+	for key, t := range tvs {
+		if key == "" {
+			return res, ErrInvalidTagExpression.WithValue("expression", t.OP+t.TagValue)
+		}
+		e := expression{key: key, op: t.OP, value: t.TagValue}
+		switch t.OP {
+		case "=", "!=":
+		case "=~", "!~":
+			// graphite matches regular expressions from the beginning of the value
+			if !strings.HasPrefix(e.value, "^") {
+				e.value = "^(?:" + e.value + ")"
+			}
+			var err error
+			if e.re, err = regexp.Compile(e.value); err != nil {
+				return res, ErrInvalidTagExpression.WithValue("expression", key+t.OP+t.TagValue).WithCause(err)
+			}
+		default:
+			return res, ErrInvalidTagExpression.WithValue("expression", key+t.OP+t.TagValue)
+		}
+		if key == "name" {
+			res.name = &e
+			continue
+		}
+		res.tags = append(res.tags, e)
+	}
+	if res.name == nil && len(res.tags) == 0 {
+		return res, ErrInvalidTagExpression.WithMessage("no tag expressions")
+	}
+	sort.Slice(res.tags, func(i, j int) bool {
+		return res.tags[i].key < res.tags[j].key
+	})
+	return res, nil
+}
+
+// parseSeriesByTag parses target 'seriesByTag('name=a.b','tag=value')'
+func parseSeriesByTag(target string) (tagExpressions, merry.Error) {
+	return parseTagExpressions(helpers.SplitTagValues(target[len("seriesByTag(") : len(target)-1]))
+}
+
+// parseTaggedName parses name of the series in graphite format ('a.b;tag=value'), that is selected by expressions
+// with '=' operator
+func parseTaggedName(name string) (tagExpressions, merry.Error) {
+	parts := strings.Split(name, ";")
+	tvs := map[string]prometheusTypes.Tag{
+		"name": {OP: "=", TagValue: parts[0]},
+	}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return tagExpressions{}, ErrInvalidTagExpression.WithValue("expression", part)
+		}
+		tvs[kv[0]] = prometheusTypes.Tag{OP: "=", TagValue: kv[1]}
+	}
+	return parseTagExpressions(tvs)
+}
+
+// matchName returns true, if the metric matches expression on 'name'
+func (e tagExpressions) matchName(metric string) bool {
+	return e.name == nil || e.name.match(map[string]string{"name": metric})
+}
+
+// match returns true, if the series matches all expressions
+func (e tagExpressions) match(metric string, tags map[string]string) bool {
+	if !e.matchName(metric) {
+		return false
+	}
+	for _, t := range e.tags {
+		if !t.match(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// filters returns filters of /api/query, that preselect series matching expressions
+func (e tagExpressions) filters() []filter {
+	var res []filter
+	for _, t := range e.tags {
+		if f, ok := t.filter(); ok {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// lookupTags returns tags of /api/search/lookup query, that preselect series matching expressions. Lookup supports
+// only exact values and wildcards, so empty value means any value.
+func (e tagExpressions) lookupTags() map[string]string {
+	res := make(map[string]string)
+	for _, t := range e.tags {
+		switch {
+		case t.op == "=" && t.value != "":
+			res[t.key] = t.value
+		case t.op == "=~", t.op == "!=" && t.value == "":
+			res[t.key] = ""
+		}
+	}
+	return res
+}
+
+// taggedName returns name of the series in graphite format ('metric;tag1=value1;tag2=value2')
+func taggedName(metric string, tags map[string]string) string {
+	var sb strings.Builder
+	sb.WriteString(metric)
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		sb.WriteString(";" + k + "=" + tags[k])
+	}
+	return sb.String()
+}
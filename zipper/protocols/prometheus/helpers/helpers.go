@@ -1,9 +1,11 @@
 package helpers
 
 import (
+	"fmt"
 	"math"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -304,3 +306,47 @@ func convertSeriesByTagToPromQL(step, target string, tagRenames map[string]strin
 	}
 	return step, queryBuilder.String()
 }
+
+var durationRe = regexp.MustCompile(`^(?:(\d+)y)?(?:(\d+)w)?(?:(\d+)d)?(?:(\d+)h)?(?:(\d+)m)?(?:(\d+)s)?(?:(\d+)ms)?$`)
+
+var durationUnits = []time.Duration{
+	365 * 24 * time.Hour,
+	7 * 24 * time.Hour,
+	24 * time.Hour,
+	time.Hour,
+	time.Minute,
+	time.Second,
+	time.Millisecond,
+}
+
+// ParseDuration parses duration in the format of prometheus, e.g. '15d' or '1y2w', units from years to milliseconds
+// must be in descending order
+func ParseDuration(s string) (time.Duration, error) {
+	m := durationRe.FindStringSubmatch(s)
+	if s == "" || m == nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	var d time.Duration
+	for i, unit := range durationUnits {
+		if m[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(m[i+1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(n) * unit
+	}
+	return d, nil
+}
+
+// ParseStorageRetention returns time-based retention from 'storageRetention' of /api/v1/status/runtimeinfo, that
+// looks like '15d', '15d or 512MiB' or '512MiB', false is returned if the retention is limited by size only
+func ParseStorageRetention(s string) (time.Duration, bool) {
+	for _, part := range strings.Split(s, " or ") {
+		if d, err := ParseDuration(strings.TrimSpace(part)); err == nil {
+			return d, true
+		}
+	}
+	return 0, false
+}
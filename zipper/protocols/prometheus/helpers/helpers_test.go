@@ -369,3 +369,27 @@ func TestSeriesByTagToPromQLWithRenames(t *testing.T) {
 		})
 	}
 }
+
+func TestParseStorageRetention(t *testing.T) {
+	tests := []struct {
+		retention string
+		want      time.Duration
+		wantOk    bool
+	}{
+		{"15d", 15 * 24 * time.Hour, true},
+		{"1y2w", (365 + 14) * 24 * time.Hour, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"30d or 512MiB", 30 * 24 * time.Hour, true},
+		{"512MiB", 0, false},
+		{"", 0, false},
+		{"2d1w", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.retention, func(t *testing.T) {
+			got, ok := ParseStorageRetention(tt.retention)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
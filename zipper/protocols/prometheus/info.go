@@ -0,0 +1,289 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ansel1/merry"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/zipper/protocols/prometheus/helpers"
+	prometheusTypes "github.com/go-graphite/carbonapi/zipper/protocols/prometheus/types"
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+// defaultListBatchSize is amount of metric names, which series are requested at once by List and Stats
+const defaultListBatchSize = 100
+
+func (c *PrometheusGroup) get(ctx context.Context, logger *zap.Logger, stats *types.Stats, path string, v url.Values, res interface{}) (bool, merry.Error) {
+	rewrite, _ := url.Parse("http://127.0.0.1" + c.apiPrefix + path)
+	rewrite.RawQuery = v.Encode()
+
+	logger.Debug("will do query",
+		zap.String("uri", rewrite.RequestURI()),
+	)
+	r, err := c.httpQuery.DoQueryWithStats(ctx, logger, rewrite.RequestURI(), nil, stats)
+	if err != nil {
+		return false, err
+	}
+	if r == nil || len(r.Response) == 0 {
+		return false, nil
+	}
+	if err := json.Unmarshal(r.Response, res); err != nil {
+		return false, types.ErrUnmarshalFailed.WithCause(err)
+	}
+	return true, nil
+}
+
+// series returns labels of all series, that match the selector
+func (c *PrometheusGroup) series(ctx context.Context, logger *zap.Logger, stats *types.Stats, selector string) ([]map[string]string, merry.Error) {
+	v := url.Values{
+		"match[]": []string{selector},
+	}
+	if c.startDelay.IsSet {
+		v.Add("start", c.startDelay.String())
+	}
+
+	var pr prometheusTypes.PrometheusFindResponse
+	if ok, err := c.get(ctx, logger, stats, "/api/v1/series", v, &pr); !ok {
+		return nil, err
+	}
+	if pr.Status != "success" {
+		return nil, types.ErrFailedToFetch.WithMessage(pr.Error).WithValue("query", selector).WithValue("error_type", pr.ErrorType).WithValue("error", pr.Error)
+	}
+	return pr.Data, nil
+}
+
+// metricNames returns values of '__name__' label
+func (c *PrometheusGroup) metricNames(ctx context.Context, logger *zap.Logger, stats *types.Stats) ([]string, merry.Error) {
+	v := url.Values{}
+	if c.startDelay.IsSet {
+		v.Add("start", c.startDelay.String())
+	}
+
+	var pr prometheusTypes.PrometheusTagResponse
+	if ok, err := c.get(ctx, logger, stats, "/api/v1/label/__name__/values", v, &pr); !ok {
+		return nil, err
+	}
+	if pr.Status != "success" {
+		return nil, types.ErrFailedToFetch.WithMessage(pr.Error).WithValue("error_type", pr.ErrorType).WithValue("error", pr.Error)
+	}
+	return pr.Data, nil
+}
+
+// metricType returns type of the metric (counter, gauge, histogram, ...) from /api/v1/metadata, series of histograms
+// and summaries have no metadata of their own and are looked up by name of the metric family
+func (c *PrometheusGroup) metricType(ctx context.Context, logger *zap.Logger, stats *types.Stats, name string) string {
+	names := []string{name}
+	for _, suffix := range []string{"_bucket", "_count", "_sum"} {
+		if base, ok := strings.CutSuffix(name, suffix); ok {
+			names = append(names, base)
+		}
+	}
+
+	for _, n := range names {
+		var pr prometheusTypes.PrometheusMetadataResponse
+		ok, err := c.get(ctx, logger, stats, "/api/v1/metadata", url.Values{"metric": []string{n}}, &pr)
+		if err != nil {
+			logger.Debug("failed to get metadata",
+				zap.String("metric", n),
+				zap.Error(err),
+			)
+			return ""
+		}
+		if !ok || pr.Status != "success" {
+			return ""
+		}
+		if md := pr.Data[n]; len(md) > 0 {
+			return md[0].Type
+		}
+	}
+	return ""
+}
+
+// consolidationFunc returns graphite aggregation method, that suits the type of the metric: cumulative values are
+// consolidated by the last one, gauges and metrics of unknown type by the average
+func consolidationFunc(metricType string) string {
+	switch metricType {
+	case "counter", "histogram", "gaugehistogram", "summary":
+		return "last"
+	default:
+		return "average"
+	}
+}
+
+// storageRetention returns retention of the backend in seconds, 'retention' option takes precedence over the one
+// reported by /api/v1/status/runtimeinfo. Zero is returned if it's unknown, e.g. VictoriaMetrics doesn't report it.
+func (c *PrometheusGroup) storageRetention(ctx context.Context, logger *zap.Logger, stats *types.Stats) int64 {
+	if c.retention > 0 {
+		return int64(c.retention.Seconds())
+	}
+
+	var pr prometheusTypes.PrometheusRuntimeInfoResponse
+	ok, err := c.get(ctx, logger, stats, "/api/v1/status/runtimeinfo", url.Values{}, &pr)
+	if err != nil {
+		logger.Debug("failed to get runtime info",
+			zap.Error(err),
+		)
+		return 0
+	}
+	if !ok || pr.Status != "success" {
+		return 0
+	}
+	d, ok := helpers.ParseStorageRetention(pr.Data.StorageRetention)
+	if !ok {
+		return 0
+	}
+	return int64(d.Seconds())
+}
+
+// Info returns step and retention of the backend for every series, that matches the names. Series are reported with
+// their labels, e.g. 'http_requests_total;code=200;job=api', consolidation function depends on the type of the metric.
+func (c *PrometheusGroup) Info(ctx context.Context, request *protov3.MultiMetricsInfoRequest) (*protov3.ZipperInfoResponse, *types.Stats, merry.Error) {
+	logger := c.logger.With(zap.String("type", "info"), zap.Strings("request", request.Names))
+	stats := &types.Stats{}
+
+	retention := c.storageRetention(ctx, logger, stats)
+	var points int64
+	if c.step > 0 {
+		points = retention / c.step
+	}
+
+	var infos protov3.MultiMetricsInfoResponse
+	var e merry.Error
+	metricTypes := make(map[string]string)
+	for _, query := range request.Names {
+		var selector string
+		if strings.HasPrefix(query, "seriesByTag") {
+			_, selector = helpers.SeriesByTagToPromQL("", query)
+		} else {
+			selector = fmt.Sprintf("{__name__=~%q}", helpers.ConvertGraphiteTargetToPromQL(query))
+		}
+
+		stats.InfoRequests++
+		series, err := c.series(ctx, logger, stats, selector)
+		if err != nil {
+			stats.InfoErrors++
+			if merry.Is(err, types.ErrTimeoutExceeded) {
+				stats.Timeouts++
+				stats.InfoTimeouts++
+			}
+			if e == nil {
+				e = err
+			} else {
+				e = e.WithCause(err)
+			}
+			continue
+		}
+
+		for _, labels := range series {
+			metric := labels["__name__"]
+			metricType, ok := metricTypes[metric]
+			if !ok {
+				metricType = c.metricType(ctx, logger, stats, metric)
+				metricTypes[metric] = metricType
+			}
+
+			infos.Metrics = append(infos.Metrics, protov3.MetricsInfoResponse{
+				Name:              helpers.PromMetricToGraphite(labels),
+				ConsolidationFunc: consolidationFunc(metricType),
+				MaxRetention:      retention,
+				Retentions: []protov3.Retention{{
+					SecondsPerPoint: c.step,
+					NumberOfPoints:  points,
+				}},
+			})
+		}
+	}
+
+	if e != nil && len(infos.Metrics) == 0 {
+		stats.FailedServers = []string{c.groupName}
+		logger.Error("errors occurred while getting results",
+			zap.Any("errors", e),
+		)
+		return nil, stats, e
+	}
+	stats.MemoryUsage = int64(infos.Size())
+
+	r := &protov3.ZipperInfoResponse{
+		Info: map[string]protov3.MultiMetricsInfoResponse{
+			c.groupName: infos,
+		},
+	}
+	return r, stats, nil
+}
+
+// eachSeries calls f for labels of every series of the backend, series are requested in batches of metric names
+func (c *PrometheusGroup) eachSeries(ctx context.Context, logger *zap.Logger, stats *types.Stats, f func(labels map[string]string)) merry.Error {
+	names, err := c.metricNames(ctx, logger, stats)
+	if err != nil {
+		return err
+	}
+
+	batchSize := c.maxMetricsPerRequest
+	if batchSize <= 0 {
+		batchSize = defaultListBatchSize
+	}
+	for start := 0; start < len(names); start += batchSize {
+		end := min(start+batchSize, len(names))
+		quoted := make([]string, 0, end-start)
+		for _, name := range names[start:end] {
+			quoted = append(quoted, regexp.QuoteMeta(name))
+		}
+
+		series, err := c.series(ctx, logger, stats, fmt.Sprintf("{__name__=~%q}", strings.Join(quoted, "|")))
+		if err != nil {
+			return err
+		}
+		for _, labels := range series {
+			f(labels)
+		}
+	}
+	return nil
+}
+
+// List returns names of all series in graphite format, with labels as tags
+func (c *PrometheusGroup) List(ctx context.Context) (*protov3.ListMetricsResponse, *types.Stats, merry.Error) {
+	logger := c.logger.With(zap.String("type", "list"))
+	stats := &types.Stats{}
+
+	r := &protov3.ListMetricsResponse{}
+	err := c.eachSeries(ctx, logger, stats, func(labels map[string]string) {
+		r.Metrics = append(r.Metrics, helpers.PromMetricToGraphite(labels))
+	})
+	if err != nil {
+		stats.FailedServers = []string{c.groupName}
+		return nil, stats, err
+	}
+	sort.Strings(r.Metrics)
+	return r, stats, nil
+}
+
+// Stats returns cardinality of the backend: Size is amount of series of every metric name
+func (c *PrometheusGroup) Stats(ctx context.Context) (*protov3.MetricDetailsResponse, *types.Stats, merry.Error) {
+	logger := c.logger.With(zap.String("type", "stats"))
+	stats := &types.Stats{}
+
+	r := &protov3.MetricDetailsResponse{
+		Metrics: make(map[string]*protov3.MetricDetails),
+	}
+	err := c.eachSeries(ctx, logger, stats, func(labels map[string]string) {
+		name := labels["__name__"]
+		if d, ok := r.Metrics[name]; ok {
+			d.Size_++
+		} else {
+			r.Metrics[name] = &protov3.MetricDetails{Size_: 1}
+		}
+	})
+	if err != nil {
+		stats.FailedServers = []string{c.groupName}
+		return nil, stats, err
+	}
+	return r, stats, nil
+}
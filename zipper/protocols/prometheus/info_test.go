@@ -0,0 +1,252 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	prometheusTypes "github.com/go-graphite/carbonapi/zipper/protocols/prometheus/types"
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+var matcherRe = regexp.MustCompile(`(\w+)(=~|!~|!=|=)("(?:[^"\\]|\\.)*")`)
+
+// standIn is a minimal prometheus, that serves series, label values, metadata and runtime info APIs
+type standIn struct {
+	t         *testing.T
+	series    []map[string]string
+	metadata  map[string][]prometheusTypes.MetricMetadata
+	retention string
+
+	sync.Mutex
+	selectors []string
+}
+
+func (s *standIn) match(selector string, labels map[string]string) bool {
+	for _, m := range matcherRe.FindAllStringSubmatch(selector, -1) {
+		value, err := strconv.Unquote(m[3])
+		if err != nil {
+			s.t.Errorf("invalid selector %q: %v", selector, err)
+			return false
+		}
+		switch m[2] {
+		case "=":
+			if labels[m[1]] != value {
+				return false
+			}
+		case "!=":
+			if labels[m[1]] == value {
+				return false
+			}
+		default:
+			re := regexp.MustCompile("^(?:" + value + ")$")
+			if re.MatchString(labels[m[1]]) != (m[2] == "=~") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var res interface{}
+	switch r.URL.Path {
+	case "/api/v1/series":
+		selector := r.URL.Query().Get("match[]")
+		s.Lock()
+		s.selectors = append(s.selectors, selector)
+		s.Unlock()
+
+		data := []map[string]string{}
+		for _, labels := range s.series {
+			if s.match(selector, labels) {
+				data = append(data, copyLabels(labels))
+			}
+		}
+		res = prometheusTypes.PrometheusFindResponse{Status: "success", Data: data}
+	case "/api/v1/label/__name__/values":
+		names := []string{}
+		seen := make(map[string]bool)
+		for _, labels := range s.series {
+			if !seen[labels["__name__"]] {
+				seen[labels["__name__"]] = true
+				names = append(names, labels["__name__"])
+			}
+		}
+		sort.Strings(names)
+		res = prometheusTypes.PrometheusTagResponse{Status: "success", Data: names}
+	case "/api/v1/metadata":
+		metric := r.URL.Query().Get("metric")
+		data := map[string][]prometheusTypes.MetricMetadata{}
+		if md, ok := s.metadata[metric]; ok {
+			data[metric] = md
+		}
+		res = prometheusTypes.PrometheusMetadataResponse{Status: "success", Data: data}
+	case "/api/v1/status/runtimeinfo":
+		if s.retention == "" {
+			http.NotFound(w, r)
+			return
+		}
+		info := prometheusTypes.PrometheusRuntimeInfoResponse{Status: "success"}
+		info.Data.StorageRetention = s.retention
+		res = info
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	res := make(map[string]string, len(labels))
+	for k, v := range labels {
+		res[k] = v
+	}
+	return res
+}
+
+func newTestGroup(t *testing.T, options map[string]interface{}) (types.BackendServer, *standIn) {
+	s := &standIn{
+		t: t,
+		series: []map[string]string{
+			{"__name__": "http_requests_total", "job": "api", "code": "200"},
+			{"__name__": "http_requests_total", "job": "api", "code": "500"},
+			{"__name__": "http_requests_total", "job": "web", "code": "200"},
+			{"__name__": "memory_bytes", "job": "api"},
+			{"__name__": "latency_seconds_bucket", "job": "api", "le": "0.1"},
+			{"__name__": "sys.cpu.user"},
+		},
+		metadata: map[string][]prometheusTypes.MetricMetadata{
+			"http_requests_total": {{Type: "counter"}},
+			"memory_bytes":        {{Type: "gauge"}},
+			"latency_seconds":     {{Type: "histogram"}},
+		},
+		retention: "15d or 512MiB",
+	}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	timeouts := types.Timeouts{Find: time.Second, Render: time.Second, Connect: time.Second}
+	concurrencyLimit, maxTries, maxBatchSize, maxIdleConns := 10, 1, 2, 10
+	idleTimeout, keepAlive := time.Minute, time.Second
+	b, err := New(zap.NewNop(), types.BackendV2{
+		GroupName:        "prometheus",
+		Protocol:         "prometheus",
+		Servers:          []string{srv.URL},
+		Timeouts:         &timeouts,
+		ConcurrencyLimit: &concurrencyLimit,
+		MaxTries:         &maxTries,
+		MaxBatchSize:     &maxBatchSize,
+		BackendOptions:   options,
+
+		MaxIdleConnsPerHost:   &maxIdleConns,
+		IdleConnectionTimeout: &idleTimeout,
+		KeepAliveInterval:     &keepAlive,
+	}, false, false)
+	if err != nil {
+		t.Fatalf("failed to create group: %v", err)
+	}
+	return b, s
+}
+
+func TestInfo(t *testing.T) {
+	const day = 24 * 60 * 60
+
+	tests := []struct {
+		name      string
+		options   map[string]interface{}
+		retention string
+		query     string
+		want      []protov3.MetricsInfoResponse
+	}{
+		{
+			name:      "retention from runtime info",
+			retention: "15d or 512MiB",
+			query:     "http_requests_total",
+			want: []protov3.MetricsInfoResponse{
+				{Name: "http_requests_total;code=200;job=api", ConsolidationFunc: "last", MaxRetention: 15 * day, Retentions: []protov3.Retention{{SecondsPerPoint: 15, NumberOfPoints: 15 * day / 15}}},
+				{Name: "http_requests_total;code=500;job=api", ConsolidationFunc: "last", MaxRetention: 15 * day, Retentions: []protov3.Retention{{SecondsPerPoint: 15, NumberOfPoints: 15 * day / 15}}},
+				{Name: "http_requests_total;code=200;job=web", ConsolidationFunc: "last", MaxRetention: 15 * day, Retentions: []protov3.Retention{{SecondsPerPoint: 15, NumberOfPoints: 15 * day / 15}}},
+			},
+		},
+		{
+			name:      "retention and step from options",
+			options:   map[string]interface{}{"retention": "1w", "step": "60s"},
+			retention: "15d",
+			query:     "sys.cpu.*",
+			want: []protov3.MetricsInfoResponse{
+				{Name: "sys.cpu.user", ConsolidationFunc: "average", MaxRetention: 7 * day, Retentions: []protov3.Retention{{SecondsPerPoint: 60, NumberOfPoints: 7 * day / 60}}},
+			},
+		},
+		{
+			name:  "seriesByTag, unknown retention",
+			query: "seriesByTag('job=api','__name__!=http_requests_total')",
+			want: []protov3.MetricsInfoResponse{
+				{Name: "memory_bytes;job=api", ConsolidationFunc: "average", Retentions: []protov3.Retention{{SecondsPerPoint: 15}}},
+				{Name: "latency_seconds_bucket;job=api;le=0.1", ConsolidationFunc: "last", Retentions: []protov3.Retention{{SecondsPerPoint: 15}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, s := newTestGroup(t, tt.options)
+			s.retention = tt.retention
+
+			res, stats, err := b.Info(t.Context(), &protov3.MultiMetricsInfoRequest{Names: []string{tt.query}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assert.Equal(t, uint64(1), stats.InfoRequests)
+			assert.Equal(t, tt.want, res.Info["prometheus"].Metrics)
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	b, s := newTestGroup(t, nil)
+
+	res, _, err := b.List(t.Context())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, []string{
+		"http_requests_total;code=200;job=api",
+		"http_requests_total;code=200;job=web",
+		"http_requests_total;code=500;job=api",
+		"latency_seconds_bucket;job=api;le=0.1",
+		"memory_bytes;job=api",
+		"sys.cpu.user",
+	}, res.Metrics)
+
+	// 4 metric names are requested in batches of max_batch_size
+	assert.Equal(t, []string{
+		`{__name__=~"http_requests_total|latency_seconds_bucket"}`,
+		`{__name__=~"memory_bytes|sys\\.cpu\\.user"}`,
+	}, s.selectors)
+}
+
+func TestStats(t *testing.T) {
+	b, _ := newTestGroup(t, nil)
+
+	res, _, err := b.Stats(t.Context())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, map[string]*protov3.MetricDetails{
+		"http_requests_total":    {Size_: 3},
+		"latency_seconds_bucket": {Size_: 1},
+		"memory_bytes":           {Size_: 1},
+		"sys.cpu.user":           {Size_: 1},
+	}, res.Metrics)
+}
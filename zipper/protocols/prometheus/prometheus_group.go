@@ -73,6 +73,10 @@ type PrometheusGroup struct {
 	forceMinStepInterval time.Duration
 
 	startDelay StartDelay
+	retention  time.Duration
+
+	// apiPrefix is prepended to paths of the API, that are used by Info, List and Stats
+	apiPrefix string
 
 	httpQuery *helper.HttpQuery
 }
@@ -170,7 +174,7 @@ func NewWithLimiter(logger *zap.Logger, config types.BackendV2, tldCacheDisabled
 		}
 	}
 
-	httpQuery := helper.NewHttpQuery(config.GroupName, config.Servers, *config.MaxTries, limiter, httpClient, httpHeaders.ContentTypeCarbonAPIv2PB)
+	httpQuery := helper.NewHttpQuery(config.GroupName, config.Servers, *config.MaxTries, limiter, httpClient, httpHeaders.ContentTypeCarbonAPIv2PB).Configure(config)
 
 	return NewWithEverythingInitialized(logger, config, tldCacheDisabled, requireSuccessAll, limiter, step, maxPointsPerQuery, forceMinStepInterval, delay, httpQuery, httpClient)
 }
@@ -194,6 +198,32 @@ func NewWithEverythingInitialized(logger *zap.Logger, config types.BackendV2, tl
 
 		httpQuery: httpQuery,
 	}
+
+	retentionI, ok := config.BackendOptions["retention"]
+	if ok {
+		retention, ok := retentionI.(string)
+		if !ok {
+			logger.Fatal("failed to parse retention",
+				zap.String("type_parsed", fmt.Sprintf("%T", retentionI)),
+				zap.String("type_expected", "string"),
+			)
+		}
+		var err error
+		c.retention, err = helpers.ParseDuration(retention)
+		if err != nil {
+			logger.Fatal("failed to parse option",
+				zap.String("option_name", "retention"),
+				zap.String("option_value", retention),
+				zap.Error(err),
+			)
+		}
+	}
+
+	// VictoriaMetrics cluster serves prometheus API of the tenant under its own path
+	if tenantID, ok := config.BackendOptions["vmclustertenantid"].(string); ok && tenantID != "" {
+		c.apiPrefix = "/select/" + tenantID + "/prometheus"
+	}
+
 	return c, nil
 }
 
@@ -204,7 +234,7 @@ func New(logger *zap.Logger, config types.BackendV2, tldCacheDisabled, requireSu
 	if len(config.Servers) == 0 {
 		return nil, types.ErrNoServersSpecified
 	}
-	l := limiter.NewServerLimiter([]string{config.GroupName}, *config.ConcurrencyLimit)
+	l := limiter.NewServerLimiter(config.Servers, *config.ConcurrencyLimit)
 
 	return NewWithLimiter(logger, config, tldCacheDisabled, requireSuccessAll, l)
 }
@@ -301,7 +331,7 @@ func (c *PrometheusGroup) Fetch(ctx context.Context, request *protov3.MultiFetch
 
 			rewrite.RawQuery = v.Encode()
 			stats.RenderRequests++
-			res, err2 := c.httpQuery.DoQuery(ctx, logger, rewrite.RequestURI(), nil)
+			res, err2 := c.httpQuery.DoQueryWithStats(ctx, logger, rewrite.RequestURI(), nil, stats)
 			if err2 != nil {
 				stats.RenderErrors++
 				if merry.Is(err, types.ErrTimeoutExceeded) {
@@ -404,7 +434,7 @@ func (c *PrometheusGroup) Find(ctx context.Context, request *protov3.MultiGlobRe
 
 		rewrite.RawQuery = v.Encode()
 		stats.FindRequests += 1
-		res, err := c.httpQuery.DoQuery(ctx, logger, rewrite.RequestURI(), nil)
+		res, err := c.httpQuery.DoQueryWithStats(ctx, logger, rewrite.RequestURI(), nil, stats)
 		if err != nil {
 			stats.FindErrors += 1
 			if merry.Is(err, types.ErrTimeoutExceeded) {
@@ -485,17 +515,6 @@ func (c *PrometheusGroup) Find(ctx context.Context, request *protov3.MultiGlobRe
 	return &r, stats, nil
 }
 
-func (c *PrometheusGroup) Info(ctx context.Context, request *protov3.MultiMetricsInfoRequest) (*protov3.ZipperInfoResponse, *types.Stats, merry.Error) {
-	return nil, nil, types.ErrNotSupportedByBackend
-}
-
-func (c *PrometheusGroup) List(ctx context.Context) (*protov3.ListMetricsResponse, *types.Stats, merry.Error) {
-	return nil, nil, types.ErrNotImplementedYet
-}
-func (c *PrometheusGroup) Stats(ctx context.Context) (*protov3.MetricDetailsResponse, *types.Stats, merry.Error) {
-	return nil, nil, types.ErrNotSupportedByBackend
-}
-
 func (c *PrometheusGroup) doSimpleTagQuery(ctx context.Context, logger *zap.Logger, isTagName bool, params map[string][]string, limit int64) ([]string, merry.Error) {
 	var rewrite *url.URL
 
@@ -94,3 +94,26 @@ type Tag struct {
 	TagValue string
 	OP       string
 }
+
+// MetricMetadata is an entry of /api/v1/metadata response
+type MetricMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+type PrometheusMetadataResponse struct {
+	Status    string                      `json:"status"`
+	ErrorType string                      `json:"errorType"`
+	Error     string                      `json:"error"`
+	Data      map[string][]MetricMetadata `json:"data"`
+}
+
+type PrometheusRuntimeInfoResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		StorageRetention string `json:"storageRetention"`
+	} `json:"data"`
+}
@@ -0,0 +1,139 @@
+package remoteread
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/ansel1/merry"
+)
+
+// bitReader reads big endian bit stream
+type bitReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *bitReader) readBit() (uint64, bool) {
+	if r.pos >= len(r.b)*8 {
+		return 0, false
+	}
+	bit := uint64(r.b[r.pos/8]>>(7-r.pos%8)) & 1
+	r.pos++
+	return bit, true
+}
+
+func (r *bitReader) readBits(n int) (uint64, bool) {
+	if r.pos+n > len(r.b)*8 {
+		return 0, false
+	}
+	var v uint64
+	for ; n > 0; n-- {
+		bit, _ := r.readBit()
+		v = v<<1 | bit
+	}
+	return v, true
+}
+
+// ReadByte implements io.ByteReader for varints, that are written to the stream without alignment
+func (r *bitReader) ReadByte() (byte, error) {
+	v, ok := r.readBits(8)
+	if !ok {
+		return 0, ErrCorruptedResponse.WithMessage("chunk is truncated")
+	}
+	return byte(v), nil
+}
+
+// decodeXORChunk appends samples of Gorilla-compressed chunk (tsdb/chunkenc/xor.go of prometheus) to dst:
+//
+//	number of samples uint16, the first timestamp varint, the first value float64,
+//	the second timestamp as uvarint delta, then delta-of-delta timestamps and values XOR-ed with the previous one
+func decodeXORChunk(chunk []byte, dst []sample) ([]sample, merry.Error) {
+	errTruncated := ErrCorruptedResponse.WithMessage("chunk is truncated")
+	if len(chunk) < 2 {
+		return dst, errTruncated
+	}
+	count := int(binary.BigEndian.Uint16(chunk))
+	r := &bitReader{b: chunk[2:]}
+
+	var t, tDelta int64
+	var value uint64
+	var leading, trailing int
+	for i := 0; i < count; i++ {
+		switch i {
+		case 0:
+			var err error
+			if t, err = binary.ReadVarint(r); err != nil {
+				return dst, errTruncated
+			}
+			var ok bool
+			if value, ok = r.readBits(64); !ok {
+				return dst, errTruncated
+			}
+			dst = append(dst, sample{TimestampMs: t, Value: math.Float64frombits(value)})
+			continue
+		case 1:
+			delta, err := binary.ReadUvarint(r)
+			if err != nil {
+				return dst, errTruncated
+			}
+			tDelta = int64(delta)
+		default:
+			// prefix of delta-of-delta is 0, 10, 110, 1110 or 1111
+			var prefix int
+			for ; prefix < 4; prefix++ {
+				bit, ok := r.readBit()
+				if !ok {
+					return dst, errTruncated
+				}
+				if bit == 0 {
+					break
+				}
+			}
+			sz := [...]int{0, 14, 17, 20, 64}[prefix]
+			if sz != 0 {
+				bits, ok := r.readBits(sz)
+				if !ok {
+					return dst, errTruncated
+				}
+				// negative numbers come back as high unsigned numbers
+				if sz != 64 && bits > 1<<(sz-1) {
+					bits -= 1 << sz
+				}
+				tDelta += int64(bits)
+			}
+		}
+		t += tDelta
+
+		bit, ok := r.readBit()
+		if !ok {
+			return dst, errTruncated
+		}
+		if bit == 1 {
+			if bit, ok = r.readBit(); !ok {
+				return dst, errTruncated
+			}
+			if bit == 1 {
+				// new count of leading zeros (5 bits) and of significant bits (6 bits, where 0 means 64)
+				l, ok1 := r.readBits(5)
+				m, ok2 := r.readBits(6)
+				if !ok1 || !ok2 {
+					return dst, errTruncated
+				}
+				if m == 0 {
+					m = 64
+				}
+				leading, trailing = int(l), 64-int(l)-int(m)
+				if trailing < 0 {
+					return dst, ErrCorruptedResponse.WithMessage("invalid count of significant bits")
+				}
+			}
+			bits, ok := r.readBits(64 - leading - trailing)
+			if !ok {
+				return dst, errTruncated
+			}
+			value ^= bits << trailing
+		}
+		dst = append(dst, sample{TimestampMs: t, Value: math.Float64frombits(value)})
+	}
+	return dst, nil
+}
@@ -0,0 +1,299 @@
+package remoteread
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"strings"
+
+	"github.com/ansel1/merry"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Messages of prometheus remote read protocol (prompb/remote.proto and prompb/types.proto). Only fields, that are
+// used by carbonapi, are encoded and decoded.
+
+const (
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeStreamed = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+	remoteReadVersion   = "0.1.0"
+)
+
+type responseType uint64
+
+const (
+	responseTypeSamples           responseType = 0
+	responseTypeStreamedXORChunks responseType = 1
+)
+
+type matcherType uint64
+
+const (
+	matchEqual     matcherType = 0
+	matchNotEqual  matcherType = 1
+	matchRegexp    matcherType = 2
+	matchNotRegexp matcherType = 3
+)
+
+// chunkTypeXOR is the only type of chunks for float samples, histogram chunks are skipped
+const chunkTypeXOR = 1
+
+var ErrCorruptedResponse = merry.New("remote read response is corrupted")
+
+type labelMatcher struct {
+	Type  matcherType
+	Name  string
+	Value string
+}
+
+func (m labelMatcher) String() string {
+	return m.Name + [...]string{"=", "!=", "=~", "!~"}[m.Type] + `"` + m.Value + `"`
+}
+
+type query struct {
+	StartMs  int64
+	EndMs    int64
+	Matchers []labelMatcher
+}
+
+func (q query) String() string {
+	matchers := make([]string, 0, len(q.Matchers))
+	for _, m := range q.Matchers {
+		matchers = append(matchers, m.String())
+	}
+	return "{" + strings.Join(matchers, ", ") + "}"
+}
+
+// readRequest is a types.HTTPRequest, that is sent as snappy compressed protobuf in the body of POST request
+type readRequest struct {
+	Queries               []query
+	AcceptedResponseTypes []responseType
+}
+
+func (r readRequest) marshalProto() []byte {
+	var b []byte
+	for _, q := range r.Queries {
+		var qb []byte
+		qb = appendVarintField(qb, 1, uint64(q.StartMs))
+		qb = appendVarintField(qb, 2, uint64(q.EndMs))
+		for _, m := range q.Matchers {
+			var mb []byte
+			mb = appendVarintField(mb, 1, uint64(m.Type))
+			mb = appendBytesField(mb, 2, []byte(m.Name))
+			mb = appendBytesField(mb, 3, []byte(m.Value))
+			qb = appendBytesField(qb, 3, mb)
+		}
+		b = appendBytesField(b, 1, qb)
+	}
+	if len(r.AcceptedResponseTypes) > 0 {
+		var packed []byte
+		for _, t := range r.AcceptedResponseTypes {
+			packed = protowire.AppendVarint(packed, uint64(t))
+		}
+		b = appendBytesField(b, 2, packed)
+	}
+	return b
+}
+
+func (r readRequest) Marshal() ([]byte, merry.Error) {
+	return snappyEncode(r.marshalProto()), nil
+}
+
+func (r readRequest) LogInfo() interface{} {
+	queries := make([]string, 0, len(r.Queries))
+	for _, q := range r.Queries {
+		queries = append(queries, q.String())
+	}
+	return queries
+}
+
+func (r readRequest) Method() string {
+	return "POST"
+}
+
+func (r readRequest) Headers() map[string]string {
+	return map[string]string{
+		"Content-Encoding":                 "snappy",
+		"Content-Type":                     contentTypeProtobuf,
+		"X-Prometheus-Remote-Read-Version": remoteReadVersion,
+	}
+}
+
+type sample struct {
+	TimestampMs int64
+	Value       float64
+}
+
+type timeSeries struct {
+	Labels  map[string]string
+	Samples []sample
+}
+
+func appendVarintField(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBytesField(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// parseMessage calls fn for every field of the message. Value of varint and fixed fields is passed as v,
+// value of length-delimited fields as data.
+func parseMessage(b []byte, fn func(num protowire.Number, v uint64, data []byte) merry.Error) merry.Error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return ErrCorruptedResponse.WithMessage(protowire.ParseError(n).Error())
+		}
+		b = b[n:]
+
+		var v uint64
+		var data []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return ErrCorruptedResponse.WithMessage(protowire.ParseError(n).Error())
+		}
+		b = b[n:]
+
+		if err := fn(num, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseLabel(b []byte, labels map[string]string) merry.Error {
+	var name, value string
+	err := parseMessage(b, func(num protowire.Number, _ uint64, data []byte) merry.Error {
+		switch num {
+		case 1:
+			name = string(data)
+		case 2:
+			value = string(data)
+		}
+		return nil
+	})
+	labels[name] = value
+	return err
+}
+
+func parseSample(b []byte) (sample, merry.Error) {
+	var s sample
+	err := parseMessage(b, func(num protowire.Number, v uint64, _ []byte) merry.Error {
+		switch num {
+		case 1:
+			s.Value = math.Float64frombits(v)
+		case 2:
+			s.TimestampMs = int64(v)
+		}
+		return nil
+	})
+	return s, err
+}
+
+// parseReadResponse parses ReadResponse, that is returned, if server doesn't support streamed response. Result
+// contains series for every query of the request.
+func parseReadResponse(b []byte) ([][]timeSeries, merry.Error) {
+	var results [][]timeSeries
+	err := parseMessage(b, func(num protowire.Number, _ uint64, data []byte) merry.Error {
+		if num != 1 {
+			return nil
+		}
+		var result []timeSeries
+		err := parseMessage(data, func(num protowire.Number, _ uint64, data []byte) merry.Error {
+			if num != 1 {
+				return nil
+			}
+			ts := timeSeries{Labels: make(map[string]string)}
+			err := parseMessage(data, func(num protowire.Number, _ uint64, data []byte) merry.Error {
+				switch num {
+				case 1:
+					return parseLabel(data, ts.Labels)
+				case 2:
+					s, err := parseSample(data)
+					ts.Samples = append(ts.Samples, s)
+					return err
+				}
+				return nil
+			})
+			result = append(result, ts)
+			return err
+		})
+		results = append(results, result)
+		return err
+	})
+	return results, err
+}
+
+// parseChunkedReadResponse parses single frame of streamed response. Samples of all chunks of the series are
+// decoded and returned in order.
+func parseChunkedReadResponse(b []byte) (queryIndex int, series []timeSeries, err merry.Error) {
+	err = parseMessage(b, func(num protowire.Number, v uint64, data []byte) merry.Error {
+		switch num {
+		case 1:
+			ts := timeSeries{Labels: make(map[string]string)}
+			err := parseMessage(data, func(num protowire.Number, _ uint64, data []byte) merry.Error {
+				switch num {
+				case 1:
+					return parseLabel(data, ts.Labels)
+				case 2:
+					var chunkType uint64
+					var chunk []byte
+					err := parseMessage(data, func(num protowire.Number, v uint64, data []byte) merry.Error {
+						switch num {
+						case 3:
+							chunkType = v
+						case 4:
+							chunk = data
+						}
+						return nil
+					})
+					if err != nil || chunkType != chunkTypeXOR {
+						return err
+					}
+					ts.Samples, err = decodeXORChunk(chunk, ts.Samples)
+					return err
+				}
+				return nil
+			})
+			series = append(series, ts)
+			return err
+		case 2:
+			queryIndex = int(v)
+		}
+		return nil
+	})
+	return queryIndex, series, err
+}
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// nextFrame returns message of the first frame of streamed response and the rest of the response. Every frame is
+// uvarint size of the message, big endian CRC32 (Castagnoli) of the message and the message itself.
+func nextFrame(b []byte) ([]byte, []byte, merry.Error) {
+	size, n := binary.Uvarint(b)
+	if n <= 0 || len(b)-n < 4 || size > uint64(len(b)-n-4) {
+		return nil, nil, ErrCorruptedResponse.WithMessage("frame is truncated")
+	}
+	b = b[n:]
+	checksum := binary.BigEndian.Uint32(b)
+	msg := b[4 : 4+size]
+	if crc32.Checksum(msg, castagnoliTable) != checksum {
+		return nil, nil, ErrCorruptedResponse.WithMessage("checksum mismatch")
+	}
+	return msg, b[4+size:], nil
+}
@@ -0,0 +1,447 @@
+package remoteread
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/expr/consolidations"
+	"github.com/go-graphite/carbonapi/limiter"
+	"github.com/go-graphite/carbonapi/zipper/helper"
+	"github.com/go-graphite/carbonapi/zipper/metadata"
+	"github.com/go-graphite/carbonapi/zipper/protocols/prometheus"
+	"github.com/go-graphite/carbonapi/zipper/protocols/prometheus/helpers"
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+func init() {
+	aliases := []string{"prometheus_remote_read", "remote_read"}
+	metadata.Metadata.Lock()
+	for _, name := range aliases {
+		metadata.Metadata.SupportedProtocols[name] = struct{}{}
+		metadata.Metadata.ProtocolInits[name] = New
+		metadata.Metadata.ProtocolInitsWithLimiter[name] = NewWithLimiter
+	}
+	defer metadata.Metadata.Unlock()
+}
+
+var ErrInvalidTarget = merry.New("target can't be converted to label matchers").WithHTTPCode(http.StatusBadRequest)
+
+// RemoteReadGroup is a protocol group, that fetches raw samples through prometheus remote read API. Find and tag
+// requests are sent to prometheus http API of the same servers.
+type RemoteReadGroup struct {
+	types.BackendServer
+
+	groupName string
+	servers   []string
+	protocol  string
+
+	client *http.Client
+
+	limiter              limiter.ServerLimiter
+	logger               *zap.Logger
+	timeout              types.Timeouts
+	maxTries             int
+	maxMetricsPerRequest int
+
+	step          int64
+	readPath      string
+	consolidation string
+	aggregate     func([]float64) float64
+
+	httpQuery *helper.HttpQuery
+}
+
+func NewWithLimiter(logger *zap.Logger, config types.BackendV2, tldCacheDisabled, requireSuccessAll bool, limiter limiter.ServerLimiter) (types.BackendServer, merry.Error) {
+	logger = logger.With(zap.String("type", "remoteRead"), zap.String("protocol", config.Protocol), zap.String("name", config.GroupName))
+
+	logger.Warn("support for this backend protocol is experimental, use with caution")
+	httpClient := helper.GetHTTPClient(logger, config)
+
+	// step is used only for series with a single sample, otherwise it's the interval between samples
+	step := int64(15)
+	stepI, ok := config.BackendOptions["step"]
+	if ok {
+		stepNew, ok := stepI.(string)
+		if !ok {
+			logger.Fatal("failed to parse step",
+				zap.String("type_parsed", fmt.Sprintf("%T", stepI)),
+				zap.String("type_expected", "string"),
+			)
+		}
+		if stepNew[len(stepNew)-1] >= '0' && stepNew[len(stepNew)-1] <= '9' {
+			stepNew += "s"
+		}
+		t, err := time.ParseDuration(stepNew)
+		if err != nil || t < time.Second {
+			logger.Fatal("failed to parse option",
+				zap.String("option_name", "step"),
+				zap.String("option_value", stepNew),
+				zap.Error(err),
+			)
+		}
+		step = int64(t.Seconds())
+	}
+
+	readPath := "/api/v1/read"
+	readPathI, ok := config.BackendOptions["read_path"]
+	if ok {
+		readPath, ok = readPathI.(string)
+		if !ok {
+			logger.Fatal("failed to parse read_path",
+				zap.String("type_parsed", fmt.Sprintf("%T", readPathI)),
+				zap.String("type_expected", "string"),
+			)
+		}
+	}
+
+	consolidation := "average"
+	consolidationI, ok := config.BackendOptions["consolidation"]
+	if ok {
+		consolidation, ok = consolidationI.(string)
+		if !ok {
+			logger.Fatal("failed to parse consolidation",
+				zap.String("type_parsed", fmt.Sprintf("%T", consolidationI)),
+				zap.String("type_expected", "string"),
+			)
+		}
+	}
+	aggregate, ok := consolidations.ConsolidationToFunc[consolidation]
+	if !ok {
+		logger.Fatal("unsupported consolidation",
+			zap.String("option_name", "consolidation"),
+			zap.String("option_value", consolidation),
+			zap.Strings("supported", consolidations.AvailableConsolidationFuncs()),
+		)
+	}
+
+	maxResponseSizeMB := 256
+	maxResponseSizeI, ok := config.BackendOptions["max_response_size_mb"]
+	if ok {
+		maxResponseSizeMB, ok = maxResponseSizeI.(int)
+		if !ok || maxResponseSizeMB < 0 {
+			logger.Fatal("failed to parse max_response_size_mb",
+				zap.String("type_parsed", fmt.Sprintf("%T", maxResponseSizeI)),
+				zap.String("type_expected", "non-negative int"),
+			)
+		}
+	}
+
+	httpQuery := helper.NewHttpQuery(config.GroupName, config.Servers, *config.MaxTries, limiter, httpClient, contentTypeProtobuf).
+		Configure(config).
+		WithMaxResponseSize(int64(maxResponseSizeMB) << 20)
+
+	c := &RemoteReadGroup{
+		groupName:            config.GroupName,
+		servers:              config.Servers,
+		protocol:             config.Protocol,
+		timeout:              *config.Timeouts,
+		maxTries:             *config.MaxTries,
+		maxMetricsPerRequest: *config.MaxBatchSize,
+
+		step:          step,
+		readPath:      readPath,
+		consolidation: consolidation,
+		aggregate:     aggregate,
+
+		client:  httpClient,
+		limiter: limiter,
+		logger:  logger,
+
+		httpQuery: httpQuery,
+	}
+
+	promLogger := logger.With(zap.String("subclass", "prometheus"))
+	c.BackendServer, _ = prometheus.NewWithEverythingInitialized(promLogger, config, tldCacheDisabled, requireSuccessAll, limiter, step, 11000, 0, prometheus.StartDelay{T: -1}, httpQuery, httpClient)
+
+	return c, nil
+}
+
+func New(logger *zap.Logger, config types.BackendV2, tldCacheDisabled, requireSuccessAll bool) (types.BackendServer, merry.Error) {
+	if config.ConcurrencyLimit == nil {
+		return nil, types.ErrConcurrencyLimitNotSet
+	}
+	if len(config.Servers) == 0 {
+		return nil, types.ErrNoServersSpecified
+	}
+	l := limiter.NewServerLimiter(config.Servers, *config.ConcurrencyLimit)
+
+	return NewWithLimiter(logger, config, tldCacheDisabled, requireSuccessAll, l)
+}
+
+func (c *RemoteReadGroup) Children() []types.BackendServer {
+	return []types.BackendServer{c}
+}
+
+// targetToMatchers converts target of the fetch request to label matchers. Tags of seriesByTag are converted one by
+// one ('name' is the name of the metric), other targets are matched against the name of the metric.
+// Step is returned, if it's set by '__step__' tag, otherwise it's 0.
+func targetToMatchers(target string) ([]labelMatcher, int64, merry.Error) {
+	if !strings.HasPrefix(target, "seriesByTag(") || !strings.HasSuffix(target, ")") {
+		if strings.ContainsAny(target, "*?[{") {
+			return []labelMatcher{{Type: matchRegexp, Name: "__name__", Value: strings.ReplaceAll(helpers.ConvertGraphiteTargetToPromQL(target), `\?`, ".")}}, 0, nil
+		}
+		return []labelMatcher{{Type: matchEqual, Name: "__name__", Value: target}}, 0, nil
+	}
+
+	tvs := helpers.SplitTagValues(target[len("seriesByTag(") : len(target)-1])
+	if v, ok := tvs["name"]; ok {
+		if _, ok := tvs["__name__"]; !ok {
+			tvs["__name__"] = v
+		}
+		delete(tvs, "name")
+	}
+	var step int64
+	if v, ok := tvs["__step__"]; ok {
+		stepStr := v.TagValue
+		if stepStr != "" && stepStr[len(stepStr)-1] >= '0' && stepStr[len(stepStr)-1] <= '9' {
+			stepStr += "s"
+		}
+		t, err := time.ParseDuration(stepStr)
+		if err != nil || t < time.Second {
+			return nil, 0, ErrInvalidTarget.WithMessagef("invalid __step__ '%s'", v.TagValue)
+		}
+		step = int64(t.Seconds())
+		delete(tvs, "__step__")
+	}
+
+	matchers := make([]labelMatcher, 0, len(tvs))
+	for name, t := range tvs {
+		m := labelMatcher{Name: name, Value: t.TagValue}
+		switch t.OP {
+		case "=":
+			m.Type = matchEqual
+		case "!=":
+			m.Type = matchNotEqual
+		case "=~":
+			m.Type = matchRegexp
+		case "!~":
+			m.Type = matchNotRegexp
+		default:
+			return nil, 0, ErrInvalidTarget.WithMessagef("unsupported tag expression in '%s'", target)
+		}
+		matchers = append(matchers, m)
+	}
+	if len(matchers) == 0 {
+		return nil, 0, ErrInvalidTarget.WithMessagef("no tag expressions in '%s'", target)
+	}
+	sort.Slice(matchers, func(i, j int) bool {
+		return matchers[i].Name < matchers[j].Name
+	})
+	return matchers, step, nil
+}
+
+// nativeStep returns the median interval between samples in seconds, so jitter of scrapes and missed scrapes don't
+// change it. Returns 0, if there are not enough samples.
+func nativeStep(samples []sample) int64 {
+	if len(samples) < 2 {
+		return 0
+	}
+	deltas := make([]int64, 0, len(samples)-1)
+	for i := 1; i < len(samples); i++ {
+		if d := samples[i].TimestampMs - samples[i-1].TimestampMs; d > 0 {
+			deltas = append(deltas, d)
+		}
+	}
+	if len(deltas) == 0 {
+		return 0
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i] < deltas[j] })
+	step := (deltas[len(deltas)/2] + 500) / 1000
+	if step < 1 {
+		step = 1
+	}
+	return step
+}
+
+// alignSamples puts samples to the nearest point of the grid with the given step. Samples, that fall into the same
+// point, are aggregated with the given function.
+func alignSamples(samples []sample, step int64, aggregate func([]float64) float64) (int64, int64, []float64) {
+	stepMs := step * 1000
+	first := (samples[0].TimestampMs + stepMs/2) / stepMs
+	last := (samples[len(samples)-1].TimestampMs + stepMs/2) / stepMs
+	values := make([]float64, last-first+1)
+	for i := range values {
+		values[i] = math.NaN()
+	}
+	point := make([]float64, 0, 1)
+	for i, s := range samples {
+		point = append(point, s.Value)
+		idx := (s.TimestampMs+stepMs/2)/stepMs - first
+		if i+1 < len(samples) && (samples[i+1].TimestampMs+stepMs/2)/stepMs-first == idx {
+			continue
+		}
+		if idx >= 0 && idx < int64(len(values)) {
+			values[idx] = aggregate(point)
+		}
+		point = point[:0]
+	}
+	return first * step, last * step, values
+}
+
+type namedSeries struct {
+	name    string
+	samples []sample
+}
+
+// parseResponse returns series for every query of the request. Streamed response can split series into a few frames,
+// so samples of the frames with the same labels are merged. Frames are decoded only after the whole response is read by
+// HttpQuery, so streaming doesn't reduce memory usage of carbonapi, the size of the response is limited by
+// max_response_size_mb option instead.
+func parseResponse(res *helper.ServerResponse, queries int) ([][]namedSeries, merry.Error) {
+	results := make([][]namedSeries, queries)
+	if res == nil || len(res.Response) == 0 {
+		return results, nil
+	}
+
+	if !strings.HasPrefix(res.ContentType, "application/x-streamed-protobuf") {
+		body, err := snappyDecode(res.Response)
+		if err != nil {
+			return nil, err
+		}
+		rr, err := parseReadResponse(body)
+		if err != nil {
+			return nil, err
+		}
+		for i, result := range rr {
+			if i >= queries {
+				break
+			}
+			for _, ts := range result {
+				results[i] = append(results[i], namedSeries{name: helpers.PromMetricToGraphite(ts.Labels), samples: ts.Samples})
+			}
+		}
+		return results, nil
+	}
+
+	index := make([]map[string]int, queries)
+	for b := res.Response; len(b) > 0; {
+		msg, rest, err := nextFrame(b)
+		if err != nil {
+			return nil, err
+		}
+		b = rest
+		i, series, err := parseChunkedReadResponse(msg)
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= queries {
+			return nil, ErrCorruptedResponse.WithMessagef("unexpected query index %d", i)
+		}
+		if index[i] == nil {
+			index[i] = make(map[string]int)
+		}
+		for _, ts := range series {
+			name := helpers.PromMetricToGraphite(ts.Labels)
+			if idx, ok := index[i][name]; ok {
+				results[i][idx].samples = append(results[i][idx].samples, ts.Samples...)
+				continue
+			}
+			index[i][name] = len(results[i])
+			results[i] = append(results[i], namedSeries{name: name, samples: ts.Samples})
+		}
+	}
+	return results, nil
+}
+
+func (c *RemoteReadGroup) Fetch(ctx context.Context, request *protov3.MultiFetchRequest) (*protov3.MultiFetchResponse, *types.Stats, merry.Error) {
+	logger := c.logger.With(zap.String("type", "fetch"), zap.String("request", request.String()))
+	stats := &types.Stats{}
+
+	var r protov3.MultiFetchResponse
+	req := readRequest{
+		AcceptedResponseTypes: []responseType{responseTypeStreamedXORChunks, responseTypeSamples},
+	}
+	var (
+		pathExprs []string
+		steps     []int64
+		e         merry.Error
+	)
+	for _, m := range request.Metrics {
+		matchers, step, err := targetToMatchers(m.Name)
+		if err != nil {
+			stats.RenderErrors++
+			if e == nil {
+				e = err
+			} else {
+				e = e.WithCause(err)
+			}
+			continue
+		}
+		req.Queries = append(req.Queries, query{
+			StartMs:  m.StartTime * 1000,
+			EndMs:    m.StopTime * 1000,
+			Matchers: matchers,
+		})
+		pathExprs = append(pathExprs, m.PathExpression)
+		steps = append(steps, step)
+	}
+
+	if len(req.Queries) > 0 {
+		logger.Debug("will do query",
+			zap.Any("queries", req.LogInfo()),
+		)
+
+		stats.RenderRequests++
+		res, err := c.httpQuery.DoQueryWithStats(ctx, logger, c.readPath, req, stats)
+		if err == nil {
+			var results [][]namedSeries
+			results, err = parseResponse(res, len(req.Queries))
+			for i, result := range results {
+				for _, s := range result {
+					if len(s.samples) == 0 {
+						continue
+					}
+					// step of __step__ tag is used for all series of the target
+					step := steps[i]
+					if step == 0 {
+						step = nativeStep(s.samples)
+					}
+					if step == 0 {
+						step = c.step
+					}
+					start, stop, values := alignSamples(s.samples, step, c.aggregate)
+					r.Metrics = append(r.Metrics, protov3.FetchResponse{
+						Name:              s.name,
+						PathExpression:    pathExprs[i],
+						ConsolidationFunc: c.consolidation,
+						StartTime:         start,
+						StopTime:          stop,
+						StepTime:          step,
+						Values:            values,
+						XFilesFactor:      0.0,
+					})
+				}
+			}
+		}
+		if err != nil {
+			stats.RenderErrors++
+			if merry.Is(err, types.ErrTimeoutExceeded) {
+				stats.Timeouts++
+				stats.RenderTimeouts++
+			}
+			if e == nil {
+				e = err
+			} else {
+				e = e.WithCause(err)
+			}
+		}
+	}
+
+	if e != nil {
+		stats.FailedServers = []string{c.groupName}
+		logger.Error("errors occurred while getting results",
+			zap.Any("errors", e),
+		)
+		return &r, stats, e
+	}
+	return &r, stats, nil
+}
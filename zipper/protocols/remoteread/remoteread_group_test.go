@@ -0,0 +1,544 @@
+package remoteread
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/bits"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ansel1/merry"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/go-graphite/carbonapi/expr/consolidations"
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+// bitWriter and encodeXORChunk are the encoder of tsdb/chunkenc/xor.go of prometheus
+type bitWriter struct {
+	b     []byte
+	count int
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for n--; n >= 0; n-- {
+		if w.count == 0 {
+			w.b = append(w.b, 0)
+			w.count = 8
+		}
+		w.count--
+		w.b[len(w.b)-1] |= byte(v>>n&1) << w.count
+	}
+}
+
+func encodeXORChunk(samples []sample) []byte {
+	w := &bitWriter{b: binary.BigEndian.AppendUint16(nil, uint16(len(samples)))}
+	var tDelta int64
+	leading, trailing := 0xff, 0
+	for i, s := range samples {
+		switch i {
+		case 0:
+			for _, b := range binary.AppendVarint(nil, s.TimestampMs) {
+				w.writeBits(uint64(b), 8)
+			}
+			w.writeBits(math.Float64bits(s.Value), 64)
+			continue
+		case 1:
+			tDelta = s.TimestampMs - samples[0].TimestampMs
+			for _, b := range binary.AppendUvarint(nil, uint64(tDelta)) {
+				w.writeBits(uint64(b), 8)
+			}
+		default:
+			delta := s.TimestampMs - samples[i-1].TimestampMs
+			dod := delta - tDelta
+			tDelta = delta
+			switch {
+			case dod == 0:
+				w.writeBits(0, 1)
+			case -(1<<13-1) <= dod && dod <= 1<<13:
+				w.writeBits(0b10, 2)
+				w.writeBits(uint64(dod), 14)
+			case -(1<<16-1) <= dod && dod <= 1<<16:
+				w.writeBits(0b110, 3)
+				w.writeBits(uint64(dod), 17)
+			case -(1<<19-1) <= dod && dod <= 1<<19:
+				w.writeBits(0b1110, 4)
+				w.writeBits(uint64(dod), 20)
+			default:
+				w.writeBits(0b1111, 4)
+				w.writeBits(uint64(dod), 64)
+			}
+		}
+
+		delta := math.Float64bits(s.Value) ^ math.Float64bits(samples[i-1].Value)
+		if delta == 0 {
+			w.writeBits(0, 1)
+			continue
+		}
+		w.writeBits(1, 1)
+		newLeading, newTrailing := bits.LeadingZeros64(delta), bits.TrailingZeros64(delta)
+		if newLeading >= 32 {
+			newLeading = 31
+		}
+		if leading != 0xff && newLeading >= leading && newTrailing >= trailing {
+			w.writeBits(0, 1)
+			w.writeBits(delta>>trailing, 64-leading-trailing)
+			continue
+		}
+		leading, trailing = newLeading, newTrailing
+		w.writeBits(1, 1)
+		w.writeBits(uint64(leading), 5)
+		w.writeBits(uint64(64-leading-trailing), 6)
+		w.writeBits(delta>>trailing, 64-leading-trailing)
+	}
+	return w.b
+}
+
+func appendLabels(b []byte, labels map[string]string) []byte {
+	for k, v := range labels {
+		lb := appendBytesField(nil, 1, []byte(k))
+		lb = appendBytesField(lb, 2, []byte(v))
+		b = appendBytesField(b, 1, lb)
+	}
+	return b
+}
+
+// encodeReadResponse returns snappy compressed ReadResponse with a single query result
+func encodeReadResponse(series []timeSeries) []byte {
+	var qr []byte
+	for _, ts := range series {
+		tb := appendLabels(nil, ts.Labels)
+		for _, s := range ts.Samples {
+			sb := protowire.AppendTag(nil, 1, protowire.Fixed64Type)
+			sb = protowire.AppendFixed64(sb, math.Float64bits(s.Value))
+			sb = appendVarintField(sb, 2, uint64(s.TimestampMs))
+			tb = appendBytesField(tb, 2, sb)
+		}
+		qr = appendBytesField(qr, 1, tb)
+	}
+	return snappyEncode(appendBytesField(nil, 1, qr))
+}
+
+// appendFrame appends frame of streamed response with the series, which samples are split to chunks
+func appendFrame(b []byte, queryIndex int, labels map[string]string, chunkType uint64, chunks ...[]sample) []byte {
+	cs := appendLabels(nil, labels)
+	for _, samples := range chunks {
+		cb := appendVarintField(nil, 1, uint64(samples[0].TimestampMs))
+		cb = appendVarintField(cb, 2, uint64(samples[len(samples)-1].TimestampMs))
+		cb = appendVarintField(cb, 3, chunkType)
+		cb = appendBytesField(cb, 4, encodeXORChunk(samples))
+		cs = appendBytesField(cs, 2, cb)
+	}
+	msg := appendVarintField(appendBytesField(nil, 1, cs), 2, uint64(queryIndex))
+
+	b = binary.AppendUvarint(b, uint64(len(msg)))
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(msg, castagnoliTable))
+	return append(b, msg...)
+}
+
+// decodeReadRequest is used by the stand-in server to check the request
+func decodeReadRequest(t *testing.T, body []byte) readRequest {
+	b, err := snappyDecode(body)
+	if err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	var r readRequest
+	err = parseMessage(b, func(num protowire.Number, _ uint64, data []byte) merry.Error {
+		switch num {
+		case 1:
+			var q query
+			err := parseMessage(data, func(num protowire.Number, v uint64, data []byte) merry.Error {
+				switch num {
+				case 1:
+					q.StartMs = int64(v)
+				case 2:
+					q.EndMs = int64(v)
+				case 3:
+					var m labelMatcher
+					err := parseMessage(data, func(num protowire.Number, v uint64, data []byte) merry.Error {
+						switch num {
+						case 1:
+							m.Type = matcherType(v)
+						case 2:
+							m.Name = string(data)
+						case 3:
+							m.Value = string(data)
+						}
+						return nil
+					})
+					q.Matchers = append(q.Matchers, m)
+					return err
+				}
+				return nil
+			})
+			r.Queries = append(r.Queries, q)
+			return err
+		case 2:
+			for len(data) > 0 {
+				v, n := protowire.ConsumeVarint(data)
+				r.AcceptedResponseTypes = append(r.AcceptedResponseTypes, responseType(v))
+				data = data[n:]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to parse request: %v", err)
+	}
+	return r
+}
+
+func newTestGroup(t *testing.T, server string, backendOptions map[string]interface{}) types.BackendServer {
+	timeouts := types.Timeouts{Find: time.Second, Render: time.Second, Connect: time.Second}
+	concurrencyLimit, maxTries, maxBatchSize, maxIdleConns := 10, 1, 100, 10
+	idleTimeout, keepAlive := time.Minute, time.Second
+	b, err := New(zap.NewNop(), types.BackendV2{
+		GroupName:        "remote_read",
+		Protocol:         "prometheus_remote_read",
+		Servers:          []string{server},
+		Timeouts:         &timeouts,
+		ConcurrencyLimit: &concurrencyLimit,
+		MaxTries:         &maxTries,
+		MaxBatchSize:     &maxBatchSize,
+
+		MaxIdleConnsPerHost:   &maxIdleConns,
+		IdleConnectionTimeout: &idleTimeout,
+		KeepAliveInterval:     &keepAlive,
+
+		BackendOptions: backendOptions,
+	}, false, false)
+	if err != nil {
+		t.Fatalf("failed to create group: %v", err)
+	}
+	return b
+}
+
+func TestSnappy(t *testing.T) {
+	data := make([]byte, 70000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	decoded, err := snappyDecode(snappyEncode(data))
+	if err != nil || !reflect.DeepEqual(decoded, data) {
+		t.Fatalf("round trip failed: %v", err)
+	}
+
+	// literal "abc" and overlapping copy of 9 bytes with offset 3
+	decoded, err = snappyDecode([]byte{12, 0x08, 'a', 'b', 'c', 0x15, 0x03})
+	if err != nil || string(decoded) != "abcabcabcabc" {
+		t.Fatalf("unexpected result: %q, %v", decoded, err)
+	}
+
+	for _, corrupted := range [][]byte{
+		{12, 0x08, 'a', 'b', 'c', 0x15, 0x04},
+		{12, 0x08, 'a', 'b', 'c'},
+		{0xff, 0xff, 0xff, 0xff, 0x0f, 0x00},
+	} {
+		if _, err := snappyDecode(corrupted); !merry.Is(err, ErrCorruptedSnappy) {
+			t.Errorf("corrupted input %v is decoded: %v", corrupted, err)
+		}
+	}
+}
+
+func TestDecodeXORChunk(t *testing.T) {
+	samples := []sample{
+		{TimestampMs: 1700000000000, Value: 1},
+		{TimestampMs: 1700000015000, Value: 1},
+		{TimestampMs: 1700000030010, Value: 1.5},
+		{TimestampMs: 1700000044990, Value: -2.25},
+		{TimestampMs: 1700000060000, Value: 1e10},
+		{TimestampMs: 1700000120000, Value: math.Inf(1)},
+		{TimestampMs: 1700000135000, Value: 0},
+		{TimestampMs: 1700010000000, Value: 42},
+	}
+	got, err := decodeXORChunk(encodeXORChunk(samples), nil)
+	if err != nil {
+		t.Fatalf("failed to decode chunk: %v", err)
+	}
+	if !reflect.DeepEqual(got, samples) {
+		t.Fatalf("unexpected samples:\n got: %v\nwant: %v", got, samples)
+	}
+
+	chunk := encodeXORChunk(samples)
+	if _, err := decodeXORChunk(chunk[:len(chunk)-3], nil); !merry.Is(err, ErrCorruptedResponse) {
+		t.Fatalf("truncated chunk is decoded: %v", err)
+	}
+}
+
+func TestTargetToMatchers(t *testing.T) {
+	tests := []struct {
+		target   string
+		matchers []labelMatcher
+		step     int64
+		err      bool
+	}{
+		{
+			target:   "node_load1",
+			matchers: []labelMatcher{{Type: matchEqual, Name: "__name__", Value: "node_load1"}},
+		},
+		{
+			target:   "node_load?",
+			matchers: []labelMatcher{{Type: matchRegexp, Name: "__name__", Value: "node_load."}},
+		},
+		{
+			target:   "node_load{1,5}",
+			matchers: []labelMatcher{{Type: matchRegexp, Name: "__name__", Value: "node_load(1|5)"}},
+		},
+		{
+			target: "seriesByTag('name=node_load1','instance!=~a.*','job!=node','__step__=60')",
+			matchers: []labelMatcher{
+				{Type: matchEqual, Name: "__name__", Value: "node_load1"},
+				{Type: matchNotRegexp, Name: "instance", Value: "a.*"},
+				{Type: matchNotEqual, Name: "job", Value: "node"},
+			},
+			step: 60,
+		},
+		{
+			target: "seriesByTag('__step__=60')",
+			err:    true,
+		},
+		{
+			target: "seriesByTag('name=node_load1','__step__=0')",
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		matchers, step, err := targetToMatchers(tt.target)
+		if tt.err {
+			if !merry.Is(err, ErrInvalidTarget) {
+				t.Errorf("%s: expected error, got %v", tt.target, err)
+			}
+			continue
+		}
+		if err != nil || step != tt.step || !reflect.DeepEqual(matchers, tt.matchers) {
+			t.Errorf("%s: unexpected result %v, %d, %v", tt.target, matchers, step, err)
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	// scrapes every 15s with jitter and a missed scrape
+	samples := []sample{
+		{TimestampMs: 1700000010100, Value: 1},
+		{TimestampMs: 1700000024900, Value: 2},
+		{TimestampMs: 1700000040050, Value: 3},
+		{TimestampMs: 1700000070020, Value: 5},
+		{TimestampMs: 1700000084950, Value: 6},
+	}
+	labels := map[string]string{"__name__": "node_load1", "instance": "a", "job": "node"}
+	other := map[string]string{"__name__": "node_load1", "instance": "b", "job": "node"}
+
+	request := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{
+			{Name: "seriesByTag('name=node_load1','job=node')", PathExpression: "seriesByTag('name=node_load1','job=node')", StartTime: 1700000000, StopTime: 1700000100},
+		},
+	}
+	want := []protov3.FetchResponse{
+		{
+			Name:              "node_load1;instance=a;job=node",
+			PathExpression:    "seriesByTag('name=node_load1','job=node')",
+			ConsolidationFunc: "average",
+			StartTime:         1700000010,
+			StopTime:          1700000085,
+			StepTime:          15,
+			Values:            []float64{1, 2, 3, math.NaN(), 5, 6},
+		},
+		{
+			Name:              "node_load1;instance=b;job=node",
+			PathExpression:    "seriesByTag('name=node_load1','job=node')",
+			ConsolidationFunc: "average",
+			StartTime:         1700000100,
+			StopTime:          1700000100,
+			StepTime:          15,
+			Values:            []float64{7},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		streamed bool
+	}{
+		{name: "streamed", streamed: true},
+		{name: "samples"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "POST" || r.URL.Path != "/api/v1/read" || r.Header.Get("Content-Encoding") != "snappy" ||
+					r.Header.Get("X-Prometheus-Remote-Read-Version") == "" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				body, _ := io.ReadAll(r.Body)
+				req := decodeReadRequest(t, body)
+				wantQuery := query{
+					StartMs: 1700000000000,
+					EndMs:   1700000100000,
+					Matchers: []labelMatcher{
+						{Type: matchEqual, Name: "__name__", Value: "node_load1"},
+						{Type: matchEqual, Name: "job", Value: "node"},
+					},
+				}
+				if len(req.Queries) != 1 || !reflect.DeepEqual(req.Queries[0], wantQuery) ||
+					!reflect.DeepEqual(req.AcceptedResponseTypes, []responseType{responseTypeStreamedXORChunks, responseTypeSamples}) {
+					t.Errorf("unexpected request: %+v", req)
+				}
+
+				if !tt.streamed {
+					w.Header().Set("Content-Type", contentTypeProtobuf)
+					_, _ = w.Write(encodeReadResponse([]timeSeries{
+						{Labels: labels, Samples: samples},
+						{Labels: other, Samples: []sample{{TimestampMs: 1700000100000, Value: 7}}},
+					}))
+					return
+				}
+				// series is split into two frames, histogram chunks are skipped
+				w.Header().Set("Content-Type", contentTypeStreamed)
+				var resp []byte
+				resp = appendFrame(resp, 0, labels, chunkTypeXOR, samples[:2], samples[2:3])
+				resp = appendFrame(resp, 0, other, 2, []sample{{TimestampMs: 1700000000000, Value: 100}})
+				resp = appendFrame(resp, 0, labels, chunkTypeXOR, samples[3:])
+				resp = appendFrame(resp, 0, other, chunkTypeXOR, []sample{{TimestampMs: 1700000100000, Value: 7}})
+				_, _ = w.Write(resp)
+			}))
+			defer srv.Close()
+
+			res, stats, err := newTestGroup(t, srv.URL, nil).Fetch(t.Context(), request)
+			if err != nil {
+				t.Fatalf("failed to fetch: %v", err)
+			}
+			if stats.RenderRequests != 1 {
+				t.Errorf("unexpected count of requests: %d", stats.RenderRequests)
+			}
+			if len(res.Metrics) != len(want) {
+				t.Fatalf("unexpected count of series: %+v", res.Metrics)
+			}
+			for i := range want {
+				got, w := res.Metrics[i], want[i]
+				if got.Name != w.Name || got.PathExpression != w.PathExpression || got.ConsolidationFunc != w.ConsolidationFunc || got.StartTime != w.StartTime ||
+					got.StopTime != w.StopTime || got.StepTime != w.StepTime || len(got.Values) != len(w.Values) {
+					t.Fatalf("unexpected series:\n got: %+v\nwant: %+v", got, w)
+				}
+				for j := range w.Values {
+					if got.Values[j] != w.Values[j] && !(math.IsNaN(got.Values[j]) && math.IsNaN(w.Values[j])) {
+						t.Fatalf("unexpected values of %s: %v", got.Name, got.Values)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAlignSamples(t *testing.T) {
+	// irregular scrapes: two samples fall into the point of 1700000010, none into 1700000020
+	samples := []sample{
+		{TimestampMs: 1700000000000, Value: 1},
+		{TimestampMs: 1700000008000, Value: 2},
+		{TimestampMs: 1700000012000, Value: 4},
+		{TimestampMs: 1700000031000, Value: 5},
+		{TimestampMs: 1700000033000, Value: 6},
+		{TimestampMs: 1700000034000, Value: 7},
+	}
+	tests := []struct {
+		consolidation string
+		values        []float64
+	}{
+		{consolidation: "average", values: []float64{1, 3, math.NaN(), 6}},
+		{consolidation: "sum", values: []float64{1, 6, math.NaN(), 18}},
+		{consolidation: "max", values: []float64{1, 4, math.NaN(), 7}},
+		{consolidation: "last", values: []float64{1, 4, math.NaN(), 7}},
+	}
+	for _, tt := range tests {
+		start, stop, values := alignSamples(samples, 10, consolidations.ConsolidationToFunc[tt.consolidation])
+		if start != 1700000000 || stop != 1700000030 || len(values) != len(tt.values) {
+			t.Fatalf("%s: unexpected result %d, %d, %v", tt.consolidation, start, stop, values)
+		}
+		for i := range values {
+			if values[i] != tt.values[i] && !(math.IsNaN(values[i]) && math.IsNaN(tt.values[i])) {
+				t.Errorf("%s: unexpected values %v, want %v", tt.consolidation, values, tt.values)
+				break
+			}
+		}
+	}
+}
+
+func TestFetchResponseTooLarge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentTypeStreamed)
+		_, _ = w.Write(make([]byte, 1<<20+1))
+	}))
+	defer srv.Close()
+
+	request := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{{Name: "up", PathExpression: "up", StartTime: 0, StopTime: 100}},
+	}
+	_, stats, err := newTestGroup(t, srv.URL, map[string]interface{}{"max_response_size_mb": 1}).Fetch(t.Context(), request)
+	if !merry.Is(err, types.ErrResponseTooLarge) {
+		t.Fatalf("too large response is not rejected: %v", err)
+	}
+	if stats.RenderErrors != 1 || len(stats.FailedServers) != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestFetchCorruptedStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentTypeStreamed)
+		resp := appendFrame(nil, 0, map[string]string{"__name__": "up"}, chunkTypeXOR, []sample{{TimestampMs: 1000, Value: 1}})
+		resp[len(resp)-1] ^= 0xff
+		_, _ = w.Write(resp)
+	}))
+	defer srv.Close()
+
+	request := &protov3.MultiFetchRequest{
+		Metrics: []protov3.FetchRequest{{Name: "up", PathExpression: "up", StartTime: 0, StopTime: 100}},
+	}
+	_, stats, err := newTestGroup(t, srv.URL, nil).Fetch(t.Context(), request)
+	if !merry.Is(err, ErrCorruptedResponse) {
+		t.Fatalf("corrupted response is not detected: %v", err)
+	}
+	if stats.RenderErrors != 1 || len(stats.FailedServers) != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestNextFrame(t *testing.T) {
+	msg := []byte("message")
+	frame := binary.AppendUvarint(nil, uint64(len(msg)))
+	frame = binary.BigEndian.AppendUint32(frame, crc32.Checksum(msg, castagnoliTable))
+	frame = append(frame, msg...)
+
+	got, rest, err := nextFrame(append(frame, 1, 2))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != string(msg) || !reflect.DeepEqual(rest, []byte{1, 2}) {
+		t.Fatalf("unexpected frame %q, rest %v", got, rest)
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{name: "empty", frame: nil},
+		{name: "no checksum", frame: binary.AppendUvarint(nil, 0)},
+		{name: "truncated message", frame: frame[:len(frame)-1]},
+		{name: "huge size", frame: append(binary.AppendUvarint(nil, math.MaxUint64), frame[1:]...)},
+		{name: "size overflows with checksum", frame: append(binary.AppendUvarint(nil, math.MaxUint64-3), frame[1:]...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := nextFrame(tt.frame); !merry.Is(err, ErrCorruptedResponse) {
+				t.Fatalf("truncated frame is not detected: %v", err)
+			}
+		})
+	}
+}
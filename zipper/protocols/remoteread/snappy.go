@@ -0,0 +1,115 @@
+package remoteread
+
+import (
+	"encoding/binary"
+
+	"github.com/ansel1/merry"
+)
+
+// Remote read uses snappy block format (https://github.com/google/snappy/blob/main/format_description.txt) for
+// requests and non-streamed responses.
+const (
+	tagLiteral = 0x00
+	tagCopy1   = 0x01
+	tagCopy2   = 0x02
+	tagCopy4   = 0x03
+
+	// maxSnappyRatio is the highest possible compression ratio of snappy (64 bytes copied by 3 bytes long tag),
+	// that is used to reject corrupted lengths before allocating memory
+	maxSnappyRatio = 22
+)
+
+var ErrCorruptedSnappy = merry.New("snappy input is corrupted")
+
+// snappyEncode encodes src as a sequence of literals. Requests are small, so it's not worth to look for copies,
+// but result is still a valid snappy block.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)+binary.MaxVarintLen64+len(src)/60*5+5), uint64(len(src)))
+	for len(src) > 0 {
+		n := len(src)
+		if n > 65536 {
+			n = 65536
+		}
+		switch {
+		case n <= 60:
+			dst = append(dst, byte(n-1)<<2|tagLiteral)
+		case n <= 256:
+			dst = append(dst, 60<<2|tagLiteral, byte(n-1))
+		default:
+			dst = append(dst, 61<<2|tagLiteral, byte(n-1), byte((n-1)>>8))
+		}
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+	return dst
+}
+
+// snappyDecode decodes snappy block
+func snappyDecode(src []byte) ([]byte, merry.Error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 || size > uint64(len(src))*maxSnappyRatio {
+		return nil, ErrCorruptedSnappy.WithMessage("invalid length of decoded data")
+	}
+	src = src[n:]
+	dst := make([]byte, 0, size)
+
+	for len(src) > 0 {
+		var length, offset int
+		switch src[0] & 0x03 {
+		case tagLiteral:
+			length = int(src[0] >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, ErrCorruptedSnappy.WithMessage("literal length is truncated")
+				}
+				length = 0
+				for i := 0; i < extra; i++ {
+					length |= int(src[i]) << (8 * i)
+				}
+				src = src[extra:]
+			}
+			length++
+			if length <= 0 || length > len(src) || len(dst)+length > int(size) {
+				return nil, ErrCorruptedSnappy.WithMessage("literal is out of bounds")
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case tagCopy1:
+			if len(src) < 2 {
+				return nil, ErrCorruptedSnappy.WithMessage("copy is truncated")
+			}
+			length = 4 + int(src[0]>>2)&0x07
+			offset = int(src[0]&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case tagCopy2:
+			if len(src) < 3 {
+				return nil, ErrCorruptedSnappy.WithMessage("copy is truncated")
+			}
+			length = 1 + int(src[0]>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case tagCopy4:
+			if len(src) < 5 {
+				return nil, ErrCorruptedSnappy.WithMessage("copy is truncated")
+			}
+			length = 1 + int(src[0]>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(size) {
+			return nil, ErrCorruptedSnappy.WithMessage("copy is out of bounds")
+		}
+		// copies may overlap with their own output, so bytes are copied one by one
+		start := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if len(dst) != int(size) {
+		return nil, ErrCorruptedSnappy.WithMessage("decoded length mismatch")
+	}
+	return dst, nil
+}
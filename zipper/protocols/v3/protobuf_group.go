@@ -69,7 +69,7 @@ func NewWithLimiter(logger *zap.Logger, config types.BackendV2, tldCacheDisabled
 
 	httpClient := helper.GetHTTPClient(logger, config)
 
-	httpQuery := helper.NewHttpQuery(config.GroupName, config.Servers, *config.MaxTries, l, httpClient, httpHeaders.ContentTypeCarbonAPIv3PB)
+	httpQuery := helper.NewHttpQuery(config.GroupName, config.Servers, *config.MaxTries, l, httpClient, httpHeaders.ContentTypeCarbonAPIv3PB).Configure(config)
 
 	c := &ClientProtoV3Group{
 		groupName:            config.GroupName,
@@ -111,7 +111,7 @@ func (c *ClientProtoV3Group) Fetch(ctx context.Context, request *protov3.MultiFe
 	}
 	rewrite.RawQuery = v.Encode()
 
-	res, err := c.httpQuery.DoQuery(ctx, logger, rewrite.RequestURI(), types.MultiFetchRequestV3{MultiFetchRequest: *request})
+	res, err := c.httpQuery.DoQueryWithStats(ctx, logger, rewrite.RequestURI(), types.MultiFetchRequestV3{MultiFetchRequest: *request}, stats)
 	if err != nil {
 		stats.RenderErrors = 1
 		if merry.Is(err, types.ErrTimeoutExceeded) {
@@ -154,7 +154,7 @@ func (c *ClientProtoV3Group) Find(ctx context.Context, request *protov3.MultiGlo
 	}
 	rewrite.RawQuery = v.Encode()
 
-	res, err := c.httpQuery.DoQuery(ctx, logger, rewrite.RequestURI(), types.MultiGlobRequestV3{MultiGlobRequest: *request})
+	res, err := c.httpQuery.DoQueryWithStats(ctx, logger, rewrite.RequestURI(), types.MultiGlobRequestV3{MultiGlobRequest: *request}, stats)
 	if err != nil {
 		stats.FindErrors = 1
 		if merry.Is(err, types.ErrTimeoutExceeded) {
@@ -190,7 +190,7 @@ func (c *ClientProtoV3Group) Info(ctx context.Context, request *protov3.MultiMet
 	}
 	rewrite.RawQuery = v.Encode()
 
-	res, err := c.httpQuery.DoQuery(ctx, logger, rewrite.RequestURI(), types.MultiMetricsInfoV3{MultiMetricsInfoRequest: *request})
+	res, err := c.httpQuery.DoQueryWithStats(ctx, logger, rewrite.RequestURI(), types.MultiMetricsInfoV3{MultiMetricsInfoRequest: *request}, stats)
 	if err != nil {
 		stats.InfoErrors = 1
 		if merry.Is(err, types.ErrTimeoutExceeded) {
@@ -117,7 +117,7 @@ func (c *VictoriaMetricsGroup) Fetch(ctx context.Context, request *protov3.Multi
 
 			rewrite.RawQuery = v.Encode()
 			stats.RenderRequests++
-			res, err2 := c.httpQuery.DoQuery(ctx, logger, rewrite.RequestURI(), nil)
+			res, err2 := c.httpQuery.DoQueryWithStats(ctx, logger, rewrite.RequestURI(), nil, stats)
 			if err2 != nil {
 				stats.RenderErrors++
 				if merry.Is(err, types.ErrTimeoutExceeded) {
@@ -52,7 +52,7 @@ func (c *VictoriaMetricsGroup) Find(ctx context.Context, request *protov3.MultiG
 
 		rewrite.RawQuery = v.Encode()
 		stats.FindRequests++
-		res, queryErr := c.httpQuery.DoQuery(ctx, logger, rewrite.RequestURI(), nil)
+		res, queryErr := c.httpQuery.DoQueryWithStats(ctx, logger, rewrite.RequestURI(), nil, stats)
 		if queryErr != nil {
 			stats.FindErrors++
 			if merry.Is(queryErr, types.ErrTimeoutExceeded) {
@@ -200,7 +200,7 @@ func NewWithLimiter(logger *zap.Logger, config types.BackendV2, tldCacheDisabled
 		}
 	}
 
-	httpQuery := helper.NewHttpQuery(config.GroupName, config.Servers, *config.MaxTries, limiter, httpClient, httpHeaders.ContentTypeCarbonAPIv2PB)
+	httpQuery := helper.NewHttpQuery(config.GroupName, config.Servers, *config.MaxTries, limiter, httpClient, httpHeaders.ContentTypeCarbonAPIv2PB).Configure(config)
 
 	c := &VictoriaMetricsGroup{
 		groupName:            config.GroupName,
@@ -248,7 +248,7 @@ func New(logger *zap.Logger, config types.BackendV2, tldCacheDisabled, requireSu
 	if len(config.Servers) == 0 {
 		return nil, types.ErrNoServersSpecified
 	}
-	l := limiter.NewServerLimiter([]string{config.GroupName}, *config.ConcurrencyLimit)
+	l := limiter.NewServerLimiter(config.Servers, *config.ConcurrencyLimit)
 
 	return NewWithLimiter(logger, config, tldCacheDisabled, requireSuccessAll, l)
 }
@@ -0,0 +1,67 @@
+package whisper
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// expandBraces returns patterns without braces, e.g. "a{b,c}d" becomes "abd" and "acd"
+func expandBraces(pattern string) []string {
+	open := strings.IndexByte(pattern, '{')
+	if open == -1 {
+		return []string{pattern}
+	}
+	depth := 0
+	for i := open; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth > 0 {
+				continue
+			}
+			var res []string
+			for _, alt := range splitAlternatives(pattern[open+1 : i]) {
+				res = append(res, expandBraces(pattern[:open]+alt+pattern[i+1:])...)
+			}
+			return res
+		}
+	}
+	// unbalanced brace is matched literally
+	return []string{pattern}
+}
+
+// splitAlternatives splits content of braces by commas, that are not inside of nested braces
+func splitAlternatives(s string) []string {
+	var res []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				res = append(res, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(res, s[start:])
+}
+
+// matchNode returns true, if name of the directory or metric file matches the node of the query
+func matchNode(pattern, name string) bool {
+	ok, _ := filepath.Match(pattern, name)
+	return ok
+}
+
+func hasWildcards(node string) bool {
+	return strings.ContainsAny(node, "*?[")
+}
+
+func isGlob(query string) bool {
+	return strings.ContainsAny(query, "*?[{")
+}
@@ -0,0 +1,26 @@
+//go:build linux
+
+package whisper
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileUsage returns size of the file on disk and its access time
+func fileUsage(fi os.FileInfo) (realSize, atime int64) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.Size(), 0
+	}
+	return st.Blocks * 512, st.Atim.Sec
+}
+
+// diskSpace returns free and total space of the file system with the directory
+func diskSpace(dir string) (free, total uint64) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0
+	}
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package whisper
+
+import (
+	"os"
+)
+
+// fileUsage returns size of the file on disk and its access time, that are known only on linux
+func fileUsage(fi os.FileInfo) (realSize, atime int64) {
+	return fi.Size(), 0
+}
+
+// diskSpace returns free and total space of the file system, that are known only on linux
+func diskSpace(dir string) (free, total uint64) {
+	return 0, 0
+}
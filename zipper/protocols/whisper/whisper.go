@@ -0,0 +1,206 @@
+package whisper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+
+	"github.com/ansel1/merry"
+)
+
+// Whisper file format (https://graphite.readthedocs.io/en/latest/whisper.html), all numbers are big endian:
+//
+//	header:       aggregationType uint32, maxRetention uint32, xFilesFactor float32, archiveCount uint32
+//	archive info: offset uint32, secondsPerPoint uint32, points uint32 (for every archive, from the highest precision)
+//	archives:     points of timestamp uint32 and value float64
+const (
+	metadataSize    = 16
+	archiveInfoSize = 12
+	pointSize       = 12
+)
+
+// compressedMagic starts compressed whisper files of go-whisper, that are not supported
+var compressedMagic = []byte("whisper_compressed")
+
+var (
+	ErrCorrupted          = merry.New("whisper file is corrupted")
+	ErrCompressedWhisper  = merry.New("compressed whisper files are not supported")
+	ErrUnknownAggregation = merry.New("unknown aggregation method")
+)
+
+var aggregationMethods = map[uint32]string{
+	1: "average",
+	2: "sum",
+	3: "last",
+	4: "max",
+	5: "min",
+	6: "avg_zero",
+	7: "absmax",
+	8: "absmin",
+}
+
+type archive struct {
+	offset          int64
+	secondsPerPoint int64
+	points          int64
+}
+
+func (a archive) retention() int64 {
+	return a.secondsPerPoint * a.points
+}
+
+type header struct {
+	aggregation  string
+	maxRetention int64
+	xFilesFactor float32
+	archives     []archive
+}
+
+// readHeader reads and validates header of opened file. Everything is checked against the size of the file, so
+// file, that is truncated or replaced by another one while it's read, returns an error instead of garbage.
+func readHeader(f *os.File, size int64) (*header, merry.Error) {
+	if size < metadataSize {
+		return nil, ErrCorrupted.WithMessagef("file is too small: %d bytes", size)
+	}
+	buf := make([]byte, metadataSize)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return nil, merry.Wrap(err)
+	}
+	if bytes.Equal(buf, compressedMagic[:metadataSize]) {
+		return nil, ErrCompressedWhisper
+	}
+
+	h := &header{
+		maxRetention: int64(binary.BigEndian.Uint32(buf[4:])),
+		xFilesFactor: math.Float32frombits(binary.BigEndian.Uint32(buf[8:])),
+	}
+	var ok bool
+	if h.aggregation, ok = aggregationMethods[binary.BigEndian.Uint32(buf)]; !ok {
+		return nil, ErrUnknownAggregation.WithValue("aggregation", binary.BigEndian.Uint32(buf))
+	}
+	if h.xFilesFactor < 0 || h.xFilesFactor > 1 {
+		return nil, ErrCorrupted.WithMessagef("invalid xFilesFactor %v", h.xFilesFactor)
+	}
+
+	count := int64(binary.BigEndian.Uint32(buf[12:]))
+	headerSize := metadataSize + count*archiveInfoSize
+	if count == 0 || headerSize > size {
+		return nil, ErrCorrupted.WithMessagef("invalid count of archives %d", count)
+	}
+	buf = make([]byte, count*archiveInfoSize)
+	if _, err := f.ReadAt(buf, metadataSize); err != nil {
+		return nil, merry.Wrap(err)
+	}
+	h.archives = make([]archive, count)
+	for i := range h.archives {
+		a := archive{
+			offset:          int64(binary.BigEndian.Uint32(buf[i*archiveInfoSize:])),
+			secondsPerPoint: int64(binary.BigEndian.Uint32(buf[i*archiveInfoSize+4:])),
+			points:          int64(binary.BigEndian.Uint32(buf[i*archiveInfoSize+8:])),
+		}
+		if a.secondsPerPoint == 0 || a.points == 0 || a.offset < headerSize || a.offset+a.points*pointSize > size {
+			return nil, ErrCorrupted.WithMessagef("invalid archive %d: %+v", i, a)
+		}
+		if i > 0 && a.secondsPerPoint <= h.archives[i-1].secondsPerPoint {
+			return nil, ErrCorrupted.WithMessagef("archive %d has higher precision than the previous one", i)
+		}
+		h.archives[i] = a
+	}
+	return h, nil
+}
+
+type series struct {
+	start  int64
+	stop   int64
+	step   int64
+	values []float64
+}
+
+// fetch reads values from the archive with the highest precision, that covers requested interval, like whisper.py
+// does. Returns nil, if interval is out of retention.
+func (h *header) fetch(f *os.File, from, until, now int64) (*series, merry.Error) {
+	oldest := now - h.maxRetention
+	if from > now || until < oldest {
+		return nil, nil
+	}
+	if from < oldest {
+		from = oldest
+	}
+	if until > now {
+		until = now
+	}
+	if from > until {
+		return nil, nil
+	}
+
+	a := h.archives[len(h.archives)-1]
+	for _, candidate := range h.archives {
+		if candidate.retention() >= now-from {
+			a = candidate
+			break
+		}
+	}
+
+	step := a.secondsPerPoint
+	fromInterval := from - from%step + step
+	untilInterval := until - until%step + step
+	if fromInterval == untilInterval {
+		untilInterval += step
+	}
+	s := &series{
+		start:  fromInterval,
+		stop:   untilInterval,
+		step:   step,
+		values: make([]float64, (untilInterval-fromInterval)/step),
+	}
+	for i := range s.values {
+		s.values[i] = math.NaN()
+	}
+
+	// timestamp of the first point in the archive is a base to find position of any point
+	buf := make([]byte, pointSize)
+	if _, err := f.ReadAt(buf, a.offset); err != nil {
+		return nil, merry.Wrap(err)
+	}
+	base := int64(binary.BigEndian.Uint32(buf))
+	if base == 0 {
+		// archive is empty
+		return s, nil
+	}
+
+	startIdx := ((fromInterval-base)/step%a.points + a.points) % a.points
+	buf, err := readPoints(f, a, startIdx, int64(len(s.values)))
+	if err != nil {
+		return nil, err
+	}
+	for i := range s.values {
+		// points, that are not written yet or are from the previous round, have unexpected timestamps
+		ts := int64(binary.BigEndian.Uint32(buf[i*pointSize:]))
+		if ts == fromInterval+int64(i)*step {
+			s.values[i] = math.Float64frombits(binary.BigEndian.Uint64(buf[i*pointSize+4:]))
+		}
+	}
+	return s, nil
+}
+
+// readPoints reads n points of the archive starting from the point with index idx, wrapping around the end of archive
+func readPoints(f *os.File, a archive, idx, n int64) ([]byte, merry.Error) {
+	buf := make([]byte, n*pointSize)
+	for read := int64(0); read < n; {
+		i := (idx + read) % a.points
+		chunk := n - read
+		if chunk > a.points-i {
+			chunk = a.points - i
+		}
+		if _, err := f.ReadAt(buf[read*pointSize:(read+chunk)*pointSize], a.offset+i*pointSize); err != nil {
+			if err == io.EOF {
+				return nil, ErrCorrupted.WithMessagef("archive is truncated at point %d", i)
+			}
+			return nil, merry.Wrap(err)
+		}
+		read += chunk
+	}
+	return buf, nil
+}
@@ -0,0 +1,464 @@
+package whisper
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/limiter"
+	"github.com/go-graphite/carbonapi/zipper/metadata"
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+func init() {
+	aliases := []string{"whisper"}
+	metadata.Metadata.Lock()
+	for _, name := range aliases {
+		metadata.Metadata.SupportedProtocols[name] = struct{}{}
+		metadata.Metadata.ProtocolInits[name] = New
+		metadata.Metadata.ProtocolInitsWithLimiter[name] = NewWithLimiter
+	}
+	defer metadata.Metadata.Unlock()
+}
+
+var ErrNotDirectory = merry.New("whisper data directory is not a directory")
+
+// WhisperGroup reads metrics from whisper files in local data directories (servers of the group), like carbonserver
+// of go-carbon does. Files are opened for every request, so files, that are replaced or removed, are read safely.
+type WhisperGroup struct {
+	groupName string
+	servers   []string
+	// roots are data directories, metric is read from the first one, that has it
+	roots []string
+
+	limiter              limiter.ServerLimiter
+	logger               *zap.Logger
+	maxMetricsPerRequest int
+
+	now func() time.Time
+}
+
+func NewWithLimiter(logger *zap.Logger, config types.BackendV2, tldCacheDisabled, requireSuccessAll bool, limiter limiter.ServerLimiter) (types.BackendServer, merry.Error) {
+	logger = logger.With(zap.String("type", "whisper"), zap.String("protocol", config.Protocol), zap.String("name", config.GroupName))
+
+	roots := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		root := filepath.Clean(strings.TrimPrefix(server, "file://"))
+		fi, err := os.Stat(root)
+		if err != nil {
+			return nil, merry.Wrap(err).WithValue("server", server)
+		}
+		if !fi.IsDir() {
+			return nil, ErrNotDirectory.WithValue("server", server)
+		}
+		roots = append(roots, root)
+	}
+
+	c := &WhisperGroup{
+		groupName:            config.GroupName,
+		servers:              config.Servers,
+		roots:                roots,
+		limiter:              limiter,
+		logger:               logger,
+		maxMetricsPerRequest: *config.MaxBatchSize,
+		now:                  time.Now,
+	}
+	return c, nil
+}
+
+func New(logger *zap.Logger, config types.BackendV2, tldCacheDisabled, requireSuccessAll bool) (types.BackendServer, merry.Error) {
+	if config.ConcurrencyLimit == nil {
+		return nil, types.ErrConcurrencyLimitNotSet
+	}
+	if len(config.Servers) == 0 {
+		return nil, types.ErrNoServersSpecified
+	}
+	l := limiter.NewServerLimiter([]string{config.GroupName}, *config.ConcurrencyLimit)
+
+	return NewWithLimiter(logger, config, tldCacheDisabled, requireSuccessAll, l)
+}
+
+func (c *WhisperGroup) Children() []types.BackendServer {
+	return []types.BackendServer{c}
+}
+
+func (c WhisperGroup) MaxMetricsPerRequest() int {
+	return c.maxMetricsPerRequest
+}
+
+func (c WhisperGroup) Name() string {
+	return c.groupName
+}
+
+func (c WhisperGroup) Backends() []string {
+	return c.servers
+}
+
+// glob returns directories and metrics, matching the query, from all data directories
+func (c *WhisperGroup) glob(query string) []protov3.GlobMatch {
+	seen := make(map[protov3.GlobMatch]struct{})
+	var matches []protov3.GlobMatch
+	for _, q := range expandBraces(query) {
+		nodes := strings.Split(q, ".")
+		for _, root := range c.roots {
+			walk(root, "", nodes, func(m protov3.GlobMatch) {
+				if _, ok := seen[m]; !ok {
+					seen[m] = struct{}{}
+					matches = append(matches, m)
+				}
+			})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Path == matches[j].Path {
+			return !matches[i].IsLeaf
+		}
+		return matches[i].Path < matches[j].Path
+	})
+	return matches
+}
+
+// walk matches entries of the directory against the first node and goes deeper with the rest of them. Directories,
+// that disappear while they are read, are skipped.
+func walk(dir, prefix string, nodes []string, found func(protov3.GlobMatch)) {
+	node := nodes[0]
+	if node == "" || strings.ContainsAny(node, `/\`) {
+		return
+	}
+	last := len(nodes) == 1
+
+	var names []string
+	if hasWildcards(node) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			if name := e.Name(); !strings.HasPrefix(name, ".") {
+				names = append(names, name)
+			}
+		}
+	} else {
+		names = []string{node, node + ".wsp"}
+	}
+
+	for _, name := range names {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		switch {
+		case fi.IsDir() && matchNode(node, name):
+			if last {
+				found(protov3.GlobMatch{Path: prefix + name, IsLeaf: false})
+			} else {
+				walk(filepath.Join(dir, name), prefix+name+".", nodes[1:], found)
+			}
+		case last && fi.Mode().IsRegular() && strings.HasSuffix(name, ".wsp") && matchNode(node, strings.TrimSuffix(name, ".wsp")):
+			found(protov3.GlobMatch{Path: prefix + strings.TrimSuffix(name, ".wsp"), IsLeaf: true})
+		}
+	}
+}
+
+// metrics returns names of metrics, matching the query
+func (c *WhisperGroup) metrics(query string) []string {
+	if !isGlob(query) {
+		return []string{query}
+	}
+	var names []string
+	for _, m := range c.glob(query) {
+		if m.IsLeaf {
+			names = append(names, m.Path)
+		}
+	}
+	return names
+}
+
+// open opens whisper file of the metric in the first data directory, that has it
+func (c *WhisperGroup) open(name string) (*os.File, os.FileInfo, error) {
+	if name == "" || strings.Contains(name, "..") || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, nil, os.ErrNotExist
+	}
+	rel := strings.ReplaceAll(name, ".", string(filepath.Separator)) + ".wsp"
+	for _, root := range c.roots {
+		f, err := os.Open(filepath.Join(root, rel))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, nil, err
+		}
+		// size is taken from the opened file, so it's consistent with the content even if the file is replaced
+		fi, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, nil, err
+		}
+		return f, fi, nil
+	}
+	return nil, nil, os.ErrNotExist
+}
+
+// readMetric reads header of the metric and, if f is not nil, calls it with the opened file
+func (c *WhisperGroup) readMetric(ctx context.Context, name string, f func(*os.File, *header) merry.Error) (*header, merry.Error) {
+	if err := c.limiter.Enter(ctx, c.groupName); err != nil {
+		return nil, types.ErrTimeoutExceeded.WithCause(err)
+	}
+	defer c.limiter.Leave(ctx, c.groupName)
+
+	file, fi, err := c.open(name)
+	if err != nil {
+		return nil, merry.Wrap(err).WithValue("metric", name)
+	}
+	defer file.Close()
+
+	h, e := readHeader(file, fi.Size())
+	if e != nil {
+		return nil, e.WithValue("metric", name)
+	}
+	if f != nil {
+		if e = f(file, h); e != nil {
+			return nil, e.WithValue("metric", name)
+		}
+	}
+	return h, nil
+}
+
+func (c *WhisperGroup) Fetch(ctx context.Context, request *protov3.MultiFetchRequest) (*protov3.MultiFetchResponse, *types.Stats, merry.Error) {
+	logger := c.logger.With(zap.String("type", "fetch"), zap.String("request", request.String()))
+	stats := &types.Stats{}
+	now := c.now().Unix()
+
+	var r protov3.MultiFetchResponse
+	var e merry.Error
+	for _, m := range request.Metrics {
+		stats.RenderRequests++
+		for _, name := range c.metrics(m.Name) {
+			var s *series
+			h, err := c.readMetric(ctx, name, func(f *os.File, h *header) merry.Error {
+				var err merry.Error
+				s, err = h.fetch(f, m.StartTime, m.StopTime, now)
+				return err
+			})
+			if err != nil {
+				if merry.Is(err, fs.ErrNotExist) {
+					// metric is absent or it was removed after find
+					continue
+				}
+				stats.RenderErrors++
+				if merry.Is(err, types.ErrTimeoutExceeded) {
+					stats.Timeouts++
+					stats.RenderTimeouts++
+				}
+				logger.Warn("failed to read whisper file",
+					zap.String("metric", name),
+					zap.Error(err),
+				)
+				if e == nil {
+					e = err
+				} else {
+					e = e.WithCause(err)
+				}
+				continue
+			}
+			if s == nil {
+				continue
+			}
+			r.Metrics = append(r.Metrics, protov3.FetchResponse{
+				Name:              name,
+				PathExpression:    m.PathExpression,
+				ConsolidationFunc: h.aggregation,
+				StartTime:         s.start,
+				StopTime:          s.stop,
+				StepTime:          s.step,
+				XFilesFactor:      h.xFilesFactor,
+				Values:            s.values,
+				RequestStartTime:  m.StartTime,
+				RequestStopTime:   m.StopTime,
+			})
+		}
+	}
+
+	if e != nil && len(r.Metrics) == 0 {
+		stats.FailedServers = []string{c.groupName}
+		return nil, stats, e
+	}
+	return &r, stats, nil
+}
+
+func (c *WhisperGroup) Find(ctx context.Context, request *protov3.MultiGlobRequest) (*protov3.MultiGlobResponse, *types.Stats, merry.Error) {
+	stats := &types.Stats{}
+
+	r := protov3.MultiGlobResponse{
+		Metrics: make([]protov3.GlobResponse, 0, len(request.Metrics)),
+	}
+	for _, query := range request.Metrics {
+		stats.FindRequests++
+		matches := c.glob(query)
+		if matches == nil {
+			matches = make([]protov3.GlobMatch, 0)
+		}
+		r.Metrics = append(r.Metrics, protov3.GlobResponse{
+			Name:    query,
+			Matches: matches,
+		})
+	}
+	return &r, stats, nil
+}
+
+func (c *WhisperGroup) Info(ctx context.Context, request *protov3.MultiMetricsInfoRequest) (*protov3.ZipperInfoResponse, *types.Stats, merry.Error) {
+	logger := c.logger.With(zap.String("type", "info"), zap.Strings("request", request.Names))
+	stats := &types.Stats{}
+
+	var infos protov3.MultiMetricsInfoResponse
+	var e merry.Error
+	for _, query := range request.Names {
+		stats.InfoRequests++
+		for _, name := range c.metrics(query) {
+			h, err := c.readMetric(ctx, name, nil)
+			if err != nil {
+				if merry.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				stats.InfoErrors++
+				logger.Warn("failed to read whisper file",
+					zap.String("metric", name),
+					zap.Error(err),
+				)
+				if e == nil {
+					e = err
+				} else {
+					e = e.WithCause(err)
+				}
+				continue
+			}
+
+			info := protov3.MetricsInfoResponse{
+				Name:              name,
+				ConsolidationFunc: h.aggregation,
+				XFilesFactor:      h.xFilesFactor,
+				MaxRetention:      h.maxRetention,
+				Retentions:        make([]protov3.Retention, 0, len(h.archives)),
+			}
+			for _, a := range h.archives {
+				info.Retentions = append(info.Retentions, protov3.Retention{
+					SecondsPerPoint: a.secondsPerPoint,
+					NumberOfPoints:  a.points,
+				})
+			}
+			infos.Metrics = append(infos.Metrics, info)
+		}
+	}
+
+	if e != nil && len(infos.Metrics) == 0 {
+		stats.FailedServers = []string{c.groupName}
+		return nil, stats, e
+	}
+	stats.MemoryUsage = int64(infos.Size())
+
+	r := &protov3.ZipperInfoResponse{
+		Info: map[string]protov3.MultiMetricsInfoResponse{
+			c.Name(): infos,
+		},
+	}
+	return r, stats, nil
+}
+
+// eachMetric calls f for every whisper file in data directories, metrics, that are in several of them, are reported once
+func (c *WhisperGroup) eachMetric(ctx context.Context, f func(name string, fi os.FileInfo)) merry.Error {
+	seen := make(map[string]struct{})
+	for _, root := range c.roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if err != nil {
+				// directory may be removed while it's walked
+				return nil
+			}
+			if d.Type().IsRegular() && strings.HasSuffix(path, ".wsp") {
+				rel, err := filepath.Rel(root, strings.TrimSuffix(path, ".wsp"))
+				if err != nil {
+					return nil
+				}
+				name := strings.ReplaceAll(rel, string(filepath.Separator), ".")
+				if _, ok := seen[name]; ok {
+					return nil
+				}
+				fi, err := d.Info()
+				if err != nil {
+					return nil
+				}
+				seen[name] = struct{}{}
+				f(name, fi)
+			}
+			return nil
+		})
+		if err != nil {
+			return types.ErrTimeoutExceeded.WithCause(err)
+		}
+	}
+	return nil
+}
+
+func (c *WhisperGroup) List(ctx context.Context) (*protov3.ListMetricsResponse, *types.Stats, merry.Error) {
+	stats := &types.Stats{}
+	r := &protov3.ListMetricsResponse{}
+	err := c.eachMetric(ctx, func(name string, _ os.FileInfo) {
+		r.Metrics = append(r.Metrics, name)
+	})
+	if err != nil {
+		return nil, stats, err
+	}
+	sort.Strings(r.Metrics)
+	return r, stats, nil
+}
+
+func (c *WhisperGroup) Stats(ctx context.Context) (*protov3.MetricDetailsResponse, *types.Stats, merry.Error) {
+	stats := &types.Stats{}
+	r := &protov3.MetricDetailsResponse{
+		Metrics: make(map[string]*protov3.MetricDetails),
+	}
+	err := c.eachMetric(ctx, func(name string, fi os.FileInfo) {
+		realSize, atime := fileUsage(fi)
+		r.Metrics[name] = &protov3.MetricDetails{
+			Size_:    fi.Size(),
+			ModTime:  fi.ModTime().Unix(),
+			ATime:    atime,
+			RealSize: realSize,
+		}
+	})
+	if err != nil {
+		return nil, stats, err
+	}
+	if len(c.roots) > 0 {
+		r.FreeSpace, r.TotalSpace = diskSpace(c.roots[0])
+	}
+	return r, stats, nil
+}
+
+func (c *WhisperGroup) ProbeTLDs(ctx context.Context) ([]string, merry.Error) {
+	var tlds []string
+	for _, m := range c.glob("*") {
+		tlds = append(tlds, m.Path)
+	}
+	return tlds, nil
+}
+
+// TagNames returns nothing, whisper files have no tags
+func (c *WhisperGroup) TagNames(ctx context.Context, query string, limit int64) ([]string, merry.Error) {
+	return []string{}, nil
+}
+
+// TagValues returns nothing, whisper files have no tags
+func (c *WhisperGroup) TagValues(ctx context.Context, query string, limit int64) ([]string, merry.Error) {
+	return []string{}, nil
+}
@@ -0,0 +1,334 @@
+package whisper
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ansel1/merry"
+	protov3 "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"go.uber.org/zap"
+
+	"github.com/go-graphite/carbonapi/zipper/types"
+)
+
+// now is aligned to both test retentions
+const now = int64(1699999800)
+
+type testArchive struct {
+	secondsPerPoint int64
+	points          int64
+	// values by timestamps
+	values map[int64]float64
+}
+
+// writeWhisper creates whisper file, the first written point of every archive is in its first slot
+func writeWhisper(t *testing.T, path string, aggregation uint32, xff float32, archives []testArchive) {
+	t.Helper()
+	headerSize := int64(metadataSize + archiveInfoSize*len(archives))
+	size := headerSize
+	for _, a := range archives {
+		size += a.points * pointSize
+	}
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf, aggregation)
+	last := archives[len(archives)-1]
+	binary.BigEndian.PutUint32(buf[4:], uint32(last.secondsPerPoint*last.points))
+	binary.BigEndian.PutUint32(buf[8:], math.Float32bits(xff))
+	binary.BigEndian.PutUint32(buf[12:], uint32(len(archives)))
+
+	offset := headerSize
+	for i, a := range archives {
+		binary.BigEndian.PutUint32(buf[metadataSize+i*archiveInfoSize:], uint32(offset))
+		binary.BigEndian.PutUint32(buf[metadataSize+i*archiveInfoSize+4:], uint32(a.secondsPerPoint))
+		binary.BigEndian.PutUint32(buf[metadataSize+i*archiveInfoSize+8:], uint32(a.points))
+
+		base := int64(-1)
+		for ts := range a.values {
+			if base == -1 || ts < base {
+				base = ts
+			}
+		}
+		for ts, v := range a.values {
+			slot := ((ts-base)/a.secondsPerPoint%a.points + a.points) % a.points
+			binary.BigEndian.PutUint32(buf[offset+slot*pointSize:], uint32(ts))
+			binary.BigEndian.PutUint64(buf[offset+slot*pointSize+4:], math.Float64bits(v))
+		}
+		offset += a.points * pointSize
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testArchives returns an hour of minutely points with values 0..59 and a day of 5-minutely points with values 1000+
+func testArchives() []testArchive {
+	minutely := testArchive{secondsPerPoint: 60, points: 60, values: make(map[int64]float64)}
+	for i := int64(0); i < 60; i++ {
+		minutely.values[now-3540+i*60] = float64(i)
+	}
+	// the point is missing
+	delete(minutely.values, now-120)
+
+	fiveMinutely := testArchive{secondsPerPoint: 300, points: 288, values: make(map[int64]float64)}
+	for i := int64(0); i < 288; i++ {
+		fiveMinutely.values[now-86100+i*300] = float64(1000 + i)
+	}
+	return []testArchive{minutely, fiveMinutely}
+}
+
+func newTestGroup(t *testing.T, dirs ...string) *WhisperGroup {
+	t.Helper()
+	limit, batch := 10, 100
+	b, err := New(zap.NewNop(), types.BackendV2{
+		GroupName:        "whisper",
+		Protocol:         "whisper",
+		Servers:          dirs,
+		ConcurrencyLimit: &limit,
+		MaxBatchSize:     &batch,
+	}, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := b.(*WhisperGroup)
+	g.now = func() time.Time { return time.Unix(now, 0) }
+	return g
+}
+
+func metricFile(dir, name string) string {
+	return filepath.Join(dir, strings.ReplaceAll(name, ".", "/")+".wsp")
+}
+
+func TestWhisperFind(t *testing.T) {
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	for _, name := range []string{"a.b.c", "a.b.d", "a.e", "z"} {
+		writeWhisper(t, metricFile(dir1, name), 1, 0.5, testArchives())
+	}
+	writeWhisper(t, metricFile(dir2, "a.b.f"), 1, 0.5, testArchives())
+	if err := os.MkdirAll(filepath.Join(dir1, "a", "b2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir1, "a", "b", "notes.txt"), []byte("not a metric"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g := newTestGroup(t, dir1, "file://"+dir2)
+
+	tests := []struct {
+		query    string
+		expected []protov3.GlobMatch
+	}{
+		{query: "*", expected: []protov3.GlobMatch{{Path: "a"}, {Path: "z", IsLeaf: true}}},
+		{query: "a.*", expected: []protov3.GlobMatch{{Path: "a.b"}, {Path: "a.b2"}, {Path: "a.e", IsLeaf: true}}},
+		{query: "a.{b,e}", expected: []protov3.GlobMatch{{Path: "a.b"}, {Path: "a.e", IsLeaf: true}}},
+		{query: "a.b.*", expected: []protov3.GlobMatch{{Path: "a.b.c", IsLeaf: true}, {Path: "a.b.d", IsLeaf: true}, {Path: "a.b.f", IsLeaf: true}}},
+		{query: "a.b.[cf]", expected: []protov3.GlobMatch{{Path: "a.b.c", IsLeaf: true}, {Path: "a.b.f", IsLeaf: true}}},
+		{query: "*.b.?", expected: []protov3.GlobMatch{{Path: "a.b.c", IsLeaf: true}, {Path: "a.b.d", IsLeaf: true}, {Path: "a.b.f", IsLeaf: true}}},
+		{query: "a.b.c", expected: []protov3.GlobMatch{{Path: "a.b.c", IsLeaf: true}}},
+		{query: "a.b.notes", expected: []protov3.GlobMatch{}},
+		{query: "a..b", expected: []protov3.GlobMatch{}},
+		{query: "missing.*", expected: []protov3.GlobMatch{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			res, _, err := g.Find(context.Background(), &protov3.MultiGlobRequest{Metrics: []string{tt.query}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Metrics) != 1 || res.Metrics[0].Name != tt.query {
+				t.Fatalf("unexpected response: %+v", res)
+			}
+			if !reflect.DeepEqual(res.Metrics[0].Matches, tt.expected) {
+				t.Fatalf("got %+v, expected %+v", res.Metrics[0].Matches, tt.expected)
+			}
+		})
+	}
+
+	tlds, err := g.ProbeTLDs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tlds, []string{"a", "z"}) {
+		t.Fatalf("unexpected TLDs: %v", tlds)
+	}
+}
+
+func TestWhisperFetch(t *testing.T) {
+	dir := t.TempDir()
+	writeWhisper(t, metricFile(dir, "a.b.c"), 4, 0.3, testArchives())
+	writeWhisper(t, metricFile(dir, "a.b.d"), 4, 0.3, testArchives())
+	g := newTestGroup(t, dir)
+
+	fetch := func(name string, from, until int64) []protov3.FetchResponse {
+		t.Helper()
+		res, _, err := g.Fetch(context.Background(), &protov3.MultiFetchRequest{Metrics: []protov3.FetchRequest{
+			{Name: name, PathExpression: name, StartTime: from, StopTime: until},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Metrics
+	}
+
+	// the last 10 minutes are in the minutely archive
+	res := fetch("a.b.c", now-600, now)
+	if len(res) != 1 {
+		t.Fatalf("unexpected count of metrics: %d", len(res))
+	}
+	m := res[0]
+	if m.Name != "a.b.c" || m.StepTime != 60 || m.StartTime != now-540 || m.StopTime != now+60 || m.ConsolidationFunc != "max" || m.XFilesFactor != 0.3 {
+		t.Fatalf("unexpected metric: %+v", m)
+	}
+	expected := []float64{50, 51, 52, 53, 54, 55, 56, math.NaN(), 58, 59}
+	if !equalValues(m.Values, expected) {
+		t.Fatalf("got values %v, expected %v", m.Values, expected)
+	}
+
+	// 2 hours are only in the 5-minutely archive
+	res = fetch("a.b.c", now-7200, now-6000)
+	if len(res) != 1 {
+		t.Fatalf("unexpected count of metrics: %d", len(res))
+	}
+	m = res[0]
+	if m.StepTime != 300 || m.StartTime != now-6900 || m.StopTime != now-5700 {
+		t.Fatalf("unexpected metric: %+v", m)
+	}
+	expected = []float64{1264, 1265, 1266, 1267}
+	if !equalValues(m.Values, expected) {
+		t.Fatalf("got values %v, expected %v", m.Values, expected)
+	}
+
+	// out of retention
+	if res = fetch("a.b.c", now-200000, now-100000); len(res) != 0 {
+		t.Fatalf("unexpected metrics out of retention: %+v", res)
+	}
+
+	// globs are expanded
+	res = fetch("a.b.*", now-600, now)
+	if len(res) != 2 || res[0].Name != "a.b.c" || res[1].Name != "a.b.d" || res[1].PathExpression != "a.b.*" {
+		t.Fatalf("unexpected metrics of glob: %+v", res)
+	}
+}
+
+func TestWhisperInfoListStats(t *testing.T) {
+	dir := t.TempDir()
+	writeWhisper(t, metricFile(dir, "a.b.c"), 2, 0.5, testArchives())
+	writeWhisper(t, metricFile(dir, "a.d"), 3, 0, testArchives()[:1])
+	g := newTestGroup(t, dir)
+
+	res, _, err := g.Info(context.Background(), &protov3.MultiMetricsInfoRequest{Names: []string{"a.b.c", "a.d", "a.missing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []protov3.MetricsInfoResponse{
+		{
+			Name:              "a.b.c",
+			ConsolidationFunc: "sum",
+			XFilesFactor:      0.5,
+			MaxRetention:      86400,
+			Retentions:        []protov3.Retention{{SecondsPerPoint: 60, NumberOfPoints: 60}, {SecondsPerPoint: 300, NumberOfPoints: 288}},
+		},
+		{
+			Name:              "a.d",
+			ConsolidationFunc: "last",
+			MaxRetention:      3600,
+			Retentions:        []protov3.Retention{{SecondsPerPoint: 60, NumberOfPoints: 60}},
+		},
+	}
+	if !reflect.DeepEqual(res.Info["whisper"].Metrics, expected) {
+		t.Fatalf("got info %+v, expected %+v", res.Info["whisper"].Metrics, expected)
+	}
+
+	list, _, err := g.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list.Metrics, []string{"a.b.c", "a.d"}) {
+		t.Fatalf("unexpected list of metrics: %v", list.Metrics)
+	}
+
+	stats, _, err := g.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Metrics) != 2 || stats.Metrics["a.b.c"].Size_ != 16+24+(60+288)*12 || stats.Metrics["a.d"].ModTime == 0 {
+		t.Fatalf("unexpected stats: %+v", stats.Metrics)
+	}
+}
+
+// Files may be replaced (e.g. resized), truncated or removed, while carbonapi reads them
+func TestWhisperRotation(t *testing.T) {
+	dir := t.TempDir()
+	writeWhisper(t, metricFile(dir, "a.b"), 1, 0.5, testArchives())
+	writeWhisper(t, metricFile(dir, "a.c"), 1, 0.5, testArchives())
+	g := newTestGroup(t, dir)
+
+	// file is replaced by a resized one
+	tmp := filepath.Join(dir, "resized.tmp")
+	writeWhisper(t, tmp, 1, 0.5, testArchives()[1:])
+	if err := os.Rename(tmp, metricFile(dir, "a.b")); err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := g.Fetch(context.Background(), &protov3.MultiFetchRequest{Metrics: []protov3.FetchRequest{
+		{Name: "a.b", PathExpression: "a.b", StartTime: now - 600, StopTime: now},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Metrics) != 1 || res.Metrics[0].StepTime != 300 {
+		t.Fatalf("resized file is not read: %+v", res.Metrics)
+	}
+
+	// truncated file is reported as an error, other metrics are still returned
+	if err := os.Truncate(metricFile(dir, "a.b"), 100); err != nil {
+		t.Fatal(err)
+	}
+	request := &protov3.MultiFetchRequest{Metrics: []protov3.FetchRequest{
+		{Name: "a.*", PathExpression: "a.*", StartTime: now - 600, StopTime: now},
+	}}
+	res, stats, err := g.Fetch(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Metrics) != 1 || res.Metrics[0].Name != "a.c" || stats.RenderErrors != 1 {
+		t.Fatalf("unexpected response with truncated file: %+v, %+v", res.Metrics, stats)
+	}
+	if err := os.Remove(metricFile(dir, "a.c")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = g.Fetch(context.Background(), request); !merry.Is(err, ErrCorrupted) {
+		t.Fatalf("expected error for truncated file, got %v", err)
+	}
+
+	// removed file is not an error
+	if err := os.Remove(metricFile(dir, "a.b")); err != nil {
+		t.Fatal(err)
+	}
+	res, stats, err = g.Fetch(context.Background(), &protov3.MultiFetchRequest{Metrics: []protov3.FetchRequest{
+		{Name: "a.b", PathExpression: "a.b", StartTime: now - 600, StopTime: now},
+	}})
+	if err != nil || len(res.Metrics) != 0 || stats.RenderErrors != 0 {
+		t.Fatalf("unexpected response for removed file: %+v, %+v, %v", res, stats, err)
+	}
+}
+
+func equalValues(got, expected []float64) bool {
+	if len(got) != len(expected) {
+		return false
+	}
+	for i := range got {
+		if got[i] != expected[i] && !(math.IsNaN(got[i]) && math.IsNaN(expected[i])) {
+			return false
+		}
+	}
+	return true
+}
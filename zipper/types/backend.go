@@ -14,12 +14,18 @@ type BackendsV2 struct {
 	KeepAliveInterval         time.Duration `mapstructure:"keepAliveInterval"`
 	MaxTries                  int           `mapstructure:"maxTries"`
 	MaxBatchSize              *int          `mapstructure:"maxBatchSize"`
+	// CircuitBreaker ejects failing servers of broadcast groups
+	CircuitBreaker CircuitBreaker `mapstructure:"circuitBreaker"`
+	// Hedging sends slow requests of rr and least_loaded groups to a second server
+	Hedging Hedging `mapstructure:"hedging"`
 }
 
 type BackendV2 struct {
 	GroupName                 string                 `mapstructure:"groupName"`
 	Protocol                  string                 `mapstructure:"protocol"`
-	LBMethod                  string                 `mapstructure:"lbMethod"` // Valid: rr/roundrobin, broadcast/all
+	LBMethod                  string                 `mapstructure:"lbMethod"`            // Valid: rr/roundrobin, least_loaded, broadcast/all, carbon_ch, fnv1a_ch, jump_fnv1a_ch
+	ReplicationFactor         int                    `mapstructure:"replicationFactor"`   // for consistent hashing lbMethods
+	ConsistentHashNodes       []string               `mapstructure:"consistentHashNodes"` // carbon-c-relay destinations (host[:port][=instance]) of servers, in the same order
 	Servers                   []string               `mapstructure:"servers"`
 	Timeouts                  *Timeouts              `mapstructure:"timeouts"`
 	ConcurrencyLimit          *int                   `mapstructure:"concurrencyLimit"`
@@ -32,6 +38,10 @@ type BackendV2 struct {
 	DoMultipleRequestsIfSplit bool                   `mapstructure:"doMultipleRequestsIfSplit"`
 	IdleConnectionTimeout     *time.Duration         `mapstructure:"idleConnectionTimeout"`
 	TLSClientConfig           *tlsconfig.TLSConfig   `mapstructure:"tlsClientConfig"`
+	// CircuitBreaker overrides global circuit breaker configuration for this backend group
+	CircuitBreaker *CircuitBreaker `mapstructure:"circuitBreaker"`
+	// Hedging overrides global hedging configuration for this backend group
+	Hedging *Hedging `mapstructure:"hedging"`
 }
 
 func (b *BackendV2) FillDefaults() {
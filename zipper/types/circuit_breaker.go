@@ -0,0 +1,42 @@
+package types
+
+import (
+	"time"
+)
+
+// CircuitBreaker is a configuration of per-server circuit breakers in broadcast groups
+type CircuitBreaker struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Window is a time, error rate and latency are measured over
+	Window time.Duration `mapstructure:"window"`
+	// MinRequests is a minimum count of requests in the window, before server can be ejected
+	MinRequests int `mapstructure:"minRequests"`
+	// ErrorRate is a share of failed requests (timeouts and 5xx errors), that ejects server
+	ErrorRate float64 `mapstructure:"errorRate"`
+	// Latency is an average latency, that ejects server, 0 disables the check
+	Latency time.Duration `mapstructure:"latency"`
+	// EjectTime is a time, ejected server doesn't get requests, before trial requests are sent to it
+	EjectTime time.Duration `mapstructure:"ejectTime"`
+	// HalfOpenRequests is a count of successful trial requests, that readmits server
+	HalfOpenRequests int `mapstructure:"halfOpenRequests"`
+}
+
+// WithDefaults returns configuration with default values instead of unset ones
+func (c CircuitBreaker) WithDefaults() CircuitBreaker {
+	if c.Window <= 0 {
+		c.Window = 30 * time.Second
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = 20
+	}
+	if c.ErrorRate <= 0 {
+		c.ErrorRate = 0.5
+	}
+	if c.EjectTime <= 0 {
+		c.EjectTime = 30 * time.Second
+	}
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = 3
+	}
+	return c
+}
@@ -11,6 +11,7 @@ import (
 var EmptyMsg = &empty.Empty{}
 
 var ErrResponseTypeMismatch = merry.New("type for the response doesn't match what's expected")
+var ErrResponseTooLarge = merry.New("response is too large")
 var ErrResponseLengthMismatch = merry.New("response length mismatch")
 var ErrResponseStartTimeMismatch = merry.New("response start time mismatch")
 var ErrResponseStepTimeMismatch = merry.New("response step time mismatch")
@@ -32,6 +33,7 @@ var ErrConcurrencyLimitNotSet = merry.New("concurrency limit is not set")
 var ErrUnmarshalFailed = merry.New("unmarshal failed")
 var ErrBackendError = merry.New("error fetching data from backend").WithHTTPCode(http.StatusServiceUnavailable)
 var ErrResponceError = merry.New("error while fetching Response")
+var ErrServerEjected = merry.New("server is ejected by circuit breaker").WithHTTPCode(http.StatusServiceUnavailable)
 
 func ReturnNonNotFoundError(errors []merry.Error) []merry.Error {
 	var errList []merry.Error
@@ -0,0 +1,29 @@
+package types
+
+import (
+	"time"
+)
+
+// Hedging is a configuration of hedged requests in groups of replicas
+type Hedging struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Percentile of latencies of recent requests, after which the same request is sent to a second server
+	Percentile float64 `mapstructure:"percentile"`
+	// MinDelay and MaxDelay limit the delay before hedged request. MaxDelay is used until latencies are known.
+	MinDelay time.Duration `mapstructure:"minDelay"`
+	MaxDelay time.Duration `mapstructure:"maxDelay"`
+}
+
+// WithDefaults returns configuration with default values instead of unset ones
+func (h Hedging) WithDefaults() Hedging {
+	if h.Percentile <= 0 || h.Percentile >= 100 {
+		h.Percentile = 95
+	}
+	if h.MaxDelay <= 0 {
+		h.MaxDelay = time.Second
+	}
+	if h.MinDelay > h.MaxDelay {
+		h.MinDelay = h.MaxDelay
+	}
+	return h
+}
@@ -12,6 +12,13 @@ type Request interface {
 	LogInfo() interface{}
 }
 
+// HTTPRequest is a Request, that must be sent with specific http method and headers (GET is used otherwise)
+type HTTPRequest interface {
+	Request
+	Method() string
+	Headers() map[string]string
+}
+
 type BackendServer interface {
 	Name() string
 	Backends() []string
@@ -31,3 +38,25 @@ type BackendServer interface {
 
 	Children() []BackendServer
 }
+
+// Route describes servers, that will receive a fetch request
+type Route struct {
+	Group   string   `json:"group"`
+	Servers []string `json:"servers"`
+	// Cached is set, if children were chosen by the internal routing (TLD) cache
+	Cached   bool    `json:"cached,omitempty"`
+	Children []Route `json:"children,omitempty"`
+}
+
+// Router is implemented by backend groups, that can tell where a request will be sent without sending it
+type Router interface {
+	Route(requests []string) Route
+}
+
+// RouteOf returns route of the request for the backend
+func RouteOf(backend BackendServer, requests []string) Route {
+	if router, ok := backend.(Router); ok {
+		return router.Route(requests)
+	}
+	return Route{Group: backend.Name(), Servers: backend.Backends()}
+}
@@ -13,6 +13,12 @@ type LBMethod int
 const (
 	RoundRobinLB LBMethod = iota
 	BroadcastLB
+	// CarbonCHLB, FNV1aCHLB and JumpFNV1aCHLB send fetches only to servers, that own metrics in carbon-c-relay cluster
+	CarbonCHLB
+	FNV1aCHLB
+	JumpFNV1aCHLB
+	// LeastLoadedLB sends request to the server of the group with the fewest in-flight requests
+	LeastLoadedLB
 )
 
 func (p LBMethod) keys(m map[string]LBMethod) []string {
@@ -29,6 +35,22 @@ var supportedLBMethods = map[string]LBMethod{
 	"any":        RoundRobinLB,
 	"broadcast":  BroadcastLB,
 	"all":        BroadcastLB,
+
+	"carbon_ch":     CarbonCHLB,
+	"fnv1a_ch":      FNV1aCHLB,
+	"jump_fnv1a_ch": JumpFNV1aCHLB,
+
+	"least_loaded": LeastLoadedLB,
+}
+
+// IsConsistentHash returns true for methods, that place metrics on servers by consistent hashing
+func (m LBMethod) IsConsistentHash() bool {
+	return m == CarbonCHLB || m == FNV1aCHLB || m == JumpFNV1aCHLB
+}
+
+// IsReplicaGroup returns true for methods, that send every request to a single server of the group
+func (m LBMethod) IsReplicaGroup() bool {
+	return m == RoundRobinLB || m == LeastLoadedLB
 }
 
 func (m *LBMethod) FromString(method string) error {
@@ -60,6 +82,14 @@ func (m LBMethod) MarshalJSON() ([]byte, error) {
 		return json.Marshal("RoundRobin")
 	case BroadcastLB:
 		return json.Marshal("Broadcast")
+	case CarbonCHLB:
+		return json.Marshal("CarbonCH")
+	case FNV1aCHLB:
+		return json.Marshal("FNV1aCH")
+	case JumpFNV1aCHLB:
+		return json.Marshal("JumpFNV1aCH")
+	case LeastLoadedLB:
+		return json.Marshal("LeastLoaded")
 	}
 
 	return nil, fmt.Errorf(ErrUnknownLBMethodFmt, m, m.keys(supportedLBMethods))
@@ -23,8 +23,26 @@ type Stats struct {
 	CacheMisses uint64
 	CacheHits   uint64
 
-	Servers       []string
-	FailedServers []string
+	// CoalesceHits is amount of requests, that got the result of identical in-flight request
+	CoalesceHits uint64
+	// CoalesceMisses is amount of coalesced requests, that were sent to backends
+	CoalesceMisses uint64
+
+	// FetchCacheHits and FetchCacheMisses count time chunks of fetched series, taken from the cache or fetched from backends
+	FetchCacheHits   uint64
+	FetchCacheMisses uint64
+
+	// EjectedRequests is amount of requests, that were not sent to servers, ejected by circuit breakers
+	EjectedRequests uint64
+
+	// HedgedRequests is amount of requests, that were sent to a second server, because the first one was slow.
+	// HedgeWins is amount of them, that got the response from the second server first.
+	HedgedRequests uint64
+	HedgeWins      uint64
+
+	Servers        []string
+	FailedServers  []string
+	EjectedServers []string
 }
 
 func (s *Stats) Merge(stats *Stats) {
@@ -44,7 +62,15 @@ func (s *Stats) Merge(stats *Stats) {
 	s.MemoryUsage += stats.MemoryUsage
 	s.CacheMisses += stats.CacheMisses
 	s.CacheHits += stats.CacheHits
+	s.CoalesceHits += stats.CoalesceHits
+	s.CoalesceMisses += stats.CoalesceMisses
+	s.FetchCacheHits += stats.FetchCacheHits
+	s.FetchCacheMisses += stats.FetchCacheMisses
+	s.EjectedRequests += stats.EjectedRequests
+	s.HedgedRequests += stats.HedgedRequests
+	s.HedgeWins += stats.HedgeWins
 
 	s.Servers = append(s.Servers, stats.Servers...)
 	s.FailedServers = append(s.FailedServers, stats.FailedServers...)
+	s.EjectedServers = append(s.EjectedServers, stats.EjectedServers...)
 }
@@ -12,17 +12,22 @@ import (
 	utilctx "github.com/go-graphite/carbonapi/util/ctx"
 	"github.com/go-graphite/carbonapi/zipper/broadcast"
 	"github.com/go-graphite/carbonapi/zipper/config"
+	"github.com/go-graphite/carbonapi/zipper/fetchcache"
 	"github.com/go-graphite/carbonapi/zipper/helper"
 	"github.com/go-graphite/carbonapi/zipper/metadata"
 	"github.com/go-graphite/carbonapi/zipper/types"
 
 	_ "github.com/go-graphite/carbonapi/zipper/protocols/auto"
 	_ "github.com/go-graphite/carbonapi/zipper/protocols/graphite"
+	_ "github.com/go-graphite/carbonapi/zipper/protocols/influxdb"
 	_ "github.com/go-graphite/carbonapi/zipper/protocols/irondb"
+	_ "github.com/go-graphite/carbonapi/zipper/protocols/opentsdb"
 	_ "github.com/go-graphite/carbonapi/zipper/protocols/prometheus"
+	_ "github.com/go-graphite/carbonapi/zipper/protocols/remoteread"
 	_ "github.com/go-graphite/carbonapi/zipper/protocols/v2"
 	_ "github.com/go-graphite/carbonapi/zipper/protocols/v3"
 	_ "github.com/go-graphite/carbonapi/zipper/protocols/victoriametrics"
+	_ "github.com/go-graphite/carbonapi/zipper/protocols/whisper"
 )
 
 // Zipper provides interface to Zipper-related functions
@@ -43,6 +48,9 @@ type Zipper struct {
 
 	sendStats func(*types.Stats)
 
+	// coalescer is nil, if identical requests are not coalesced
+	coalescer *coalescer
+
 	logger *zap.Logger
 }
 
@@ -56,6 +64,7 @@ func createBackendsV2(logger *zap.Logger, backends types.BackendsV2, expireDelay
 		maxIdleConnsPerHost := backends.MaxIdleConnsPerHost
 		keepAliveInterval := backends.KeepAliveInterval
 		maxBatchSize := backends.MaxBatchSize
+		hedging := backends.Hedging
 
 		if backend.Timeouts == nil {
 			backend.Timeouts = &timeouts
@@ -75,6 +84,9 @@ func createBackendsV2(logger *zap.Logger, backends types.BackendsV2, expireDelay
 		if backend.KeepAliveInterval == nil {
 			backend.KeepAliveInterval = &keepAliveInterval
 		}
+		if backend.Hedging == nil {
+			backend.Hedging = &hedging
+		}
 
 		var backendServer types.BackendServer
 		logger.Debug("creating lb group",
@@ -104,12 +116,24 @@ func createBackendsV2(logger *zap.Logger, backends types.BackendsV2, expireDelay
 		var lbMethod types.LBMethod
 		err := lbMethod.FromString(backend.LBMethod)
 		if err != nil {
-			logger.Fatal("failed to parse lbMethod",
+			logger.Error("failed to parse lbMethod",
 				zap.String("lbMethod", backend.LBMethod),
 				zap.Error(err),
 			)
+			return nil, merry.Wrap(err)
+		}
+		circuitBreaker := backends.CircuitBreaker
+		if backend.CircuitBreaker != nil {
+			circuitBreaker = *backend.CircuitBreaker
 		}
-		if lbMethod == types.RoundRobinLB {
+		if lbMethod.IsReplicaGroup() {
+			if circuitBreaker.Enabled {
+				// servers of replica group are picked by the protocol group for every request, so they can't be ejected
+				logger.Warn("circuit breaker is not supported for replica groups, use hedging instead",
+					zap.String("group", backend.GroupName),
+					zap.String("lbMethod", backend.LBMethod),
+				)
+			}
 			backendServer, e = backendInit(logger, backend, tldCacheDisabled, requireSuccessAll)
 			if e != nil {
 				return nil, e
@@ -128,12 +152,29 @@ func createBackendsV2(logger *zap.Logger, backends types.BackendsV2, expireDelay
 				backendServers = append(backendServers, backendServer)
 			}
 
-			backendServer, err = broadcast.NewBroadcastGroup(logger, backend.GroupName, backend.DoMultipleRequestsIfSplit, backendServers,
+			bg, e := broadcast.NewBroadcastGroup(logger, backend.GroupName, backend.DoMultipleRequestsIfSplit, backendServers,
 				expireDelaySec, *backend.ConcurrencyLimit, *backend.MaxBatchSize, timeouts, tldCacheDisabled, requireSuccessAll,
 			)
-			if err != nil {
-				return nil, merry.Wrap(err)
+			if e != nil {
+				return nil, e
 			}
+			if lbMethod.IsConsistentHash() {
+				nodes, err := broadcast.HashNodes(backend.Servers, backend.ConsistentHashNodes)
+				if err != nil {
+					return nil, merry.Prepend(err, backend.GroupName)
+				}
+				consistentHash, err := broadcast.NewConsistentHash(lbMethod, nodes, backend.ReplicationFactor)
+				if err != nil {
+					return nil, merry.Prepend(err, backend.GroupName)
+				}
+				if e = bg.SetConsistentHash(consistentHash); e != nil {
+					return nil, e.Prepend(backend.GroupName)
+				}
+			}
+			if circuitBreaker.Enabled {
+				bg.SetCircuitBreaker(circuitBreaker)
+			}
+			backendServer = bg
 		}
 		backendServers = append(backendServers, backendServer)
 	}
@@ -148,9 +189,19 @@ func NewZipper(sender func(*types.Stats), cfg *config.Config, logger *zap.Logger
 
 	backends, err := createBackendsV2(logger, cfg.BackendsV2, int32(cfg.InternalRoutingCache.Seconds()), cfg.TLDCacheDisabled, cfg.RequireSuccessAll)
 	if err != nil {
-		logger.Fatal("errors while initialing zipper store backend",
+		logger.Error("errors while initialing zipper store backend",
 			zap.Any("error", err),
 		)
+		return nil, err
+	}
+
+	probeQuit := make(chan struct{})
+	if cfg.FetchCache.Enabled {
+		fetchCache := fetchcache.New(cfg.FetchCache)
+		go fetchCache.Cleaner(probeQuit)
+		for i := range backends {
+			backends[i] = fetchCache.Wrap(logger, backends[i])
+		}
 	}
 
 	logger.Error("DEBUG ERROR LOGGGGG", zap.Any("cfg", cfg))
@@ -158,13 +209,14 @@ func NewZipper(sender func(*types.Stats), cfg *config.Config, logger *zap.Logger
 		int32(cfg.InternalRoutingCache.Seconds()), cfg.ConcurrencyLimitPerServer, *cfg.MaxBatchSize, cfg.Timeouts, cfg.TLDCacheDisabled, cfg.RequireSuccessAll,
 	)
 	if err != nil {
-		logger.Fatal("error while initialing zipper store backend",
+		logger.Error("error while initialing zipper store backend",
 			zap.Any("error", err),
 		)
+		return nil, merry.Wrap(err)
 	}
 
 	z := &Zipper{
-		ProbeQuit:  make(chan struct{}),
+		ProbeQuit:  probeQuit,
 		ProbeForce: make(chan int),
 
 		ScaleToCommonStep: cfg.ScaleToCommonStep,
@@ -182,6 +234,10 @@ func NewZipper(sender func(*types.Stats), cfg *config.Config, logger *zap.Logger
 		zap.Any("config", cfg),
 	)
 
+	if cfg.CoalesceRequests {
+		z.coalescer = newCoalescer()
+	}
+
 	if !cfg.TLDCacheDisabled {
 		z.probeTicker = time.NewTicker(cfg.InternalRoutingCache)
 
@@ -192,6 +248,22 @@ func NewZipper(sender func(*types.Stats), cfg *config.Config, logger *zap.Logger
 	return z, nil
 }
 
+// Close stops background TLD probing and cleanup, path caches are removed from the registry. Zipper still can serve
+// requests after Close.
+func (z *Zipper) Close() {
+	if bg, ok := z.backend.(*broadcast.BroadcastGroup); ok {
+		bg.Close()
+	}
+	if z.ProbeQuit == nil {
+		return
+	}
+	select {
+	case <-z.ProbeQuit:
+	default:
+		close(z.ProbeQuit)
+	}
+}
+
 func (z *Zipper) doProbe(logger *zap.Logger) {
 	ctx := context.Background()
 
@@ -227,7 +299,10 @@ func (z *Zipper) probeTlds() {
 func (z Zipper) FetchProtoV3(ctx context.Context, request *protov3.MultiFetchRequest) (*protov3.MultiFetchResponse, *types.Stats, merry.Error) {
 	logger := z.logger.With(zap.String("function", "FetchProtoV3"), zap.String("carbonapi_uuid", utilctx.GetUUID(ctx)))
 
-	res, stats, e := z.backend.Fetch(ctx, request)
+	r, stats, e := z.coalescer.do(ctx, "fetch", request, func() (interface{}, *types.Stats, merry.Error) {
+		return z.backend.Fetch(ctx, request)
+	}, cloneFetchResponse, chargeFetch)
+	res, _ := r.(*protov3.MultiFetchResponse)
 
 	if e != nil {
 		logger.Debug("had errors while fetching result",
@@ -251,7 +326,10 @@ func (z Zipper) FetchProtoV3(ctx context.Context, request *protov3.MultiFetchReq
 func (z Zipper) FindProtoV3(ctx context.Context, request *protov3.MultiGlobRequest) (*protov3.MultiGlobResponse, *types.Stats, merry.Error) {
 	logger := z.logger.With(zap.String("function", "FindProtoV3"), zap.String("carbonapi_uuid", utilctx.GetUUID(ctx)))
 
-	res, stats, err := z.backend.Find(ctx, request)
+	r, stats, err := z.coalescer.do(ctx, "find", request, func() (interface{}, *types.Stats, merry.Error) {
+		return z.backend.Find(ctx, request)
+	}, cloneFindResponse, nil)
+	res, _ := r.(*protov3.MultiGlobResponse)
 
 	var errs []merry.Error
 	if err != nil {
@@ -376,3 +454,8 @@ func (z Zipper) TagValues(ctx context.Context, query string, limit int64) ([]str
 
 	return data, nil
 }
+
+// Route returns backends, that will receive fetch request for the metrics, without sending it
+func (z Zipper) Route(metrics []string) types.Route {
+	return types.RouteOf(z.backend, metrics)
+}